@@ -0,0 +1,210 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Flusher can be implemented by plugins that keep cached data,
+// e.g. cache. It is called by the /api/cache/flush api.
+type Flusher interface {
+	Flush()
+}
+
+// DataReloader can be implemented by plugins that load data files,
+// e.g. domain_set. It is called by the /api/data/reload api.
+// The old data should be kept if ReloadData returns an error.
+type DataReloader interface {
+	ReloadData() error
+}
+
+// PluginInfo is an entry of the /api/plugins api.
+type PluginInfo struct {
+	Tag  string   `json:"tag"`
+	Type string   `json:"type"`
+	Deps []string `json:"deps,omitempty"`
+}
+
+// PluginInfos returns loaded plugins, sorted by tags.
+func (m *Mosdns) PluginInfos() []PluginInfo {
+	l := make([]PluginInfo, 0, len(m.plugins))
+	for tag := range m.plugins {
+		typ := m.pluginTypes[tag]
+		if len(typ) == 0 {
+			typ = "preset"
+		}
+		l = append(l, PluginInfo{Tag: tag, Type: typ, Deps: m.pluginDeps[tag]})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Tag < l[j].Tag })
+	return l
+}
+
+func (m *Mosdns) pluginsApiHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(m.PluginInfos())
+}
+
+// configApiHandler writes the main config in yaml. Included configs are
+// not merged. Values of keys that look like credentials are redacted,
+// other decrypted secrets are not.
+func (m *Mosdns) configApiHandler(w http.ResponseWriter, _ *http.Request) {
+	if m.cfg == nil {
+		http.Error(w, "config is not available", http.StatusNotFound)
+		return
+	}
+	b, err := yaml.Marshal(m.cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var v any
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err = yaml.Marshal(redactCredentials(v))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(b)
+}
+
+// credentialKeyParts are substrings of config or api keys whose values
+// are credentials.
+var credentialKeyParts = [...]string{
+	"password", "passwd", "passphrase", "token", "secret", "credential",
+	"access_key", "private_key", "api_key", "psk",
+}
+
+// isCredentialKey reports whether values of config or api key k look like
+// credentials.
+func isCredentialKey(k string) bool {
+	lk := strings.ToLower(k)
+	for _, s := range credentialKeyParts {
+		if strings.Contains(lk, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactCredentials replaces values of credential keys in v. See
+// isCredentialKey. Non-string values of credential keys, e.g. token maps,
+// are replaced as a whole.
+func redactCredentials(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if e != nil && e != "" && isCredentialKey(k) {
+				v[k] = "<redacted>"
+				continue
+			}
+			v[k] = redactCredentials(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = redactCredentials(e)
+		}
+	}
+	return v
+}
+
+// flushApiHandler flushes the plugin of the "tag" query, or all Flusher
+// plugins if it's empty. Flushed tags are returned.
+func (m *Mosdns) flushApiHandler(w http.ResponseWriter, r *http.Request) {
+	var flushed []string
+	err := m.forEachPlugin(r.URL.Query().Get("tag"), func(tag string, p any) (bool, error) {
+		f, ok := p.(Flusher)
+		if ok {
+			f.Flush()
+			flushed = append(flushed, tag)
+		}
+		return ok, nil
+	})
+	writeAdminResult(w, flushed, err)
+}
+
+// reloadDataApiHandler reloads data files of the plugin of the "tag"
+// query, or all DataReloader plugins if it's empty. Reloaded tags are
+// returned. Plugins that failed keep their old data.
+func (m *Mosdns) reloadDataApiHandler(w http.ResponseWriter, r *http.Request) {
+	var reloaded []string
+	err := m.forEachPlugin(r.URL.Query().Get("tag"), func(tag string, p any) (bool, error) {
+		d, ok := p.(DataReloader)
+		if !ok {
+			return false, nil
+		}
+		if err := d.ReloadData(); err != nil {
+			return true, fmt.Errorf("failed to reload %s, %w", tag, err)
+		}
+		reloaded = append(reloaded, tag)
+		return true, nil
+	})
+	writeAdminResult(w, reloaded, err)
+}
+
+var errPluginNotSupported = errors.New("plugin does not exist or does not support this operation")
+
+// forEachPlugin calls f with plugin tag, or all plugins (sorted by tag)
+// if tag is empty. f returns whether the plugin supports the operation.
+// Errors of f are joined.
+func (m *Mosdns) forEachPlugin(tag string, f func(tag string, p any) (bool, error)) error {
+	if len(tag) > 0 {
+		ok, err := f(tag, m.plugins[tag])
+		if !ok {
+			return errPluginNotSupported
+		}
+		return err
+	}
+	var errs []error
+	for _, pi := range m.PluginInfos() {
+		if _, err := f(pi.Tag, m.plugins[pi.Tag]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func writeAdminResult(w http.ResponseWriter, tags []string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	res := struct {
+		Tags  []string `json:"tags"`
+		Error string   `json:"error,omitempty"`
+	}{Tags: tags}
+	switch {
+	case errors.Is(err, errPluginNotSupported):
+		w.WriteHeader(http.StatusNotFound)
+		res.Error = err.Error()
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		res.Error = err.Error()
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_redactCredentials(t *testing.T) {
+	v := map[string]any{
+		"log": map[string]any{"level": "info"},
+		"plugins": []any{
+			map[string]any{"args": map[string]any{
+				"access_key":  "ak",
+				"secret_key":  "sk",
+				"private_key": "pk",
+				"public_key":  "pub",
+				"key":         "/etc/tls.key",
+				"password":    "",
+				"auth":        map[string]any{"tokens": map[string]any{"t1": "lan"}},
+			}},
+		},
+	}
+	want := map[string]any{
+		"log": map[string]any{"level": "info"},
+		"plugins": []any{
+			map[string]any{"args": map[string]any{
+				"access_key":  "<redacted>",
+				"secret_key":  "<redacted>",
+				"private_key": "<redacted>",
+				"public_key":  "pub",
+				"key":         "/etc/tls.key",
+				"password":    "",
+				"auth":        map[string]any{"tokens": "<redacted>"},
+			}},
+		},
+	}
+	if got := redactCredentials(v); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
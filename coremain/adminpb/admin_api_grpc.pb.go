@@ -0,0 +1,655 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.27.1
+// source: admin_api.proto
+
+// Admin api of mosdns. It mirrors the http api, and is served if
+// "api.grpc" is set. Calls are authenticated with the "authorization"
+// metadata, which has the same format as the http header.
+//
+// Regenerate the go code with:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative admin_api.proto
+
+package adminpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Admin_TailAudit_FullMethodName       = "/mosdns.admin.v1.Admin/TailAudit"
+	Admin_ExportState_FullMethodName     = "/mosdns.admin.v1.Admin/ExportState"
+	Admin_ImportState_FullMethodName     = "/mosdns.admin.v1.Admin/ImportState"
+	Admin_Backup_FullMethodName          = "/mosdns.admin.v1.Admin/Backup"
+	Admin_Dump_FullMethodName            = "/mosdns.admin.v1.Admin/Dump"
+	Admin_GetReloadStatus_FullMethodName = "/mosdns.admin.v1.Admin/GetReloadStatus"
+	Admin_Reload_FullMethodName          = "/mosdns.admin.v1.Admin/Reload"
+	Admin_GetStatsTotals_FullMethodName  = "/mosdns.admin.v1.Admin/GetStatsTotals"
+	Admin_StreamQueryLog_FullMethodName  = "/mosdns.admin.v1.Admin/StreamQueryLog"
+	Admin_GetHitStats_FullMethodName     = "/mosdns.admin.v1.Admin/GetHitStats"
+	Admin_ListRules_FullMethodName       = "/mosdns.admin.v1.Admin/ListRules"
+	Admin_AddRule_FullMethodName         = "/mosdns.admin.v1.Admin/AddRule"
+	Admin_DeleteRule_FullMethodName      = "/mosdns.admin.v1.Admin/DeleteRule"
+	Admin_FlushCache_FullMethodName      = "/mosdns.admin.v1.Admin/FlushCache"
+)
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	// GET /api/audit?limit=N
+	TailAudit(ctx context.Context, in *TailAuditRequest, opts ...grpc.CallOption) (*TailAuditResponse, error)
+	// GET /api/state/export
+	ExportState(ctx context.Context, in *ExportStateRequest, opts ...grpc.CallOption) (*StateBundle, error)
+	// POST /api/state/import
+	ImportState(ctx context.Context, in *StateBundle, opts ...grpc.CallOption) (*ImportStateResponse, error)
+	// POST /api/backup
+	Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (*BackupResponse, error)
+	// GET /api/dump
+	Dump(ctx context.Context, in *DumpRequest, opts ...grpc.CallOption) (*DumpResponse, error)
+	// GET /api/reload
+	GetReloadStatus(ctx context.Context, in *GetReloadStatusRequest, opts ...grpc.CallOption) (*ReloadStatus, error)
+	// POST /api/reload
+	Reload(ctx context.Context, in *ReloadRequest, opts ...grpc.CallOption) (*ReloadResponse, error)
+	// GET /api/stats/totals
+	GetStatsTotals(ctx context.Context, in *GetStatsTotalsRequest, opts ...grpc.CallOption) (*StatsTotals, error)
+	// GET /api/log/stream?client=&domain=
+	StreamQueryLog(ctx context.Context, in *StreamQueryLogRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[QueryLogRecord], error)
+	// GET /plugins/<tag>/hits
+	GetHitStats(ctx context.Context, in *PluginRequest, opts ...grpc.CallOption) (*HitStats, error)
+	// GET /plugins/<tag>/rules
+	ListRules(ctx context.Context, in *PluginRequest, opts ...grpc.CallOption) (*ListRulesResponse, error)
+	// POST /plugins/<tag>/rules
+	AddRule(ctx context.Context, in *AddRuleRequest, opts ...grpc.CallOption) (*AddRuleResponse, error)
+	// DELETE /plugins/<tag>/rules?exp=
+	DeleteRule(ctx context.Context, in *DeleteRuleRequest, opts ...grpc.CallOption) (*DeleteRuleResponse, error)
+	// GET /plugins/<tag>/flush
+	FlushCache(ctx context.Context, in *PluginRequest, opts ...grpc.CallOption) (*FlushCacheResponse, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) TailAudit(ctx context.Context, in *TailAuditRequest, opts ...grpc.CallOption) (*TailAuditResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TailAuditResponse)
+	err := c.cc.Invoke(ctx, Admin_TailAudit_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ExportState(ctx context.Context, in *ExportStateRequest, opts ...grpc.CallOption) (*StateBundle, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StateBundle)
+	err := c.cc.Invoke(ctx, Admin_ExportState_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ImportState(ctx context.Context, in *StateBundle, opts ...grpc.CallOption) (*ImportStateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ImportStateResponse)
+	err := c.cc.Invoke(ctx, Admin_ImportState_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (*BackupResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BackupResponse)
+	err := c.cc.Invoke(ctx, Admin_Backup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Dump(ctx context.Context, in *DumpRequest, opts ...grpc.CallOption) (*DumpResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DumpResponse)
+	err := c.cc.Invoke(ctx, Admin_Dump_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetReloadStatus(ctx context.Context, in *GetReloadStatusRequest, opts ...grpc.CallOption) (*ReloadStatus, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReloadStatus)
+	err := c.cc.Invoke(ctx, Admin_GetReloadStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Reload(ctx context.Context, in *ReloadRequest, opts ...grpc.CallOption) (*ReloadResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReloadResponse)
+	err := c.cc.Invoke(ctx, Admin_Reload_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetStatsTotals(ctx context.Context, in *GetStatsTotalsRequest, opts ...grpc.CallOption) (*StatsTotals, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StatsTotals)
+	err := c.cc.Invoke(ctx, Admin_GetStatsTotals_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) StreamQueryLog(ctx context.Context, in *StreamQueryLogRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[QueryLogRecord], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Admin_ServiceDesc.Streams[0], Admin_StreamQueryLog_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamQueryLogRequest, QueryLogRecord]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Admin_StreamQueryLogClient = grpc.ServerStreamingClient[QueryLogRecord]
+
+func (c *adminClient) GetHitStats(ctx context.Context, in *PluginRequest, opts ...grpc.CallOption) (*HitStats, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HitStats)
+	err := c.cc.Invoke(ctx, Admin_GetHitStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ListRules(ctx context.Context, in *PluginRequest, opts ...grpc.CallOption) (*ListRulesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListRulesResponse)
+	err := c.cc.Invoke(ctx, Admin_ListRules_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) AddRule(ctx context.Context, in *AddRuleRequest, opts ...grpc.CallOption) (*AddRuleResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AddRuleResponse)
+	err := c.cc.Invoke(ctx, Admin_AddRule_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) DeleteRule(ctx context.Context, in *DeleteRuleRequest, opts ...grpc.CallOption) (*DeleteRuleResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteRuleResponse)
+	err := c.cc.Invoke(ctx, Admin_DeleteRule_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) FlushCache(ctx context.Context, in *PluginRequest, opts ...grpc.CallOption) (*FlushCacheResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FlushCacheResponse)
+	err := c.cc.Invoke(ctx, Admin_FlushCache_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility.
+type AdminServer interface {
+	// GET /api/audit?limit=N
+	TailAudit(context.Context, *TailAuditRequest) (*TailAuditResponse, error)
+	// GET /api/state/export
+	ExportState(context.Context, *ExportStateRequest) (*StateBundle, error)
+	// POST /api/state/import
+	ImportState(context.Context, *StateBundle) (*ImportStateResponse, error)
+	// POST /api/backup
+	Backup(context.Context, *BackupRequest) (*BackupResponse, error)
+	// GET /api/dump
+	Dump(context.Context, *DumpRequest) (*DumpResponse, error)
+	// GET /api/reload
+	GetReloadStatus(context.Context, *GetReloadStatusRequest) (*ReloadStatus, error)
+	// POST /api/reload
+	Reload(context.Context, *ReloadRequest) (*ReloadResponse, error)
+	// GET /api/stats/totals
+	GetStatsTotals(context.Context, *GetStatsTotalsRequest) (*StatsTotals, error)
+	// GET /api/log/stream?client=&domain=
+	StreamQueryLog(*StreamQueryLogRequest, grpc.ServerStreamingServer[QueryLogRecord]) error
+	// GET /plugins/<tag>/hits
+	GetHitStats(context.Context, *PluginRequest) (*HitStats, error)
+	// GET /plugins/<tag>/rules
+	ListRules(context.Context, *PluginRequest) (*ListRulesResponse, error)
+	// POST /plugins/<tag>/rules
+	AddRule(context.Context, *AddRuleRequest) (*AddRuleResponse, error)
+	// DELETE /plugins/<tag>/rules?exp=
+	DeleteRule(context.Context, *DeleteRuleRequest) (*DeleteRuleResponse, error)
+	// GET /plugins/<tag>/flush
+	FlushCache(context.Context, *PluginRequest) (*FlushCacheResponse, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAdminServer struct{}
+
+func (UnimplementedAdminServer) TailAudit(context.Context, *TailAuditRequest) (*TailAuditResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TailAudit not implemented")
+}
+func (UnimplementedAdminServer) ExportState(context.Context, *ExportStateRequest) (*StateBundle, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExportState not implemented")
+}
+func (UnimplementedAdminServer) ImportState(context.Context, *StateBundle) (*ImportStateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ImportState not implemented")
+}
+func (UnimplementedAdminServer) Backup(context.Context, *BackupRequest) (*BackupResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Backup not implemented")
+}
+func (UnimplementedAdminServer) Dump(context.Context, *DumpRequest) (*DumpResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Dump not implemented")
+}
+func (UnimplementedAdminServer) GetReloadStatus(context.Context, *GetReloadStatusRequest) (*ReloadStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetReloadStatus not implemented")
+}
+func (UnimplementedAdminServer) Reload(context.Context, *ReloadRequest) (*ReloadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reload not implemented")
+}
+func (UnimplementedAdminServer) GetStatsTotals(context.Context, *GetStatsTotalsRequest) (*StatsTotals, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatsTotals not implemented")
+}
+func (UnimplementedAdminServer) StreamQueryLog(*StreamQueryLogRequest, grpc.ServerStreamingServer[QueryLogRecord]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamQueryLog not implemented")
+}
+func (UnimplementedAdminServer) GetHitStats(context.Context, *PluginRequest) (*HitStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetHitStats not implemented")
+}
+func (UnimplementedAdminServer) ListRules(context.Context, *PluginRequest) (*ListRulesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRules not implemented")
+}
+func (UnimplementedAdminServer) AddRule(context.Context, *AddRuleRequest) (*AddRuleResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddRule not implemented")
+}
+func (UnimplementedAdminServer) DeleteRule(context.Context, *DeleteRuleRequest) (*DeleteRuleResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteRule not implemented")
+}
+func (UnimplementedAdminServer) FlushCache(context.Context, *PluginRequest) (*FlushCacheResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FlushCache not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+func (UnimplementedAdminServer) testEmbeddedByValue()               {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	// If the following call pancis, it indicates UnimplementedAdminServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_TailAudit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TailAuditRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).TailAudit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_TailAudit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).TailAudit(ctx, req.(*TailAuditRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ExportState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportStateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ExportState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_ExportState_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ExportState(ctx, req.(*ExportStateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ImportState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StateBundle)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ImportState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_ImportState_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ImportState(ctx, req.(*StateBundle))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Backup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Backup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_Backup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Backup(ctx, req.(*BackupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Dump_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DumpRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Dump(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_Dump_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Dump(ctx, req.(*DumpRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetReloadStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetReloadStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetReloadStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_GetReloadStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetReloadStatus(ctx, req.(*GetReloadStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Reload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReloadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Reload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_Reload_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Reload(ctx, req.(*ReloadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetStatsTotals_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsTotalsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetStatsTotals(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_GetStatsTotals_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetStatsTotals(ctx, req.(*GetStatsTotalsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_StreamQueryLog_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamQueryLogRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AdminServer).StreamQueryLog(m, &grpc.GenericServerStream[StreamQueryLogRequest, QueryLogRecord]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Admin_StreamQueryLogServer = grpc.ServerStreamingServer[QueryLogRecord]
+
+func _Admin_GetHitStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PluginRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetHitStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_GetHitStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetHitStats(ctx, req.(*PluginRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ListRules_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PluginRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListRules(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_ListRules_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListRules(ctx, req.(*PluginRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_AddRule_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddRuleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).AddRule(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_AddRule_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).AddRule(ctx, req.(*AddRuleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_DeleteRule_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRuleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).DeleteRule(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_DeleteRule_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).DeleteRule(ctx, req.(*DeleteRuleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_FlushCache_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PluginRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).FlushCache(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_FlushCache_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).FlushCache(ctx, req.(*PluginRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mosdns.admin.v1.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "TailAudit",
+			Handler:    _Admin_TailAudit_Handler,
+		},
+		{
+			MethodName: "ExportState",
+			Handler:    _Admin_ExportState_Handler,
+		},
+		{
+			MethodName: "ImportState",
+			Handler:    _Admin_ImportState_Handler,
+		},
+		{
+			MethodName: "Backup",
+			Handler:    _Admin_Backup_Handler,
+		},
+		{
+			MethodName: "Dump",
+			Handler:    _Admin_Dump_Handler,
+		},
+		{
+			MethodName: "GetReloadStatus",
+			Handler:    _Admin_GetReloadStatus_Handler,
+		},
+		{
+			MethodName: "Reload",
+			Handler:    _Admin_Reload_Handler,
+		},
+		{
+			MethodName: "GetStatsTotals",
+			Handler:    _Admin_GetStatsTotals_Handler,
+		},
+		{
+			MethodName: "GetHitStats",
+			Handler:    _Admin_GetHitStats_Handler,
+		},
+		{
+			MethodName: "ListRules",
+			Handler:    _Admin_ListRules_Handler,
+		},
+		{
+			MethodName: "AddRule",
+			Handler:    _Admin_AddRule_Handler,
+		},
+		{
+			MethodName: "DeleteRule",
+			Handler:    _Admin_DeleteRule_Handler,
+		},
+		{
+			MethodName: "FlushCache",
+			Handler:    _Admin_FlushCache_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamQueryLog",
+			Handler:       _Admin_StreamQueryLog_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "admin_api.proto",
+}
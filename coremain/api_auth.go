@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role is the permission level of an api user.
+type Role int
+
+const (
+	RoleNone Role = iota
+	// RoleViewer can only read stats and states.
+	RoleViewer
+	// RoleOperator can also change runtime states, e.g. flush the cache.
+	RoleOperator
+	// RoleAdmin has full access, including debug endpoints and audit logs.
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleOperator:
+		return "operator"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+func parseRole(s string) (Role, error) {
+	switch s {
+	case "viewer":
+		return RoleViewer, nil
+	case "operator":
+		return RoleOperator, nil
+	case "admin":
+		return RoleAdmin, nil
+	default:
+		return RoleNone, fmt.Errorf("invalid role %q", s)
+	}
+}
+
+type apiUser struct {
+	name     string
+	token    string
+	password string
+	role     Role
+}
+
+// apiAuth authenticates api requests. A nil *apiAuth allows everything.
+type apiAuth struct {
+	users []apiUser
+}
+
+func newApiAuth(cfgs []APIUserConfig) (*apiAuth, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+	a := new(apiAuth)
+	for i, c := range cfgs {
+		if len(c.Name) == 0 {
+			return nil, fmt.Errorf("api user #%d has no name", i)
+		}
+		if len(c.Token) == 0 && len(c.Password) == 0 {
+			return nil, fmt.Errorf("api user %s has neither token nor password", c.Name)
+		}
+		role, err := parseRole(c.Role)
+		if err != nil {
+			return nil, fmt.Errorf("api user %s, %w", c.Name, err)
+		}
+		a.users = append(a.users, apiUser{name: c.Name, token: c.Token, password: c.Password, role: role})
+	}
+	return a, nil
+}
+
+func secretEqual(a, b string) bool {
+	return len(a) > 0 && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authenticate returns the user of r. It returns nil if r has no
+// valid credential.
+func (a *apiAuth) authenticate(r *http.Request) *apiUser {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for i := range a.users {
+			if secretEqual(a.users[i].token, token) {
+				return &a.users[i]
+			}
+		}
+		return nil
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		for i := range a.users {
+			if a.users[i].name == name && secretEqual(a.users[i].password, password) {
+				return &a.users[i]
+			}
+		}
+	}
+	return nil
+}
+
+// authMiddleware authenticates the request and rejects requests that
+// need a higher role. It must be registered before auditMiddleware.
+func (m *Mosdns) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := &apiReqState{mutation: !isReadOnlyMethod(r.Method), role: RoleAdmin}
+		if m.auth != nil {
+			u := m.auth.authenticate(r)
+			if u == nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="mosdns"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				m.appendAudit(r, st, http.StatusUnauthorized, "")
+				return
+			}
+			st.user = u.name
+			st.role = u.role
+		}
+		if st.mutation && st.role < RoleOperator {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			m.appendAudit(r, st, http.StatusForbidden, "")
+			return
+		}
+		next.ServeHTTP(w, withApiReqState(r, st))
+	})
+}
+
+// RequestRole returns the role of the api user of r. ok is false if r was
+// not served by the api, e.g. r is from the http server of a plugin.
+func RequestRole(r *http.Request) (role Role, ok bool) {
+	st := getApiReqState(r)
+	if st == nil {
+		return RoleNone, false
+	}
+	return st.role, true
+}
+
+// RequireRole returns a middleware that rejects requests from users whose
+// role is lower than role. It has no effect if api users are not configured.
+func RequireRole(role Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if st := getApiReqState(r); st != nil && st.role < role {
+				st.denied = true
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_authMiddleware_auditDenied(t *testing.T) {
+	m := NewTestMosdnsWithPlugins(nil)
+	auth, err := newApiAuth([]APIUserConfig{
+		{Name: "v", Token: "vt", Role: "viewer"},
+		{Name: "o", Token: "ot", Role: "operator"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.auth = auth
+	m.httpMux.Use(m.authMiddleware, m.auditMiddleware)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	m.httpMux.Get("/read", ok)
+	m.httpMux.Post("/write", ok)
+	m.httpMux.With(RequireRole(RoleAdmin)).Get("/admin", ok)
+	m.httpMux.Get("/flush", Mutation(ok))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		wantStatus int
+		wantActor  string // Prefix of the actor. Empty if the request should not be audited.
+	}{
+		{"no credential", http.MethodGet, "/read", "", http.StatusUnauthorized, "anonymous@192.0.2.1"},
+		{"bad token", http.MethodPost, "/write", "bad", http.StatusUnauthorized, "token:"},
+		{"viewer read", http.MethodGet, "/read", "vt", http.StatusOK, ""},
+		{"viewer write", http.MethodPost, "/write", "vt", http.StatusForbidden, "user:v"},
+		{"viewer admin", http.MethodGet, "/admin", "vt", http.StatusForbidden, "user:v"},
+		{"viewer mutation", http.MethodGet, "/flush", "vt", http.StatusForbidden, "user:v"},
+		{"operator write", http.MethodPost, "/write", "ot", http.StatusOK, "user:o"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := m.audit.Tail(100)
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if len(tt.token) > 0 {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			m.httpMux.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("want status %d, got %d", tt.wantStatus, w.Code)
+			}
+			after, _ := m.audit.Tail(100)
+			if len(tt.wantActor) == 0 {
+				if len(after) != len(before) {
+					t.Fatalf("unexpected audit entry %+v", after[len(after)-1])
+				}
+				return
+			}
+			if len(after) != len(before)+1 {
+				t.Fatalf("request was not audited")
+			}
+			e := after[len(after)-1]
+			if !strings.HasPrefix(e.Actor, tt.wantActor) || e.Status != tt.wantStatus || e.Path != tt.path {
+				t.Fatalf("unexpected audit entry %+v", e)
+			}
+		})
+	}
+}
+
+func Test_RequestRole(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, ok := RequestRole(r); ok {
+		t.Fatal("request was not served by the api")
+	}
+	r = withApiReqState(r, &apiReqState{role: RoleViewer})
+	if role, ok := RequestRole(r); !ok || role != RoleViewer {
+		t.Fatalf("unexpected role %v, %v", role, ok)
+	}
+}
@@ -0,0 +1,321 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+)
+
+const (
+	maxAuditDiffSize     = 4096
+	maxMemoryAuditEntry  = 1024
+	defaultAuditApiLimit = 100
+)
+
+// AuditEntry is a record of an api call that changed the state of mosdns.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+	Diff   string    `json:"diff,omitempty"`
+}
+
+// auditLog is an append-only log of AuditEntry. If file is empty, entries
+// are kept in memAudit, and only the latest maxMemoryAuditEntry entries
+// are retained.
+type auditLog struct {
+	file string
+
+	mu sync.Mutex
+}
+
+// memAudit keeps entries of audit logs that have no file. It is shared
+// by all instances, so entries survive reloads, including the entry of
+// the reload itself.
+var memAudit struct {
+	sync.Mutex
+	entries []AuditEntry
+}
+
+func newAuditLog(file string) *auditLog {
+	return &auditLog{file: file}
+}
+
+func (l *auditLog) Append(e AuditEntry) error {
+	if len(l.file) == 0 {
+		memAudit.Lock()
+		defer memAudit.Unlock()
+		if len(memAudit.entries) >= maxMemoryAuditEntry {
+			memAudit.entries = append(memAudit.entries[:0], memAudit.entries[1:]...)
+		}
+		memAudit.entries = append(memAudit.entries, e)
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	return err
+}
+
+// Tail returns the latest n entries.
+func (l *auditLog) Tail(n int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	if len(l.file) == 0 {
+		memAudit.Lock()
+		entries = append(entries, memAudit.entries...)
+		memAudit.Unlock()
+	} else {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		f, err := os.Open(l.file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		s.Buffer(nil, 1<<20)
+		for s.Scan() {
+			e := AuditEntry{}
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				return nil, fmt.Errorf("invalid audit log entry, %w", err)
+			}
+			entries = append(entries, e)
+			if len(entries) > n {
+				entries = append(entries[:0], entries[1:]...)
+			}
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
+
+type apiReqStateKey struct{}
+
+// apiReqState is shared by api middlewares of a request.
+type apiReqState struct {
+	mutation bool
+	denied   bool   // The request was rejected because of the role.
+	user     string // Empty if api users are not configured.
+	role     Role
+}
+
+func withApiReqState(r *http.Request, st *apiReqState) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiReqStateKey{}, st))
+}
+
+func getApiReqState(r *http.Request) *apiReqState {
+	st, _ := r.Context().Value(apiReqStateKey{}).(*apiReqState)
+	return st
+}
+
+// Mutation marks h as an api call that changes the state of mosdns, so
+// that it requires the operator role and will be recorded in the audit
+// log even if it is a GET request. Non-GET/HEAD requests are always
+// treated as mutations.
+func Mutation(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if st := getApiReqState(r); st != nil {
+			st.mutation = true
+			if st.role < RoleOperator {
+				st.denied = true
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+func isReadOnlyMethod(m string) bool {
+	return m == http.MethodGet || m == http.MethodHead || m == http.MethodOptions
+}
+
+// apiActor identifies who sent the api request. Bearer tokens are
+// never logged in plaintext.
+func apiActor(r *http.Request, st *apiReqState) string {
+	if len(st.user) > 0 {
+		return "user:" + st.user
+	}
+	if auth := r.Header.Get("Authorization"); len(auth) > 0 {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			h := sha256.Sum256([]byte(token))
+			return "token:" + hex.EncodeToString(h[:4])
+		}
+		if u, _, ok := r.BasicAuth(); ok {
+			return "user:" + u
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "anonymous@" + host
+}
+
+// auditMiddleware records mutations and denied requests to m.audit.
+func (m *Mosdns) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := getApiReqState(r)
+		if st == nil {
+			st = &apiReqState{mutation: !isReadOnlyMethod(r.Method), role: RoleAdmin}
+			r = withApiReqState(r, st)
+		}
+		var body []byte
+		if st.mutation && r.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(r.Body, maxAuditDiffSize+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		if !st.mutation && !st.denied {
+			return
+		}
+
+		diff := redactQuery(r.URL.RawQuery)
+		if len(body) > 0 {
+			if len(diff) > 0 {
+				diff += "\n"
+			}
+			diff += redactBody(r.Header.Get("Content-Type"), body)
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.appendAudit(r, st, status, diff)
+	})
+}
+
+func (m *Mosdns) appendAudit(r *http.Request, st *apiReqState, status int, diff string) {
+	e := AuditEntry{
+		Time:   time.Now(),
+		Actor:  apiActor(r, st),
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Status: status,
+		Diff:   diff,
+	}
+	if err := m.audit.Append(e); err != nil {
+		m.logger.Error("failed to write audit log", zap.Error(err))
+	}
+}
+
+// redactQuery redacts values of credential keys in url query q.
+func redactQuery(q string) string {
+	v, err := url.ParseQuery(q)
+	if err != nil {
+		return "<invalid query>"
+	}
+	for k := range v {
+		if isCredentialKey(k) {
+			v[k] = []string{"<redacted>"}
+		}
+	}
+	return v.Encode()
+}
+
+// redactBody returns the body of a request for the audit log. Values of
+// credential keys in json and form bodies are redacted. Other bodies,
+// e.g. configs and states, may contain credentials in any form, so only
+// their sizes are logged.
+func redactBody(contentType string, body []byte) string {
+	if len(body) <= maxAuditDiffSize {
+		if ct, _, _ := mime.ParseMediaType(contentType); ct == "application/x-www-form-urlencoded" {
+			return redactQuery(string(body))
+		}
+		var v any
+		if json.Unmarshal(body, &v) == nil {
+			b := new(bytes.Buffer)
+			enc := json.NewEncoder(b)
+			enc.SetEscapeHTML(false)
+			if enc.Encode(redactCredentials(v)) == nil {
+				return strings.TrimSuffix(b.String(), "\n")
+			}
+		}
+	}
+	if len(body) > maxAuditDiffSize {
+		return fmt.Sprintf("<more than %d bytes>", maxAuditDiffSize)
+	}
+	return fmt.Sprintf("<%d bytes>", len(body))
+}
+
+func (m *Mosdns) auditApiHandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultAuditApiLimit
+	if s := r.URL.Query().Get("limit"); len(s) > 0 {
+		i, err := strconv.Atoi(s)
+		if err != nil || i <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = i
+	}
+	entries, err := m.audit.Tail(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_redactAuditDiff(t *testing.T) {
+	if got := redactQuery("tag=cache&token=abc"); got != "tag=cache&token=%3Credacted%3E" {
+		t.Fatalf("unexpected query %s", got)
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"json", "application/json", `{"name":"a","password":"p","nested":[{"api_token":"t"}]}`, `{"name":"a","nested":[{"api_token":"<redacted>"}],"password":"<redacted>"}`},
+		{"form", "application/x-www-form-urlencoded", "hostname=nas&secret=s", "hostname=nas&secret=%3Credacted%3E"},
+		{"yaml", "application/yaml", "password: p\n", "<12 bytes>"},
+		{"large", "application/json", `{"a":"` + strings.Repeat("x", maxAuditDiffSize) + `"}`, "<more than 4096 bytes>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactBody(tt.contentType, []byte(tt.body)); got != tt.want {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// In-memory audit logs are shared by instances, so reloads don't erase them.
+func Test_auditLog_memory(t *testing.T) {
+	old := newAuditLog("")
+	before, _ := old.Tail(maxMemoryAuditEntry)
+	if err := old.Append(AuditEntry{Path: "/api/reload"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := newAuditLog("").Tail(maxMemoryAuditEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != min(len(before)+1, maxMemoryAuditEntry) || entries[len(entries)-1].Path != "/api/reload" {
+		t.Fatalf("entries of the old instance are lost, %v", entries)
+	}
+}
@@ -0,0 +1,538 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+const (
+	backupFilePrefix   = "mosdns-backup-"
+	backupFileSuffix   = ".tar.gz"
+	backupManifestName = "manifest.json"
+	backupStateName    = "state.json"
+	// Backups made in the same second must not overwrite each other.
+	backupTimeFormat = "20060102-150405.000000000"
+
+	// restoreS3Prefix marks backups on the s3 storage of the config.
+	restoreS3Prefix = "s3:"
+)
+
+// BackupConfig configures scheduled backups of config files,
+// runtime state (see StateExporter) and plugin data (see DataDumper).
+type BackupConfig struct {
+	// Interval in seconds. 0 disables scheduled backups.
+	Interval int `yaml:"interval"`
+
+	// Dir is a local dir that backups are written to.
+	Dir string `yaml:"dir"`
+	// Keep is the number of backups that are kept in Dir. Default is 7.
+	Keep int `yaml:"keep"`
+
+	// S3 uploads backups to an S3 compatible storage. Old backups are
+	// not removed, use lifecycle rules of the bucket instead.
+	S3       *remote.S3Config `yaml:"s3"`
+	S3Prefix string           `yaml:"s3_prefix"`
+}
+
+// DataDumper is implemented by plugins that can dump their data,
+// e.g. cache. Dumps are included in backups.
+type DataDumper interface {
+	DumpData(w io.Writer) error
+	LoadData(r io.Reader) error
+}
+
+type backupManifest struct {
+	Time time.Time `json:"time"`
+	// Config files. Name in archive -> original path.
+	Configs map[string]string `json:"configs"`
+	// Plugin data dumps. Name in archive -> plugin tag.
+	Data map[string]string `json:"data"`
+}
+
+type backupper struct {
+	cfg BackupConfig
+	s3  *remote.S3Client // maybe nil
+}
+
+func newBackupper(cfg BackupConfig) (*backupper, error) {
+	if len(cfg.Dir) == 0 && cfg.S3 == nil {
+		return nil, nil
+	}
+	if cfg.Keep <= 0 {
+		cfg.Keep = 7
+	}
+	b := &backupper{cfg: cfg}
+	if cfg.S3 != nil {
+		c, err := remote.NewS3Client(*cfg.S3)
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 config, %w", err)
+		}
+		b.s3 = c
+	}
+	return b, nil
+}
+
+// startBackup starts the scheduled backup goroutine if it is configured.
+func (m *Mosdns) startBackup() {
+	if m.backup == nil || m.backup.cfg.Interval <= 0 {
+		return
+	}
+	interval := time.Duration(m.backup.cfg.Interval) * time.Second
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if name, err := m.Backup(context.Background()); err != nil {
+					m.logger.Error("backup failed", zap.Error(err))
+				} else {
+					m.logger.Info("backup finished", zap.String("name", name))
+				}
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+}
+
+// Backup creates a backup and stores it to the configured dir and/or s3.
+// It returns the backup file name.
+func (m *Mosdns) Backup(ctx context.Context) (string, error) {
+	if m.backup == nil {
+		return "", errors.New("backup is not configured")
+	}
+	buf := new(bytes.Buffer)
+	if err := m.writeBackup(buf); err != nil {
+		return "", err
+	}
+	name := backupFilePrefix + time.Now().Format(backupTimeFormat) + backupFileSuffix
+
+	var errs []error
+	if dir := m.backup.cfg.Dir; len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			errs = append(errs, err)
+		} else if err := writeFileExcl(filepath.Join(dir, name), buf.Bytes()); err != nil {
+			errs = append(errs, err)
+		} else if err := removeOldBackups(dir, m.backup.cfg.Keep); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove old backups, %w", err))
+		}
+	}
+	if m.backup.s3 != nil {
+		key := path.Join(m.backup.cfg.S3Prefix, name)
+		if err := m.backup.s3.PutObject(ctx, key, buf.Bytes()); err != nil {
+			errs = append(errs, fmt.Errorf("failed to upload backup to s3, %w", err))
+		}
+	}
+	return name, errors.Join(errs...)
+}
+
+func (m *Mosdns) writeBackup(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+	addFile := func(name string, b []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: now}); err != nil {
+			return err
+		}
+		_, err := tw.Write(b)
+		return err
+	}
+
+	manifest := backupManifest{
+		Time:    now,
+		Configs: make(map[string]string),
+		Data:    make(map[string]string),
+	}
+	for i, f := range m.configFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("failed to read config file %s, %w", f, err)
+		}
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("configs/%d%s", i, filepath.Ext(f))
+		manifest.Configs[name] = abs
+		if err := addFile(name, b); err != nil {
+			return err
+		}
+	}
+
+	state, err := m.ExportState()
+	if err != nil {
+		return err
+	}
+	stateJson, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := addFile(backupStateName, stateJson); err != nil {
+		return err
+	}
+
+	for tag, p := range m.plugins {
+		d, ok := p.(DataDumper)
+		if !ok {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if err := d.DumpData(buf); err != nil {
+			return fmt.Errorf("failed to dump data of plugin %s, %w", tag, err)
+		}
+		name := "data/" + tag + ".dump"
+		manifest.Data[name] = tag
+		if err := addFile(name, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	manifestJson, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := addFile(backupManifestName, manifestJson); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// writeFileAtomic writes b to a tmp file in the dir of name, then renames
+// it to name, so name is never left half written. The file mode is 0600.
+func writeFileAtomic(name string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// writeFileExcl writes b to a new file. It never overwrites existing files.
+func writeFileExcl(name string, b []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// removeOldBackups keeps the newest keep backups in dir.
+func removeOldBackups(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if n := e.Name(); !e.IsDir() && strings.HasPrefix(n, backupFilePrefix) && strings.HasSuffix(n, backupFileSuffix) {
+			names = append(names, n)
+		}
+	}
+	if len(names) <= keep {
+		return nil
+	}
+	sort.Strings(names) // names contain sortable timestamps
+	var errs []error
+	for _, n := range names[:len(names)-keep] {
+		if err := os.Remove(filepath.Join(dir, n)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *Mosdns) backupApiHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := m.Backup(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = fmt.Fprintln(w, name)
+}
+
+// configFilesApiHandler returns absolute paths of the config files that
+// were loaded. The restore command only restores configs to them.
+func (m *Mosdns) configFilesApiHandler(w http.ResponseWriter, _ *http.Request) {
+	files := make([]string, 0, len(m.configFiles))
+	for _, f := range m.configFiles {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		files = append(files, abs)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(files)
+}
+
+// loadDataApiHandler loads the data dump of a plugin. It is used by the
+// restore command.
+func (m *Mosdns) loadDataApiHandler(w http.ResponseWriter, r *http.Request) {
+	tag := r.URL.Query().Get("tag")
+	d, ok := m.plugins[tag].(DataDumper)
+	if !ok {
+		http.Error(w, fmt.Sprintf("plugin %s does not exist or cannot load data", tag), http.StatusNotFound)
+		return
+	}
+	if err := d.LoadData(r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+func init() {
+	var (
+		api   string
+		token string
+		noCfg bool
+		cfg   string
+	)
+	c := &cobra.Command{
+		Use:   "restore backup_file|s3:backup_name [-c config_file] [--api http://127.0.0.1:8080]",
+		Short: "Restore a backup.",
+		Long: "Restore config files of a backup to their original paths. " +
+			"Configs are only restored to the config files that the mosdns of --api, or the config of -c loads. " +
+			"Backups with the \"s3:\" prefix are downloaded from the s3 storage in the backup section of the config. " +
+			"If --api is set, runtime state and plugin data are loaded to the running mosdns via its api.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			b, err := fetchBackup(cmd.Context(), args[0], cfg)
+			if err != nil {
+				return fmt.Errorf("failed to read backup, %w", err)
+			}
+			return restoreBackup(b, api, token, cfg, !noCfg)
+		},
+		DisableFlagsInUseLine: true,
+		SilenceUsage:          true,
+	}
+	c.Flags().StringVar(&api, "api", "", "api address of a running mosdns")
+	c.Flags().StringVar(&token, "token", "", "api bearer token")
+	c.Flags().BoolVar(&noCfg, "no-config", false, "do not restore config files")
+	c.Flags().StringVarP(&cfg, "config", "c", "", "config file that has the s3 storage of backups")
+	rootCmd.AddCommand(c)
+}
+
+// fetchBackup reads the backup from a local file or, if name has the
+// restoreS3Prefix, from the s3 storage of the backup config in cfgFile.
+func fetchBackup(ctx context.Context, name, cfgFile string) ([]byte, error) {
+	key, ok := strings.CutPrefix(name, restoreS3Prefix)
+	if !ok {
+		return os.ReadFile(name)
+	}
+	cfg, _, err := loadConfig(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Backup.S3 == nil {
+		return nil, errors.New("no s3 storage is configured in the backup section")
+	}
+	c, err := remote.NewS3Client(*cfg.Backup.S3)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 config, %w", err)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return c.GetObject(ctx, path.Join(cfg.Backup.S3Prefix, key))
+}
+
+// restoreBackup restores backup b. Config files are restored to the
+// config files of the running mosdns of api, or of cfgFile if api is
+// empty.
+func restoreBackup(b []byte, api, token, cfgFile string, restoreConfigs bool) error {
+	files, err := readBackup(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to read backup, %w", err)
+	}
+	manifest := new(backupManifest)
+	if err := json.Unmarshal(files[backupManifestName], manifest); err != nil {
+		return fmt.Errorf("invalid manifest, %w", err)
+	}
+	mlog.S().Infof("restoring backup created at %s", manifest.Time)
+
+	api = strings.TrimSuffix(api, "/")
+	call := func(method, u string, b []byte) ([]byte, error) {
+		req, err := http.NewRequest(method, u, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			return nil, fmt.Errorf("api returned status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+		}
+		return io.ReadAll(resp.Body)
+	}
+	post := func(u string, b []byte) error {
+		_, err := call(http.MethodPost, u, b)
+		return err
+	}
+
+	if restoreConfigs {
+		var loaded []string
+		if len(api) > 0 {
+			b, err := call(http.MethodGet, api+"/api/state/config_files", nil)
+			if err == nil {
+				err = json.Unmarshal(b, &loaded)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to get config files of the running mosdns, %w", err)
+			}
+		} else {
+			loaded, err = localConfigFiles(cfgFile)
+			if err != nil {
+				return fmt.Errorf("failed to load config files, %w", err)
+			}
+		}
+		// Check all configs before writing any of them.
+		for name, dst := range manifest.Configs {
+			if _, ok := files[name]; !ok {
+				return fmt.Errorf("config %s is missing in the backup", name)
+			}
+			if !filepath.IsAbs(dst) || filepath.Clean(dst) != dst || !slices.Contains(loaded, dst) {
+				return fmt.Errorf("config path %q is not a loaded config file", dst)
+			}
+		}
+		for name, dst := range manifest.Configs {
+			// Configs may have secrets, they are written with mode 0600.
+			if err := writeFileAtomic(dst, files[name]); err != nil {
+				return fmt.Errorf("failed to restore config %s, %w", dst, err)
+			}
+			mlog.S().Infof("config restored: %s", dst)
+		}
+	}
+
+	if len(api) == 0 {
+		return nil
+	}
+	if err := post(api+"/api/state/import", files[backupStateName]); err != nil {
+		return fmt.Errorf("failed to import state, %w", err)
+	}
+	mlog.S().Info("runtime state restored")
+	for name, tag := range manifest.Data {
+		if err := post(api+"/api/state/data?"+url.Values{"tag": {tag}}.Encode(), files[name]); err != nil {
+			return fmt.Errorf("failed to load data of plugin %s, %w", tag, err)
+		}
+		mlog.S().Infof("plugin data restored: %s", tag)
+	}
+	return nil
+}
+
+// localConfigFiles returns absolute paths of cfgFile and the local
+// config files that it includes.
+func localConfigFiles(cfgFile string) ([]string, error) {
+	if isRemoteConfig(cfgFile) {
+		return nil, errors.New("configs of a remote config cannot be restored")
+	}
+	cfg, _, err := loadConfig(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	cfgs, err := loadConfigTree(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, c := range cfgs {
+		if len(c.file) == 0 || isRemoteConfig(c.file) {
+			continue
+		}
+		abs, err := filepath.Abs(c.file)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, abs)
+	}
+	return files, nil
+}
+
+func readBackup(r io.Reader) (map[string][]byte, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	files := make(map[string][]byte)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[h.Name] = b
+	}
+	if _, ok := files[backupManifestName]; !ok {
+		return nil, errors.New("missing manifest")
+	}
+	return files, nil
+}
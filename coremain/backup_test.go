@@ -0,0 +1,192 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testDumper struct {
+	data []byte
+}
+
+func (d *testDumper) DumpData(w io.Writer) error {
+	_, err := w.Write(d.data)
+	return err
+}
+
+func (d *testDumper) LoadData(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	d.data = b
+	return err
+}
+
+type testStateExporter struct {
+	state json.RawMessage
+}
+
+func (s *testStateExporter) ExportState() (json.RawMessage, error) { return s.state, nil }
+
+func (s *testStateExporter) ImportState(b json.RawMessage) error {
+	s.state = b
+	return nil
+}
+
+func Test_backup_restore(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(cfgFile, []byte("log: {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The tag must be escaped in the url.
+	const dumperTag = "cache&x=1"
+	dumper := &testDumper{data: []byte("cache dump")}
+	state := &testStateExporter{state: json.RawMessage(`{"rules":["a"]}`)}
+	m := NewTestMosdnsWithPlugins(map[string]any{dumperTag: dumper, "rules": state})
+	m.configFiles = []string{cfgFile}
+	m.backup = &backupper{cfg: BackupConfig{Dir: filepath.Join(dir, "backups"), Keep: 7}}
+
+	// Backups made in the same second must not overwrite each other.
+	n1, err := m.Backup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := m.Backup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1 == n2 {
+		t.Fatalf("backups have the same name %s", n1)
+	}
+
+	// Restore to a running instance.
+	if err := os.Remove(cfgFile); err != nil {
+		t.Fatal(err)
+	}
+	dumper.data = nil
+	state.state = nil
+	m.initHttpMux()
+	srv := httptest.NewServer(m.httpMux)
+	defer srv.Close()
+	b, err := fetchBackup(context.Background(), filepath.Join(dir, "backups", n2), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreBackup(b, srv.URL, "", "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(cfgFile)
+	if err != nil || string(got) != "log: {}\n" {
+		t.Fatalf("config was not restored, %q, %v", got, err)
+	}
+	if fi, err := os.Stat(cfgFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("restored config should be 0600, %v, %v", fi.Mode(), err)
+	}
+	if !bytes.Equal(dumper.data, []byte("cache dump")) {
+		t.Fatalf("plugin data was not restored, %q", dumper.data)
+	}
+	if string(state.state) != `{"rules":["a"]}` {
+		t.Fatalf("state was not restored, %s", state.state)
+	}
+}
+
+// makeBackup returns a backup of manifest and files.
+func makeBackup(t *testing.T, manifest backupManifest, files map[string]string) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	add := func(name string, b []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(b))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, s := range files {
+		add(name, []byte(s))
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add(backupManifestName, b)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func Test_restoreBackup_configs(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "config.yaml")
+	other := filepath.Join(dir, "other.yaml")
+	for _, f := range []string{cfgFile, other} {
+		if err := os.WriteFile(f, []byte("log: {}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unchanged := func() {
+		t.Helper()
+		for _, f := range []string{cfgFile, other} {
+			if b, _ := os.ReadFile(f); string(b) != "log: {}\n" {
+				t.Fatalf("%s should not be changed, got %q", f, b)
+			}
+		}
+	}
+
+	// A config that is missing in the archive.
+	b := makeBackup(t, backupManifest{Configs: map[string]string{"configs/0.yaml": cfgFile}}, nil)
+	if err := restoreBackup(b, "", "", cfgFile, true); err == nil {
+		t.Fatal("want error of a missing config")
+	}
+	unchanged()
+
+	// Paths that are not loaded configs.
+	for _, dst := range []string{other, "config.yaml", dir + "/x/../config.yaml"} {
+		b := makeBackup(t, backupManifest{Configs: map[string]string{"configs/0.yaml": dst}}, map[string]string{"configs/0.yaml": "bad"})
+		if err := restoreBackup(b, "", "", cfgFile, true); err == nil {
+			t.Fatalf("%s: want error of an unknown config path", dst)
+		}
+		unchanged()
+	}
+
+	b = makeBackup(t, backupManifest{Configs: map[string]string{"configs/0.yaml": cfgFile}}, map[string]string{"configs/0.yaml": "log: {level: debug}\n"})
+	if err := restoreBackup(b, "", "", cfgFile, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(cfgFile); string(got) != "log: {level: debug}\n" {
+		t.Fatalf("config was not restored, %q", got)
+	}
+}
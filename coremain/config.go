@@ -21,6 +21,7 @@ package coremain
 
 import (
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
 )
 
 type Config struct {
@@ -28,6 +29,43 @@ type Config struct {
 	Include []string       `yaml:"include"`
 	Plugins []PluginConfig `yaml:"plugins"`
 	API     APIConfig      `yaml:"api"`
+	Metrics MetricsConfig  `yaml:"metrics"`
+
+	// Upstreams are named upstream groups that can be referenced by
+	// plugins, so the same upstreams don't need to be defined repeatedly.
+	Upstreams []UpstreamGroupConfig `yaml:"upstreams"`
+
+	// Storages are remote storages that data files can be loaded from,
+	// by using "storage://<tag>/<path>" as the file path.
+	Storages []remote.StorageConfig `yaml:"storages"`
+
+	// Macros are named values that plugin args can refer to, by
+	// {$macro: name}. Macros of all config files, including included
+	// ones, are shared. See macroKey for details.
+	Macros map[string]any `yaml:"macros"`
+
+	// AutoReload restarts mosdns when the config file, included config
+	// files or data files of domain_set and ip_set change.
+	// Default is true. Only the main config file's setting is used.
+	AutoReload *bool `yaml:"auto_reload"`
+	// Reload configures how the running instance is replaced on auto
+	// reload. Only the main config file's setting is used.
+	Reload ReloadConfig `yaml:"reload"`
+
+	Diagnostics DiagnosticsConfig `yaml:"diagnostics"`
+	Backup      BackupConfig      `yaml:"backup"`
+	Stats       StatsConfig       `yaml:"stats"`
+
+	// file is the path of this config file. Set by loadConfig.
+	file string
+
+	// cacheDir is the dir that remote configs included by this config
+	// are cached in. Set by loadConfig.
+	cacheDir string
+
+	// tree is this config and configs it includes, included configs
+	// first. Set by loadConfigTree.
+	tree []*Config
 }
 
 // PluginConfig represents a plugin config
@@ -45,6 +83,40 @@ type PluginConfig struct {
 	Args any `yaml:"args"`
 }
 
+// UpstreamGroupConfig is a named group of upstreams. The format of
+// each upstream is defined by the plugin that uses this group, e.g. forward.
+type UpstreamGroupConfig struct {
+	Tag       string `yaml:"tag"`
+	Upstreams []any  `yaml:"upstreams"`
+}
+
 type APIConfig struct {
 	HTTP string `yaml:"http"`
+
+	// GRPC is the listen address of the gRPC api. See adminpb/admin_api.proto.
+	// It has the same users, roles and audit log as the http api.
+	GRPC string `yaml:"grpc"`
+
+	// AuditLog is the file that api mutations are appended to.
+	// If empty, the latest entries are kept in memory, across reloads.
+	AuditLog string `yaml:"audit_log"`
+
+	// Users of the api. If empty, the api has no authentication.
+	Users []APIUserConfig `yaml:"users"`
+
+	// Dashboard serves a web dashboard of live statistics at "/dashboard".
+	// It keeps the latest DashboardSize (default 10000) queries in memory.
+	Dashboard     bool `yaml:"dashboard"`
+	DashboardSize int  `yaml:"dashboard_size"`
+}
+
+// APIUserConfig is an api user. It can authenticate itself by
+// "Authorization: Bearer <token>" or http basic auth with name and password.
+type APIUserConfig struct {
+	Name     string `yaml:"name"`
+	Token    string `yaml:"token"`
+	Password string `yaml:"password"`
+
+	// Role is one of "viewer", "operator" and "admin".
+	Role string `yaml:"role"`
 }
@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDashboardSize   = 10000
+	defaultDashboardWindow = 5 * time.Minute
+	maxDashboardWindow     = 24 * time.Hour
+	defaultDashboardTopN   = 10
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// dashboardStats is the response of the /api/dashboard/stats api.
+type dashboardStats struct {
+	query_log.Summary
+	Cache          cacheStats       `json:"cache"`
+	UpstreamHealth []upstreamHealth `json:"upstream_health"`
+	Inflight       int64            `json:"inflight"`
+	UptimeSeconds  int64            `json:"uptime_seconds"`
+
+	// Totals are the persisted counters. Nil if stats persistence is
+	// disabled.
+	Totals *query_log.TotalsSnapshot `json:"totals,omitempty"`
+}
+
+// cacheStats sums counters of all cache plugins since start.
+type cacheStats struct {
+	Queries float64 `json:"queries"`
+	Hits    float64 `json:"hits"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// upstreamHealth is the stats of a forward upstream since start.
+type upstreamHealth struct {
+	Plugin       string  `json:"plugin"`
+	Upstream     string  `json:"upstream"`
+	Queries      float64 `json:"queries"`
+	Errors       float64 `json:"errors"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// initDashboard counts every query and keeps the latest size records
+// for top lists, then registers the dashboard page and api. It must be
+// called before plugins are loaded.
+func (m *Mosdns) initDashboard(size int) {
+	if size <= 0 {
+		size = defaultDashboardSize
+	}
+	ring := query_log.NewRing(size)
+	counter := query_log.NewCounter(maxDashboardWindow)
+	m.queryObservers = append(m.queryObservers, func(r *query_log.Record) {
+		counter.Add(r)
+		ring.Add(r)
+	})
+
+	m.httpMux.Get("/dashboard", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(dashboardHTML)
+	})
+	m.httpMux.Get("/api/dashboard/stats", func(w http.ResponseWriter, r *http.Request) {
+		m.dashboardStatsHandler(w, r, ring, counter)
+	})
+	m.logger.Info("dashboard enabled", zap.Int("size", size))
+}
+
+// dashboardStatsHandler writes dashboardStats. The time window of the
+// summary can be set by the url query "window" in seconds (default 300),
+// and the length of top lists by "top" (default 10). Counts are from
+// counter, top lists are from the latest records in ring.
+func (m *Mosdns) dashboardStatsHandler(w http.ResponseWriter, r *http.Request, ring *query_log.Ring, counter *query_log.Counter) {
+	window := defaultDashboardWindow
+	if s := r.URL.Query().Get("window"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || time.Duration(n)*time.Second > maxDashboardWindow {
+			http.Error(w, "invalid window", http.StatusBadRequest)
+			return
+		}
+		window = time.Duration(n) * time.Second
+	}
+	top := defaultDashboardTopN
+	if s := r.URL.Query().Get("top"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	now := time.Now()
+	stats := dashboardStats{
+		Summary:       query_log.Summarize(ring.Records(), now, window, top),
+		Inflight:      m.inflight.Load(),
+		UptimeSeconds: int64(time.Since(m.startTime).Seconds()),
+	}
+	stats.Counts = counter.Counts(now, window)
+	if m.totals != nil {
+		s := m.totals.Snapshot()
+		stats.Totals = &s
+	}
+	if mfs, err := m.metricsReg.Gather(); err == nil {
+		stats.Cache, stats.UpstreamHealth = statsFromMetrics(mfs)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
+
+// statsFromMetrics reads cache and forward metrics.
+func statsFromMetrics(mfs []*dto.MetricFamily) (cacheStats, []upstreamHealth) {
+	var cs cacheStats
+	ups := make(map[[2]string]*upstreamHealth)
+	upstream := func(m *dto.Metric) *upstreamHealth {
+		var k [2]string
+		for _, l := range m.GetLabel() {
+			switch l.GetName() {
+			case "tag":
+				k[0] = l.GetValue()
+			case "upstream":
+				k[1] = l.GetValue()
+			}
+		}
+		u := ups[k]
+		if u == nil {
+			u = &upstreamHealth{Plugin: k[0], Upstream: k[1]}
+			ups[k] = u
+		}
+		return u
+	}
+
+	for _, mf := range mfs {
+		for _, metric := range mf.GetMetric() {
+			switch mf.GetName() {
+			case "mosdns_cache_query_total":
+				cs.Queries += metric.GetCounter().GetValue()
+			case "mosdns_cache_hit_total":
+				cs.Hits += metric.GetCounter().GetValue()
+			case "mosdns_forward_query_total":
+				upstream(metric).Queries = metric.GetCounter().GetValue()
+			case "mosdns_forward_err_total":
+				upstream(metric).Errors = metric.GetCounter().GetValue()
+			case "mosdns_forward_response_latency_millisecond":
+				if h := metric.GetHistogram(); h.GetSampleCount() > 0 {
+					upstream(metric).AvgLatencyMs = h.GetSampleSum() / float64(h.GetSampleCount())
+				}
+			}
+		}
+	}
+	if cs.Queries > 0 {
+		cs.HitRate = cs.Hits / cs.Queries
+	}
+	l := make([]upstreamHealth, 0, len(ups))
+	for _, u := range ups {
+		l = append(l, *u)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Plugin != l[j].Plugin {
+			return l[i].Plugin < l[j].Plugin
+		}
+		return l[i].Upstream < l[j].Upstream
+	})
+	return cs, l
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
+	"go.uber.org/zap"
+)
+
+// DataFileProvider can be implemented by DataReloader plugins. Local
+// files returned by DataFiles are checked periodically, and ReloadData is
+// called when their modification time or size changes. Files in remote
+// storages are not checked.
+type DataFileProvider interface {
+	DataReloader
+	DataFiles() []string
+}
+
+const dataFileCheckInterval = time.Second * 5
+
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchedData is a DataFileProvider plugin and the stats of its files
+// when they were checked last time.
+type watchedData struct {
+	tag   string
+	p     DataFileProvider
+	files []string
+	stats []fileStat
+}
+
+// statDataFiles returns stats of files. Missing files have zero stats.
+func statDataFiles(files []string) []fileStat {
+	stats := make([]fileStat, len(files))
+	for i, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			stats[i] = fileStat{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return stats
+}
+
+// collectWatchedData returns DataFileProvider plugins that have local
+// files, sorted by tag.
+func (m *Mosdns) collectWatchedData() []*watchedData {
+	var l []*watchedData
+	for tag, p := range m.plugins {
+		dp, ok := p.(DataFileProvider)
+		if !ok {
+			continue
+		}
+		var files []string
+		for _, f := range dp.DataFiles() {
+			if !remote.IsStorageFile(f) {
+				files = append(files, f)
+			}
+		}
+		if len(files) == 0 {
+			continue
+		}
+		l = append(l, &watchedData{tag: tag, p: dp, files: files, stats: statDataFiles(files)})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].tag < l[j].tag })
+	return l
+}
+
+// checkWatchedData reloads plugins whose files were changed. A failed
+// reload is not retried until the files change again.
+func (m *Mosdns) checkWatchedData(l []*watchedData) {
+	for _, d := range l {
+		stats := statDataFiles(d.files)
+		changed := false
+		for i := range stats {
+			if !stats[i].modTime.Equal(d.stats[i].modTime) || stats[i].size != d.stats[i].size {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			continue
+		}
+		d.stats = stats
+		if err := d.p.ReloadData(); err != nil {
+			m.logger.Warn("failed to reload data files", zap.String("tag", d.tag), zap.Error(err))
+			continue
+		}
+		m.logger.Info("data files reloaded", zap.String("tag", d.tag))
+	}
+}
+
+// startDataFileWatcher checks files of DataFileProvider plugins every
+// dataFileCheckInterval until m is closed.
+func (m *Mosdns) startDataFileWatcher() {
+	l := m.collectWatchedData()
+	if len(l) == 0 {
+		return
+	}
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		ticker := time.NewTicker(dataFileCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.checkWatchedData(l)
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+}
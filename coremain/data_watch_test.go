@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testDataFiles struct {
+	files   []string
+	reloads int
+	err     error
+}
+
+func (d *testDataFiles) DataFiles() []string { return d.files }
+
+func (d *testDataFiles) ReloadData() error {
+	d.reloads++
+	return d.err
+}
+
+func Test_checkWatchedData(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "data.txt")
+	write := func(s string, mod time.Time) {
+		t.Helper()
+		if err := os.WriteFile(f, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("a", now)
+
+	local := &testDataFiles{files: []string{f}}
+	remoteOnly := &testDataFiles{files: []string{"storage://s3/data.txt"}}
+	m := NewTestMosdnsWithPlugins(map[string]any{"local": local, "remote": remoteOnly, "other": 1})
+	l := m.collectWatchedData()
+	if len(l) != 1 || l[0].tag != "local" {
+		t.Fatalf("unexpected watched plugins %v", l)
+	}
+
+	m.checkWatchedData(l)
+	if local.reloads != 0 {
+		t.Fatal("unchanged files were reloaded")
+	}
+
+	write("ab", now.Add(time.Second))
+	m.checkWatchedData(l)
+	m.checkWatchedData(l)
+	if local.reloads != 1 {
+		t.Fatalf("want 1 reload, got %d", local.reloads)
+	}
+
+	// A failed reload is not retried until the file changes again.
+	local.err = errors.New("bad data")
+	write("abc", now.Add(2*time.Second))
+	m.checkWatchedData(l)
+	m.checkWatchedData(l)
+	if local.reloads != 2 {
+		t.Fatalf("want 2 reloads, got %d", local.reloads)
+	}
+
+	// Removed files are changes too.
+	local.err = nil
+	if err := os.Remove(f); err != nil {
+		t.Fatal(err)
+	}
+	m.checkWatchedData(l)
+	if local.reloads != 3 {
+		t.Fatalf("want 3 reloads, got %d", local.reloads)
+	}
+}
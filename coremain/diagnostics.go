@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Expected goroutines and fds of an in-flight query. Used to tolerate
+	// busy servers.
+	goroutinesPerQuery = 4
+	fdsPerQuery        = 2
+
+	maxStackSampleSize = 16 * 1024
+)
+
+// DiagnosticsConfig configures periodic leak self-diagnostics and state dumps.
+type DiagnosticsConfig struct {
+	// Interval of checks in seconds. 0 disables diagnostics.
+	Interval int `yaml:"interval"`
+
+	// A leak is suspected if the number of goroutines (or open fds)
+	// exceeds the number after start up by more than this threshold,
+	// after in-flight queries are taken into account.
+	// Default is 1000 goroutines and 500 fds.
+	GoroutineThreshold int `yaml:"goroutine_threshold"`
+	FDThreshold        int `yaml:"fd_threshold"`
+
+	// DumpDir is where state dumps are written on SIGQUIT.
+	// Default is the temp dir.
+	DumpDir string `yaml:"dump_dir"`
+}
+
+// startDiagnostics starts the leak self-diagnostics loop. It does not block.
+func (m *Mosdns) startDiagnostics(cfg DiagnosticsConfig) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	if cfg.GoroutineThreshold <= 0 {
+		cfg.GoroutineThreshold = 1000
+	}
+	if cfg.FDThreshold <= 0 {
+		cfg.FDThreshold = 500
+	}
+
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		baseGoroutines := runtime.NumGoroutine()
+		baseFDs := countOpenFDs()
+		lastWarnedGoroutines, lastWarnedFDs := 0, 0
+
+		ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-closeSignal:
+				return
+			}
+
+			inflight := int(m.inflight.Load())
+			goroutines := runtime.NumGoroutine()
+			fds := countOpenFDs()
+			excessGoroutines := goroutines - baseGoroutines - inflight*goroutinesPerQuery
+			excessFDs := fds - baseFDs - inflight*fdsPerQuery
+			m.logger.Debug("diagnostics",
+				zap.Int("goroutines", goroutines),
+				zap.Int("fds", fds),
+				zap.Int("inflight_queries", inflight),
+			)
+
+			// Only warn again if things got worse.
+			goroutineLeak := excessGoroutines > cfg.GoroutineThreshold && goroutines > lastWarnedGoroutines
+			fdLeak := baseFDs >= 0 && excessFDs > cfg.FDThreshold && fds > lastWarnedFDs
+			if !goroutineLeak && !fdLeak {
+				continue
+			}
+			lastWarnedGoroutines, lastWarnedFDs = goroutines, fds
+			m.logger.Warn("possible goroutine or fd leak",
+				zap.Int("goroutines", goroutines),
+				zap.Int("goroutines_at_start", baseGoroutines),
+				zap.Int("fds", fds),
+				zap.Int("fds_at_start", baseFDs),
+				zap.Int("inflight_queries", inflight),
+				zap.String("stack_sample", goroutineStackSample()),
+			)
+		}
+	})
+}
+
+// countOpenFDs returns the number of open fds of this process.
+// It returns -1 if it is not supported on this platform.
+func countOpenFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// goroutineStackSample returns goroutine stacks that are grouped by
+// identical stacks, truncated to maxStackSampleSize.
+func goroutineStackSample() string {
+	b := new(bytes.Buffer)
+	_ = pprof.Lookup("goroutine").WriteTo(b, 1)
+	if b.Len() > maxStackSampleSize {
+		b.Truncate(maxStackSampleSize)
+		b.WriteString("\n...(truncated)")
+	}
+	return b.String()
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+)
+
+const maxDumpRecentErrors = 100
+
+// startDumpOnSignal writes a state dump to dir on SIGQUIT.
+// It does not block.
+func (m *Mosdns) startDumpOnSignal(dir string) {
+	if len(dir) == 0 {
+		dir = os.TempDir()
+	}
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGQUIT)
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-c:
+				fp := filepath.Join(dir, fmt.Sprintf("mosdns-dump-%s.txt", time.Now().Format("20060102-150405")))
+				if err := m.writeStateDumpFile(fp); err != nil {
+					m.logger.Error("failed to write state dump", zap.Error(err))
+				} else {
+					m.logger.Info("state dump written", zap.String("file", fp))
+				}
+			case <-closeSignal:
+				return
+			}
+		}
+	})
+}
+
+func (m *Mosdns) writeStateDumpFile(fp string) error {
+	b := new(bytes.Buffer)
+	if err := m.WriteStateDump(b); err != nil {
+		return err
+	}
+	return os.WriteFile(fp, b.Bytes(), 0600)
+}
+
+// WriteStateDump writes a report of the instance for bug reports. It
+// includes plugins and their dependencies, recent errors, metrics (e.g.
+// upstream and cache stats) and goroutine stacks.
+func (m *Mosdns) WriteStateDump(w io.Writer) error {
+	b := new(bytes.Buffer)
+	fmt.Fprintf(b, "mosdns state dump\n")
+	fmt.Fprintf(b, "time: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(b, "uptime: %s\n", time.Since(m.startTime).Round(time.Second))
+	fmt.Fprintf(b, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(b, "pid: %d\n", os.Getpid())
+	fmt.Fprintf(b, "goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(b, "inflight queries: %d\n", m.inflight.Load())
+	fmt.Fprintf(b, "config files: %s\n", strings.Join(m.configFiles, ", "))
+
+	b.WriteString("\n== plugins ==\n")
+	tags := make([]string, 0, len(m.plugins))
+	for tag := range m.plugins {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		typ := m.pluginTypes[tag]
+		if len(typ) == 0 {
+			typ = "preset"
+		}
+		fmt.Fprintf(b, "%s (%s, %T)", tag, typ, m.plugins[tag])
+		if deps := m.pluginDeps[tag]; len(deps) > 0 {
+			fmt.Fprintf(b, " -> %s", strings.Join(deps, ", "))
+		}
+		b.WriteByte('\n')
+	}
+
+	b.WriteString("\n== recent errors and warnings ==\n")
+	if m.recentErrs != nil {
+		for _, e := range m.recentErrs.Entries() {
+			fmt.Fprintf(b, "%s %s %s %s", e.Time.Format(time.RFC3339), e.Level, e.Logger, e.Message)
+			keys := make([]string, 0, len(e.Fields))
+			for k := range e.Fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Fprintf(b, " %s=%q", k, e.Fields[k])
+			}
+			b.WriteByte('\n')
+		}
+	}
+
+	b.WriteString("\n== metrics ==\n")
+	mfs, err := m.metricsReg.Gather()
+	if err != nil {
+		fmt.Fprintf(b, "failed to gather metrics, %v\n", err)
+	}
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(b, mf); err != nil {
+			return err
+		}
+	}
+
+	b.WriteString("\n== goroutines ==\n")
+	if err := pprof.Lookup("goroutine").WriteTo(b, 2); err != nil {
+		return err
+	}
+
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+func (m *Mosdns) dumpApiHandler(w http.ResponseWriter, _ *http.Request) {
+	b := new(bytes.Buffer)
+	if err := m.WriteStateDump(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(b.Bytes())
+}
+
+// findPluginRefs returns tags of loaded plugins that are referenced in
+// plugin args, e.g. "$tag" in sequences or "entry: tag" in servers.
+func (m *Mosdns) findPluginRefs(args any) []string {
+	refs := make(map[string]struct{})
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case string:
+			if _, ok := m.plugins[v]; ok {
+				refs[v] = struct{}{}
+			}
+			for _, f := range strings.Fields(v) {
+				if tag, ok := strings.CutPrefix(f, "$"); ok {
+					if _, ok := m.plugins[tag]; ok {
+						refs[tag] = struct{}{}
+					}
+				}
+			}
+		case map[string]any:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[any]any:
+			for _, e := range v {
+				walk(e)
+			}
+		case []any:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(args)
+	if len(refs) == 0 {
+		return nil
+	}
+	s := make([]string, 0, len(refs))
+	for tag := range refs {
+		s = append(s, tag)
+	}
+	sort.Strings(s)
+	return s
+}
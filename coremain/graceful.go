@@ -0,0 +1,165 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+
+	"go.uber.org/zap"
+)
+
+// ListenerStopper is implemented by server plugins that can stop
+// accepting new queries while queries in flight are still answered.
+// In graceful reloads, it is called on the old instance before its
+// in-flight queries are drained.
+type ListenerStopper interface {
+	StopListening()
+}
+
+// HandOverer is implemented by plugins that save state on close that
+// plugins of the next instance load on start (e.g. cache dumps). In
+// graceful reloads, the next instance starts before the old one is
+// closed. So HandOver is called on the old instance first to save the
+// state, after which the plugin must not save it again. If the next
+// instance failed to start, the returned cancel func is called and the
+// plugin should work as before.
+type HandOverer interface {
+	HandOver() (cancel func())
+}
+
+type ReloadConfig struct {
+	// Graceful starts the new instance while the old one is still
+	// running. Then the old one stops accepting queries and is closed
+	// after its in-flight queries are finished. Listeners of both
+	// instances share their addresses by SO_REUSEPORT. If the new config
+	// is invalid, the old instance keeps running. If the new instance
+	// can't listen alongside the old one, the old one is closed first,
+	// as non-graceful reloads do. Default is true.
+	Graceful *bool `yaml:"graceful"`
+
+	// DrainTimeout is the max time in seconds to wait for in-flight
+	// queries of the old instance. Default is 5.
+	DrainTimeout int `yaml:"drain_timeout"`
+}
+
+func (c ReloadConfig) graceful() bool {
+	return c.Graceful == nil || *c.Graceful
+}
+
+func (c ReloadConfig) drainTimeout() time.Duration {
+	if c.DrainTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.DrainTimeout) * time.Second
+}
+
+// drain waits until m has no in-flight queries or timeout. It returns
+// the number of queries that are still in flight.
+func (m *Mosdns) drain(timeout time.Duration) int64 {
+	ddl := time.Now().Add(timeout)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		n := m.inflight.Load()
+		if n <= 0 || time.Now().After(ddl) {
+			return n
+		}
+		<-ticker.C
+	}
+}
+
+// listenAPI listens on addr for api servers. Listeners are stopped
+// before m is drained in graceful reloads.
+func (m *Mosdns) listenAPI(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sl := utils.NewStoppableListener(l)
+	m.apiListeners = append(m.apiListeners, sl)
+	return sl, nil
+}
+
+// handOver calls HandOver of all plugins of m. See HandOverer.
+func (m *Mosdns) handOver() (cancel func()) {
+	var cancels []func()
+	for tag, p := range m.plugins {
+		if h, ok := p.(HandOverer); ok {
+			m.logger.Debug("handing over plugin state", zap.String("tag", tag))
+			cancels = append(cancels, h.HandOver())
+		}
+	}
+	return func() {
+		for _, f := range cancels {
+			f()
+		}
+	}
+}
+
+// stopListening stops api servers and server plugins of m from accepting
+// new requests.
+func (m *Mosdns) stopListening() {
+	for _, l := range m.apiListeners {
+		l.Stop()
+	}
+	for tag, p := range m.plugins {
+		if s, ok := p.(ListenerStopper); ok {
+			m.logger.Info("stop listening", zap.String("tag", tag))
+			s.StopListening()
+		}
+	}
+}
+
+// startAlongside starts a new instance by start while old is still
+// running. The state of old is handed over first, and the hand over is
+// cancelled if start failed. overlap reports that start failed because
+// the new instance can't run alongside old (e.g. an address that can't
+// be shared), so old should be closed before start is tried again.
+// Otherwise, old is still valid and should keep running.
+func startAlongside(old *Mosdns, start func() (*Mosdns, *Config, error)) (newM *Mosdns, cfg *Config, overlap bool, err error) {
+	cancel := old.handOver()
+	newM, cfg, err = start()
+	if err != nil {
+		cancel()
+		return nil, nil, isAddrInUse(err), err
+	}
+	return newM, cfg, false, nil
+}
+
+// closeGracefully stops m from accepting new queries, and closes m after
+// its in-flight queries are finished or timeout. The new instance should
+// already be listening on the same addresses, so no query is refused in
+// between.
+func (m *Mosdns) closeGracefully(timeout time.Duration) {
+	m.stopListening()
+	start := time.Now()
+	if n := m.drain(timeout); n > 0 {
+		m.logger.Warn("drain timeout, closing with in-flight queries", zap.Int64("inflight", n))
+	} else {
+		m.logger.Info("in-flight queries drained", zap.Duration("elapsed", time.Since(start)))
+	}
+	m.sc.SendCloseSignal(nil)
+	_ = m.sc.WaitClosed()
+}
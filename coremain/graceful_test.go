@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type testListenerStopper struct {
+	m       *Mosdns
+	stopped bool
+}
+
+// StopListening finishes the query in flight, as a server that stopped
+// accepting new queries would.
+func (s *testListenerStopper) StopListening() {
+	s.stopped = true
+	s.m.inflight.Add(-1)
+}
+
+type testHandOverer struct {
+	handedOver, cancelled int
+}
+
+func (h *testHandOverer) HandOver() func() {
+	h.handedOver++
+	return func() { h.cancelled++ }
+}
+
+func Test_closeGracefully(t *testing.T) {
+	s := new(testListenerStopper)
+	m := NewTestMosdnsWithPlugins(map[string]any{"server": s})
+	s.m = m
+	m.inflight.Add(1)
+	l, err := m.listenAPI("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	start := time.Now()
+	m.closeGracefully(5 * time.Second)
+	if !s.stopped {
+		t.Fatal("listener was not stopped")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("listeners were not stopped before draining")
+	}
+	if c, err := net.DialTimeout("tcp", l.Addr().String(), time.Second); err == nil {
+		c.Close()
+		t.Fatal("api listener was not stopped")
+	}
+}
+
+func Test_startAlongside(t *testing.T) {
+	h := new(testHandOverer)
+	old := NewTestMosdnsWithPlugins(map[string]any{"cache": h})
+	newM := NewTestMosdnsWithPlugins(nil)
+
+	errInUse := fmt.Errorf("failed to init plugin, %w", &net.OpError{Op: "listen", Net: "udp", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)})
+	tests := []struct {
+		name        string
+		err         error
+		wantOverlap bool
+	}{
+		{"ok", nil, false},
+		{"invalid config", errors.New("invalid config"), false},
+		{"address in use", errInUse, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*h = testHandOverer{}
+			got, _, overlap, err := startAlongside(old, func() (*Mosdns, *Config, error) {
+				if h.handedOver != 1 {
+					t.Fatal("state was not handed over before the new instance starts")
+				}
+				if tt.err != nil {
+					return nil, nil, tt.err
+				}
+				return newM, new(Config), nil
+			})
+			if !errors.Is(err, tt.err) || overlap != tt.wantOverlap {
+				t.Fatalf("want err %v overlap %v, got %v %v", tt.err, tt.wantOverlap, err, overlap)
+			}
+			if tt.err == nil {
+				if got != newM || h.cancelled != 0 {
+					t.Fatal("hand over was cancelled after the new instance started")
+				}
+			} else if h.cancelled != 1 {
+				t.Fatal("hand over was not cancelled")
+			}
+		})
+	}
+}
+
+func TestHoldSystemState(t *testing.T) {
+	saved := 0
+	save := func() (string, error) {
+		saved++
+		return fmt.Sprintf("original%d", saved), nil
+	}
+	o1, release1, err := HoldSystemState("test/key", save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new instance of a graceful reload sees the state changed by
+	// the old one, but gets the original one.
+	o2, release2, err := HoldSystemState("test/key", save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o1 != "original1" || o2 != "original1" || saved != 1 {
+		t.Fatalf("unexpected original states %s %s, saved %d times", o1, o2, saved)
+	}
+	if release1() || release1() {
+		t.Fatal("old instance restored the state held by the new one")
+	}
+	if !release2() {
+		t.Fatal("the last holder should restore the state")
+	}
+	if release2() {
+		t.Fatal("release is not idempotent")
+	}
+
+	// Next holder saves the state again.
+	o3, release3, err := HoldSystemState("test/key", save)
+	if err != nil || o3 != "original2" {
+		t.Fatalf("unexpected original state %s, %v", o3, err)
+	}
+	release3()
+
+	if _, _, err := HoldSystemState("test/err", func() (int, error) { return 0, errors.New("err") }); err == nil {
+		t.Fatal("save err is not returned")
+	}
+	if _, release, err := HoldSystemState("test/err", func() (int, error) { return 1, nil }); err != nil || !release() {
+		t.Fatal("failed save should not add a holder")
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	GraphFormatDOT     = "dot"
+	GraphFormatMermaid = "mermaid"
+)
+
+type graphNode struct {
+	id   string // tag of the plugin or the upstream group
+	kind string // plugin type, or "upstream group"
+}
+
+type graphEdge struct {
+	from, to string
+	label    string
+}
+
+type configGraph struct {
+	nodes []graphNode
+	edges []graphEdge
+}
+
+// WriteConfigGraph loads the config file and its included files, and
+// writes the graph of plugins and upstream groups to w in format
+// GraphFormatDOT or GraphFormatMermaid. Plugins are not initialized.
+func WriteConfigGraph(file string, format string, w io.Writer) error {
+	cfg, _, err := loadConfig(file)
+	if err != nil {
+		return err
+	}
+	g, err := buildConfigGraph(cfg)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	switch format {
+	case GraphFormatDOT:
+		g.writeDOT(bw)
+	case GraphFormatMermaid:
+		g.writeMermaid(bw)
+	default:
+		return fmt.Errorf("unknown graph format %s", format)
+	}
+	return bw.Flush()
+}
+
+func buildConfigGraph(cfg *Config) (*configGraph, error) {
+	cfgs, err := loadConfigTree(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	g := new(configGraph)
+	macros := make(map[string]any)
+	nodes := make(map[string]struct{})
+	var plugins []PluginConfig
+	presets := len(LoadNewPersetPluginFuncs()) // Same names as newPlugin.
+	for _, c := range cfgs {
+		if err := addMacros(macros, c.Macros); err != nil {
+			return nil, err
+		}
+		for _, u := range c.Upstreams {
+			g.nodes = append(g.nodes, graphNode{id: u.Tag, kind: "upstream group"})
+			nodes[u.Tag] = struct{}{}
+		}
+		for _, pc := range c.Plugins {
+			if len(pc.Tag) == 0 {
+				pc.Tag = fmt.Sprintf("anonymouse_%s_%d", pc.Type, presets+len(plugins))
+			}
+			g.nodes = append(g.nodes, graphNode{id: pc.Tag, kind: pc.Type})
+			nodes[pc.Tag] = struct{}{}
+			plugins = append(plugins, pc)
+		}
+	}
+
+	for _, pc := range plugins {
+		args, err := expandMacros(pc.Args, macros)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s, %w", pc.Tag, err)
+		}
+		refs := make(map[graphEdge]struct{})
+		addRef := func(tag, label string) {
+			if _, ok := nodes[tag]; ok && tag != pc.Tag {
+				refs[graphEdge{from: pc.Tag, to: tag, label: label}] = struct{}{}
+			}
+		}
+		var walk func(v any, label string)
+		walk = func(v any, label string) {
+			switch v := v.(type) {
+			case string:
+				addRef(v, label)
+				fs := strings.Fields(v)
+				if label == "exec" && len(fs) == 2 && (fs[0] == "jump" || fs[0] == "goto") {
+					addRef(fs[1], fs[0])
+				}
+				for _, f := range fs {
+					if tag, ok := strings.CutPrefix(f, "$"); ok {
+						addRef(tag, label)
+					}
+				}
+			case map[string]any:
+				for k, e := range v {
+					walk(e, k)
+				}
+			case []any:
+				for _, e := range v {
+					walk(e, label)
+				}
+			}
+		}
+		walk(args, "")
+		for e := range refs {
+			g.edges = append(g.edges, e)
+		}
+	}
+	sort.Slice(g.edges, func(i, j int) bool {
+		a, b := g.edges[i], g.edges[j]
+		return a.from < b.from || a.from == b.from && (a.to < b.to || a.to == b.to && a.label < b.label)
+	})
+	return g, nil
+}
+
+func graphNodeShape(kind string) string {
+	switch {
+	case kind == "upstream group":
+		return "cylinder"
+	case kind == "sequence" || kind == "fallback":
+		return "box"
+	case strings.HasSuffix(kind, "_server"):
+		return "invhouse"
+	default:
+		return "ellipse"
+	}
+}
+
+func (g *configGraph) writeDOT(w *bufio.Writer) {
+	w.WriteString("digraph mosdns {\n\trankdir=LR;\n")
+	for _, n := range g.nodes {
+		fmt.Fprintf(w, "\t%s [label=%s shape=%s];\n", strconv.Quote(n.id), strconv.Quote(n.id+"\n"+n.kind), graphNodeShape(n.kind))
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(w, "\t%s -> %s", strconv.Quote(e.from), strconv.Quote(e.to))
+		if len(e.label) > 0 {
+			fmt.Fprintf(w, " [label=%s]", strconv.Quote(e.label))
+		}
+		w.WriteString(";\n")
+	}
+	w.WriteString("}\n")
+}
+
+func (g *configGraph) writeMermaid(w *bufio.Writer) {
+	// Tags may have characters that mermaid ids don't allow.
+	ids := make(map[string]string, len(g.nodes))
+	w.WriteString("flowchart LR\n")
+	for i, n := range g.nodes {
+		id := "n" + strconv.Itoa(i)
+		ids[n.id] = id
+		label := strings.ReplaceAll(n.id+" ("+n.kind+")", `"`, "#quot;")
+		switch graphNodeShape(n.kind) {
+		case "cylinder":
+			fmt.Fprintf(w, "\t%s[(\"%s\")]\n", id, label)
+		case "box":
+			fmt.Fprintf(w, "\t%s[\"%s\"]\n", id, label)
+		case "invhouse":
+			fmt.Fprintf(w, "\t%s[/\"%s\"\\]\n", id, label)
+		default:
+			fmt.Fprintf(w, "\t%s(\"%s\")\n", id, label)
+		}
+	}
+	for _, e := range g.edges {
+		if len(e.label) > 0 {
+			fmt.Fprintf(w, "\t%s -->|%s| %s\n", ids[e.from], e.label, ids[e.to])
+		} else {
+			fmt.Fprintf(w, "\t%s --> %s\n", ids[e.from], ids[e.to])
+		}
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const graphTestConfig = `
+macros:
+  fwd: {$macro: up}
+  up: cloudflare
+upstreams:
+  - tag: cloudflare
+    upstreams: [{addr: 1.1.1.1}]
+plugins:
+  - tag: forward_main
+    type: forward
+    args:
+      upstream_groups: [{$macro: fwd}]
+  - tag: direct_set
+    type: domain_set
+    args:
+      files: [direct.txt]
+  - tag: sub
+    type: sequence
+    args:
+      - exec: $forward_main
+  - tag: main
+    type: sequence
+    args:
+      - matches: qname $direct_set
+        exec: jump sub
+      - exec: $forward_main
+  - tag: udp
+    type: udp_server
+    args:
+      entry: main
+      listen: :53
+`
+
+func writeGraphTestConfig(t *testing.T) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(f, []byte(graphTestConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func Test_buildConfigGraph(t *testing.T) {
+	cfg, _, err := loadConfig(writeGraphTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := buildConfigGraph(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantNodes := []graphNode{
+		{id: "cloudflare", kind: "upstream group"},
+		{id: "forward_main", kind: "forward"},
+		{id: "direct_set", kind: "domain_set"},
+		{id: "sub", kind: "sequence"},
+		{id: "main", kind: "sequence"},
+		{id: "udp", kind: "udp_server"},
+	}
+	if !reflect.DeepEqual(g.nodes, wantNodes) {
+		t.Fatalf("want nodes %v, got %v", wantNodes, g.nodes)
+	}
+	wantEdges := []graphEdge{
+		{from: "forward_main", to: "cloudflare", label: "upstream_groups"}, // Through macros.
+		{from: "main", to: "direct_set", label: "matches"},
+		{from: "main", to: "forward_main", label: "exec"},
+		{from: "main", to: "sub", label: "jump"},
+		{from: "sub", to: "forward_main", label: "exec"},
+		{from: "udp", to: "main", label: "entry"},
+	}
+	if !reflect.DeepEqual(g.edges, wantEdges) {
+		t.Fatalf("want edges %v, got %v", wantEdges, g.edges)
+	}
+}
+
+func Test_WriteConfigGraph(t *testing.T) {
+	f := writeGraphTestConfig(t)
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{GraphFormatDOT, []string{
+			"digraph mosdns {\n",
+			`"cloudflare" [label="cloudflare\nupstream group" shape=cylinder];`,
+			`"main" [label="main\nsequence" shape=box];`,
+			`"udp" [label="udp\nudp_server" shape=invhouse];`,
+			`"main" -> "sub" [label="jump"];`,
+		}},
+		{GraphFormatMermaid, []string{
+			"flowchart LR\n",
+			"\tn0[(\"cloudflare (upstream group)\")]\n",
+			"\tn4[\"main (sequence)\"]\n",
+			"\tn5[/\"udp (udp_server)\"\\]\n",
+			"\tn4 -->|jump| n3\n",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			b := new(bytes.Buffer)
+			if err := WriteConfigGraph(f, tt.format, b); err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.want {
+				if !strings.Contains(b.String(), s) {
+					t.Fatalf("output does not contain %q:\n%s", s, b)
+				}
+			}
+		})
+	}
+
+	if err := WriteConfigGraph(f, "svg", new(bytes.Buffer)); err == nil {
+		t.Fatal("expect an err for the unknown format")
+	}
+}
@@ -0,0 +1,450 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain/adminpb"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// startGrpcServer starts the gRPC admin api on addr.
+func (m *Mosdns) startGrpcServer(addr string) error {
+	l, err := m.listenAPI(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen api grpc server, %w", err)
+	}
+	s := grpc.NewServer()
+	adminpb.RegisterAdminServer(s, &adminServer{m: m})
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		errChan := make(chan error, 1)
+		go func() {
+			m.logger.Info("starting api grpc server", zap.Stringer("addr", l.Addr()))
+			errChan <- s.Serve(l)
+		}()
+		select {
+		case err := <-errChan:
+			m.sc.SendCloseSignal(err)
+		case <-closeSignal:
+			s.Stop()
+		}
+	})
+	return nil
+}
+
+// adminServer serves the gRPC admin api. Calls are served in-process by
+// the http api, so they have the same authentication, roles and audit
+// logs as http requests.
+type adminServer struct {
+	adminpb.UnimplementedAdminServer
+	m *Mosdns
+}
+
+func (s *adminServer) newRequest(ctx context.Context, method, target string, body any) (*http.Request, error) {
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	r, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(b))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			r.Header.Set("Authorization", v[0])
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+	if !s.m.httpMux.Match(chi.NewRouteContext(), method, r.URL.Path) {
+		return nil, status.Errorf(codes.Unimplemented, "%s %s is not available", method, r.URL.Path)
+	}
+	return r, nil
+}
+
+// call serves the api request and returns the response body.
+func (s *adminServer) call(ctx context.Context, method, target string, body any) ([]byte, error) {
+	r, err := s.newRequest(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	w := httptest.NewRecorder()
+	s.m.httpMux.ServeHTTP(w, r)
+	if err := httpStatusErr(w.Code, w.Body.Bytes()); err != nil {
+		return nil, err
+	}
+	return w.Body.Bytes(), nil
+}
+
+// callJSON is call, and decodes the response body into out.
+func (s *adminServer) callJSON(ctx context.Context, method, target string, body, out any) error {
+	b, err := s.call(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return status.Errorf(codes.Internal, "invalid api response, %v", err)
+	}
+	return nil
+}
+
+// httpStatusErr converts an error response of the http api to a gRPC
+// status error. It returns nil if code is not an error.
+func httpStatusErr(code int, body []byte) error {
+	if code < 400 {
+		return nil
+	}
+	var c codes.Code
+	switch code {
+	case http.StatusBadRequest:
+		c = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		c = codes.Unauthenticated
+	case http.StatusForbidden:
+		c = codes.PermissionDenied
+	case http.StatusNotFound:
+		c = codes.NotFound
+	case http.StatusConflict:
+		c = codes.FailedPrecondition
+	case http.StatusNotImplemented:
+		c = codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		c = codes.Unavailable
+	default:
+		c = codes.Internal
+	}
+	return status.Error(c, strings.TrimSpace(string(body)))
+}
+
+// pluginPath returns the api path p of plugin tag.
+func (s *adminServer) pluginPath(tag, p string) (string, error) {
+	if len(tag) == 0 {
+		return "", status.Error(codes.InvalidArgument, "missing tag")
+	}
+	if s.m.GetPlugin(tag) == nil {
+		return "", status.Errorf(codes.NotFound, "plugin %s does not exist", tag)
+	}
+	return "/plugins/" + url.PathEscape(tag) + p, nil
+}
+
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func (s *adminServer) TailAudit(ctx context.Context, req *adminpb.TailAuditRequest) (*adminpb.TailAuditResponse, error) {
+	target := "/api/audit"
+	if req.GetLimit() > 0 {
+		target += "?limit=" + strconv.Itoa(int(req.GetLimit()))
+	}
+	var entries []AuditEntry
+	if err := s.callJSON(ctx, http.MethodGet, target, nil, &entries); err != nil {
+		return nil, err
+	}
+	resp := new(adminpb.TailAuditResponse)
+	for _, e := range entries {
+		resp.Entries = append(resp.Entries, &adminpb.AuditEntry{
+			Time:   timestamp(e.Time),
+			Actor:  e.Actor,
+			Method: e.Method,
+			Path:   e.Path,
+			Status: int32(e.Status),
+			Diff:   e.Diff,
+		})
+	}
+	return resp, nil
+}
+
+func (s *adminServer) ExportState(ctx context.Context, _ *adminpb.ExportStateRequest) (*adminpb.StateBundle, error) {
+	var b StateBundle
+	if err := s.callJSON(ctx, http.MethodGet, "/api/state/export", nil, &b); err != nil {
+		return nil, err
+	}
+	resp := &adminpb.StateBundle{Version: int32(b.Version), Time: timestamp(b.Time), Plugins: make(map[string][]byte)}
+	for tag, state := range b.Plugins {
+		resp.Plugins[tag] = state
+	}
+	return resp, nil
+}
+
+func (s *adminServer) ImportState(ctx context.Context, req *adminpb.StateBundle) (*adminpb.ImportStateResponse, error) {
+	b := StateBundle{Version: int(req.GetVersion()), Plugins: make(map[string]json.RawMessage)}
+	if req.GetTime() != nil {
+		b.Time = req.GetTime().AsTime()
+	}
+	for tag, state := range req.GetPlugins() {
+		if !json.Valid(state) {
+			return nil, status.Errorf(codes.InvalidArgument, "state of %s is not valid json", tag)
+		}
+		b.Plugins[tag] = state
+	}
+	if _, err := s.call(ctx, http.MethodPost, "/api/state/import", b); err != nil {
+		return nil, err
+	}
+	return new(adminpb.ImportStateResponse), nil
+}
+
+func (s *adminServer) Backup(ctx context.Context, _ *adminpb.BackupRequest) (*adminpb.BackupResponse, error) {
+	b, err := s.call(ctx, http.MethodPost, "/api/backup", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &adminpb.BackupResponse{Name: strings.TrimSpace(string(b))}, nil
+}
+
+func (s *adminServer) Dump(ctx context.Context, _ *adminpb.DumpRequest) (*adminpb.DumpResponse, error) {
+	b, err := s.call(ctx, http.MethodGet, "/api/dump", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &adminpb.DumpResponse{Report: string(b)}, nil
+}
+
+func (s *adminServer) GetReloadStatus(ctx context.Context, _ *adminpb.GetReloadStatusRequest) (*adminpb.ReloadStatus, error) {
+	var rs ReloadStatus
+	if err := s.callJSON(ctx, http.MethodGet, "/api/reload", nil, &rs); err != nil {
+		return nil, err
+	}
+	return &adminpb.ReloadStatus{
+		Time:       timestamp(rs.Time),
+		File:       rs.File,
+		Ok:         rs.Ok,
+		Error:      rs.Error,
+		RolledBack: rs.RolledBack,
+	}, nil
+}
+
+func (s *adminServer) Reload(ctx context.Context, _ *adminpb.ReloadRequest) (*adminpb.ReloadResponse, error) {
+	if _, err := s.call(ctx, http.MethodPost, "/api/reload", nil); err != nil {
+		return nil, err
+	}
+	return new(adminpb.ReloadResponse), nil
+}
+
+func (s *adminServer) GetStatsTotals(ctx context.Context, _ *adminpb.GetStatsTotalsRequest) (*adminpb.StatsTotals, error) {
+	var t query_log.TotalsSnapshot
+	if err := s.callJSON(ctx, http.MethodGet, "/api/stats/totals", nil, &t); err != nil {
+		return nil, err
+	}
+	return &adminpb.StatsTotals{
+		Since:     timestamp(t.Since),
+		Queries:   t.Queries,
+		Blocked:   t.Blocked,
+		Errors:    t.Errors,
+		Upstreams: t.Upstreams,
+	}, nil
+}
+
+func (s *adminServer) StreamQueryLog(req *adminpb.StreamQueryLogRequest, stream grpc.ServerStreamingServer[adminpb.QueryLogRecord]) error {
+	q := url.Values{}
+	if len(req.GetClient()) > 0 {
+		q.Set("client", req.GetClient())
+	}
+	if len(req.GetDomain()) > 0 {
+		q.Set("domain", req.GetDomain())
+	}
+	r, err := s.newRequest(stream.Context(), http.MethodGet, "/api/log/stream?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	w := &eventStreamWriter{header: make(http.Header), send: func(rec *query_log.Record) error {
+		return stream.Send(&adminpb.QueryLogRecord{
+			Time:        timestamp(rec.Time),
+			Client:      rec.Client,
+			ClientGroup: rec.ClientGroup,
+			ClientId:    rec.ClientID,
+			Qname:       rec.QName,
+			Qtype:       rec.QType,
+			Rcode:       rec.Rcode,
+			Answers:     rec.Answers,
+			LatencyMs:   int64(rec.LatencyMs),
+			Upstream:    rec.Upstream,
+			Rule:        rec.Rule,
+			Err:         rec.Err,
+		})
+	}}
+	s.m.httpMux.ServeHTTP(w, r)
+	if err := httpStatusErr(w.code, w.buf.Bytes()); err != nil {
+		return err
+	}
+	return w.err
+}
+
+// eventStreamWriter is a http.ResponseWriter that decodes the
+// server-sent events of queryLogStreamHandler and sends them.
+type eventStreamWriter struct {
+	header http.Header
+	code   int
+	buf    bytes.Buffer
+	send   func(rec *query_log.Record) error
+	err    error
+}
+
+var _ http.Flusher = (*eventStreamWriter)(nil)
+
+func (w *eventStreamWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *eventStreamWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *eventStreamWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.WriteHeader(http.StatusOK)
+	return w.buf.Write(b)
+}
+
+// Flush sends all complete events in the buffer.
+func (w *eventStreamWriter) Flush() {
+	if w.code != http.StatusOK {
+		return
+	}
+	for w.err == nil {
+		event, rest, ok := bytes.Cut(w.buf.Bytes(), []byte("\n\n"))
+		if !ok {
+			return
+		}
+		if data, ok := bytes.CutPrefix(event, []byte("data: ")); ok {
+			rec := new(query_log.Record)
+			if err := json.Unmarshal(data, rec); err != nil {
+				w.err = status.Errorf(codes.Internal, "invalid query log event, %v", err)
+			} else if err := w.send(rec); err != nil {
+				w.err = err
+			}
+		}
+		w.buf.Next(len(w.buf.Bytes()) - len(rest))
+	}
+}
+
+func (s *adminServer) GetHitStats(ctx context.Context, req *adminpb.PluginRequest) (*adminpb.HitStats, error) {
+	p, err := s.pluginPath(req.GetTag(), "/hits")
+	if err != nil {
+		return nil, err
+	}
+	var hs struct {
+		QueryTotal uint64 `json:"query_total"`
+		HitTotal   uint64 `json:"hit_total"`
+	}
+	if err := s.callJSON(ctx, http.MethodGet, p, nil, &hs); err != nil {
+		return nil, err
+	}
+	return &adminpb.HitStats{QueryTotal: hs.QueryTotal, HitTotal: hs.HitTotal}, nil
+}
+
+func (s *adminServer) ListRules(ctx context.Context, req *adminpb.PluginRequest) (*adminpb.ListRulesResponse, error) {
+	p, err := s.pluginPath(req.GetTag(), "/rules")
+	if err != nil {
+		return nil, err
+	}
+	// Rules of domain_set have "exp", and rules of ip_set have "ip".
+	var rules []struct {
+		Exp    string     `json:"exp"`
+		IP     string     `json:"ip"`
+		Expiry *time.Time `json:"expiry"`
+	}
+	if err := s.callJSON(ctx, http.MethodGet, p, nil, &rules); err != nil {
+		return nil, err
+	}
+	resp := new(adminpb.ListRulesResponse)
+	for _, r := range rules {
+		pr := &adminpb.Rule{Exp: r.Exp}
+		if len(pr.Exp) == 0 {
+			pr.Exp = r.IP
+		}
+		if r.Expiry != nil {
+			pr.Expiry = timestamppb.New(*r.Expiry)
+		}
+		resp.Rules = append(resp.Rules, pr)
+	}
+	return resp, nil
+}
+
+func (s *adminServer) AddRule(ctx context.Context, req *adminpb.AddRuleRequest) (*adminpb.AddRuleResponse, error) {
+	p, err := s.pluginPath(req.GetTag(), "/rules")
+	if err != nil {
+		return nil, err
+	}
+	body := map[string]any{"exp": req.GetExp(), "ip": req.GetExp(), "ttl": req.GetTtl()}
+	if _, err := s.call(ctx, http.MethodPost, p, body); err != nil {
+		return nil, err
+	}
+	return new(adminpb.AddRuleResponse), nil
+}
+
+func (s *adminServer) DeleteRule(ctx context.Context, req *adminpb.DeleteRuleRequest) (*adminpb.DeleteRuleResponse, error) {
+	p, err := s.pluginPath(req.GetTag(), "/rules")
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{"exp": {req.GetExp()}, "ip": {req.GetExp()}}
+	if _, err := s.call(ctx, http.MethodDelete, p+"?"+q.Encode(), nil); err != nil {
+		return nil, err
+	}
+	return new(adminpb.DeleteRuleResponse), nil
+}
+
+func (s *adminServer) FlushCache(ctx context.Context, req *adminpb.PluginRequest) (*adminpb.FlushCacheResponse, error) {
+	p, err := s.pluginPath(req.GetTag(), "/flush")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.call(ctx, http.MethodGet, p, nil); err != nil {
+		return nil, err
+	}
+	return new(adminpb.FlushCacheResponse), nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain/adminpb"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	"github.com/go-chi/chi/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func Test_adminServer(t *testing.T) {
+	m := NewTestMosdnsWithPlugins(map[string]any{"set": struct{}{}})
+	m.queryLog = query_log.NewHub()
+	auth, err := newApiAuth([]APIUserConfig{
+		{Name: "v", Token: "vt", Role: "viewer"},
+		{Name: "a", Token: "at", Role: "admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.auth = auth
+	m.initHttpMux()
+
+	// A plugin with runtime rules.
+	var rules []map[string]any
+	pm := chi.NewRouter()
+	pm.Get("/rules", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(rules)
+	})
+	pm.Post("/rules", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Exp string `json:"exp"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		rules = append(rules, map[string]any{"exp": body.Exp})
+	})
+	m.RegPluginAPI("set", pm)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	adminpb.RegisterAdminServer(s, &adminServer{m: m})
+	go s.Serve(l)
+	defer s.Stop()
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := adminpb.NewAdminClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	as := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+	wantCode := func(err error, code codes.Code) {
+		t.Helper()
+		if status.Code(err) != code {
+			t.Fatalf("want code %s, got err %v", code, err)
+		}
+	}
+
+	_, err = c.ExportState(ctx, &adminpb.ExportStateRequest{})
+	wantCode(err, codes.Unauthenticated)
+	_, err = c.ExportState(as("vt"), &adminpb.ExportStateRequest{})
+	wantCode(err, codes.PermissionDenied)
+	b, err := c.ExportState(as("at"), &adminpb.ExportStateRequest{})
+	wantCode(err, codes.OK)
+	if b.GetVersion() != stateBundleVersion {
+		t.Fatalf("unexpected state bundle %v", b)
+	}
+
+	_, err = c.AddRule(as("at"), &adminpb.AddRuleRequest{Tag: "set", Exp: "example.com"})
+	wantCode(err, codes.OK)
+	lr, err := c.ListRules(as("vt"), &adminpb.PluginRequest{Tag: "set"})
+	wantCode(err, codes.OK)
+	if len(lr.GetRules()) != 1 || lr.GetRules()[0].GetExp() != "example.com" {
+		t.Fatalf("unexpected rules %v", lr.GetRules())
+	}
+	_, err = c.GetHitStats(as("vt"), &adminpb.PluginRequest{Tag: "set"})
+	wantCode(err, codes.Unimplemented)
+	_, err = c.GetHitStats(as("vt"), &adminpb.PluginRequest{Tag: "missing"})
+	wantCode(err, codes.NotFound)
+	_, err = c.GetStatsTotals(as("vt"), &adminpb.GetStatsTotalsRequest{})
+	wantCode(err, codes.Unimplemented)
+
+	// Denied calls and mutations are audited like http requests.
+	ta, err := c.TailAudit(as("at"), &adminpb.TailAuditRequest{Limit: 10})
+	wantCode(err, codes.OK)
+	var denied, added bool
+	for _, e := range ta.GetEntries() {
+		denied = denied || (e.GetStatus() == http.StatusForbidden && e.GetActor() == "user:v")
+		added = added || (e.GetMethod() == http.MethodPost && e.GetPath() == "/plugins/set/rules")
+	}
+	if !denied || !added {
+		t.Fatalf("missing audit entries, %v", ta.GetEntries())
+	}
+
+	stream, err := c.StreamQueryLog(as("vt"), &adminpb.StreamQueryLogRequest{Domain: "example.com"})
+	wantCode(err, codes.OK)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond * 10):
+				m.queryLog.Publish(&query_log.Record{QName: "other.test.", QType: "A"})
+				m.queryLog.Publish(&query_log.Record{QName: "www.example.com.", QType: "AAAA"})
+			}
+		}
+	}()
+	rec, err := stream.Recv()
+	wantCode(err, codes.OK)
+	if rec.GetQname() != "www.example.com." || rec.GetQtype() != "AAAA" {
+		t.Fatalf("unexpected record %v", rec)
+	}
+}
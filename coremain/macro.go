@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// macroKey refers to a macro in plugin args. A map {$macro: name} is
+// replaced by the macro. If the map has other keys, the macro must be a
+// map, and other keys are merged into (override) a copy of it. In lists,
+// an element {$macro: name} whose macro is a list is replaced by the
+// elements of the macro, so lists can be concatenated.
+const macroKey = "$macro"
+
+// Macros may refer to other macros. This limits the depth, so a macro
+// that refers to itself is an error.
+const maxMacroDepth = 16
+
+// expandMacros returns a copy of v, which is a value decoded from yaml,
+// with macro references replaced. Macro names are case-insensitive.
+func expandMacros(v any, macros map[string]any) (any, error) {
+	return expandMacrosDepth(v, macros, 0)
+}
+
+func lookupMacro(name any, macros map[string]any, depth int) (any, error) {
+	s, ok := name.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid macro name %v", name)
+	}
+	mv, ok := macros[strings.ToLower(s)]
+	if !ok {
+		return nil, fmt.Errorf("undefined macro %s", s)
+	}
+	if depth >= maxMacroDepth {
+		return nil, fmt.Errorf("macro %s: maximum depth reached, macros may refer to each other", s)
+	}
+	mv, err := expandMacrosDepth(mv, macros, depth+1)
+	if err != nil {
+		return nil, fmt.Errorf("macro %s: %w", s, err)
+	}
+	return mv, nil
+}
+
+func expandMacrosDepth(v any, macros map[string]any, depth int) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		var out map[string]any
+		if name, ok := v[macroKey]; ok {
+			mv, err := lookupMacro(name, macros, depth)
+			if err != nil {
+				return nil, err
+			}
+			if len(v) == 1 {
+				return mv, nil
+			}
+			base, ok := mv.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("macro %v is not a map, it cannot have other keys", name)
+			}
+			out = base // base is a copy.
+		} else {
+			out = make(map[string]any, len(v))
+		}
+		for k, e := range v {
+			if k == macroKey {
+				continue
+			}
+			d, err := expandMacrosDepth(e, macros, depth)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			out[k] = d
+		}
+		return out, nil
+	case []any:
+		out := make([]any, 0, len(v))
+		for i, e := range v {
+			if m, ok := e.(map[string]any); ok && len(m) == 1 && m[macroKey] != nil {
+				mv, err := lookupMacro(m[macroKey], macros, depth)
+				if err != nil {
+					return nil, fmt.Errorf("#%d: %w", i, err)
+				}
+				if l, ok := mv.([]any); ok {
+					out = append(out, l...)
+				} else {
+					out = append(out, mv)
+				}
+				continue
+			}
+			d, err := expandMacrosDepth(e, macros, depth)
+			if err != nil {
+				return nil, fmt.Errorf("#%d: %w", i, err)
+			}
+			out = append(out, d)
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// addMacros adds macros of a config to dst.
+func addMacros(dst map[string]any, macros map[string]any) error {
+	for name, v := range macros {
+		name = strings.ToLower(name)
+		if len(name) == 0 {
+			return errors.New("macro has an empty name")
+		}
+		if _, dup := dst[name]; dup {
+			return fmt.Errorf("duplicated macro %s", name)
+		}
+		dst[name] = v
+	}
+	return nil
+}
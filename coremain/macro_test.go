@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_expandMacros(t *testing.T) {
+	macros := map[string]any{
+		"ups":    []any{"1.1.1.1", "8.8.8.8"},
+		"base":   map[string]any{"concurrent": 2, "upstreams": map[string]any{"$macro": "UPS"}},
+		"self":   map[string]any{"$macro": "self"},
+		"scalar": "v",
+	}
+	tests := []struct {
+		name    string
+		v       any
+		want    any
+		wantErr bool
+	}{
+		{"scalar", map[string]any{"$macro": "scalar"}, "v", false},
+		{"case insensitive", map[string]any{"$macro": "SCALAR"}, "v", false},
+		{"nested", map[string]any{"a": map[string]any{"$macro": "base"}}, map[string]any{"a": map[string]any{"concurrent": 2, "upstreams": []any{"1.1.1.1", "8.8.8.8"}}}, false},
+		{"merge", map[string]any{"$macro": "base", "concurrent": 4}, map[string]any{"concurrent": 4, "upstreams": []any{"1.1.1.1", "8.8.8.8"}}, false},
+		{"concat", []any{"9.9.9.9", map[string]any{"$macro": "ups"}}, []any{"9.9.9.9", "1.1.1.1", "8.8.8.8"}, false},
+		{"list element", []any{map[string]any{"$macro": "scalar"}}, []any{"v"}, false},
+		{"no macro", map[string]any{"a": []any{1, "b"}}, map[string]any{"a": []any{1, "b"}}, false},
+		{"undefined", map[string]any{"$macro": "undefined"}, nil, true},
+		{"invalid name", map[string]any{"$macro": 1}, nil, true},
+		{"self reference", map[string]any{"$macro": "self"}, nil, true},
+		{"merge non-map", map[string]any{"$macro": "ups", "a": 1}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandMacros(tt.v, macros)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandMacros() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	// Merging must not modify the macro.
+	if _, err := expandMacros(map[string]any{"$macro": "base", "concurrent": 4}, macros); err != nil {
+		t.Fatal(err)
+	}
+	if c := macros["base"].(map[string]any)["concurrent"]; c != 2 {
+		t.Fatalf("macro was modified, concurrent = %v", c)
+	}
+}
+
+func Test_addMacros(t *testing.T) {
+	dst := make(map[string]any)
+	if err := addMacros(dst, map[string]any{"A": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dst["a"]; !ok {
+		t.Fatal("macro name is not lower cased")
+	}
+	if err := addMacros(dst, map[string]any{"a": 2}); err == nil {
+		t.Fatal("expect an err for the duplicated macro")
+	}
+	if err := addMacros(dst, map[string]any{"": 2}); err == nil {
+		t.Fatal("expect an err for the empty name")
+	}
+}
+
+// Macros defined in included files can be used by the main config.
+func Test_NewMosdns_macros(t *testing.T) {
+	dir := t.TempDir()
+	inc := filepath.Join(dir, "inc.yaml")
+	main := filepath.Join(dir, "main.yaml")
+	write := func(f, s string) {
+		t.Helper()
+		if err := os.WriteFile(f, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(inc, "macros:\n  val: from_include\n")
+	write(main, "log:\n  level: error\ninclude: ["+inc+"]\nplugins:\n  - tag: p\n    type: rollback_test\n    args:\n      v: {$macro: val}\n")
+
+	cfg, _, err := loadConfig(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMosdns(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		m.sc.SendCloseSignal(nil)
+		_ = m.sc.WaitClosed()
+	})
+	if v := m.GetPlugin("p").(*rollbackTestArgs).V; v != "from_include" {
+		t.Fatalf("unexpected args %q", v)
+	}
+
+	// Macros with the same name in different files are errors.
+	write(main, "log:\n  level: error\ninclude: ["+inc+"]\nmacros:\n  val: dup\n")
+	cfg, _, err = loadConfig(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMosdns(cfg); err == nil {
+		t.Fatal("expect an err for the duplicated macro")
+	}
+}
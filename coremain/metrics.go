@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// MetricsConfig configures the metrics server. The /metrics entry of
+// the api server is always available.
+type MetricsConfig struct {
+	// Listen starts a dedicated http server that only serves /metrics,
+	// e.g. "127.0.0.1:9153". It has no authentication, so the api
+	// can be kept private while metrics are scraped.
+	Listen string `yaml:"listen"`
+
+	// PluginLatency measures the execution time of plugins that are
+	// referred by tags in sequences. Recursive plugins (e.g. cache) are
+	// not measured because their time includes the rest of the sequence.
+	PluginLatency bool `yaml:"plugin_latency"`
+
+	// Analysis measures the cost and match rate of every matcher and
+	// executable in sequences, so sequences can suggest cheaper matcher
+	// orders. It adds some overhead to every query.
+	Analysis bool `yaml:"analysis"`
+}
+
+// MetricsProvider can be implemented by plugins. Collectors returned by
+// Metrics are registered after the plugin is initialized, with a prefix
+// of "mosdns_<plugin type>_" and a "tag" label.
+type MetricsProvider interface {
+	Metrics() []prometheus.Collector
+}
+
+// regPluginMetrics registers collectors of plugin p if it implements
+// MetricsProvider.
+func (m *Mosdns) regPluginMetrics(tag, typ string, p any) error {
+	mp, ok := p.(MetricsProvider)
+	if !ok {
+		return nil
+	}
+	r := prometheus.WrapRegistererWith(prometheus.Labels{"tag": tag}, prometheus.WrapRegistererWithPrefix(typ+"_", m.GetMetricsReg()))
+	for _, c := range mp.Metrics() {
+		if err := r.Register(c); err != nil {
+			return fmt.Errorf("failed to register metrics, %w", err)
+		}
+	}
+	return nil
+}
+
+func newPluginLatency() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mosdns_plugin_exec_duration_seconds",
+		Help:    "The execution time of plugins in sequences",
+		Buckets: []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+	}, []string{"tag"})
+}
+
+// PluginLatencyObserver returns the observer of execution time of plugin
+// tag. It returns nil if plugin latency is disabled.
+func (m *Mosdns) PluginLatencyObserver(tag string) prometheus.Observer {
+	if m.pluginLatency == nil {
+		return nil
+	}
+	return m.pluginLatency.WithLabelValues(tag)
+}
+
+// AnalysisEnabled reports whether sequences should measure their rules.
+func (m *Mosdns) AnalysisEnabled() bool {
+	return m.analysis
+}
+
+// startMetricsServer starts the dedicated metrics server if it's configured.
+func (m *Mosdns) startMetricsServer(cfg MetricsConfig) error {
+	if len(cfg.Listen) == 0 {
+		return nil
+	}
+	l, err := m.listenAPI(cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen metrics http server, %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.metricsReg, promhttp.HandlerOpts{}))
+	httpServer := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 5,
+	}
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		errChan := make(chan error, 1)
+		go func() {
+			m.logger.Info("starting metrics http server", zap.Stringer("addr", l.Addr()))
+			errChan <- httpServer.Serve(l)
+		}()
+		select {
+		case err := <-errChan:
+			m.sc.SendCloseSignal(err)
+		case <-closeSignal:
+			_ = httpServer.Close()
+		}
+	})
+	return nil
+}
@@ -24,26 +24,68 @@ import (
 	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
 	"github.com/IrineSistiana/mosdns/v5/pkg/safe_close"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/go-chi/chi/v5"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"io"
 	"net/http"
 	"net/http/pprof"
+	"sync/atomic"
+	"time"
 )
 
 type Mosdns struct {
 	logger *zap.Logger // non-nil logger.
+	cfg    *Config     // The main config. Maybe nil.
 
 	// Plugins
 	plugins map[string]any
+	// Types and dependencies of plugins from configs. Tag -> type/tags.
+	pluginTypes map[string]string
+	pluginDeps  map[string][]string
+
+	// Upstream groups from the config. Tag -> upstream configs.
+	upstreamGroups map[string][]any
+	// Tags of upstream groups that were referenced by plugins.
+	usedUpstreamGroups map[string]struct{}
 
 	httpMux    *chi.Mux
 	metricsReg *prometheus.Registry
+	audit      *auditLog
+	auth       *apiAuth
 	sc         *safe_close.SafeClose
+
+	// Listeners of api, grpc and metrics servers.
+	apiListeners []*utils.StoppableListener
+
+	// Execution time of plugins. Nil if it's disabled.
+	pluginLatency *prometheus.HistogramVec
+	analysis      bool
+
+	// Number of queries that are being processed by server handlers.
+	inflight atomic.Int64
+	queryLog *query_log.Hub
+	totals   *query_log.Totals // maybe nil
+
+	// queryObservers are called by server handlers with the record of
+	// every finished query. They must be added before plugins are loaded.
+	queryObservers []func(r *query_log.Record)
+
+	recentErrs *mlog.RecentCore // maybe nil
+	startTime  time.Time
+
+	// Config files that were loaded, including included files.
+	configFiles []string
+	backup      *backupper // maybe nil
+	storages    remote.Storages
 }
 
 // NewMosdns initializes a mosdns instance and its plugins.
@@ -54,28 +96,79 @@ func NewMosdns(cfg *Config) (*Mosdns, error) {
 		return nil, fmt.Errorf("failed to init logger: %w", err)
 	}
 
+	auth, err := newApiAuth(cfg.API.Users)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init api users: %w", err)
+	}
+
+	storages, err := remote.NewStorages(cfg.Storages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init storages: %w", err)
+	}
+
+	backup, err := newBackupper(cfg.Backup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init backup: %w", err)
+	}
+
+	// Keep recent errors and warnings for state dumps.
+	recentErrs := mlog.NewRecentCore(maxDumpRecentErrors, zapcore.WarnLevel)
+	lg = lg.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(c, recentErrs)
+	}))
+
 	m := &Mosdns{
-		logger:     lg,
-		plugins:    make(map[string]any),
-		httpMux:    chi.NewRouter(),
-		metricsReg: newMetricsReg(),
-		sc:         safe_close.NewSafeClose(),
+		logger:             lg,
+		cfg:                cfg,
+		recentErrs:         recentErrs,
+		startTime:          time.Now(),
+		plugins:            make(map[string]any),
+		pluginTypes:        make(map[string]string),
+		pluginDeps:         make(map[string][]string),
+		upstreamGroups:     make(map[string][]any),
+		usedUpstreamGroups: make(map[string]struct{}),
+		httpMux:            chi.NewRouter(),
+		metricsReg:         newMetricsReg(),
+		audit:              newAuditLog(cfg.API.AuditLog),
+		auth:               auth,
+		sc:                 safe_close.NewSafeClose(),
+		backup:             backup,
+		storages:           storages,
+		queryLog:           query_log.NewHub(),
+	}
+	if len(cfg.file) > 0 {
+		m.configFiles = append(m.configFiles, cfg.file)
+	}
+	if cfg.Metrics.PluginLatency {
+		m.pluginLatency = newPluginLatency()
+		m.metricsReg.MustRegister(m.pluginLatency)
 	}
-	// This must be called after m.httpMux and m.metricsReg been set.
+	m.analysis = cfg.Metrics.Analysis
+	// This must be called after m.httpMux, m.metricsReg, m.audit and m.auth been set.
 	m.initHttpMux()
+	if err := m.initStats(cfg.Stats); err != nil {
+		m.sc.SendCloseSignal(err)
+		_ = m.sc.WaitClosed()
+		return nil, err
+	}
 
 	// Start http api server
 	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
+		// Listen synchronously, so a graceful reload can tell whether the
+		// new instance is able to run alongside the old one.
+		l, err := m.listenAPI(httpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen api http server, %w", err)
+		}
 		httpServer := &http.Server{
-			Addr:    httpAddr,
 			Handler: m.httpMux,
 		}
 		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 			defer done()
 			errChan := make(chan error, 1)
 			go func() {
-				m.logger.Info("starting api http server", zap.String("addr", httpAddr))
-				errChan <- httpServer.ListenAndServe()
+				m.logger.Info("starting api http server", zap.Stringer("addr", l.Addr()))
+				errChan <- httpServer.Serve(l)
 			}()
 			select {
 			case err := <-errChan:
@@ -86,6 +179,20 @@ func NewMosdns(cfg *Config) (*Mosdns, error) {
 		})
 	}
 
+	if grpcAddr := cfg.API.GRPC; len(grpcAddr) > 0 {
+		if err := m.startGrpcServer(grpcAddr); err != nil {
+			m.sc.SendCloseSignal(err)
+			_ = m.sc.WaitClosed()
+			return nil, err
+		}
+	}
+
+	if err := m.startMetricsServer(cfg.Metrics); err != nil {
+		m.sc.SendCloseSignal(err)
+		_ = m.sc.WaitClosed()
+		return nil, err
+	}
+
 	// Load plugins.
 
 	// Close all plugins on signal.
@@ -112,13 +219,18 @@ func NewMosdns(cfg *Config) (*Mosdns, error) {
 		return nil, err
 	}
 	// Plugins from config.
-	if err := m.loadPluginsFromCfg(cfg, 0); err != nil {
+	if err := m.loadPluginsFromCfg(cfg); err != nil {
 		m.sc.SendCloseSignal(err)
 		_ = m.sc.WaitClosed()
 		return nil, err
 	}
 	m.logger.Info("all plugins are loaded")
 
+	m.startDiagnostics(cfg.Diagnostics)
+	m.startDumpOnSignal(cfg.Diagnostics.DumpDir)
+	m.startBackup()
+	m.startDataFileWatcher()
+
 	return m, nil
 }
 
@@ -129,6 +241,7 @@ func NewTestMosdnsWithPlugins(p map[string]any) *Mosdns {
 		httpMux:    chi.NewRouter(),
 		plugins:    p,
 		metricsReg: newMetricsReg(),
+		audit:      newAuditLog(""),
 		sc:         safe_close.NewSafeClose(),
 	}
 }
@@ -152,11 +265,63 @@ func (m *Mosdns) GetPlugin(tag string) any {
 	return m.plugins[tag]
 }
 
+// QueryLogHub returns the hub of live query logs. Server handlers
+// should publish records to it.
+func (m *Mosdns) QueryLogHub() *query_log.Hub {
+	return m.queryLog
+}
+
+// QueryObserver returns a func that server handlers should call with the
+// record of every finished query. It returns nil if no one observes
+// queries, so handlers don't need to build records.
+func (m *Mosdns) QueryObserver() func(r *query_log.Record) {
+	obs := m.queryObservers
+	switch len(obs) {
+	case 0:
+		return nil
+	case 1:
+		return obs[0]
+	}
+	return func(r *query_log.Record) {
+		for _, f := range obs {
+			f(r)
+		}
+	}
+}
+
+// GetUpstreamGroup returns the raw upstream configs of the upstream group
+// that was defined in the top-level "upstreams" section.
+// Groups that are not referenced by any plugin are config errors, so
+// plugins that support upstream groups must get them by this method.
+func (m *Mosdns) GetUpstreamGroup(tag string) ([]any, bool) {
+	g, ok := m.upstreamGroups[tag]
+	if ok {
+		m.usedUpstreamGroups[tag] = struct{}{}
+	}
+	return g, ok
+}
+
+// Storages returns the storages of this instance. Plugins must read
+// their data files from it. It is safe to call on a nil *Mosdns, which
+// can only read local files.
+func (m *Mosdns) Storages() remote.Storages {
+	if m == nil {
+		return nil
+	}
+	return m.storages
+}
+
 // GetMetricsReg returns a prometheus.Registerer with a prefix of "mosdns_"
 func (m *Mosdns) GetMetricsReg() prometheus.Registerer {
 	return prometheus.WrapRegistererWithPrefix("mosdns_", m.metricsReg)
 }
 
+// InflightCounter returns the counter of queries that are being
+// processed. Server handlers should update it.
+func (m *Mosdns) InflightCounter() *atomic.Int64 {
+	return &m.inflight
+}
+
 func (m *Mosdns) GetAPIRouter() *chi.Mux {
 	return m.httpMux
 }
@@ -169,16 +334,74 @@ func newMetricsReg() *prometheus.Registry {
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	reg.MustRegister(collectors.NewGoCollector())
+	regIngressMetrics(reg)
 	return reg
 }
 
-// initHttpMux initializes api entries. It MUST be called after m.metricsReg being initialized.
+// regIngressMetrics registers counters of queries that were rejected by
+// server.UnpackQuery.
+func regIngressMetrics(reg prometheus.Registerer) {
+	reasons := [...]struct {
+		name string
+		f    func(s server.IngressStats) uint64
+	}{
+		{"too_small", func(s server.IngressStats) uint64 { return s.TooSmall }},
+		{"too_large", func(s server.IngressStats) uint64 { return s.TooLarge }},
+		{"not_query", func(s server.IngressStats) uint64 { return s.NotQuery }},
+		{"invalid_count", func(s server.IngressStats) uint64 { return s.InvalidCount }},
+		{"malformed", func(s server.IngressStats) uint64 { return s.Malformed }},
+	}
+	for _, r := range reasons {
+		f := r.f
+		reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "mosdns_ingress_rejected_total",
+			Help:        "The total number of queries from clients that were rejected before processing",
+			ConstLabels: map[string]string{"reason": r.name},
+		}, func() float64 { return float64(f(server.ReadIngressStats())) }))
+	}
+}
+
+// initHttpMux initializes api entries. It MUST be called after m.metricsReg, m.audit and m.auth being initialized.
 func (m *Mosdns) initHttpMux() {
+	// Middlewares must be registered before any route.
+	m.httpMux.Use(m.authMiddleware, m.auditMiddleware)
+
+	// Register audit log.
+	m.httpMux.With(RequireRole(RoleAdmin)).Get("/api/audit", m.auditApiHandler)
+
+	// Register runtime state export and import.
+	m.httpMux.Route("/api/state", func(r chi.Router) {
+		r.Use(RequireRole(RoleAdmin))
+		r.Get("/export", m.exportStateApiHandler)
+		r.Post("/import", m.importStateApiHandler)
+		r.Post("/data", m.loadDataApiHandler)
+		r.Get("/config_files", m.configFilesApiHandler)
+	})
+	m.httpMux.With(RequireRole(RoleAdmin)).Post("/api/backup", m.backupApiHandler)
+	m.httpMux.With(RequireRole(RoleAdmin)).Get("/api/dump", m.dumpApiHandler)
+
+	// Register the status of the latest config reload, and a trigger.
+	m.httpMux.Get("/api/reload", m.reloadStatusApiHandler)
+	m.httpMux.Post("/api/reload", m.reloadApiHandler)
+
+	// Register runtime inspection and control.
+	m.httpMux.Get("/api/plugins", m.pluginsApiHandler)
+	m.httpMux.With(RequireRole(RoleAdmin)).Get("/api/config", m.configApiHandler)
+	m.httpMux.Post("/api/cache/flush", m.flushApiHandler)
+	m.httpMux.Post("/api/data/reload", m.reloadDataApiHandler)
+
+	// Register live query log.
+	m.httpMux.Get("/api/log/stream", m.queryLogStreamHandler)
+	if m.cfg != nil && m.cfg.API.Dashboard {
+		m.initDashboard(m.cfg.API.DashboardSize)
+	}
+
 	// Register metrics.
 	m.httpMux.Method(http.MethodGet, "/metrics", promhttp.HandlerFor(m.metricsReg, promhttp.HandlerOpts{}))
 
 	// Register pprof.
 	m.httpMux.Route("/debug/pprof", func(r chi.Router) {
+		r.Use(RequireRole(RoleAdmin))
 		r.Get("/*", pprof.Index)
 		r.Get("/cmdline", pprof.Cmdline)
 		r.Get("/profile", pprof.Profile)
@@ -215,30 +438,109 @@ func (m *Mosdns) loadPresetPlugins() error {
 	return nil
 }
 
-// loadPluginsFromCfg loads plugins from this config. It follows include first.
-func (m *Mosdns) loadPluginsFromCfg(cfg *Config, includeDepth int) error {
-	const maxIncludeDepth = 8
-	if includeDepth > maxIncludeDepth {
-		return errors.New("maximum include depth reached")
+// loadPluginsFromCfg loads plugins from this config and included configs.
+// Included configs are loaded first. Macros and upstream groups of all
+// configs are loaded before plugins.
+func (m *Mosdns) loadPluginsFromCfg(cfg *Config) error {
+	cfgs, err := loadConfigTree(cfg, func(path string) {
+		m.logger.Info("load config", zap.String("file", path))
+		m.configFiles = append(m.configFiles, path)
+	})
+	if err != nil {
+		return err
 	}
-	includeDepth++
 
-	// Follow include first.
-	for _, s := range cfg.Include {
-		subCfg, path, err := loadConfig(s)
-		if err != nil {
-			return fmt.Errorf("failed to read config from %s, %w", s, err)
+	macros := make(map[string]any)
+	for _, c := range cfgs {
+		if err := addMacros(macros, c.Macros); err != nil {
+			return fmt.Errorf("invalid macros in %s, %w", c.file, err)
 		}
-		m.logger.Info("load config", zap.String("file", path))
-		if err := m.loadPluginsFromCfg(subCfg, includeDepth); err != nil {
-			return fmt.Errorf("failed to load config from %s, %w", s, err)
+		for i, g := range c.Upstreams {
+			if len(g.Tag) == 0 {
+				return fmt.Errorf("upstream group #%d has no tag", i)
+			}
+			if _, dup := m.upstreamGroups[g.Tag]; dup {
+				return fmt.Errorf("duplicated upstream group tag %s", g.Tag)
+			}
+			m.upstreamGroups[g.Tag] = g.Upstreams
+		}
+	}
+
+	for _, c := range cfgs {
+		for i, pc := range c.Plugins {
+			if len(macros) > 0 {
+				args, err := expandMacros(pc.Args, macros)
+				if err != nil {
+					return fmt.Errorf("failed to expand macros of plugin #%d %s, %w", i, pc.Tag, err)
+				}
+				pc.Args = args
+			}
+			if err := m.newPlugin(pc); err != nil {
+				return fmt.Errorf("failed to init plugin #%d %s, %w", i, pc.Tag, err)
+			}
 		}
 	}
 
-	for i, pc := range cfg.Plugins {
-		if err := m.newPlugin(pc); err != nil {
-			return fmt.Errorf("failed to init plugin #%d %s, %w", i, pc.Tag, err)
+	// Upstream groups are only supported by some plugins (e.g. forward).
+	// An unreferenced group is likely a typo or an unsupported use.
+	for _, c := range cfgs {
+		for _, g := range c.Upstreams {
+			if _, ok := m.usedUpstreamGroups[g.Tag]; !ok {
+				return fmt.Errorf("upstream group %s is not used by any plugin, only forward supports upstream groups", g.Tag)
+			}
 		}
 	}
 	return nil
 }
+
+// loadConfigTree returns cfg and configs it includes, included configs
+// first. onLoad, if not nil, is called with the path of each included
+// config file.
+// Included files are only read once, the resolved tree is kept in cfg.
+// So an instance started again from cfg (e.g. a rollback) has the same
+// configs, even if included files were changed since.
+func loadConfigTree(cfg *Config, onLoad func(path string)) ([]*Config, error) {
+	if cfg.tree == nil {
+		cfgs, err := resolveConfigTree(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cfg.tree = cfgs
+	}
+	if onLoad != nil {
+		for _, c := range cfg.tree[:len(cfg.tree)-1] {
+			onLoad(c.file)
+		}
+	}
+	return cfg.tree, nil
+}
+
+func resolveConfigTree(cfg *Config) ([]*Config, error) {
+	const maxIncludeDepth = 8
+	var cfgs []*Config
+	var load func(cfg *Config, depth int) error
+	load = func(cfg *Config, depth int) error {
+		if depth > maxIncludeDepth {
+			return errors.New("maximum include depth reached")
+		}
+		cacheDir := cfg.cacheDir
+		if len(cacheDir) == 0 { // not loaded from a file, e.g. by ParseConfig
+			cacheDir = remoteConfigCacheDir
+		}
+		for _, s := range cfg.Include {
+			subCfg, _, err := loadConfigIn(s, cacheDir)
+			if err != nil {
+				return fmt.Errorf("failed to read config from %s, %w", s, err)
+			}
+			if err := load(subCfg, depth+1); err != nil {
+				return fmt.Errorf("failed to load config from %s, %w", s, err)
+			}
+		}
+		cfgs = append(cfgs, cfg)
+		return nil
+	}
+	if err := load(cfg, 0); err != nil {
+		return nil, err
+	}
+	return cfgs, nil
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// takeoverTimeout is how long --force-takeover waits for the old
+// instance to exit.
+const takeoverTimeout = time.Second * 10
+
+// pidFile is a locked file that contains the pid of the running instance.
+// It prevents a second instance from being started with the same config.
+type pidFile struct {
+	path string
+	f    *os.File
+}
+
+// defaultPidFilePath returns a pid file path in the dir of pidFileDir
+// that is derived from the config path, so instances with different
+// configs don't conflict.
+func defaultPidFilePath(sf *serverFlags) (string, error) {
+	id := sf.c
+	if !isRemoteConfig(id) {
+		dir, _ := os.Getwd() // it has been changed to sf.dir
+		if len(id) == 0 {
+			id = "config" // config is auto searched in the working dir.
+		}
+		if !filepath.IsAbs(id) {
+			id = filepath.Join(dir, id)
+		}
+		id = filepath.Clean(id)
+	}
+	dir, err := pidFileDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the pid file dir, %w", err)
+	}
+	h := sha256.Sum256([]byte(id))
+	return filepath.Join(dir, "mosdns-"+hex.EncodeToString(h[:8])+".pid"), nil
+}
+
+// openPidFile opens the pid file at path. It never follows symlinks.
+// The file is created if it does not exist.
+func openPidFile(path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL|oNoFollow, 0o644)
+		if err == nil || !errors.Is(err, os.ErrExist) {
+			return f, err
+		}
+		// The file exists. It may be held by a running instance, or was
+		// left by an instance that crashed.
+		f, err = os.OpenFile(path, os.O_RDWR|oNoFollow, 0)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // removed in the meantime
+		}
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if !fi.Mode().IsRegular() {
+			f.Close()
+			return nil, fmt.Errorf("%s is not a regular file", path)
+		}
+		return f, nil
+	}
+}
+
+// acquirePidFile locks the pid file at path and writes the current pid
+// to it. If the file is locked by another instance, it returns an error,
+// or, if takeover is true, asks that instance to exit and waits for it.
+func acquirePidFile(path string, takeover bool) (*pidFile, error) {
+	deadline := time.Now().Add(takeoverTimeout)
+	signaled := false
+	for {
+		f, err := openPidFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pid file, %w", err)
+		}
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock pid file, %w", err)
+		}
+		if ok {
+			// The old instance removes the file on exit. Make sure we
+			// locked the file that is still at path.
+			if !isFileAt(f, path) {
+				f.Close()
+				continue
+			}
+			if err := writePid(f); err != nil {
+				f.Close()
+				return nil, err
+			}
+			return &pidFile{path: path, f: f}, nil
+		}
+
+		pid := readPid(f)
+		f.Close()
+		if !takeover {
+			return nil, fmt.Errorf("another mosdns instance (pid %d) is running with the same config (pid file %s), stop it first or use --force-takeover", pid, path)
+		}
+		if !signaled {
+			if pid <= 0 {
+				return nil, fmt.Errorf("cannot take over, invalid pid in pid file %s", path)
+			}
+			if err := signalTakeover(pid); err != nil {
+				return nil, fmt.Errorf("failed to signal the old instance (pid %d), %w", pid, err)
+			}
+			signaled = true
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("the old instance (pid %d) did not exit in %s", pid, takeoverTimeout)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func isFileAt(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, pi)
+}
+
+func writePid(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return err
+}
+
+func readPid(f *os.File) int {
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b[:n])))
+	return pid
+}
+
+// Release removes the pid file and releases the lock.
+func (p *pidFile) Release() error {
+	// Remove before close, so the file won't be removed after
+	// another instance has locked it.
+	rmErr := os.Remove(p.path)
+	closeErr := p.f.Close()
+	if rmErr != nil { // e.g. an opened file cannot be removed on windows.
+		rmErr = os.Remove(p.path)
+	}
+	return errors.Join(rmErr, closeErr)
+}
@@ -0,0 +1,44 @@
+//go:build !unix && !windows
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"os"
+	"runtime"
+)
+
+const oNoFollow = 0
+
+func pidFileDir() (string, error) {
+	return os.TempDir(), nil
+}
+
+// tryLockFile is not supported on this platform. It always succeeds,
+// so there is no double-instance protection.
+func tryLockFile(_ *os.File) (bool, error) {
+	return true, nil
+}
+
+func signalTakeover(_ int) error {
+	return errors.New("takeover is not supported on " + runtime.GOOS)
+}
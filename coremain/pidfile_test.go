@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_acquirePidFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mosdns.pid")
+
+	pf, err := acquirePidFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("unexpected pid file content %q", b)
+	}
+
+	// The file is locked.
+	if _, err := acquirePidFile(path, false); err == nil {
+		t.Fatal("expect an err for a locked pid file")
+	}
+
+	if err := pf.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("pid file is not removed, %v", err)
+	}
+
+	// A stale file left by a crashed instance is reused.
+	if err := os.WriteFile(path, []byte("999999\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pf, err = acquirePidFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid := readPid(pf.f); pid != os.Getpid() {
+		t.Fatalf("unexpected pid %d", pid)
+	}
+	_ = pf.Release()
+
+	// Dirs are not pid files.
+	if _, err := acquirePidFile(dir, false); err == nil {
+		t.Fatal("expect an err for a dir")
+	}
+}
+
+func Test_acquirePidFile_symlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "mosdns.pid")
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+	if pf, err := acquirePidFile(path, false); err == nil {
+		_ = pf.Release()
+		t.Fatal("expect an err for a symlink")
+	}
+	if b, _ := os.ReadFile(target); string(b) != "keep" {
+		t.Fatalf("symlink target was modified, %q", b)
+	}
+}
+
+func Test_defaultPidFilePath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the dir is in the app data dir on windows")
+	}
+	dir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	p1, err := defaultPidFilePath(&serverFlags{c: "/etc/mosdns/a.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := defaultPidFilePath(&serverFlags{c: "/etc/mosdns/b.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(p1) != dir || p1 == p2 {
+		t.Fatalf("unexpected paths %s %s", p1, p2)
+	}
+}
@@ -0,0 +1,78 @@
+//go:build unix
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const oNoFollow = unix.O_NOFOLLOW
+
+// pidFileDir returns $XDG_RUNTIME_DIR, or /run for root. Otherwise,
+// it returns a dir in the temp dir that is private to the current user.
+func pidFileDir() (string, error) {
+	if d := os.Getenv("XDG_RUNTIME_DIR"); len(d) > 0 {
+		return d, nil
+	}
+	uid := os.Geteuid()
+	if uid == 0 {
+		if fi, err := os.Stat("/run"); err == nil && fi.IsDir() {
+			return "/run", nil
+		}
+	}
+	d := filepath.Join(os.TempDir(), "mosdns-"+strconv.Itoa(uid))
+	if err := os.Mkdir(d, 0o700); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+	// The dir may be created by another user before us.
+	fi, err := os.Lstat(d)
+	if err != nil {
+		return "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != uid || fi.Mode().Perm()&0o077 != 0 {
+		return "", fmt.Errorf("%s is not a private dir of the current user", d)
+	}
+	return d, nil
+}
+
+// tryLockFile tries to lock f exclusively. It returns false if f is
+// locked by another process. The lock is released when f is closed.
+func tryLockFile(f *os.File) (bool, error) {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// signalTakeover asks the instance pid to exit gracefully.
+func signalTakeover(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
@@ -116,6 +116,11 @@ func (m *Mosdns) newPlugin(c PluginConfig) error {
 		return fmt.Errorf("failed to init plugin: %w", err)
 	}
 	m.plugins[c.Tag] = p
+	m.pluginTypes[c.Tag] = c.Type
+	if err := m.regPluginMetrics(c.Tag, c.Type, p); err != nil {
+		return err
+	}
+	m.pluginDeps[c.Tag] = m.findPluginRefs(c.Args)
 	return nil
 }
 
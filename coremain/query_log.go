@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+)
+
+const (
+	queryLogStreamBuf       = 256
+	queryLogStreamKeepalive = time.Second * 15
+)
+
+// queryLogStreamHandler streams query logs as server-sent events.
+// Records can be filtered by url queries "client" (ip or cidr)
+// and "domain" (the domain and its subdomains).
+func (m *Mosdns) queryLogStreamHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := query_log.ParseFilter(r.URL.Query().Get("client"), r.URL.Query().Get("domain"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c, cancel := m.queryLog.Subscribe(f, queryLogStreamBuf)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(queryLogStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case rec := <-c:
+			b, _ := json.Marshal(rec)
+			if _, err := w.Write([]byte("data: ")); err != nil {
+				return
+			}
+			_, _ = w.Write(b)
+			_, _ = w.Write([]byte("\n\n"))
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-m.sc.ReceiveCloseSignal():
+			return
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
+	"go.uber.org/zap"
+)
+
+// ReloadStatus is the result of a config reload.
+type ReloadStatus struct {
+	Time time.Time `json:"time"`
+	// File is the changed file that triggered the reload.
+	File  string `json:"file"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// RolledBack indicates the new config failed and the previous
+	// working config is still running, or was started again.
+	RolledBack bool `json:"rolled_back"`
+}
+
+// lastReload is shared by all instances, because the instance that
+// reports a failed reload is not the one that failed.
+var lastReload struct {
+	sync.Mutex
+	s *ReloadStatus
+}
+
+func setReloadStatus(s ReloadStatus) {
+	lastReload.Lock()
+	defer lastReload.Unlock()
+	lastReload.s = &s
+}
+
+// LastReloadStatus returns the status of the latest reload.
+// It returns nil if there was no reload.
+func LastReloadStatus() *ReloadStatus {
+	lastReload.Lock()
+	defer lastReload.Unlock()
+	if lastReload.s == nil {
+		return nil
+	}
+	s := *lastReload.s
+	return &s
+}
+
+// reloadByApi is the ReloadStatus.File of reloads requested by the api.
+const reloadByApi = "api"
+
+var (
+	// reloadRequests receives reload requests from the api.
+	reloadRequests = make(chan struct{}, 1)
+	// reloadApiEnabled is set while the start command is handling
+	// reloadRequests. Not in service mode.
+	reloadApiEnabled atomic.Bool
+)
+
+// reloadApiHandler requests a reload. The reload is graceful if
+// the config allows.
+func (m *Mosdns) reloadApiHandler(w http.ResponseWriter, _ *http.Request) {
+	if !reloadApiEnabled.Load() {
+		http.Error(w, "reload is not supported in this mode", http.StatusNotImplemented)
+		return
+	}
+	select {
+	case reloadRequests <- struct{}{}:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "a reload is pending", http.StatusConflict)
+	}
+}
+
+func (m *Mosdns) reloadStatusApiHandler(w http.ResponseWriter, _ *http.Request) {
+	s := LastReloadStatus()
+	if s == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s)
+}
+
+// Plugin types whose "files" args are watched for auto reload. Plugins
+// that watch and reload their own files, e.g. hosts, are not listed.
+var watchedDataFilePlugins = []string{"domain_set", "ip_set"}
+
+// collectWatchFiles returns local files that trigger a reload when they
+// change: mainFile (if not empty), config files included by cfg, and data
+// files of plugins in those configs. Remote files are not included.
+func collectWatchFiles(cfg *Config, mainFile string) []string {
+	const maxIncludeDepth = 8
+
+	var files []string
+	add := func(f string) {
+		if len(f) == 0 || isRemoteConfig(f) || remote.IsStorageFile(f) {
+			return
+		}
+		if !slices.Contains(files, f) {
+			files = append(files, f)
+		}
+	}
+	add(mainFile)
+
+	var walk func(cfg *Config, depth int)
+	walk = func(cfg *Config, depth int) {
+		for _, pc := range cfg.Plugins {
+			if !slices.Contains(watchedDataFilePlugins, pc.Type) {
+				continue
+			}
+			args, _ := pc.Args.(map[string]any)
+			dataFiles, _ := args["files"].([]any)
+			for _, f := range dataFiles {
+				if s, ok := f.(string); ok {
+					add(s)
+				}
+			}
+		}
+		if depth >= maxIncludeDepth {
+			return
+		}
+		for _, inc := range cfg.Include {
+			if isRemoteConfig(inc) {
+				continue
+			}
+			subCfg, path, err := loadConfig(inc)
+			if err != nil {
+				mlog.L().Warn("failed to load included config", zap.String("file", inc), zap.Error(err))
+				continue
+			}
+			add(path)
+			walk(subCfg, depth+1)
+		}
+	}
+	walk(cfg, 0)
+	return files
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+type rollbackTestArgs struct {
+	V string `yaml:"v"`
+}
+
+func init() {
+	RegNewPluginFunc("rollback_test", func(_ *BP, args any) (any, error) {
+		return args, nil
+	}, func() any { return new(rollbackTestArgs) })
+}
+
+// A rollback starts an instance from the last good config. It must not
+// read included files again, which may have been changed to bad ones.
+func Test_NewMosdns_rollbackUsesResolvedIncludes(t *testing.T) {
+	dir := t.TempDir()
+	inc := filepath.Join(dir, "inc.yaml")
+	main := filepath.Join(dir, "main.yaml")
+	write := func(f, s string) {
+		t.Helper()
+		if err := os.WriteFile(f, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(inc, "plugins:\n  - tag: p\n    type: rollback_test\n    args:\n      v: good\n")
+	write(main, "log:\n  level: error\ninclude: ["+inc+"]\n")
+
+	cfg, _, err := loadConfig(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := func() *Mosdns {
+		t.Helper()
+		m, err := NewMosdns(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			m.sc.SendCloseSignal(nil)
+			_ = m.sc.WaitClosed()
+		})
+		return m
+	}
+	m := start()
+	if v := m.GetPlugin("p").(*rollbackTestArgs).V; v != "good" {
+		t.Fatalf("unexpected args %q", v)
+	}
+
+	// The included file is changed to an invalid config.
+	write(inc, "plugins:\n  - tag: p\n    type: undefined_type\n")
+	m2 := start()
+	if v := m2.GetPlugin("p").(*rollbackTestArgs).V; v != "good" {
+		t.Fatalf("unexpected args %q", v)
+	}
+	if len(m2.configFiles) != 2 || m2.configFiles[1] != inc {
+		t.Fatalf("unexpected config files %v", m2.configFiles)
+	}
+
+	// A fresh load sees the change.
+	cfg2, _, err := loadConfig(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMosdns(cfg2); err == nil {
+		t.Fatal("expect an err for the changed include")
+	}
+}
+
+func Test_collectWatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := func(f string) string { return filepath.Join(dir, f) }
+	write := func(f, s string) {
+		t.Helper()
+		if err := os.WriteFile(path(f), []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("main.yaml", "include: ["+path("inc.yaml")+", "+path("missing.yaml")+", https://example.com/remote.yaml]\n"+
+		"plugins:\n"+
+		"  - tag: d\n    type: domain_set\n    args:\n      files: ["+path("domains.txt")+", storage://s3/domains.txt]\n"+
+		"  - tag: h\n    type: hosts\n    args:\n      files: ["+path("hosts.txt")+"]\n")
+	write("inc.yaml", "include: ["+path("main.yaml")+"]\n"+
+		"plugins:\n"+
+		"  - tag: i\n    type: ip_set\n    args:\n      files: ["+path("ips.txt")+", "+path("domains.txt")+"]\n")
+
+	cfg, file, err := loadConfig(path("main.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := collectWatchFiles(cfg, file)
+	want := []string{path("main.yaml"), path("domains.txt"), path("inc.yaml"), path("ips.txt")}
+	if !slices.Equal(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	// Remote main files are not watched.
+	if got := collectWatchFiles(cfg, ""); got[0] != path("domains.txt") {
+		t.Fatalf("unexpected files %v", got)
+	}
+}
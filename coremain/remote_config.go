@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"go.uber.org/zap"
+)
+
+const (
+	remoteConfigTimeout  = time.Second * 30
+	remoteConfigMaxSize  = 16 << 20
+	remoteConfigCacheDir = "remote_config_cache"
+	remoteConfigTokenEnv = "MOSDNS_CONFIG_TOKEN"
+)
+
+// remoteConfigClient fetches remote configs. It refuses redirects to
+// non-https urls, so the token is never sent in plain text.
+var remoteConfigClient = &http.Client{
+	Timeout: remoteConfigTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to non-https url %s", req.URL.Redacted())
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	},
+}
+
+// remoteConfigToken is sent as a Bearer token when fetching remote configs.
+// It is set by the "--config-token" flag or the MOSDNS_CONFIG_TOKEN env.
+var remoteConfigToken = os.Getenv(remoteConfigTokenEnv)
+
+// isRemoteConfig reports whether s is a remote config url.
+// Only https is supported, the token should not be sent in plain text.
+func isRemoteConfig(s string) bool {
+	return strings.HasPrefix(s, "https://")
+}
+
+// fetchRemoteConfig downloads the config from u to a local cache file in
+// cacheDir and returns the path of the cache file. If the download failed,
+// the previous cache file is used.
+func fetchRemoteConfig(u, cacheDir string) (string, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", fmt.Errorf("invalid url, %w", err)
+	}
+	ext := path.Ext(pu.Path)
+	if len(ext) == 0 {
+		ext = ".yaml"
+	}
+	sum := sha256.Sum256([]byte(u))
+	cacheFile := filepath.Join(cacheDir, hex.EncodeToString(sum[:8])+ext)
+
+	fetchErr := downloadRemoteConfig(u, cacheFile)
+	if fetchErr == nil {
+		return cacheFile, nil
+	}
+	if _, err := os.Stat(cacheFile); err != nil {
+		return "", fmt.Errorf("failed to fetch remote config and no cache is available, %w", fetchErr)
+	}
+	mlog.L().Warn("failed to fetch remote config, using local cache", zap.String("url", pu.Redacted()), zap.String("cache", cacheFile), zap.Error(fetchErr))
+	return cacheFile, nil
+}
+
+func downloadRemoteConfig(u, dst string) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if len(remoteConfigToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+remoteConfigToken)
+	}
+	resp, err := remoteConfigClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, remoteConfigMaxSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > remoteConfigMaxSize {
+		return errors.New("remote config is too large")
+	}
+
+	// A broken download never overwrites a good cache.
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, b)
+}
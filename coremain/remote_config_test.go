@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newRemoteConfigServer returns a https server that serves body at
+// "/config.yaml" if the request has the token. remoteConfigClient
+// trusts it until the test ends.
+func newRemoteConfigServer(t *testing.T, token string, body *atomic.Value) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config.yaml", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s, _ := body.Load().(string)
+		if len(s) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(s))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://"+r.Host+"/config.yaml", http.StatusFound)
+	})
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	transport, oldToken := remoteConfigClient.Transport, remoteConfigToken
+	remoteConfigClient.Transport = srv.Client().Transport
+	remoteConfigToken = token
+	t.Cleanup(func() {
+		remoteConfigClient.Transport, remoteConfigToken = transport, oldToken
+	})
+	return srv
+}
+
+func Test_fetchRemoteConfig(t *testing.T) {
+	var body atomic.Value
+	body.Store("log:\n  level: error\n")
+	srv := newRemoteConfigServer(t, "s3cret", &body)
+	u := srv.URL + "/config.yaml"
+	dir := filepath.Join(t.TempDir(), "cache")
+
+	read := func(f string) string {
+		t.Helper()
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// Download.
+	f, err := fetchRemoteConfig(u, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(f) != dir {
+		t.Fatalf("cache file %s is not in %s", f, dir)
+	}
+	if got := read(f); got != "log:\n  level: error\n" {
+		t.Fatalf("unexpected cache content %q", got)
+	}
+
+	// The cache is updated by later downloads.
+	body.Store("log:\n  level: warn\n")
+	if _, err := fetchRemoteConfig(u, dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(f); got != "log:\n  level: warn\n" {
+		t.Fatalf("cache is not updated, got %q", got)
+	}
+
+	// Failed downloads fall back to the cache, and don't break it.
+	body.Store("")
+	f2, err := fetchRemoteConfig(u, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f2 != f || read(f) != "log:\n  level: warn\n" {
+		t.Fatal("failed download should fall back to the cache")
+	}
+
+	// No cache.
+	if _, err := fetchRemoteConfig(u, t.TempDir()); err == nil {
+		t.Fatal("failed download without a cache should fail")
+	}
+
+	// Redirects to http urls are refused.
+	body.Store("log:\n  level: error\n")
+	err = downloadRemoteConfig(srv.URL+"/redirect", filepath.Join(t.TempDir(), "c.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "non-https") {
+		t.Fatalf("redirect to http should fail, got %v", err)
+	}
+}
+
+// Remote configs included by a local config are cached next to it.
+func Test_loadConfig_remoteIncludeCacheDir(t *testing.T) {
+	var body atomic.Value
+	body.Store("plugins:\n  - tag: p\n    type: rollback_test\n    args:\n      v: remote\n")
+	srv := newRemoteConfigServer(t, "s3cret", &body)
+
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.yaml")
+	if err := os.WriteFile(main, []byte("include: ["+srv.URL+"/config.yaml]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := loadConfig(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgs, err := loadConfigTree(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfgs) != 2 || len(cfgs[0].Plugins) != 1 {
+		t.Fatalf("remote include is not loaded, got %d configs", len(cfgs))
+	}
+	if got, want := filepath.Dir(cfgs[0].file), filepath.Join(dir, remoteConfigCacheDir); got != want {
+		t.Fatalf("remote include is cached in %s, want %s", got, want)
+	}
+}
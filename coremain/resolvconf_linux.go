@@ -0,0 +1,134 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"go.uber.org/zap"
+)
+
+const (
+	resolvConfPath       = "/etc/resolv.conf"
+	resolvConfBackupPath = "/etc/resolv.conf.mosdns-backup"
+	resolvedDropInPath   = "/etc/systemd/resolved.conf.d/mosdns.conf"
+)
+
+// takeOverResolvConf points the system resolver to addr. It returns a
+// func that restores the original settings.
+// If /etc/resolv.conf is managed by systemd-resolved, a drop-in config
+// is installed instead of replacing the file. Otherwise, the original
+// file (or symlink) is moved to resolvConfBackupPath. If the backup
+// already exists, it is left by a previous run that did not exit
+// cleanly, and it is kept as the original.
+// Note: NetworkManager or dhcp clients may still overwrite the file.
+func takeOverResolvConf(addr string) (func() error, error) {
+	if _, err := netip.ParseAddr(addr); err != nil {
+		return nil, fmt.Errorf("invalid addr, %w", err)
+	}
+
+	if usesSystemdResolved() {
+		return takeOverResolved(addr)
+	}
+
+	if _, err := os.Lstat(resolvConfBackupPath); err == nil {
+		mlog.L().Warn("resolv.conf backup from previous run found, keeping it as the original", zap.String("file", resolvConfBackupPath))
+	} else {
+		if err := os.Rename(resolvConfPath, resolvConfBackupPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to backup resolv.conf, %w", err)
+		}
+	}
+
+	b := fmt.Sprintf("# Generated by mosdns. The original file is %s.\nnameserver %s\n", resolvConfBackupPath, addr)
+	if err := os.WriteFile(resolvConfPath, []byte(b), 0644); err != nil {
+		_ = restoreResolvConf()
+		return nil, fmt.Errorf("failed to write resolv.conf, %w", err)
+	}
+	mlog.L().Info("resolv.conf taken over", zap.String("nameserver", addr))
+	return restoreResolvConf, nil
+}
+
+func restoreResolvConf() error {
+	if err := os.Rename(resolvConfBackupPath, resolvConfPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) { // There was no resolv.conf.
+			return os.Remove(resolvConfPath)
+		}
+		return err
+	}
+	mlog.L().Info("resolv.conf restored")
+	return nil
+}
+
+func usesSystemdResolved() bool {
+	target, err := os.Readlink(resolvConfPath)
+	if err != nil {
+		return false
+	}
+	if !strings.Contains(target, "systemd/resolve") {
+		return false
+	}
+	_, err = exec.LookPath("resolvectl")
+	return err == nil
+}
+
+func takeOverResolved(addr string) (func() error, error) {
+	b := fmt.Sprintf("# Generated by mosdns.\n[Resolve]\nDNS=%s\nDomains=~.\n", addr)
+	if err := os.MkdirAll(filepath.Dir(resolvedDropInPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(resolvedDropInPath, []byte(b), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write systemd-resolved drop-in config, %w", err)
+	}
+	if err := restartResolved(); err != nil {
+		_ = os.Remove(resolvedDropInPath)
+		return nil, err
+	}
+	mlog.L().Info("systemd-resolved configured", zap.String("dns", addr))
+
+	restore := func() error {
+		if err := os.Remove(resolvedDropInPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := restartResolved(); err != nil {
+			return err
+		}
+		mlog.L().Info("systemd-resolved config restored")
+		return nil
+	}
+	return restore, nil
+}
+
+func restartResolved() error {
+	if out, err := exec.Command("systemctl", "restart", "systemd-resolved").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restart systemd-resolved, %w, %s", err, strings.TrimSpace(string(out)))
+	}
+	// Drop the cache of the old servers.
+	_ = exec.Command("resolvectl", "flush-caches").Run()
+	return nil
+}
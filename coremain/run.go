@@ -20,12 +20,13 @@
 package coremain
 
 import (
+	"bytes"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
-	"slices"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -44,6 +45,19 @@ type serverFlags struct {
 	dir       string
 	cpu       int
 	asService bool
+
+	// manageResolvConf is the nameserver addr that the system resolver
+	// will be pointed to while mosdns is running. Empty means disabled.
+	manageResolvConf string
+
+	// shutdownAudit checks that no goroutines or sockets of the old
+	// instance are left after a reload, and exits if there are any.
+	shutdownAudit bool
+
+	// pidFile is locked while running to prevent a second instance.
+	// Default is a file in the temp dir derived from the config path.
+	pidFile       string
+	forceTakeover bool
 }
 
 var rootCmd = &cobra.Command{
@@ -56,6 +70,35 @@ func init() {
 		Use:   "start [-c config_file] [-d working_dir]",
 		Short: "Start mosdns main program.",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if sf.cpu > 0 {
+				runtime.GOMAXPROCS(sf.cpu)
+			}
+			// Change the working directory first. Relative paths, e.g. the
+			// config and the files it includes, are relative to it.
+			if len(sf.dir) > 0 {
+				if err := os.Chdir(sf.dir); err != nil {
+					return fmt.Errorf("failed to change the current working directory, %w", err)
+				}
+				mlog.L().Info("working directory changed", zap.String("path", sf.dir))
+			}
+
+			if len(sf.pidFile) == 0 {
+				p, err := defaultPidFilePath(sf)
+				if err != nil {
+					return err
+				}
+				sf.pidFile = p
+			}
+			pf, err := acquirePidFile(sf.pidFile, sf.forceTakeover)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := pf.Release(); err != nil {
+					mlog.L().Warn("failed to release pid file", zap.Error(err))
+				}
+			}()
+
 			if sf.asService {
 				svc, err := service.New(&serverService{f: sf}, svcCfg)
 				if err != nil {
@@ -64,48 +107,110 @@ func init() {
 				return svc.Run()
 			}
 
-			var m *Mosdns
-			var handler = func(sf *serverFlags) {
-				var err error
-				m, err = NewServer(sf)
+			if len(sf.manageResolvConf) > 0 {
+				restore, err := takeOverResolvConf(sf.manageResolvConf)
 				if err != nil {
-					return
+					return fmt.Errorf("failed to take over resolv.conf, %w", err)
 				}
+				defer func() {
+					if err := restore(); err != nil {
+						mlog.L().Error("failed to restore resolv.conf", zap.Error(err))
+					}
+				}()
+			}
 
+			// m is the running instance. It is nil if no instance is running.
+			var m atomic.Pointer[Mosdns]
+			// Resources held before the first instance starts. Every
+			// instance should release its resources back to this on close.
+			var baseline resourceSnapshot
+			// lastGood is the latest config that started an instance successfully.
+			var lastGood *Config
+			var serve = func(m *Mosdns) {
+				closed := make(chan struct{})
+				defer close(closed)
 				go func() {
 					c := make(chan os.Signal, 1)
 					signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-					sig := <-c
-					m.logger.Warn("signal received", zap.Stringer("signal", sig))
-					m.sc.SendCloseSignal(nil)
+					defer signal.Stop(c)
+					select {
+					case sig := <-c:
+						m.logger.Warn("signal received", zap.Stringer("signal", sig))
+						m.sc.SendCloseSignal(nil)
+					case <-closed:
+					}
 				}()
 
 				m.GetSafeClose().WaitClosed()
-
 			}
-			go handler(sf)
-
-			var needWatchFiles []string
-
-			needWatchFiles = append(needWatchFiles, sf.c)
-
-			cfg, _, _ := loadConfig(sf.c)
-
-			needWatchFiles = append(needWatchFiles, cfg.Include...)
-
-			for _, pc := range cfg.Plugins {
-				if pc.Type == "domain_set" || pc.Type == "ip_set" || pc.Type == "hosts" {
-					for t, files := range pc.Args.(map[string]interface{}) {
-						if t == "files" {
-							for _, file := range files.([]interface{}) {
-								if slices.Contains(needWatchFiles, file.(string)) == false {
-									needWatchFiles = append(needWatchFiles, file.(string))
-								}
-
-							}
+			var start = func() {
+				newM, cfg, err := newServer(sf)
+				if err != nil {
+					mlog.L().Error("failed to start mosdns", zap.Error(err))
+					return
+				}
+				lastGood = cfg
+				m.Store(newM)
+				go serve(newM)
+			}
+			var reload = func(file string) {
+				status := ReloadStatus{Time: time.Now(), File: file}
+				newM, cfg, err := newServer(sf)
+				if err == nil {
+					lastGood = cfg
+					status.Ok = true
+				} else {
+					status.Error = err.Error()
+					mlog.L().Error("failed to reload, rolling back to the previous config", zap.Error(err))
+					if lastGood != nil {
+						newM, err = NewMosdns(lastGood)
+						if err != nil {
+							mlog.L().Error("failed to roll back", zap.Error(err))
+						} else {
+							status.RolledBack = true
 						}
 					}
 				}
+				setReloadStatus(status)
+				if newM != nil {
+					m.Store(newM)
+					go serve(newM)
+				}
+			}
+
+			// gracefulReload starts a new instance alongside the running one,
+			// then closes the old one after its queries are drained. If the new
+			// config is invalid, the old one keeps running. It returns false if
+			// the new instance can't run alongside the old one, which is
+			// untouched and should be closed first.
+			var gracefulReload = func(file string) bool {
+				old := m.Load()
+				if lastGood == nil || !lastGood.Reload.graceful() || old == nil {
+					return false
+				}
+				drainTimeout := lastGood.Reload.drainTimeout()
+				newM, cfg, overlap, err := startAlongside(old, func() (*Mosdns, *Config, error) { return newServer(sf) })
+				if err != nil {
+					if overlap {
+						mlog.L().Warn("failed to start the new instance alongside the running one, closing the running one first", zap.Error(err))
+						return false
+					}
+					mlog.L().Error("failed to reload, keeping the running instance", zap.Error(err))
+					setReloadStatus(ReloadStatus{Time: time.Now(), File: file, Error: err.Error(), RolledBack: true})
+					return true
+				}
+				lastGood = cfg
+				setReloadStatus(ReloadStatus{Time: time.Now(), File: file, Ok: true})
+				m.Store(newM)
+				go serve(newM)
+				old.closeGracefully(drainTimeout)
+				mlog.L().Info("graceful reload finished")
+				return true
+			}
+
+			cfg, fileUsed, err := loadConfig(sf.c)
+			if err != nil {
+				return fmt.Errorf("fail to load config, %w", err)
 			}
 
 			w := watcher.New()
@@ -116,50 +221,158 @@ func init() {
 
 			defer w.Close()
 
+			quit := make(chan os.Signal, 1)
+			signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+			// fatal receives errors that should stop mosdns. They are returned
+			// through the normal shutdown path, so that deferred restores
+			// (e.g. resolv.conf and the pid file) still run.
+			fatal := make(chan error, 1)
+			var sendFatal = func(err error) {
+				select {
+				case fatal <- err:
+				default:
+				}
+			}
+
+			autoReload := cfg.AutoReload == nil || *cfg.AutoReload
+			mainFile := fileUsed
+			if isRemoteConfig(sf.c) {
+				mainFile = "" // remote files are not watched
+			}
+			// watchFiles makes w watch the files of cfg, and only them.
+			var watchFiles = func(cfg *Config) error {
+				watched := w.WatchedFiles()
+				keep := make(map[string]bool)
+				for _, file := range collectWatchFiles(cfg, mainFile) {
+					abs, err := filepath.Abs(file)
+					if err != nil {
+						return fmt.Errorf("failed to watch file %s, %w", file, err)
+					}
+					keep[abs] = true
+					if _, ok := watched[abs]; ok {
+						continue
+					}
+					if err := w.Add(file); err != nil {
+						return fmt.Errorf("failed to watch file %s, %w", file, err)
+					}
+					mlog.L().Debug("watching file", zap.String("file", file))
+				}
+				for file := range watched {
+					if !keep[file] {
+						_ = w.Remove(file)
+					}
+				}
+				return nil
+			}
+
+			// doReload replaces the running instance with a new one.
+			var doReload = func(file string) {
+				// The new config may include other files.
+				prev := lastGood
+				defer func() {
+					if autoReload && lastGood != prev {
+						if err := watchFiles(lastGood); err != nil {
+							mlog.L().Warn("failed to update watched files", zap.Error(err))
+						}
+					}
+				}()
+				// The audit needs the old instance to be the only one.
+				if !sf.shutdownAudit && gracefulReload(file) {
+					return
+				}
+				if old := m.Swap(nil); old != nil {
+					old.sc.SendCloseSignal(nil)
+					_ = old.sc.WaitClosed()
+				}
+				if sf.shutdownAudit {
+					if err := auditShutdown(baseline, shutdownAuditTimeout); err != nil {
+						sendFatal(fmt.Errorf("shutdown audit failed, %w", err))
+						return
+					}
+					mlog.L().Info("shutdown audit passed")
+				}
+				reload(file)
+			}
+
+			if !autoReload {
+				mlog.L().Info("auto reload is disabled")
+			} else if err := watchFiles(cfg); err != nil {
+				return err
+			}
+
+			ready := make(chan struct{})
 			go func() {
+				if autoReload {
+					w.Wait()
+				}
+				if sf.shutdownAudit {
+					baseline = takeResourceSnapshot()
+				}
+				close(ready)
+
+				reloadApiEnabled.Store(true)
+				defer reloadApiEnabled.Store(false)
 				for {
 					select {
 					case event := <-w.Event:
-						m.sc.SendCloseSignal(nil)
 						mlog.L().Info("server restart by config file change:", zap.String("file", event.Path))
-						go handler(sf)
-
+						doReload(event.Path)
+					case <-reloadRequests:
+						mlog.L().Info("server restart by api request")
+						doReload(reloadByApi)
 					case err := <-w.Error:
-						log.Fatalln(err)
+						sendFatal(fmt.Errorf("file watcher failed, %w", err))
+						return
 					case <-w.Closed:
 						return
 					}
 				}
 			}()
 
-			for _, file := range needWatchFiles {
-				if err := w.Add(file); err != nil {
-					log.Fatalln(err)
-				}
+			if autoReload {
+				go func() {
+					if err := w.Start(time.Millisecond * 100); err != nil {
+						sendFatal(fmt.Errorf("failed to start the file watcher, %w", err))
+					}
+				}()
 			}
+			select {
+			case <-ready:
+			case err := <-fatal:
+				return err
+			}
+			start()
 
-			go func() {
-				if err := w.Start(time.Millisecond * 100); err != nil {
-					log.Fatalln(err)
-				}
-			}()
-
-			quit := make(chan os.Signal)
-			signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-			<-quit
+			var exitErr error
+			select {
+			case <-quit:
+			case exitErr = <-fatal:
+				mlog.L().Error("fatal error, shutting down", zap.Error(exitErr))
+			}
+			if m := m.Load(); m != nil {
+				m.sc.SendCloseSignal(nil)
+				_ = m.sc.WaitClosed()
+			}
 			mlog.L().Info("service stop")
 
-			return nil
+			return exitErr
 		},
 		DisableFlagsInUseLine: true,
 		SilenceUsage:          true,
 	}
 	rootCmd.AddCommand(startCmd)
 	fs := startCmd.Flags()
-	fs.StringVarP(&sf.c, "config", "c", "", "config file")
+	fs.StringVarP(&sf.c, "config", "c", "", "config file or https url")
+	fs.StringVar(&remoteConfigToken, "config-token", remoteConfigToken, "bearer token for remote config urls, default is env "+remoteConfigTokenEnv)
+	fs.StringVar(&secretKeyFile, "secret-key-file", secretKeyFile, "file of the key that decrypts ENC[...] secrets in configs, default is env "+secretKeyFileEnv+" or the key in env "+secretKeyEnv)
 	fs.StringVarP(&sf.dir, "dir", "d", "", "working dir")
 	fs.IntVar(&sf.cpu, "cpu", 0, "set runtime.GOMAXPROCS")
 	fs.BoolVar(&sf.asService, "as-service", false, "start as a service")
+	fs.StringVar(&sf.manageResolvConf, "manage-resolvconf", "", "point the system resolver (/etc/resolv.conf or systemd-resolved) to this addr while running, and restore it on exit")
+	fs.Lookup("manage-resolvconf").NoOptDefVal = "127.0.0.1"
+	fs.StringVar(&sf.pidFile, "pid-file", "", "pid file that prevents starting a second instance with the same config, default is derived from the config path")
+	fs.BoolVar(&sf.forceTakeover, "force-takeover", false, "if another instance is running with the same pid file, ask it to exit and take over")
+	fs.BoolVar(&sf.shutdownAudit, "shutdown-audit", false, "after each reload, check that the old instance left no goroutines or sockets, exit if it did (for debugging)")
 	_ = fs.MarkHidden("as-service")
 
 	serviceCmd := &cobra.Command{
@@ -187,32 +400,48 @@ func Run() error {
 }
 
 func NewServer(sf *serverFlags) (*Mosdns, error) {
-	if sf.cpu > 0 {
-		runtime.GOMAXPROCS(sf.cpu)
-	}
-
-	if len(sf.dir) > 0 {
-		err := os.Chdir(sf.dir)
-		if err != nil {
-			return nil, fmt.Errorf("failed to change the current working directory, %w", err)
-		}
-		mlog.L().Info("working directory changed", zap.String("path", sf.dir))
-	}
+	m, _, err := newServer(sf)
+	return m, err
+}
 
+// newServer is like NewServer, but also returns the loaded config.
+// The working directory must have been changed to sf.dir.
+func newServer(sf *serverFlags) (*Mosdns, *Config, error) {
 	cfg, fileUsed, err := loadConfig(sf.c)
 	if err != nil {
-		return nil, fmt.Errorf("fail to load config, %w", err)
+		return nil, nil, fmt.Errorf("fail to load config, %w", err)
 	}
 	mlog.L().Info("main config loaded", zap.String("file", fileUsed))
 
-	return NewMosdns(cfg)
+	m, err := NewMosdns(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, cfg, nil
 }
 
 // loadConfig load a config from a file. If filePath is empty, it will
 // automatically search and load a file which name start with "config".
+// If filePath is a https url, the config will be fetched from it and
+// cached in the working dir.
 func loadConfig(filePath string) (*Config, string, error) {
+	return loadConfigIn(filePath, remoteConfigCacheDir)
+}
+
+// loadConfigIn is like loadConfig, but a remote config is cached in
+// cacheDir.
+func loadConfigIn(filePath, cacheDir string) (*Config, string, error) {
 	v := viper.New()
 
+	remote := isRemoteConfig(filePath)
+	if remote {
+		f, err := fetchRemoteConfig(filePath, cacheDir)
+		if err != nil {
+			return nil, "", err
+		}
+		filePath = f
+	}
+
 	if len(filePath) > 0 {
 		v.SetConfigFile(filePath)
 	} else {
@@ -224,15 +453,58 @@ func loadConfig(filePath string) (*Config, string, error) {
 		return nil, "", fmt.Errorf("failed to read config: %w", err)
 	}
 
+	cfg, err := decodeConfig(v)
+	if err != nil {
+		return nil, "", err
+	}
+	cfg.file = v.ConfigFileUsed()
+	// Remote configs included by a local config are cached next to it.
+	// A remote config shares its cache dir with its includes.
+	cfg.cacheDir = cacheDir
+	if !remote {
+		cfg.cacheDir = filepath.Join(filepath.Dir(cfg.file), remoteConfigCacheDir)
+	}
+	return cfg, cfg.file, nil
+}
+
+// ParseConfig parses a yaml config from b.
+func ParseConfig(b []byte) (*Config, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return decodeConfig(v)
+}
+
+func decodeConfig(v *viper.Viper) (*Config, error) {
 	decoderOpt := func(cfg *mapstructure.DecoderConfig) {
 		cfg.ErrorUnused = true
 		cfg.TagName = "yaml"
 		cfg.WeaklyTypedInput = true
 	}
 
+	settings, err := decryptSecrets(v.AllSettings())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secrets: %w", err)
+	}
+
+	// Same as v.Unmarshal, but with decrypted settings.
 	cfg := new(Config)
-	if err := v.Unmarshal(cfg, decoderOpt); err != nil {
-		return nil, "", fmt.Errorf("failed to unmarshal config: %w", err)
+	dc := &mapstructure.DecoderConfig{
+		Result: cfg,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	}
+	decoderOpt(dc)
+	d, err := mapstructure.NewDecoder(dc)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Decode(settings); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
-	return cfg, v.ConfigFileUsed(), nil
+	return cfg, nil
 }
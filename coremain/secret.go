@@ -0,0 +1,220 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Secrets in configs are written as "ENC[<base64>]", where <base64> is
+// the AES-256-GCM nonce followed by the sealed value. The key is a
+// base64 encoded 32 bytes key from env MOSDNS_SECRET_KEY or a file.
+const (
+	secretKeyEnv     = "MOSDNS_SECRET_KEY"
+	secretKeyFileEnv = "MOSDNS_SECRET_KEY_FILE"
+
+	secretPrefix = "ENC["
+	secretSuffix = "]"
+)
+
+// secretKeyFile is the file that contains the secret key. If it is
+// empty, the key is read from env secretKeyEnv.
+var secretKeyFile = os.Getenv(secretKeyFileEnv)
+
+func loadSecretKey() ([]byte, error) {
+	s := os.Getenv(secretKeyEnv)
+	if len(secretKeyFile) > 0 {
+		b, err := os.ReadFile(secretKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret key file, %w", err)
+		}
+		s = string(b)
+	}
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return nil, fmt.Errorf("no secret key, set env %s or %s", secretKeyEnv, secretKeyFileEnv)
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key, %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid secret key length %d, want 32", len(key))
+	}
+	return key, nil
+}
+
+func isSecret(s string) bool {
+	return strings.HasPrefix(s, secretPrefix) && strings.HasSuffix(s, secretSuffix)
+}
+
+func encryptSecret(key []byte, plaintext string) (string, error) {
+	aead, err := newSecretAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	b := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return secretPrefix + base64.StdEncoding.EncodeToString(b) + secretSuffix, nil
+}
+
+func decryptSecret(key []byte, s string) (string, error) {
+	aead, err := newSecretAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(s, secretPrefix), secretSuffix))
+	if err != nil {
+		return "", fmt.Errorf("invalid secret, %w", err)
+	}
+	if len(b) < aead.NonceSize() {
+		return "", errors.New("invalid secret, too short")
+	}
+	p, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret, wrong key? %w", err)
+	}
+	return string(p), nil
+}
+
+func newSecretAEAD(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+// decryptSecrets replaces all secrets in v, which is a value decoded
+// from yaml, with their plaintext. The key is only loaded if v contains
+// secrets.
+func decryptSecrets(v any) (any, error) {
+	var key []byte
+	var walk func(v any) (any, error)
+	walk = func(v any) (any, error) {
+		switch v := v.(type) {
+		case string:
+			if !isSecret(v) {
+				return v, nil
+			}
+			if key == nil {
+				var err error
+				if key, err = loadSecretKey(); err != nil {
+					return nil, err
+				}
+			}
+			return decryptSecret(key, v)
+		case map[string]any:
+			for k, e := range v {
+				d, err := walk(e)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", k, err)
+				}
+				v[k] = d
+			}
+		case map[any]any:
+			for k, e := range v {
+				d, err := walk(e)
+				if err != nil {
+					return nil, fmt.Errorf("%v: %w", k, err)
+				}
+				v[k] = d
+			}
+		case []any:
+			for i, e := range v {
+				d, err := walk(e)
+				if err != nil {
+					return nil, fmt.Errorf("#%d: %w", i, err)
+				}
+				v[i] = d
+			}
+		}
+		return v, nil
+	}
+	return walk(v)
+}
+
+func init() {
+	c := &cobra.Command{
+		Use:   "secret",
+		Short: "Generate secret keys and encrypt config secrets.",
+	}
+	c.AddCommand(&cobra.Command{
+		Use:   "gen-key",
+		Short: "Generate a secret key.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return err
+			}
+			fmt.Println(base64.StdEncoding.EncodeToString(key))
+			return nil
+		},
+		SilenceUsage: true,
+	})
+	encCmd := &cobra.Command{
+		Use:   "encrypt [value]",
+		Short: "Encrypt a value to ENC[...] that can be used in configs.",
+		Long: "Encrypt a value to ENC[...] that can be used in configs. " +
+			"If value is omitted, it is read from stdin. The key is read from env " + secretKeyEnv + " or --key-file.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			key, err := loadSecretKey()
+			if err != nil {
+				return err
+			}
+			var v string
+			if len(args) == 1 {
+				v = args[0]
+			} else {
+				b, err := io.ReadAll(bufio.NewReader(os.Stdin))
+				if err != nil {
+					return err
+				}
+				v = strings.TrimRight(string(b), "\r\n")
+			}
+			s, err := encryptSecret(key, v)
+			if err != nil {
+				return err
+			}
+			fmt.Println(s)
+			return nil
+		},
+		SilenceUsage: true,
+	}
+	encCmd.Flags().StringVar(&secretKeyFile, "key-file", secretKeyFile, "secret key file, default is env "+secretKeyFileEnv)
+	c.AddCommand(encCmd)
+	rootCmd.AddCommand(c)
+}
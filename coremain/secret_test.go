@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestSecretKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func Test_encryptSecret(t *testing.T) {
+	key := newTestSecretKey(t)
+	s, err := encryptSecret(key, "p@ss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSecret(s) || strings.Contains(s, "p@ss") {
+		t.Fatalf("unexpected secret %s", s)
+	}
+	s2, _ := encryptSecret(key, "p@ss")
+	if s == s2 {
+		t.Fatal("nonce is reused")
+	}
+	p, err := decryptSecret(key, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != "p@ss" {
+		t.Fatalf("unexpected plaintext %q", p)
+	}
+
+	if _, err := decryptSecret(newTestSecretKey(t), s); err == nil {
+		t.Fatal("expect an err for a wrong key")
+	}
+	b, _ := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(s, secretPrefix), secretSuffix))
+	b[len(b)-1] ^= 1
+	if _, err := decryptSecret(key, secretPrefix+base64.StdEncoding.EncodeToString(b)+secretSuffix); err == nil {
+		t.Fatal("expect an err for a modified secret")
+	}
+	for _, bad := range []string{"ENC[!!]", "ENC[AAAA]", "ENC[]"} {
+		if _, err := decryptSecret(key, bad); err == nil {
+			t.Fatalf("expect an err for %s", bad)
+		}
+	}
+}
+
+func Test_loadSecretKey(t *testing.T) {
+	key := newTestSecretKey(t)
+	defer func(f string) { secretKeyFile = f }(secretKeyFile)
+
+	secretKeyFile = ""
+	t.Setenv(secretKeyEnv, "")
+	if _, err := loadSecretKey(); err == nil {
+		t.Fatal("expect an err for no key")
+	}
+	t.Setenv(secretKeyEnv, base64.StdEncoding.EncodeToString(key[:16]))
+	if _, err := loadSecretKey(); err == nil {
+		t.Fatal("expect an err for a short key")
+	}
+	t.Setenv(secretKeyEnv, base64.StdEncoding.EncodeToString(key))
+	if k, err := loadSecretKey(); err != nil || string(k) != string(key) {
+		t.Fatalf("failed to load key from env, %v", err)
+	}
+
+	// The key file has priority.
+	f := filepath.Join(t.TempDir(), "key")
+	key2 := newTestSecretKey(t)
+	if err := os.WriteFile(f, []byte(base64.StdEncoding.EncodeToString(key2)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	secretKeyFile = f
+	if k, err := loadSecretKey(); err != nil || string(k) != string(key2) {
+		t.Fatalf("failed to load key from file, %v", err)
+	}
+	secretKeyFile = filepath.Join(t.TempDir(), "missing")
+	if _, err := loadSecretKey(); err == nil {
+		t.Fatal("expect an err for a missing key file")
+	}
+}
+
+func Test_ParseConfig_secrets(t *testing.T) {
+	key := newTestSecretKey(t)
+	defer func(f string) { secretKeyFile = f }(secretKeyFile)
+	secretKeyFile = ""
+
+	// Configs without secrets don't need a key.
+	t.Setenv(secretKeyEnv, "")
+	if _, err := ParseConfig([]byte("plugins:\n  - tag: a\n    type: t\n    args: {password: plain}\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := encryptSecret(key, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgText := "api:\n  users:\n    - {name: u, token: \"" + enc + "\"}\n" +
+		"plugins:\n  - tag: a\n    type: t\n    args:\n      upstreams:\n        - {addr: x, password: \"" + enc + "\"}\n"
+	if _, err := ParseConfig([]byte(cfgText)); err == nil {
+		t.Fatal("expect an err for no key")
+	}
+
+	t.Setenv(secretKeyEnv, base64.StdEncoding.EncodeToString(key))
+	cfg, err := ParseConfig([]byte(cfgText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.API.Users[0].Token; got != "s3cret" {
+		t.Fatalf("unexpected token %q", got)
+	}
+	args := cfg.Plugins[0].Args.(map[string]any)
+	if got := args["upstreams"].([]any)[0].(map[string]any)["password"]; got != "s3cret" {
+		t.Fatalf("unexpected password %v", got)
+	}
+
+	t.Setenv(secretKeyEnv, base64.StdEncoding.EncodeToString(newTestSecretKey(t)))
+	if _, err := ParseConfig([]byte(cfgText)); err == nil {
+		t.Fatal("expect an err for a wrong key")
+	}
+}
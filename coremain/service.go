@@ -27,6 +27,7 @@ import (
 	"go.uber.org/zap"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -43,6 +44,9 @@ var (
 type serverService struct {
 	f *serverFlags
 	m *Mosdns
+
+	restoreResolvConf func() error
+	restoreOnce       sync.Once
 }
 
 func (ss *serverService) Start(s service.Service) error {
@@ -52,9 +56,18 @@ func (ss *serverService) Start(s service.Service) error {
 		return err
 	}
 	ss.m = m
+	if len(ss.f.manageResolvConf) > 0 {
+		restore, err := takeOverResolvConf(ss.f.manageResolvConf)
+		if err != nil {
+			m.Logger().Error("failed to take over resolv.conf", zap.Error(err))
+		}
+		ss.restoreResolvConf = restore
+	}
 	go func() {
 		err := m.GetSafeClose().WaitClosed()
 		if err != nil {
+			// Fatal skips deferred functions, restore resolv.conf first.
+			ss.restore()
 			m.Logger().Fatal("server exited", zap.Error(err))
 		} else {
 			m.Logger().Info("server exited")
@@ -66,7 +79,21 @@ func (ss *serverService) Start(s service.Service) error {
 func (ss *serverService) Stop(_ service.Service) error {
 	ss.m.Logger().Info("service is shutting down")
 	ss.m.GetSafeClose().SendCloseSignal(nil)
-	return ss.m.GetSafeClose().WaitClosed()
+	err := ss.m.GetSafeClose().WaitClosed()
+	ss.restore()
+	return err
+}
+
+// restore restores resolv.conf if it was taken over. It is safe to call
+// restore multiple times.
+func (ss *serverService) restore() {
+	ss.restoreOnce.Do(func() {
+		if ss.restoreResolvConf != nil {
+			if err := ss.restoreResolvConf(); err != nil {
+				ss.m.Logger().Error("failed to restore resolv.conf", zap.Error(err))
+			}
+		}
+	})
 }
 
 // initService will init svc for sub command "service"
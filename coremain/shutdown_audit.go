@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// shutdownAuditTimeout is how long the audit waits for the old
+	// instance's goroutines and sockets to go away.
+	shutdownAuditTimeout = time.Second * 5
+	maxStackDumpSize     = 256 * 1024
+)
+
+// resourceSnapshot records resources held by the process.
+type resourceSnapshot struct {
+	goroutines uint64
+	sockets    map[string]struct{} // nil if socket tracking is not supported.
+}
+
+func takeResourceSnapshot() resourceSnapshot {
+	s := []metrics.Sample{{Name: "/sched/goroutines:goroutines"}}
+	metrics.Read(s)
+	var goroutines uint64
+	if s[0].Value.Kind() == metrics.KindUint64 {
+		goroutines = s[0].Value.Uint64()
+	} else {
+		goroutines = uint64(runtime.NumGoroutine())
+	}
+	sockets, _ := listOpenSockets()
+	return resourceSnapshot{goroutines: goroutines, sockets: sockets}
+}
+
+// leakedSockets returns sockets in s that are not in baseline.
+func (s resourceSnapshot) leakedSockets(baseline resourceSnapshot) []string {
+	if s.sockets == nil || baseline.sockets == nil {
+		return nil
+	}
+	var leaked []string
+	for sk := range s.sockets {
+		if _, ok := baseline.sockets[sk]; !ok {
+			leaked = append(leaked, sk)
+		}
+	}
+	sort.Strings(leaked)
+	return leaked
+}
+
+// auditShutdown checks that resources went back to baseline after an
+// instance was closed. It polls until timeout because goroutines may
+// need a moment to exit after Close() returns. It returns an error
+// with details, including a goroutine dump, if resources were leaked.
+func auditShutdown(baseline resourceSnapshot, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		s := takeResourceSnapshot()
+		leakedSockets := s.leakedSockets(baseline)
+		if s.goroutines <= baseline.goroutines && len(leakedSockets) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			b := new(strings.Builder)
+			fmt.Fprintf(b, "%d goroutines left (baseline %d)", s.goroutines, baseline.goroutines)
+			if len(leakedSockets) > 0 {
+				fmt.Fprintf(b, ", %d sockets left %v", len(leakedSockets), leakedSockets)
+			}
+			buf := make([]byte, maxStackDumpSize)
+			buf = buf[:runtime.Stack(buf, true)]
+			fmt.Fprintf(b, "\n%s", buf)
+			return fmt.Errorf("resources leaked after shutdown: %s", b)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
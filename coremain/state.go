@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const stateBundleVersion = 1
+
+// StateExporter is implemented by plugins that have runtime-managed state,
+// e.g. rules that were added by the api (domain_set, ip_set), records of
+// update_server and the override flag. The state is exported and
+// imported as json, so it can be migrated to another instance.
+// Data that is loaded from config files (e.g. hosts and set files) is not
+// runtime state, it is covered by backups instead.
+type StateExporter interface {
+	ExportState() (json.RawMessage, error)
+	ImportState(b json.RawMessage) error
+}
+
+// StateBundle is the runtime state of all StateExporter plugins.
+type StateBundle struct {
+	Version int                        `json:"version"`
+	Time    time.Time                  `json:"time"`
+	Plugins map[string]json.RawMessage `json:"plugins"` // tag -> state
+}
+
+// ExportState exports state from all StateExporter plugins.
+func (m *Mosdns) ExportState() (*StateBundle, error) {
+	b := &StateBundle{
+		Version: stateBundleVersion,
+		Time:    time.Now(),
+		Plugins: make(map[string]json.RawMessage),
+	}
+	for tag, p := range m.plugins {
+		se, ok := p.(StateExporter)
+		if !ok {
+			continue
+		}
+		s, err := se.ExportState()
+		if err != nil {
+			return nil, fmt.Errorf("failed to export state from plugin %s, %w", tag, err)
+		}
+		b.Plugins[tag] = s
+	}
+	return b, nil
+}
+
+// ImportState imports state to plugins with the same tags. It tries all
+// plugins in the bundle and returns a joined error.
+func (m *Mosdns) ImportState(b *StateBundle) error {
+	if b.Version != stateBundleVersion {
+		return fmt.Errorf("unsupported state bundle version %d", b.Version)
+	}
+	tags := make([]string, 0, len(b.Plugins))
+	for tag := range b.Plugins {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	var errs []error
+	for _, tag := range tags {
+		se, ok := m.plugins[tag].(StateExporter)
+		if !ok {
+			errs = append(errs, fmt.Errorf("plugin %s does not exist or has no state", tag))
+			continue
+		}
+		if err := se.ImportState(b.Plugins[tag]); err != nil {
+			errs = append(errs, fmt.Errorf("failed to import state to plugin %s, %w", tag, err))
+			continue
+		}
+		m.logger.Info("plugin state imported", zap.String("tag", tag))
+	}
+	return errors.Join(errs...)
+}
+
+func (m *Mosdns) exportStateApiHandler(w http.ResponseWriter, _ *http.Request) {
+	b, err := m.ExportState()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(b)
+}
+
+func (m *Mosdns) importStateApiHandler(w http.ResponseWriter, r *http.Request) {
+	b := new(StateBundle)
+	if err := json.NewDecoder(r.Body).Decode(b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := m.ImportState(b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
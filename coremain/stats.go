@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// StatsConfig persists aggregate query counters (total, blocked, errors
+// and responses of each upstream) to File, so they are not reset by
+// restarts and reloads.
+type StatsConfig struct {
+	File         string `yaml:"file"`
+	SaveInterval int    `yaml:"save_interval"` // (seconds) default is 60.
+}
+
+// Totals of a file are shared by all instances in the process. A reloaded
+// instance starts before the old one is closed, so it can't load the
+// counters that the old one saves on close.
+var (
+	sharedTotalsMu sync.Mutex
+	sharedTotals   = make(map[string]*query_log.Totals)
+)
+
+func loadSharedTotals(file string) (*query_log.Totals, error) {
+	sharedTotalsMu.Lock()
+	defer sharedTotalsMu.Unlock()
+	if t := sharedTotals[file]; t != nil {
+		return t, nil
+	}
+	t, err := query_log.LoadTotals(file, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sharedTotals[file] = t
+	return t, nil
+}
+
+// initStats counts every query that server handlers report. It saves
+// counters every SaveInterval and on close.
+func (m *Mosdns) initStats(cfg StatsConfig) error {
+	if len(cfg.File) == 0 {
+		return nil
+	}
+	utils.SetDefaultNum(&cfg.SaveInterval, 60)
+	t, err := loadSharedTotals(cfg.File)
+	if err != nil {
+		return fmt.Errorf("failed to load stats file, %w", err)
+	}
+	m.totals = t
+
+	save := func() {
+		if err := t.Save(cfg.File); err != nil {
+			m.logger.Warn("failed to save stats", zap.String("file", cfg.File), zap.Error(err))
+		}
+	}
+	m.queryObservers = append(m.queryObservers, t.Add)
+	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		go func() {
+			defer done()
+			ticker := time.NewTicker(time.Duration(cfg.SaveInterval) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					save()
+				case <-closeSignal:
+					save()
+					return
+				}
+			}
+		}()
+	})
+
+	m.metricsReg.MustRegister(totalsCollector{t: t})
+	m.httpMux.Get("/api/stats/totals", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(t.Snapshot())
+	})
+	m.logger.Info("stats persistence enabled", zap.String("file", cfg.File), zap.Uint64("queries", t.Snapshot().Queries))
+	return nil
+}
+
+var (
+	totalsQueriesDesc   = prometheus.NewDesc("mosdns_stats_queries_total", "The total number of queries, kept across restarts", nil, nil)
+	totalsBlockedDesc   = prometheus.NewDesc("mosdns_stats_blocked_total", "The total number of queries that were answered by a rule, kept across restarts", nil, nil)
+	totalsErrorsDesc    = prometheus.NewDesc("mosdns_stats_errors_total", "The total number of queries that failed, kept across restarts", nil, nil)
+	totalsUpstreamsDesc = prometheus.NewDesc("mosdns_stats_upstream_responses_total", "The total number of responses from each upstream, kept across restarts", []string{"upstream"}, nil)
+)
+
+// totalsCollector exports persisted counters.
+type totalsCollector struct {
+	t *query_log.Totals
+}
+
+func (c totalsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- totalsQueriesDesc
+	ch <- totalsBlockedDesc
+	ch <- totalsErrorsDesc
+	ch <- totalsUpstreamsDesc
+}
+
+func (c totalsCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.t.Snapshot()
+	ch <- prometheus.MustNewConstMetric(totalsQueriesDesc, prometheus.CounterValue, float64(s.Queries))
+	ch <- prometheus.MustNewConstMetric(totalsBlockedDesc, prometheus.CounterValue, float64(s.Blocked))
+	ch <- prometheus.MustNewConstMetric(totalsErrorsDesc, prometheus.CounterValue, float64(s.Errors))
+	for u, n := range s.Upstreams {
+		ch <- prometheus.MustNewConstMetric(totalsUpstreamsDesc, prometheus.CounterValue, float64(n), u)
+	}
+}
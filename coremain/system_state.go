@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"sync"
+)
+
+// systemStates are changes to the system (e.g. dns settings of the os)
+// that are made by plugins. During graceful reloads, the plugins of the
+// old and the new instance hold the same state at the same time. So the
+// original state is saved by the first holder, and only the last holder
+// restores it.
+var systemStates = struct {
+	sync.Mutex
+	m map[string]*systemState
+}{m: make(map[string]*systemState)}
+
+type systemState struct {
+	holders  int
+	original any
+}
+
+// HoldSystemState adds a holder of the system state key. If key has no
+// holder, save is called to read its original state. Otherwise, the
+// original state that was saved by the first holder is returned.
+// The holder must call release when it no longer changes the state.
+// release returns true if the holder was the last one, which should
+// restore the original state. release can be called multiple times.
+func HoldSystemState[T any](key string, save func() (T, error)) (original T, release func() (last bool), err error) {
+	systemStates.Lock()
+	defer systemStates.Unlock()
+	s := systemStates.m[key]
+	if s == nil {
+		original, err = save()
+		if err != nil {
+			return original, nil, err
+		}
+		s = &systemState{original: original}
+		systemStates.m[key] = s
+	}
+	s.holders++
+
+	var once sync.Once
+	release = func() bool {
+		last := false
+		once.Do(func() {
+			systemStates.Lock()
+			defer systemStates.Unlock()
+			s.holders--
+			if s.holders == 0 {
+				delete(systemStates.m, key)
+				last = true
+			}
+		})
+		return last
+	}
+	return s.original.(T), release, nil
+}
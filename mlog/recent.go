@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// RecentEntry is a log entry kept by RecentCore.
+type RecentEntry struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Logger  string            `json:"logger,omitempty"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// RecentCore is a zapcore.Core that keeps the latest entries at or
+// above a level in memory, e.g. for diagnostic reports.
+type RecentCore struct {
+	zapcore.LevelEnabler
+	fields []zapcore.Field
+	r      *recentRing
+}
+
+type recentRing struct {
+	mu      sync.Mutex
+	size    int
+	entries []RecentEntry
+}
+
+// NewRecentCore returns a RecentCore that keeps the latest size entries.
+func NewRecentCore(size int, l zapcore.LevelEnabler) *RecentCore {
+	if size <= 0 {
+		size = 1
+	}
+	return &RecentCore{LevelEnabler: l, r: &recentRing{size: size}}
+}
+
+func (c *RecentCore) With(fields []zapcore.Field) zapcore.Core {
+	return &RecentCore{
+		LevelEnabler: c.LevelEnabler,
+		fields:       append(append([]zapcore.Field(nil), c.fields...), fields...),
+		r:            c.r,
+	}
+}
+
+func (c *RecentCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *RecentCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	re := RecentEntry{
+		Time:    e.Time,
+		Level:   e.Level.String(),
+		Logger:  e.LoggerName,
+		Message: e.Message,
+	}
+	if len(enc.Fields) > 0 {
+		re.Fields = make(map[string]string, len(enc.Fields))
+		for k, v := range enc.Fields {
+			re.Fields[k] = fmt.Sprint(v)
+		}
+	}
+
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	if len(c.r.entries) >= c.r.size {
+		c.r.entries = append(c.r.entries[:0], c.r.entries[1:]...)
+	}
+	c.r.entries = append(c.r.entries, re)
+	return nil
+}
+
+func (c *RecentCore) Sync() error {
+	return nil
+}
+
+// Entries returns kept entries, oldest first.
+func (c *RecentCore) Entries() []RecentEntry {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	return append([]RecentEntry(nil), c.r.entries...)
+}
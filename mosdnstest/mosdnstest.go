@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package mosdnstest runs full mosdns instances in Go tests, so configs
+// can be tested end-to-end.
+//
+//	inst := mosdnstest.Start(t, cfg) // servers listen on "127.0.0.1:0"
+//	r := inst.Client("udp_server_tag").Query("example.com.", dns.TypeA)
+package mosdnstest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin"
+	http_server "github.com/IrineSistiana/mosdns/v5/plugin/server/http_server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/server/tcp_server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/server/udp_server"
+	"github.com/miekg/dns"
+)
+
+const queryTimeout = time.Second * 5
+
+// Instance is a running mosdns instance.
+type Instance struct {
+	t testing.TB
+	m *coremain.Mosdns
+}
+
+// Start starts a mosdns instance from a yaml config. It fails the test
+// if the instance cannot be started. The instance is closed when the
+// test ends. Servers should listen on ephemeral ports, e.g. "127.0.0.1:0".
+// The log level is "error" unless it is set in the config.
+func Start(t testing.TB, config string) *Instance {
+	t.Helper()
+	cfg, err := coremain.ParseConfig([]byte(config))
+	if err != nil {
+		t.Fatalf("invalid config, %v", err)
+	}
+	if len(cfg.Log.Level) == 0 {
+		cfg.Log.Level = "error"
+	}
+	m, err := coremain.NewMosdns(cfg)
+	if err != nil {
+		t.Fatalf("failed to start mosdns, %v", err)
+	}
+	t.Cleanup(func() {
+		m.GetSafeClose().SendCloseSignal(nil)
+		_ = m.GetSafeClose().WaitClosed()
+	})
+	return &Instance{t: t, m: m}
+}
+
+// M returns the underlying mosdns.
+func (i *Instance) M() *coremain.Mosdns {
+	return i.m
+}
+
+// API returns the api handler of the instance.
+// It can be used with net/http/httptest.
+func (i *Instance) API() http.Handler {
+	return i.m.GetAPIRouter()
+}
+
+// Addr returns the listening address of the server plugin tag.
+func (i *Instance) Addr(tag string) net.Addr {
+	i.t.Helper()
+	s, ok := i.m.GetPlugin(tag).(interface{ Addr() net.Addr })
+	if !ok {
+		i.t.Fatalf("plugin %s is not a server", tag)
+	}
+	return s.Addr()
+}
+
+// Client returns a client of the server plugin tag.
+// Supported servers are udp_server, tcp_server (without tls) and
+// http_server (without tls, path "/dns-query").
+func (i *Instance) Client(tag string) *Client {
+	i.t.Helper()
+	c := &Client{t: i.t, addr: i.Addr(tag).String()}
+	switch i.m.GetPlugin(tag).(type) {
+	case *udp_server.UdpServer:
+		c.network = "udp"
+	case *tcp_server.TcpServer:
+		c.network = "tcp"
+	case *http_server.HttpServer:
+		c.network = "http"
+	default:
+		i.t.Fatalf("unsupported server %s", tag)
+	}
+	return c
+}
+
+// Client sends queries to a server of an Instance.
+// Errors fail the test.
+type Client struct {
+	t       testing.TB
+	network string
+	addr    string
+}
+
+// Query sends a query with the name and type and returns the response.
+func (c *Client) Query(name string, qtype uint16) *dns.Msg {
+	c.t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	return c.Exchange(q)
+}
+
+// Exchange sends q and returns the response.
+func (c *Client) Exchange(q *dns.Msg) *dns.Msg {
+	c.t.Helper()
+	r, err := c.exchange(q)
+	if err != nil {
+		c.t.Fatalf("failed to exchange query %v via %s://%s, %v", q.Question, c.network, c.addr, err)
+	}
+	return r
+}
+
+func (c *Client) exchange(q *dns.Msg) (*dns.Msg, error) {
+	if c.network != "http" {
+		dc := &dns.Client{Net: c.network, Timeout: queryTimeout}
+		r, _, err := dc.Exchange(q, c.addr)
+		return r, err
+	}
+
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	hc := &http.Client{Timeout: queryTimeout}
+	resp, err := hc.Post("http://"+c.addr+"/dns-query", "application/dns-message", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	rb, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	return r, r.Unpack(rb)
+}
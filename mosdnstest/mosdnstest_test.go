@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mosdnstest
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStart(t *testing.T) {
+	inst := Start(t, `
+plugins:
+  - tag: hosts
+    type: hosts
+    args:
+      entries:
+        - "nas.lan 192.168.1.10"
+  - tag: main
+    type: sequence
+    args:
+      - exec: $hosts
+      - matches: has_resp
+        exec: accept
+      - exec: reject 3
+  - tag: udp
+    type: udp_server
+    args:
+      entry: main
+      listen: 127.0.0.1:0
+  - tag: tcp
+    type: tcp_server
+    args:
+      entry: main
+      listen: 127.0.0.1:0
+  - tag: doh
+    type: http_server
+    args:
+      entries:
+        - exec: main
+      listen: 127.0.0.1:0
+`)
+
+	for _, tag := range []string{"udp", "tcp", "doh"} {
+		c := inst.Client(tag)
+		r := c.Query("nas.lan", dns.TypeA)
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.168.1.10" {
+			t.Fatalf("%s: unexpected response %v", tag, r)
+		}
+		if r := c.Query("example.com", dns.TypeA); r.Rcode != dns.RcodeNameError {
+			t.Fatalf("%s: want NXDOMAIN, got %v", tag, r)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"encoding/base64"
+	"net"
+	"strings"
+	"unicode"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// OptionCodeMAC is the code of the EDNS0 option that dnsmasq
+	// (--add-mac) and OpenWrt use to carry the MAC address of the client.
+	OptionCodeMAC uint16 = 65001
+
+	// OptionCodeCPEID is the code of the EDNS0 option that carries a
+	// device name or CPE id (dnsmasq --add-cpe-id).
+	OptionCodeCPEID uint16 = 65074
+
+	// MaxClientIDLen is the max length of a client id.
+	MaxClientIDLen = 64
+)
+
+// DefaultClientIDCodes are codes of options that are checked by
+// ClientIDFromOpt by default.
+var DefaultClientIDCodes = []uint16{OptionCodeMAC, OptionCodeCPEID}
+
+// ClientIDFromOpt returns the client id carried by the first option in
+// codes that has a valid id. See ParseClientID. opt can be nil.
+func ClientIDFromOpt(opt *dns.OPT, codes []uint16) string {
+	for _, code := range codes {
+		if b, ok := FindMetaOption(opt, code); ok {
+			if id := ParseClientID(code, b); len(id) > 0 {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// ParseClientID parses the data of a client id option with code.
+// Option OptionCodeMAC can have a six bytes binary, base64 or text MAC
+// address (all formats of dnsmasq --add-mac). Other options are texts
+// and are returned by NormalizeClientID. An empty string is returned if
+// b is not a valid id.
+func ParseClientID(code uint16, b []byte) string {
+	if code == OptionCodeMAC {
+		if len(b) == 6 {
+			return net.HardwareAddr(b).String()
+		}
+		if mac, err := base64.StdEncoding.DecodeString(string(b)); err == nil && len(mac) == 6 {
+			return net.HardwareAddr(mac).String()
+		}
+	}
+	return NormalizeClientID(string(b))
+}
+
+// NormalizeClientID returns MAC addresses in the form of
+// "aa:bb:cc:dd:ee:ff" and other ids in lower case. An empty string is
+// returned if s is empty, too long or has non-printable characters.
+func NormalizeClientID(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 || len(s) > MaxClientIDLen {
+		return ""
+	}
+	if mac, err := net.ParseMAC(s); err == nil && len(mac) == 6 {
+		return mac.String()
+	}
+	for _, r := range s {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return ""
+		}
+	}
+	return strings.ToLower(s)
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseClientID(t *testing.T) {
+	for _, test := range []struct {
+		code uint16
+		b    string
+		want string
+	}{
+		{OptionCodeMAC, "\x00\x11\x22\xaa\xbb\xcc", "00:11:22:aa:bb:cc"},
+		{OptionCodeMAC, "ABEiqrvM", "00:11:22:aa:bb:cc"},
+		{OptionCodeMAC, "00-11-22-AA-BB-CC", "00:11:22:aa:bb:cc"},
+		{OptionCodeCPEID, "Kids-Tablet", "kids-tablet"},
+		{OptionCodeCPEID, "kidsipad", "kidsipad"}, // Not base64 of other options.
+		{OptionCodeCPEID, "laptop", "laptop"},     // Not binary of other options.
+		{OptionCodeCPEID, "bad\x00id", ""},
+		{OptionCodeCPEID, "", ""},
+	} {
+		if got := ParseClientID(test.code, []byte(test.b)); got != test.want {
+			t.Errorf("ParseClientID(%d, %q) = %q, want %q", test.code, test.b, got, test.want)
+		}
+	}
+}
+
+func TestClientIDFromOpt(t *testing.T) {
+	if id := ClientIDFromOpt(nil, DefaultClientIDCodes); id != "" {
+		t.Fatalf("nil opt should have no id, got %q", id)
+	}
+	opt := new(dns.OPT)
+	opt.Option = []dns.EDNS0{
+		&dns.EDNS0_LOCAL{Code: OptionCodeMAC, Data: []byte{1, 2}}, // invalid
+		&dns.EDNS0_LOCAL{Code: OptionCodeCPEID, Data: []byte("nas")},
+	}
+	if id := ClientIDFromOpt(opt, DefaultClientIDCodes); id != "nas" {
+		t.Fatalf("want nas, got %q", id)
+	}
+	if id := ClientIDFromOpt(opt, []uint16{OptionCodeMAC}); id != "" {
+		t.Fatalf("want no id, got %q", id)
+	}
+}
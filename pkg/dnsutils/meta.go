@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultMetaOptionCode is the default EDNS0 option code of query
+// metadata. It's in the local/experimental range (RFC 6891 9).
+const DefaultMetaOptionCode = 65001
+
+const (
+	metaTypeClientGroup = 1
+	metaTypeMarks       = 2
+	metaTypeClientAddr  = 3
+)
+
+// Meta is the query metadata that a mosdns attaches to the queries it
+// forwards, so the next mosdns in a chain can use it.
+type Meta struct {
+	ClientGroup string
+	Marks       []uint32
+	ClientAddr  netip.Addr // The original client. Optional.
+}
+
+// PackMeta encodes m as a list of (type uint8, length uint8, value)
+// fields. Empty fields are omitted.
+func PackMeta(m Meta) ([]byte, error) {
+	var b []byte
+	if len(m.ClientGroup) > 0 {
+		if len(m.ClientGroup) > 255 {
+			return nil, errors.New("client group is too long")
+		}
+		b = append(b, metaTypeClientGroup, byte(len(m.ClientGroup)))
+		b = append(b, m.ClientGroup...)
+	}
+	if len(m.Marks) > 0 {
+		if len(m.Marks) > 255/4 {
+			return nil, errors.New("too many marks")
+		}
+		b = append(b, metaTypeMarks, byte(len(m.Marks)*4))
+		for _, mark := range m.Marks {
+			b = binary.BigEndian.AppendUint32(b, mark)
+		}
+	}
+	if m.ClientAddr.IsValid() {
+		a := m.ClientAddr.Unmap().AsSlice()
+		b = append(b, metaTypeClientAddr, byte(len(a)))
+		b = append(b, a...)
+	}
+	return b, nil
+}
+
+// UnpackMeta decodes b that was encoded by PackMeta. Unknown fields
+// are ignored.
+func UnpackMeta(b []byte) (Meta, error) {
+	var m Meta
+	for len(b) > 0 {
+		if len(b) < 2 || len(b)-2 < int(b[1]) {
+			return Meta{}, errors.New("truncated meta field")
+		}
+		typ, v := b[0], b[2:2+int(b[1])]
+		b = b[2+len(v):]
+		switch typ {
+		case metaTypeClientGroup:
+			m.ClientGroup = string(v)
+		case metaTypeMarks:
+			if len(v)%4 != 0 {
+				return Meta{}, fmt.Errorf("invalid marks length %d", len(v))
+			}
+			for i := 0; i < len(v); i += 4 {
+				m.Marks = append(m.Marks, binary.BigEndian.Uint32(v[i:]))
+			}
+		case metaTypeClientAddr:
+			addr, ok := netip.AddrFromSlice(v)
+			if !ok {
+				return Meta{}, fmt.Errorf("invalid client addr length %d", len(v))
+			}
+			m.ClientAddr = addr
+		}
+	}
+	return m, nil
+}
+
+// FindMetaOption returns the data of the first local option with code
+// in opt. opt can be nil.
+func FindMetaOption(opt *dns.OPT, code uint16) ([]byte, bool) {
+	if opt == nil {
+		return nil, false
+	}
+	for _, o := range opt.Option {
+		if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == code {
+			return l.Data, true
+		}
+	}
+	return nil, false
+}
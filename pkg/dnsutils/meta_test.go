@@ -0,0 +1,47 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestMeta(t *testing.T) {
+	m := Meta{ClientGroup: "kids", Marks: []uint32{1, 65536}, ClientAddr: netip.MustParseAddr("2001:db8::1")}
+	b, err := PackMeta(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnpackMeta(append(b, 99, 1, 0)) // With an unknown field.
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Fatalf("want %v, got %v", m, got)
+	}
+
+	for _, l := range []int{1, 3, len(b) - 1} {
+		if _, err := UnpackMeta(b[:l]); err == nil {
+			t.Fatalf("truncated meta of length %d should be rejected", l)
+		}
+	}
+}
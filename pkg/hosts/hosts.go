@@ -26,13 +26,28 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/miekg/dns"
 	"net/netip"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
 type Hosts struct {
 	matcher domain.Matcher[*IPs]
+	ptr     map[netip.Addr][]ptrName // set by SetReverse
 }
 
+type ptrName struct {
+	fqdn string
+	ttl  uint32
+}
+
+// maxCNAMEChain is the max length of CNAME chains that are followed in
+// hosts.
+const maxCNAMEChain = 8
+
+// DefaultTTL is the ttl of records of entries that have no "ttl=" option.
+const DefaultTTL = 10
+
 // NewHosts creates a hosts using m.
 func NewHosts(m domain.Matcher[*IPs]) *Hosts {
 	return &Hosts{
@@ -40,6 +55,11 @@ func NewHosts(m domain.Matcher[*IPs]) *Hosts {
 	}
 }
 
+// SetReverse enables PTR answers from t.
+func (h *Hosts) SetReverse(t *ReverseTable) {
+	h.ptr = t.build()
+}
+
 func (h *Hosts) Lookup(fqdn string) (ipv4, ipv6 []netip.Addr) {
 	ips, ok := h.matcher.Match(fqdn)
 	if !ok {
@@ -48,6 +68,49 @@ func (h *Hosts) Lookup(fqdn string) (ipv4, ipv6 []netip.Addr) {
 	return ips.IPv4, ips.IPv6
 }
 
+// LookupPTR returns the names of addr.
+func (h *Hosts) LookupPTR(addr netip.Addr) []string {
+	var names []string
+	for _, n := range h.ptr[addr.Unmap()] {
+		names = append(names, n.fqdn)
+	}
+	return names
+}
+
+// Follow follows CNAME entries from fqdn. It returns the CNAME records on
+// the way and the last name of the chain. local reports whether the last
+// name has addresses in hosts. chain is empty if fqdn has no CNAME entry.
+func (h *Hosts) Follow(fqdn string) (chain []dns.RR, last string, local bool) {
+	last = fqdn
+	for i := 0; i <= maxCNAMEChain; i++ {
+		ips, ok := h.matcher.Match(last)
+		if !ok {
+			return chain, last, false
+		}
+		if len(ips.CNAME) == 0 {
+			return chain, last, true
+		}
+		if i == maxCNAMEChain {
+			break
+		}
+		chain = append(chain, &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   last,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    ips.ttl(),
+			},
+			Target: ips.CNAME,
+		})
+		last = ips.CNAME
+	}
+	// Chain is too long or a loop. Leave the rest to others.
+	return chain, last, false
+}
+
+// LookupMsg returns a response of m from hosts. CNAME entries are followed
+// in hosts. If the chain ends with a name that is not in hosts, only the
+// CNAME records are answered. It returns nil if m is not in hosts.
 func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	if len(m.Question) != 1 {
 		return nil
@@ -55,26 +118,43 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	q := m.Question[0]
 	typ := q.Qtype
 	fqdn := q.Name
-	if q.Qclass != dns.ClassINET || (typ != dns.TypeA && typ != dns.TypeAAAA) {
+	if q.Qclass != dns.ClassINET {
 		return nil
 	}
+	if typ == dns.TypePTR {
+		return h.lookupPTRMsg(m)
+	}
 
-	ipv4, ipv6 := h.Lookup(fqdn)
-	if len(ipv4)+len(ipv6) == 0 {
+	chain, last, local := h.Follow(fqdn)
+	if len(chain) == 0 && (typ != dns.TypeA && typ != dns.TypeAAAA) {
+		return nil
+	}
+	var ipv4, ipv6 []netip.Addr
+	var ttl uint32
+	if local {
+		ips, _ := h.matcher.Match(last)
+		ipv4, ipv6, ttl = ips.IPv4, ips.IPv6, ips.ttl()
+	}
+	if len(chain) == 0 && len(ipv4)+len(ipv6) == 0 {
 		return nil // no such host
 	}
 
 	r := new(dns.Msg)
 	r.SetReply(m)
+	if typ == dns.TypeCNAME && len(chain) > 0 {
+		r.Answer = chain[:1]
+		return r
+	}
+	r.Answer = chain
 	switch {
 	case typ == dns.TypeA && len(ipv4) > 0:
 		for _, ip := range ipv4 {
 			rr := &dns.A{
 				Hdr: dns.RR_Header{
-					Name:   fqdn,
+					Name:   last,
 					Rrtype: dns.TypeA,
 					Class:  dns.ClassINET,
-					Ttl:    10,
+					Ttl:    ttl,
 				},
 				A: ip.AsSlice(),
 			}
@@ -84,10 +164,10 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 		for _, ip := range ipv6 {
 			rr := &dns.AAAA{
 				Hdr: dns.RR_Header{
-					Name:   fqdn,
+					Name:   last,
 					Rrtype: dns.TypeAAAA,
 					Class:  dns.ClassINET,
-					Ttl:    10,
+					Ttl:    ttl,
 				},
 				AAAA: ip.AsSlice(),
 			}
@@ -96,8 +176,34 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	}
 
 	// Append fake SOA record for empty reply.
-	if len(r.Answer) == 0 {
-		r.Ns = []dns.RR{dnsutils.FakeSOA(fqdn)}
+	if len(r.Answer) == len(chain) && local {
+		r.Ns = []dns.RR{dnsutils.FakeSOA(last)}
+	}
+	return r
+}
+
+func (h *Hosts) lookupPTRMsg(m *dns.Msg) *dns.Msg {
+	fqdn := m.Question[0].Name
+	addr, err := dnsutils.ParsePTRQName(strings.ToLower(fqdn))
+	if err != nil {
+		return nil
+	}
+	names := h.ptr[addr.Unmap()]
+	if len(names) == 0 {
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(m)
+	for _, name := range names {
+		r.Answer = append(r.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   fqdn,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    name.ttl,
+			},
+			Ptr: name.fqdn,
+		})
 	}
 	return r
 }
@@ -105,19 +211,60 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 type IPs struct {
 	IPv4 []netip.Addr
 	IPv6 []netip.Addr
+
+	// CNAME is the fqdn target of a "cname:target" entry. Entries that
+	// have a CNAME have no ip.
+	CNAME string
+
+	// TTL is the ttl of records of this entry. 0 means DefaultTTL.
+	TTL uint32
+}
+
+func (ips *IPs) ttl() uint32 {
+	if ips.TTL == 0 {
+		return DefaultTTL
+	}
+	return ips.TTL
 }
 
 var _ domain.ParseStringFunc[*IPs] = ParseIPs
 
+// ParseIPs parses a "pattern ip..." or "pattern cname:target" entry.
+// An optional "ttl=seconds" field sets the ttl of the records.
+// A "*.example.com" pattern matches all subdomains of example.com but not
+// example.com itself. It is a regexp pattern, so full and domain patterns
+// take precedence over it.
 func ParseIPs(s string) (string, *IPs, error) {
 	f := strings.Fields(s)
 	if len(f) == 0 {
 		return "", nil, errors.New("empty string")
 	}
 
-	pattern := f[0]
+	pattern, err := parseWildcard(f[0])
+	if err != nil {
+		return "", nil, err
+	}
 	v := new(IPs)
 	for _, ipStr := range f[1:] {
+		if ttlStr, ok := strings.CutPrefix(ipStr, "ttl="); ok {
+			ttl, err := strconv.ParseUint(ttlStr, 10, 32)
+			if err != nil || ttl == 0 {
+				return "", nil, fmt.Errorf("invalid ttl %s", ttlStr)
+			}
+			v.TTL = uint32(ttl)
+			continue
+		}
+		if target, ok := strings.CutPrefix(ipStr, "cname:"); ok {
+			if len(v.CNAME) > 0 {
+				return "", nil, errors.New("multiple cname targets")
+			}
+			if _, ok := dns.IsDomainName(target); !ok || len(target) == 0 {
+				return "", nil, fmt.Errorf("invalid cname target %s", target)
+			}
+			v.CNAME = dns.Fqdn(strings.ToLower(target))
+			continue
+		}
+
 		ip, err := netip.ParseAddr(ipStr)
 		if err != nil {
 			return "", nil, fmt.Errorf("invalid ip addr %s, %w", ipStr, err)
@@ -129,6 +276,78 @@ func ParseIPs(s string) (string, *IPs, error) {
 			v.IPv6 = append(v.IPv6, ip)
 		}
 	}
+	if len(v.CNAME) > 0 && len(v.IPv4)+len(v.IPv6) > 0 {
+		return "", nil, errors.New("cname entry cannot have ips")
+	}
 
 	return pattern, v, nil
 }
+
+// parseWildcard converts a "*.example.com" pattern to a regexp pattern.
+// Other patterns are returned as they are.
+func parseWildcard(pattern string) (string, error) {
+	if strings.Contains(pattern, ":") || !strings.Contains(pattern, "*") {
+		return pattern, nil
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*.")
+	if !ok || len(suffix) == 0 || strings.Contains(suffix, "*") {
+		return "", fmt.Errorf("invalid wildcard pattern %s, only a leading \"*.\" is supported", pattern)
+	}
+	return domain.MatcherRegexp + ":^.+\\." + regexp.QuoteMeta(domain.NormalizeDomain(suffix)) + "$", nil
+}
+
+// ReverseTable records names and addresses of entries for PTR answers.
+// Only full and domain patterns have names.
+type ReverseTable struct {
+	defaultType string
+	names       []string        // in loading order
+	entries     map[string]*IPs // fqdn -> last loaded entry
+}
+
+// NewReverseTable creates a ReverseTable. defaultType is the type of
+// patterns that have no type prefix.
+func NewReverseTable(defaultType string) *ReverseTable {
+	return &ReverseTable{defaultType: defaultType, entries: make(map[string]*IPs)}
+}
+
+// ParseFunc wraps parse so that loaded entries are also recorded in t.
+func (t *ReverseTable) ParseFunc(parse domain.ParseStringFunc[*IPs]) domain.ParseStringFunc[*IPs] {
+	return func(s string) (string, *IPs, error) {
+		pattern, v, err := parse(s)
+		if err == nil {
+			t.add(pattern, v)
+		}
+		return pattern, v, err
+	}
+}
+
+func (t *ReverseTable) add(pattern string, v *IPs) {
+	if strings.HasPrefix(pattern, domain.SpecialPrefix) {
+		return
+	}
+	typ, name, ok := strings.Cut(pattern, ":")
+	if !ok {
+		typ, name = t.defaultType, pattern
+	}
+	if typ != domain.MatcherFull && typ != domain.MatcherDomain {
+		return
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+	if _, dup := t.entries[name]; !dup {
+		t.names = append(t.names, name)
+	}
+	t.entries[name] = v
+}
+
+func (t *ReverseTable) build() map[netip.Addr][]ptrName {
+	m := make(map[netip.Addr][]ptrName)
+	for _, name := range t.names {
+		v := t.entries[name]
+		for _, l := range [...][]netip.Addr{v.IPv4, v.IPv6} {
+			for _, addr := range l {
+				m[addr] = append(m[addr], ptrName{fqdn: name, ttl: v.ttl()})
+			}
+		}
+	}
+	return m
+}
@@ -103,3 +103,143 @@ func Test_hostsContainer_Match(t *testing.T) {
 		})
 	}
 }
+
+func Test_hosts_CNAME_PTR(t *testing.T) {
+	m := domain.NewMixMatcher[*IPs]()
+	m.SetDefaultMatcher(domain.MatcherFull)
+	rt := NewReverseTable(domain.MatcherFull)
+	entries := `
+a.com 1.1.1.1 2001:db8::1
+full:b.com 1.1.1.1
+regexp:^c 1.1.1.1
+alias.com cname:A.com
+alias2.com cname:alias.com
+ext.com cname:example.org
+loop1.com cname:loop2.com
+loop2.com cname:loop1.com
+`
+	if err := domain.LoadFromTextReader[*IPs](m, bytes.NewBufferString(entries), rt.ParseFunc(ParseIPs)); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHosts(m)
+	h.SetReverse(rt)
+
+	lookup := func(name string, typ uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, typ)
+		return h.LookupMsg(q)
+	}
+
+	r := lookup("alias2.com.", dns.TypeA)
+	if r == nil || len(r.Answer) != 3 {
+		t.Fatalf("want 2 CNAMEs and an A, got %v", r)
+	}
+	if c := r.Answer[1].(*dns.CNAME); c.Hdr.Name != "alias.com." || c.Target != "a.com." {
+		t.Fatalf("unexpected CNAME %v", c)
+	}
+	if a := r.Answer[2].(*dns.A); a.Hdr.Name != "a.com." || !a.A.Equal(net.ParseIP("1.1.1.1")) {
+		t.Fatalf("unexpected A %v", a)
+	}
+
+	r = lookup("alias.com.", dns.TypeMX)
+	if r == nil || len(r.Answer) != 1 || len(r.Ns) != 1 {
+		t.Fatalf("want a CNAME and a SOA, got %v", r)
+	}
+	r = lookup("alias2.com.", dns.TypeCNAME)
+	if r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.CNAME).Target != "alias.com." {
+		t.Fatalf("want the first CNAME only, got %v", r)
+	}
+
+	chain, last, local := h.Follow("ext.com.")
+	if len(chain) != 1 || last != "example.org." || local {
+		t.Fatalf("unexpected follow result %v %s %v", chain, last, local)
+	}
+	if chain, _, local := h.Follow("loop1.com."); len(chain) != maxCNAMEChain || local {
+		t.Fatalf("loop should stop at %d, got %d", maxCNAMEChain, len(chain))
+	}
+
+	r = lookup("1.1.1.1.in-addr.arpa.", dns.TypePTR)
+	if r == nil || len(r.Answer) != 2 {
+		t.Fatalf("want 2 PTRs, got %v", r)
+	}
+	if p := r.Answer[0].(*dns.PTR).Ptr; p != "a.com." {
+		t.Fatalf("want a.com., got %s", p)
+	}
+	if p := r.Answer[1].(*dns.PTR).Ptr; p != "b.com." {
+		t.Fatalf("want b.com., got %s", p)
+	}
+	r = lookup("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", dns.TypePTR)
+	if r == nil || len(r.Answer) != 1 {
+		t.Fatalf("want 1 PTR, got %v", r)
+	}
+	if r := lookup("2.2.2.2.in-addr.arpa.", dns.TypePTR); r != nil {
+		t.Fatalf("want nil, got %v", r)
+	}
+
+	if _, _, err := ParseIPs("x.com cname:a.com 1.2.3.4"); err == nil {
+		t.Fatal("cname with ips should fail")
+	}
+}
+
+func Test_hosts_Wildcard_TTL(t *testing.T) {
+	m := domain.NewMixMatcher[*IPs]()
+	m.SetDefaultMatcher(domain.MatcherFull)
+	rt := NewReverseTable(domain.MatcherFull)
+	entries := `
+*.Example.com 1.1.1.1 ttl=60
+exact.example.com 2.2.2.2
+example.com 3.3.3.3
+alias.com cname:x.example.com ttl=30
+regexp:^re[0-9]+\.net$ 4.4.4.4 ttl=5
+`
+	if err := domain.LoadFromTextReader[*IPs](m, bytes.NewBufferString(entries), rt.ParseFunc(ParseIPs)); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHosts(m)
+	h.SetReverse(rt)
+
+	lookupA := func(name string) (string, uint32) {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		r := h.LookupMsg(q)
+		if r == nil || len(r.Answer) == 0 {
+			return "", 0
+		}
+		a := r.Answer[len(r.Answer)-1].(*dns.A)
+		return a.A.String(), a.Hdr.Ttl
+	}
+
+	tests := []struct {
+		name    string
+		wantIP  string
+		wantTTL uint32
+	}{
+		{"a.example.com.", "1.1.1.1", 60},
+		{"a.B.example.com.", "1.1.1.1", 60},
+		{"exact.example.com.", "2.2.2.2", DefaultTTL},
+		{"example.com.", "3.3.3.3", DefaultTTL},
+		{"notexample.com.", "", 0},
+		{"re12.net.", "4.4.4.4", 5},
+		{"re.net.", "", 0},
+	}
+	for _, tt := range tests {
+		ip, ttl := lookupA(tt.name)
+		if ip != tt.wantIP || ttl != tt.wantTTL {
+			t.Errorf("%s: want %s %d, got %s %d", tt.name, tt.wantIP, tt.wantTTL, ip, ttl)
+		}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("alias.com.", dns.TypeA)
+	r := h.LookupMsg(q)
+	if r == nil || len(r.Answer) != 2 || r.Answer[0].Header().Ttl != 30 || r.Answer[1].Header().Ttl != 60 {
+		t.Fatalf("unexpected cname response %v", r)
+	}
+
+	for _, s := range []string{"x.com ttl=0", "x.com ttl=abc", "a.*.com 1.1.1.1", "* 1.1.1.1"} {
+		if _, _, err := ParseIPs(s); err == nil {
+			t.Errorf("%q should fail", s)
+		}
+	}
+}
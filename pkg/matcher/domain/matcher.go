@@ -230,7 +230,12 @@ func (m *MixMatcher[T]) GetSubMatcher(typ string) WriteableMatcher[T] {
 
 var ErrNodefaultMatcher = errors.New("default matcher is not set")
 
+// Add adds pattern s to m. s can also be a built-in domain set
+// ("@local-tlds"), see SpecialSetNames.
 func (m *MixMatcher[T]) Add(s string, v T) error {
+	if strings.HasPrefix(s, SpecialPrefix) {
+		return addSpecial[T](m, s, v)
+	}
 	typ, pattern := m.splitTypeAndPattern(s)
 	if len(typ) == 0 {
 		if len(m.defaultMatcher) != 0 {
@@ -198,3 +198,43 @@ func Test_RegexMatcher(t *testing.T) {
 	expr = "*"
 	add(expr, nil, true)
 }
+
+func TestMixMatcher_SpecialSets(t *testing.T) {
+	m := NewDomainMixMatcher()
+	for _, s := range []string{"@local-tlds", "@onion", "@reverse-private", "example.com"} {
+		if err := m.Add(s, struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"nas.lan.", true},
+		{"printer.home.arpa.", true},
+		{"svc.internal", true},
+		{"abc.onion.", true},
+		{"1.0.168.192.in-addr.arpa.", true},
+		{"1.0.20.172.in-addr.arpa.", true},
+		{"1.0.32.172.in-addr.arpa.", false},
+		{"1.0.0.100.100.in-addr.arpa.", true},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", true},
+		{"8.8.8.8.in-addr.arpa.", false},
+		{"www.example.com.", true},
+		{"google.com.", false},
+	}
+	for _, tt := range tests {
+		if _, ok := m.Match(tt.s); ok != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.s, ok, tt.want)
+		}
+	}
+
+	if err := m.Add("@nonexistent", struct{}{}); err == nil {
+		t.Fatal("unknown set should fail")
+	}
+	for _, name := range SpecialSetNames() {
+		if l, ok := SpecialSet(name); !ok || len(l) == 0 {
+			t.Fatalf("set %s is empty", name)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SpecialPrefix is the prefix of named built-in domain sets in
+// expressions, e.g. "@local-tlds".
+const SpecialPrefix = "@"
+
+// specialSets are built-in domain sets. Their expressions are domain
+// patterns.
+var specialSets = map[string][]string{
+	// Private use TLDs (RFC 6762 Appendix G, RFC 8375) and common
+	// intranet suffixes.
+	"local-tlds": {"lan", "home", "corp", "intranet", "private", "internal", "localdomain", "local", "home.arpa"},
+	"localhost":  {"localhost"},
+	"onion":      {"onion"},
+	// Special-use domain names that should never be resolved by public
+	// dns (RFC 6761, RFC 7686, RFC 9476).
+	"special-use":     {"test", "invalid", "localhost", "onion", "alt", "home.arpa"},
+	"reverse-private": reversePrivate(),
+}
+
+// reversePrivate returns reverse zones of private, loopback, link-local,
+// CGNAT and unspecified addresses.
+func reversePrivate() []string {
+	l := []string{
+		"10.in-addr.arpa",
+		"168.192.in-addr.arpa",
+		"127.in-addr.arpa",
+		"254.169.in-addr.arpa",
+		"0.in-addr.arpa",
+		"d.f.ip6.arpa",   // fd00::/8
+		"c.f.ip6.arpa",   // fc00::/8
+		"8.e.f.ip6.arpa", // fe80::/10
+		"9.e.f.ip6.arpa", // fe80::/10
+		"a.e.f.ip6.arpa", // fe80::/10
+		"b.e.f.ip6.arpa", // fe80::/10
+		"1." + strings.Repeat("0.", 31) + "ip6.arpa", // ::1
+	}
+	for i := 16; i <= 31; i++ { // 172.16.0.0/12
+		l = append(l, strconv.Itoa(i)+".172.in-addr.arpa")
+	}
+	for i := 64; i <= 127; i++ { // 100.64.0.0/10
+		l = append(l, strconv.Itoa(i)+".100.in-addr.arpa")
+	}
+	return l
+}
+
+// SpecialSetNames returns the names of all built-in domain sets.
+func SpecialSetNames() []string {
+	names := make([]string, 0, len(specialSets))
+	for name := range specialSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SpecialSet returns the expressions of the built-in domain set name.
+func SpecialSet(name string) ([]string, bool) {
+	l, ok := specialSets[name]
+	if !ok {
+		return nil, false
+	}
+	exps := make([]string, 0, len(l))
+	for _, s := range l {
+		exps = append(exps, MatcherDomain+":"+s)
+	}
+	return exps, true
+}
+
+// addSpecial adds the built-in domain set of s ("@name") to m.
+func addSpecial[T any](m WriteableMatcher[T], s string, v T) error {
+	name := strings.TrimPrefix(s, SpecialPrefix)
+	exps, ok := SpecialSet(name)
+	if !ok {
+		return fmt.Errorf("unknown domain set %s, available sets are %s", name, strings.Join(SpecialSetNames(), ", "))
+	}
+	for _, exp := range exps {
+		if err := m.Add(exp, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
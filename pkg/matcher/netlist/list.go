@@ -115,6 +115,7 @@ func (list *List) Match(addr netip.Addr) bool {
 }
 
 // Contains reports whether the list includes the given netip.Addr.
+// IPv4-mapped IPv6 addresses are matched as IPv4 addresses.
 func (list *List) Contains(addr netip.Addr) bool {
 	if !list.sorted {
 		panic("list is not sorted")
@@ -52,9 +52,13 @@ func LoadFromReader(l *List, reader io.Reader) error {
 	return scanner.Err()
 }
 
-// LoadFromText loads an IP from s.
+// LoadFromText loads an IP, a CIDR or a special-use set ("@private")
+// from s. See SpecialSetNames for available sets.
 // It might modify the List and causes List unsorted.
 func LoadFromText(l *List, s string) error {
+	if strings.HasPrefix(s, SpecialPrefix) {
+		return appendSpecial(l, s)
+	}
 	if strings.ContainsRune(s, '/') {
 		ipNet, err := netip.ParsePrefix(s)
 		if err != nil {
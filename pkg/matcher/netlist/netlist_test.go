@@ -116,3 +116,42 @@ func TestIPNetList_New_And_Contains(t *testing.T) {
 		})
 	}
 }
+
+func TestList_SpecialSets(t *testing.T) {
+	l := NewList()
+	for _, s := range []string{"@private", "@cgnat", "8.8.8.8"} {
+		if err := LoadFromText(l, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Sort()
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"172.31.255.255", true},
+		{"172.32.0.0", false},
+		{"fd00::1", true},
+		{"100.100.0.1", true},
+		{"::ffff:8.8.8.8", true},
+		{"127.0.0.1", false},
+		{"1.1.1.1", false},
+	}
+	for _, tt := range tests {
+		if got := l.Match(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if err := LoadFromText(NewList(), "@nonexistent"); err == nil {
+		t.Fatal("unknown set should fail")
+	}
+	for _, name := range SpecialSetNames() {
+		if p, ok := SpecialSet(name); !ok || len(p) == 0 {
+			t.Fatalf("set %s is empty", name)
+		}
+	}
+}
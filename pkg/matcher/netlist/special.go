@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package netlist
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// SpecialPrefix is the prefix of named special-use sets in ip lists,
+// e.g. "@private".
+const SpecialPrefix = "@"
+
+// specialSets are special-use address ranges (RFC 6890 and its updates).
+var specialSets = map[string][]string{
+	"private":       {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+	"loopback":      {"127.0.0.0/8", "::1/128"},
+	"cgnat":         {"100.64.0.0/10"},
+	"link_local":    {"169.254.0.0/16", "fe80::/10"},
+	"documentation": {"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "2001:db8::/32"},
+	"benchmarking":  {"198.18.0.0/15", "2001:2::/48"},
+	"multicast":     {"224.0.0.0/4", "ff00::/8"},
+	"unspecified":   {"0.0.0.0/8", "::/128"},
+	"reserved":      {"240.0.0.0/4", "255.255.255.255/32"},
+}
+
+// specialOnly are ranges that are only in the "special" set.
+var specialOnly = []string{
+	"192.0.0.0/24", // IETF protocol assignments
+	"2001::/23",    // IETF protocol assignments
+	"100::/64",     // discard-only
+}
+
+// SpecialSetNames returns the names of all special-use sets.
+// "special" is the union of all sets and some other IETF ranges.
+func SpecialSetNames() []string {
+	names := make([]string, 0, len(specialSets)+1)
+	for name := range specialSets {
+		names = append(names, name)
+	}
+	names = append(names, "special")
+	sort.Strings(names)
+	return names
+}
+
+// SpecialSet returns the prefixes of the special-use set name.
+func SpecialSet(name string) ([]netip.Prefix, bool) {
+	var l []string
+	if name == "special" {
+		for _, s := range specialSets {
+			l = append(l, s...)
+		}
+		l = append(l, specialOnly...)
+	} else {
+		s, ok := specialSets[name]
+		if !ok {
+			return nil, false
+		}
+		l = s
+	}
+	prefixes := make([]netip.Prefix, 0, len(l))
+	for _, s := range l {
+		prefixes = append(prefixes, netip.MustParsePrefix(s))
+	}
+	return prefixes, true
+}
+
+// appendSpecial appends the special-use set of s ("@name") to l.
+func appendSpecial(l *List, s string) error {
+	name := strings.TrimPrefix(s, SpecialPrefix)
+	prefixes, ok := SpecialSet(name)
+	if !ok {
+		return fmt.Errorf("unknown special-use set %s, available sets are %s", name, strings.Join(SpecialSetNames(), ", "))
+	}
+	l.Append(prefixes...)
+	return nil
+}
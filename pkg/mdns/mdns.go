@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package mdns has constants and helpers of multicast dns (RFC 6762)
+// that are shared by mdns plugins.
+package mdns
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	Port = 5353
+
+	// CacheFlushBit is the top bit of the rrclass of records in
+	// multicast responses. See RFC 6762 10.2.
+	CacheFlushBit = 1 << 15
+	// UnicastResponseBit is the top bit of the qclass. See RFC 6762 5.4.
+	UnicastResponseBit = 1 << 15
+)
+
+var (
+	GroupV4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: Port}
+	GroupV6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: Port}
+)
+
+// Interfaces returns interfaces by names. If names is empty, it returns
+// all up multicast interfaces except loopback, which may be empty.
+func Interfaces(names []string) ([]net.Interface, error) {
+	var ifaces []net.Interface
+	if len(names) > 0 {
+		for _, name := range names {
+			ifi, err := net.InterfaceByName(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid interface %s, %w", name, err)
+			}
+			ifaces = append(ifaces, *ifi)
+		}
+		return ifaces, nil
+	}
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+			ifaces = append(ifaces, ifi)
+		}
+	}
+	return ifaces, nil
+}
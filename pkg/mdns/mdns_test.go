@@ -0,0 +1,40 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mdns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestInterfaces(t *testing.T) {
+	if _, err := Interfaces([]string{"no-such-interface"}); err == nil {
+		t.Fatal("want error of an invalid interface")
+	}
+	ifaces, err := Interfaces(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			t.Fatalf("loopback interface %s should be excluded", ifi.Name)
+		}
+	}
+}
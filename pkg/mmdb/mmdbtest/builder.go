@@ -0,0 +1,254 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package mmdbtest builds small MaxMind DB files for tests.
+package mmdbtest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+const (
+	recEmpty = -1
+)
+
+// Builder builds a database. Values may be map[string]any, []any,
+// string, bool, float64, uint16, uint32, uint64, int and int32.
+type Builder struct {
+	IPVersion  int // 4 or 6, default 6.
+	RecordSize int // 24, 28 or 32, default 24.
+
+	nodes [][2]int // >= 0: node, recEmpty, < recEmpty: data -2-i
+	data  []any
+}
+
+// Insert maps prefix to v. Longer prefixes override shorter ones if
+// they are inserted later.
+func (b *Builder) Insert(prefix netip.Prefix, v any) {
+	if len(b.nodes) == 0 {
+		b.nodes = append(b.nodes, [2]int{recEmpty, recEmpty})
+	}
+	addr := prefix.Addr()
+	bits := prefix.Bits()
+	var ip []byte
+	if b.IPVersion == 4 {
+		a := addr.Unmap().As4()
+		ip = a[:]
+	} else {
+		a := addr.As16()
+		if addr.Is4() {
+			// IPv4 networks live in ::/96.
+			bits += 96
+			a[10], a[11] = 0, 0
+		}
+		ip = a[:]
+	}
+	b.data = append(b.data, v)
+	ref := -2 - (len(b.data) - 1)
+
+	node := 0
+	for i := 0; i < bits; i++ {
+		bit := int(ip[i>>3]>>(7-uint(i&7))) & 1
+		if i == bits-1 {
+			b.nodes[node][bit] = ref
+			return
+		}
+		next := b.nodes[node][bit]
+		if next < 0 {
+			// Split an empty or data record into a new node that
+			// keeps the old value on both sides.
+			b.nodes = append(b.nodes, [2]int{next, next})
+			next = len(b.nodes) - 1
+			b.nodes[node][bit] = next
+		}
+		node = next
+	}
+}
+
+// Bytes returns the database file content.
+func (b *Builder) Bytes() []byte {
+	ipVersion := b.IPVersion
+	if ipVersion == 0 {
+		ipVersion = 6
+	}
+	recordSize := b.RecordSize
+	if recordSize == 0 {
+		recordSize = 24
+	}
+	if len(b.nodes) == 0 {
+		b.nodes = append(b.nodes, [2]int{recEmpty, recEmpty})
+	}
+
+	var data []byte
+	offsets := make([]int, len(b.data))
+	for i, v := range b.data {
+		offsets[i] = len(data)
+		data = encode(data, v)
+	}
+
+	nodeCount := len(b.nodes)
+	recordValue := func(r int) uint32 {
+		switch {
+		case r >= 0:
+			return uint32(r)
+		case r == recEmpty:
+			return uint32(nodeCount)
+		default:
+			return uint32(nodeCount + 16 + offsets[-2-r])
+		}
+	}
+
+	var out []byte
+	for _, n := range b.nodes {
+		l, r := recordValue(n[0]), recordValue(n[1])
+		switch recordSize {
+		case 24:
+			out = append(out, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			out = append(out, byte(l>>16), byte(l>>8), byte(l), byte(l>>24<<4)|byte(r>>24&0x0f), byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			out = binary.BigEndian.AppendUint32(out, l)
+			out = binary.BigEndian.AppendUint32(out, r)
+		default:
+			panic(fmt.Sprintf("invalid record size %d", recordSize))
+		}
+	}
+	out = append(out, make([]byte, 16)...)
+	out = append(out, data...)
+	out = append(out, "\xAB\xCD\xEFMaxMind.com"...)
+	out = encode(out, map[string]any{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(ipVersion),
+		"database_type":               "mmdbtest",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(0),
+	})
+	return out
+}
+
+// WriteFile writes the database to a file in t.TempDir() and returns
+// its path.
+func (b *Builder) WriteFile(t testing.TB) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(f, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func appendCtrl(b []byte, typ int, size int) []byte {
+	var ctrl byte
+	var ext []byte
+	if typ > 7 {
+		ext = []byte{byte(typ - 7)}
+	} else {
+		ctrl = byte(typ) << 5
+	}
+	var sz []byte
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+		sz = []byte{byte(size - 29)}
+	case size < 65821:
+		ctrl |= 30
+		s := size - 285
+		sz = []byte{byte(s >> 8), byte(s)}
+	default:
+		ctrl |= 31
+		s := size - 65821
+		sz = []byte{byte(s >> 16), byte(s >> 8), byte(s)}
+	}
+	b = append(b, ctrl)
+	b = append(b, ext...)
+	return append(b, sz...)
+}
+
+func appendUint(b []byte, typ int, u uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], u)
+	i := 0
+	for i < 8 && buf[i] == 0 {
+		i++
+	}
+	b = appendCtrl(b, typ, 8-i)
+	return append(b, buf[i:]...)
+}
+
+func encode(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case string:
+		b = appendCtrl(b, 2, len(v))
+		return append(b, v...)
+	case float64:
+		b = appendCtrl(b, 3, 8)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	case []byte:
+		b = appendCtrl(b, 4, len(v))
+		return append(b, v...)
+	case uint16:
+		return appendUint(b, 5, uint64(v))
+	case uint32:
+		return appendUint(b, 6, uint64(v))
+	case int:
+		return appendUint(b, 6, uint64(v))
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendCtrl(b, 7, len(v))
+		for _, k := range keys {
+			b = encode(b, k)
+			b = encode(b, v[k])
+		}
+		return b
+	case int32:
+		b = appendCtrl(b, 8, 4)
+		return binary.BigEndian.AppendUint32(b, uint32(v))
+	case uint64:
+		return appendUint(b, 9, v)
+	case []any:
+		b = appendCtrl(b, 11, len(v))
+		for _, e := range v {
+			b = encode(b, e)
+		}
+		return b
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		return appendCtrl(b, 14, size)
+	default:
+		panic(fmt.Sprintf("mmdbtest: unsupported type %T", v))
+	}
+}
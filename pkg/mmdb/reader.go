@@ -0,0 +1,436 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package mmdb reads MaxMind DB (.mmdb) files such as GeoLite2-Country
+// and GeoLite2-ASN. The whole file is kept in memory.
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+)
+
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const (
+	dataSectionSeparator = 16
+	maxDecodeDepth       = 32
+)
+
+var (
+	ErrInvalidDatabase = errors.New("invalid mmdb database")
+)
+
+// Metadata is the metadata section of a database.
+type Metadata struct {
+	NodeCount    uint32
+	RecordSize   uint16
+	IPVersion    uint16
+	DatabaseType string
+	BuildEpoch   uint64
+}
+
+// Reader looks up networks in a database. It is safe for concurrent use.
+type Reader struct {
+	buf       []byte
+	tree      []byte
+	data      []byte
+	meta      Metadata
+	nodeBytes int
+	ipv4Start uint32
+}
+
+// Open reads the database file f.
+func Open(f string) (*Reader, error) {
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(b)
+}
+
+// FromBytes parses a database from b. b must not be modified afterward.
+func FromBytes(b []byte) (*Reader, error) {
+	i := bytes.LastIndex(b, metadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w, metadata marker not found", ErrInvalidDatabase)
+	}
+	metaStart := i + len(metadataMarker)
+	d := decoder{buf: b[metaStart:]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w, bad metadata, %w", ErrInvalidDatabase, err)
+	}
+	mm, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w, metadata is not a map", ErrInvalidDatabase)
+	}
+
+	r := &Reader{buf: b}
+	r.meta.NodeCount = uint32(toUint(mm["node_count"]))
+	r.meta.RecordSize = uint16(toUint(mm["record_size"]))
+	r.meta.IPVersion = uint16(toUint(mm["ip_version"]))
+	r.meta.DatabaseType, _ = mm["database_type"].(string)
+	r.meta.BuildEpoch = toUint(mm["build_epoch"])
+
+	switch r.meta.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w, unsupported record size %d", ErrInvalidDatabase, r.meta.RecordSize)
+	}
+	if r.meta.IPVersion != 4 && r.meta.IPVersion != 6 {
+		return nil, fmt.Errorf("%w, unsupported ip version %d", ErrInvalidDatabase, r.meta.IPVersion)
+	}
+	r.nodeBytes = int(r.meta.RecordSize) / 4
+	treeSize := uint64(r.meta.NodeCount) * uint64(r.nodeBytes)
+	if treeSize+dataSectionSeparator > uint64(i) {
+		return nil, fmt.Errorf("%w, search tree is larger than the file", ErrInvalidDatabase)
+	}
+	r.tree = b[:treeSize]
+	r.data = b[treeSize+dataSectionSeparator : i]
+
+	if r.meta.IPVersion == 6 {
+		// IPv4 addresses live in ::/96. Find that subtree once.
+		node := uint32(0)
+		for j := 0; j < 96 && node < r.meta.NodeCount; j++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// Metadata returns the metadata of the database.
+func (r *Reader) Metadata() Metadata {
+	return r.meta
+}
+
+// record reads the left (bit == 0) or right record of node.
+func (r *Reader) record(node uint32, bit uint) uint32 {
+	b := r.tree[int(node)*r.nodeBytes:]
+	switch r.meta.RecordSize {
+	case 24:
+		off := bit * 3
+		return uint32(b[off])<<16 | uint32(b[off+1])<<8 | uint32(b[off+2])
+	case 28:
+		if bit == 0 {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		return binary.BigEndian.Uint32(b[bit*4:])
+	}
+}
+
+// LookupOffset returns the data offset of the network that contains addr.
+// Records of different networks may share one offset.
+// ok is false if addr is not in the database.
+func (r *Reader) LookupOffset(addr netip.Addr) (offset uint32, ok bool, err error) {
+	addr = addr.Unmap()
+	var ip []byte
+	node := uint32(0)
+	if addr.Is4() {
+		a4 := addr.As4()
+		ip = a4[:]
+		node = r.ipv4Start
+	} else {
+		if r.meta.IPVersion == 4 {
+			return 0, false, nil
+		}
+		a16 := addr.As16()
+		ip = a16[:]
+	}
+
+	nodeCount := r.meta.NodeCount
+	for i := 0; i < len(ip)*8 && node < nodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		node = r.record(node, bit)
+	}
+	switch {
+	case node == nodeCount:
+		return 0, false, nil
+	case node > nodeCount:
+		off := node - nodeCount - dataSectionSeparator
+		if int(off) >= len(r.data) {
+			return 0, false, fmt.Errorf("%w, data pointer %d out of range", ErrInvalidDatabase, off)
+		}
+		return off, true, nil
+	default:
+		return 0, false, fmt.Errorf("%w, search tree is too deep", ErrInvalidDatabase)
+	}
+}
+
+// Lookup returns the record of the network that contains addr.
+// Maps are decoded as map[string]any, arrays as []any, unsigned ints
+// as uint64 (uint128 as *big.Int), int32 as int64, floats as float64.
+// ok is false if addr is not in the database.
+func (r *Reader) Lookup(addr netip.Addr) (v any, ok bool, err error) {
+	off, ok, err := r.LookupOffset(addr)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	v, err = r.Decode(off)
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+// Decode decodes the value at data section offset off.
+func (r *Reader) Decode(off uint32) (any, error) {
+	d := decoder{buf: r.data}
+	v, _, err := d.decode(int(off), 0)
+	return v, err
+}
+
+// Path walks v through nested maps and returns the value at keys.
+// Integer keys index arrays.
+func Path(v any, keys ...any) (any, bool) {
+	for _, k := range keys {
+		switch k := k.(type) {
+		case string:
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			v, ok = m[k]
+			if !ok {
+				return nil, false
+			}
+		case int:
+			a, ok := v.([]any)
+			if !ok || k < 0 || k >= len(a) {
+				return nil, false
+			}
+			v = a[k]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func toUint(v any) uint64 {
+	switch v := v.(type) {
+	case uint64:
+		return v
+	case int64:
+		if v >= 0 {
+			return uint64(v)
+		}
+	}
+	return 0
+}
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+type decoder struct {
+	buf []byte
+}
+
+var errShortData = fmt.Errorf("%w, unexpected end of data", ErrInvalidDatabase)
+
+func (d *decoder) next(off, n int) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > len(d.buf) {
+		return nil, errShortData
+	}
+	return d.buf[off : off+n], nil
+}
+
+// decode decodes the value at off and returns it with the offset
+// right after it.
+func (d *decoder) decode(off int, depth int) (any, int, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, fmt.Errorf("%w, data nested too deep", ErrInvalidDatabase)
+	}
+	b, err := d.next(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	off++
+	typ := int(ctrl >> 5)
+	if typ == typePointer {
+		ptr, newOff, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, newOff, err
+	}
+	if typ == typeExtended {
+		b, err := d.next(off, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + int(b[0])
+		off++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.next(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + int(b[0])
+		case 2:
+			size = 285 + (int(b[0])<<8 | int(b[1]))
+		default:
+			size = 65821 + (int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+		}
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]any, size)
+		for i := 0; i < size; i++ {
+			k, n, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w, map key is not a string", ErrInvalidDatabase)
+			}
+			v, n, err := d.decode(n, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[ks] = v
+			off = n
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]any, 0, min(size, 1024))
+		for i := 0; i < size; i++ {
+			v, n, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = n
+		}
+		return a, off, nil
+	case typeBool:
+		if size > 1 {
+			return nil, 0, fmt.Errorf("%w, invalid bool size %d", ErrInvalidDatabase, size)
+		}
+		return size == 1, off, nil
+	case typeEndMarker, typeContainer:
+		return nil, off, nil
+	}
+
+	b, err = d.next(off, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	off += size
+	switch typ {
+	case typeString:
+		return string(b), off, nil
+	case typeBytes:
+		return bytes.Clone(b), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w, invalid double size %d", ErrInvalidDatabase, size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w, invalid float size %d", ErrInvalidDatabase, size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("%w, invalid uint size %d", ErrInvalidDatabase, size)
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, off, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("%w, invalid int32 size %d", ErrInvalidDatabase, size)
+		}
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(u)), off, nil
+		}
+		return int64(u), off, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, fmt.Errorf("%w, invalid uint128 size %d", ErrInvalidDatabase, size)
+		}
+		return new(big.Int).SetBytes(b), off, nil
+	default:
+		return nil, 0, fmt.Errorf("%w, unknown data type %d", ErrInvalidDatabase, typ)
+	}
+}
+
+func (d *decoder) pointer(ctrl byte, off int) (ptr int, newOff int, err error) {
+	n := int((ctrl>>3)&0x3) + 1
+	b, err := d.next(off, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	v := int(ctrl & 0x7)
+	switch n {
+	case 1:
+		ptr = v<<8 | int(b[0])
+	case 2:
+		ptr = (v<<16 | int(b[0])<<8 | int(b[1])) + 2048
+	case 3:
+		ptr = (v<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+	default:
+		ptr = int(binary.BigEndian.Uint32(b))
+	}
+	return ptr, off + n, nil
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mmdb
+
+import (
+	"math/big"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/mmdb/mmdbtest"
+)
+
+func TestReader_Lookup(t *testing.T) {
+	cn := map[string]any{
+		"country": map[string]any{"iso_code": "CN", "geoname_id": uint32(1814991)},
+		"names":   []any{"a", "b"},
+		"flag":    true,
+		"loc":     1.5,
+		"n":       int32(-3),
+	}
+	jp := map[string]any{"country": map[string]any{"iso_code": "JP"}}
+	asn := map[string]any{"autonomous_system_number": uint32(13335)}
+
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			b := &mmdbtest.Builder{IPVersion: ipVersion, RecordSize: recordSize}
+			b.Insert(netip.MustParsePrefix("1.0.0.0/8"), cn)
+			b.Insert(netip.MustParsePrefix("1.2.3.0/24"), jp)
+			if ipVersion == 6 {
+				b.Insert(netip.MustParsePrefix("2400::/16"), asn)
+			}
+			r, err := FromBytes(b.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m := r.Metadata(); int(m.IPVersion) != ipVersion || int(m.RecordSize) != recordSize {
+				t.Fatalf("unexpected metadata %+v", m)
+			}
+
+			tests := []struct {
+				addr string
+				want any
+			}{
+				{"1.1.1.1", cn},
+				{"1.2.3.4", jp},
+				{"1.2.4.4", cn},
+				{"::ffff:1.2.3.4", jp},
+				{"2.2.2.2", nil},
+				{"2400:1::1", asn},
+				{"2401::1", nil},
+			}
+			for _, tt := range tests {
+				v, ok, err := r.Lookup(netip.MustParseAddr(tt.addr))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := tt.want
+				if ipVersion == 4 && tt.addr == "2400:1::1" {
+					want = nil
+				}
+				if want == nil {
+					if ok {
+						t.Errorf("v%d/%d: %s: want not found, got %v", ipVersion, recordSize, tt.addr, v)
+					}
+					continue
+				}
+				if !ok || !reflect.DeepEqual(normalize(want), v) {
+					t.Errorf("v%d/%d: %s: want %v, got %v, %v", ipVersion, recordSize, tt.addr, want, v, ok)
+				}
+			}
+		}
+	}
+}
+
+// normalize converts builder input types to decoded types.
+func normalize(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = normalize(e)
+		}
+		return m
+	case []any:
+		a := make([]any, len(v))
+		for i, e := range v {
+			a[i] = normalize(e)
+		}
+		return a
+	case uint16:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	case int32:
+		return int64(v)
+	default:
+		return v
+	}
+}
+
+func TestPath(t *testing.T) {
+	v := map[string]any{"a": []any{map[string]any{"b": "c"}}}
+	if got, ok := Path(v, "a", 0, "b"); !ok || got != "c" {
+		t.Fatalf("want c, got %v, %v", got, ok)
+	}
+	if _, ok := Path(v, "a", 1); ok {
+		t.Fatal("out of range index should not be found")
+	}
+	if _, ok := Path(v, "x"); ok {
+		t.Fatal("missing key should not be found")
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want any
+	}{
+		{"pointer", []byte{0x20, 0x03, 0x00, 0x42, 'a', 'b'}, "ab"},
+		{"long string", append([]byte{0x5d, 0x01}, make([]byte, 30)...), string(make([]byte, 30))},
+		{"uint128", []byte{0x02, 0x03, 0x01, 0x00}, big.NewInt(256)},
+		{"false", []byte{0x00, 0x07}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := decoder{buf: tt.b}
+			v, _, err := d.decode(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v, tt.want) {
+				t.Fatalf("want %#v, got %#v", tt.want, v)
+			}
+		})
+	}
+
+	d := decoder{buf: []byte{0x44, 'a'}}
+	if _, _, err := d.decode(0, 0); err == nil {
+		t.Fatal("short data should fail")
+	}
+}
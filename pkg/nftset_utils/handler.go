@@ -85,8 +85,25 @@ func (h *NftSetHandler) getSetLocked() (*nftables.Set, error) {
 	return set, nil
 }
 
+// Elem is an element with a timeout. A zero Timeout means the default
+// timeout of the set.
+type Elem struct {
+	Prefix  netip.Prefix
+	Timeout time.Duration
+}
+
 // AddElems adds netip.Prefix(s) to set in a single batch.
 func (h *NftSetHandler) AddElems(es ...netip.Prefix) error {
+	elems := make([]Elem, 0, len(es))
+	for _, e := range es {
+		elems = append(elems, Elem{Prefix: e})
+	}
+	return h.AddElemsWithTimeout(elems...)
+}
+
+// AddElemsWithTimeout adds Elem(s) to set in a single batch. Timeouts are
+// ignored if the set does not have the timeout flag.
+func (h *NftSetHandler) AddElemsWithTimeout(es ...Elem) error {
 	h.m.Lock()
 	defer h.m.Unlock()
 
@@ -114,20 +131,21 @@ func (h *NftSetHandler) AddElems(es ...netip.Prefix) error {
 		elems = make([]nftables.SetElement, 0, len(es))
 	}
 
-	for i, e := range es {
+	for i, elem := range es {
+		e := elem.Prefix
 		if !e.IsValid() {
 			return fmt.Errorf("invalid prefix at index %d", i)
 		}
 		if set.Interval {
 			start := e.Masked().Addr()
-			elems = append(elems, nftables.SetElement{Key: start.AsSlice(), IntervalEnd: false})
+			elems = append(elems, nftables.SetElement{Key: start.AsSlice(), IntervalEnd: false, Timeout: elem.Timeout})
 			
 			end := netipx.PrefixLastIP(e).Next() // may be invalid if end is overflowed
 			if end.IsValid() {
 				elems = append(elems, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true})
 			}
 		} else {
-			elems = append(elems, nftables.SetElement{Key: e.Addr().AsSlice()})
+			elems = append(elems, nftables.SetElement{Key: e.Addr().AsSlice(), Timeout: elem.Timeout})
 		}
 	}
 
@@ -0,0 +1,67 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package portmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// DefaultGateway returns the ipv4 default gateway from /proc/net/route.
+func DefaultGateway() (netip.Addr, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer f.Close()
+	return parseProcRoute(bufio.NewScanner(f))
+}
+
+// parseProcRoute parses /proc/net/route. Addresses in the file are
+// hex encoded in the host byte order.
+func parseProcRoute(s *bufio.Scanner) (netip.Addr, error) {
+	s.Scan() // header
+	for s.Scan() {
+		fs := strings.Fields(s.Text())
+		if len(fs) < 3 || fs[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fs[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		var gw [4]byte
+		binary.BigEndian.PutUint32(gw[:], binary.NativeEndian.Uint32(b))
+		if addr := netip.AddrFrom4(gw); !addr.IsUnspecified() {
+			return addr, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.Addr{}, errors.New("no default route")
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package portmap
+
+import (
+	"bufio"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func Test_parseProcRoute(t *testing.T) {
+	route := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	00000000	0101A8C0	0003	0	0	0	00000000	0	0	0
+`
+	gw, err := parseProcRoute(bufio.NewScanner(strings.NewReader(route)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gw != netip.MustParseAddr("192.168.1.1") {
+		t.Fatalf("unexpected gateway %s", gw)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	natpmpPort = 5351
+
+	natpmpOpExternalAddr = 0
+	natpmpOpMapUDP       = 1
+	natpmpOpMapTCP       = 2
+
+	// natpmpInitialTimeout is the first retransmission timeout. It is
+	// doubled for every retry. See RFC 6886 3.1.
+	natpmpInitialTimeout = 250 * time.Millisecond
+	natpmpMaxTries       = 4
+)
+
+var natpmpResultErrs = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized or refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// NATPMP is a NAT-PMP client.
+type NATPMP struct {
+	gateway netip.AddrPort
+}
+
+func NewNATPMP(gateway netip.AddrPort) *NATPMP {
+	return &NATPMP{gateway: gateway}
+}
+
+func (n *NATPMP) Protocol() string {
+	return ProtocolNATPMP
+}
+
+func (n *NATPMP) ExternalAddr(ctx context.Context) (netip.Addr, error) {
+	resp, err := n.call(ctx, []byte{0, natpmpOpExternalAddr}, 12)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.AddrFrom4([4]byte(resp[8:12])), nil
+}
+
+func (n *NATPMP) Map(ctx context.Context, proto string, internalPort, externalPort uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	op, err := natpmpMapOp(proto)
+	if err != nil {
+		return 0, 0, err
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], internalPort)
+	binary.BigEndian.PutUint16(req[6:], externalPort)
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	resp, err := n.call(ctx, req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	mapped := binary.BigEndian.Uint16(resp[10:])
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+	return mapped, granted, nil
+}
+
+// Unmap deletes the mapping of internalPort. See RFC 6886 3.4.
+func (n *NATPMP) Unmap(ctx context.Context, proto string, internalPort, _ uint16) error {
+	op, err := natpmpMapOp(proto)
+	if err != nil {
+		return err
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], internalPort)
+	_, err = n.call(ctx, req, 16)
+	return err
+}
+
+func natpmpMapOp(proto string) (byte, error) {
+	switch proto {
+	case "udp":
+		return natpmpOpMapUDP, nil
+	case "tcp":
+		return natpmpOpMapTCP, nil
+	default:
+		return 0, errInvalidProto
+	}
+}
+
+// call sends req and returns the response that has at least respLen bytes.
+// The result code of the response is checked.
+func (n *NATPMP) call(ctx context.Context, req []byte, respLen int) ([]byte, error) {
+	c, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(n.gateway))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { _ = c.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	b := make([]byte, 16)
+	timeout := natpmpInitialTimeout
+	for try := 0; try < natpmpMaxTries; try++ {
+		if _, err := c.Write(req); err != nil {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		_ = c.SetReadDeadline(time.Now().Add(timeout))
+		timeout *= 2
+		for {
+			l, err := c.Read(b)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			resp := b[:l]
+			// Ignores unrelated packets.
+			if l < 4 || resp[0] != 0 || resp[1] != req[1]|0x80 {
+				continue
+			}
+			if rc := binary.BigEndian.Uint16(resp[2:]); rc != 0 {
+				if msg, ok := natpmpResultErrs[rc]; ok {
+					return nil, fmt.Errorf("natpmp error, %s", msg)
+				}
+				return nil, fmt.Errorf("natpmp error, result code %d", rc)
+			}
+			if l < respLen {
+				return nil, fmt.Errorf("invalid natpmp response length %d", l)
+			}
+			return resp, nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, errors.New("natpmp gateway didn't respond")
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package portmap creates port mappings on home routers with NAT-PMP
+// (RFC 6886) or UPnP IGD.
+package portmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	ProtocolAuto   = "auto"
+	ProtocolNATPMP = "natpmp"
+	ProtocolUPnP   = "upnp"
+)
+
+// Mapper creates port mappings on a gateway. proto is "tcp" or "udp".
+type Mapper interface {
+	// Protocol returns ProtocolNATPMP or ProtocolUPnP.
+	Protocol() string
+	// ExternalAddr returns the external address of the gateway.
+	ExternalAddr(ctx context.Context) (netip.Addr, error)
+	// Map maps externalPort of the gateway to internalPort of this host,
+	// and returns the port and lifetime that were actually mapped.
+	Map(ctx context.Context, proto string, internalPort, externalPort uint16, lifetime time.Duration) (uint16, time.Duration, error)
+	// Unmap deletes a mapping.
+	Unmap(ctx context.Context, proto string, internalPort, externalPort uint16) error
+}
+
+// Discover finds a Mapper. protocol is one of ProtocolAuto, ProtocolNATPMP
+// or ProtocolUPnP. gateway is the NAT-PMP gateway address. If it is
+// invalid, the default gateway of the system is used.
+// ProtocolAuto tries NAT-PMP first.
+func Discover(ctx context.Context, protocol string, gateway netip.Addr) (Mapper, error) {
+	discoverNATPMP := func() (Mapper, error) {
+		if !gateway.IsValid() {
+			gw, err := DefaultGateway()
+			if err != nil {
+				return nil, fmt.Errorf("failed to find the default gateway, %w", err)
+			}
+			gateway = gw
+		}
+		m := NewNATPMP(netip.AddrPortFrom(gateway, natpmpPort))
+		if _, err := m.ExternalAddr(ctx); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	discoverUPnP := func() (Mapper, error) {
+		m, err := DiscoverUPnP(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	switch protocol {
+	case ProtocolNATPMP:
+		return discoverNATPMP()
+	case ProtocolUPnP:
+		return discoverUPnP()
+	case ProtocolAuto, "":
+		m, errPMP := discoverNATPMP()
+		if errPMP == nil {
+			return m, nil
+		}
+		m, errUPnP := discoverUPnP()
+		if errUPnP == nil {
+			return m, nil
+		}
+		return nil, fmt.Errorf("no gateway was found, natpmp: %w, upnp: %w", errPMP, errUPnP)
+	default:
+		return nil, fmt.Errorf("unknown protocol %s", protocol)
+	}
+}
+
+var errInvalidProto = errors.New("invalid protocol, must be tcp or udp")
@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNATPMP serves NAT-PMP requests. It drops the first request to
+// test retransmission.
+func fakeNATPMP(t *testing.T) netip.AddrPort {
+	t.Helper()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		b := make([]byte, 64)
+		dropped := false
+		for {
+			n, addr, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if !dropped {
+				dropped = true
+				continue
+			}
+			req := b[:n]
+			resp := make([]byte, 16)
+			resp[1] = req[1] | 0x80
+			binary.BigEndian.PutUint32(resp[4:], 1000) // epoch
+			switch req[1] {
+			case natpmpOpExternalAddr:
+				copy(resp[8:], []byte{203, 0, 113, 1})
+				resp = resp[:12]
+			case natpmpOpMapTCP, natpmpOpMapUDP:
+				internal := binary.BigEndian.Uint16(req[4:])
+				external := binary.BigEndian.Uint16(req[6:])
+				if internal == 1 {
+					binary.BigEndian.PutUint16(resp[2:], 2) // refused
+				}
+				copy(resp[8:], req[4:6])
+				binary.BigEndian.PutUint16(resp[10:], external+1)
+				copy(resp[12:], req[8:12])
+			}
+			_, _ = c.WriteTo(resp, addr)
+		}
+	}()
+	return c.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestNATPMP(t *testing.T) {
+	m := NewNATPMP(fakeNATPMP(t))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	addr, err := m.ExternalAddr(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != netip.MustParseAddr("203.0.113.1") {
+		t.Fatalf("unexpected external addr %s", addr)
+	}
+
+	port, lifetime, err := m.Map(ctx, "tcp", 853, 853, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 854 || lifetime != time.Hour {
+		t.Fatalf("unexpected mapping %d, %s", port, lifetime)
+	}
+	if err := m.Unmap(ctx, "udp", 853, 854); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.Map(ctx, "tcp", 1, 1, time.Hour); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("want a refused error, got %v", err)
+	}
+	if _, _, err := m.Map(ctx, "sctp", 1, 1, time.Hour); err == nil {
+		t.Fatal("want an error")
+	}
+}
+
+func TestUPnP(t *testing.T) {
+	const serviceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	var mappings []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+ <device>
+  <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+  <deviceList><device>
+   <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+   <deviceList><device>
+    <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+    <serviceList><service>
+     <serviceType>%s</serviceType>
+     <controlURL>/ctl/IPConn</controlURL>
+    </service></serviceList>
+   </device></deviceList>
+  </device></deviceList>
+ </device>
+</root>`, serviceType)
+	})
+	mux.HandleFunc("/ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		action := r.Header.Get("SOAPAction")
+		body, _ := io.ReadAll(r.Body)
+		switch action {
+		case `"` + serviceType + `#GetExternalIPAddress"`:
+			fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetExternalIPAddressResponse xmlns:u="`+serviceType+`"><NewExternalIPAddress>198.51.100.7</NewExternalIPAddress></u:GetExternalIPAddressResponse>
+</s:Body></s:Envelope>`)
+		case `"` + serviceType + `#AddPortMapping"`:
+			values, err := parseSOAPBody(strings.NewReader(string(body)))
+			if err != nil || values["NewInternalClient"] != "127.0.0.1" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if values["NewExternalPort"] == "443" {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail>
+<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>718</errorCode><errorDescription>ConflictInMappingEntry</errorDescription></UPnPError>
+</detail></s:Fault></s:Body></s:Envelope>`)
+				return
+			}
+			mappings = append(mappings, values["NewProtocol"]+":"+values["NewExternalPort"]+":"+values["NewLeaseDuration"])
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	u, err := NewUPnP(ctx, srv.URL+"/desc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.controlURL != srv.URL+"/ctl/IPConn" {
+		t.Fatalf("unexpected control url %s", u.controlURL)
+	}
+	addr, err := u.ExternalAddr(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != netip.MustParseAddr("198.51.100.7") {
+		t.Fatalf("unexpected external addr %s", addr)
+	}
+	if _, _, err := u.Map(ctx, "tcp", 853, 853, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 1 || mappings[0] != "TCP:853:3600" {
+		t.Fatalf("unexpected mappings %v", mappings)
+	}
+	if _, _, err := u.Map(ctx, "tcp", 443, 443, time.Hour); err == nil || !strings.Contains(err.Error(), "ConflictInMappingEntry") {
+		t.Fatalf("want a conflict error, got %v", err)
+	}
+}
+
+func Test_parseSSDPResponse(t *testing.T) {
+	resp := "HTTP/1.1 200 OK\r\n" +
+		"CACHE-CONTROL: max-age=120\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"LOCATION: http://192.168.1.1:5000/rootDesc.xml\r\n\r\n"
+	if l := parseSSDPResponse([]byte(resp)); l != "http://192.168.1.1:5000/rootDesc.xml" {
+		t.Fatalf("unexpected location %q", l)
+	}
+	if l := parseSSDPResponse([]byte(strings.Replace(resp, "InternetGatewayDevice", "MediaServer", 1))); l != "" {
+		t.Fatalf("want no location, got %q", l)
+	}
+}
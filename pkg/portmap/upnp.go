@@ -0,0 +1,328 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpAddr      = "239.255.255.250:1900"
+	ssdpSearchIGD = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+
+	upnpDescription = "mosdns"
+	upnpMaxBodySize = 1 << 20
+)
+
+// UPnP is an UPnP IGD client of the WANIPConnection or WANPPPConnection
+// service.
+type UPnP struct {
+	controlURL  string
+	serviceType string
+	localAddr   netip.Addr // the address of this host that reaches the gateway
+	client      *http.Client
+}
+
+// DiscoverUPnP finds an internet gateway device with SSDP.
+func DiscoverUPnP(ctx context.Context) (*UPnP, error) {
+	location, err := ssdpSearch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewUPnP(ctx, location)
+}
+
+// NewUPnP creates an UPnP client from the device description url.
+func NewUPnP(ctx context.Context, location string) (*UPnP, error) {
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device description, %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get device description, http status %d", resp.StatusCode)
+	}
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, upnpMaxBodySize)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("invalid device description, %w", err)
+	}
+	svc := root.Device.findWANConnection()
+	if svc == nil {
+		return nil, errors.New("device has no wan connection service")
+	}
+
+	base := location
+	if len(root.URLBase) > 0 {
+		base = root.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url, %w", err)
+	}
+	controlURL, err := baseURL.Parse(strings.TrimSpace(svc.ControlURL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid control url, %w", err)
+	}
+	localAddr, err := localAddrTo(controlURL)
+	if err != nil {
+		return nil, err
+	}
+	return &UPnP{
+		controlURL:  controlURL.String(),
+		serviceType: strings.TrimSpace(svc.ServiceType),
+		localAddr:   localAddr,
+		client:      client,
+	}, nil
+}
+
+func (u *UPnP) Protocol() string {
+	return ProtocolUPnP
+}
+
+func (u *UPnP) ExternalAddr(ctx context.Context) (netip.Addr, error) {
+	resp, err := u.soap(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(resp["NewExternalIPAddress"]))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid external address, %w", err)
+	}
+	return addr, nil
+}
+
+// Map adds a port mapping. The external port must be available, UPnP
+// doesn't pick another port.
+func (u *UPnP) Map(ctx context.Context, proto string, internalPort, externalPort uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	if proto != "tcp" && proto != "udp" {
+		return 0, 0, errInvalidProto
+	}
+	_, err := u.soap(ctx, "AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(externalPort))},
+		{"NewProtocol", strings.ToUpper(proto)},
+		{"NewInternalPort", strconv.Itoa(int(internalPort))},
+		{"NewInternalClient", u.localAddr.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", upnpDescription},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return externalPort, lifetime, nil
+}
+
+func (u *UPnP) Unmap(ctx context.Context, proto string, _, externalPort uint16) error {
+	if proto != "tcp" && proto != "udp" {
+		return errInvalidProto
+	}
+	_, err := u.soap(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(externalPort))},
+		{"NewProtocol", strings.ToUpper(proto)},
+	})
+	return err
+}
+
+// soap calls action with ordered args, and returns the values of the
+// response.
+func (u *UPnP) soap(ctx context.Context, action string, args [][2]string) (map[string]string, error) {
+	body := new(bytes.Buffer)
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(body, `<u:%s xmlns:u="%s">`, action, u.serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(body, "<%s>", arg[0])
+		_ = xml.EscapeText(body, []byte(arg[1]))
+		fmt.Fprintf(body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.controlURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.serviceType, action))
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	values, err := parseSOAPBody(io.LimitReader(resp.Body, upnpMaxBodySize))
+	if resp.StatusCode != http.StatusOK {
+		if desc := values["errorDescription"]; len(desc) > 0 {
+			return nil, fmt.Errorf("upnp error %s, %s", values["errorCode"], desc)
+		}
+		return nil, fmt.Errorf("upnp error, http status %d", resp.StatusCode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid soap response, %w", err)
+	}
+	return values, nil
+}
+
+// parseSOAPBody returns the text of leaf elements in the body.
+func parseSOAPBody(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	d := xml.NewDecoder(r)
+	var name string
+	var text []byte
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return values, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text = text[:0]
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			if t.Name.Local == name {
+				values[name] = string(text)
+			}
+			name = ""
+		}
+	}
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+func (d *upnpDevice) findWANConnection() *upnpService {
+	for i, s := range d.Services {
+		if strings.Contains(s.ServiceType, ":WANIPConnection:") || strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+			return &d.Services[i]
+		}
+	}
+	for i := range d.Devices {
+		if s := d.Devices[i].findWANConnection(); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// ssdpSearch sends a SSDP M-SEARCH for internet gateway devices and
+// returns the location of the first response.
+func ssdpSearch(ctx context.Context) (string, error) {
+	c, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { _ = c.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+	msg := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: " + ssdpSearchIGD + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := c.WriteTo([]byte(msg), dst); err != nil {
+		return "", err
+	}
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	b := make([]byte, 2048)
+	for {
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return "", errors.New("no upnp gateway was found")
+			}
+			return "", err
+		}
+		if location := parseSSDPResponse(b[:n]); len(location) > 0 {
+			return location, nil
+		}
+	}
+}
+
+// parseSSDPResponse returns the location of a SSDP response of an IGD.
+// It returns an empty string if b is not one.
+func parseSSDPResponse(b []byte) string {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return ""
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("St"), "InternetGatewayDevice") {
+		return ""
+	}
+	return resp.Header.Get("Location")
+}
+
+// localAddrTo returns the local address that is used to reach the host
+// of u.
+func localAddrTo(u *url.URL) (netip.Addr, error) {
+	port := u.Port()
+	if len(port) == 0 {
+		port = "80"
+	}
+	c, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to find the local address, %w", err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
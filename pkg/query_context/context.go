@@ -48,6 +48,7 @@ type Context struct {
 	resp        *dns.Msg
 	respOpt     *dns.OPT // nil if clientOpt == nil
 	upstreamOpt *dns.OPT // may be nil
+	dropResp    bool
 
 	// lazy init.
 	kv    map[uint32]any
@@ -149,6 +150,17 @@ func (ctx *Context) RespOpt() *dns.OPT {
 	return ctx.respOpt
 }
 
+// DropResponse tells the server not to send any response to the client.
+// Note that tcp based servers may close the connection instead.
+func (ctx *Context) DropResponse() {
+	ctx.dropResp = true
+}
+
+// ResponseDropped reports whether DropResponse was called.
+func (ctx *Context) ResponseDropped() bool {
+	return ctx.dropResp
+}
+
 // UpstreamOpt returns the OPT from upstream. May be nil.
 // Plugins that responsible for handling EDNS0 option should
 // check UpstreamOpt and pick/add options into RespOpt on demand.
@@ -188,6 +200,7 @@ func (ctx *Context) CopyTo(d *Context) *Context {
 		d.respOpt = dns.Copy(ctx.respOpt).(*dns.OPT)
 	}
 	d.upstreamOpt = ctx.upstreamOpt
+	d.dropResp = ctx.dropResp
 
 	d.kv = copyMap(ctx.kv)
 	d.marks = copyMap(ctx.marks)
@@ -33,3 +33,13 @@ func RegKey() uint32 {
 	}
 	return i
 }
+
+// Well-known keys of values that plugins store for logging.
+var (
+	// KeyUpstream is the name (string) of the upstream that answered the
+	// query.
+	KeyUpstream = RegKey()
+	// KeyRule is the rule (string) that decided the response, e.g. a
+	// matched blocklist rule.
+	KeyRule = RegKey()
+)
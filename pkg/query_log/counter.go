@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"sync"
+	"time"
+)
+
+// Counter counts records in one-second slots. Unlike Summarize over a
+// Ring, its counts are exact no matter how many queries there are in
+// the window. It is safe for concurrent use.
+type Counter struct {
+	m     sync.Mutex
+	slots []counterSlot
+}
+
+type counterSlot struct {
+	sec       int64 // unix time of the slot
+	total     uint32
+	blocked   uint32
+	errors    uint32
+	latencyMs float64
+}
+
+// NewCounter returns a Counter that keeps counts of the last span
+// (at least a minute). It takes 32 bytes per second of span.
+func NewCounter(span time.Duration) *Counter {
+	n := int(span / time.Second)
+	if n < 60 {
+		n = 60
+	}
+	return &Counter{slots: make([]counterSlot, n)}
+}
+
+// Add counts r in the slot of r.Time. It should be called in the
+// handler path, so no record is lost.
+func (c *Counter) Add(r *Record) {
+	sec := r.Time.Unix()
+	c.m.Lock()
+	defer c.m.Unlock()
+	s := &c.slots[c.index(sec)]
+	if s.sec != sec {
+		if s.sec > sec { // older than the span
+			return
+		}
+		*s = counterSlot{sec: sec}
+	}
+	s.total++
+	if len(r.Rule) > 0 {
+		s.blocked++
+	}
+	if len(r.Err) > 0 {
+		s.errors++
+	}
+	s.latencyMs += r.LatencyMs
+}
+
+func (c *Counter) index(sec int64) int {
+	i := int(sec % int64(len(c.slots)))
+	if i < 0 {
+		i += len(c.slots)
+	}
+	return i
+}
+
+// Counts returns the counts of records in (now-window, now]. The window
+// is limited by the span of c.
+func (c *Counter) Counts(now time.Time, window time.Duration) Counts {
+	to := now.Unix()
+	n := int64(window / time.Second)
+	n = min(n, int64(len(c.slots)))
+	cs := Counts{QPSSeries: make([]int, 60)}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	var latency float64
+	for sec := to - n + 1; sec <= to; sec++ {
+		s := &c.slots[c.index(sec)]
+		if s.sec != sec {
+			continue
+		}
+		cs.Total += int(s.total)
+		cs.Blocked += int(s.blocked)
+		cs.Errors += int(s.errors)
+		latency += s.latencyMs
+	}
+	for i := range cs.QPSSeries {
+		sec := to - int64(len(cs.QPSSeries)-1-i)
+		if s := &c.slots[c.index(sec)]; s.sec == sec {
+			cs.QPSSeries[i] = int(s.total)
+		}
+	}
+	if cs.Total > 0 {
+		cs.AvgLatencyMs = latency / float64(cs.Total)
+	}
+	if n > 0 {
+		cs.QPS = float64(cs.Total) / float64(n)
+	}
+	return cs
+}
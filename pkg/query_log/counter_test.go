@@ -0,0 +1,53 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounter(time.Minute * 5)
+	now := time.Unix(1000, 0)
+	c.Add(&Record{Time: now.Add(-time.Minute * 10)}) // out of the window
+	for i := 0; i < 3; i++ {
+		c.Add(&Record{Time: now, LatencyMs: 10})
+	}
+	c.Add(&Record{Time: now.Add(-time.Second), Rule: "||ads.com^", LatencyMs: 2})
+	c.Add(&Record{Time: now.Add(-time.Minute * 2), Err: "timeout", LatencyMs: 4})
+
+	cs := c.Counts(now, time.Minute*5)
+	if cs.Total != 5 || cs.Blocked != 1 || cs.Errors != 1 || cs.QPS != 5.0/300 || cs.AvgLatencyMs != 36.0/5 {
+		t.Fatalf("unexpected counts %+v", cs)
+	}
+	if cs.QPSSeries[59] != 3 || cs.QPSSeries[58] != 1 {
+		t.Fatalf("unexpected qps series %v", cs.QPSSeries)
+	}
+	if cs := c.Counts(now, time.Minute); cs.Total != 4 {
+		t.Fatalf("want 4 queries in the last minute, got %d", cs.Total)
+	}
+
+	// A late record of an old slot doesn't reset a newer one.
+	c.Add(&Record{Time: now.Add(-time.Minute * 5)})
+	if cs := c.Counts(now, time.Minute*5); cs.Total != 5 {
+		t.Fatalf("want 5 queries, got %d", cs.Total)
+	}
+}
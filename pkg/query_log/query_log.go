@@ -0,0 +1,222 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+// Record is a query log event.
+type Record struct {
+	Time        time.Time `json:"time"`
+	Client      string    `json:"client,omitempty"`
+	ClientGroup string    `json:"client_group,omitempty"`
+	ClientID    string    `json:"client_id,omitempty"`
+	QName       string    `json:"qname"`
+	QType       string    `json:"qtype"`
+	Rcode       string    `json:"rcode"`
+	Answers     []string  `json:"answers,omitempty"`
+	LatencyMs   float64   `json:"latency_ms"`
+	Upstream    string    `json:"upstream,omitempty"`
+	Rule        string    `json:"rule,omitempty"` // the rule that decided the response, e.g. a blocklist rule
+	Err         string    `json:"err,omitempty"`
+	// Dropped means no response was sent, e.g. the query was dropped by
+	// a rate limiter.
+	Dropped bool `json:"dropped,omitempty"`
+
+	clientAddr netip.Addr
+	qtype      uint16
+}
+
+// NewRecord builds a Record from a finished query. resp and err may be nil.
+// resp is ignored if the response of qCtx was dropped.
+// It is shared by the live query log, the dashboard and the query_log and
+// query_stats plugins.
+func NewRecord(qCtx *query_context.Context, resp *dns.Msg, err error) *Record {
+	q := qCtx.QQuestion()
+	r := &Record{
+		Time:        qCtx.StartTime(),
+		ClientGroup: qCtx.ServerMeta.ClientGroup,
+		ClientID:    qCtx.ServerMeta.ClientID,
+		QName:       q.Name,
+		QType:       dnsutils.QtypeToString(q.Qtype),
+		LatencyMs:   float64(time.Since(qCtx.StartTime()).Microseconds()) / 1000,
+		clientAddr:  qCtx.ServerMeta.ClientAddr,
+		qtype:       q.Qtype,
+	}
+	if r.clientAddr.IsValid() {
+		r.Client = r.clientAddr.String()
+	}
+	if qCtx.ResponseDropped() {
+		r.Dropped = true
+		resp = nil
+	}
+	if resp != nil {
+		r.Rcode = dns.RcodeToString[resp.Rcode]
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				r.Answers = append(r.Answers, rr.A.String())
+			case *dns.AAAA:
+				r.Answers = append(r.Answers, rr.AAAA.String())
+			case *dns.CNAME:
+				r.Answers = append(r.Answers, rr.Target)
+			}
+		}
+	}
+	if v, ok := qCtx.GetValue(query_context.KeyUpstream); ok {
+		r.Upstream, _ = v.(string)
+	}
+	if v, ok := qCtx.GetValue(query_context.KeyRule); ok {
+		r.Rule, _ = v.(string)
+	}
+	if err != nil {
+		r.Err = err.Error()
+	}
+	return r
+}
+
+// Qtype returns the numeric qtype of the query.
+func (r *Record) Qtype() uint16 {
+	return r.qtype
+}
+
+// RcodeCode returns the numeric rcode of the response. ok is false if
+// there is no response.
+func (r *Record) RcodeCode() (rcode int, ok bool) {
+	rcode, ok = dns.StringToRcode[r.Rcode]
+	return rcode, ok
+}
+
+// Filter selects records. Zero value selects all records.
+type Filter struct {
+	// Client is an ip or a cidr.
+	Client netip.Prefix
+	// Domain matches the qname and its subdomains.
+	Domain string
+}
+
+// ParseFilter parses a filter. All args are optional.
+func ParseFilter(client, domain string) (Filter, error) {
+	var f Filter
+	if len(client) > 0 {
+		if strings.ContainsRune(client, '/') {
+			p, err := netip.ParsePrefix(client)
+			if err != nil {
+				return f, fmt.Errorf("invalid client, %w", err)
+			}
+			f.Client = p.Masked()
+		} else {
+			a, err := netip.ParseAddr(client)
+			if err != nil {
+				return f, fmt.Errorf("invalid client, %w", err)
+			}
+			f.Client = netip.PrefixFrom(a, a.BitLen())
+		}
+	}
+	if len(domain) > 0 {
+		f.Domain = dns.Fqdn(strings.ToLower(domain))
+	}
+	return f, nil
+}
+
+func (f Filter) Match(r *Record) bool {
+	if f.Client.IsValid() && !f.Client.Contains(r.clientAddr.Unmap()) && !f.Client.Contains(r.clientAddr) {
+		return false
+	}
+	if len(f.Domain) > 0 {
+		qname := strings.ToLower(r.QName)
+		if qname != f.Domain && !strings.HasSuffix(qname, "."+f.Domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// Hub broadcasts records to subscribers. It is safe for concurrent use.
+// Slow subscribers lose records instead of blocking publishers.
+type Hub struct {
+	n    atomic.Int32
+	m    sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	f       Filter
+	c       chan *Record
+	dropped atomic.Uint64
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*subscriber]struct{})}
+}
+
+// Active reports whether h has subscribers. Publishers can call it
+// to avoid building records that no one receives.
+func (h *Hub) Active() bool {
+	return h != nil && h.n.Load() > 0
+}
+
+// Publish sends r to all matched subscribers.
+func (h *Hub) Publish(r *Record) {
+	if !h.Active() {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	for s := range h.subs {
+		if !s.f.Match(r) {
+			continue
+		}
+		select {
+		case s.c <- r:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribe returns a channel that receives matched records and a func
+// to cancel the subscription. The channel is not closed by cancel.
+func (h *Hub) Subscribe(f Filter, buf int) (<-chan *Record, func()) {
+	s := &subscriber{f: f, c: make(chan *Record, buf)}
+	h.m.Lock()
+	h.subs[s] = struct{}{}
+	h.n.Store(int32(len(h.subs)))
+	h.m.Unlock()
+	var once sync.Once
+	return s.c, func() {
+		once.Do(func() {
+			h.m.Lock()
+			delete(h.subs, s)
+			h.n.Store(int32(len(h.subs)))
+			h.m.Unlock()
+		})
+	}
+}
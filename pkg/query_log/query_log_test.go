@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	if h.Active() {
+		t.Fatal("empty hub should not be active")
+	}
+
+	f, err := ParseFilter("192.168.1.0/24", "Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, cancel := h.Subscribe(f, 4)
+	if !h.Active() {
+		t.Fatal("hub should be active")
+	}
+
+	rec := func(client, qname string) *Record {
+		return &Record{QName: qname, clientAddr: netip.MustParseAddr(client)}
+	}
+	h.Publish(rec("192.168.1.2", "www.example.com."))
+	h.Publish(rec("192.168.2.2", "www.example.com.")) // client not matched
+	h.Publish(rec("192.168.1.2", "notexample.com."))  // domain not matched
+	h.Publish(rec("::ffff:192.168.1.3", "example.com."))
+
+	for _, want := range []string{"www.example.com.", "example.com."} {
+		select {
+		case r := <-c:
+			if r.QName != want {
+				t.Fatalf("got %s, want %s", r.QName, want)
+			}
+		default:
+			t.Fatalf("missing record %s", want)
+		}
+	}
+	select {
+	case r := <-c:
+		t.Fatalf("unexpected record %v", r)
+	default:
+	}
+
+	cancel()
+	if h.Active() {
+		t.Fatal("hub should not be active after cancel")
+	}
+}
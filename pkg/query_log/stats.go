@@ -0,0 +1,187 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ring keeps the latest records. It is safe for concurrent use.
+type Ring struct {
+	m    sync.Mutex
+	buf  []*Record
+	next int
+	full bool
+}
+
+func NewRing(size int) *Ring {
+	return &Ring{buf: make([]*Record, size)}
+}
+
+func (r *Ring) Add(rec *Record) {
+	r.m.Lock()
+	r.buf[r.next] = rec
+	r.next++
+	if r.next == len(r.buf) {
+		r.next = 0
+		r.full = true
+	}
+	r.m.Unlock()
+}
+
+// Records returns kept records, oldest first.
+func (r *Ring) Records() []*Record {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if !r.full {
+		return append([]*Record(nil), r.buf[:r.next]...)
+	}
+	l := make([]*Record, 0, len(r.buf))
+	l = append(l, r.buf[r.next:]...)
+	return append(l, r.buf[:r.next]...)
+}
+
+// Count is an entry of a top list.
+type Count struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// UpstreamSummary is the summary of responses from an upstream.
+type UpstreamSummary struct {
+	Name         string  `json:"name"`
+	Count        int     `json:"count"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// Counts are the counts of queries in a time window.
+type Counts struct {
+	Total   int     `json:"total"`
+	Blocked int     `json:"blocked"` // records that have a rule
+	Errors  int     `json:"errors"`
+	QPS     float64 `json:"qps"`
+	// QPSSeries is the number of queries in every second of the last
+	// minute, oldest first.
+	QPSSeries []int `json:"qps_series"`
+
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// Summary is the summary of records in a time window.
+type Summary struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	Counts
+
+	TopDomains []Count           `json:"top_domains"`
+	TopBlocked []Count           `json:"top_blocked"`
+	TopClients []Count           `json:"top_clients"`
+	Rcodes     []Count           `json:"rcodes"`
+	Upstreams  []UpstreamSummary `json:"upstreams"`
+}
+
+// Summarize summarizes records in (now-window, now]. Top lists have at
+// most topN entries.
+func Summarize(records []*Record, now time.Time, window time.Duration, topN int) Summary {
+	from := now.Add(-window)
+	s := Summary{From: from, To: now, Counts: Counts{QPSSeries: make([]int, 60)}}
+
+	var (
+		domains  = make(map[string]int)
+		blocked  = make(map[string]int)
+		clients  = make(map[string]int)
+		rcodes   = make(map[string]int)
+		ups      = make(map[string]*UpstreamSummary)
+		latency  float64
+		upLatSum = make(map[string]float64)
+	)
+	for _, r := range records {
+		if !r.Time.After(from) || r.Time.After(now) {
+			continue
+		}
+		s.Total++
+		latency += r.LatencyMs
+		qname := strings.ToLower(r.QName)
+		domains[qname]++
+		if len(r.Rule) > 0 {
+			s.Blocked++
+			blocked[qname]++
+		}
+		if len(r.Err) > 0 {
+			s.Errors++
+		}
+		if len(r.Client) > 0 {
+			clients[r.Client]++
+		}
+		if len(r.Rcode) > 0 {
+			rcodes[r.Rcode]++
+		}
+		if len(r.Upstream) > 0 {
+			u := ups[r.Upstream]
+			if u == nil {
+				u = &UpstreamSummary{Name: r.Upstream}
+				ups[r.Upstream] = u
+			}
+			u.Count++
+			upLatSum[r.Upstream] += r.LatencyMs
+		}
+		if sec := int(now.Sub(r.Time) / time.Second); sec < len(s.QPSSeries) {
+			s.QPSSeries[len(s.QPSSeries)-1-sec]++
+		}
+	}
+	if s.Total > 0 {
+		s.AvgLatencyMs = latency / float64(s.Total)
+	}
+	if window > 0 {
+		s.QPS = float64(s.Total) / window.Seconds()
+	}
+	s.TopDomains = topCounts(domains, topN)
+	s.TopBlocked = topCounts(blocked, topN)
+	s.TopClients = topCounts(clients, topN)
+	s.Rcodes = topCounts(rcodes, len(rcodes))
+	for name, u := range ups {
+		u.AvgLatencyMs = upLatSum[name] / float64(u.Count)
+		s.Upstreams = append(s.Upstreams, *u)
+	}
+	sort.Slice(s.Upstreams, func(i, j int) bool { return s.Upstreams[i].Name < s.Upstreams[j].Name })
+	return s
+}
+
+// topCounts returns the n largest counts of m, sorted by counts
+// and then keys.
+func topCounts(m map[string]int, n int) []Count {
+	l := make([]Count, 0, len(m))
+	for k, c := range m {
+		l = append(l, Count{Key: k, Count: c})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Count != l[j].Count {
+			return l[i].Count > l[j].Count
+		}
+		return l[i].Key < l[j].Key
+	})
+	if len(l) > n {
+		l = l[:n]
+	}
+	return l
+}
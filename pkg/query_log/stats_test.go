@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	r := NewRing(3)
+	for i := 0; i < 5; i++ {
+		r.Add(&Record{LatencyMs: float64(i)})
+	}
+	l := r.Records()
+	if len(l) != 3 || l[0].LatencyMs != 2 || l[2].LatencyMs != 4 {
+		t.Fatalf("unexpected records %v", l)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	now := time.Now()
+	records := []*Record{
+		{Time: now.Add(-time.Hour), QName: "old.com."},
+		{Time: now.Add(-30 * time.Second), QName: "a.com.", Client: "192.168.1.2", Rcode: "NOERROR", Upstream: "u1", LatencyMs: 10},
+		{Time: now.Add(-2 * time.Second), QName: "A.com.", Client: "192.168.1.2", Rcode: "NOERROR", Upstream: "u1", LatencyMs: 30},
+		{Time: now.Add(-time.Second), QName: "ads.com.", Client: "192.168.1.3", Rcode: "NXDOMAIN", Rule: "||ads.com^"},
+		{Time: now.Add(-time.Second), QName: "b.com.", Client: "192.168.1.3", Err: "timeout", LatencyMs: 2000},
+	}
+	s := Summarize(records, now, time.Minute, 2)
+	if s.Total != 4 || s.Blocked != 1 || s.Errors != 1 {
+		t.Fatalf("unexpected counts %+v", s)
+	}
+	if len(s.TopDomains) != 2 || s.TopDomains[0] != (Count{Key: "a.com.", Count: 2}) {
+		t.Fatalf("unexpected top domains %v", s.TopDomains)
+	}
+	if len(s.TopBlocked) != 1 || s.TopBlocked[0].Key != "ads.com." {
+		t.Fatalf("unexpected top blocked %v", s.TopBlocked)
+	}
+	if len(s.TopClients) != 2 || s.TopClients[0].Count != 2 {
+		t.Fatalf("unexpected top clients %v", s.TopClients)
+	}
+	if len(s.Upstreams) != 1 || s.Upstreams[0] != (UpstreamSummary{Name: "u1", Count: 2, AvgLatencyMs: 20}) {
+		t.Fatalf("unexpected upstreams %v", s.Upstreams)
+	}
+	if s.QPSSeries[59] != 0 || s.QPSSeries[58] != 2 || s.QPSSeries[57] != 1 || s.QPSSeries[29] != 1 {
+		t.Fatalf("unexpected qps series %v", s.QPSSeries)
+	}
+}
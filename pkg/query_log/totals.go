@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Totals are aggregate counters of records. Unlike Summary, they are not
+// limited to a time window and can be saved to a file, so they survive
+// restarts. It is safe for concurrent use.
+type Totals struct {
+	m sync.Mutex
+	s TotalsSnapshot
+}
+
+// TotalsSnapshot is a copy of Totals.
+type TotalsSnapshot struct {
+	Since     time.Time         `json:"since"`
+	Queries   uint64            `json:"queries"`
+	Blocked   uint64            `json:"blocked"` // records that have a rule
+	Errors    uint64            `json:"errors"`
+	Upstreams map[string]uint64 `json:"upstreams"` // responses from each upstream
+}
+
+// NewTotals returns empty Totals that count since now.
+func NewTotals(now time.Time) *Totals {
+	return &Totals{s: TotalsSnapshot{Since: now, Upstreams: make(map[string]uint64)}}
+}
+
+// LoadTotals loads Totals from file. It returns empty Totals if file does
+// not exist.
+func LoadTotals(file string, now time.Time) (*Totals, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return NewTotals(now), nil
+		}
+		return nil, err
+	}
+	t := NewTotals(now)
+	if err := json.Unmarshal(b, &t.s); err != nil {
+		return nil, err
+	}
+	if t.s.Upstreams == nil {
+		t.s.Upstreams = make(map[string]uint64)
+	}
+	return t, nil
+}
+
+func (t *Totals) Add(r *Record) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.s.Queries++
+	if len(r.Rule) > 0 {
+		t.s.Blocked++
+	}
+	if len(r.Err) > 0 {
+		t.s.Errors++
+	}
+	if len(r.Upstream) > 0 {
+		t.s.Upstreams[r.Upstream]++
+	}
+}
+
+func (t *Totals) Snapshot() TotalsSnapshot {
+	t.m.Lock()
+	defer t.m.Unlock()
+	s := t.s
+	s.Upstreams = make(map[string]uint64, len(t.s.Upstreams))
+	for k, v := range t.s.Upstreams {
+		s.Upstreams[k] = v
+	}
+	return s
+}
+
+// Save writes t to file atomically.
+func (t *Totals) Save(file string) error {
+	b, err := json.Marshal(t.Snapshot())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
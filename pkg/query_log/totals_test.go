@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTotals(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "stats.json")
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tt, err := LoadTotals(f, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt.Add(&Record{QName: "a.com.", Upstream: "u1"})
+	tt.Add(&Record{QName: "b.com.", Rule: "b.com"})
+	tt.Add(&Record{QName: "c.com.", Upstream: "u1", Err: "timeout"})
+	tt.Add(&Record{QName: "d.com.", Upstream: "u2"})
+	if err := tt.Save(f); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadTotals(f, since.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TotalsSnapshot{Since: since, Queries: 4, Blocked: 1, Errors: 1, Upstreams: map[string]uint64{"u1": 2, "u2": 1}}
+	if got := loaded.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+
+	// Snapshots are copies.
+	s := loaded.Snapshot()
+	s.Upstreams["u1"] = 100
+	if loaded.Snapshot().Upstreams["u1"] != 2 {
+		t.Fatal("snapshot shares the map")
+	}
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package redis is a minimal redis client that speaks RESP2. It supports
+// pipelining and a small pool of connections.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDialTimeout = time.Second * 5
+	defaultMaxIdle     = 8
+	maxBulkLen         = 512 << 20
+	maxArrayLen        = 1 << 20
+)
+
+var ErrClosed = errors.New("redis client closed")
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Reply is a reply from the server.
+type Reply struct {
+	// Nil is set for nil bulk strings and nil arrays.
+	Nil   bool
+	Str   []byte  // simple strings and bulk strings
+	Int   int64   // integers
+	Array []Reply // arrays
+	Err   error   // error replies, Error
+}
+
+type Opts struct {
+	// Addr is "host:port". Required.
+	Addr     string
+	Password string
+	DB       int
+
+	// DialTimeout, default is 5s.
+	DialTimeout time.Duration
+	// MaxIdle is the maximum number of idle connections. Default is 8.
+	MaxIdle int
+}
+
+type Client struct {
+	opts Opts
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+type conn struct {
+	c  net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+func NewClient(opts Opts) *Client {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = defaultDialTimeout
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = defaultMaxIdle
+	}
+	return &Client{opts: opts}
+}
+
+// Do sends one command and returns its reply. Error replies are
+// returned as Error.
+func (c *Client) Do(ctx context.Context, args ...[]byte) (Reply, error) {
+	rs, err := c.Pipeline(ctx, [][][]byte{args})
+	if err != nil {
+		return Reply{}, err
+	}
+	return rs[0], rs[0].Err
+}
+
+// Pipeline sends cmds in one batch and returns their replies in order.
+// Error replies are returned in Reply.Err. The error is not nil only if
+// the connection failed.
+func (c *Client) Pipeline(ctx context.Context, cmds [][][]byte) ([]Reply, error) {
+	cn, err := c.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := cn.pipeline(ctx, cmds)
+	if err != nil {
+		cn.c.Close()
+		return nil, err
+	}
+	c.putConn(cn)
+	return rs, nil
+}
+
+func (c *Client) getConn(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	d := net.Dialer{Timeout: c.opts.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{c: nc, br: bufio.NewReader(nc), bw: bufio.NewWriter(nc)}
+	var init [][][]byte
+	if len(c.opts.Password) > 0 {
+		init = append(init, [][]byte{[]byte("AUTH"), []byte(c.opts.Password)})
+	}
+	if c.opts.DB != 0 {
+		init = append(init, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(c.opts.DB))})
+	}
+	if len(init) > 0 {
+		rs, err := cn.pipeline(ctx, init)
+		if err == nil {
+			for _, r := range rs {
+				if r.Err != nil {
+					err = r.Err
+					break
+				}
+			}
+		}
+		if err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("failed to init connection, %w", err)
+		}
+	}
+	return cn, nil
+}
+
+func (c *Client) putConn(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= c.opts.MaxIdle {
+		cn.c.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// Close closes idle connections. Connections in use are closed when
+// they are released.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cn := range c.idle {
+		cn.c.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (cn *conn) pipeline(ctx context.Context, cmds [][][]byte) ([]Reply, error) {
+	if ddl, ok := ctx.Deadline(); ok {
+		cn.c.SetDeadline(ddl)
+	} else {
+		cn.c.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() { cn.c.SetDeadline(time.Now()) })
+	defer stop()
+
+	for _, args := range cmds {
+		writeCmd(cn.bw, args)
+	}
+	if err := cn.bw.Flush(); err != nil {
+		return nil, err
+	}
+	rs := make([]Reply, len(cmds))
+	for i := range rs {
+		r, err := readReply(cn.br, 0)
+		if err != nil {
+			return nil, err
+		}
+		rs[i] = r
+	}
+	return rs, nil
+}
+
+func writeCmd(w *bufio.Writer, args [][]byte) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(len(args)))
+	w.WriteString("\r\n")
+	for _, a := range args {
+		w.WriteByte('$')
+		w.WriteString(strconv.Itoa(len(a)))
+		w.WriteString("\r\n")
+		w.Write(a)
+		w.WriteString("\r\n")
+	}
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	l, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(l) < 2 || l[len(l)-2] != '\r' {
+		return nil, errors.New("invalid line ending")
+	}
+	return l[:len(l)-2], nil
+}
+
+func readReply(r *bufio.Reader, depth int) (Reply, error) {
+	if depth > 8 {
+		return Reply{}, errors.New("reply is nested too deep")
+	}
+	l, err := readLine(r)
+	if err != nil {
+		return Reply{}, err
+	}
+	if len(l) == 0 {
+		return Reply{}, errors.New("empty reply")
+	}
+	switch l[0] {
+	case '+':
+		return Reply{Str: append([]byte(nil), l[1:]...)}, nil
+	case '-':
+		return Reply{Err: Error(l[1:])}, nil
+	case ':':
+		n, err := strconv.ParseInt(string(l[1:]), 10, 64)
+		if err != nil {
+			return Reply{}, fmt.Errorf("invalid integer reply, %w", err)
+		}
+		return Reply{Int: n}, nil
+	case '$':
+		n, err := strconv.Atoi(string(l[1:]))
+		if err != nil || n > maxBulkLen {
+			return Reply{}, fmt.Errorf("invalid bulk length %q", l[1:])
+		}
+		if n < 0 {
+			return Reply{Nil: true}, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return Reply{}, err
+		}
+		return Reply{Str: b[:n]}, nil
+	case '*':
+		n, err := strconv.Atoi(string(l[1:]))
+		if err != nil || n > maxArrayLen {
+			return Reply{}, fmt.Errorf("invalid array length %q", l[1:])
+		}
+		if n < 0 {
+			return Reply{Nil: true}, nil
+		}
+		a := make([]Reply, n)
+		for i := range a {
+			if a[i], err = readReply(r, depth+1); err != nil {
+				return Reply{}, err
+			}
+		}
+		return Reply{Array: a}, nil
+	default:
+		return Reply{}, fmt.Errorf("unknown reply type %q", l[0])
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/redis/redistest"
+)
+
+func TestClient(t *testing.T) {
+	s := redistest.NewServer(t)
+	c := NewClient(Opts{Addr: s.Addr(), Password: "pw", DB: 1})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := c.Do(ctx, []byte("SET"), []byte("k\r\n"), []byte("v\x00"), []byte("PX"), []byte("60000")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Do(ctx, []byte("GET"), []byte("k\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r.Str) != "v\x00" {
+		t.Fatalf("want v, got %q", r.Str)
+	}
+	if ttl := s.TTL("k\r\n"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("unexpected ttl %s", ttl)
+	}
+
+	rs, err := c.Pipeline(ctx, [][][]byte{
+		{[]byte("GET"), []byte("missing")},
+		{[]byte("MGET"), []byte("k\r\n"), []byte("missing")},
+		{[]byte("DEL"), []byte("k\r\n")},
+		{[]byte("BAD")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs[0].Nil || len(rs[1].Array) != 2 || !rs[1].Array[1].Nil || rs[2].Int != 1 {
+		t.Fatalf("unexpected replies %+v", rs)
+	}
+	var re Error
+	if !errors.As(rs[3].Err, &re) {
+		t.Fatalf("want an error reply, got %+v", rs[3])
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package redistest provides an in-memory redis server for tests. It
+// supports PING, AUTH, SELECT, GET, SET (with PX), MGET, DEL, SCAN
+// (with MATCH of prefix patterns) and FLUSHDB.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Server struct {
+	l net.Listener
+
+	mu   sync.Mutex
+	data map[string]entry
+	cmds int
+}
+
+type entry struct {
+	v   []byte
+	exp time.Time // zero means no expiration
+}
+
+// NewServer starts a server on localhost. It is closed when t finishes.
+func NewServer(t testing.TB) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{l: l, data: make(map[string]entry)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveConn(c)
+		}
+	}()
+	return s
+}
+
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Get returns the value of key.
+func (s *Server) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(key)
+	return e.v, ok
+}
+
+// TTL returns the remaining ttl of key. It returns 0 if key has no ttl.
+func (s *Server) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(key)
+	if !ok || e.exp.IsZero() {
+		return 0
+	}
+	return time.Until(e.exp)
+}
+
+// Commands returns the number of received commands.
+func (s *Server) Commands() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cmds
+}
+
+func (s *Server) get(key string) (entry, bool) {
+	e, ok := s.data[key]
+	if ok && !e.exp.IsZero() && time.Now().After(e.exp) {
+		delete(s.data, key)
+		return entry{}, false
+	}
+	return e, ok
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	bw := bufio.NewWriter(c)
+	for {
+		args, err := readCmd(br)
+		if err != nil {
+			return
+		}
+		s.exec(bw, args)
+		if br.Buffered() == 0 {
+			if err := bw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readCmd(r *bufio.Reader) ([]string, error) {
+	l, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(l, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		bl, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(l, "$")))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, bl+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:bl])
+	}
+	return args, nil
+}
+
+func (s *Server) exec(w *bufio.Writer, args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cmds++
+	if len(args) == 0 {
+		fmt.Fprint(w, "-ERR empty command\r\n")
+		return
+	}
+	bulk := func(b []byte, ok bool) {
+		if !ok {
+			fmt.Fprint(w, "$-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(b), b)
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING", "AUTH", "SELECT", "FLUSHDB":
+		if strings.EqualFold(args[0], "FLUSHDB") {
+			s.data = make(map[string]entry)
+		}
+		fmt.Fprint(w, "+OK\r\n")
+	case "GET":
+		e, ok := s.get(args[1])
+		bulk(e.v, ok)
+	case "MGET":
+		fmt.Fprintf(w, "*%d\r\n", len(args)-1)
+		for _, k := range args[1:] {
+			e, ok := s.get(k)
+			bulk(e.v, ok)
+		}
+	case "SET":
+		e := entry{v: []byte(args[2])}
+		if len(args) == 5 && strings.EqualFold(args[3], "PX") {
+			ms, _ := strconv.Atoi(args[4])
+			e.exp = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		s.data[args[1]] = e
+		fmt.Fprint(w, "+OK\r\n")
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := s.get(k); ok {
+				delete(s.data, k)
+				n++
+			}
+		}
+		fmt.Fprintf(w, ":%d\r\n", n)
+	case "SCAN":
+		// All matched keys are returned in one batch.
+		prefix := ""
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.EqualFold(args[i], "MATCH") {
+				prefix = strings.TrimSuffix(args[i+1], "*")
+			}
+		}
+		var keys []string
+		for k := range s.data {
+			if _, ok := s.get(k); ok && strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		fmt.Fprintf(w, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+		for _, k := range keys {
+			bulk([]byte(k), true)
+		}
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+	}
+}
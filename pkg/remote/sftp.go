@@ -0,0 +1,295 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPConfig configures a SFTP storage.
+type SFTPConfig struct {
+	Addr     string `yaml:"addr"` // "host:port". Port is 22 if omitted.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// PrivateKey is the path to a PEM encoded private key.
+	// One of Password and PrivateKey must be set.
+	PrivateKey string `yaml:"private_key"`
+
+	// HostKey is the server's public key in authorized_keys format,
+	// e.g. "ssh-ed25519 AAAA...". Required.
+	HostKey string `yaml:"host_key"`
+
+	// Dir is the base dir of files. Relative paths are relative to
+	// the login directory.
+	Dir string `yaml:"dir"`
+}
+
+// SFTP reads files from a SFTP server. A new ssh connection is used
+// for each read, as files are read only on (re)loads.
+type SFTP struct {
+	addr string
+	dir  string
+	cc   *ssh.ClientConfig
+}
+
+func NewSFTP(cfg SFTPConfig) (*SFTP, error) {
+	if len(cfg.Addr) == 0 {
+		return nil, errors.New("missing addr")
+	}
+	addr := cfg.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	if len(cfg.Username) == 0 {
+		return nil, errors.New("missing username")
+	}
+	if len(cfg.HostKey) == 0 {
+		return nil, errors.New("missing host_key")
+	}
+	hk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cfg.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host_key, %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if len(cfg.PrivateKey) > 0 {
+		b, err := os.ReadFile(cfg.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key, %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key, %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if len(cfg.Password) > 0 {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("one of password and private_key must be set")
+	}
+
+	return &SFTP{
+		addr: addr,
+		dir:  cfg.Dir,
+		cc: &ssh.ClientConfig{
+			User:            cfg.Username,
+			Auth:            auth,
+			HostKeyCallback: ssh.FixedHostKey(hk),
+			Timeout:         fetchTimeout,
+		},
+	}, nil
+}
+
+func (s *SFTP) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the connection interrupts all pending io.
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	defer c.Close()
+
+	sc, chans, reqs, err := ssh.NewClientConn(c, s.addr, s.cc)
+	if err != nil {
+		return nil, err
+	}
+	client := ssh.NewClient(sc, chans, reqs)
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+	w, err := sess.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := sess.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.RequestSubsystem("sftp"); err != nil {
+		return nil, err
+	}
+
+	b, err := sftpReadFile(w, bufio.NewReader(r), path.Join(s.dir, p))
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return b, err
+}
+
+// SFTP v3 packet types and constants.
+// See draft-ietf-secsh-filexfer-02.
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpRead    = 5
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpData    = 103
+
+	sftpFlagRead  = 0x1
+	sftpStatusEOF = 1
+
+	sftpReadChunk = 32 << 10
+	sftpMaxPacket = sftpReadChunk + 1024
+)
+
+// sftpReadFile reads file p with a sequential SFTP v3 session on w and r.
+func sftpReadFile(w io.Writer, r io.Reader, p string) ([]byte, error) {
+	if err := sftpSend(w, sftpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return nil, err
+	}
+	typ, _, err := sftpRecv(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpVersion {
+		return nil, fmt.Errorf("unexpected sftp packet type %d", typ)
+	}
+
+	var id uint32
+	call := func(typ byte, payload []byte) (byte, []byte, error) {
+		id++
+		if err := sftpSend(w, typ, append(binary.BigEndian.AppendUint32(nil, id), payload...)); err != nil {
+			return 0, nil, err
+		}
+		rt, rp, err := sftpRecv(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(rp) < 4 || binary.BigEndian.Uint32(rp) != id {
+			return 0, nil, errors.New("unexpected sftp response id")
+		}
+		return rt, rp[4:], nil
+	}
+
+	open := sftpAppendString(nil, []byte(p))
+	open = binary.BigEndian.AppendUint32(open, sftpFlagRead)
+	open = binary.BigEndian.AppendUint32(open, 0) // no attrs
+	typ, payload, err := call(sftpOpen, open)
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpHandle {
+		return nil, sftpErr(typ, payload)
+	}
+	h, _, ok := sftpCutString(payload)
+	if !ok {
+		return nil, errors.New("invalid sftp handle")
+	}
+	defer call(sftpClose, sftpAppendString(nil, h))
+
+	var b []byte
+	for {
+		req := sftpAppendString(nil, h)
+		req = binary.BigEndian.AppendUint64(req, uint64(len(b)))
+		req = binary.BigEndian.AppendUint32(req, sftpReadChunk)
+		typ, payload, err := call(sftpRead, req)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case sftpData:
+			d, _, ok := sftpCutString(payload)
+			if !ok {
+				return nil, errors.New("invalid sftp data")
+			}
+			b = append(b, d...)
+			if len(b) > maxFetchedSize {
+				return nil, errors.New("file is too large")
+			}
+		case sftpStatus:
+			if len(payload) >= 4 && binary.BigEndian.Uint32(payload) == sftpStatusEOF {
+				return b, nil
+			}
+			return nil, sftpErr(typ, payload)
+		default:
+			return nil, sftpErr(typ, payload)
+		}
+	}
+}
+
+func sftpSend(w io.Writer, typ byte, payload []byte) error {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	b = append(b, typ)
+	_, err := w.Write(append(b, payload...))
+	return err
+}
+
+func sftpRecv(r io.Reader) (byte, []byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n == 0 || n > sftpMaxPacket {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
+
+func sftpAppendString(b, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func sftpCutString(b []byte) (s, rest []byte, ok bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(n) {
+		return nil, nil, false
+	}
+	return b[4 : 4+n], b[4+n:], true
+}
+
+// sftpErr converts an unexpected response to an error.
+func sftpErr(typ byte, payload []byte) error {
+	if typ != sftpStatus || len(payload) < 4 {
+		return fmt.Errorf("unexpected sftp packet type %d", typ)
+	}
+	code := binary.BigEndian.Uint32(payload)
+	msg, _, _ := sftpCutString(payload[4:])
+	return fmt.Errorf("sftp error %d: %s", code, msg)
+}
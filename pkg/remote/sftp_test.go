@@ -0,0 +1,184 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package remote
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serveSFTP serves files with a minimal SFTP v3 server on rw.
+func serveSFTP(rw io.ReadWriter, files map[string]string) {
+	handles := make(map[string]string)
+	for {
+		typ, p, err := sftpRecv(rw)
+		if err != nil {
+			return
+		}
+		if typ == sftpInit {
+			_ = sftpSend(rw, sftpVersion, binary.BigEndian.AppendUint32(nil, 3))
+			continue
+		}
+		id, p := p[:4], p[4:]
+		status := func(code uint32) {
+			_ = sftpSend(rw, sftpStatus, append(append(id, binary.BigEndian.AppendUint32(nil, code)...), 0, 0, 0, 0, 0, 0, 0, 0))
+		}
+		switch typ {
+		case sftpOpen:
+			name, _, _ := sftpCutString(p)
+			if _, ok := files[string(name)]; !ok {
+				status(2) // no such file
+				continue
+			}
+			handles["h"] = string(name)
+			_ = sftpSend(rw, sftpHandle, sftpAppendString(id, []byte("h")))
+		case sftpRead:
+			h, rest, _ := sftpCutString(p)
+			off := binary.BigEndian.Uint64(rest)
+			n := binary.BigEndian.Uint32(rest[8:])
+			data := files[handles[string(h)]]
+			if off >= uint64(len(data)) {
+				status(sftpStatusEOF)
+				continue
+			}
+			end := min(off+uint64(n), uint64(len(data)))
+			_ = sftpSend(rw, sftpData, sftpAppendString(id, []byte(data[off:end])))
+		case sftpClose:
+			status(0)
+		default:
+			status(8) // unsupported
+		}
+	}
+}
+
+func startSSHServer(t *testing.T, files map[string]string) (addr string, hostKey string) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pw []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(pw) == "pw" {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	cfg.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, chans, reqs, err := ssh.NewServerConn(c, cfg)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					ch, reqs, err := nc.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						for req := range reqs {
+							ok := req.Type == "subsystem" && strings.HasSuffix(string(req.Payload), "sftp")
+							_ = req.Reply(ok, nil)
+							if ok {
+								go func() {
+									serveSFTP(ch, files)
+									ch.Close()
+								}()
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+}
+
+func TestReadFile_sftp(t *testing.T) {
+	content := strings.Repeat("example.com\n", 10000) // multiple read chunks
+	addr, hostKey := startSSHServer(t, map[string]string{"/data/lists/ads.txt": content})
+
+	s, err := NewStorage(StorageConfig{SFTP: &SFTPConfig{
+		Addr: addr, Username: "user", Password: "pw", HostKey: hostKey, Dir: "/data",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := Storages{"nas": s}
+	b, err := ss.ReadFile("storage://nas/lists/ads.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != content {
+		t.Fatalf("unexpected content, len %d", len(b))
+	}
+	if _, err := ss.ReadFile("storage://nas/missing.txt"); err == nil {
+		t.Fatal("expect an err for missing file")
+	}
+
+	// Wrong password and wrong host key.
+	bad := []SFTPConfig{
+		{Addr: addr, Username: "user", Password: "wrong", HostKey: hostKey},
+		{Addr: addr, Username: "user", Password: "pw", HostKey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"},
+	}
+	for i, c := range bad {
+		s, err := NewSFTP(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ReadFile(context.Background(), "/data/lists/ads.txt"); err == nil {
+			t.Fatalf("#%d: expect an err", i)
+		}
+	}
+
+	if _, err := NewSFTP(SFTPConfig{Addr: addr, Username: "user", Password: "pw"}); err == nil {
+		t.Fatal("expect an err for missing host key")
+	}
+	if _, err := NewStorage(StorageConfig{SFTP: &SFTPConfig{}, WebDAV: &WebDAVConfig{}}); err == nil {
+		t.Fatal("expect an err for multiple storage types")
+	}
+}
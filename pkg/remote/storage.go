@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// StorageScheme is the prefix of files in remote storages.
+// Format: "storage://<storage_tag>/<path>".
+const StorageScheme = "storage://"
+
+const (
+	fetchTimeout   = time.Minute
+	maxFetchedSize = 256 << 20
+)
+
+// Storage is a remote storage that files can be read from.
+type Storage interface {
+	ReadFile(ctx context.Context, path string) ([]byte, error)
+}
+
+// StorageConfig configures a storage. One of S3, WebDAV and SFTP must be set.
+type StorageConfig struct {
+	Tag    string        `yaml:"tag"`
+	S3     *S3Config     `yaml:"s3"`
+	WebDAV *WebDAVConfig `yaml:"webdav"`
+	SFTP   *SFTPConfig   `yaml:"sftp"`
+}
+
+func NewStorage(cfg StorageConfig) (Storage, error) {
+	n := 0
+	for _, set := range []bool{cfg.S3 != nil, cfg.WebDAV != nil, cfg.SFTP != nil} {
+		if set {
+			n++
+		}
+	}
+	switch {
+	case n > 1:
+		return nil, errors.New("only one of s3, webdav and sftp can be set")
+	case cfg.S3 != nil:
+		c, err := NewS3Client(*cfg.S3)
+		if err != nil {
+			return nil, err
+		}
+		return s3Storage{c: c}, nil
+	case cfg.WebDAV != nil:
+		return NewWebDAV(*cfg.WebDAV)
+	case cfg.SFTP != nil:
+		return NewSFTP(*cfg.SFTP)
+	default:
+		return nil, errors.New("no s3, webdav or sftp config")
+	}
+}
+
+// Storages are storages indexed by their tags. Each mosdns instance
+// has its own Storages, so instances that overlap during a reload
+// don't see each other's storages.
+// A nil Storages can only read local files.
+type Storages map[string]Storage
+
+// NewStorages builds Storages from cfgs. Tags must be unique.
+func NewStorages(cfgs []StorageConfig) (Storages, error) {
+	s := make(Storages)
+	for i, c := range cfgs {
+		if len(c.Tag) == 0 {
+			return nil, fmt.Errorf("storage #%d has no tag", i)
+		}
+		if _, dup := s[c.Tag]; dup {
+			return nil, fmt.Errorf("duplicated storage tag %s", c.Tag)
+		}
+		st, err := NewStorage(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage %s, %w", c.Tag, err)
+		}
+		s[c.Tag] = st
+	}
+	return s, nil
+}
+
+// IsStorageFile reports whether f is a file in a remote storage.
+func IsStorageFile(f string) bool {
+	return strings.HasPrefix(f, StorageScheme)
+}
+
+// ReadFile reads the file f. If f is in the format of "storage://tag/path",
+// the file is read from the storage tag. Otherwise, it is read
+// from the local file system.
+func (ss Storages) ReadFile(f string) ([]byte, error) {
+	if !IsStorageFile(f) {
+		return os.ReadFile(f)
+	}
+	tag, p, _ := strings.Cut(strings.TrimPrefix(f, StorageScheme), "/")
+	s := ss[tag]
+	if s == nil {
+		return nil, fmt.Errorf("storage %s is not defined", tag)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	return s.ReadFile(ctx, p)
+}
+
+type s3Storage struct {
+	c *S3Client
+}
+
+func (s s3Storage) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return s.c.GetObject(ctx, path)
+}
+
+// WebDAVConfig configures a WebDAV storage.
+type WebDAVConfig struct {
+	URL      string `yaml:"url"` // Base url, e.g. "https://nas.lan/dav/".
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// WebDAV reads files from a WebDAV server with http basic auth.
+type WebDAV struct {
+	cfg  WebDAVConfig
+	base *url.URL
+	hc   *http.Client
+}
+
+func NewWebDAV(cfg WebDAVConfig) (*WebDAV, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid webdav url %q", cfg.URL)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &WebDAV{cfg: cfg, base: u, hc: &http.Client{}}, nil
+}
+
+func (w *WebDAV) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	u := w.base.JoinPath(path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(w.cfg.Username) > 0 {
+		req.SetBasicAuth(w.cfg.Username, w.cfg.Password)
+	}
+	resp, err := w.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("webdav returned status %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxFetchedSize {
+		return nil, errors.New("file is too large")
+	}
+	return b, nil
+}
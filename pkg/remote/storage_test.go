@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package remote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadFile_webdav(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pw" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/dav/lists/ads.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("example.com\n"))
+	}))
+	defer srv.Close()
+
+	s, err := NewStorage(StorageConfig{WebDAV: &WebDAVConfig{URL: srv.URL + "/dav", Username: "user", Password: "pw"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := Storages{"nas": s}
+
+	b, err := ss.ReadFile("storage://nas/lists/ads.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "example.com\n" {
+		t.Fatalf("unexpected content %q", b)
+	}
+	if _, err := ss.ReadFile("storage://nas/missing.txt"); err == nil {
+		t.Fatal("expect an err for missing file")
+	}
+	if _, err := ss.ReadFile("storage://undefined/a.txt"); err == nil {
+		t.Fatal("expect an err for undefined storage")
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// AnomalyKind is a kind of suspicious request.
+type AnomalyKind int
+
+const (
+	// AnomalyMalformed is a packet that was rejected by UnpackQuery.
+	AnomalyMalformed AnomalyKind = iota
+	// AnomalyOpcode is a query with an opcode other than QUERY.
+	AnomalyOpcode
+	// AnomalyOversized is a query that is larger than AnomalyOpts.MaxQuerySize.
+	AnomalyOversized
+	// AnomalySpoofed is an udp query from a source that is unlikely to
+	// be a real client, e.g. port 0 or a well known reflection service port.
+	// Those queries are only counted unless AnomalyOpts.DropSpoofed is set.
+	AnomalySpoofed
+
+	numAnomalyKinds
+)
+
+var anomalyKindNames = [numAnomalyKinds]string{"malformed", "opcode", "oversized", "spoofed"}
+
+func (k AnomalyKind) String() string {
+	if k < 0 || k >= numAnomalyKinds {
+		return "unknown"
+	}
+	return anomalyKindNames[k]
+}
+
+// AllAnomalyKinds returns all anomaly kinds.
+func AllAnomalyKinds() []AnomalyKind {
+	s := make([]AnomalyKind, 0, numAnomalyKinds)
+	for k := AnomalyKind(0); k < numAnomalyKinds; k++ {
+		s = append(s, k)
+	}
+	return s
+}
+
+// Source ports of udp services that are commonly abused for reflection.
+// A real dns client never uses them.
+var reflectionPorts = map[uint16]struct{}{
+	0: {}, 7: {}, 17: {}, 19: {}, 53: {}, 111: {}, 123: {}, 137: {}, 161: {},
+	389: {}, 1900: {}, 3702: {}, 5353: {}, 11211: {},
+}
+
+const defaultMaxQuerySize = 512
+
+type AnomalyOpts struct {
+	// Queries larger than MaxQuerySize are counted as oversized.
+	// Default is 512.
+	MaxQuerySize int
+
+	// DropSpoofed drops udp queries from spoofed-looking sources. By default,
+	// they are only counted, because some middleboxes and NATs use unusual
+	// source ports. Spoofed sources never count towards bans: the source
+	// address is most likely the forged address of a victim.
+	DropSpoofed bool
+
+	// If a client sent BanThreshold anomalies within BanWindow, its
+	// requests are dropped for BanDuration. Zero BanThreshold disables bans.
+	BanThreshold int
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+
+	// OnBan is called when a client is banned. Optional.
+	OnBan func(client netip.Addr)
+}
+
+// AnomalyTracker counts suspicious requests of a listener and bans
+// clients that sent too many of them. A nil AnomalyTracker is valid and
+// does nothing. It is safe for concurrent use.
+type AnomalyTracker struct {
+	opts     AnomalyOpts
+	counters [numAnomalyKinds]atomic.Uint64
+
+	// Only used if bans are enabled.
+	mu        sync.Mutex
+	clients   map[netip.Addr]*clientAnomaly
+	lastPrune time.Time
+}
+
+type clientAnomaly struct {
+	windowStart time.Time
+	n           int
+	bannedUntil time.Time
+}
+
+func NewAnomalyTracker(opts AnomalyOpts) *AnomalyTracker {
+	if opts.MaxQuerySize <= 0 {
+		opts.MaxQuerySize = defaultMaxQuerySize
+	}
+	t := &AnomalyTracker{opts: opts}
+	if opts.BanThreshold > 0 {
+		t.clients = make(map[netip.Addr]*clientAnomaly)
+	}
+	return t
+}
+
+// Count returns the number of anomalies of kind k.
+func (t *AnomalyTracker) Count(k AnomalyKind) uint64 {
+	if t == nil || k < 0 || k >= numAnomalyKinds {
+		return 0
+	}
+	return t.counters[k].Load()
+}
+
+// BannedClients returns the number of clients that are banned now.
+func (t *AnomalyTracker) BannedClients() int {
+	if t == nil || t.clients == nil {
+		return 0
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, c := range t.clients {
+		if now.Before(c.bannedUntil) {
+			n++
+		}
+	}
+	return n
+}
+
+// Banned reports whether requests from client should be dropped.
+func (t *AnomalyTracker) Banned(client netip.Addr) bool {
+	if t == nil || t.clients == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.clients[client]
+	return c != nil && time.Now().Before(c.bannedUntil)
+}
+
+// Record records an anomaly from client.
+func (t *AnomalyTracker) Record(client netip.Addr, k AnomalyKind) {
+	if t == nil {
+		return
+	}
+	t.counters[k].Add(1)
+	if t.clients == nil {
+		return
+	}
+
+	now := time.Now()
+	banned := false
+	t.mu.Lock()
+	t.pruneLocked(now)
+	c := t.clients[client]
+	if c == nil {
+		c = &clientAnomaly{windowStart: now}
+		t.clients[client] = c
+	}
+	if now.Sub(c.windowStart) > t.opts.BanWindow {
+		c.windowStart = now
+		c.n = 0
+	}
+	c.n++
+	if c.n >= t.opts.BanThreshold && !now.Before(c.bannedUntil) {
+		c.bannedUntil = now.Add(t.opts.BanDuration)
+		c.n = 0
+		banned = true
+	}
+	t.mu.Unlock()
+
+	if banned && t.opts.OnBan != nil {
+		t.opts.OnBan(client)
+	}
+}
+
+// pruneLocked removes clients that are neither banned nor in a window.
+func (t *AnomalyTracker) pruneLocked(now time.Time) {
+	if now.Sub(t.lastPrune) < time.Minute {
+		return
+	}
+	t.lastPrune = now
+	for addr, c := range t.clients {
+		if now.Sub(c.windowStart) > t.opts.BanWindow && !now.Before(c.bannedUntil) {
+			delete(t.clients, addr)
+		}
+	}
+}
+
+// checkUDPSource counts spoofed-looking sources of udp queries and
+// reports whether the query should be dropped.
+func (t *AnomalyTracker) checkUDPSource(src netip.AddrPort) (drop bool) {
+	if t == nil {
+		return false
+	}
+	a := src.Addr()
+	_, reflection := reflectionPorts[src.Port()]
+	if reflection || a.IsUnspecified() || a.IsMulticast() || (a.Is4() && a.As4() == [4]byte{255, 255, 255, 255}) {
+		t.counters[AnomalySpoofed].Add(1)
+		return t.opts.DropSpoofed
+	}
+	return false
+}
+
+// checkQuery records anomalies of a query of size bytes that was
+// unpacked by UnpackQuery with result q and err.
+func (t *AnomalyTracker) checkQuery(client netip.Addr, size int, q *dns.Msg, err error) {
+	if t == nil {
+		return
+	}
+	if err != nil {
+		if errors.Is(err, ErrQueryTooLarge) {
+			t.Record(client, AnomalyOversized)
+		} else {
+			t.Record(client, AnomalyMalformed)
+		}
+		return
+	}
+	if size > t.opts.MaxQuerySize {
+		t.Record(client, AnomalyOversized)
+	}
+	if q.Opcode != dns.OpcodeQuery {
+		t.Record(client, AnomalyOpcode)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestAnomalyTracker(t *testing.T) {
+	var banned []netip.Addr
+	tr := NewAnomalyTracker(AnomalyOpts{
+		BanThreshold: 3,
+		BanWindow:    time.Minute,
+		BanDuration:  time.Minute,
+		OnBan:        func(c netip.Addr) { banned = append(banned, c) },
+	})
+	client := netip.MustParseAddr("192.0.2.1")
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	tr.checkQuery(client, 100, q, nil)
+	if tr.Banned(client) || tr.Count(AnomalyMalformed)+tr.Count(AnomalyOpcode)+tr.Count(AnomalyOversized) != 0 {
+		t.Fatal("normal query counted as anomaly")
+	}
+
+	q.Opcode = dns.OpcodeUpdate
+	tr.checkQuery(client, 1024, q, nil)
+	if tr.Count(AnomalyOpcode) != 1 || tr.Count(AnomalyOversized) != 1 {
+		t.Fatal("opcode or oversized anomaly is not counted")
+	}
+	if tr.Banned(client) {
+		t.Fatal("client banned before threshold")
+	}
+	tr.checkQuery(client, 10, nil, ErrMalformedQuery)
+	if tr.Count(AnomalyMalformed) != 1 {
+		t.Fatal("malformed anomaly is not counted")
+	}
+	if !tr.Banned(client) || len(banned) != 1 || tr.BannedClients() != 1 {
+		t.Fatal("client is not banned")
+	}
+	if tr.Banned(netip.MustParseAddr("192.0.2.2")) {
+		t.Fatal("other client banned")
+	}
+
+	spoofed := netip.MustParseAddrPort("192.0.2.3:123")
+	for i := 0; i < 3; i++ {
+		if tr.checkUDPSource(spoofed) {
+			t.Fatal("spoofed-looking source dropped without DropSpoofed")
+		}
+	}
+	if tr.Count(AnomalySpoofed) != 3 {
+		t.Fatal("spoofed-looking source is not counted")
+	}
+	if tr.Banned(spoofed.Addr()) {
+		t.Fatal("spoofed-looking source counted towards bans")
+	}
+	if tr.checkUDPSource(netip.MustParseAddrPort("192.0.2.3:40000")) || tr.Count(AnomalySpoofed) != 3 {
+		t.Fatal("normal source is spoofed-looking")
+	}
+
+	dropper := NewAnomalyTracker(AnomalyOpts{DropSpoofed: true})
+	for _, src := range []string{"192.0.2.3:0", "192.0.2.3:53", "0.0.0.0:40000", "224.0.0.1:40000", "255.255.255.255:40000", "[ff02::1]:40000"} {
+		if !dropper.checkUDPSource(netip.MustParseAddrPort(src)) {
+			t.Fatalf("spoofed-looking source %s is not dropped", src)
+		}
+	}
+	if dropper.checkUDPSource(netip.MustParseAddrPort("[2001:db8::1]:40000")) {
+		t.Fatal("normal source dropped")
+	}
+
+	var nilTracker *AnomalyTracker
+	nilTracker.Record(client, AnomalyMalformed)
+	if nilTracker.Banned(client) {
+		t.Fatal("nil tracker banned a client")
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var ErrUnauthorized = errors.New("unauthorized client")
+
+// ClientAuth maps client identities to client groups.
+// A nil ClientAuth accepts all clients as anonymous.
+type ClientAuth struct {
+	// Tokens maps tokens to client groups. A token can be sent in
+	// the url query "token" or as a Bearer token.
+	Tokens map[string]string
+
+	// PathToken also accepts tokens as the last element of the url
+	// path, e.g. "/dns-query/<token>".
+	PathToken bool
+
+	// Users maps basic auth usernames to their passwords and groups.
+	Users map[string]BasicUser
+
+	// CertGroups maps common names of verified client certificates
+	// to client groups. If a common name has no mapping, the common
+	// name itself is used as the group.
+	CertGroups map[string]string
+
+	// Required rejects clients that cannot be authenticated.
+	Required bool
+}
+
+type BasicUser struct {
+	Password string
+	Group    string
+}
+
+// AuthTLS returns the client group from the verified client certificate.
+func (a *ClientAuth) AuthTLS(cs *tls.ConnectionState) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	if g, ok := a.certGroup(cs); ok {
+		return g, nil
+	}
+	return a.anonymous()
+}
+
+// AuthHTTP returns the client group of req from the client certificate,
+// the token or basic auth, in this order.
+func (a *ClientAuth) AuthHTTP(req *http.Request) (string, error) {
+	g, _, err := a.authHTTP(req)
+	return g, err
+}
+
+// authHTTP is like AuthHTTP. It also reports whether the client was
+// authenticated by the token in the url path.
+func (a *ClientAuth) authHTTP(req *http.Request) (_ string, pathToken bool, _ error) {
+	if a == nil {
+		return "", false, nil
+	}
+	if g, ok := a.certGroup(req.TLS); ok {
+		return g, false, nil
+	}
+
+	if len(a.Tokens) > 0 {
+		if u := req.URL; u != nil {
+			if g, ok := a.tokenGroup(u.Query().Get("token")); ok {
+				return g, false, nil
+			}
+			if a.PathToken {
+				if g, ok := a.tokenGroup(lastPathElem(u.Path)); ok {
+					return g, true, nil
+				}
+			}
+		}
+		if h := req.Header.Get("Authorization"); len(h) > 7 && h[:7] == "Bearer " {
+			if g, ok := a.tokenGroup(h[7:]); ok {
+				return g, false, nil
+			}
+		}
+	}
+
+	if len(a.Users) > 0 {
+		if username, password, ok := req.BasicAuth(); ok {
+			if u, ok := a.Users[username]; ok && len(password) > 0 && subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1 {
+				return u.Group, false, nil
+			}
+		}
+	}
+	g, err := a.anonymous()
+	return g, false, err
+}
+
+// lastPathElem returns the part of p after its last slash.
+// Unlike path.Base, it returns "" if p ends with a slash.
+func lastPathElem(p string) string {
+	return p[strings.LastIndexByte(p, '/')+1:]
+}
+
+func (a *ClientAuth) anonymous() (string, error) {
+	if a.Required {
+		return "", ErrUnauthorized
+	}
+	return "", nil
+}
+
+func (a *ClientAuth) certGroup(cs *tls.ConnectionState) (string, bool) {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.PeerCertificates) == 0 {
+		return "", false
+	}
+	cn := cs.PeerCertificates[0].Subject.CommonName
+	if g, ok := a.CertGroups[cn]; ok {
+		return g, true
+	}
+	return cn, true
+}
+
+func (a *ClientAuth) tokenGroup(t string) (string, bool) {
+	if len(t) == 0 {
+		return "", false
+	}
+	for token, g := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return g, true
+		}
+	}
+	return "", false
+}
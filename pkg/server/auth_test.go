@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAuth_AuthHTTP(t *testing.T) {
+	a := &ClientAuth{
+		Tokens:    map[string]string{"t0k3n": "home", "": "empty"},
+		Users:     map[string]BasicUser{"alice": {Password: "pw", Group: "family"}, "bob": {Group: "empty"}},
+		PathToken: true,
+		Required:  true,
+	}
+
+	tests := []struct {
+		name      string
+		url       string
+		basicUser string
+		basicPw   string
+		wantGroup string
+		wantErr   error
+	}{
+		{"query token", "/dns-query?token=t0k3n", "", "", "home", nil},
+		{"path token", "/dns-query/t0k3n", "", "", "home", nil},
+		{"basic auth", "/dns-query", "alice", "pw", "family", nil},
+		{"wrong password", "/dns-query", "alice", "bad", "", ErrUnauthorized},
+		{"wrong token", "/dns-query/bad", "", "", "", ErrUnauthorized},
+		{"path without token", "/t0k3n/", "", "", "", ErrUnauthorized},
+		{"empty token", "/dns-query/?token=", "", "", "", ErrUnauthorized},
+		{"empty password", "/dns-query", "bob", "", "", ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if len(tt.basicUser) > 0 {
+				req.SetBasicAuth(tt.basicUser, tt.basicPw)
+			}
+			g, err := a.AuthHTTP(req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AuthHTTP() err = %v, want %v", err, tt.wantErr)
+			}
+			if g != tt.wantGroup {
+				t.Fatalf("AuthHTTP() group = %s, want %s", g, tt.wantGroup)
+			}
+		})
+	}
+
+	noPathToken := &ClientAuth{Tokens: a.Tokens, Required: true}
+	if _, err := noPathToken.AuthHTTP(httptest.NewRequest("GET", "/dns-query/t0k3n", nil)); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("path token should be rejected if PathToken is disabled, got %v", err)
+	}
+
+	var nilAuth *ClientAuth
+	if g, err := nilAuth.AuthHTTP(httptest.NewRequest("GET", "/", nil)); err != nil || len(g) > 0 {
+		t.Fatalf("nil auth should accept anonymous clients, got %s, %v", g, err)
+	}
+}
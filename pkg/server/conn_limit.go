@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type ConnLimitOpts struct {
+	// Max concurrent connections of a client. Zero means no limit.
+	MaxPerClient int
+	// Max concurrent connections of the listener. Zero means no limit.
+	MaxTotal int
+}
+
+// ConnLimiter tracks concurrent persistent connections per client and
+// rejects connections over the limits. A nil ConnLimiter is valid and
+// allows all connections. It is safe for concurrent use.
+type ConnLimiter struct {
+	opts     ConnLimitOpts
+	rejected atomic.Uint64
+
+	mu    sync.Mutex
+	conns map[netip.Addr]int
+	total int
+}
+
+func NewConnLimiter(opts ConnLimitOpts) *ConnLimiter {
+	return &ConnLimiter{opts: opts, conns: make(map[netip.Addr]int)}
+}
+
+// Acquire reports whether a new connection from client is allowed. If
+// it returns true, Release must be called once the connection is closed.
+// Connections without a valid client address (e.g. from unix sockets)
+// are only limited by MaxTotal.
+func (l *ConnLimiter) Acquire(client netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.opts.MaxTotal > 0 && l.total >= l.opts.MaxTotal {
+		l.rejected.Add(1)
+		return false
+	}
+	if client.IsValid() {
+		n := l.conns[client]
+		if l.opts.MaxPerClient > 0 && n >= l.opts.MaxPerClient {
+			l.rejected.Add(1)
+			return false
+		}
+		l.conns[client] = n + 1
+	}
+	l.total++
+	return true
+}
+
+// Release releases a connection that was allowed by Acquire.
+func (l *ConnLimiter) Release(client netip.Addr) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if client.IsValid() {
+		if n := l.conns[client] - 1; n > 0 {
+			l.conns[client] = n
+		} else {
+			delete(l.conns, client)
+		}
+	}
+}
+
+// Rejected returns the number of rejected connections.
+func (l *ConnLimiter) Rejected() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.rejected.Load()
+}
+
+type ConnStats struct {
+	Conns          int // current connections
+	Clients        int // clients that have connections
+	MaxClientConns int // connections of the busiest client
+}
+
+func (l *ConnLimiter) Stats() ConnStats {
+	if l == nil {
+		return ConnStats{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := ConnStats{Conns: l.total, Clients: len(l.conns)}
+	for _, n := range l.conns {
+		s.MaxClientConns = max(s.MaxClientConns, n)
+	}
+	return s
+}
+
+type ClientConns struct {
+	Client netip.Addr
+	Conns  int
+}
+
+// Top returns up to n clients that have the most connections. n <= 0
+// means all clients.
+func (l *ConnLimiter) Top(n int) []ClientConns {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	s := make([]ClientConns, 0, len(l.conns))
+	for c, k := range l.conns {
+		s = append(s, ClientConns{Client: c, Conns: k})
+	}
+	l.mu.Unlock()
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Conns != s[j].Conns {
+			return s[i].Conns > s[j].Conns
+		}
+		return s[i].Client.Less(s[j].Client)
+	})
+	if n > 0 && len(s) > n {
+		s = s[:n]
+	}
+	return s
+}
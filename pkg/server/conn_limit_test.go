@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := NewConnLimiter(ConnLimitOpts{MaxPerClient: 2, MaxTotal: 3})
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.2")
+
+	if !l.Acquire(a) || !l.Acquire(a) {
+		t.Fatal("first 2 connections should be allowed")
+	}
+	if l.Acquire(a) {
+		t.Fatal("3rd connection of a client should be rejected")
+	}
+	if !l.Acquire(b) {
+		t.Fatal("other clients should be allowed")
+	}
+	if l.Acquire(netip.Addr{}) {
+		t.Fatal("connections over max total should be rejected")
+	}
+	if s := l.Stats(); s != (ConnStats{Conns: 3, Clients: 2, MaxClientConns: 2}) {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if top := l.Top(1); len(top) != 1 || top[0] != (ClientConns{Client: a, Conns: 2}) {
+		t.Fatalf("unexpected top %v", top)
+	}
+	if n := l.Rejected(); n != 2 {
+		t.Fatalf("want 2 rejected, got %d", n)
+	}
+
+	l.Release(a)
+	l.Release(a)
+	l.Release(b)
+	if s := l.Stats(); s != (ConnStats{}) {
+		t.Fatalf("want empty stats, got %+v", s)
+	}
+
+	var nilLimiter *ConnLimiter
+	if !nilLimiter.Acquire(a) {
+		t.Fatal("nil limiter should allow all")
+	}
+	nilLimiter.Release(a)
+}
+
+func TestServeTCP_ConnLimiter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	limiter := NewConnLimiter(ConnLimitOpts{MaxPerClient: 1})
+	go ServeTCP(ln, ttlHandler(300), TCPServerOpts{ConnLimiter: limiter})
+
+	exchange := func(c net.Conn) error {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		dc := &dns.Conn{Conn: c}
+		_ = c.SetDeadline(time.Now().Add(time.Second))
+		if err := dc.WriteMsg(q); err != nil {
+			return err
+		}
+		_, err := dc.ReadMsg()
+		return err
+	}
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	if err := exchange(c1); err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if err := exchange(c2); err == nil {
+		t.Fatal("2nd connection should be closed")
+	}
+
+	// The slot is released once the first connection is closed.
+	c1.Close()
+	for i := 0; limiter.Stats().Conns > 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c3, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	if err := exchange(c3); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -24,14 +24,24 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"sync"
 	"time"
 
-	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"go.uber.org/zap"
 )
 
+// DoQ error codes. RFC 9250 4.3.
+const (
+	DoQNoError          = 0x0
+	DoQInternalError    = 0x1
+	DoQProtocolError    = 0x2
+	DoQRequestCancelled = 0x3
+	DoQExcessiveLoad    = 0x4
+)
+
 const (
 	defaultQuicIdleTimeout = time.Second * 30
 	streamReadTimeout      = time.Second * 2
@@ -41,11 +51,25 @@ const (
 type DoQServerOpts struct {
 	Logger      *zap.Logger
 	IdleTimeout time.Duration
+
+	// Auth authenticates clients by their tls certificates. If it is
+	// set, queries are not handled before handshakes complete, so 0-RTT
+	// data is not used.
+	Auth *ClientAuth
+
+	// StopAccepting stops the server from accepting new connections once
+	// it is closed. l is closed, and accepted connections are still
+	// served until they are closed, e.g. by closing the transport of l.
+	// Optional.
+	StopAccepting <-chan struct{}
 }
 
 // ServeDoQ starts a server at l. It returns if l had an Accept() error.
 // It always returns a non-nil error.
-func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
+// Connections are accepted before their handshakes are completed, so queries
+// in 0-RTT data can be handled if l allows 0-RTT. Zone transfers are
+// deferred until the handshake is completed (RFC 9250 4.5).
+func ServeDoQ(l *quic.EarlyListener, h Handler, opts DoQServerOpts) error {
 	logger := opts.Logger
 	if logger == nil {
 		logger = nopLogger
@@ -57,16 +81,34 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 
 	listenerCtx, cancel := context.WithCancelCause(context.Background())
 	defer cancel(errListenerCtxCanceled)
+
+	if opts.StopAccepting != nil {
+		go func() {
+			select {
+			case <-opts.StopAccepting:
+				_ = l.Close()
+			case <-listenerCtx.Done():
+			}
+		}()
+	}
+
+	var connWg sync.WaitGroup
 	for {
 		c, err := l.Accept(listenerCtx)
 		if err != nil {
+			if opts.StopAccepting != nil && isClosed(opts.StopAccepting) {
+				// Don't cancel accepted connections.
+				connWg.Wait()
+			}
 			return fmt.Errorf("unexpected listener err: %w", err)
 		}
 
 		// handle connection
 		connCtx, cancelConn := context.WithCancelCause(listenerCtx)
+		connWg.Add(1)
 		go func() {
-			defer c.CloseWithError(0, "")
+			defer connWg.Done()
+			defer c.CloseWithError(DoQNoError, "")
 			defer cancelConn(errConnectionCtxCanceled)
 
 			var clientAddr netip.Addr
@@ -75,6 +117,24 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 				clientAddr = ta.AddrPort().Addr()
 			}
 
+			// Client certificates are verified during the handshake.
+			var clientGroup string
+			if opts.Auth != nil {
+				select {
+				case <-c.HandshakeComplete():
+				case <-connCtx.Done():
+					return
+				}
+				cs := c.ConnectionState().TLS
+				g, err := opts.Auth.AuthTLS(&cs)
+				if err != nil {
+					logger.Warn("failed to auth client", zap.Stringer("client", c.RemoteAddr()), zap.Error(err))
+					c.CloseWithError(DoQProtocolError, "unauthorized")
+					return
+				}
+				clientGroup = g
+			}
+
 			firstRead := true
 			for {
 				var streamAcceptTimeout time.Duration
@@ -96,21 +156,36 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 				go func() {
 					defer func() {
 						stream.Close()
-						stream.CancelRead(0) // TODO: Needs a proper error code.
+						stream.CancelRead(DoQNoError)
 					}()
 					// Avoid fragmentation attack.
 					stream.SetReadDeadline(time.Now().Add(streamReadTimeout))
-					req, _, err := dnsutils.ReadMsgFromTCP(stream)
+					req, _, err := readQueryFromTCP(stream)
 					if err != nil {
+						stream.CancelWrite(DoQProtocolError)
+						return
+					}
+					// RFC 9250 4.2.1, message id must be 0.
+					if req.Id != 0 {
+						c.CloseWithError(DoQProtocolError, "non-zero message id")
 						return
 					}
+					if isZoneTransfer(req) {
+						select {
+						case <-c.HandshakeComplete():
+						case <-connCtx.Done():
+							return
+						}
+					}
 					queryMeta := QueryMeta{
-						ClientAddr: clientAddr,
-						ServerName: c.ConnectionState().TLS.ServerName,
+						ClientAddr:  clientAddr,
+						ServerName:  c.ConnectionState().TLS.ServerName,
+						ClientGroup: clientGroup,
 					}
 
 					resp := h.Handle(connCtx, req, queryMeta, pool.PackTCPBuffer)
 					if resp == nil {
+						stream.CancelWrite(DoQRequestCancelled)
 						return
 					}
 					if _, err := stream.Write(*resp); err != nil {
@@ -121,3 +196,8 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 		}()
 	}
 }
+
+func isZoneTransfer(q *dns.Msg) bool {
+	qt := q.Question[0].Qtype
+	return qt == dns.TypeAXFR || qt == dns.TypeIXFR
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+func startTestDoQServer(t *testing.T) net.Addr {
+	t.Helper()
+	cert, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", tlsConfig, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go ServeDoQ(l, ttlHandler(300), DoQServerOpts{})
+	return l.Addr()
+}
+
+func doqExchange(conn quic.EarlyConnection, id uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.Id = id
+	b, err := pool.PackTCPBuffer(q)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.ReleaseBuf(b)
+
+	stream, err := conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(*b); err != nil {
+		return nil, err
+	}
+	stream.Close()
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	r, err := dnsutils.ReadRawMsgFromTCP(stream)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.ReleaseBuf(r)
+	resp := new(dns.Msg)
+	return resp, resp.Unpack(*r)
+}
+
+func TestServeDoQ(t *testing.T) {
+	addr := startTestDoQServer(t)
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"doq"},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	dial := func() quic.EarlyConnection {
+		conn, err := quic.DialAddrEarly(context.Background(), addr.String(), tlsConfig, &quic.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	conn := dial()
+	r, err := doqExchange(conn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != 0 || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+	conn.CloseWithError(DoQNoError, "")
+
+	// Session resumption with 0-RTT.
+	conn = dial()
+	defer conn.CloseWithError(DoQNoError, "")
+	if _, err := doqExchange(conn, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.ConnectionState().Used0RTT {
+		t.Fatal("0-RTT was not used")
+	}
+
+	// Non-zero message id is a protocol error.
+	_, err = doqExchange(conn, 1)
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || appErr.ErrorCode != DoQProtocolError {
+		t.Fatalf("want DOQ_PROTOCOL_ERROR, got %v", err)
+	}
+}
+
+func TestServeDoQ_StopAccepting(t *testing.T) {
+	cert, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	tr := &quic.Transport{Conn: uc}
+	defer tr.Close()
+	l, err := tr.ListenEarly(&tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}, &quic.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeDoQ(l, ttlHandler(300), DoQServerOpts{StopAccepting: stop})
+	}()
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"doq"}}
+	dial := func(timeout time.Duration) (quic.EarlyConnection, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		conn, err := quic.DialAddrEarly(ctx, l.Addr().String(), tlsConfig, &quic.Config{})
+		return conn, err
+	}
+	conn, err := dial(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doqExchange(conn, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	close(stop)
+	if conn, err := dial(200 * time.Millisecond); err == nil {
+		conn.CloseWithError(DoQNoError, "")
+		t.Fatal("new connections should not be accepted")
+	}
+	// The accepted connection is still served.
+	if _, err := doqExchange(conn, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("server returned before its connections were closed, %v", err)
+	default:
+	}
+	conn.CloseWithError(DoQNoError, "")
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("server is still running after its connections were closed")
+	}
+}
+
+// groupHandler answers queries with a TXT record of the client group.
+type groupHandler struct{}
+
+func (groupHandler) Handle(_ context.Context, q *dns.Msg, meta QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{meta.ClientGroup},
+	})
+	b, _ := pack(r)
+	return b
+}
+
+func generateClientCert(t *testing.T, cn string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: c}, c
+}
+
+func TestServeDoQ_Auth(t *testing.T) {
+	clientCert, ca := generateClientCert(t, "laptop")
+	serverCert, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		NextProtos:   []string{"doq"},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", serverTLS, &quic.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	auth := &ClientAuth{CertGroups: map[string]string{"laptop": "family"}, Required: true}
+	go ServeDoQ(l, groupHandler{}, DoQServerOpts{Auth: auth})
+
+	exchange := func(certs []tls.Certificate) (*dns.Msg, error) {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"doq"}, Certificates: certs}
+		conn, err := quic.DialAddrEarly(context.Background(), l.Addr().String(), tlsConfig, &quic.Config{})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.CloseWithError(DoQNoError, "")
+		return doqExchange(conn, 0)
+	}
+
+	r, err := exchange([]tls.Certificate{clientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txt, ok := r.Answer[0].(*dns.TXT); !ok || txt.Txt[0] != "family" {
+		t.Fatalf("unexpected client group in %v", r)
+	}
+
+	_, err = exchange(nil)
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || appErr.ErrorCode != DoQProtocolError {
+		t.Fatalf("want DOQ_PROTOCOL_ERROR for clients without certificates, got %v", err)
+	}
+}
@@ -26,8 +26,10 @@ import (
 	"io"
 	"net/http"
 	"net/netip"
+	"strconv"
 	"strings"
 
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -41,12 +43,21 @@ type HttpHandlerOpts struct {
 	// Logger specifies the logger which Handler writes its log to.
 	// Default is a nop logger.
 	Logger *zap.Logger
+
+	// Auth authenticates clients. Nil means no auth.
+	Auth *ClientAuth
+
+	// ClientIDParam, if not empty, is the url query parameter that
+	// carries the client id, e.g. "/dns-query?id=kids-tablet".
+	ClientIDParam string
 }
 
 type HttpHandler struct {
-	dnsHandler  Handler
-	logger      *zap.Logger
-	srcIPHeader string
+	dnsHandler    Handler
+	logger        *zap.Logger
+	srcIPHeader   string
+	auth          *ClientAuth
+	clientIDParam string
 }
 
 var _ http.Handler = (*HttpHandler)(nil)
@@ -55,6 +66,8 @@ func NewHttpHandler(h Handler, opts HttpHandlerOpts) *HttpHandler {
 	hh := new(HttpHandler)
 	hh.dnsHandler = h
 	hh.srcIPHeader = opts.GetSrcIPFromHeader
+	hh.auth = opts.Auth
+	hh.clientIDParam = opts.ClientIDParam
 	hh.logger = opts.Logger
 	if hh.logger == nil {
 		hh.logger = nopLogger
@@ -88,6 +101,22 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	clientGroup, pathToken, err := h.auth.authHTTP(req)
+	if err != nil {
+		h.warnErr(req, "failed to auth client", err)
+		if len(h.auth.Users) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mosdns"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
 	// read msg
 	q, err := ReadMsgFromReq(req)
 	if err != nil {
@@ -97,27 +126,57 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	queryMeta := QueryMeta{
-		ClientAddr: clientAddr,
+		ClientAddr:  clientAddr,
+		ClientGroup: clientGroup,
 	}
 	if u := req.URL; u != nil {
 		queryMeta.UrlPath = u.Path
+		if pathToken {
+			// Don't leak the token to the query log and scripts.
+			queryMeta.UrlPath = strings.TrimSuffix(u.Path, lastPathElem(u.Path))
+		}
+		if len(h.clientIDParam) > 0 {
+			queryMeta.ClientID = dnsutils.NormalizeClientID(u.Query().Get(h.clientIDParam))
+		}
 	}
 	if tlsStat := req.TLS; tlsStat != nil {
 		queryMeta.ServerName = tlsStat.ServerName
 	}
-	resp := h.dnsHandler.Handle(req.Context(), q, queryMeta, pool.PackBuffer)
+	maxAge := -1
+	packResp := func(m *dns.Msg) (*[]byte, error) {
+		maxAge = respMaxAge(m)
+		return pool.PackBuffer(m)
+	}
+	resp := h.dnsHandler.Handle(req.Context(), q, queryMeta, packResp)
 	if resp == nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	defer pool.ReleaseBuf(resp)
 	w.Header().Set("Content-Type", "application/dns-message")
+	// RFC 8484 5.1, freshness lifetime should not be longer than
+	// the smallest ttl in the response.
+	if maxAge >= 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(maxAge))
+	}
 	if _, err := w.Write(*resp); err != nil {
 		h.warnErr(req, "failed to write response", err)
 		return
 	}
 }
 
+// respMaxAge returns the http cache lifetime of m, or -1 if m should
+// not be cached.
+func respMaxAge(m *dns.Msg) int {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return -1
+	}
+	if len(m.Answer)+len(m.Ns) == 0 {
+		return -1
+	}
+	return int(dnsutils.GetMinimalTTL(m))
+}
+
 func readClientAddrFromXFF(s string) (netip.Addr, error) {
 	if i := strings.IndexRune(s, ','); i > 0 {
 		return netip.ParseAddr(s[:i])
@@ -127,6 +186,19 @@ func readClientAddrFromXFF(s string) (netip.Addr, error) {
 
 var errInvalidMediaType = errors.New("missing or invalid media type header")
 
+// acceptsDnsMessage reports whether an Accept header value allows
+// "application/dns-message".
+func acceptsDnsMessage(accept string) bool {
+	for _, t := range strings.Split(accept, ",") {
+		t, _, _ = strings.Cut(t, ";") // ignore params like q=0.9
+		switch strings.TrimSpace(t) {
+		case "application/dns-message", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
 var bufPool = pool.NewBytesBufPool(512)
 
 func ReadMsgFromReq(req *http.Request) (*dns.Msg, error) {
@@ -134,8 +206,8 @@ func ReadMsgFromReq(req *http.Request) (*dns.Msg, error) {
 
 	switch req.Method {
 	case http.MethodGet:
-		// Check accept header
-		if req.Header.Get("Accept") != "application/dns-message" {
+		// Check accept header. Missing header means any type.
+		if accept := req.Header.Get("Accept"); len(accept) > 0 && !acceptsDnsMessage(accept) {
 			return nil, errInvalidMediaType
 		}
 
@@ -171,8 +243,8 @@ func ReadMsgFromReq(req *http.Request) (*dns.Msg, error) {
 		return nil, fmt.Errorf("unsupported method: %s", req.Method)
 	}
 
-	m := new(dns.Msg)
-	if err := m.Unpack(b); err != nil {
+	m, err := UnpackQuery(b)
+	if err != nil {
 		return nil, fmt.Errorf("failed to unpack msg [%x], %w", b, err)
 	}
 	return m, nil
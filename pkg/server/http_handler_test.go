@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type ttlHandler uint32
+
+func (h ttlHandler) Handle(_ context.Context, q *dns.Msg, _ QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(h)},
+		A:   []byte{1, 2, 3, 4},
+	})
+	b, _ := pack(r)
+	return b
+}
+
+func TestHttpHandler_ServeHTTP(t *testing.T) {
+	h := NewHttpHandler(ttlHandler(300), HttpHandlerOpts{})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	wire, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	getUrl := "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(wire)
+
+	tests := []struct {
+		name       string
+		method     string
+		accept     string
+		wantStatus int
+	}{
+		{"get", http.MethodGet, "application/dns-message", http.StatusOK},
+		{"get without accept", http.MethodGet, "", http.StatusOK},
+		{"get with browser accept", http.MethodGet, "text/html, application/dns-message;q=0.9", http.StatusOK},
+		{"get with wrong accept", http.MethodGet, "application/json", http.StatusBadRequest},
+		{"post", http.MethodPost, "", http.StatusOK},
+		{"put", http.MethodPut, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			if tt.method == http.MethodGet {
+				req = httptest.NewRequest(tt.method, getUrl, nil)
+			} else {
+				req = httptest.NewRequest(tt.method, "/dns-query", bytes.NewReader(wire))
+				req.Header.Set("Content-Type", "application/dns-message")
+			}
+			if len(tt.accept) > 0 {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if cc := w.Header().Get("Cache-Control"); cc != "max-age=300" {
+				t.Fatalf("Cache-Control = %q, want max-age=300", cc)
+			}
+			r := new(dns.Msg)
+			if err := r.Unpack(w.Body.Bytes()); err != nil || len(r.Answer) != 1 {
+				t.Fatalf("invalid response %v, err %v", r, err)
+			}
+		})
+	}
+}
+
+type metaHandler struct {
+	ttlHandler
+	meta QueryMeta
+}
+
+func (h *metaHandler) Handle(ctx context.Context, q *dns.Msg, meta QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	h.meta = meta
+	return h.ttlHandler.Handle(ctx, q, meta, pack)
+}
+
+func TestHttpHandler_ClientID(t *testing.T) {
+	dh := &metaHandler{ttlHandler: 300}
+	h := NewHttpHandler(dh, HttpHandlerOpts{ClientIDParam: "id"})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	wire, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/dns-query?id=Kids-Tablet", bytes.NewReader(wire))
+	req.Header.Set("Content-Type", "application/dns-message")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	if dh.meta.ClientID != "kids-tablet" {
+		t.Fatalf("want client id kids-tablet, got %q", dh.meta.ClientID)
+	}
+}
+
+func TestHttpHandler_PathToken(t *testing.T) {
+	dh := &metaHandler{ttlHandler: 300}
+	auth := &ClientAuth{Tokens: map[string]string{"t0k3n": "home"}, PathToken: true}
+	h := NewHttpHandler(dh, HttpHandlerOpts{Auth: auth})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	wire, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url       string
+		wantPath  string
+		wantGroup string
+	}{
+		{"/dns-query/t0k3n", "/dns-query/", "home"},
+		{"/dns-query/kids", "/dns-query/kids", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.url, bytes.NewReader(wire))
+		req.Header.Set("Content-Type", "application/dns-message")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d", tt.url, w.Code)
+		}
+		if dh.meta.UrlPath != tt.wantPath || dh.meta.ClientGroup != tt.wantGroup {
+			t.Fatalf("%s: got path %q group %q, want %q %q", tt.url, dh.meta.UrlPath, dh.meta.ClientGroup, tt.wantPath, tt.wantGroup)
+		}
+	}
+}
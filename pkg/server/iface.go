@@ -26,4 +26,13 @@ type QueryMeta struct {
 	ClientAddr netip.Addr
 	ServerName string
 	UrlPath    string
+
+	// ClientGroup is the group of an authenticated client.
+	// Empty if the server has no auth or the client is anonymous.
+	ClientGroup string
+
+	// ClientID identifies the client device, e.g. its MAC address in
+	// the form of "aa:bb:cc:dd:ee:ff" or a device name in lower case.
+	// See dnsutils.NormalizeClientID. Empty if it's unknown.
+	ClientID string
 }
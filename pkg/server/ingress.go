@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+const dnsHeaderLen = 12
+
+var (
+	ErrQueryTooSmall     = errors.New("query is too small")
+	ErrQueryTooLarge     = errors.New("query is too large")
+	ErrNotQuery          = errors.New("msg is not a query")
+	ErrNotUpdate         = errors.New("msg is not an update")
+	ErrInvalidQueryCount = errors.New("query has invalid section counts")
+	ErrMalformedQuery    = errors.New("malformed query")
+)
+
+// IngressStats counts queries that were rejected by UnpackQuery.
+type IngressStats struct {
+	TooSmall     uint64
+	TooLarge     uint64
+	NotQuery     uint64
+	InvalidCount uint64
+	Malformed    uint64
+}
+
+var ingressCounters struct {
+	tooSmall     atomic.Uint64
+	tooLarge     atomic.Uint64
+	notQuery     atomic.Uint64
+	invalidCount atomic.Uint64
+	malformed    atomic.Uint64
+}
+
+// ReadIngressStats returns the number of rejected queries of all listeners.
+func ReadIngressStats() IngressStats {
+	return IngressStats{
+		TooSmall:     ingressCounters.tooSmall.Load(),
+		TooLarge:     ingressCounters.tooLarge.Load(),
+		NotQuery:     ingressCounters.notQuery.Load(),
+		InvalidCount: ingressCounters.invalidCount.Load(),
+		Malformed:    ingressCounters.malformed.Load(),
+	}
+}
+
+// UnpackQuery is the only entry that untrusted wire data from clients
+// is parsed into a query. All listeners must use it.
+// Cheap header checks run before the full unpack, so obviously invalid
+// packets are rejected without allocations. Rejected packets are counted
+// and can be read by ReadIngressStats.
+// A query that passes has exactly one question, no answer and authority
+// records and at most one additional record (the OPT).
+func UnpackQuery(b []byte) (*dns.Msg, error) {
+	if len(b) < dnsHeaderLen {
+		ingressCounters.tooSmall.Add(1)
+		return nil, ErrQueryTooSmall
+	}
+	if len(b) > dns.MaxMsgSize {
+		ingressCounters.tooLarge.Add(1)
+		return nil, ErrQueryTooLarge
+	}
+	if b[2]&0x80 != 0 { // QR bit
+		ingressCounters.notQuery.Add(1)
+		return nil, ErrNotQuery
+	}
+	qdCount := binary.BigEndian.Uint16(b[4:])
+	anCount := binary.BigEndian.Uint16(b[6:])
+	nsCount := binary.BigEndian.Uint16(b[8:])
+	arCount := binary.BigEndian.Uint16(b[10:])
+	if qdCount != 1 || anCount != 0 || nsCount != 0 || arCount > 1 {
+		ingressCounters.invalidCount.Add(1)
+		return nil, ErrInvalidQueryCount
+	}
+
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil {
+		ingressCounters.malformed.Add(1)
+		return nil, fmt.Errorf("%w, %w", ErrMalformedQuery, err)
+	}
+	// Unpack may tolerate some truncated sections. Check again.
+	if len(q.Question) != 1 || len(q.Answer)+len(q.Ns) > 0 || len(q.Extra) > 1 {
+		ingressCounters.malformed.Add(1)
+		return nil, ErrMalformedQuery
+	}
+	return q, nil
+}
+
+// UnpackUpdate is like UnpackQuery, but for dns update msgs (RFC 2136)
+// from untrusted clients. Update listeners must use it instead of
+// UnpackQuery.
+// An update that passes has exactly one zone and at most two additional
+// records (the OPT and the TSIG). Prerequisite and update sections are
+// not limited.
+func UnpackUpdate(b []byte) (*dns.Msg, error) {
+	if len(b) < dnsHeaderLen {
+		ingressCounters.tooSmall.Add(1)
+		return nil, ErrQueryTooSmall
+	}
+	if len(b) > dns.MaxMsgSize {
+		ingressCounters.tooLarge.Add(1)
+		return nil, ErrQueryTooLarge
+	}
+	if b[2]&0x80 != 0 || int(b[2]>>3)&0xF != dns.OpcodeUpdate {
+		ingressCounters.notQuery.Add(1)
+		return nil, ErrNotUpdate
+	}
+	zoCount := binary.BigEndian.Uint16(b[4:])
+	adCount := binary.BigEndian.Uint16(b[10:])
+	if zoCount != 1 || adCount > 2 {
+		ingressCounters.invalidCount.Add(1)
+		return nil, ErrInvalidQueryCount
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		ingressCounters.malformed.Add(1)
+		return nil, fmt.Errorf("%w, %w", ErrMalformedQuery, err)
+	}
+	if len(m.Question) != 1 || len(m.Extra) > 2 {
+		ingressCounters.malformed.Add(1)
+		return nil, ErrMalformedQuery
+	}
+	// Only the OPT and the TSIG are allowed, and the TSIG must be the last.
+	var opt, tsig int
+	for i, rr := range m.Extra {
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT:
+			opt++
+		case dns.TypeTSIG:
+			if i != len(m.Extra)-1 {
+				ingressCounters.malformed.Add(1)
+				return nil, ErrMalformedQuery
+			}
+			tsig++
+		default:
+			ingressCounters.malformed.Add(1)
+			return nil, ErrMalformedQuery
+		}
+	}
+	if opt > 1 || tsig > 1 {
+		ingressCounters.malformed.Add(1)
+		return nil, ErrMalformedQuery
+	}
+	return m, nil
+}
+
+// readQueryFromTCP reads a query from c in RFC 1035 format (msg is
+// prefixed with a two byte length field) and unpacks it by UnpackQuery.
+// n is the size of the msg. It is 0 if no msg was read.
+func readQueryFromTCP(c io.Reader) (q *dns.Msg, n int, err error) {
+	b, err := dnsutils.ReadRawMsgFromTCP(c)
+	if err != nil {
+		if errors.Is(err, dnsutils.ErrPayloadTooSmall) {
+			ingressCounters.tooSmall.Add(1)
+		}
+		return nil, 0, err
+	}
+	defer pool.ReleaseBuf(b)
+	q, err = UnpackQuery(*b)
+	return q, len(*b), err
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func packOrDie(t testing.TB, m *dns.Msg) []byte {
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestUnpackQuery(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	valid := packOrDie(t, q)
+
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+
+	twoQuestions := q.Copy()
+	twoQuestions.Question = append(twoQuestions.Question, twoQuestions.Question[0])
+
+	withAnswer := q.Copy()
+	withAnswer.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}}}
+
+	tests := []struct {
+		name    string
+		b       []byte
+		wantErr error
+	}{
+		{"valid", valid, nil},
+		{"too small", valid[:dnsHeaderLen-1], ErrQueryTooSmall},
+		{"too large", make([]byte, dns.MaxMsgSize+1), ErrQueryTooLarge},
+		{"response", packOrDie(t, resp), ErrNotQuery},
+		{"two questions", packOrDie(t, twoQuestions), ErrInvalidQueryCount},
+		{"answer in query", packOrDie(t, withAnswer), ErrInvalidQueryCount},
+		{"truncated question", valid[:dnsHeaderLen+3], ErrMalformedQuery},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := UnpackQuery(tt.b)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("unexpected err %v", err)
+				}
+				if m.Question[0].Name != "example.com." {
+					t.Fatalf("unexpected question %v", m.Question)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("want err %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestUnpackUpdate(t *testing.T) {
+	u := new(dns.Msg)
+	u.SetUpdate("lan.")
+	u.Insert([]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "nas.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: []byte{192, 168, 1, 2}}})
+	u.SetEdns0(1232, false)
+	u.SetTsig("key.", dns.HmacSHA256, 300, 0)
+	q := new(dns.Msg)
+	q.SetQuestion("lan.", dns.TypeSOA)
+
+	tsigFirst := u.Copy()
+	tsigFirst.Extra[0], tsigFirst.Extra[1] = tsigFirst.Extra[1], tsigFirst.Extra[0]
+
+	extraRR := u.Copy()
+	extraRR.Extra[0] = &dns.A{Hdr: dns.RR_Header{Name: "nas.lan.", Rrtype: dns.TypeA, Class: dns.ClassINET}}
+
+	threeExtra := u.Copy()
+	threeExtra.Extra = append([]dns.RR{threeExtra.Extra[0]}, threeExtra.Extra...)
+
+	signed, _, err := dns.TsigGenerate(u.Copy(), "c2VjcmV0", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// UnpackQuery must not be used for updates.
+	if _, err := UnpackQuery(signed); err == nil {
+		t.Fatal("UnpackQuery should reject updates")
+	}
+
+	tests := []struct {
+		name    string
+		b       []byte
+		wantErr error
+	}{
+		{"edns0 and tsig", signed, nil},
+		{"too small", signed[:dnsHeaderLen-1], ErrQueryTooSmall},
+		{"query", packOrDie(t, q), ErrNotUpdate},
+		{"tsig not last", packOrDie(t, tsigFirst), ErrMalformedQuery},
+		{"other additional rr", packOrDie(t, extraRR), ErrMalformedQuery},
+		{"three additional rrs", packOrDie(t, threeExtra), ErrInvalidQueryCount},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := UnpackUpdate(tt.b)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("unexpected err %v", err)
+				}
+				if m.IsTsig() == nil || m.IsEdns0() == nil || len(m.Ns) != 1 {
+					t.Fatalf("unexpected update %v", m)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("want err %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func FuzzUnpackQuery(f *testing.F) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	f.Add(packOrDie(f, q))
+	q.SetEdns0(4096, true)
+	f.Add(packOrDie(f, q))
+	f.Add([]byte{})
+	f.Add(make([]byte, dnsHeaderLen))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := UnpackQuery(b)
+		if err != nil {
+			return
+		}
+		if m.Response || len(m.Question) != 1 || len(m.Answer)+len(m.Ns) > 0 || len(m.Extra) > 1 {
+			t.Fatalf("invalid query passed: %v", m)
+		}
+		// A valid query must be able to be packed again.
+		if _, err := m.Pack(); err != nil {
+			t.Fatalf("failed to pack a valid query, %v", err)
+		}
+	})
+}
@@ -27,7 +27,6 @@ import (
 	"net/netip"
 	"time"
 
-	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"go.uber.org/zap"
 )
@@ -43,6 +42,16 @@ type TCPServerOpts struct {
 
 	// Default is defaultTCPIdleTimeout.
 	IdleTimeout time.Duration
+
+	// Auth authenticates clients by their tls certificates.
+	// Nil means no auth.
+	Auth *ClientAuth
+	// Anomaly counts suspicious queries and bans abusive clients.
+	// Nil means disabled.
+	Anomaly *AnomalyTracker
+	// ConnLimiter limits concurrent connections per client.
+	// Nil means no limit.
+	ConnLimiter *ConnLimiter
 }
 
 // ServeTCP starts a server at l. It returns if l had an Accept() error.
@@ -74,8 +83,30 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 		go func() {
 			defer c.Close()
 			defer cancelConn(errConnectionCtxCanceled)
+			// Close the connection once the listener is closed, so it won't
+			// outlive the server (e.g. after a reload).
+			stop := context.AfterFunc(tcpConnCtx, func() { c.Close() })
+			defer stop()
+
+			var clientAddr netip.Addr
+			if ta, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+				clientAddr = ta.AddrPort().Addr()
+			}
+			if opts.Anomaly.Banned(clientAddr) {
+				return
+			}
+			if !opts.ConnLimiter.Acquire(clientAddr) {
+				logger.Debug("too many connections", zap.Stringer("client", c.RemoteAddr()))
+				return
+			}
+			defer opts.ConnLimiter.Release(clientAddr)
 
 			firstRead := true
+			var (
+				authed      bool
+				serverName  string
+				clientGroup string
+			)
 			for {
 				if firstRead {
 					firstRead = false
@@ -83,25 +114,34 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 				} else {
 					c.SetReadDeadline(time.Now().Add(idleTimeout))
 				}
-				req, _, err := dnsutils.ReadMsgFromTCP(c)
+				req, n, err := readQueryFromTCP(c)
+				if n > 0 {
+					opts.Anomaly.checkQuery(clientAddr, n, req, err)
+				}
 				if err != nil {
 					return // read err, close the connection
 				}
 
-				// Try to get server name from tls conn.
-				var serverName string
-				if tlsConn, ok := c.(*tls.Conn); ok {
-					serverName = tlsConn.ConnectionState().ServerName
+				// Handshake is done after the first read. Get server name
+				// and client identity from the tls conn.
+				if !authed {
+					authed = true
+					var cs *tls.ConnectionState
+					if tlsConn, ok := c.(*tls.Conn); ok {
+						s := tlsConn.ConnectionState()
+						cs = &s
+						serverName = s.ServerName
+					}
+					clientGroup, err = opts.Auth.AuthTLS(cs)
+					if err != nil {
+						logger.Warn("failed to auth client", zap.Stringer("client", c.RemoteAddr()), zap.Error(err))
+						return
+					}
 				}
 
 				// handle query
 				go func() {
-					var clientAddr netip.Addr
-					ta, ok := c.RemoteAddr().(*net.TCPAddr)
-					if ok {
-						clientAddr = ta.AddrPort().Addr()
-					}
-					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName}, pool.PackTCPBuffer)
+					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName, ClientGroup: clientGroup}, pool.PackTCPBuffer)
 					if r == nil {
 						c.Close() // abort the connection
 						return
@@ -21,8 +21,11 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/miekg/dns"
@@ -31,6 +34,16 @@ import (
 
 type UDPServerOpts struct {
 	Logger *zap.Logger
+
+	// Anomaly counts suspicious queries and bans abusive clients.
+	// Nil means disabled.
+	Anomaly *AnomalyTracker
+
+	// StopAccepting stops the server from handling new queries once it
+	// is closed. c is still used to answer queries that are in flight,
+	// and new queries are read and dropped until c is closed.
+	// Optional.
+	StopAccepting <-chan struct{}
 }
 
 // ServeUDP starts a server at c. It returns if c had a read error.
@@ -59,10 +72,33 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 		ob = *obp
 	}
 
+	// Unblock the read once opts.StopAccepting is closed.
+	stopped := false
+	if opts.StopAccepting != nil {
+		go func() {
+			select {
+			case <-opts.StopAccepting:
+				_ = c.SetReadDeadline(time.Unix(1, 0))
+			case <-listenerCtx.Done():
+			}
+		}()
+	}
+
 	for {
 		n, oobn, _, remoteAddr, err := c.ReadMsgUDPAddrPort(*rb, ob)
+		if stopped {
+			if err != nil && n <= 0 {
+				return fmt.Errorf("unexpected read err: %w", err)
+			}
+			continue // drop new queries
+		}
 		if err != nil {
-			if n == 0 {
+			if n <= 0 {
+				if opts.StopAccepting != nil && errors.Is(err, os.ErrDeadlineExceeded) && isClosed(opts.StopAccepting) {
+					stopped = true
+					_ = c.SetReadDeadline(time.Time{})
+					continue
+				}
 				// Err with zero read. Most likely because c was closed.
 				return fmt.Errorf("unexpected read err: %w", err)
 			}
@@ -71,9 +107,14 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 			continue
 		}
 
-		q := new(dns.Msg)
-		if err := q.Unpack((*rb)[:n]); err != nil {
-			logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", (*rb)[:n]), zap.Stringer("from", remoteAddr))
+		if opts.Anomaly.Banned(remoteAddr.Addr()) || opts.Anomaly.checkUDPSource(remoteAddr) {
+			continue
+		}
+
+		q, err := UnpackQuery((*rb)[:n])
+		opts.Anomaly.checkQuery(remoteAddr.Addr(), n, q, err)
+		if err != nil {
+			logger.Debug("invalid msg", zap.Error(err), zap.Binary("msg", (*rb)[:n]), zap.Stringer("from", remoteAddr))
 			continue
 		}
 
@@ -107,3 +148,12 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 
 type getSrcAddrFromOOB func(oob []byte) (net.IP, error)
 type writeSrcAddrToOOB func(a net.IP) []byte
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
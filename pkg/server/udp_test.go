@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type blockingHandler struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (h *blockingHandler) Handle(ctx context.Context, q *dns.Msg, _ QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	h.calls.Add(1)
+	select {
+	case <-h.release:
+	case <-ctx.Done():
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	b, _ := pack(r)
+	return b
+}
+
+func TestServeUDP_StopAccepting(t *testing.T) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &blockingHandler{release: make(chan struct{})}
+	core, logs := observer.New(zap.WarnLevel)
+	stop := make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeUDP(c, h, UDPServerOpts{Logger: zap.New(core), StopAccepting: stop})
+	}()
+
+	client, err := net.Dial("udp", c.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, err := client.Write(packOrDie(t, q)); err != nil {
+		t.Fatal(err)
+	}
+	for h.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	q2 := q.Copy()
+	q2.Id++
+	if _, err := client.Write(packOrDie(t, q2)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(h.release)
+
+	// The query in flight is still answered.
+	b := make([]byte, 512)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(b[:n]); err != nil || r.Id != q.Id {
+		t.Fatalf("unexpected response %v, %v", r, err)
+	}
+	if h.calls.Load() != 1 {
+		t.Fatal("query was handled after the server stopped accepting")
+	}
+
+	select {
+	case err := <-served:
+		t.Fatalf("server returned before its socket was closed, %v", err)
+	default:
+	}
+	c.Close()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("server is still running after its socket was closed")
+	}
+	if logs.Len() > 0 {
+		t.Fatalf("unexpected warnings %v", logs.All())
+	}
+}
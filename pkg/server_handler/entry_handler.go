@@ -21,10 +21,14 @@ package server_handler
 
 import (
 	"context"
+	"net/netip"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_log"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
@@ -60,6 +64,56 @@ type EntryHandlerOpts struct {
 	// QueryTimeout limits the timeout value of each query.
 	// Default is defaultQueryTimeout.
 	QueryTimeout time.Duration
+
+	// Inflight, if not nil, counts queries that are being processed.
+	Inflight *atomic.Int64
+
+	// QueryLog, if not nil, receives records of finished queries.
+	QueryLog *query_log.Hub
+
+	// OnQuery, if not nil, is called with the record of every finished
+	// query before the response is sent. Unlike subscribers of QueryLog,
+	// it never misses records, so it can update counters.
+	OnQuery func(r *query_log.Record)
+
+	// MinimalANY answers ANY queries with a synthesized HINFO record
+	// (RFC 8482) instead of executing Entry.
+	MinimalANY bool
+
+	// OnQuestionMismatch, if not nil, is called when a response doesn't
+	// echo the id or the exact question (including the case of the qname)
+	// of the query. The response is fixed before it is sent.
+	OnQuestionMismatch func()
+
+	// OnResponse, if not nil, is called with the rcode of each response
+	// before it is sent.
+	OnResponse func(rcode int)
+
+	// MetaTrusted, if not nil, reports whether the client is a trusted
+	// front proxy (e.g. the previous mosdns in a chain), whose queries
+	// carry the identity of the original client.
+	MetaTrusted func(addr netip.Addr) bool
+
+	// MetaOptionCode, if not zero, is the code of the EDNS0 option that
+	// carries the query metadata (see dnsutils.Meta). The client address,
+	// client group and marks in it are applied to queries from trusted
+	// clients.
+	MetaOptionCode uint16
+
+	// ClientAddrFromECS uses the address of the ECS option from trusted
+	// clients as the client address, if the query has no client address
+	// in its metadata.
+	ClientAddrFromECS bool
+
+	// ClientIDCodes, if not empty, are codes of EDNS0 options that carry
+	// the client id (see dnsutils.ClientIDFromOpt), e.g. the MAC address
+	// inserted by dnsmasq. It is ignored if the query already has a
+	// client id, e.g. from the url of a DoH query.
+	ClientIDCodes []uint16
+
+	// ClientIDTrusted, if not nil, reports whether the client id options
+	// from the client are trusted. Nil means all clients are trusted.
+	ClientIDTrusted func(addr netip.Addr) bool
 }
 
 func (opts *EntryHandlerOpts) init() {
@@ -83,21 +137,45 @@ func NewEntryHandler(opts EntryHandlerOpts) *EntryHandler {
 // ServeDNS implements server.Handler.
 // If entry returns an error, a SERVFAIL response will be returned.
 // If entry returns without a response, a REFUSED response will be returned.
+// If the response was dropped by query_context.Context.DropResponse, nil
+// is returned.
 func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
 	// basic query check.
 	if q.Response || len(q.Question) != 1 || len(q.Answer)+len(q.Ns) > 0 || len(q.Extra) > 1 {
 		return nil
 	}
 
+	if h.opts.Inflight != nil {
+		h.opts.Inflight.Add(1)
+		defer h.opts.Inflight.Add(-1)
+	}
+
 	ddl := time.Now().Add(h.opts.QueryTimeout)
 	ctx, cancel := context.WithDeadline(ctx, ddl)
 	defer cancel()
 
+	// Plugins may modify the query in place, keep the original one.
+	orgId, orgQuestion := q.Id, q.Question[0]
+
 	qCtx := query_context.NewContext(q)
 	qCtx.ServerMeta = serverMeta
+	if len(h.opts.ClientIDCodes) > 0 && len(serverMeta.ClientID) == 0 {
+		// Before applyMeta, so the trusted client is the peer.
+		if h.opts.ClientIDTrusted == nil || h.opts.ClientIDTrusted(serverMeta.ClientAddr) {
+			qCtx.ServerMeta.ClientID = dnsutils.ClientIDFromOpt(qCtx.ClientOpt(), h.opts.ClientIDCodes)
+		}
+	}
+	if h.opts.MetaTrusted != nil {
+		h.applyMeta(qCtx)
+	}
 
 	// exec entry
-	err := h.opts.Entry.Exec(ctx, qCtx)
+	var err error
+	if h.opts.MinimalANY && q.Question[0].Qtype == dns.TypeANY {
+		qCtx.SetResponse(minimalANYResponse(qCtx.Q()))
+	} else {
+		err = h.opts.Entry.Exec(ctx, qCtx)
+	}
 	var resp *dns.Msg
 	if err != nil {
 		h.opts.Logger.Warn("entry err", qCtx.InfoField(), zap.Error(err))
@@ -105,6 +183,10 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 		resp.SetReply(q)
 		resp.Rcode = dns.RcodeServerFailure
 	} else {
+		if qCtx.ResponseDropped() {
+			h.publish(qCtx, nil, nil)
+			return nil
+		}
 		resp = qCtx.R()
 	}
 
@@ -116,6 +198,26 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 	// We assume that our server is a forwarder.
 	resp.RecursionAvailable = true
 
+	if resp.Id != orgId || len(resp.Question) != 1 || resp.Question[0] != orgQuestion {
+		// Upstreams may omit the question in FORMERR and NOTIMP responses.
+		noQuestionErr := resp.Id == orgId && len(resp.Question) == 0 &&
+			(resp.Rcode == dns.RcodeFormatError || resp.Rcode == dns.RcodeNotImplemented)
+		if !noQuestionErr {
+			h.opts.Logger.Debug("response does not match the query, fixing", qCtx.InfoField(), zap.Uint16("resp_id", resp.Id), zap.Any("resp_question", resp.Question))
+			if h.opts.OnQuestionMismatch != nil {
+				h.opts.OnQuestionMismatch()
+			}
+		}
+		resp.Id = orgId
+		resp.Question = []dns.Question{orgQuestion}
+	}
+
+	if h.opts.OnResponse != nil {
+		h.opts.OnResponse(resp.Rcode)
+	}
+
+	h.publish(qCtx, resp, err)
+
 	// add respOpt back to resp
 	if respOpt := qCtx.RespOpt(); respOpt != nil {
 		resp.Extra = append(resp.Extra, respOpt)
@@ -134,6 +236,75 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 	return payload
 }
 
+// publish sends the record of a finished query to OnQuery and the
+// query log.
+func (h *EntryHandler) publish(qCtx *query_context.Context, resp *dns.Msg, err error) {
+	if h.opts.OnQuery != nil || h.opts.QueryLog.Active() {
+		rec := query_log.NewRecord(qCtx, resp, err)
+		if h.opts.OnQuery != nil {
+			h.opts.OnQuery(rec)
+		}
+		h.opts.QueryLog.Publish(rec)
+	}
+}
+
+// applyMeta applies the identity of the original client from trusted
+// clients to qCtx.
+func (h *EntryHandler) applyMeta(qCtx *query_context.Context) {
+	if !h.opts.MetaTrusted(qCtx.ServerMeta.ClientAddr) {
+		return
+	}
+	var m dnsutils.Meta
+	if h.opts.MetaOptionCode != 0 {
+		if b, ok := dnsutils.FindMetaOption(qCtx.ClientOpt(), h.opts.MetaOptionCode); ok {
+			var err error
+			m, err = dnsutils.UnpackMeta(b)
+			if err != nil {
+				h.opts.Logger.Debug("invalid meta option", qCtx.InfoField(), zap.Error(err))
+				return
+			}
+		}
+	}
+	if !m.ClientAddr.IsValid() && h.opts.ClientAddrFromECS {
+		m.ClientAddr = ecsAddr(qCtx.ClientOpt())
+	}
+
+	if m.ClientAddr.IsValid() {
+		qCtx.ServerMeta.ClientAddr = m.ClientAddr
+	}
+	if len(m.ClientGroup) > 0 {
+		qCtx.ServerMeta.ClientGroup = m.ClientGroup
+	}
+	for _, mark := range m.Marks {
+		qCtx.SetMark(mark)
+	}
+}
+
+// ecsAddr returns the address of the ECS option in opt. opt can be nil.
+func ecsAddr(opt *dns.OPT) netip.Addr {
+	if opt == nil {
+		return netip.Addr{}
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			addr, _ := netip.AddrFromSlice(ecs.Address)
+			return addr.Unmap()
+		}
+	}
+	return netip.Addr{}
+}
+
+// minimalANYResponse returns a response of an ANY query as RFC 8482 4.2.
+func minimalANYResponse(q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeHINFO, Class: q.Question[0].Qclass, Ttl: 3600},
+		Cpu: "RFC8482",
+	})
+	return r
+}
+
 // opt can be nil.
 func getValidUDPSize(opt *dns.OPT) int {
 	var s uint16
@@ -0,0 +1,301 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+func TestEntryHandler_MinimalANY(t *testing.T) {
+	executed := false
+	h := NewEntryHandler(EntryHandlerOpts{
+		Entry: sequence.ExecutableFunc(func(_ context.Context, _ *query_context.Context) error {
+			executed = true
+			return nil
+		}),
+		MinimalANY: true,
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeANY)
+	b := h.Handle(context.Background(), q, server.QueryMeta{}, pool.PackBuffer)
+	if b == nil {
+		t.Fatal("no response")
+	}
+	defer pool.ReleaseBuf(b)
+	r := new(dns.Msg)
+	if err := r.Unpack(*b); err != nil {
+		t.Fatal(err)
+	}
+	if executed {
+		t.Fatal("entry should not be executed")
+	}
+	if len(r.Answer) != 1 {
+		t.Fatalf("want 1 answer, got %v", r)
+	}
+	if hinfo, ok := r.Answer[0].(*dns.HINFO); !ok || hinfo.Cpu != "RFC8482" {
+		t.Fatalf("unexpected answer %v", r.Answer[0])
+	}
+}
+
+func TestEntryHandler_QuestionMismatch(t *testing.T) {
+	mismatches := 0
+	h := NewEntryHandler(EntryHandlerOpts{
+		Entry: sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA) // lower case and a new id
+			r.Response = true
+			qCtx.SetResponse(r)
+			return nil
+		}),
+		OnQuestionMismatch: func() { mismatches++ },
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("ExAmPle.com.", dns.TypeA)
+	b := h.Handle(context.Background(), q, server.QueryMeta{}, pool.PackBuffer)
+	if b == nil {
+		t.Fatal("no response")
+	}
+	defer pool.ReleaseBuf(b)
+	r := new(dns.Msg)
+	if err := r.Unpack(*b); err != nil {
+		t.Fatal(err)
+	}
+	if mismatches != 1 {
+		t.Fatalf("want 1 mismatch, got %d", mismatches)
+	}
+	if r.Id != q.Id || r.Question[0] != q.Question[0] {
+		t.Fatalf("response does not echo the query, %v", r)
+	}
+}
+
+func TestEntryHandler_NoQuestionError(t *testing.T) {
+	mismatches := 0
+	h := NewEntryHandler(EntryHandlerOpts{
+		Entry: sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+			r := new(dns.Msg)
+			r.Id = qCtx.Q().Id
+			r.Response = true
+			r.Rcode = dns.RcodeFormatError
+			qCtx.SetResponse(r)
+			return nil
+		}),
+		OnQuestionMismatch: func() { mismatches++ },
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b := h.Handle(context.Background(), q, server.QueryMeta{}, pool.PackBuffer)
+	if b == nil {
+		t.Fatal("no response")
+	}
+	defer pool.ReleaseBuf(b)
+	r := new(dns.Msg)
+	if err := r.Unpack(*b); err != nil {
+		t.Fatal(err)
+	}
+	if mismatches != 0 {
+		t.Fatal("formerr without a question counted as a mismatch")
+	}
+	if r.Rcode != dns.RcodeFormatError || len(r.Question) != 1 || r.Question[0] != q.Question[0] {
+		t.Fatalf("unexpected response %v", r)
+	}
+}
+
+func TestEntryHandler_OnResponse(t *testing.T) {
+	var rcodes []int
+	h := NewEntryHandler(EntryHandlerOpts{
+		Entry: sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+			if qCtx.Q().Question[0].Qtype == dns.TypeAAAA {
+				return errors.New("entry err")
+			}
+			return nil // no response
+		}),
+		OnResponse: func(rcode int) { rcodes = append(rcodes, rcode) },
+	})
+
+	for _, qt := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", qt)
+		if b := h.Handle(context.Background(), q, server.QueryMeta{}, pool.PackBuffer); b != nil {
+			pool.ReleaseBuf(b)
+		}
+	}
+	if len(rcodes) != 2 || rcodes[0] != dns.RcodeRefused || rcodes[1] != dns.RcodeServerFailure {
+		t.Fatalf("unexpected rcodes %v", rcodes)
+	}
+}
+
+func TestEntryHandler_OnQuery(t *testing.T) {
+	var records []*query_log.Record
+	h := NewEntryHandler(EntryHandlerOpts{
+		Entry: sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+			return errors.New("entry err")
+		}),
+		OnQuery: func(r *query_log.Record) { records = append(records, r) },
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if b := h.Handle(context.Background(), q, server.QueryMeta{}, pool.PackBuffer); b != nil {
+		pool.ReleaseBuf(b)
+	}
+	if len(records) != 1 || records[0].QName != "example.com." || records[0].Rcode != "SERVFAIL" || records[0].Err != "entry err" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+
+	// Dropped queries are recorded too.
+	records = nil
+	h = NewEntryHandler(EntryHandlerOpts{
+		Entry: sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+			qCtx.SetResponse(new(dns.Msg).SetRcode(qCtx.Q(), dns.RcodeRefused))
+			qCtx.DropResponse()
+			return nil
+		}),
+		OnQuery: func(r *query_log.Record) { records = append(records, r) },
+	})
+	if b := h.Handle(context.Background(), q, server.QueryMeta{}, pool.PackBuffer); b != nil {
+		t.Fatal("dropped query should not be answered")
+	}
+	if len(records) != 1 || !records[0].Dropped || len(records[0].Rcode) != 0 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+}
+
+func TestEntryHandler_Meta(t *testing.T) {
+	type result struct {
+		group string
+		mark  bool
+	}
+	var got result
+	h := NewEntryHandler(EntryHandlerOpts{
+		Entry: sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+			got = result{group: qCtx.ServerMeta.ClientGroup, mark: qCtx.HasMark(7)}
+			return nil
+		}),
+		MetaOptionCode: dnsutils.DefaultMetaOptionCode,
+		MetaTrusted:    func(addr netip.Addr) bool { return addr.IsLoopback() },
+	})
+
+	b, err := dnsutils.PackMeta(dnsutils.Meta{ClientGroup: "kids", Marks: []uint32{7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		client string
+		want   result
+	}{
+		{"127.0.0.1", result{group: "kids", mark: true}},
+		{"192.0.2.1", result{group: "lan"}},
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(1232, false)
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dnsutils.DefaultMetaOptionCode, Data: b})
+		meta := server.QueryMeta{ClientAddr: netip.MustParseAddr(test.client), ClientGroup: "lan"}
+		if b := h.Handle(context.Background(), q, meta, pool.PackBuffer); b != nil {
+			pool.ReleaseBuf(b)
+		}
+		if got != test.want {
+			t.Fatalf("client %s: want %+v, got %+v", test.client, test.want, got)
+		}
+	}
+}
+
+func TestEntryHandler_ClientAddrFromECS(t *testing.T) {
+	var got netip.Addr
+	h := NewEntryHandler(EntryHandlerOpts{
+		Entry: sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+			got = qCtx.ServerMeta.ClientAddr
+			return nil
+		}),
+		MetaTrusted:       func(addr netip.Addr) bool { return addr.IsLoopback() },
+		ClientAddrFromECS: true,
+	})
+
+	for _, test := range []struct {
+		client string
+		want   string
+	}{
+		{"127.0.0.1", "192.0.2.0"},
+		{"198.51.100.1", "198.51.100.1"},
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(1232, false)
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(192, 0, 2, 0)})
+		if b := h.Handle(context.Background(), q, server.QueryMeta{ClientAddr: netip.MustParseAddr(test.client)}, pool.PackBuffer); b != nil {
+			pool.ReleaseBuf(b)
+		}
+		if got.String() != test.want {
+			t.Fatalf("client %s: want %s, got %s", test.client, test.want, got)
+		}
+	}
+}
+
+func TestEntryHandler_ClientID(t *testing.T) {
+	var got string
+	h := NewEntryHandler(EntryHandlerOpts{
+		Entry: sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+			got = qCtx.ServerMeta.ClientID
+			return nil
+		}),
+		ClientIDCodes:   dnsutils.DefaultClientIDCodes,
+		ClientIDTrusted: func(addr netip.Addr) bool { return addr.IsLoopback() },
+	})
+
+	for _, test := range []struct {
+		client string
+		id     string // id from the url of DoH
+		want   string
+	}{
+		{"127.0.0.1", "", "00:11:22:aa:bb:cc"},
+		{"127.0.0.1", "tablet", "tablet"},
+		{"192.0.2.1", "", ""},
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(1232, false)
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dnsutils.OptionCodeMAC, Data: []byte{0, 0x11, 0x22, 0xaa, 0xbb, 0xcc}})
+		meta := server.QueryMeta{ClientAddr: netip.MustParseAddr(test.client), ClientID: test.id}
+		if b := h.Handle(context.Background(), q, meta, pool.PackBuffer); b != nil {
+			pool.ReleaseBuf(b)
+		}
+		if got != test.want {
+			t.Fatalf("client %s: want %q, got %q", test.client, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/dnscrypt"
+)
+
+// AvailabilityReporter can be implemented by upstreams that know they
+// can't serve queries for a while, e.g. a DNSCrypt upstream without a
+// valid certificate.
+type AvailabilityReporter interface {
+	Available() bool
+}
+
+// IsAvailable returns false if u implements AvailabilityReporter and
+// reports it is unavailable.
+func IsAvailable(u Upstream) bool {
+	ar, ok := u.(AvailabilityReporter)
+	return !ok || ar.Available()
+}
+
+func newDNSCryptUpstream(s string, opt Opt) (*dnscrypt.Client, error) {
+	st, err := dnscrypt.ParseStamp(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp, %w", err)
+	}
+	if len(opt.DialAddr) > 0 {
+		_, port, _ := net.SplitHostPort(st.Addr)
+		host, dialPort, err := parseDialAddr("", opt.DialAddr, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dial addr, %w", err)
+		}
+		if dialPort != 0 {
+			st.Addr = joinPort(host, dialPort)
+		} else {
+			st.Addr = net.JoinHostPort(host, port)
+		}
+	}
+	dialer := &net.Dialer{
+		Control: getSocketControlFunc(socketOpts{
+			so_mark:        opt.SoMark,
+			bind_to_device: opt.BindToDevice,
+		}),
+	}
+	return dnscrypt.NewClient(dnscrypt.ClientOpts{
+		Stamp:       st,
+		DialContext: dialer.DialContext,
+		Logger:      opt.Logger,
+	}), nil
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var certMagic = []byte{'D', 'N', 'S', 'C'}
+
+const (
+	certMinLen   = 124
+	signatureLen = ed25519.SignatureSize
+)
+
+// Cert is a resolver certificate.
+type Cert struct {
+	EsVersion   esVersion
+	ResolverPK  [32]byte
+	ClientMagic [8]byte
+	Serial      uint32
+	NotBefore   time.Time
+	NotAfter    time.Time
+}
+
+// Valid reports whether c is valid at t.
+func (c *Cert) Valid(t time.Time) bool {
+	return !t.Before(c.NotBefore) && t.Before(c.NotAfter)
+}
+
+// parseCert parses and verifies a binary certificate.
+func parseCert(b []byte, providerPK ed25519.PublicKey) (*Cert, error) {
+	if len(b) < certMinLen {
+		return nil, fmt.Errorf("cert is too short, %d bytes", len(b))
+	}
+	if !bytes.Equal(b[:4], certMagic) {
+		return nil, errors.New("invalid cert magic")
+	}
+	es := esVersion(binary.BigEndian.Uint16(b[4:6]))
+	if es != esXSalsa20Poly1305 && es != esXChacha20Poly1305 {
+		return nil, fmt.Errorf("unsupported es version %d", es)
+	}
+	sig := b[8 : 8+signatureLen]
+	signed := b[8+signatureLen:]
+	if !ed25519.Verify(providerPK, signed, sig) {
+		return nil, errors.New("invalid cert signature")
+	}
+
+	c := &Cert{EsVersion: es}
+	copy(c.ResolverPK[:], signed[0:32])
+	copy(c.ClientMagic[:], signed[32:40])
+	c.Serial = binary.BigEndian.Uint32(signed[40:44])
+	c.NotBefore = time.Unix(int64(binary.BigEndian.Uint32(signed[44:48])), 0)
+	c.NotAfter = time.Unix(int64(binary.BigEndian.Uint32(signed[48:52])), 0)
+	return c, nil
+}
+
+// unescapeTxt converts a TXT string in presentation format (with \DDD
+// and \X escapes) back to bytes.
+func unescapeTxt(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return nil, errors.New("invalid escape at the end")
+		}
+		if i+3 <= len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			n, err := strconv.ParseUint(s[i:i+3], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid escape, %w", err)
+			}
+			b = append(b, byte(n))
+			i += 2
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return b, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,414 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// Certs are fetched again after this interval, so rotated certs
+	// are used before old ones expire.
+	certRefreshInterval = time.Hour
+	// Retry interval if there is no valid cert.
+	certRetryInterval = time.Minute
+	certFetchTimeout  = time.Second * 5
+
+	minUDPQuerySize = 256
+	maxUDPRespSize  = 4096
+
+	// Max number of idle udp sockets that are kept for later queries.
+	maxIdleUDPConns = 8
+)
+
+var resolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+
+var (
+	ErrNoValidCert = errors.New("no valid dnscrypt certificate")
+	ErrClosed      = errors.New("dnscrypt client closed")
+)
+
+type ClientOpts struct {
+	Stamp *Stamp
+
+	// DialContext dials the server. Default is a net.Dialer.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Logger. Default is a nop logger.
+	Logger *zap.Logger
+}
+
+// Client is a DNSCrypt v2 client. It keeps the resolver certificate up
+// to date in the background.
+type Client struct {
+	opts ClientOpts
+
+	session atomic.Pointer[session]
+
+	udpMu    sync.Mutex
+	udpConns []net.Conn // idle udp sockets
+	closed   bool
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// session is the cert in use and keys derived from it.
+type session struct {
+	cert      *Cert
+	publicKey [32]byte
+	sharedKey [32]byte
+}
+
+// NewClient creates a Client and starts fetching certificates. It
+// doesn't wait for the first certificate.
+func NewClient(opts ClientOpts) *Client {
+	if opts.DialContext == nil {
+		opts.DialContext = new(net.Dialer).DialContext
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	c := &Client{opts: opts, closeNotify: make(chan struct{})}
+	go c.refreshLoop()
+	return c
+}
+
+// Available reports whether c has a valid certificate.
+func (c *Client) Available() bool {
+	s := c.session.Load()
+	return s != nil && s.cert.Valid(time.Now())
+}
+
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeNotify)
+		c.udpMu.Lock()
+		c.closed = true
+		for _, conn := range c.udpConns {
+			conn.Close()
+		}
+		c.udpConns = nil
+		c.udpMu.Unlock()
+	})
+	return nil
+}
+
+func (c *Client) refreshLoop() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), certFetchTimeout)
+		err := c.refresh(ctx)
+		cancel()
+		next := certRefreshInterval
+		if err != nil {
+			c.opts.Logger.Warn("failed to fetch dnscrypt certificate", zap.String("provider", c.opts.Stamp.ProviderName), zap.Error(err))
+		}
+		if !c.Available() {
+			next = certRetryInterval
+		}
+		t := time.NewTimer(next)
+		select {
+		case <-t.C:
+		case <-c.closeNotify:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// refresh fetches certs and uses the newest valid one. A new client key
+// pair is generated for each new cert.
+func (c *Client) refresh(ctx context.Context) error {
+	cert, err := c.fetchCert(ctx)
+	if err != nil {
+		return err
+	}
+	if old := c.session.Load(); old != nil && old.cert.Serial == cert.Serial && old.cert.Valid(time.Now()) {
+		return nil
+	}
+	s, err := newSession(cert)
+	if err != nil {
+		return err
+	}
+	c.session.Store(s)
+	c.opts.Logger.Info("dnscrypt certificate updated", zap.String("provider", c.opts.Stamp.ProviderName), zap.Uint32("serial", cert.Serial), zap.Time("not_after", cert.NotAfter))
+	return nil
+}
+
+func newSession(cert *Cert) (*session, error) {
+	var sk [32]byte
+	if _, err := rand.Read(sk[:]); err != nil {
+		return nil, err
+	}
+	pk, err := curve25519.X25519(sk[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{cert: cert}
+	copy(s.publicKey[:], pk)
+	s.sharedKey, err = sharedKey(cert.EsVersion, &sk, &cert.ResolverPK)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// fetchCert queries the provider's TXT records and returns the valid
+// cert with the highest serial.
+func (c *Client) fetchCert(ctx context.Context) (*Cert, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(c.opts.Stamp.ProviderName), dns.TypeTXT)
+	q.RecursionDesired = false
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// Plain responses must match the query id.
+	check := func(r []byte) (*[]byte, error) {
+		if len(r) < 12 || binary.BigEndian.Uint16(r) != q.Id {
+			return nil, errors.New("response id mismatch")
+		}
+		out := pool.GetBuf(len(r))
+		copy(*out, r)
+		return out, nil
+	}
+	rb, err := c.exchangeRaw(ctx, "udp", b, check)
+	if err == nil && isTruncated(*rb) {
+		pool.ReleaseBuf(rb)
+		rb, err = c.exchangeRaw(ctx, "tcp", b, check)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer pool.ReleaseBuf(rb)
+	r := new(dns.Msg)
+	if err := r.Unpack(*rb); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var best *Cert
+	var lastErr error
+	for _, rr := range r.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		b, err := unescapeTxt(strings.Join(txt.Txt, ""))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		cert, err := parseCert(b, c.opts.Stamp.PublicKey)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !cert.Valid(now) {
+			lastErr = fmt.Errorf("cert %d is expired or not yet valid", cert.Serial)
+			continue
+		}
+		if best == nil || cert.Serial > best.Serial || (cert.Serial == best.Serial && cert.EsVersion > best.EsVersion) {
+			best = cert
+		}
+	}
+	if best == nil {
+		if lastErr == nil {
+			lastErr = errors.New("no cert in response")
+		}
+		return nil, lastErr
+	}
+	return best, nil
+}
+
+// ExchangeContext sends query q encrypted and returns the decrypted response.
+// It falls back to tcp if the udp response is truncated.
+func (c *Client) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
+	select {
+	case <-c.closeNotify:
+		return nil, ErrClosed
+	default:
+	}
+	s := c.session.Load()
+	if s == nil || !s.cert.Valid(time.Now()) {
+		return nil, ErrNoValidCert
+	}
+	r, err := c.exchangeEncrypted(ctx, s, "udp", q)
+	if err == nil && isTruncated(*r) {
+		pool.ReleaseBuf(r)
+		r, err = c.exchangeEncrypted(ctx, s, "tcp", q)
+	}
+	return r, err
+}
+
+func (c *Client) exchangeEncrypted(ctx context.Context, s *session, network string, q []byte) (*[]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:halfNonceSize]); err != nil {
+		return nil, err
+	}
+	minSize := 0
+	if network == "udp" {
+		minSize = minUDPQuerySize
+	}
+	b := make([]byte, 0, 8+32+halfNonceSize+tagSize+len(q)+64+minSize)
+	b = append(b, s.cert.ClientMagic[:]...)
+	b = append(b, s.publicKey[:]...)
+	b = append(b, nonce[:halfNonceSize]...)
+	b = seal(s.cert.EsVersion, b, pad(q, minSize), &nonce, &s.sharedKey)
+
+	return c.exchangeRaw(ctx, network, b, func(r []byte) (*[]byte, error) {
+		return s.decrypt(r, &nonce)
+	})
+}
+
+// decrypt decrypts response r of the query with nonce.
+func (s *session) decrypt(r []byte, queryNonce *[nonceSize]byte) (*[]byte, error) {
+	if len(r) < len(resolverMagic)+nonceSize+tagSize || !bytes.Equal(r[:len(resolverMagic)], resolverMagic) {
+		return nil, errors.New("invalid response")
+	}
+	r = r[len(resolverMagic):]
+	if !bytes.Equal(r[:halfNonceSize], queryNonce[:halfNonceSize]) {
+		return nil, errors.New("response nonce mismatch")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], r[:nonceSize])
+	m, err := open(s.cert.EsVersion, nil, r[nonceSize:], &nonce, &s.sharedKey)
+	if err != nil {
+		return nil, err
+	}
+	m, err = unpad(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(m) < 12 {
+		return nil, errors.New("response is too short")
+	}
+	out := pool.GetBuf(len(m))
+	copy(*out, m)
+	return out, nil
+}
+
+// exchangeRaw sends b and returns the first response that is accepted by
+// check. On udp, datagrams that are not accepted (e.g. spoofed ones, or
+// late responses of previous queries on a reused socket) are ignored
+// until ctx is done. On tcp, the length header is added and removed, and
+// a response that is not accepted is an error.
+func (c *Client) exchangeRaw(ctx context.Context, network string, b []byte, check func(r []byte) (*[]byte, error)) (*[]byte, error) {
+	var conn net.Conn
+	if network == "udp" {
+		conn = c.getUDPConn()
+	}
+	if conn == nil {
+		var err error
+		conn, err = c.opts.DialContext(ctx, network, c.opts.Stamp.Addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+
+	r, err := exchangeConn(conn, network, b, check)
+	// The deadline may be set if ctx was done.
+	if stop() && err == nil && network == "udp" {
+		c.putUDPConn(conn)
+	} else {
+		conn.Close()
+	}
+	return r, err
+}
+
+func exchangeConn(conn net.Conn, network string, b []byte, check func(r []byte) (*[]byte, error)) (*[]byte, error) {
+	if network == "tcp" {
+		if _, err := dnsutils.WriteRawMsgToTCP(conn, b); err != nil {
+			return nil, err
+		}
+		rb, err := dnsutils.ReadRawMsgFromTCP(conn)
+		if err != nil {
+			return nil, err
+		}
+		defer pool.ReleaseBuf(rb)
+		return check(*rb)
+	}
+
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+	rb := pool.GetBuf(maxUDPRespSize)
+	defer pool.ReleaseBuf(rb)
+	var lastErr error
+	for {
+		n, err := conn.Read(*rb)
+		if err != nil {
+			if lastErr != nil {
+				return nil, fmt.Errorf("%w, last invalid response: %v", err, lastErr)
+			}
+			return nil, err
+		}
+		r, err := check((*rb)[:n])
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return r, nil
+	}
+}
+
+// getUDPConn returns an idle udp socket, or nil if there is none.
+func (c *Client) getUDPConn() net.Conn {
+	c.udpMu.Lock()
+	defer c.udpMu.Unlock()
+	if n := len(c.udpConns); n > 0 {
+		conn := c.udpConns[n-1]
+		c.udpConns = c.udpConns[:n-1]
+		return conn
+	}
+	return nil
+}
+
+// putUDPConn keeps conn for later queries.
+func (c *Client) putUDPConn(conn net.Conn) {
+	c.udpMu.Lock()
+	defer c.udpMu.Unlock()
+	if c.closed || len(c.udpConns) >= maxIdleUDPConns {
+		conn.Close()
+		return
+	}
+	c.udpConns = append(c.udpConns, conn)
+}
+
+func isTruncated(m []byte) bool {
+	return len(m) >= 3 && m[2]&0x02 != 0
+}
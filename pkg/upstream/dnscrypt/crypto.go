@@ -0,0 +1,172 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// esVersion is the encryption system of a certificate.
+type esVersion uint16
+
+const (
+	esXSalsa20Poly1305  esVersion = 1
+	esXChacha20Poly1305 esVersion = 2
+)
+
+const (
+	nonceSize     = 24
+	halfNonceSize = nonceSize / 2
+	tagSize       = poly1305.TagSize
+)
+
+var errDecrypt = errors.New("failed to decrypt")
+
+// sharedKey computes the key between sk and the peer's pk.
+func sharedKey(es esVersion, sk, pk *[32]byte) ([32]byte, error) {
+	var k [32]byte
+	switch es {
+	case esXSalsa20Poly1305:
+		box.Precompute(&k, pk, sk)
+		return k, nil
+	case esXChacha20Poly1305:
+		s, err := curve25519.X25519(sk[:], pk[:])
+		if err != nil {
+			return k, err
+		}
+		if subtle.ConstantTimeCompare(s, make([]byte, 32)) == 1 {
+			return k, errors.New("weak public key")
+		}
+		var zeroNonce [16]byte
+		h, err := chacha20.HChaCha20(s, zeroNonce[:])
+		if err != nil {
+			return k, err
+		}
+		copy(k[:], h)
+		return k, nil
+	default:
+		return k, errors.New("unsupported es version")
+	}
+}
+
+// seal encrypts msg and appends the result (tag first) to out.
+func seal(es esVersion, out, msg []byte, nonce *[nonceSize]byte, key *[32]byte) []byte {
+	if es == esXSalsa20Poly1305 {
+		return secretbox.Seal(out, msg, nonce, key)
+	}
+	return xSeal(out, msg, nonce, key)
+}
+
+// open decrypts box and appends the result to out.
+func open(es esVersion, out, box []byte, nonce *[nonceSize]byte, key *[32]byte) ([]byte, error) {
+	var ok bool
+	if es == esXSalsa20Poly1305 {
+		out, ok = secretbox.Open(out, box, nonce, key)
+	} else {
+		out, ok = xOpen(out, box, nonce, key)
+	}
+	if !ok {
+		return nil, errDecrypt
+	}
+	return out, nil
+}
+
+// xSeal is secretbox.Seal with XChaCha20 instead of XSalsa20, as the
+// XChaCha20-Poly1305 construction of DNSCrypt.
+func xSeal(out, msg []byte, nonce *[nonceSize]byte, key *[32]byte) []byte {
+	c, polyKey, firstBlock := xCipher(nonce, key)
+	ret := append(out, make([]byte, tagSize+len(msg))...)
+	tagOut, ct := ret[len(out):len(out)+tagSize], ret[len(out)+tagSize:]
+	n := min(len(msg), 32)
+	for i := 0; i < n; i++ {
+		ct[i] = firstBlock[32+i] ^ msg[i]
+	}
+	c.XORKeyStream(ct[n:], msg[n:])
+	tag := new([tagSize]byte)
+	poly1305.Sum(tag, ct, polyKey)
+	copy(tagOut, tag[:])
+	return ret
+}
+
+func xOpen(out, box []byte, nonce *[nonceSize]byte, key *[32]byte) ([]byte, bool) {
+	if len(box) < tagSize {
+		return nil, false
+	}
+	c, polyKey, firstBlock := xCipher(nonce, key)
+	var tag [tagSize]byte
+	copy(tag[:], box[:tagSize])
+	ct := box[tagSize:]
+	if !poly1305.Verify(&tag, ct, polyKey) {
+		return nil, false
+	}
+	ret := append(out, make([]byte, len(ct))...)
+	msg := ret[len(out):]
+	n := min(len(ct), 32)
+	for i := 0; i < n; i++ {
+		msg[i] = firstBlock[32+i] ^ ct[i]
+	}
+	c.XORKeyStream(msg[n:], ct[n:])
+	return ret, true
+}
+
+// xCipher returns a XChaCha20 cipher at block 1, the poly1305 key and
+// the key stream of block 0.
+func xCipher(nonce *[nonceSize]byte, key *[32]byte) (*chacha20.Cipher, *[32]byte, *[64]byte) {
+	c, err := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	if err != nil {
+		panic(err) // impossible, sizes are fixed
+	}
+	firstBlock := new([64]byte)
+	c.XORKeyStream(firstBlock[:], firstBlock[:])
+	polyKey := new([32]byte)
+	copy(polyKey[:], firstBlock[:32])
+	return c, polyKey, firstBlock
+}
+
+// pad pads msg as ISO/IEC 7816-4 to a multiple of 64 bytes, and at least
+// minSize bytes.
+func pad(msg []byte, minSize int) []byte {
+	l := max(minSize, (len(msg)+1+63)/64*64)
+	b := make([]byte, l)
+	copy(b, msg)
+	b[len(msg)] = 0x80
+	return b
+}
+
+func unpad(b []byte) ([]byte, error) {
+	for i := len(b) - 1; i >= 0; i-- {
+		switch b[i] {
+		case 0x00:
+			continue
+		case 0x80:
+			return b[:i], nil
+		default:
+			return nil, errors.New("invalid padding")
+		}
+	}
+	return nil, errors.New("invalid padding")
+}
@@ -0,0 +1,371 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestStamp(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(rand.Reader)
+	st := &Stamp{Props: 1, Addr: "127.0.0.1:5443", PublicKey: pk, ProviderName: "2.dnscrypt-cert.example.com"}
+	got, err := ParseStamp(st.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Props != st.Props || got.Addr != st.Addr || !got.PublicKey.Equal(st.PublicKey) || got.ProviderName != st.ProviderName {
+		t.Fatalf("stamp mismatch, want %+v, got %+v", st, got)
+	}
+
+	// Default port
+	st.Addr = "127.0.0.1"
+	got, err = ParseStamp(st.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Addr != "127.0.0.1:443" {
+		t.Fatalf("want default port, got %s", got.Addr)
+	}
+
+	for _, s := range []string{"", "sdns://", "sdns://AgcAAAAAAAAA", "https://example.com"} {
+		if _, err := ParseStamp(s); err == nil {
+			t.Fatalf("%q should be invalid", s)
+		}
+	}
+}
+
+func Test_unescapeTxt(t *testing.T) {
+	b, err := unescapeTxt(`a\\\"\000\255b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{'a', '\\', '"', 0, 255, 'b'}; !bytes.Equal(b, want) {
+		t.Fatalf("want %v, got %v", want, b)
+	}
+}
+
+// testServer is a minimal DNSCrypt resolver on udp.
+type testServer struct {
+	c           net.PacketConn
+	providerSK  ed25519.PrivateKey
+	resolverSK  [32]byte
+	clientMagic [8]byte
+	es          esVersion
+	notAfter    time.Time
+
+	// noise sends invalid datagrams before each encrypted response.
+	noise atomic.Bool
+
+	mu      sync.Mutex
+	clients map[string]struct{} // addrs of encrypted queries
+}
+
+func newTestServer(t *testing.T, es esVersion, notAfter time.Time) (*testServer, *Stamp) {
+	t.Helper()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	pk, sk, _ := ed25519.GenerateKey(rand.Reader)
+	s := &testServer{c: c, providerSK: sk, es: es, notAfter: notAfter}
+	rand.Read(s.resolverSK[:])
+	rand.Read(s.clientMagic[:])
+	go s.serve()
+	return s, &Stamp{Addr: c.LocalAddr().String(), PublicKey: pk, ProviderName: "2.dnscrypt-cert.test"}
+}
+
+func (s *testServer) cert() []byte {
+	resolverPK, _ := curve25519.X25519(s.resolverSK[:], curve25519.Basepoint)
+	signed := append([]byte{}, resolverPK...)
+	signed = append(signed, s.clientMagic[:]...)
+	signed = binary.BigEndian.AppendUint32(signed, 1)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(time.Now().Add(-time.Hour).Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(s.notAfter.Unix()))
+	b := append([]byte{}, certMagic...)
+	b = binary.BigEndian.AppendUint16(b, uint16(s.es))
+	b = append(b, 0, 0)
+	b = append(b, ed25519.Sign(s.providerSK, signed)...)
+	return append(b, signed...)
+}
+
+func (s *testServer) serve() {
+	b := make([]byte, 4096)
+	for {
+		n, addr, err := s.c.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		var resp []byte
+		if n > 8 && bytes.Equal(b[:8], s.clientMagic[:]) {
+			s.mu.Lock()
+			if s.clients == nil {
+				s.clients = make(map[string]struct{})
+			}
+			s.clients[addr.String()] = struct{}{}
+			s.mu.Unlock()
+			resp, err = s.handleEncrypted(b[:n])
+			if err == nil && s.noise.Load() {
+				s.c.WriteTo([]byte("garbage"), addr)
+				// A response with a valid format but a wrong nonce.
+				bad := append([]byte{}, resp...)
+				bad[len(resolverMagic)] ^= 0xff
+				s.c.WriteTo(bad, addr)
+				// A response that fails authentication.
+				bad = append([]byte{}, resp...)
+				bad[len(bad)-1] ^= 0xff
+				s.c.WriteTo(bad, addr)
+			}
+		} else {
+			resp, err = s.handleCertQuery(b[:n])
+		}
+		if err == nil {
+			s.c.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *testServer) handleCertQuery(b []byte) ([]byte, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	// Split the cert like real servers do, the client must join them.
+	cert := string(s.cert())
+	r.Answer = append(r.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{escapeTxt(cert[:60]), escapeTxt(cert[60:])},
+	})
+	return r.Pack()
+}
+
+func escapeTxt(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' || c == '"':
+			b = append(b, '\\', c)
+		case c < ' ' || c > '~':
+			b = append(b, '\\', '0'+c/100, '0'+c/10%10, '0'+c%10)
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+func (s *testServer) handleEncrypted(b []byte) ([]byte, error) {
+	var clientPK [32]byte
+	copy(clientPK[:], b[8:40])
+	var nonce [nonceSize]byte
+	copy(nonce[:], b[40:40+halfNonceSize])
+	key, err := sharedKey(s.es, &s.resolverSK, &clientPK)
+	if err != nil {
+		return nil, err
+	}
+	m, err := open(s.es, nil, b[40+halfNonceSize:], &nonce, &key)
+	if err != nil {
+		return nil, err
+	}
+	if m, err = unpad(m); err != nil {
+		return nil, err
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(1, 2, 3, 4),
+	})
+	rb, err := r.Pack()
+	if err != nil {
+		return nil, err
+	}
+	rand.Read(nonce[halfNonceSize:])
+	out := append([]byte{}, resolverMagic...)
+	out = append(out, nonce[:]...)
+	return seal(s.es, out, pad(rb, 0), &nonce, &key), nil
+}
+
+func TestClient(t *testing.T) {
+	for _, es := range []esVersion{esXSalsa20Poly1305, esXChacha20Poly1305} {
+		_, st := newTestServer(t, es, time.Now().Add(time.Hour))
+		c := NewClient(ClientOpts{Stamp: st})
+		defer c.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := c.refresh(ctx); err != nil {
+			t.Fatalf("es %d: failed to fetch cert, %v", es, err)
+		}
+		if !c.Available() {
+			t.Fatalf("es %d: client should be available", es)
+		}
+
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qb, _ := q.Pack()
+		rb, err := c.ExchangeContext(ctx, qb)
+		if err != nil {
+			t.Fatalf("es %d: %v", es, err)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(*rb); err != nil {
+			t.Fatal(err)
+		}
+		pool.ReleaseBuf(rb)
+		if r.Id != q.Id || len(r.Answer) != 1 {
+			t.Fatalf("es %d: unexpected response %s", es, r)
+		}
+	}
+}
+
+func TestClient_InvalidDatagramsAndReuse(t *testing.T) {
+	s, st := newTestServer(t, esXChacha20Poly1305, time.Now().Add(time.Hour))
+	s.noise.Store(true)
+	c := NewClient(ClientOpts{Stamp: st})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := c.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qb, _ := q.Pack()
+		rb, err := c.ExchangeContext(ctx, qb)
+		if err != nil {
+			t.Fatalf("query #%d: %v", i, err)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(*rb); err != nil || r.Id != q.Id {
+			t.Fatalf("query #%d: unexpected response %v, %v", i, r, err)
+		}
+		pool.ReleaseBuf(rb)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.clients) != 1 {
+		t.Fatalf("udp socket is not reused, queries came from %d addrs", len(s.clients))
+	}
+}
+
+// Test vectors are generated by libsodium's crypto_box_*_beforenm and
+// crypto_box_*_easy_afternm.
+func Test_crypto_knownAnswer(t *testing.T) {
+	var clientSK, resolverSK [32]byte
+	for i := range clientSK {
+		clientSK[i] = byte(1 + i)
+		resolverSK[i] = byte(101 + i)
+	}
+	var resolverPK [32]byte
+	pk, _ := curve25519.X25519(resolverSK[:], curve25519.Basepoint)
+	copy(resolverPK[:], pk)
+	if got := hex.EncodeToString(pk); got != "5714769d116bf76436ae74bc793d2c30ad1903c59ac5273805c7e2698b410c36" {
+		t.Fatalf("unexpected resolver pk %s", got)
+	}
+	var nonce [nonceSize]byte
+	for i := range nonce {
+		nonce[i] = byte(200 + i)
+	}
+	msg := make([]byte, 200) // crosses chacha20 block boundaries
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		es  esVersion
+		key string
+		box string
+	}{
+		{
+			es:  esXSalsa20Poly1305,
+			key: "72da8bbbf5a0760cea2a1d1f2c5f19d54f292f8e7a1dd292b7a86a567ceabc69",
+			box: "fc3c613013ac03631604d8f9cf3aa40ac6bd3c40f29a31e30b86646eb7551f7a028bd92f2ba14c5cc60a0d7009aa61e9c82521091834fec086afb61ead425e1c17a253013da2df96311ba39b15ea578279dccb18849398d2f21736c4a6a43b1ac81e8a1d0e6c0686febfee69d48ec47d513d32f41e04e9510189cdfd3f8a89e0a939376513da314b880785c4f3c4f89840df8d7950a6f49e1330d0916bf899aaf23f6ca50627e348d0985ef06ea1491a0181c791e89f4452341107391e07b1b14959d4d8b8a869870336728ab33569317d69591131f99c9d",
+		},
+		{
+			es:  esXChacha20Poly1305,
+			key: "9a4117e68709c989276b31ae77887e707625253a3b97b002b4836ab3b7311864",
+			box: "5e9305ddeda67d68f9f7846a89bd4aef822a0fcd8292ca1deb06d43cb92ed44f310e8a4661efd059dcba725ba08437175e5adb401e6caf08a8b3143ec356106799e4a0a705d3f4c9021a411dd81b1800e006eda5a1b88889ab933a207cf9af7bbf54b03b9e9240c871824c27aad980e015f61e385fb9a33ed3ac2ce1d613b8c78364e91546cacc699d3381ff4dc2f72f69008bdac83872120bbedcbab10cbc13c7b70484fc4924a6a2d5a2b19525d9ed754bbca6b9dc95ba58d9f96a860e51d4fd620fceae4e2141fad94bc2cb94a80992c2d2f865fe757c",
+		},
+	}
+	for _, tt := range tests {
+		key, err := sharedKey(tt.es, &clientSK, &resolverPK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(key[:]); got != tt.key {
+			t.Fatalf("es %d: unexpected shared key %s", tt.es, got)
+		}
+		box := seal(tt.es, nil, msg, &nonce, &key)
+		if got := hex.EncodeToString(box); got != tt.box {
+			t.Fatalf("es %d: unexpected box %s", tt.es, got)
+		}
+		m, err := open(tt.es, nil, box, &nonce, &key)
+		if err != nil || !bytes.Equal(m, msg) {
+			t.Fatalf("es %d: failed to open box, %v", tt.es, err)
+		}
+		box[len(box)-1] ^= 1
+		if _, err := open(tt.es, nil, box, &nonce, &key); err == nil {
+			t.Fatalf("es %d: modified box is opened", tt.es)
+		}
+	}
+}
+
+func TestClient_ExpiredCert(t *testing.T) {
+	_, st := newTestServer(t, esXChacha20Poly1305, time.Now().Add(-time.Minute))
+	c := NewClient(ClientOpts{Stamp: st})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := c.refresh(ctx); err == nil {
+		t.Fatal("expired cert should be rejected")
+	}
+	if c.Available() {
+		t.Fatal("client should not be available")
+	}
+	if _, err := c.ExchangeContext(ctx, make([]byte, 12)); !errors.Is(err, ErrNoValidCert) {
+		t.Fatalf("want ErrNoValidCert, got %v", err)
+	}
+}
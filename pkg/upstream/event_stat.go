@@ -22,6 +22,8 @@ package upstream
 import (
 	"net"
 	"sync/atomic"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
 )
 
 type Event int
@@ -29,6 +31,18 @@ type Event int
 const (
 	EventConnOpen Event = iota
 	EventConnClose
+
+	// A response was dropped because no ongoing query has its id.
+	EventRespIdMismatch
+	// A response was dropped because its question doesn't match the
+	// query with the same id.
+	EventRespQuestionMismatch
+	// A suspicious udp response was dropped and the query was retried
+	// over tcp. See Opt.TCPRetry.
+	EventTCPRetry
+	// The EDNS0 buffer size of an udp upstream was lowered, or the
+	// upstream was switched to tcp. See Opt.AutoDowngrade.
+	EventUDPDowngrade
 )
 
 type EventObserver interface {
@@ -39,6 +53,22 @@ type nopEO struct{}
 
 func (n nopEO) OnEvent(_ Event) {}
 
+// mismatchObserver returns a transport.TraditionalDnsConnOpts.OnMismatch
+// that sends mismatches to ob. It returns nil if ob is nopEO.
+func mismatchObserver(ob EventObserver) func(kind transport.MismatchKind) {
+	if _, ok := ob.(nopEO); ok {
+		return nil
+	}
+	return func(kind transport.MismatchKind) {
+		switch kind {
+		case transport.MismatchId:
+			ob.OnEvent(EventRespIdMismatch)
+		case transport.MismatchQuestion:
+			ob.OnEvent(EventRespQuestionMismatch)
+		}
+	}
+}
+
 type connWrapper struct {
 	net.Conn
 	closed atomic.Bool
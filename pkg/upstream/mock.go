@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+const mockScheme = "mock://"
+
+// mockUpstream serves canned responses from a zone file, for tests.
+// Queries are answered by records with the same name and type, or
+// a CNAME record of the name. If the name exists but has no such
+// records, the response is empty with NOERROR. Otherwise, NXDOMAIN.
+type mockUpstream struct {
+	rrs   map[dns.Question][]dns.RR
+	names map[string]struct{}
+}
+
+var _ Upstream = (*mockUpstream)(nil)
+
+func newMockUpstream(file string) (*mockUpstream, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	u := &mockUpstream{
+		rrs:   make(map[dns.Question][]dns.RR),
+		names: make(map[string]struct{}),
+	}
+	parser := dns.NewZoneParser(f, "", file)
+	parser.SetDefaultTTL(300)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		q := dns.Question{Name: name, Qtype: h.Rrtype, Qclass: h.Class}
+		u.rrs[q] = append(u.rrs[q], rr)
+		u.names[name] = struct{}{}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file, %w", err)
+	}
+	return u, nil
+}
+
+func (u *mockUpstream) reply(q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	if len(q.Question) != 1 {
+		r.Rcode = dns.RcodeFormatError
+		return r
+	}
+	question := q.Question[0]
+	question.Name = strings.ToLower(question.Name)
+
+	if rrs := u.rrs[question]; len(rrs) > 0 {
+		r.Answer = append(r.Answer, rrs...)
+		return r
+	}
+	cnameQ := dns.Question{Name: question.Name, Qtype: dns.TypeCNAME, Qclass: question.Qclass}
+	if rrs := u.rrs[cnameQ]; len(rrs) > 0 {
+		r.Answer = append(r.Answer, rrs...)
+		if cname, ok := rrs[0].(*dns.CNAME); ok {
+			target := dns.Question{Name: strings.ToLower(cname.Target), Qtype: question.Qtype, Qclass: question.Qclass}
+			r.Answer = append(r.Answer, u.rrs[target]...)
+		}
+		return r
+	}
+	if _, ok := u.names[question.Name]; !ok {
+		r.Rcode = dns.RcodeNameError
+	}
+	return r
+}
+
+func (u *mockUpstream) ExchangeContext(_ context.Context, m []byte) (*[]byte, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, fmt.Errorf("invalid query, %w", err)
+	}
+	return pool.PackBuffer(u.reply(q))
+}
+
+func (u *mockUpstream) Close() error {
+	return nil
+}
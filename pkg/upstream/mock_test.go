@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_mockUpstream(t *testing.T) {
+	zone := `
+example.com.     IN A     192.0.2.1
+example.com.     IN A     192.0.2.2
+www.example.com. IN CNAME example.com.
+txt.example.com. IN TXT   "hello"
+`
+	f := filepath.Join(t.TempDir(), "mock.zone")
+	if err := os.WriteFile(f, []byte(zone), 0644); err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewUpstream("mock://"+f, Opt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		wantRcode int
+		wantAns   int
+	}{
+		{"example.com.", dns.TypeA, dns.RcodeSuccess, 2},
+		{"EXAMPLE.com.", dns.TypeA, dns.RcodeSuccess, 2},
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, 3},
+		{"txt.example.com.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"nx.example.com.", dns.TypeA, dns.RcodeNameError, 0},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, tt.qtype)
+		b, _ := q.Pack()
+		rb, err := u.ExchangeContext(context.Background(), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(*rb); err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != tt.wantRcode || len(r.Answer) != tt.wantAns {
+			t.Errorf("%s: got rcode %d with %d answers, want %d with %d", tt.name, r.Rcode, len(r.Answer), tt.wantRcode, tt.wantAns)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+// funcUpstream answers queries with f.
+type funcUpstream struct {
+	f     func(q *dns.Msg) *dns.Msg
+	calls int
+}
+
+func (u *funcUpstream) ExchangeContext(_ context.Context, m []byte) (*[]byte, error) {
+	u.calls++
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, err
+	}
+	r := u.f(q)
+	b, err := r.Pack()
+	if err != nil {
+		// Malformed test responses.
+		b = []byte{byte(q.Id >> 8), byte(q.Id), 0x81, 0x80, 0, 1}
+	}
+	buf := pool.GetBuf(len(b))
+	copy(*buf, b)
+	return buf, nil
+}
+
+func (u *funcUpstream) Close() error { return nil }
+
+type countingEO struct{ n map[Event]int }
+
+func (c *countingEO) OnEvent(typ Event) { c.n[typ]++ }
+
+func Test_udpWithFallback_TCPRetry(t *testing.T) {
+	reply := func(edns bool, tc bool, name string) func(q *dns.Msg) *dns.Msg {
+		return func(q *dns.Msg) *dns.Msg {
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Truncated = tc
+			if name != "" {
+				r.Question[0].Name = name
+			}
+			if edns {
+				r.SetEdns0(1232, false)
+			}
+			return r
+		}
+	}
+	malformed := func(q *dns.Msg) *dns.Msg {
+		return &dns.Msg{MsgHdr: dns.MsgHdr{Id: q.Id}, Question: q.Question, Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "\x00bad"}}}}
+	}
+
+	tests := []struct {
+		name      string
+		tcpRetry  bool
+		edns      bool
+		udp       func(q *dns.Msg) *dns.Msg
+		wantTCP   bool
+		wantEvent bool
+	}{
+		{"normal", true, true, reply(true, false, ""), false, false},
+		{"truncated", false, true, reply(true, true, ""), true, false},
+		{"missing opt without retry", false, true, reply(false, false, ""), false, false},
+		{"missing opt", true, true, reply(false, false, ""), true, true},
+		{"query without opt", true, false, reply(false, false, ""), false, false},
+		{"question mismatch", true, false, reply(false, false, "other.com."), true, true},
+		{"question case", true, false, reply(false, false, "EXAMPLE.com."), false, false},
+		{"malformed", true, false, malformed, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			udp := &funcUpstream{f: tt.udp}
+			tcp := &funcUpstream{f: reply(true, false, "")}
+			eo := &countingEO{n: make(map[Event]int)}
+			u := &udpWithFallback{u: udp, t: tcp, tcpRetry: tt.tcpRetry, ob: eo}
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			if tt.edns {
+				q.SetEdns0(1232, false)
+			}
+			b, err := q.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := u.ExchangeContext(context.Background(), b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool.ReleaseBuf(r)
+			if (tcp.calls > 0) != tt.wantTCP {
+				t.Errorf("want tcp %v, got %d tcp calls", tt.wantTCP, tcp.calls)
+			}
+			if (eo.n[EventTCPRetry] > 0) != tt.wantEvent {
+				t.Errorf("want event %v, got %v", tt.wantEvent, eo.n)
+			}
+		})
+	}
+}
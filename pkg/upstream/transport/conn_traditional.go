@@ -24,6 +24,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -51,6 +52,7 @@ type TraditionalDnsConn struct {
 	closeNotify chan struct{}
 	closed      atomic.Bool // atomic, for fast check
 	closeErr    error       // closeErr is ready (not nil) when closeNotify is closed.
+	onMismatch  func(kind MismatchKind)
 
 	queueMu       sync.RWMutex
 	reservedQuery int
@@ -75,14 +77,30 @@ type TraditionalDnsConnOpts struct {
 	// MaxConcurrentQuery limits the number of maximum concurrent queries
 	// in the connection. Default is defaultTdcMaxConcurrentQuery.
 	MaxConcurrentQuery int
+
+	// OnMismatch, if not nil, is called when a response is dropped because
+	// no ongoing query has its id, or its question doesn't match the query
+	// with the same id. On udp, they may indicate spoofing attempts. Note that
+	// late responses of timed out queries are id mismatches as well.
+	OnMismatch func(kind MismatchKind)
 }
 
+type MismatchKind uint8
+
+const (
+	MismatchId MismatchKind = iota
+	MismatchQuestion
+)
+
 func NewDnsConn(opt TraditionalDnsConnOpts, conn NetConn) *TraditionalDnsConn {
 	dc := &TraditionalDnsConn{
 		c:           conn,
 		isTcp:       opt.WithLengthHeader,
 		closeNotify: make(chan struct{}),
 		queue:       make(map[uint32]chan *[]byte),
+		onMismatch:  opt.OnMismatch,
+		// Random initial qid makes ids harder to guess.
+		nextQid: uint16(rand.Uint32()),
 	}
 	setDefaultGZ(&dc.idleTimeout, opt.IdleTimeout, defaultIdleTimeout)
 	setDefaultGZ(&dc.maxCq, opt.MaxConcurrentQuery, defaultTdcMaxConcurrentQuery)
@@ -124,15 +142,29 @@ func (dc *TraditionalDnsConn) exchange(ctx context.Context, q []byte) (*[]byte,
 		dc.c.SetReadDeadline(time.Now().Add(waitingReplyTimeout))
 	}
 
-	select {
-	case <-ctx.Done():
-		return nil, context.Cause(ctx)
-	case r := <-respChan:
-		orgId := binary.BigEndian.Uint16(q)
-		binary.BigEndian.PutUint16(*r, orgId)
-		return r, nil
-	case <-dc.closeNotify:
-		return nil, dc.closeErr
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		case r := <-respChan:
+			if !sameQuestion(q, *r) {
+				// Not the reply of q. Drop it and keep waiting.
+				pool.ReleaseBuf(r)
+				dc.mismatch(MismatchQuestion)
+				continue
+			}
+			orgId := binary.BigEndian.Uint16(q)
+			binary.BigEndian.PutUint16(*r, orgId)
+			return r, nil
+		case <-dc.closeNotify:
+			return nil, dc.closeErr
+		}
+	}
+}
+
+func (dc *TraditionalDnsConn) mismatch(kind MismatchKind) {
+	if dc.onMismatch != nil {
+		dc.onMismatch(kind)
 	}
 }
 
@@ -183,6 +215,7 @@ func (dc *TraditionalDnsConn) readLoop() {
 			}
 		} else {
 			pool.ReleaseBuf(r)
+			dc.mismatch(MismatchId)
 		}
 	}
 }
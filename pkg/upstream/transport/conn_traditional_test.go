@@ -248,3 +248,32 @@ func Test_dnsConn_exchange_race(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func Test_sameQuestion(t *testing.T) {
+	pack := func(name string, qtype uint16) []byte {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		b, err := m.Pack()
+		require.NoError(t, err)
+		return b
+	}
+	q := pack("ExAmPle.com.", dns.TypeA)
+	require.True(t, sameQuestion(q, pack("ExAmPle.com.", dns.TypeA)))
+	require.True(t, sameQuestion(q, pack("example.com.", dns.TypeA)), "case should be ignored")
+	require.False(t, sameQuestion(q, pack("example.org.", dns.TypeA)))
+	require.False(t, sameQuestion(q, pack("example.com.", dns.TypeAAAA)))
+	require.False(t, sameQuestion(q, q[:dnsHeaderLen+3]))
+
+	noQuestion := func(rcode int) []byte {
+		m := new(dns.Msg)
+		m.Response = true
+		m.Rcode = rcode
+		b, err := m.Pack()
+		require.NoError(t, err)
+		return b
+	}
+	require.True(t, sameQuestion(q, noQuestion(dns.RcodeFormatError)), "formerr may have no question")
+	require.True(t, sameQuestion(q, noQuestion(dns.RcodeNotImplemented)), "notimp may have no question")
+	require.False(t, sameQuestion(q, noQuestion(dns.RcodeSuccess)))
+	require.False(t, sameQuestion(q, noQuestion(dns.RcodeServerFailure)))
+}
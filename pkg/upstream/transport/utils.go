@@ -20,8 +20,10 @@
 package transport
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
+	"strings"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/miekg/dns"
@@ -71,6 +73,48 @@ readAgain:
 	return payload, err
 }
 
+// sameQuestion reports whether msg r has the same question section as
+// msg q. Names are compared case-insensitively, because some servers don't
+// preserve the case of the qname. FORMERR and NOTIMP responses without a
+// question are accepted, because servers may not be able to parse the
+// question of a query they don't understand.
+func sameQuestion(q, r []byte) bool {
+	if len(q) < dnsHeaderLen || len(r) < dnsHeaderLen {
+		return false
+	}
+	qdCount := binary.BigEndian.Uint16(q[4:])
+	rQdCount := binary.BigEndian.Uint16(r[4:])
+	if rQdCount == 0 {
+		switch int(r[3] & 0x0f) {
+		case dns.RcodeFormatError, dns.RcodeNotImplemented:
+			return true
+		}
+	}
+	if qdCount != rQdCount {
+		return false
+	}
+	qOff, rOff := dnsHeaderLen, dnsHeaderLen
+	for i := uint16(0); i < qdCount; i++ {
+		qName, qEnd, err := dns.UnpackDomainName(q, qOff)
+		if err != nil {
+			return false
+		}
+		rName, rEnd, err := dns.UnpackDomainName(r, rOff)
+		if err != nil {
+			return false
+		}
+		if !strings.EqualFold(qName, rName) {
+			return false
+		}
+		// qtype and qclass
+		if qEnd+4 > len(q) || rEnd+4 > len(r) || !bytes.Equal(q[qEnd:qEnd+4], r[rEnd:rEnd+4]) {
+			return false
+		}
+		qOff, rOff = qEnd+4, rEnd+4
+	}
+	return true
+}
+
 func setDefaultGZ[T constraints.Float | constraints.Integer](i *T, s, d T) {
 	if s > 0 {
 		*i = s
@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultProbeSize is the buffer size of probes if the upstream size
+	// is not set. Most stub resolvers advertise it.
+	defaultProbeSize = 4096
+	probeTCPTimeout  = 5 * time.Second
+	// minProbeRespSize is the size that probe responses should exceed.
+	// Smaller responses are not fragmented on ethernet paths, so their
+	// probes can't detect anything.
+	minProbeRespSize = 1500
+	// recoverSuccesses is the number of consecutive probes of the
+	// original buffer size that restore a downgraded upstream.
+	recoverSuccesses = 3
+)
+
+// probeLoop sends a probe with a large response to the udp upstream
+// every interval. If the udp response is lost but the tcp one is not, the
+// udpSizer lowers the buffer size, or switches the upstream to tcp, the
+// same way as lost responses of queries. After a downgrade, probes are
+// sent with the original buffer size, and the upstream is restored once
+// they are answered over udp again.
+func (u *udpWithFallback) probeLoop(interval time.Duration, name string, qtype uint16) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	warned := false
+	for {
+		select {
+		case <-u.closeNotify:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), udpAttemptTimeout+probeTCPTimeout)
+			go func() { // Stop probing on close.
+				select {
+				case <-u.closeNotify:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			n, lost, err := u.probe(ctx, name, qtype)
+			cancel()
+			switch {
+			case err != nil:
+				u.sizer.logger.Debug("udp probe failed", zap.Error(err))
+			case lost:
+				u.sizer.logger.Debug("udp probe response is lost")
+			case n <= minProbeRespSize && !warned:
+				warned = true
+				u.sizer.logger.Warn("udp probe response is too small to detect fragmentation issues", zap.String("name", name), zap.Int("size", n), zap.Int("want", minProbeRespSize+1))
+			}
+		}
+	}
+}
+
+// probe sends one probe. n is the size of the udp response. lost reports
+// whether the udp response was lost but the tcp one was not.
+func (u *udpWithFallback) probe(ctx context.Context, name string, qtype uint16) (n int, lost bool, err error) {
+	s := u.sizer
+	downgraded := s.downgraded()
+	size := uint16(s.size.Load())
+	if downgraded {
+		size = uint16(s.orig)
+	}
+	if size == 0 {
+		size = defaultProbeSize
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.SetEdns0(size, true)
+	q, err := m.Pack()
+	if err != nil {
+		return 0, false, err
+	}
+
+	udpCtx, cancel := context.WithTimeout(ctx, udpAttemptTimeout)
+	defer cancel()
+	r, err := u.u.ExchangeContext(udpCtx, q)
+	if err == nil {
+		n = len(*r)
+		pool.ReleaseBuf(r)
+		if downgraded {
+			s.probeReceived(n)
+		} else {
+			s.received(n)
+		}
+		return n, false, nil
+	}
+	if ctx.Err() != nil || !isTimeout(err) {
+		return 0, false, err
+	}
+	if downgraded { // Still lost, the path is not recovered.
+		s.recoveries.Store(0)
+		return 0, true, nil
+	}
+	r, err = u.t.ExchangeContext(ctx, q)
+	if err != nil { // The upstream is down, not the udp path.
+		return 0, false, err
+	}
+	s.lost(q, len(*r))
+	pool.ReleaseBuf(r)
+	return 0, true, nil
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/miekg/dns"
+)
+
+// timeoutUpstream fails with a timeout if the query is larger than size.
+type timeoutUpstream struct {
+	f    func(q *dns.Msg) *dns.Msg
+	size uint16
+}
+
+func (u *timeoutUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, err
+	}
+	if opt := q.IsEdns0(); opt != nil && opt.UDPSize() > u.size {
+		return nil, context.DeadlineExceeded
+	}
+	return (&funcUpstream{f: u.f}).ExchangeContext(ctx, m)
+}
+
+func (u *timeoutUpstream) Close() error { return nil }
+
+func Test_udpWithFallback_probe(t *testing.T) {
+	large := func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		for i := 0; i < 100; i++ {
+			r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: []byte{10, 0, 0, byte(i)}})
+		}
+		return r
+	}
+
+	// The path drops fragments of responses larger than 1232 bytes.
+	udp := &timeoutUpstream{f: large, size: flagDayUDPSize}
+	tcp := &funcUpstream{f: large}
+	eo := &countingEO{n: make(map[Event]int)}
+	s := newUDPSizer(Opt{MTUProbeInterval: 1, EventObserver: eo, Logger: mlog.Nop()})
+	u := &udpWithFallback{u: udp, t: tcp, sizer: s, ob: eo}
+
+	ctx := context.Background()
+	for i := 0; i < downgradeStrikes; i++ {
+		_, lost, err := u.probe(ctx, "example.com", dns.TypeTXT)
+		if err != nil || !lost {
+			t.Fatalf("want lost probe, got %v, %v", lost, err)
+		}
+	}
+	if got := s.size.Load(); got != flagDayUDPSize {
+		t.Fatalf("want size %d, got %d", flagDayUDPSize, got)
+	}
+	if eo.n[EventUDPDowngrade] != 1 || s.useTCP() {
+		t.Fatalf("unexpected downgrade, %v", eo.n)
+	}
+
+	// Probes of the original size are still lost, the upstream is not
+	// downgraded again.
+	_, lost, err := u.probe(ctx, "example.com", dns.TypeTXT)
+	if err != nil || !lost || s.size.Load() != flagDayUDPSize || eo.n[EventUDPDowngrade] != 1 {
+		t.Fatalf("unexpected probe, %v, %v, size %d", lost, err, s.size.Load())
+	}
+
+	// The path is fixed.
+	udp.size = defaultProbeSize
+	for i := 0; i < recoverSuccesses; i++ {
+		n, lost, err := u.probe(ctx, "example.com", dns.TypeTXT)
+		if err != nil || lost || n <= flagDayUDPSize {
+			t.Fatalf("want probe response, got %d, %v, %v", n, lost, err)
+		}
+	}
+	if s.downgraded() || s.size.Load() != 0 {
+		t.Fatalf("upstream was not restored, size %d", s.size.Load())
+	}
+
+	// The upstream is down, not the udp path.
+	u = &udpWithFallback{u: &timeoutUpstream{f: large}, t: &errUpstream{}, sizer: newUDPSizer(Opt{MTUProbeInterval: 1, EventObserver: eo, Logger: mlog.Nop()}), ob: eo}
+	if _, _, err := u.probe(ctx, "example.com", dns.TypeTXT); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+func TestNewUpstream_mtuProbe(t *testing.T) {
+	if _, err := NewUpstream("udp://127.0.0.1", Opt{MTUProbeInterval: time.Minute}); err == nil {
+		t.Fatal("probes without a domain were accepted")
+	}
+	u, err := NewUpstream("udp://127.0.0.1", Opt{MTUProbeInterval: time.Minute, MTUProbeDomain: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Close()
+}
+
+type errUpstream struct{}
+
+func (errUpstream) ExchangeContext(context.Context, []byte) (*[]byte, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (errUpstream) Close() error { return nil }
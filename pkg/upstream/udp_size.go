@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	// EDNS0 buffer sizes of DNS flag day 2020. Responses of flagDayUDPSize
+	// are not fragmented on most paths, and responses of minUDPSize are
+	// never fragmented.
+	flagDayUDPSize = 1232
+	minUDPSize     = 512
+
+	// downgradeStrikes is the number of consecutive lost udp responses
+	// that downgrade an upstream.
+	downgradeStrikes = 3
+	// tcpOnlyDuration is how long an upstream uses tcp only after
+	// responses of minUDPSize are lost.
+	tcpOnlyDuration = 10 * time.Minute
+	// udpAttemptTimeout is the time to wait for an udp response before
+	// the query is retried over tcp. See Opt.AutoDowngrade.
+	udpAttemptTimeout = 2 * time.Second
+)
+
+// udpSizer sets the EDNS0 buffer size of queries to an udp upstream. If
+// auto is set, it lowers the size, or switches the upstream to tcp for a
+// while, if large udp responses are lost but the tcp ones are not, which
+// typically means the path drops fragments.
+type udpSizer struct {
+	auto   bool
+	ob     EventObserver
+	logger *zap.Logger
+
+	orig       uint32        // the configured size
+	size       atomic.Uint32 // 0 means the size of queries is not changed.
+	strikes    atomic.Uint32
+	recoveries atomic.Uint32
+	tcpUntil   atomic.Int64 // unix nano
+}
+
+func newUDPSizer(opt Opt) *udpSizer {
+	if opt.UDPSize <= 0 && !opt.AutoDowngrade && opt.MTUProbeInterval <= 0 {
+		return nil
+	}
+	s := &udpSizer{auto: opt.AutoDowngrade, ob: opt.EventObserver, logger: opt.Logger, orig: uint32(max(opt.UDPSize, 0))}
+	s.size.Store(s.orig)
+	return s
+}
+
+// downgraded reports whether the size was lowered or the upstream was
+// switched to tcp.
+func (s *udpSizer) downgraded() bool {
+	return s.size.Load() != s.orig || s.useTCP()
+}
+
+// probeReceived is called when an udp response of size n to a probe of
+// the original size is received after a downgrade. The upstream is
+// restored after recoverSuccesses consecutive large responses.
+func (s *udpSizer) probeReceived(n int) {
+	if n <= flagDayUDPSize {
+		s.recoveries.Store(0)
+		return
+	}
+	if s.recoveries.Add(1) < recoverSuccesses {
+		return
+	}
+	s.recoveries.Store(0)
+	s.strikes.Store(0)
+	s.size.Store(s.orig)
+	s.tcpUntil.Store(0)
+	s.logger.Info("large udp responses are received again, restoring the edns0 buffer size", zap.Uint32("size", s.orig))
+}
+
+// useTCP reports whether the upstream was switched to tcp.
+func (s *udpSizer) useTCP() bool {
+	return time.Now().UnixNano() < s.tcpUntil.Load()
+}
+
+// setSize returns a copy of q with the buffer size. It returns false if
+// the size is not set, or q has no OPT.
+func (s *udpSizer) setSize(q []byte) (*[]byte, bool) {
+	size := s.size.Load()
+	off := optSizeOffset(q)
+	if size == 0 || off < 0 {
+		return nil, false
+	}
+	b := pool.GetBuf(len(q))
+	copy(*b, q)
+	binary.BigEndian.PutUint16((*b)[off:], uint16(size))
+	return b, true
+}
+
+// received is called when an udp response of size n is received.
+func (s *udpSizer) received(n int) {
+	if n > minUDPSize {
+		s.strikes.Store(0)
+	}
+}
+
+// lost is called when the udp response of query q was lost, but the tcp
+// response of size n was not.
+func (s *udpSizer) lost(q []byte, n int) {
+	if n <= minUDPSize { // Not fragmented.
+		return
+	}
+	if s.strikes.Add(1) < downgradeStrikes {
+		return
+	}
+	s.strikes.Store(0)
+
+	cur := uint32(minUDPSize) // Queries without OPT.
+	if off := optSizeOffset(q); off >= 0 {
+		cur = uint32(binary.BigEndian.Uint16(q[off:]))
+	}
+	switch {
+	case cur > flagDayUDPSize:
+		s.size.Store(flagDayUDPSize)
+		s.logger.Warn("large udp responses are lost, lowering the edns0 buffer size", zap.Uint32("from", cur), zap.Uint32("to", flagDayUDPSize))
+	case cur > minUDPSize:
+		s.size.Store(minUDPSize)
+		s.logger.Warn("large udp responses are lost, lowering the edns0 buffer size", zap.Uint32("from", cur), zap.Uint32("to", minUDPSize))
+	default:
+		s.tcpUntil.Store(time.Now().Add(tcpOnlyDuration).UnixNano())
+		s.logger.Warn("udp responses are lost, switching to tcp", zap.Duration("duration", tcpOnlyDuration))
+	}
+	s.ob.OnEvent(EventUDPDowngrade)
+}
+
+// optSizeOffset returns the offset of the class (the udp buffer size) of
+// the OPT record in msg m. It returns -1 if m has no OPT or is malformed.
+func optSizeOffset(m []byte) int {
+	if len(m) < 12 {
+		return -1
+	}
+	qd := int(binary.BigEndian.Uint16(m[4:]))
+	an := int(binary.BigEndian.Uint16(m[6:]))
+	ns := int(binary.BigEndian.Uint16(m[8:]))
+	ar := int(binary.BigEndian.Uint16(m[10:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		off = skipName(m, off)
+		if off < 0 || off+4 > len(m) {
+			return -1
+		}
+		off += 4 // type and class
+	}
+	for i := 0; i < an+ns+ar; i++ {
+		off = skipName(m, off)
+		if off < 0 || off+10 > len(m) {
+			return -1
+		}
+		if i >= an+ns && binary.BigEndian.Uint16(m[off:]) == dns.TypeOPT {
+			return off + 2
+		}
+		off += 10 + int(binary.BigEndian.Uint16(m[off+8:])) // type, class, ttl, rdlength and rdata
+	}
+	return -1
+}
+
+// skipName returns the offset after the domain name at off, or -1 if
+// the name is malformed.
+func skipName(m []byte, off int) int {
+	for off < len(m) {
+		l := int(m[off])
+		switch {
+		case l == 0:
+			return off + 1
+		case l&0xc0 == 0xc0: // pointer
+			if off+2 > len(m) {
+				return -1
+			}
+			return off + 2
+		case l&0xc0 != 0:
+			return -1
+		}
+		off += 1 + l
+	}
+	return -1
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+func packQuery(t *testing.T, size uint16) []byte {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if size > 0 {
+		q.SetEdns0(size, false)
+	}
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func Test_optSizeOffset(t *testing.T) {
+	b := packQuery(t, 4096)
+	off := optSizeOffset(b)
+	if off < 0 || binary.BigEndian.Uint16(b[off:]) != 4096 {
+		t.Fatalf("invalid offset %d", off)
+	}
+	if off := optSizeOffset(packQuery(t, 0)); off != -1 {
+		t.Fatalf("want -1 for query without opt, got %d", off)
+	}
+	if off := optSizeOffset(b[:len(b)-5]); off != -1 {
+		t.Fatalf("want -1 for truncated msg, got %d", off)
+	}
+
+	s := newUDPSizer(Opt{UDPSize: 1232})
+	nb, ok := s.setSize(b)
+	if !ok {
+		t.Fatal("size is not set")
+	}
+	defer pool.ReleaseBuf(nb)
+	m := new(dns.Msg)
+	if err := m.Unpack(*nb); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.IsEdns0().UDPSize(); got != 1232 {
+		t.Fatalf("want size 1232, got %d", got)
+	}
+	if binary.BigEndian.Uint16(b[off:]) != 4096 {
+		t.Fatal("original query was modified")
+	}
+	if _, ok := s.setSize(packQuery(t, 0)); ok {
+		t.Fatal("query without opt should not be changed")
+	}
+}
+
+func Test_udpSizer_lost(t *testing.T) {
+	eo := &countingEO{n: make(map[Event]int)}
+	s := newUDPSizer(Opt{AutoDowngrade: true, EventObserver: eo, Logger: mlog.Nop()})
+
+	lose := func(q []byte, n int) {
+		for i := 0; i < downgradeStrikes; i++ {
+			s.lost(q, n)
+		}
+	}
+
+	// Small responses are never fragmented.
+	lose(packQuery(t, 4096), 300)
+	if eo.n[EventUDPDowngrade] != 0 {
+		t.Fatal("unexpected downgrade")
+	}
+
+	// Successful large responses reset strikes.
+	s.lost(packQuery(t, 4096), 2000)
+	s.lost(packQuery(t, 4096), 2000)
+	s.received(1000)
+	s.lost(packQuery(t, 4096), 2000)
+	if eo.n[EventUDPDowngrade] != 0 {
+		t.Fatal("unexpected downgrade")
+	}
+
+	steps := []uint16{4096, flagDayUDPSize, minUDPSize}
+	for i, size := range steps {
+		lose(packQuery(t, size), 2000)
+		if eo.n[EventUDPDowngrade] != i+1 {
+			t.Fatalf("step %d: want %d events, got %d", i, i+1, eo.n[EventUDPDowngrade])
+		}
+		if i < len(steps)-1 {
+			if got := s.size.Load(); got != uint32(steps[i+1]) {
+				t.Fatalf("step %d: want size %d, got %d", i, steps[i+1], got)
+			}
+		}
+	}
+	if !s.useTCP() {
+		t.Fatal("want tcp only")
+	}
+}
+
+// blockingUpstream blocks until ctx is done.
+type blockingUpstream struct{ calls int }
+
+func (u *blockingUpstream) ExchangeContext(ctx context.Context, _ []byte) (*[]byte, error) {
+	u.calls++
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (u *blockingUpstream) Close() error { return nil }
+
+func Test_udpWithFallback_AutoDowngrade(t *testing.T) {
+	reply := func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		for i := 0; i < 100; i++ {
+			r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: []byte{10, 0, 0, byte(i)}})
+		}
+		return r
+	}
+	udp := &blockingUpstream{}
+	tcp := &funcUpstream{f: reply}
+	eo := &countingEO{n: make(map[Event]int)}
+	s := newUDPSizer(Opt{AutoDowngrade: true, EventObserver: eo, Logger: mlog.Nop()})
+	u := &udpWithFallback{u: udp, t: tcp, sizer: s, ob: eo}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q := packQuery(t, 4096)
+	for i := 0; i < downgradeStrikes; i++ {
+		r, err := u.ExchangeContext(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.ReleaseBuf(r)
+	}
+	if tcp.calls != downgradeStrikes {
+		t.Fatalf("want %d tcp calls, got %d", downgradeStrikes, tcp.calls)
+	}
+	if eo.n[EventUDPDowngrade] != 1 || s.size.Load() != flagDayUDPSize {
+		t.Fatalf("want downgrade to %d, got %d events and size %d", flagDayUDPSize, eo.n[EventUDPDowngrade], s.size.Load())
+	}
+
+	// TCP only.
+	s.tcpUntil.Store(time.Now().Add(time.Minute).UnixNano())
+	udpCalls := udp.calls
+	r, err := u.ExchangeContext(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.ReleaseBuf(r)
+	if udp.calls != udpCalls {
+		t.Fatal("want tcp only")
+	}
+}
+
+func Test_sizeLimitedUpstream(t *testing.T) {
+	reply := func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		return r
+	}
+	q := packQuery(t, 0)
+	u := &sizeLimitedUpstream{Upstream: &funcUpstream{f: reply}, max: len(q)}
+	r, err := u.ExchangeContext(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.ReleaseBuf(r)
+
+	u.max = len(q) - 1
+	if _, err := u.ExchangeContext(context.Background(), q); !errors.Is(err, ErrRespTooLarge) {
+		t.Fatalf("want ErrRespTooLarge, got %v", err)
+	}
+}
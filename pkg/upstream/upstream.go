@@ -31,14 +31,17 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/mlog"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/bootstrap"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/dnscrypt"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/doh"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"go.uber.org/zap"
@@ -119,6 +122,49 @@ type Opt struct {
 	// EventObserver can observe connection events.
 	// Not implemented for quic based protocol (DoH3, DoQ).
 	EventObserver EventObserver
+
+	// TCPRetry makes an udp upstream retry a query over tcp if the udp
+	// response looks suspicious: it is malformed, its question does not
+	// match the query, or the query has an EDNS0 OPT but the response
+	// doesn't (typical of injected responses). Truncated responses are
+	// always retried over tcp.
+	// Available for udp upstream.
+	TCPRetry bool
+
+	// UDPSize is the EDNS0 buffer size of queries with an OPT to the udp
+	// upstream. Default is 0, queries are not changed.
+	// Available for udp upstream.
+	UDPSize int
+
+	// TCPOnly makes an udp upstream send all queries over tcp.
+	// Available for udp upstream.
+	TCPOnly bool
+
+	// AutoDowngrade makes an udp upstream retry queries over tcp if
+	// there is no udp response in 2s. If large responses keep being lost
+	// over udp but not over tcp, which means the path drops fragments,
+	// the EDNS0 buffer size is lowered to 1232, then 512, and then the
+	// upstream uses tcp only for 10 minutes (DNS flag day 2020).
+	// Available for udp upstream.
+	AutoDowngrade bool
+
+	// MaxRespSize is the maximum size of responses. Larger responses are
+	// errors. Default is 0, no limit.
+	MaxRespSize int
+
+	// MTUProbeInterval is the interval of probes that detect udp paths
+	// that drop fragments. If probes with large responses keep being lost
+	// over udp but not over tcp, the udp upstream is downgraded as the
+	// same as AutoDowngrade. Default is 0, no probe.
+	// Available for udp upstream.
+	MTUProbeInterval time.Duration
+
+	// MTUProbeDomain and MTUProbeType are the question of probes.
+	// MTUProbeDomain is required by probes. Its response must be larger
+	// than 1500 bytes, so it is fragmented on ethernet paths. Default type
+	// is TXT. Probes are sent with the DO bit.
+	MTUProbeDomain string
+	MTUProbeType   uint16
 }
 
 // NewUpstream creates a upstream.
@@ -128,13 +174,33 @@ type Opt struct {
 // Helper protocol:
 //   - tcp+pipeline/tls+pipeline: Automatically set opt.EnablePipeline to true.
 //   - h3: Automatically set opt.EnableHTTP3 to true.
-func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
+//
+// DNSCrypt v2 servers are configured by their stamps, e.g. "sdns://AQcAAAAAAAAA...".
+// Their certificates are fetched and rotated in background.
+//
+// Test protocol:
+//   - mock: Serves canned responses from a zone file, e.g. "mock://testdata/records.zone".
+func NewUpstream(addr string, opt Opt) (Upstream, error) {
+	u, err := newUpstream(addr, opt)
+	if err != nil || opt.MaxRespSize <= 0 {
+		return u, err
+	}
+	return &sizeLimitedUpstream{Upstream: u, max: opt.MaxRespSize}, nil
+}
+
+func newUpstream(addr string, opt Opt) (_ Upstream, err error) {
+	if file, ok := strings.CutPrefix(addr, mockScheme); ok {
+		return newMockUpstream(file)
+	}
 	if opt.Logger == nil {
 		opt.Logger = mlog.Nop()
 	}
 	if opt.EventObserver == nil {
 		opt.EventObserver = nopEO{}
 	}
+	if strings.HasPrefix(addr, dnscrypt.StampScheme) {
+		return newDNSCryptUpstream(addr, opt)
+	}
 
 	// parse protocol and server addr
 	if !strings.Contains(addr, "://") {
@@ -275,6 +341,9 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 	case "", "udp":
 		const defaultPort = 53
 		const maxConcurrentQueryPreConn = 4096 // Protocol limit is 65535.
+		if opt.MTUProbeInterval > 0 && len(opt.MTUProbeDomain) == 0 {
+			return nil, errors.New("mtu probe requires a probe domain")
+		}
 		host, port, err := parseDialAddr(addrUrlHost, opt.DialAddr, defaultPort)
 		if err != nil {
 			return nil, err
@@ -293,6 +362,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 				WithLengthHeader:   false,
 				IdleTimeout:        time.Minute * 5,
 				MaxConcurrentQuery: maxConcurrentQueryPreConn,
+				OnMismatch:         mismatchObserver(opt.EventObserver),
 			}
 			return transport.NewDnsConn(to, wrapConn(c, opt.EventObserver)), nil
 		}
@@ -304,14 +374,30 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			return wrapConn(c, opt.EventObserver), nil
 		}
 
-		return &udpWithFallback{
+		t := transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialTcpNetConn})
+		if opt.TCPOnly {
+			return t, nil
+		}
+		u := &udpWithFallback{
 			u: transport.NewPipelineTransport(transport.PipelineOpts{
 				DialContext:                    dialUdpPipeline,
 				MaxConcurrentQueryWhileDialing: maxConcurrentQueryPreConn,
 				Logger:                         opt.Logger,
 			}),
-			t: transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialTcpNetConn}),
-		}, nil
+			t:           t,
+			tcpRetry:    opt.TCPRetry,
+			sizer:       newUDPSizer(opt),
+			ob:          opt.EventObserver,
+			closeNotify: make(chan struct{}),
+		}
+		if opt.MTUProbeInterval > 0 {
+			qtype := opt.MTUProbeType
+			if qtype == 0 {
+				qtype = dns.TypeTXT
+			}
+			go u.probeLoop(opt.MTUProbeInterval, opt.MTUProbeDomain, qtype)
+		}
+		return u, nil
 	case "tcp":
 		const defaultPort = 53
 		tcpDialer, err := newTcpDialer(true, defaultPort)
@@ -335,6 +421,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 				WithLengthHeader:   true,
 				IdleTimeout:        idleTimeout,
 				MaxConcurrentQuery: pipelineConcurrentLimit,
+				OnMismatch:         mismatchObserver(opt.EventObserver),
 			}
 			dialDnsConn := func(ctx context.Context) (transport.DnsConn, error) {
 				c, err := dialNetConn(ctx)
@@ -384,6 +471,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 				WithLengthHeader:   true,
 				IdleTimeout:        opt.IdleTimeout,
 				MaxConcurrentQuery: pipelineConcurrentLimit,
+				OnMismatch:         mismatchObserver(opt.EventObserver),
 			}
 			dialDnsConn := func(ctx context.Context) (transport.DnsConn, error) {
 				c, err := dialNetConn(ctx)
@@ -554,23 +642,76 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 }
 
 type udpWithFallback struct {
-	u *transport.PipelineTransport
-	t *transport.ReuseConnTransport
+	u Upstream // udp
+	t Upstream // tcp
+
+	tcpRetry bool
+	sizer    *udpSizer // maybe nil
+	ob       EventObserver
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
 }
 
 func (u *udpWithFallback) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
-	r, err := u.u.ExchangeContext(ctx, q)
-	if err != nil {
-		return nil, err
+	if s := u.sizer; s != nil {
+		if s.useTCP() {
+			return u.t.ExchangeContext(ctx, q)
+		}
+		if b, ok := s.setSize(q); ok {
+			defer pool.ReleaseBuf(b)
+			q = *b
+		}
+	}
+	r, viaTCP, err := u.exchangeUDP(ctx, q)
+	if err != nil || viaTCP {
+		return r, err
 	}
 	if msgTruncated(*r) {
 		pool.ReleaseBuf(r)
 		return u.t.ExchangeContext(ctx, q)
 	}
+	if u.tcpRetry && respSuspicious(q, *r) {
+		pool.ReleaseBuf(r)
+		u.ob.OnEvent(EventTCPRetry)
+		return u.t.ExchangeContext(ctx, q)
+	}
 	return r, nil
 }
 
+// exchangeUDP exchanges q over udp. If AutoDowngrade is enabled and the
+// udp response is not received in time, q is retried over tcp and viaTCP
+// is true.
+func (u *udpWithFallback) exchangeUDP(ctx context.Context, q []byte) (r *[]byte, viaTCP bool, err error) {
+	s := u.sizer
+	if s == nil || !s.auto {
+		r, err = u.u.ExchangeContext(ctx, q)
+		return r, false, err
+	}
+	udpCtx, cancel := context.WithTimeout(ctx, udpAttemptTimeout)
+	defer cancel()
+	r, err = u.u.ExchangeContext(udpCtx, q)
+	if err == nil {
+		s.received(len(*r))
+		return r, false, nil
+	}
+	if ctx.Err() != nil || udpCtx.Err() == nil { // Not an udp timeout.
+		return nil, false, err
+	}
+	r, err = u.t.ExchangeContext(ctx, q)
+	if err != nil {
+		return nil, true, err
+	}
+	s.lost(q, len(*r))
+	return r, true, nil
+}
+
 func (u *udpWithFallback) Close() error {
+	u.closeOnce.Do(func() {
+		if u.closeNotify != nil {
+			close(u.closeNotify)
+		}
+	})
 	u.u.Close()
 	u.t.Close()
 	return nil
@@ -607,3 +748,24 @@ func newDefaultClientQuicConfig() *quic.Config {
 		HandshakeIdleTimeout: tlsHandshakeTimeout,
 	}
 }
+
+// ErrRespTooLarge is returned by upstreams if a response is larger than
+// Opt.MaxRespSize.
+var ErrRespTooLarge = errors.New("response is too large")
+
+type sizeLimitedUpstream struct {
+	Upstream
+	max int
+}
+
+func (u *sizeLimitedUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	r, err := u.Upstream.ExchangeContext(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if len(*r) > u.max {
+		pool.ReleaseBuf(r)
+		return nil, fmt.Errorf("%w, %d bytes", ErrRespTooLarge, len(*r))
+	}
+	return r, nil
+}
@@ -24,6 +24,9 @@ import (
 	"net"
 	"net/netip"
 	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
 )
 
 type socketOpts struct {
@@ -102,3 +105,33 @@ func tryTrimIpv6Brackets(s string) string {
 func msgTruncated(b []byte) bool {
 	return b[2]&(1<<1) != 0
 }
+
+// respSuspicious reports whether the udp response r of query q fails
+// sanity checks. See Opt.TCPRetry.
+func respSuspicious(q, r []byte) bool {
+	rm := new(dns.Msg)
+	if err := rm.Unpack(r); err != nil {
+		return true
+	}
+	qm := new(dns.Msg)
+	if err := qm.Unpack(q); err != nil {
+		return false // not our business
+	}
+	if len(qm.Question) != len(rm.Question) {
+		return true
+	}
+	for i := range qm.Question {
+		qq, rq := qm.Question[i], rm.Question[i]
+		if qq.Qtype != rq.Qtype || qq.Qclass != rq.Qclass || !strings.EqualFold(qq.Name, rq.Name) {
+			return true
+		}
+	}
+	// Servers that do not support EDNS0 reply FORMERR without OPT.
+	if qm.IsEdns0() != nil && rm.IsEdns0() == nil {
+		switch rm.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"net"
+	"sync"
+)
+
+// StoppableListener is a net.Listener that can stop accepting connections
+// before it is closed. After Stop, the underlying listener is closed, so
+// new connections go to other sockets of the same SO_REUSEPORT group, but
+// Accept blocks until Close is called instead of returning an error. So
+// the server that serves it keeps running and connections that are
+// already accepted are not affected.
+type StoppableListener struct {
+	net.Listener
+
+	stopOnce  sync.Once
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewStoppableListener(l net.Listener) *StoppableListener {
+	return &StoppableListener{
+		Listener: l,
+		stopped:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (l *StoppableListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.stopped:
+			<-l.closed
+			return nil, net.ErrClosed
+		default:
+		}
+	}
+	return c, err
+}
+
+// Stop stops accepting new connections.
+func (l *StoppableListener) Stop() {
+	l.stopOnce.Do(func() {
+		close(l.stopped)
+		_ = l.Listener.Close()
+	})
+}
+
+// Stopped returns a channel that is closed once Stop is called.
+func (l *StoppableListener) Stopped() <-chan struct{} {
+	return l.stopped
+}
+
+// Close closes the listener and unblocks Accept.
+func (l *StoppableListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	select {
+	case <-l.stopped:
+		return nil // the underlying listener was closed by Stop
+	default:
+		return err
+	}
+}
@@ -21,11 +21,15 @@ package domain_set
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
 	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
-	"os"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+	"time"
 )
 
 const PluginType = "domain_set"
@@ -39,6 +43,12 @@ func Init(bp *coremain.BP, args any) (any, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := m.hits.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg()), bp.Tag()); err != nil {
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
+	api := m.hits.Api()
+	m.runtime.regApi(api)
+	bp.RegAPI(api)
 	return m, nil
 }
 
@@ -49,43 +59,129 @@ type Args struct {
 }
 
 var _ data_provider.DomainMatcherProvider = (*DomainSet)(nil)
+var _ data_provider.UncountedDomainMatcherProvider = (*DomainSet)(nil)
+var _ coremain.StateExporter = (*DomainSet)(nil)
+var _ coremain.DataReloader = (*DomainSet)(nil)
 
 type DomainSet struct {
-	mg []domain.Matcher[struct{}]
+	args *Args
+	ss   remote.Storages
+	// Rules from args.Exps and args.Files. It can be replaced by ReloadData.
+	local   atomic.Pointer[domain.MixMatcher[struct{}]]
+	mg      []domain.Matcher[struct{}] // from args.Sets
+	runtime *runtimeRules
+	hits    data_provider.HitCounter
+}
+
+// ReloadData loads exps and files again.
+func (d *DomainSet) ReloadData() error {
+	m, err := loadLocal(d.args, d.ss)
+	if err != nil {
+		return err
+	}
+	d.local.Store(m)
+	return nil
+}
+
+func loadLocal(args *Args, ss remote.Storages) (*domain.MixMatcher[struct{}], error) {
+	m := domain.NewDomainMixMatcher()
+	if err := LoadExpsAndFiles(args.Exps, args.Files, m, ss); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
+// GetDomainMatcher returns a matcher that also updates the hit counters
+// of this set.
 func (d *DomainSet) GetDomainMatcher() domain.Matcher[struct{}] {
-	return MatcherGroup(d.mg)
+	return countingMatcher{d: d}
+}
+
+// GetUncountedDomainMatcher returns a matcher that does not update
+// the hit counters. It is used by sets that include this set.
+func (d *DomainSet) GetUncountedDomainMatcher() domain.Matcher[struct{}] {
+	return uncountedMatcher{d: d}
+}
+
+// AddRuntimeRule adds a rule to this set. If ttl > 0, the rule
+// expires after ttl.
+func (d *DomainSet) AddRuntimeRule(exp string, ttl time.Duration) error {
+	return d.runtime.Add(exp, ttl)
+}
+
+// ExportState exports runtime rules.
+func (d *DomainSet) ExportState() (json.RawMessage, error) {
+	return json.Marshal(d.runtime.List())
+}
+
+// ImportState imports runtime rules.
+func (d *DomainSet) ImportState(b json.RawMessage) error {
+	var l []RuntimeRule
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	return d.runtime.Import(l)
+}
+
+// HitStats returns the hit counters of this set.
+func (d *DomainSet) HitStats() data_provider.HitStats {
+	return d.hits.Stats()
+}
+
+type countingMatcher struct {
+	d *DomainSet
+}
+
+func (m countingMatcher) Match(s string) (struct{}, bool) {
+	return struct{}{}, m.d.hits.Observe(m.d.match(s))
+}
+
+type uncountedMatcher struct {
+	d *DomainSet
+}
+
+func (m uncountedMatcher) Match(s string) (struct{}, bool) {
+	return struct{}{}, m.d.match(s)
+}
+
+func (d *DomainSet) match(s string) bool {
+	_, ok := d.local.Load().Match(s)
+	if !ok {
+		_, ok = MatcherGroup(d.mg).Match(s)
+	}
+	if !ok {
+		_, ok = d.runtime.Match(s)
+	}
+	return ok
 }
 
 // NewDomainSet inits a DomainSet from given args.
 func NewDomainSet(bp *coremain.BP, args *Args) (*DomainSet, error) {
-	ds := &DomainSet{}
+	ds := &DomainSet{args: args, ss: bp.M().Storages(), runtime: newRuntimeRules()}
 
-	m := domain.NewDomainMixMatcher()
-	if err := LoadExpsAndFiles(args.Exps, args.Files, m); err != nil {
+	m, err := loadLocal(args, ds.ss)
+	if err != nil {
 		return nil, err
 	}
-	if m.Len() > 0 {
-		ds.mg = append(ds.mg, m)
-	}
+	ds.local.Store(m)
 
 	for _, tag := range args.Sets {
 		provider, _ := bp.M().GetPlugin(tag).(data_provider.DomainMatcherProvider)
 		if provider == nil {
 			return nil, fmt.Errorf("%s is not a DomainMatcherProvider", tag)
 		}
-		m := provider.GetDomainMatcher()
-		ds.mg = append(ds.mg, m)
+		ds.mg = append(ds.mg, data_provider.NestedDomainMatcher(provider))
 	}
 	return ds, nil
 }
 
-func LoadExpsAndFiles(exps []string, fs []string, m *domain.MixMatcher[struct{}]) error {
+// LoadExpsAndFiles loads exps and files to m. Files in remote storages
+// are read from ss.
+func LoadExpsAndFiles(exps []string, fs []string, m *domain.MixMatcher[struct{}], ss remote.Storages) error {
 	if err := LoadExps(exps, m); err != nil {
 		return err
 	}
-	if err := LoadFiles(fs, m); err != nil {
+	if err := LoadFiles(fs, m, ss); err != nil {
 		return err
 	}
 	return nil
@@ -100,18 +196,18 @@ func LoadExps(exps []string, m *domain.MixMatcher[struct{}]) error {
 	return nil
 }
 
-func LoadFiles(fs []string, m *domain.MixMatcher[struct{}]) error {
+func LoadFiles(fs []string, m *domain.MixMatcher[struct{}], ss remote.Storages) error {
 	for i, f := range fs {
-		if err := LoadFile(f, m); err != nil {
+		if err := LoadFile(f, m, ss); err != nil {
 			return fmt.Errorf("failed to load file #%d %s, %w", i, f, err)
 		}
 	}
 	return nil
 }
 
-func LoadFile(f string, m *domain.MixMatcher[struct{}]) error {
+func LoadFile(f string, m *domain.MixMatcher[struct{}], ss remote.Storages) error {
 	if len(f) > 0 {
-		b, err := os.ReadFile(f)
+		b, err := ss.ReadFile(f)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain_set
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDomainSet_ReloadData(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(f, []byte("a.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := NewDomainSet(plugintest.NewBP("test", nil), &Args{Files: []string{f}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := ds.GetDomainMatcher()
+	if _, ok := m.Match("a.com."); !ok {
+		t.Fatal("a.com should match")
+	}
+
+	if err := os.WriteFile(f, []byte("b.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.ReloadData(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Match("a.com."); ok {
+		t.Fatal("a.com should not match after reload")
+	}
+	if _, ok := m.Match("b.com."); !ok {
+		t.Fatal("b.com should match after reload")
+	}
+
+	// A failed reload keeps old rules.
+	if err := os.WriteFile(f, []byte("regexp:[\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.ReloadData(); err == nil {
+		t.Fatal("invalid file should fail")
+	}
+	if _, ok := m.Match("b.com."); !ok {
+		t.Fatal("old rules should be kept")
+	}
+}
+
+func TestDomainSet_HitCounters(t *testing.T) {
+	child, err := NewDomainSet(plugintest.NewBP("child", nil), &Args{Exps: []string{"a.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := NewDomainSet(plugintest.NewBP("parent", map[string]any{"child": child}), &Args{Exps: []string{"b.com"}, Sets: []string{"child"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pm := parent.GetDomainMatcher()
+	for _, s := range []string{"a.com.", "b.com.", "c.com."} {
+		pm.Match(s)
+	}
+	if got, want := parent.HitStats(), (data_provider.HitStats{QueryTotal: 3, HitTotal: 2}); got != want {
+		t.Fatalf("parent stats = %+v, want %+v", got, want)
+	}
+	// Matches through the parent are not counted by the child.
+	if got := child.HitStats(); got != (data_provider.HitStats{}) {
+		t.Fatalf("child stats = %+v, want zero", got)
+	}
+
+	cm := child.GetDomainMatcher()
+	cm.Match("a.com.")
+	cm.Match("c.com.")
+	want := data_provider.HitStats{QueryTotal: 2, HitTotal: 1}
+	if got := child.HitStats(); got != want {
+		t.Fatalf("child stats = %+v, want %+v", got, want)
+	}
+
+	reg := prometheus.NewRegistry()
+	if err := child.hits.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", reg), "child"); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]float64)
+	for _, mf := range mfs {
+		metrics[mf.GetName()] = mf.GetMetric()[0].GetCounter().GetValue()
+	}
+	if metrics["domain_set_query_total"] != 2 || metrics["domain_set_hit_total"] != 1 {
+		t.Fatalf("unexpected metrics %v", metrics)
+	}
+
+	w := httptest.NewRecorder()
+	child.hits.Api().ServeHTTP(w, httptest.NewRequest("GET", "/hits", nil))
+	var got data_provider.HitStats
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("/hits = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain_set
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/go-chi/chi/v5"
+)
+
+// runtimeRules are rules added by the api. A rule can have a ttl,
+// after which it expires automatically. Runtime rules are not persisted.
+type runtimeRules struct {
+	m     sync.Mutex
+	rules map[string]time.Time // exp -> expiry time, zero means never.
+
+	// Rebuilt on every change. Values are expiry times.
+	matcher atomic.Pointer[domain.MixMatcher[time.Time]]
+}
+
+var _ domain.Matcher[struct{}] = (*runtimeRules)(nil)
+
+func newRuntimeRules() *runtimeRules {
+	return &runtimeRules{rules: make(map[string]time.Time)}
+}
+
+func (r *runtimeRules) Match(s string) (struct{}, bool) {
+	m := r.matcher.Load()
+	if m == nil {
+		return struct{}{}, false
+	}
+	expiry, ok := m.Match(s)
+	if !ok {
+		return struct{}{}, false
+	}
+	return struct{}{}, expiry.IsZero() || time.Now().Before(expiry)
+}
+
+// Add adds or replaces a rule. If ttl > 0, the rule expires after ttl.
+func (r *runtimeRules) Add(exp string, ttl time.Duration) error {
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl)
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	old, existed := r.rules[exp]
+	r.rules[exp] = expiry
+	if err := r.rebuildLocked(); err != nil {
+		if existed {
+			r.rules[exp] = old
+		} else {
+			delete(r.rules, exp)
+		}
+		return err
+	}
+	return nil
+}
+
+// Del removes a rule. It reports whether the rule existed.
+func (r *runtimeRules) Del(exp string) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if _, ok := r.rules[exp]; !ok {
+		return false
+	}
+	delete(r.rules, exp)
+	_ = r.rebuildLocked() // rules were valid.
+	return true
+}
+
+type RuntimeRule struct {
+	Exp    string     `json:"exp"`
+	Expiry *time.Time `json:"expiry,omitempty"`
+}
+
+// List returns rules that are not expired.
+func (r *runtimeRules) List() []RuntimeRule {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.purgeLocked()
+	l := make([]RuntimeRule, 0, len(r.rules))
+	for exp, expiry := range r.rules {
+		rule := RuntimeRule{Exp: exp}
+		if !expiry.IsZero() {
+			e := expiry
+			rule.Expiry = &e
+		}
+		l = append(l, rule)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Exp < l[j].Exp })
+	return l
+}
+
+// Import adds rules from l. Expired rules are skipped.
+func (r *runtimeRules) Import(l []RuntimeRule) error {
+	now := time.Now()
+	for _, rule := range l {
+		var ttl time.Duration
+		if rule.Expiry != nil {
+			if ttl = rule.Expiry.Sub(now); ttl <= 0 {
+				continue
+			}
+		}
+		if err := r.Add(rule.Exp, ttl); err != nil {
+			return fmt.Errorf("invalid rule %s, %w", rule.Exp, err)
+		}
+	}
+	return nil
+}
+
+// purgeLocked removes expired rules.
+func (r *runtimeRules) purgeLocked() {
+	now := time.Now()
+	removed := false
+	for exp, expiry := range r.rules {
+		if !expiry.IsZero() && !now.Before(expiry) {
+			delete(r.rules, exp)
+			removed = true
+		}
+	}
+	if removed {
+		_ = r.rebuildLocked()
+	}
+}
+
+func (r *runtimeRules) rebuildLocked() error {
+	now := time.Now()
+	m := domain.NewMixMatcher[time.Time]()
+	m.SetDefaultMatcher(domain.MatcherDomain)
+	for exp, expiry := range r.rules {
+		if !expiry.IsZero() && !now.Before(expiry) {
+			continue
+		}
+		if err := m.Add(exp, expiry); err != nil {
+			return err
+		}
+	}
+	r.matcher.Store(m)
+	return nil
+}
+
+// regApi registers GET/POST/DELETE "/rules" to router.
+// POST accepts json {"exp": "example.com", "ttl": 3600}. ttl is in
+// seconds, 0 means the rule never expires.
+// DELETE accepts the url query "exp".
+func (r *runtimeRules) regApi(router *chi.Mux) {
+	router.Get("/rules", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(r.List())
+	})
+	router.Post("/rules", func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Exp string `json:"exp"`
+			TTL int    `json:"ttl"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body.Exp) == 0 || body.TTL < 0 {
+			http.Error(w, errors.New("invalid exp or ttl").Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.Add(body.Exp, time.Duration(body.TTL)*time.Second); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	})
+	router.Delete("/rules", func(w http.ResponseWriter, req *http.Request) {
+		if !r.Del(req.URL.Query().Get("exp")) {
+			http.Error(w, "rule not found", http.StatusNotFound)
+		}
+	})
+}
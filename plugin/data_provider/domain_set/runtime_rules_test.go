@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain_set
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_runtimeRules(t *testing.T) {
+	r := newRuntimeRules()
+	if _, ok := r.Match("example.com."); ok {
+		t.Fatal("empty rules should not match")
+	}
+
+	if err := r.Add("example.com", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add("temp.com", time.Millisecond*50); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add("regexp:[", 0); err == nil {
+		t.Fatal("invalid exp should be rejected")
+	}
+
+	for _, s := range []string{"example.com.", "sub.example.com.", "temp.com."} {
+		if _, ok := r.Match(s); !ok {
+			t.Fatalf("%s should match", s)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	if _, ok := r.Match("temp.com."); ok {
+		t.Fatal("expired rule should not match")
+	}
+	if l := r.List(); len(l) != 1 || l[0].Exp != "example.com" {
+		t.Fatalf("unexpected rules %v", l)
+	}
+
+	if !r.Del("example.com") {
+		t.Fatal("failed to delete rule")
+	}
+	if _, ok := r.Match("example.com."); ok {
+		t.Fatal("deleted rule should not match")
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package data_provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HitCounter counts how many times a data set was queried and how
+// many of those queries matched. It is safe for concurrent use.
+type HitCounter struct {
+	queryTotal atomic.Uint64
+	hitTotal   atomic.Uint64
+}
+
+// Observe records a match attempt and its result. It returns matched.
+func (c *HitCounter) Observe(matched bool) bool {
+	c.queryTotal.Add(1)
+	if matched {
+		c.hitTotal.Add(1)
+	}
+	return matched
+}
+
+// HitStats is a snapshot of a HitCounter.
+type HitStats struct {
+	QueryTotal uint64 `json:"query_total"`
+	HitTotal   uint64 `json:"hit_total"`
+}
+
+func (c *HitCounter) Stats() HitStats {
+	return HitStats{
+		QueryTotal: c.queryTotal.Load(),
+		HitTotal:   c.hitTotal.Load(),
+	}
+}
+
+// RegMetricsTo registers query_total and hit_total counters with given tag to r.
+func (c *HitCounter) RegMetricsTo(r prometheus.Registerer, tag string) error {
+	lb := map[string]string{"tag": tag}
+	collectors := [...]prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "query_total",
+			Help:        "The total number of match attempts against this set",
+			ConstLabels: lb,
+		}, func() float64 { return float64(c.queryTotal.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "hit_total",
+			Help:        "The total number of match attempts that hit this set",
+			ConstLabels: lb,
+		}, func() float64 { return float64(c.hitTotal.Load()) }),
+	}
+	for _, collector := range collectors {
+		if err := r.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Api returns a router that serves the counter snapshot at "/hits".
+func (c *HitCounter) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/hits", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.Stats())
+	})
+	return r
+}
@@ -31,3 +31,34 @@ type DomainMatcherProvider interface {
 type IPMatcherProvider interface {
 	GetIPMatcher() netlist.Matcher
 }
+
+// UncountedDomainMatcherProvider is a DomainMatcherProvider with hit
+// counters. GetUncountedDomainMatcher returns a matcher that does not
+// update them.
+type UncountedDomainMatcherProvider interface {
+	GetUncountedDomainMatcher() domain.Matcher[struct{}]
+}
+
+// UncountedIPMatcherProvider is the IPMatcherProvider version of
+// UncountedDomainMatcherProvider.
+type UncountedIPMatcherProvider interface {
+	GetUncountedIPMatcher() netlist.Matcher
+}
+
+// NestedDomainMatcher returns the matcher of p for sets that include p.
+// The hit counters of p are not updated by it, so they only count
+// the queries that match against p directly.
+func NestedDomainMatcher(p DomainMatcherProvider) domain.Matcher[struct{}] {
+	if up, ok := p.(UncountedDomainMatcherProvider); ok {
+		return up.GetUncountedDomainMatcher()
+	}
+	return p.GetDomainMatcher()
+}
+
+// NestedIPMatcher is the IPMatcherProvider version of NestedDomainMatcher.
+func NestedIPMatcher(p IPMatcherProvider) netlist.Matcher {
+	if up, ok := p.(UncountedIPMatcherProvider); ok {
+		return up.GetUncountedIPMatcher()
+	}
+	return p.GetIPMatcher()
+}
@@ -21,13 +21,17 @@ package ip_set
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
 	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/prometheus/client_golang/prometheus"
 	"net/netip"
-	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const PluginType = "ip_set"
@@ -37,7 +41,17 @@ func init() {
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	return NewIPSet(bp, args.(*Args))
+	p, err := NewIPSet(bp, args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	if err := p.hits.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg()), bp.Tag()); err != nil {
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
+	api := p.hits.Api()
+	p.runtime.regApi(api)
+	bp.RegAPI(api)
+	return p, nil
 }
 
 type Args struct {
@@ -47,32 +61,110 @@ type Args struct {
 }
 
 var _ data_provider.IPMatcherProvider = (*IPSet)(nil)
+var _ data_provider.UncountedIPMatcherProvider = (*IPSet)(nil)
+var _ coremain.DataReloader = (*IPSet)(nil)
+var _ coremain.StateExporter = (*IPSet)(nil)
 
 type IPSet struct {
-	mg []netlist.Matcher
+	args *Args
+	ss   remote.Storages
+	// IPs from args.IPs and args.Files. It can be replaced by ReloadData.
+	local   atomic.Pointer[netlist.List]
+	mg      []netlist.Matcher // from args.Sets
+	runtime *runtimeRules
+	hits    data_provider.HitCounter
 }
 
-func (d *IPSet) GetIPMatcher() netlist.Matcher {
-	return MatcherGroup(d.mg)
+// AddRuntimeRule adds an ip or CIDR to this set. If ttl > 0, the rule
+// expires after ttl.
+func (d *IPSet) AddRuntimeRule(ip string, ttl time.Duration) error {
+	return d.runtime.Add(ip, ttl)
 }
 
-func NewIPSet(bp *coremain.BP, args *Args) (*IPSet, error) {
-	p := &IPSet{}
+// ExportState exports runtime rules.
+func (d *IPSet) ExportState() (json.RawMessage, error) {
+	return json.Marshal(d.runtime.List())
+}
 
+// ImportState imports runtime rules.
+func (d *IPSet) ImportState(b json.RawMessage) error {
+	var l []RuntimeRule
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	return d.runtime.Import(l)
+}
+
+// ReloadData loads ips and files again.
+func (d *IPSet) ReloadData() error {
+	l, err := loadLocal(d.args, d.ss)
+	if err != nil {
+		return err
+	}
+	d.local.Store(l)
+	return nil
+}
+
+func loadLocal(args *Args, ss remote.Storages) (*netlist.List, error) {
 	l := netlist.NewList()
-	if err := LoadFromIPsAndFiles(args.IPs, args.Files, l); err != nil {
+	if err := LoadFromIPsAndFiles(args.IPs, args.Files, l, ss); err != nil {
 		return nil, err
 	}
 	l.Sort()
-	if l.Len() > 0 {
-		p.mg = append(p.mg, l)
+	return l, nil
+}
+
+// GetIPMatcher returns a matcher that also updates the hit counters
+// of this set.
+func (d *IPSet) GetIPMatcher() netlist.Matcher {
+	return countingMatcher{d: d}
+}
+
+// GetUncountedIPMatcher returns a matcher that does not update
+// the hit counters. It is used by sets that include this set.
+func (d *IPSet) GetUncountedIPMatcher() netlist.Matcher {
+	return uncountedMatcher{d: d}
+}
+
+// HitStats returns the hit counters of this set.
+func (d *IPSet) HitStats() data_provider.HitStats {
+	return d.hits.Stats()
+}
+
+type countingMatcher struct {
+	d *IPSet
+}
+
+func (m countingMatcher) Match(addr netip.Addr) bool {
+	return m.d.hits.Observe(m.d.match(addr))
+}
+
+type uncountedMatcher struct {
+	d *IPSet
+}
+
+func (m uncountedMatcher) Match(addr netip.Addr) bool {
+	return m.d.match(addr)
+}
+
+func (d *IPSet) match(addr netip.Addr) bool {
+	return d.local.Load().Match(addr) || d.runtime.Match(addr) || MatcherGroup(d.mg).Match(addr)
+}
+
+func NewIPSet(bp *coremain.BP, args *Args) (*IPSet, error) {
+	p := &IPSet{args: args, ss: bp.M().Storages(), runtime: newRuntimeRules()}
+
+	l, err := loadLocal(args, p.ss)
+	if err != nil {
+		return nil, err
 	}
+	p.local.Store(l)
 	for _, tag := range args.Sets {
 		provider, _ := bp.M().GetPlugin(tag).(data_provider.IPMatcherProvider)
 		if provider == nil {
 			return nil, fmt.Errorf("%s is not an IPMatcherProvider", tag)
 		}
-		p.mg = append(p.mg, provider.GetIPMatcher())
+		p.mg = append(p.mg, data_provider.NestedIPMatcher(provider))
 	}
 	return p, nil
 }
@@ -88,18 +180,27 @@ func parseNetipPrefix(s string) (netip.Prefix, error) {
 	return addr.Prefix(addr.BitLen())
 }
 
-func LoadFromIPsAndFiles(ips []string, fs []string, l *netlist.List) error {
+// LoadFromIPsAndFiles loads ips and files to l. Files in remote storages
+// are read from ss.
+func LoadFromIPsAndFiles(ips []string, fs []string, l *netlist.List, ss remote.Storages) error {
 	if err := LoadFromIPs(ips, l); err != nil {
 		return err
 	}
-	if err := LoadFromFiles(fs, l); err != nil {
+	if err := LoadFromFiles(fs, l, ss); err != nil {
 		return err
 	}
 	return nil
 }
 
+// LoadFromIPs loads ips, CIDRs and special-use sets ("@private") to l.
 func LoadFromIPs(ips []string, l *netlist.List) error {
 	for i, s := range ips {
+		if strings.HasPrefix(s, netlist.SpecialPrefix) {
+			if err := netlist.LoadFromText(l, s); err != nil {
+				return fmt.Errorf("invalid ip #%d %s, %w", i, s, err)
+			}
+			continue
+		}
 		p, err := parseNetipPrefix(s)
 		if err != nil {
 			return fmt.Errorf("invalid ip #%d %s, %w", i, s, err)
@@ -109,18 +210,18 @@ func LoadFromIPs(ips []string, l *netlist.List) error {
 	return nil
 }
 
-func LoadFromFiles(fs []string, l *netlist.List) error {
+func LoadFromFiles(fs []string, l *netlist.List, ss remote.Storages) error {
 	for i, f := range fs {
-		if err := LoadFromFile(f, l); err != nil {
+		if err := LoadFromFile(f, l, ss); err != nil {
 			return fmt.Errorf("failed to load file #%d %s, %w", i, f, err)
 		}
 	}
 	return nil
 }
 
-func LoadFromFile(f string, l *netlist.List) error {
+func LoadFromFile(f string, l *netlist.List, ss remote.Storages) error {
 	if len(f) > 0 {
-		b, err := os.ReadFile(f)
+		b, err := ss.ReadFile(f)
 		if err != nil {
 			return err
 		}
@@ -133,7 +234,10 @@ func LoadFromFile(f string, l *netlist.List) error {
 
 type MatcherGroup []netlist.Matcher
 
+// Match matches addr against all matchers. IPv4-mapped IPv6 addresses
+// are unmapped first.
 func (mg MatcherGroup) Match(addr netip.Addr) bool {
+	addr = addr.Unmap()
 	for _, m := range mg {
 		if m.Match(addr) {
 			return true
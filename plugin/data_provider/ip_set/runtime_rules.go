@@ -0,0 +1,211 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_set
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/go-chi/chi/v5"
+)
+
+// runtimeRules are ips added by the api. A rule can have a ttl,
+// after which it expires automatically. Runtime rules are not persisted.
+type runtimeRules struct {
+	m     sync.Mutex
+	rules map[netip.Prefix]time.Time // prefix -> expiry time, zero means never.
+
+	// Rebuilt on every change.
+	list atomic.Pointer[runtimeList]
+}
+
+type runtimeList struct {
+	l *netlist.List
+	// The earliest expiry time of rules in l. Zero means never.
+	nextExpiry time.Time
+}
+
+var _ netlist.Matcher = (*runtimeRules)(nil)
+
+func newRuntimeRules() *runtimeRules {
+	return &runtimeRules{rules: make(map[netip.Prefix]time.Time)}
+}
+
+func (r *runtimeRules) Match(addr netip.Addr) bool {
+	rl := r.list.Load()
+	if rl == nil {
+		return false
+	}
+	if !rl.nextExpiry.IsZero() && !time.Now().Before(rl.nextExpiry) {
+		r.m.Lock()
+		r.purgeLocked()
+		r.m.Unlock()
+		rl = r.list.Load()
+	}
+	return rl.l.Match(addr)
+}
+
+// Add adds or replaces a rule. If ttl > 0, the rule expires after ttl.
+func (r *runtimeRules) Add(ip string, ttl time.Duration) error {
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl)
+	}
+	return r.add(ip, expiry)
+}
+
+// add adds or replaces a rule. A zero expiry means never.
+func (r *runtimeRules) add(ip string, expiry time.Time) error {
+	p, err := parseNetipPrefix(ip)
+	if err != nil {
+		return err
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.rules[p.Masked()] = expiry
+	r.rebuildLocked()
+	return nil
+}
+
+// Del removes a rule. It reports whether the rule existed.
+func (r *runtimeRules) Del(ip string) bool {
+	p, err := parseNetipPrefix(ip)
+	if err != nil {
+		return false
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if _, ok := r.rules[p.Masked()]; !ok {
+		return false
+	}
+	delete(r.rules, p.Masked())
+	r.rebuildLocked()
+	return true
+}
+
+type RuntimeRule struct {
+	IP     string     `json:"ip"`
+	Expiry *time.Time `json:"expiry,omitempty"`
+}
+
+// List returns rules that are not expired.
+func (r *runtimeRules) List() []RuntimeRule {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.purgeLocked()
+	l := make([]RuntimeRule, 0, len(r.rules))
+	for p, expiry := range r.rules {
+		rule := RuntimeRule{IP: p.String()}
+		if !expiry.IsZero() {
+			e := expiry
+			rule.Expiry = &e
+		}
+		l = append(l, rule)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].IP < l[j].IP })
+	return l
+}
+
+// Import adds rules from l. Expired rules are skipped.
+func (r *runtimeRules) Import(l []RuntimeRule) error {
+	now := time.Now()
+	for _, rule := range l {
+		var expiry time.Time
+		if rule.Expiry != nil {
+			if !now.Before(*rule.Expiry) {
+				continue
+			}
+			expiry = *rule.Expiry
+		}
+		if err := r.add(rule.IP, expiry); err != nil {
+			return fmt.Errorf("invalid rule %s, %w", rule.IP, err)
+		}
+	}
+	return nil
+}
+
+// purgeLocked removes expired rules.
+func (r *runtimeRules) purgeLocked() {
+	now := time.Now()
+	removed := false
+	for p, expiry := range r.rules {
+		if !expiry.IsZero() && !now.Before(expiry) {
+			delete(r.rules, p)
+			removed = true
+		}
+	}
+	if removed {
+		r.rebuildLocked()
+	}
+}
+
+func (r *runtimeRules) rebuildLocked() {
+	rl := &runtimeList{l: netlist.NewList()}
+	for p, expiry := range r.rules {
+		rl.l.Append(p)
+		if !expiry.IsZero() && (rl.nextExpiry.IsZero() || expiry.Before(rl.nextExpiry)) {
+			rl.nextExpiry = expiry
+		}
+	}
+	rl.l.Sort()
+	r.list.Store(rl)
+}
+
+// regApi registers GET/POST/DELETE "/rules" to router.
+// POST accepts json {"ip": "192.0.2.0/24", "ttl": 3600}. ttl is in
+// seconds, 0 means the rule never expires.
+// DELETE accepts the url query "ip".
+func (r *runtimeRules) regApi(router *chi.Mux) {
+	router.Get("/rules", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(r.List())
+	})
+	router.Post("/rules", func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			IP  string `json:"ip"`
+			TTL int    `json:"ttl"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body.IP) == 0 || body.TTL < 0 {
+			http.Error(w, errors.New("invalid ip or ttl").Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.Add(body.IP, time.Duration(body.TTL)*time.Second); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	})
+	router.Delete("/rules", func(w http.ResponseWriter, req *http.Request) {
+		if !r.Del(req.URL.Query().Get("ip")) {
+			http.Error(w, "rule not found", http.StatusNotFound)
+		}
+	})
+}
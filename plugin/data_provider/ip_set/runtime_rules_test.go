@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_set
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_runtimeRules(t *testing.T) {
+	r := newRuntimeRules()
+	addr := netip.MustParseAddr
+	if r.Match(addr("192.0.2.1")) {
+		t.Fatal("empty rules should not match")
+	}
+
+	if err := r.Add("192.0.2.0/24", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add("2001:db8::1", time.Millisecond*50); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add("not an ip", 0); err == nil {
+		t.Fatal("invalid ip should be rejected")
+	}
+
+	for _, a := range []string{"192.0.2.1", "::ffff:192.0.2.200", "2001:db8::1"} {
+		if !r.Match(addr(a)) {
+			t.Fatalf("%s should match", a)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	if r.Match(addr("2001:db8::1")) {
+		t.Fatal("expired rule should not match")
+	}
+	if l := r.List(); len(l) != 1 || l[0].IP != "192.0.2.0/24" {
+		t.Fatalf("unexpected rules %v", l)
+	}
+
+	if !r.Del("192.0.2.0/24") {
+		t.Fatal("failed to delete rule")
+	}
+	if r.Match(addr("192.0.2.1")) {
+		t.Fatal("deleted rule should not match")
+	}
+}
+
+func TestIPSet_State(t *testing.T) {
+	src := &IPSet{runtime: newRuntimeRules()}
+	if err := src.AddRuntimeRule("192.0.2.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AddRuntimeRule("198.51.100.0/24", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	b, err := src.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &IPSet{runtime: newRuntimeRules()}
+	if err := dst.ImportState(b); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(dst.runtime.List())
+	if string(got) != string(b) {
+		t.Fatalf("want state %s, got %s", b, got)
+	}
+}
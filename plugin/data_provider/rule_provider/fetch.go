@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rule_provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const maxRuleFileSize = 256 << 20
+
+// fetcher downloads a rule file with conditional requests.
+type fetcher struct {
+	url    string
+	sigURL string            // empty if signatures are not verified
+	pubKey ed25519.PublicKey // set if sigURL is set
+	hc     *http.Client
+
+	// Validators of the last applied file. Callers must serialize fetches.
+	v validators
+}
+
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+var errNotModified = errors.New("not modified")
+
+// fetch downloads the rule file. It returns errNotModified if the server
+// says the file was not changed since the file of f.v. Callers set f.v
+// after the file is applied.
+func (f *fetcher) fetch(ctx context.Context) ([]byte, validators, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, validators{}, err
+	}
+	if len(f.v.etag) > 0 {
+		req.Header.Set("If-None-Match", f.v.etag)
+	}
+	if len(f.v.lastModified) > 0 {
+		req.Header.Set("If-Modified-Since", f.v.lastModified)
+	}
+	resp, err := f.hc.Do(req)
+	if err != nil {
+		return nil, validators{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, validators{}, errNotModified
+	default:
+		return nil, validators{}, fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+	b, err := readAll(resp.Body)
+	if err != nil {
+		return nil, validators{}, err
+	}
+	if len(f.sigURL) > 0 {
+		if err := f.verify(ctx, b); err != nil {
+			return nil, validators{}, err
+		}
+	}
+	v := validators{etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified")}
+	return b, v, nil
+}
+
+// verify downloads the detached ed25519 signature of b and verifies it.
+// The signature file is the raw 64 bytes signature or its base64 encoding.
+func (f *fetcher) verify(ctx context.Context, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.sigURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch signature, %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch signature, server returned status %d", resp.StatusCode)
+	}
+	sig, err := readAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to fetch signature, %w", err)
+	}
+	sig, err = parseSignature(sig)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(f.pubKey, b, sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func parseSignature(b []byte) ([]byte, error) {
+	if len(b) == ed25519.SignatureSize {
+		return b, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, errors.New("invalid signature format")
+	}
+	return sig, nil
+}
+
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid key length %d", len(b))
+	}
+	return b, nil
+}
+
+func readAll(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxRuleFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxRuleFileSize {
+		return nil, errors.New("file is too large")
+	}
+	return b, nil
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rule_provider
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// geosite.dat and geoip.dat are v2ray protobuf lists. Only fields that are
+// used here are decoded.
+//
+//	GeoSiteList { repeated GeoSite entry = 1; }
+//	GeoSite     { string country_code = 1; repeated Domain domain = 2; }
+//	Domain      { Type type = 1; string value = 2; }
+//	GeoIPList   { repeated GeoIP entry = 1; }
+//	GeoIP       { string country_code = 1; repeated CIDR cidr = 2; bool reverse_match = 3; }
+//	CIDR        { bytes ip = 1; uint32 prefix = 2; }
+
+// Domain types of geosite.dat.
+const (
+	geositePlain  = 0 // keyword
+	geositeRegex  = 1
+	geositeDomain = 2
+	geositeFull   = 3
+)
+
+// decodeGeoSite returns the domain expressions of entries in codes.
+func decodeGeoSite(b []byte, codes map[string]struct{}) ([]string, error) {
+	var exps []string
+	err := forEachEntry(b, codes, func(field protowire.Number, v []byte) error {
+		if field != 2 {
+			return nil
+		}
+		exp, err := decodeGeoSiteDomain(v)
+		if err != nil {
+			return err
+		}
+		exps = append(exps, exp)
+		return nil
+	})
+	return exps, err
+}
+
+func decodeGeoSiteDomain(b []byte) (string, error) {
+	var typ uint64
+	var value string
+	err := forEachField(b, func(num protowire.Number, wt protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && wt == protowire.VarintType:
+			typ = n
+		case num == 2 && wt == protowire.BytesType:
+			value = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(value) == 0 {
+		return "", errors.New("empty domain value")
+	}
+	switch typ {
+	case geositePlain:
+		return "keyword:" + value, nil
+	case geositeRegex:
+		return "regexp:" + value, nil
+	case geositeDomain:
+		return "domain:" + value, nil
+	case geositeFull:
+		return "full:" + value, nil
+	default:
+		return "", fmt.Errorf("unknown domain type %d", typ)
+	}
+}
+
+// decodeGeoIP returns the prefixes of entries in codes. Entries with
+// reverse_match are not supported.
+func decodeGeoIP(b []byte, codes map[string]struct{}) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	err := forEachEntry(b, codes, func(field protowire.Number, v []byte) error {
+		switch field {
+		case 2:
+			p, err := decodeGeoIPCIDR(v)
+			if err != nil {
+				return err
+			}
+			prefixes = append(prefixes, p)
+		case 3:
+			if len(v) > 0 {
+				return errors.New("reverse_match is not supported")
+			}
+		}
+		return nil
+	})
+	return prefixes, err
+}
+
+func decodeGeoIPCIDR(b []byte) (netip.Prefix, error) {
+	var ip []byte
+	var bits uint64
+	err := forEachField(b, func(num protowire.Number, wt protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && wt == protowire.BytesType:
+			ip = v
+		case num == 2 && wt == protowire.VarintType:
+			bits = n
+		}
+		return nil
+	})
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Prefix{}, fmt.Errorf("invalid ip length %d", len(ip))
+	}
+	p := netip.PrefixFrom(addr, int(bits))
+	if !p.IsValid() {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix %s/%d", addr, bits)
+	}
+	return p, nil
+}
+
+// forEachEntry calls f with every field of list entries whose country
+// codes are in codes, except the country code itself. v of a true varint
+// field is non-empty. Codes are compared in lower case. It is an error if
+// a code is not found.
+func forEachEntry(b []byte, codes map[string]struct{}, f func(field protowire.Number, v []byte) error) error {
+	found := make(map[string]struct{})
+	err := forEachField(b, func(num protowire.Number, wt protowire.Type, entry []byte, _ uint64) error {
+		if num != 1 || wt != protowire.BytesType {
+			return nil
+		}
+		code, err := entryCode(entry)
+		if err != nil {
+			return err
+		}
+		if _, ok := codes[code]; !ok {
+			return nil
+		}
+		found[code] = struct{}{}
+		return forEachField(entry, func(num protowire.Number, wt protowire.Type, v []byte, n uint64) error {
+			if num == 1 {
+				return nil
+			}
+			if wt == protowire.VarintType && n != 0 {
+				v = []byte{1}
+			}
+			return f(num, v)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for code := range codes {
+		if _, ok := found[code]; !ok {
+			return fmt.Errorf("code %s is not found", code)
+		}
+	}
+	return nil
+}
+
+func entryCode(entry []byte) (string, error) {
+	var code string
+	err := forEachField(entry, func(num protowire.Number, wt protowire.Type, v []byte, _ uint64) error {
+		if num == 1 && wt == protowire.BytesType {
+			code = strings.ToLower(string(v))
+		}
+		return nil
+	})
+	return code, err
+}
+
+// forEachField calls f with every field of the message b. v is the value
+// of bytes fields and n is the value of varint fields.
+func forEachField(b []byte, f func(num protowire.Number, wt protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, wt, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		var v []byte
+		var n uint64
+		switch wt {
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, wt, b)
+		}
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		if err := f(num, wt, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
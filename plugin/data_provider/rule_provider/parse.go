@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rule_provider
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"unicode"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+// Rule list formats.
+const (
+	formatDomain  = "domain"  // domain expressions, one per line
+	formatIP      = "ip"      // ips and CIDRs, one per line
+	formatHosts   = "hosts"   // "ip name..." hosts file, names are full domains
+	formatGeoSite = "geosite" // v2ray geosite.dat
+	formatGeoIP   = "geoip"   // v2ray geoip.dat
+)
+
+func isIPFormat(format string) bool {
+	return format == formatIP || format == formatGeoIP
+}
+
+// ruleSet is a parsed rule list. Only one of d and ip is set.
+type ruleSet struct {
+	d  *domain.MixMatcher[struct{}]
+	ip *netlist.List
+	n  int // number of rules
+}
+
+// emptyRuleSet returns a ruleSet of format that has no rules.
+func emptyRuleSet(format string) *ruleSet {
+	if isIPFormat(format) {
+		return &ruleSet{ip: netlist.NewList()}
+	}
+	return &ruleSet{d: domain.NewDomainMixMatcher()}
+}
+
+// parseRules parses a rule list. Lists without any rule are invalid.
+func parseRules(b []byte, format string, codes map[string]struct{}) (*ruleSet, error) {
+	rs, err := parseRuleSet(b, format, codes)
+	if err != nil {
+		return nil, err
+	}
+	if rs.n == 0 {
+		return nil, errors.New("list has no rules")
+	}
+	return rs, nil
+}
+
+func parseRuleSet(b []byte, format string, codes map[string]struct{}) (*ruleSet, error) {
+	switch format {
+	case formatDomain:
+		m := domain.NewDomainMixMatcher()
+		if err := domain.LoadFromTextReader[struct{}](m, bytes.NewReader(b), parseDomainRule); err != nil {
+			return nil, err
+		}
+		return &ruleSet{d: m, n: m.Len()}, nil
+	case formatHosts:
+		return parseHosts(b)
+	case formatGeoSite:
+		exps, err := decodeGeoSite(b, codes)
+		if err != nil {
+			return nil, err
+		}
+		m := domain.NewDomainMixMatcher()
+		for _, exp := range exps {
+			if err := m.Add(exp, struct{}{}); err != nil {
+				return nil, fmt.Errorf("invalid expression %s, %w", exp, err)
+			}
+		}
+		return &ruleSet{d: m, n: m.Len()}, nil
+	case formatIP:
+		l := netlist.NewList()
+		if err := netlist.LoadFromReader(l, bytes.NewReader(b)); err != nil {
+			return nil, err
+		}
+		l.Sort()
+		return &ruleSet{ip: l, n: l.Len()}, nil
+	case formatGeoIP:
+		prefixes, err := decodeGeoIP(b, codes)
+		if err != nil {
+			return nil, err
+		}
+		l := netlist.NewList()
+		l.Append(prefixes...)
+		l.Sort()
+		return &ruleSet{ip: l, n: l.Len()}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+}
+
+// parseDomainRule parses a line of a domain list. Names of full and
+// domain rules must be valid host names, so that other files, e.g. html
+// error pages, are not loaded as rules.
+func parseDomainRule(s string) (string, struct{}, error) {
+	if strings.IndexFunc(s, unicode.IsSpace) != -1 {
+		return "", struct{}{}, errors.New("rule string has more than one section")
+	}
+	typ, name, ok := strings.Cut(s, ":")
+	if !ok {
+		typ, name = domain.MatcherDomain, s
+	}
+	if (typ == domain.MatcherDomain || typ == domain.MatcherFull) && !isHostName(name) {
+		return "", struct{}{}, fmt.Errorf("invalid domain name %q", name)
+	}
+	return s, struct{}{}, nil
+}
+
+// isHostName reports whether s is a domain name of letters, digits,
+// hyphens and underscores. A trailing dot is allowed.
+func isHostName(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hostsSkip are names in hosts files that are not rules.
+var hostsSkip = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+// parseHosts parses a hosts file, e.g. a block list. The names are
+// loaded as full domains. The addresses are ignored.
+func parseHosts(b []byte) (*ruleSet, error) {
+	m := domain.NewDomainMixMatcher()
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(utils.RemoveComment(scanner.Text(), "#"))
+		f := strings.Fields(s)
+		if len(f) == 0 {
+			continue
+		}
+		if _, err := netip.ParseAddr(f[0]); err != nil {
+			return nil, fmt.Errorf("line %d: invalid ip %s", line, f[0])
+		}
+		for _, name := range f[1:] {
+			name = strings.ToLower(name)
+			if _, ok := hostsSkip[name]; ok {
+				continue
+			}
+			if !isHostName(name) {
+				return nil, fmt.Errorf("line %d: invalid domain name %q", line, name)
+			}
+			if err := m.Add(domain.MatcherFull+":"+name, struct{}{}); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &ruleSet{d: m, n: m.Len()}, nil
+}
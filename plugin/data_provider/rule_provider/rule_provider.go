@@ -0,0 +1,459 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rule_provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const PluginType = "rule_provider"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+// Args configures a remote rule list.
+type Args struct {
+	URL string `yaml:"url"` // Required. http or https url.
+	// Format is one of "domain" (default), "ip", "hosts", "geosite"
+	// and "geoip". Domain formats provide a domain set and ip formats
+	// provide an ip set.
+	Format string `yaml:"format"`
+	// Codes are the country codes (or geosite list names) to load from
+	// geosite and geoip files.
+	Codes []string `yaml:"codes"`
+
+	Interval int `yaml:"interval"` // (seconds) update interval, default is 86400. Negative disables it.
+	Timeout  int `yaml:"timeout"`  // (seconds) download timeout, default is 60.
+
+	// CacheFile keeps the last downloaded file. It is loaded at startup
+	// so that the rules are available before the first download.
+	CacheFile string `yaml:"cache_file"`
+
+	// PublicKey is a base64 ed25519 public key. If set, downloaded files
+	// must have a valid detached signature at SignatureURL (default is
+	// URL + ".sig").
+	PublicKey    string `yaml:"public_key"`
+	SignatureURL string `yaml:"signature_url"`
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultNum(&a.Interval, 86400)
+	utils.SetDefaultNum(&a.Timeout, 60)
+	utils.SetDefaultString(&a.Format, formatDomain)
+	u, err := url.Parse(a.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("invalid url %q", a.URL)
+	}
+	switch a.Format {
+	case formatDomain, formatIP, formatHosts:
+	case formatGeoSite, formatGeoIP:
+		if len(a.Codes) == 0 {
+			return fmt.Errorf("%s format requires codes", a.Format)
+		}
+	default:
+		return fmt.Errorf("unknown format %s", a.Format)
+	}
+	if len(a.PublicKey) > 0 {
+		utils.SetDefaultString(&a.SignatureURL, a.URL+".sig")
+	}
+	return nil
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	p, err := NewRuleProvider(args.(*Args), bp.L())
+	if err != nil {
+		return nil, err
+	}
+	r := prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())
+	if err := p.hits.RegMetricsTo(r, bp.Tag()); err != nil {
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
+	for _, c := range p.collectors(bp.Tag()) {
+		if err := r.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register metrics, %w", err)
+		}
+	}
+	bp.RegAPI(p.Api())
+	p.start()
+	if isIPFormat(p.args.Format) {
+		return &IPRuleProvider{p}, nil
+	}
+	return &DomainRuleProvider{p}, nil
+}
+
+var _ coremain.DataReloader = (*RuleProvider)(nil)
+var _ data_provider.DomainMatcherProvider = (*DomainRuleProvider)(nil)
+var _ data_provider.IPMatcherProvider = (*IPRuleProvider)(nil)
+var _ data_provider.UncountedDomainMatcherProvider = (*DomainRuleProvider)(nil)
+var _ data_provider.UncountedIPMatcherProvider = (*IPRuleProvider)(nil)
+
+// RuleProvider downloads a rule list and updates it periodically in the
+// background. It starts with the cache file, or an empty list. New lists
+// are validated and replace the old one atomically. A failed update keeps
+// the old list and is retried with backoff.
+type RuleProvider struct {
+	args   *Args
+	logger *zap.Logger
+	codes  map[string]struct{}
+	f      *fetcher
+
+	rules atomic.Pointer[ruleSet]
+	hits  data_provider.HitCounter
+
+	fromCache bool       // the list was loaded from the cache file at startup
+	updateMu  sync.Mutex // serializes updates
+
+	statusMu sync.Mutex
+	status   Status // URL, Format and Rules are not set
+	errTotal atomic.Uint64
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// DomainRuleProvider is a RuleProvider of a domain format.
+type DomainRuleProvider struct {
+	*RuleProvider
+}
+
+func (p *DomainRuleProvider) GetDomainMatcher() domain.Matcher[struct{}] {
+	return domainMatcher{p: p.RuleProvider}
+}
+
+func (p *DomainRuleProvider) GetUncountedDomainMatcher() domain.Matcher[struct{}] {
+	return domainMatcher{p: p.RuleProvider, uncounted: true}
+}
+
+// IPRuleProvider is a RuleProvider of an ip format.
+type IPRuleProvider struct {
+	*RuleProvider
+}
+
+func (p *IPRuleProvider) GetIPMatcher() netlist.Matcher {
+	return ipMatcher{p: p.RuleProvider}
+}
+
+func (p *IPRuleProvider) GetUncountedIPMatcher() netlist.Matcher {
+	return ipMatcher{p: p.RuleProvider, uncounted: true}
+}
+
+type domainMatcher struct {
+	p         *RuleProvider
+	uncounted bool // don't update hit counters
+}
+
+func (m domainMatcher) Match(s string) (struct{}, bool) {
+	_, ok := m.p.rules.Load().d.Match(s)
+	if m.uncounted {
+		return struct{}{}, ok
+	}
+	return struct{}{}, m.p.hits.Observe(ok)
+}
+
+type ipMatcher struct {
+	p         *RuleProvider
+	uncounted bool // don't update hit counters
+}
+
+func (m ipMatcher) Match(addr netip.Addr) bool {
+	ok := m.p.rules.Load().ip.Match(addr)
+	if m.uncounted {
+		return ok
+	}
+	return m.p.hits.Observe(ok)
+}
+
+// NewRuleProvider loads the cache file. If there is no cache, the
+// provider starts with an empty list. Nothing is downloaded until the
+// updates are started.
+func NewRuleProvider(args *Args, logger *zap.Logger) (*RuleProvider, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	p := &RuleProvider{
+		args:   args,
+		logger: logger,
+		codes:  make(map[string]struct{}),
+		f: &fetcher{
+			url:    args.URL,
+			sigURL: args.SignatureURL,
+			hc:     &http.Client{Timeout: time.Duration(args.Timeout) * time.Second},
+		},
+		closeNotify: make(chan struct{}),
+	}
+	for _, c := range args.Codes {
+		p.codes[strings.ToLower(c)] = struct{}{}
+	}
+	if len(args.PublicKey) > 0 {
+		k, err := parsePublicKey(args.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key, %w", err)
+		}
+		p.f.pubKey = k
+	}
+
+	if len(args.CacheFile) > 0 {
+		if err := p.loadCache(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("failed to load cache file", zap.String("file", args.CacheFile), zap.Error(err))
+		}
+		p.fromCache = p.rules.Load() != nil
+	}
+	if p.rules.Load() == nil {
+		p.rules.Store(emptyRuleSet(args.Format))
+	}
+	return p, nil
+}
+
+func (p *RuleProvider) loadCache() error {
+	b, err := os.ReadFile(p.args.CacheFile)
+	if err != nil {
+		return err
+	}
+	rs, err := parseRules(b, p.args.Format, p.codes)
+	if err != nil {
+		return err
+	}
+	p.rules.Store(rs)
+	return nil
+}
+
+// Failed updates are retried after firstRetryInterval, doubled after
+// each failure up to maxRetryInterval (or the update interval if it's
+// shorter).
+var (
+	firstRetryInterval = time.Second * 10
+	maxRetryInterval   = time.Hour
+)
+
+// start starts updates in the background. The list is updated
+// immediately. If periodic updates are disabled, a list from the cache
+// file is not updated, and an empty list is updated until it succeeds.
+func (p *RuleProvider) start() {
+	if p.args.Interval <= 0 && p.fromCache {
+		return
+	}
+	go p.updateLoop()
+}
+
+func (p *RuleProvider) updateLoop() {
+	interval := time.Duration(p.args.Interval) * time.Second
+	maxRetry := maxRetryInterval
+	if interval > 0 && interval < maxRetry {
+		maxRetry = interval
+	}
+	retry := firstRetryInterval
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-p.closeNotify:
+			return
+		}
+		if err := p.updateAndLog(); err != nil {
+			timer.Reset(retry)
+			retry = min(retry*2, maxRetry)
+			continue
+		}
+		if interval <= 0 {
+			return
+		}
+		retry = firstRetryInterval
+		timer.Reset(interval)
+	}
+}
+
+func (p *RuleProvider) updateAndLog() error {
+	updated, err := p.update(context.Background())
+	if err != nil {
+		p.logger.Warn("failed to update rules", zap.String("url", p.args.URL), zap.Error(err))
+		return err
+	}
+	if updated {
+		p.logger.Info("rules updated", zap.String("url", p.args.URL), zap.Int("rules", p.rules.Load().n))
+	}
+	return nil
+}
+
+// update downloads and applies the list. It reports whether the list was
+// changed.
+func (p *RuleProvider) update(ctx context.Context) (bool, error) {
+	p.updateMu.Lock()
+	defer p.updateMu.Unlock()
+	updated, err := p.fetchAndApply(ctx)
+	if err != nil {
+		p.errTotal.Add(1)
+	}
+
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	p.status.LastCheck = time.Now()
+	p.status.LastError = ""
+	if err != nil {
+		p.status.LastError = err.Error()
+	}
+	if updated {
+		p.status.LastUpdate = p.status.LastCheck
+		p.status.ETag = p.f.v.etag
+	}
+	return updated, err
+}
+
+func (p *RuleProvider) fetchAndApply(ctx context.Context) (bool, error) {
+	b, v, err := p.f.fetch(ctx)
+	if err != nil {
+		if errors.Is(err, errNotModified) {
+			return false, nil
+		}
+		return false, err
+	}
+	rs, err := parseRules(b, p.args.Format, p.codes)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse rules, %w", err)
+	}
+	p.rules.Store(rs)
+	p.f.v = v
+	if len(p.args.CacheFile) > 0 {
+		if err := writeFileAtomic(p.args.CacheFile, b); err != nil {
+			p.logger.Warn("failed to write cache file", zap.String("file", p.args.CacheFile), zap.Error(err))
+		}
+	}
+	return true, nil
+}
+
+func writeFileAtomic(name string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// ReloadData downloads the list now.
+func (p *RuleProvider) ReloadData() error {
+	_, err := p.update(context.Background())
+	return err
+}
+
+func (p *RuleProvider) Close() error {
+	p.closeOnce.Do(func() { close(p.closeNotify) })
+	return nil
+}
+
+// Status is the update status of a RuleProvider.
+type Status struct {
+	URL        string    `json:"url"`
+	Format     string    `json:"format"`
+	Rules      int       `json:"rules"`
+	LastUpdate time.Time `json:"last_update"`
+	LastCheck  time.Time `json:"last_check"`
+	LastError  string    `json:"last_error,omitempty"`
+	ETag       string    `json:"etag,omitempty"`
+}
+
+func (p *RuleProvider) Status() Status {
+	p.statusMu.Lock()
+	s := p.status
+	p.statusMu.Unlock()
+	s.URL = p.args.URL
+	s.Format = p.args.Format
+	s.Rules = p.rules.Load().n
+	return s
+}
+
+// Api serves hit counters at "/hits", the status at "/status" and
+// triggers an update by "POST /update".
+func (p *RuleProvider) Api() *chi.Mux {
+	r := p.hits.Api()
+	r.Get("/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.Status())
+	})
+	r.Post("/update", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := p.update(req.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.Status())
+	})
+	return r
+}
+
+func (p *RuleProvider) collectors(tag string) []prometheus.Collector {
+	lb := map[string]string{"tag": tag}
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "rules",
+			Help:        "The number of rules in the current list",
+			ConstLabels: lb,
+		}, func() float64 { return float64(p.rules.Load().n) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "last_update_timestamp_seconds",
+			Help:        "The unix time of the last successful update that changed the list",
+			ConstLabels: lb,
+		}, func() float64 {
+			if t := p.Status().LastUpdate; !t.IsZero() {
+				return float64(t.Unix())
+			}
+			return 0
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "update_err_total",
+			Help:        "The total number of failed updates",
+			ConstLabels: lb,
+		}, func() float64 { return float64(p.errTotal.Load()) }),
+	}
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rule_provider
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ruleServer serves a rule file with an ETag and its signature.
+type ruleServer struct {
+	mu      sync.Mutex
+	body    []byte
+	etag    string
+	sig     []byte
+	hits    int // 200 responses
+	notMods int // 304 responses
+}
+
+func (s *ruleServer) set(body []byte, etag string, key ed25519.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.etag = body, etag
+	if key != nil {
+		s.sig = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, body)))
+	}
+}
+
+func (s *ruleServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path == "/rules.sig" {
+		_, _ = w.Write(s.sig)
+		return
+	}
+	if r.Header.Get("If-None-Match") == s.etag {
+		s.notMods++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.hits++
+	w.Header().Set("ETag", s.etag)
+	_, _ = w.Write(s.body)
+}
+
+func TestRuleProvider_Update(t *testing.T) {
+	rs := new(ruleServer)
+	rs.set([]byte("a.com\nfull:b.com\n"), `"1"`, nil)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	cache := filepath.Join(t.TempDir(), "rules.txt")
+	p, err := NewRuleProvider(&Args{URL: srv.URL + "/rules", CacheFile: cache}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := (&DomainRuleProvider{p}).GetDomainMatcher()
+	if _, ok := m.Match("www.a.com."); ok || rs.hits != 0 {
+		t.Fatal("want an empty list without downloading")
+	}
+	if updated, err := p.update(context.Background()); err != nil || !updated {
+		t.Fatalf("want updated, got %v %v", updated, err)
+	}
+	if _, ok := m.Match("www.a.com."); !ok {
+		t.Fatal("want www.a.com matched")
+	}
+
+	// Not modified.
+	if updated, err := p.update(context.Background()); err != nil || updated {
+		t.Fatalf("want not updated, got %v %v", updated, err)
+	}
+	if rs.notMods != 1 {
+		t.Fatalf("want a conditional request, got %d 304s", rs.notMods)
+	}
+
+	// Updated.
+	rs.set([]byte("c.com\n"), `"2"`, nil)
+	if updated, err := p.update(context.Background()); err != nil || !updated {
+		t.Fatalf("want updated, got %v %v", updated, err)
+	}
+	if _, ok := m.Match("a.com."); ok {
+		t.Fatal("old rules should be replaced")
+	}
+	if _, ok := m.Match("c.com."); !ok {
+		t.Fatal("want c.com matched")
+	}
+
+	// Broken lists keep the old rules.
+	for i, body := range []string{"regexp:(\n", "<!DOCTYPE html>\n<html>\n", "# empty\n"} {
+		rs.set([]byte(body), `"3`+strconv.Itoa(i)+`"`, nil)
+		if _, err := p.update(context.Background()); err == nil {
+			t.Fatalf("want an error for %q", body)
+		}
+	}
+	if _, ok := m.Match("c.com."); !ok {
+		t.Fatal("want old rules kept")
+	}
+	if s := p.Status(); s.LastError == "" || s.ETag != `"2"` || s.Rules != 1 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+
+	// The cache file is used if the server is down.
+	srv.Close()
+	p2, err := NewRuleProvider(&Args{URL: srv.URL + "/rules", CacheFile: cache}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := (&DomainRuleProvider{p2}).GetDomainMatcher().Match("c.com."); !ok || !p2.fromCache {
+		t.Fatal("want rules from the cache file")
+	}
+}
+
+// An empty provider downloads the list in the background and retries
+// failures.
+func TestRuleProvider_Start(t *testing.T) {
+	defer func(d time.Duration) { firstRetryInterval = d }(firstRetryInterval)
+	firstRetryInterval = time.Millisecond * 10
+
+	var fails atomic.Int32
+	fails.Store(2)
+	rs := new(ruleServer)
+	rs.set([]byte("a.com\n"), `"1"`, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fails.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rs.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	p, err := NewRuleProvider(&Args{URL: srv.URL + "/rules", Interval: -1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.start()
+	m := (&DomainRuleProvider{p}).GetDomainMatcher()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		if _, ok := m.Match("a.com."); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rules were not downloaded")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if p.errTotal.Load() != 2 {
+		t.Fatalf("want 2 failed updates, got %d", p.errTotal.Load())
+	}
+}
+
+func TestRuleProvider_Signature(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	rs := new(ruleServer)
+	rs.set([]byte("1.0.0.0/8\n"), `"1"`, key)
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	args := &Args{URL: srv.URL + "/rules", Format: "ip", PublicKey: base64.StdEncoding.EncodeToString(pub)}
+	p, err := NewRuleProvider(args, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !(&IPRuleProvider{p}).GetIPMatcher().Match(netip.MustParseAddr("1.2.3.4")) {
+		t.Fatal("want 1.2.3.4 matched")
+	}
+
+	rs.set([]byte("2.0.0.0/8\n"), `"2"`, otherKey)
+	if _, err := p.update(context.Background()); err == nil {
+		t.Fatal("want a signature error")
+	}
+	if (&IPRuleProvider{p}).GetIPMatcher().Match(netip.MustParseAddr("2.2.3.4")) {
+		t.Fatal("unsigned rules should not be applied")
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	hosts := `
+127.0.0.1 localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.com tracker.com # comment
+`
+	rs, err := parseRules([]byte(hosts), formatHosts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rs.d.Match("ads.com."); !ok || rs.n != 2 {
+		t.Fatalf("unexpected hosts rules, n = %d", rs.n)
+	}
+	if _, ok := rs.d.Match("sub.ads.com."); ok {
+		t.Fatal("hosts names should be full domains")
+	}
+
+	var site []byte
+	site = appendEntry(site, "CN", func(b []byte) []byte {
+		b = appendGeoSiteDomain(b, geositeDomain, "cn.com")
+		return appendGeoSiteDomain(b, geositeFull, "full.com")
+	})
+	site = appendEntry(site, "US", func(b []byte) []byte {
+		return appendGeoSiteDomain(b, geositeDomain, "us.com")
+	})
+	rs, err = parseRules(site, formatGeoSite, map[string]struct{}{"cn": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s, want := range map[string]bool{"a.cn.com.": true, "full.com.": true, "a.full.com.": false, "us.com.": false} {
+		if _, ok := rs.d.Match(s); ok != want {
+			t.Errorf("geosite Match(%s) = %v, want %v", s, ok, want)
+		}
+	}
+	if _, err := parseRules([]byte("0.0.0.0 <html>\n"), formatHosts, nil); err == nil {
+		t.Fatal("invalid hosts names should fail")
+	}
+	if _, err := parseRules(site, formatGeoSite, map[string]struct{}{"jp": {}}); err == nil {
+		t.Fatal("missing code should fail")
+	}
+
+	var geoip []byte
+	geoip = appendEntry(geoip, "CN", func(b []byte) []byte {
+		return appendCIDR(b, []byte{1, 0, 0, 0}, 8)
+	})
+	rs, err = parseRules(geoip, formatGeoIP, map[string]struct{}{"cn": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs.ip.Match(netip.MustParseAddr("1.2.3.4")) || rs.ip.Match(netip.MustParseAddr("2.2.3.4")) {
+		t.Fatal("unexpected geoip rules")
+	}
+}
+
+func appendEntry(b []byte, code string, fields func(b []byte) []byte) []byte {
+	var e []byte
+	e = protowire.AppendTag(e, 1, protowire.BytesType)
+	e = protowire.AppendString(e, code)
+	e = fields(e)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, e)
+}
+
+func appendGeoSiteDomain(b []byte, typ uint64, value string) []byte {
+	var d []byte
+	d = protowire.AppendTag(d, 1, protowire.VarintType)
+	d = protowire.AppendVarint(d, typ)
+	d = protowire.AppendTag(d, 2, protowire.BytesType)
+	d = protowire.AppendString(d, value)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, d)
+}
+
+func appendCIDR(b []byte, ip []byte, bits uint64) []byte {
+	var c []byte
+	c = protowire.AppendTag(c, 1, protowire.BytesType)
+	c = protowire.AppendBytes(c, ip)
+	c = protowire.AppendTag(c, 2, protowire.VarintType)
+	c = protowire.AppendVarint(c, bits)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, c)
+}
@@ -24,13 +24,19 @@ import (
 	// data provider
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/ip_set"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/rule_provider"
 
 	// matcher
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/captive_portal"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/client_group"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/client_id"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/client_ip"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/client_matcher"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/cname"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/env"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/has_resp"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/has_wanted_ans"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/mmdb"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/ptr_ip"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/qclass"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/qname"
@@ -41,34 +47,67 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/string_exp"
 
 	// executable
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/aaaa_suppress"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/alert"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/arbitrary"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/auth_zone"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/black_hole"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/blocklist"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/cache"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/chaos"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/debug_print"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dhcp_leases"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dns64"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/drop_resp"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dual_selector"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ecs_handler"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/edns0_meta"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/failover"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/family_policy"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/fault"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/forward"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/forward_edns0opt"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/health_domain"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/hosts"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ipset"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/mdns_bridge"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/metrics_collector"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/nftset"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/override"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/query_log"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/query_stats"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/query_summary"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/rate_limiter"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/redirect"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/reverse_lookup"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/rpz"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/rrl"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/script"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence/fallback"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sleep"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/special_domain"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/top_n"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ttl"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ttl_override"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/wol"
 
 	// executable and matcher
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/mark"
 
 	// server
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/dyn_hosts"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/http_server"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/mdns_publisher"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/quic_server"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/tcp_server"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/udp_server"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/update_server"
+
+	// system integration
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/system/ddns"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/system/macos_resolver"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/system/odhcpd_dns"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/system/port_mapping"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/system/windows_dns"
 )
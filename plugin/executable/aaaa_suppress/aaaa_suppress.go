@@ -0,0 +1,272 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aaaa_suppress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	base "github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_domain"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const PluginType = "aaaa_suppress"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	cacheSize       = 16 * 1024
+	maxProbeAddrs   = 4
+	cacheGcInterval = time.Minute
+)
+
+// Args configures AAAA suppression. AAAA queries of matched domains get
+// empty (NODATA) responses if Always is set, or if recent probes show that
+// their ipv6 addresses are unreachable, so clients with broken ipv6 won't
+// try ipv6 first and wait for timeouts.
+type Args struct {
+	// Domains that this plugin acts on. Empty means all domains.
+	Exps       []string `yaml:"exps"`
+	DomainSets []string `yaml:"domain_sets"`
+	Files      []string `yaml:"files"`
+
+	// Always suppresses AAAA answers of matched domains without probing.
+	Always bool `yaml:"always"`
+
+	// Probes connect to ipv6 addresses in AAAA answers by tcp. Addresses
+	// are reachable if any of them accepts or refuses the connection.
+	ProbePort    int `yaml:"probe_port"`    // default is 443
+	ProbeTimeout int `yaml:"probe_timeout"` // (milliseconds) default is 1000
+	ProbeTTL     int `yaml:"probe_ttl"`     // (seconds) results are kept for this long, default is 600
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultNum(&a.ProbePort, 443)
+	utils.SetDefaultNum(&a.ProbeTimeout, 1000)
+	utils.SetDefaultNum(&a.ProbeTTL, 600)
+	if !utils.CheckNumRange(a.ProbePort, 1, 65535) {
+		return fmt.Errorf("invalid probe_port %d", a.ProbePort)
+	}
+	return nil
+}
+
+// probeFunc reports whether any of addrs is reachable.
+type probeFunc func(ctx context.Context, addrs []netip.Addr) bool
+
+var _ sequence.RecursiveExecutable = (*Suppressor)(nil)
+
+type Suppressor struct {
+	args    Args
+	logger  *zap.Logger
+	matcher sequence.Matcher // nil means all domains
+	probe   probeFunc
+
+	// Probe results of domains. True means reachable.
+	results *cache.Cache[key, bool]
+	mu      sync.Mutex
+	probing map[key]struct{}
+
+	suppressedTotal    prometheus.Counter
+	probeFailuresTotal prometheus.Counter
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if err := a.init(); err != nil {
+		return nil, err
+	}
+	var matcher sequence.Matcher
+	if len(a.Exps)+len(a.DomainSets)+len(a.Files) > 0 {
+		m, err := base.NewMatcher(bp, &base.Args{Exps: a.Exps, DomainSets: a.DomainSets, Files: a.Files}, matchQName)
+		if err != nil {
+			return nil, err
+		}
+		matcher = m
+	}
+	s := NewSuppressor(*a, matcher, tcpProbe(a.ProbePort, time.Duration(a.ProbeTimeout)*time.Millisecond))
+	s.logger = bp.L()
+
+	return s, nil
+}
+
+// NewSuppressor creates a Suppressor. args must be initialized. matcher can
+// be nil, which matches all domains.
+func NewSuppressor(args Args, matcher sequence.Matcher, probe probeFunc) *Suppressor {
+	return &Suppressor{
+		args:    args,
+		logger:  zap.NewNop(),
+		matcher: matcher,
+		probe:   probe,
+		results: cache.New[key, bool](cache.Opts{Size: cacheSize, CleanerInterval: cacheGcInterval}),
+		probing: make(map[key]struct{}),
+		suppressedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "suppressed_total",
+			Help: "The total number of AAAA queries that got empty responses",
+		}),
+		probeFailuresTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "probe_failures_total",
+			Help: "The total number of probes that found ipv6 addresses unreachable",
+		}),
+	}
+}
+
+// Metrics implements coremain.MetricsProvider.
+func (s *Suppressor) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{s.suppressedTotal, s.probeFailuresTotal}
+}
+
+func (s *Suppressor) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeAAAA {
+		return next.ExecNext(ctx, qCtx)
+	}
+	if s.matcher != nil {
+		ok, err := s.matcher.Match(ctx, qCtx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return next.ExecNext(ctx, qCtx)
+		}
+	}
+
+	k := key(strings.ToLower(q.Question[0].Name))
+	if reachable, _, probed := s.results.Get(k); s.args.Always || (probed && !reachable) {
+		s.suppressedTotal.Inc()
+		qCtx.SetResponse(dnsutils.GenEmptyReply(q, dns.RcodeSuccess))
+		return nil
+	}
+
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	if r := qCtx.R(); r != nil {
+		if addrs := aaaaAddrs(r); len(addrs) > 0 {
+			s.startProbe(k, addrs)
+		}
+	}
+	return nil
+}
+
+// startProbe probes addrs of domain k in the background, unless there is
+// already a result or a probe of k.
+func (s *Suppressor) startProbe(k key, addrs []netip.Addr) {
+	if _, _, ok := s.results.Get(k); ok {
+		return
+	}
+	s.mu.Lock()
+	if _, dup := s.probing[k]; dup {
+		s.mu.Unlock()
+		return
+	}
+	s.probing[k] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.probing, k)
+			s.mu.Unlock()
+		}()
+		reachable := s.probe(context.Background(), addrs)
+		if !reachable {
+			s.probeFailuresTotal.Inc()
+			s.logger.Info("ipv6 addresses are unreachable, suppressing AAAA answers", zap.String("domain", string(k)), zap.Int("ttl", s.args.ProbeTTL))
+		}
+		s.results.Store(k, reachable, time.Now().Add(time.Duration(s.args.ProbeTTL)*time.Second))
+	}()
+}
+
+func (s *Suppressor) Close() error {
+	return s.results.Close()
+}
+
+func matchQName(qCtx *query_context.Context, m domain.Matcher[struct{}]) (bool, error) {
+	_, ok := m.Match(qCtx.Q().Question[0].Name)
+	return ok, nil
+}
+
+func aaaaAddrs(r *dns.Msg) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rr := range r.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok {
+			if a, ok := netip.AddrFromSlice(aaaa.AAAA); ok {
+				addrs = append(addrs, a)
+				if len(addrs) >= maxProbeAddrs {
+					break
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// tcpProbe returns a probeFunc that connects to addrs in parallel.
+func tcpProbe(port int, timeout time.Duration) probeFunc {
+	return func(ctx context.Context, addrs []netip.Addr) bool {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		res := make(chan bool, len(addrs))
+		for _, addr := range addrs {
+			go func(addr netip.Addr) {
+				var d net.Dialer
+				c, err := d.DialContext(ctx, "tcp6", netip.AddrPortFrom(addr, uint16(port)).String())
+				if err == nil {
+					c.Close()
+				}
+				// A refused connection still means the path works.
+				res <- err == nil || errors.Is(err, syscall.ECONNREFUSED)
+			}(addr)
+		}
+		for range addrs {
+			if <-res {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+type key string
+
+var seed = maphash.MakeSeed()
+
+func (k key) Sum() uint64 {
+	return maphash.String(seed, string(k))
+}
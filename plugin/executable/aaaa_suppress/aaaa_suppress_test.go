@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aaaa_suppress
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func TestSuppressor_Exec(t *testing.T) {
+	var probes atomic.Int32
+	unreachable := func(_ context.Context, _ []netip.Addr) bool {
+		probes.Add(1)
+		return false
+	}
+	s := NewSuppressor(Args{ProbeTTL: 60}, nil, unreachable)
+	defer s.Close()
+
+	answer := plugintest.Answer("@ 300 IN AAAA 2001:db8::1")
+	exec := func(qtype uint16) *dns.Msg {
+		qCtx := plugintest.NewQuery("Example.com", qtype).Build()
+		if err := plugintest.Exec(t, s, qCtx, answer); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R()
+	}
+
+	// The first answer passes, and starts a probe.
+	if r := exec(dns.TypeAAAA); len(r.Answer) != 1 {
+		t.Fatalf("want the original answer, got %v", r)
+	}
+	for i := 0; i < 100; i++ {
+		if _, _, ok := s.results.Get("example.com."); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Unreachable, suppressed. The name is case-insensitive.
+	r := exec(dns.TypeAAAA)
+	if len(r.Answer) != 0 || r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("want NODATA, got %v", r)
+	}
+	if n := probes.Load(); n != 1 {
+		t.Fatalf("want 1 probe, got %d", n)
+	}
+}
+
+func TestSuppressor_Always(t *testing.T) {
+	s := NewSuppressor(Args{Always: true}, nil, nil)
+	defer s.Close()
+
+	qCtx := plugintest.NewQuery("example.com", dns.TypeAAAA).Build()
+	if err := plugintest.Exec(t, s, qCtx, plugintest.Answer("@ 300 IN AAAA 2001:db8::1")); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); len(r.Answer) != 0 {
+		t.Fatalf("want NODATA, got %v", r)
+	}
+
+	// Other types are untouched.
+	qCtx = plugintest.NewQuery("example.com", dns.TypeA).Build()
+	if err := plugintest.Exec(t, s, qCtx, plugintest.Answer("@ 300 IN A 192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); len(r.Answer) != 1 {
+		t.Fatalf("want the original answer, got %v", r)
+	}
+}
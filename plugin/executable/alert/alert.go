@@ -0,0 +1,293 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "alert"
+
+const hookTimeout = time.Second * 10
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*Alert)(nil)
+
+type Args struct {
+	// Window is the evaluation window in seconds. Default is 60.
+	Window int `yaml:"window"`
+	// MinQueries is the minimum number of queries in a window to
+	// evaluate rates. Default is 20.
+	MinQueries int `yaml:"min_queries"`
+	// Cooldown in seconds before the same alert fires again. Default is 600.
+	Cooldown int `yaml:"cooldown"`
+
+	// Rate thresholds in [0, 1]. 0 disables the check.
+	ServfailRate float64 `yaml:"servfail_rate"`
+	NxdomainRate float64 `yaml:"nxdomain_rate"`
+	// ErrorRate is the rate of queries that following plugins failed
+	// to process, e.g. upstreams are down.
+	ErrorRate float64 `yaml:"error_rate"`
+
+	// Hooks.
+	Webhook string      `yaml:"webhook"` // POST alerts as json.
+	Exec    []string    `yaml:"exec"`    // Command and its args. Alert json is written to stdin.
+	Email   EmailConfig `yaml:"email"`
+}
+
+type EmailConfig struct {
+	SMTP     string   `yaml:"smtp"` // host:port
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultUnsignNum(&a.Window, 60)
+	utils.SetDefaultUnsignNum(&a.MinQueries, 20)
+	utils.SetDefaultUnsignNum(&a.Cooldown, 600)
+	for _, r := range [...]float64{a.ServfailRate, a.NxdomainRate, a.ErrorRate} {
+		if r < 0 || r > 1 {
+			return fmt.Errorf("invalid rate %v, must be in [0, 1]", r)
+		}
+	}
+	if len(a.Webhook) == 0 && len(a.Exec) == 0 && len(a.Email.SMTP) == 0 {
+		return errors.New("no alert hook is configured")
+	}
+	if len(a.Email.SMTP) > 0 && (len(a.Email.From) == 0 || len(a.Email.To) == 0) {
+		return errors.New("email hook requires from and to")
+	}
+	return nil
+}
+
+// Event is an alert that is sent to hooks.
+type Event struct {
+	Tag       string    `json:"tag"`
+	Kind      string    `json:"kind"` // "servfail", "nxdomain" or "error".
+	Rate      float64   `json:"rate"`
+	Threshold float64   `json:"threshold"`
+	Queries   uint64    `json:"queries"`
+	Window    int       `json:"window"`
+	Time      time.Time `json:"time"`
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("mosdns %s: %s rate %.2f%% exceeded threshold %.2f%% (%d queries in %ds)",
+		e.Tag, e.Kind, e.Rate*100, e.Threshold*100, e.Queries, e.Window)
+}
+
+type Alert struct {
+	tag    string
+	args   *Args
+	logger *zap.Logger
+
+	total    atomic.Uint64
+	servfail atomic.Uint64
+	nxdomain atomic.Uint64
+	errs     atomic.Uint64
+
+	lastFired map[string]time.Time // only accessed by the loop goroutine
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewAlert(args.(*Args), bp.Tag(), bp.L())
+}
+
+func NewAlert(args *Args, tag string, logger *zap.Logger) (*Alert, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	a := &Alert{
+		tag:       tag,
+		args:      args,
+		logger:    logger,
+		lastFired: make(map[string]time.Time),
+		closed:    make(chan struct{}),
+	}
+	go a.loop()
+	return a, nil
+}
+
+func (a *Alert) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	err := next.ExecNext(ctx, qCtx)
+	a.total.Add(1)
+	if err != nil {
+		a.errs.Add(1)
+		return err
+	}
+	if r := qCtx.R(); r != nil {
+		switch r.Rcode {
+		case dns.RcodeServerFailure:
+			a.servfail.Add(1)
+		case dns.RcodeNameError:
+			a.nxdomain.Add(1)
+		}
+	}
+	return nil
+}
+
+func (a *Alert) loop() {
+	ticker := time.NewTicker(time.Duration(a.args.Window) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.evaluate(time.Now())
+		case <-a.closed:
+			return
+		}
+	}
+}
+
+// evaluate checks rates of the last window and resets counters.
+func (a *Alert) evaluate(now time.Time) {
+	total := a.total.Swap(0)
+	servfail := a.servfail.Swap(0)
+	nxdomain := a.nxdomain.Swap(0)
+	errs := a.errs.Swap(0)
+	if total == 0 || total < uint64(a.args.MinQueries) {
+		return
+	}
+
+	checks := [...]struct {
+		kind      string
+		n         uint64
+		threshold float64
+	}{
+		{"servfail", servfail, a.args.ServfailRate},
+		{"nxdomain", nxdomain, a.args.NxdomainRate},
+		{"error", errs, a.args.ErrorRate},
+	}
+	for _, c := range checks {
+		if c.threshold <= 0 {
+			continue
+		}
+		rate := float64(c.n) / float64(total)
+		if rate < c.threshold {
+			continue
+		}
+		if t, ok := a.lastFired[c.kind]; ok && now.Sub(t) < time.Duration(a.args.Cooldown)*time.Second {
+			continue
+		}
+		a.lastFired[c.kind] = now
+		e := &Event{
+			Tag:       a.tag,
+			Kind:      c.kind,
+			Rate:      rate,
+			Threshold: c.threshold,
+			Queries:   total,
+			Window:    a.args.Window,
+			Time:      now,
+		}
+		a.logger.Warn("alert fired", zap.Stringer("alert", e))
+		go a.fire(e)
+	}
+}
+
+func (a *Alert) fire(e *Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	b, _ := json.Marshal(e)
+
+	if u := a.args.Webhook; len(u) > 0 {
+		if err := postWebhook(ctx, u, b); err != nil {
+			a.logger.Error("failed to call alert webhook", zap.Error(err))
+		}
+	}
+	if len(a.args.Exec) > 0 {
+		cmd := exec.CommandContext(ctx, a.args.Exec[0], a.args.Exec[1:]...)
+		cmd.Stdin = bytes.NewReader(b)
+		cmd.Env = append(cmd.Environ(),
+			"MOSDNS_ALERT_KIND="+e.Kind,
+			"MOSDNS_ALERT_RATE="+strconv.FormatFloat(e.Rate, 'f', 4, 64),
+			"MOSDNS_ALERT_MESSAGE="+e.String(),
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			a.logger.Error("failed to exec alert command", zap.Error(err), zap.ByteString("output", out))
+		}
+	}
+	if len(a.args.Email.SMTP) > 0 {
+		if err := sendEmail(a.args.Email, e); err != nil {
+			a.logger.Error("failed to send alert email", zap.Error(err))
+		}
+	}
+}
+
+func postWebhook(ctx context.Context, url string, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func sendEmail(c EmailConfig, e *Event) error {
+	var auth smtp.Auth
+	if len(c.Username) > 0 {
+		host, _, err := net.SplitHostPort(c.SMTP)
+		if err != nil {
+			return fmt.Errorf("invalid smtp addr, %w", err)
+		}
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [mosdns] %s alert\r\n\r\n%s\r\n",
+		c.From, strings.Join(c.To, ", "), e.Kind, e.String())
+	return smtp.SendMail(c.SMTP, auth, c.From, c.To, []byte(msg))
+}
+
+func (a *Alert) Close() error {
+	a.closeOnce.Do(func() { close(a.closed) })
+	return nil
+}
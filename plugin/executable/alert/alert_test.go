@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestAlert_evaluate(t *testing.T) {
+	events := make(chan Event, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer srv.Close()
+
+	a, err := NewAlert(&Args{Window: 3600, MinQueries: 10, ServfailRate: 0.5, Webhook: srv.URL}, "test", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	// Below min_queries.
+	a.total.Store(5)
+	a.servfail.Store(5)
+	a.evaluate(time.Now())
+
+	a.total.Store(10)
+	a.servfail.Store(6)
+	a.evaluate(time.Now())
+	select {
+	case e := <-events:
+		if e.Kind != "servfail" || e.Queries != 10 {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("alert not fired")
+	}
+
+	// In cooldown.
+	a.total.Store(10)
+	a.servfail.Store(10)
+	a.evaluate(time.Now())
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event in cooldown %+v", e)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
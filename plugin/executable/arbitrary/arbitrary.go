@@ -25,9 +25,9 @@ import (
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
 	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
-	"os"
 	"strings"
 )
 
@@ -48,7 +48,7 @@ type Arbitrary struct {
 	m *zone_file.Matcher
 }
 
-func NewArbitrary(args *Args) (*Arbitrary, error) {
+func NewArbitrary(args *Args, ss remote.Storages) (*Arbitrary, error) {
 	m := new(zone_file.Matcher)
 	for i, s := range args.Rules {
 		if err := m.Load(strings.NewReader(s)); err != nil {
@@ -56,7 +56,7 @@ func NewArbitrary(args *Args) (*Arbitrary, error) {
 		}
 	}
 	for i, file := range args.Files {
-		b, err := os.ReadFile(file)
+		b, err := ss.ReadFile(file)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read file #%d [%s], %w", i, file, err)
 		}
@@ -76,7 +76,7 @@ func (a *Arbitrary) Exec(_ context.Context, qCtx *query_context.Context) error {
 	return nil
 }
 
-func Init(_ *coremain.BP, v any) (any, error) {
+func Init(bp *coremain.BP, v any) (any, error) {
 	args := v.(*Args)
-	return NewArbitrary(args)
+	return NewArbitrary(args, bp.M().Storages())
 }
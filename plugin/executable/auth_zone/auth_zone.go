@@ -0,0 +1,165 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth_zone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "auth_zone"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*AuthZone)(nil)
+var _ coremain.DataFileProvider = (*AuthZone)(nil)
+
+// Args configures authoritative zones. Zones are RFC 1035 zone files.
+type Args struct {
+	Zones []ZoneArgs `yaml:"zones"`
+}
+
+// ZoneArgs is a zone file.
+type ZoneArgs struct {
+	Name string `yaml:"name"` // Zone origin. Default is the owner of the SOA record in File.
+	File string `yaml:"file"` // Required.
+}
+
+func (a *Args) init() error {
+	if len(a.Zones) == 0 {
+		return errors.New("no zone is configured")
+	}
+	for i, z := range a.Zones {
+		if len(z.File) == 0 {
+			return fmt.Errorf("zone #%d has no file", i)
+		}
+		if len(z.Name) > 0 {
+			if _, ok := dns.IsDomainName(z.Name); !ok {
+				return fmt.Errorf("zone #%d has an invalid name %s", i, z.Name)
+			}
+			a.Zones[i].Name = dns.Fqdn(z.Name)
+		}
+	}
+	return nil
+}
+
+// AuthZone answers queries of names in its zones authoritatively, with
+// wildcards (RFC 4592), CNAMEs in the zone, delegations and negative
+// responses with the zone SOA. Queries of other names go to the rest of
+// the sequence.
+type AuthZone struct {
+	args  *Args
+	ss    remote.Storages
+	zones atomic.Pointer[[]*zone] // longest origin first
+
+	reloadMu sync.Mutex // serializes reloads
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewAuthZone(args.(*Args), bp.M().Storages())
+}
+
+// NewAuthZone loads zone files. Files in remote storages are read
+// from ss.
+func NewAuthZone(args *Args, ss remote.Storages) (*AuthZone, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	a := &AuthZone{
+		args: args,
+		ss:   ss,
+	}
+	if err := a.ReloadData(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ReloadData loads zone files again. The old zones are kept if any file
+// fails.
+func (a *AuthZone) ReloadData() error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+	zones := make([]*zone, 0, len(a.args.Zones))
+	origins := make(map[string]struct{})
+	for i, za := range a.args.Zones {
+		b, err := a.ss.ReadFile(za.File)
+		if err != nil {
+			return fmt.Errorf("failed to read zone file #%d %s, %w", i, za.File, err)
+		}
+		z, err := parseZone(b, za.Name, za.File)
+		if err != nil {
+			return fmt.Errorf("failed to load zone file #%d %s, %w", i, za.File, err)
+		}
+		if _, dup := origins[z.origin]; dup {
+			return fmt.Errorf("duplicated zone %s", z.origin)
+		}
+		origins[z.origin] = struct{}{}
+		zones = append(zones, z)
+	}
+	sort.SliceStable(zones, func(i, j int) bool { return len(zones[i].origin) > len(zones[j].origin) })
+	a.zones.Store(&zones)
+	return nil
+}
+
+// DataFiles implements coremain.DataFileProvider.
+func (a *AuthZone) DataFiles() []string {
+	files := make([]string, 0, len(a.args.Zones))
+	for _, z := range a.args.Zones {
+		files = append(files, z.File)
+	}
+	return files
+}
+
+// Response returns the response of q, or nil if q is not in any zone.
+// If do is true, NODATA responses have an unsigned NSEC record.
+func (a *AuthZone) Response(q *dns.Msg, do bool) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	name := strings.ToLower(q.Question[0].Name)
+	for _, z := range *a.zones.Load() {
+		if dns.IsSubDomain(z.origin, name) {
+			return z.response(q, do)
+		}
+	}
+	return nil
+}
+
+func (a *AuthZone) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	opt := qCtx.ClientOpt()
+	if r := a.Response(qCtx.Q(), opt != nil && opt.Do()); r != nil {
+		qCtx.SetResponse(r)
+	}
+	return next.ExecNext(ctx, qCtx)
+}
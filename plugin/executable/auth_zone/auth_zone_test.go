@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth_zone
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+const testZone = `$ORIGIN home.lan.
+$TTL 3600
+@ IN SOA ns.home.lan. admin.home.lan. 2024010101 7200 3600 1209600 300
+@ NS ns
+ns A 192.168.1.1
+@ MX 10 mail
+mail A 192.168.1.2
+nas A 192.168.1.10
+nas AAAA fd00::10
+www CNAME nas
+ext CNAME example.com.
+*.apps A 192.168.1.20
+a.b.deep TXT "deep"
+sub NS ns.sub
+ns.sub A 192.168.1.53
+`
+
+func writeZone(t *testing.T, s string) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "home.lan.zone")
+	if err := os.WriteFile(f, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestAuthZone_Response(t *testing.T) {
+	a, err := NewAuthZone(&Args{Zones: []ZoneArgs{{File: writeZone(t, testZone)}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const soa = "home.lan.\t300\tIN\tSOA\tns.home.lan. admin.home.lan. 2024010101 7200 3600 1209600 300\n"
+	tests := []struct {
+		name  string
+		qtype uint16
+		do    bool
+		want  string
+	}{
+		{"NAS.home.lan.", dns.TypeA, false, "rcode: NOERROR\nflags: aa rd ra\nquestion: ;NAS.home.lan.\tIN\t A\n" +
+			"answer:\nNAS.home.lan.\t3600\tIN\tA\t192.168.1.10\n"},
+		{"www.home.lan.", dns.TypeA, false, "rcode: NOERROR\nflags: aa rd ra\nquestion: ;www.home.lan.\tIN\t A\n" +
+			"answer:\nwww.home.lan.\t3600\tIN\tCNAME\tnas.home.lan.\nnas.home.lan.\t3600\tIN\tA\t192.168.1.10\n"},
+		{"ext.home.lan.", dns.TypeA, false, "rcode: NOERROR\nflags: aa rd ra\nquestion: ;ext.home.lan.\tIN\t A\n" +
+			"answer:\next.home.lan.\t3600\tIN\tCNAME\texample.com.\n"},
+		{"x.apps.home.lan.", dns.TypeA, false, "rcode: NOERROR\nflags: aa rd ra\nquestion: ;x.apps.home.lan.\tIN\t A\n" +
+			"answer:\nx.apps.home.lan.\t3600\tIN\tA\t192.168.1.20\n"},
+		{"x.apps.home.lan.", dns.TypeAAAA, true, "rcode: NOERROR\nflags: aa rd ra\nquestion: ;x.apps.home.lan.\tIN\t AAAA\n" +
+			"authority:\n" + soa + "x.apps.home.lan.\t300\tIN\tNSEC\t\\000.x.apps.home.lan. A NSEC\n"},
+		{"apps.home.lan.", dns.TypeA, false, "rcode: NOERROR\nflags: aa rd ra\nquestion: ;apps.home.lan.\tIN\t A\n" +
+			"authority:\n" + soa},
+		{"b.deep.home.lan.", dns.TypeTXT, false, "rcode: NOERROR\nflags: aa rd ra\nquestion: ;b.deep.home.lan.\tIN\t TXT\n" +
+			"authority:\n" + soa},
+		{"missing.home.lan.", dns.TypeA, false, "rcode: NXDOMAIN\nflags: aa rd ra\nquestion: ;missing.home.lan.\tIN\t A\n" +
+			"authority:\n" + soa},
+		{"host.sub.home.lan.", dns.TypeA, false, "rcode: NOERROR\nflags: rd ra\nquestion: ;host.sub.home.lan.\tIN\t A\n" +
+			"authority:\nsub.home.lan.\t3600\tIN\tNS\tns.sub.home.lan.\nadditional:\nns.sub.home.lan.\t3600\tIN\tA\t192.168.1.53\n"},
+		{"sub.home.lan.", dns.TypeDS, false, "rcode: NOERROR\nflags: aa rd ra\nquestion: ;sub.home.lan.\tIN\t DS\n" +
+			"authority:\n" + soa},
+		{"home.lan.", dns.TypeMX, false, "rcode: NOERROR\nflags: aa rd ra\nquestion: ;home.lan.\tIN\t MX\n" +
+			"answer:\nhome.lan.\t3600\tIN\tMX\t10 mail.home.lan.\nadditional:\nmail.home.lan.\t3600\tIN\tA\t192.168.1.2\n"},
+		{"nas.home.lan.", dns.TypeTXT, true, "rcode: NOERROR\nflags: aa rd ra\nquestion: ;nas.home.lan.\tIN\t TXT\n" +
+			"authority:\n" + soa + "nas.home.lan.\t300\tIN\tNSEC\t\\000.nas.home.lan. A AAAA NSEC\n"},
+	}
+	for _, tt := range tests {
+		q := plugintest.NewQuery(tt.name, tt.qtype).Build().Q()
+		plugintest.AssertResponse(t, a.Response(q, tt.do), tt.want)
+	}
+}
+
+func TestAuthZone_Exec(t *testing.T) {
+	a, err := NewAuthZone(&Args{Zones: []ZoneArgs{{File: writeZone(t, testZone)}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not in the zone.
+	qCtx := plugintest.NewQuery("example.com.", dns.TypeA).Build()
+	if err := plugintest.Exec(t, a, qCtx, plugintest.Answer("@ 60 IN A 1.1.1.1")); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || r.Authoritative || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	qCtx = plugintest.NewQuery("nas.home.lan.", dns.TypeAAAA).EDNS0(1232, true).Build()
+	if err := plugintest.Exec(t, a, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || !r.Authoritative || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+}
+
+func TestAuthZone_Reload(t *testing.T) {
+	f := writeZone(t, testZone)
+	a, err := NewAuthZone(&Args{Zones: []ZoneArgs{{File: f}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := a.DataFiles(); len(files) != 1 || files[0] != f {
+		t.Fatalf("unexpected data files %v", files)
+	}
+
+	if err := os.WriteFile(f, []byte(testZone+"new A 192.168.1.99\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ReloadData(); err != nil {
+		t.Fatal(err)
+	}
+	r := a.Response(plugintest.NewQuery("new.home.lan.", dns.TypeA).Build().Q(), false)
+	if r == nil || len(r.Answer) != 1 {
+		t.Fatalf("zone was not reloaded, %v", r)
+	}
+
+	// A bad file keeps the old zone.
+	if err := os.WriteFile(f, []byte("bad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ReloadData(); err == nil {
+		t.Fatal("bad zone was loaded")
+	}
+	if r := a.Response(plugintest.NewQuery("new.home.lan.", dns.TypeA).Build().Q(), false); r == nil || len(r.Answer) != 1 {
+		t.Fatal("old zone was not kept")
+	}
+}
+
+func Test_parseZone(t *testing.T) {
+	for name, s := range map[string]string{
+		"no soa":      "$ORIGIN home.lan.\nnas 60 A 192.168.1.10\n",
+		"out of zone": "$ORIGIN home.lan.\n@ 60 SOA ns admin 1 2 3 4 5\nexample.com. 60 A 1.1.1.1\n",
+		"cname":       "$ORIGIN home.lan.\n@ 60 SOA ns admin 1 2 3 4 5\nwww 60 CNAME nas\nwww 60 A 1.1.1.1\n",
+		"soa":         "$ORIGIN home.lan.\n@ 60 SOA ns admin 1 2 3 4 5\nsub 60 SOA ns admin 1 2 3 4 5\n",
+	} {
+		if _, err := parseZone([]byte(s), "", ""); err == nil {
+			t.Errorf("%s: invalid zone was loaded", name)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth_zone
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain is the maximum number of CNAMEs that are followed in a
+// zone.
+const maxCNAMEChain = 8
+
+// rrsets are records of a name by type.
+type rrsets map[uint16][]dns.RR
+
+// zone is an authoritative zone.
+type zone struct {
+	origin string // lower case fqdn
+	soa    *dns.SOA
+	names  map[string]rrsets // lower case owners, and empty non-terminals that have no rrsets
+}
+
+// parseZone parses zone file b. If origin is empty, it's the owner of the
+// first SOA record. The zone must have a SOA record at its apex. Records
+// must be in the zone and of class IN.
+func parseZone(b []byte, origin, file string) (*zone, error) {
+	origin = strings.ToLower(origin)
+	zp := dns.NewZoneParser(bytes.NewReader(b), origin, file)
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(origin) == 0 {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				origin = strings.ToLower(rr.Header().Name)
+				break
+			}
+		}
+		if len(origin) == 0 {
+			return nil, errors.New("zone has no SOA record")
+		}
+	}
+
+	z := &zone{origin: origin, names: make(map[string]rrsets)}
+	for _, rr := range rrs {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		if h.Class != dns.ClassINET {
+			return nil, fmt.Errorf("%s has unsupported class %s", h.Name, dns.ClassToString[h.Class])
+		}
+		if !dns.IsSubDomain(origin, name) {
+			return nil, fmt.Errorf("%s is out of zone %s", h.Name, origin)
+		}
+		if soa, ok := rr.(*dns.SOA); ok {
+			if name != origin {
+				return nil, fmt.Errorf("SOA record %s is not at the zone apex", h.Name)
+			}
+			if z.soa != nil {
+				return nil, errors.New("zone has more than one SOA record")
+			}
+			z.soa = soa
+		}
+		s := z.names[name]
+		if s == nil {
+			s = make(rrsets)
+			z.names[name] = s
+		}
+		s[h.Rrtype] = append(s[h.Rrtype], rr)
+
+		// Empty non-terminals.
+		for off, end := dns.NextLabel(name, 0); !end && len(name)-off >= len(origin); off, end = dns.NextLabel(name, off) {
+			if _, ok := z.names[name[off:]]; !ok {
+				z.names[name[off:]] = nil
+			}
+		}
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("zone %s has no SOA record", origin)
+	}
+	for name, s := range z.names {
+		if len(s[dns.TypeCNAME]) > 0 && len(s) > 1 {
+			return nil, fmt.Errorf("%s has CNAME and other records", name)
+		}
+	}
+	return z, nil
+}
+
+// response returns the authoritative response of q, whose name must be
+// in the zone. If do is true, NODATA responses have an NSEC record that
+// lists the types of the name. The NSEC is not signed.
+func (z *zone) response(q *dns.Msg, do bool) *dns.Msg {
+	question := q.Question[0]
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	r.RecursionAvailable = true
+
+	name := strings.ToLower(question.Name)
+	owner := question.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		if ns := z.delegation(name, question.Qtype); ns != nil {
+			if i > 0 { // The chain leaves the zone.
+				return r
+			}
+			r.Authoritative = false
+			r.Ns = copyRRs(nil, ns, "")
+			r.Extra = z.glue(ns)
+			return r
+		}
+		s, ok := z.lookup(name)
+		if !ok {
+			r.Rcode = dns.RcodeNameError
+			r.Ns = []dns.RR{z.negativeSOA()}
+			return r
+		}
+		if rrs := s[question.Qtype]; len(rrs) > 0 {
+			r.Answer = copyRRs(r.Answer, rrs, owner)
+			if question.Qtype == dns.TypeNS || question.Qtype == dns.TypeMX || question.Qtype == dns.TypeSRV {
+				r.Extra = z.glue(rrs)
+			}
+			return r
+		}
+		if question.Qtype == dns.TypeANY && len(s) > 0 {
+			for _, t := range sortedTypes(s) {
+				r.Answer = copyRRs(r.Answer, s[t], owner)
+			}
+			return r
+		}
+		if c := s[dns.TypeCNAME]; len(c) > 0 {
+			r.Answer = copyRRs(r.Answer, c, owner)
+			target := c[0].(*dns.CNAME).Target
+			name = strings.ToLower(target)
+			owner = target
+			if !dns.IsSubDomain(z.origin, name) {
+				return r
+			}
+			continue
+		}
+
+		// NODATA
+		r.Ns = []dns.RR{z.negativeSOA()}
+		if do {
+			r.Ns = append(r.Ns, z.nsec(owner, s))
+		}
+		return r
+	}
+	return r
+}
+
+// lookup returns rrsets of name. If name doesn't exist, rrsets of the
+// wildcard of its closest encloser are returned with owners replaced by
+// name. It returns false if name doesn't exist and there is no wildcard.
+func (z *zone) lookup(name string) (rrsets, bool) {
+	if s, ok := z.names[name]; ok {
+		return s, true
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		ce := name[off:]
+		if _, ok := z.names[ce]; !ok {
+			continue
+		}
+		w, ok := z.names["*."+ce]
+		return w, ok
+	}
+	return nil, false
+}
+
+// delegation returns the NS records of the zone cut above or at name, or
+// nil if name is not delegated. DS records of a zone cut are answered by
+// the zone.
+func (z *zone) delegation(name string, qtype uint16) []dns.RR {
+	var ns []dns.RR
+	for off, end := 0, false; !end && len(name)-off > len(z.origin); off, end = dns.NextLabel(name, off) {
+		cut := name[off:]
+		if cut == name && qtype == dns.TypeDS {
+			continue
+		}
+		if rrs := z.names[cut][dns.TypeNS]; len(rrs) > 0 {
+			ns = rrs // The cut closest to the apex wins.
+		}
+	}
+	return ns
+}
+
+// glue returns copies of A and AAAA records in the zone of targets of
+// NS, MX and SRV records rrs.
+func (z *zone) glue(rrs []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range rrs {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.NS:
+			target = rr.Ns
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		}
+		s := z.names[strings.ToLower(target)]
+		extra = copyRRs(extra, s[dns.TypeA], "")
+		extra = copyRRs(extra, s[dns.TypeAAAA], "")
+	}
+	return extra
+}
+
+// negativeSOA returns the SOA of negative responses. Its ttl is the
+// minimum of the SOA ttl and the SOA minimum field (RFC 2308).
+func (z *zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return soa
+}
+
+// nsec returns an NSEC record of name that lists types of s, like a
+// minimally covering NSEC (RFC 4470).
+func (z *zone) nsec(name string, s rrsets) dns.RR {
+	types := append(sortedTypes(s), dns.TypeNSEC)
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: z.negativeSOA().Header().Ttl},
+		NextDomain: "\\000." + name,
+		TypeBitMap: types,
+	}
+}
+
+func sortedTypes(s rrsets) []uint16 {
+	types := make([]uint16, 0, len(s))
+	for t := range s {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// copyRRs appends copies of rrs to dst. If owner is not empty, owners of
+// the copies are replaced by owner.
+func copyRRs(dst, rrs []dns.RR, owner string) []dns.RR {
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if len(owner) > 0 {
+			rr.Header().Name = owner
+		}
+		dst = append(dst, rr)
+	}
+	return dst
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package blocklist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const PluginType = "blocklist"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+// Block responses.
+const (
+	responseNullIP   = "null_ip"  // 0.0.0.0 and ::, NODATA for other types
+	responseNXDomain = "nxdomain" // NXDOMAIN
+	responseRefused  = "refused"  // REFUSED
+	responseNoData   = "nodata"   // empty NOERROR
+)
+
+// Args configures a blocklist. Blocked queries get the Response and the
+// rest of the sequence is skipped. Allow rules and AllowSets override
+// block rules, except "$important" abp rules.
+type Args struct {
+	// Files are block lists. Format is one of "auto" (default), "abp",
+	// "hosts" and "domain". "auto" detects the format line by line.
+	Files  []string `yaml:"files"`
+	Format string   `yaml:"format"`
+	// Rules are inline rules in any format, e.g. "||ads.com^" or
+	// "@@||good.ads.com^".
+	Rules []string `yaml:"rules"`
+	// Allow are domain expressions that are never blocked.
+	Allow []string `yaml:"allow"`
+
+	// BlockSets and AllowSets are tags of domain sets, e.g. rule_provider
+	// plugins.
+	BlockSets []string `yaml:"block_sets"`
+	AllowSets []string `yaml:"allow_sets"`
+
+	Response string `yaml:"response"` // default is "null_ip"
+	TTL      int    `yaml:"ttl"`      // ttl of block responses, default is 60
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultString(&a.Format, formatAuto)
+	utils.SetDefaultString(&a.Response, responseNullIP)
+	utils.SetDefaultNum(&a.TTL, 60)
+	switch a.Format {
+	case formatAuto, formatABP, formatHosts, formatDomain:
+	default:
+		return fmt.Errorf("unknown format %s", a.Format)
+	}
+	switch a.Response {
+	case responseNullIP, responseNXDomain, responseRefused, responseNoData:
+	default:
+		return fmt.Errorf("unknown response %s", a.Response)
+	}
+	return nil
+}
+
+var _ sequence.RecursiveExecutable = (*Blocklist)(nil)
+var _ coremain.DataReloader = (*Blocklist)(nil)
+var _ coremain.MetricsProvider = (*Blocklist)(nil)
+
+type Blocklist struct {
+	args      *Args
+	ss        remote.Storages
+	rules     atomic.Pointer[rules]
+	blockSets []domain.Matcher[struct{}]
+	allowSets []domain.Matcher[struct{}]
+
+	blockedTotal prometheus.Counter
+	allowedTotal prometheus.Counter
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	b, err := NewBlocklist(a, bp.M().Storages())
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range [...]struct {
+		tags []string
+		ms   *[]domain.Matcher[struct{}]
+	}{{a.BlockSets, &b.blockSets}, {a.AllowSets, &b.allowSets}} {
+		for _, tag := range l.tags {
+			p, _ := bp.M().GetPlugin(tag).(data_provider.DomainMatcherProvider)
+			if p == nil {
+				return nil, fmt.Errorf("%s is not a DomainMatcherProvider", tag)
+			}
+			*l.ms = append(*l.ms, p.GetDomainMatcher())
+		}
+	}
+	bp.RegAPI(b.Api())
+	return b, nil
+}
+
+// NewBlocklist loads rules, files and allow expressions. Domain sets are
+// not loaded.
+func NewBlocklist(args *Args, ss remote.Storages) (*Blocklist, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	b := &Blocklist{
+		args: args,
+		ss:   ss,
+		blockedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "blocked_total",
+			Help: "The total number of blocked queries",
+		}),
+		allowedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "allowed_total",
+			Help: "The total number of queries that matched allow rules",
+		}),
+	}
+	if err := b.ReloadData(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ReloadData loads rules and files again. The old rules are kept if it
+// fails.
+func (b *Blocklist) ReloadData() error {
+	r := newRules()
+	for i, s := range b.args.Rules {
+		if err := r.load([]byte(s), formatAuto); err != nil {
+			return fmt.Errorf("invalid rule #%d %s, %w", i, s, err)
+		}
+	}
+	for i, f := range b.args.Files {
+		data, err := b.ss.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("failed to read file #%d %s, %w", i, f, err)
+		}
+		if err := r.load(data, b.args.Format); err != nil {
+			return fmt.Errorf("failed to load file #%d %s, %w", i, f, err)
+		}
+	}
+	for i, exp := range b.args.Allow {
+		if err := r.allow.Add(exp, exp); err != nil {
+			return fmt.Errorf("invalid allow expression #%d %s, %w", i, exp, err)
+		}
+		r.allowRules++
+	}
+	b.rules.Store(r)
+	return nil
+}
+
+// Metrics implements coremain.MetricsProvider.
+func (b *Blocklist) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{b.blockedTotal, b.allowedTotal}
+}
+
+// check decides whether fqdn is blocked.
+func (b *Blocklist) check(fqdn string) decision {
+	d := b.rules.Load().match(fqdn)
+	if d.important {
+		return d
+	}
+	for i, m := range b.allowSets {
+		if _, ok := m.Match(fqdn); ok {
+			return decision{rule: "$" + b.args.AllowSets[i]}
+		}
+	}
+	if len(d.rule) > 0 {
+		return d
+	}
+	for i, m := range b.blockSets {
+		if _, ok := m.Match(fqdn); ok {
+			return decision{blocked: true, rule: "$" + b.args.BlockSets[i]}
+		}
+	}
+	return decision{}
+}
+
+func (b *Blocklist) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return next.ExecNext(ctx, qCtx)
+	}
+	d := b.check(q.Question[0].Name)
+	if !d.blocked {
+		if len(d.rule) > 0 {
+			b.allowedTotal.Inc()
+		}
+		return next.ExecNext(ctx, qCtx)
+	}
+	b.blockedTotal.Inc()
+	qCtx.StoreValue(query_context.KeyRule, d.rule)
+	qCtx.SetResponse(b.response(q))
+	return nil
+}
+
+// response returns the block response of q.
+func (b *Blocklist) response(q *dns.Msg) *dns.Msg {
+	question := q.Question[0]
+	ttl := uint32(b.args.TTL)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	switch b.args.Response {
+	case responseRefused:
+		r.Rcode = dns.RcodeRefused
+		return r
+	case responseNXDomain:
+		r.Rcode = dns.RcodeNameError
+	case responseNullIP:
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		switch question.Qtype {
+		case dns.TypeA:
+			r.Answer = []dns.RR{&dns.A{Hdr: hdr, A: make([]byte, 4)}}
+			return r
+		case dns.TypeAAAA:
+			r.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: make([]byte, 16)}}
+			return r
+		}
+	}
+	soa := dnsutils.FakeSOA(question.Name)
+	soa.Hdr.Ttl = ttl
+	soa.Minttl = ttl
+	r.Ns = []dns.RR{soa}
+	return r
+}
+
+// CheckResult is the result of the check api.
+type CheckResult struct {
+	Name    string `json:"name"`
+	Blocked bool   `json:"blocked"`
+	Rule    string `json:"rule,omitempty"`
+}
+
+// Api serves "/check?name=example.com" which tells whether a name is
+// blocked and by which rule, and "/stats".
+func (b *Blocklist) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/check", func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("name")
+		if len(name) == 0 {
+			http.Error(w, "missing name", http.StatusBadRequest)
+			return
+		}
+		d := b.check(dns.Fqdn(name))
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(CheckResult{Name: name, Blocked: d.blocked, Rule: d.rule})
+	})
+	r.Get("/stats", func(w http.ResponseWriter, req *http.Request) {
+		rs := b.rules.Load()
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int{
+			"block_rules":   rs.blockRules,
+			"allow_rules":   rs.allowRules,
+			"skipped_rules": rs.skipped,
+		})
+	})
+	return r
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package blocklist
+
+import (
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+const testList = `
+! Title: test list
+[Adblock Plus 2.0]
+||ads.com^
+||tracker.net^$important
+@@||good.ads.com^
+@@||good.tracker.net^
+|exact.com^
+||ad*.example.org^
+/^banner[0-9]+\./
+||unsupported.com^$third-party
+example.com##.banner
+0.0.0.0 hosts.com
+plain.com
+# comment
+`
+
+func TestRules_Match(t *testing.T) {
+	r := newRules()
+	if err := r.load([]byte(testList), formatAuto); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		{"ads.com.", true},
+		{"x.ads.com.", true},
+		{"good.ads.com.", false},
+		{"tracker.net.", true},
+		{"good.tracker.net.", true}, // $important wins
+		{"exact.com.", true},
+		{"sub.exact.com.", false},
+		{"ad1.example.org.", true},
+		{"x.ads2.example.org.", true},
+		{"bad1.example.org.", false},
+		{"banner12.cdn.com.", true},
+		{"unsupported.com.", false},
+		{"hosts.com.", true},
+		{"sub.hosts.com.", false},
+		{"plain.com.", true},
+		{"www.plain.com.", true},
+		{"example.com.", false},
+	}
+	for _, tt := range tests {
+		if d := r.match(tt.name); d.blocked != tt.blocked {
+			t.Errorf("%s: want blocked %v, got %+v", tt.name, tt.blocked, d)
+		}
+	}
+	if r.skipped != 2 {
+		t.Errorf("want 2 skipped rules, got %d", r.skipped)
+	}
+}
+
+func TestBlocklist_Exec(t *testing.T) {
+	tests := []struct {
+		response string
+		qtype    uint16
+		rcode    int
+		answers  int
+		soa      bool
+	}{
+		{"null_ip", dns.TypeA, dns.RcodeSuccess, 1, false},
+		{"null_ip", dns.TypeAAAA, dns.RcodeSuccess, 1, false},
+		{"null_ip", dns.TypeMX, dns.RcodeSuccess, 0, true},
+		{"nxdomain", dns.TypeA, dns.RcodeNameError, 0, true},
+		{"refused", dns.TypeA, dns.RcodeRefused, 0, false},
+		{"nodata", dns.TypeA, dns.RcodeSuccess, 0, true},
+	}
+	for _, tt := range tests {
+		b, err := NewBlocklist(&Args{Rules: []string{"||ads.com^"}, Allow: []string{"good.ads.com"}, Response: tt.response}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := &plugintest.Recorder{}
+		qCtx := plugintest.NewQuery("www.ads.com", tt.qtype).Build()
+		if err := plugintest.Exec(t, b, qCtx, rec); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		if len(rec.Queries) != 0 || r == nil {
+			t.Fatalf("%s: want blocked", tt.response)
+		}
+		if r.Rcode != tt.rcode || len(r.Answer) != tt.answers || (len(r.Ns) > 0) != tt.soa {
+			t.Errorf("%s %d: unexpected response %v", tt.response, tt.qtype, r)
+		}
+
+		rec = &plugintest.Recorder{}
+		qCtx = plugintest.NewQuery("good.ads.com", tt.qtype).Build()
+		if err := plugintest.Exec(t, b, qCtx, rec); err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.Queries) != 1 || qCtx.R() != nil {
+			t.Fatalf("%s: allowed query should be passed on", tt.response)
+		}
+	}
+
+	if _, err := NewBlocklist(&Args{Response: "bad"}, nil); err == nil {
+		t.Fatal("invalid response should fail")
+	}
+}
@@ -0,0 +1,313 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+// List formats.
+const (
+	formatAuto   = "auto"   // detected line by line
+	formatABP    = "abp"    // AdGuard/EasyList syntax, hostname rules only
+	formatHosts  = "hosts"  // "ip name...", names are full domains
+	formatDomain = "domain" // mosdns domain expressions
+)
+
+// rules are compiled block and allow rules. Values of matchers are the
+// original rule strings.
+type rules struct {
+	block          *domain.MixMatcher[string]
+	blockImportant *domain.MixMatcher[string] // $important rules
+	allow          *domain.MixMatcher[string]
+	allowImportant *domain.MixMatcher[string]
+
+	blockRules int
+	allowRules int
+	skipped    int // unsupported abp rules
+}
+
+func newRules() *rules {
+	r := &rules{
+		block:          domain.NewMixMatcher[string](),
+		blockImportant: domain.NewMixMatcher[string](),
+		allow:          domain.NewMixMatcher[string](),
+		allowImportant: domain.NewMixMatcher[string](),
+	}
+	for _, m := range [...]*domain.MixMatcher[string]{r.block, r.blockImportant, r.allow, r.allowImportant} {
+		m.SetDefaultMatcher(domain.MatcherDomain)
+	}
+	return r
+}
+
+// decision is the result of matching a name.
+type decision struct {
+	blocked   bool
+	important bool   // blocked by an $important rule
+	rule      string // the matched rule, empty if no rule matched
+}
+
+// match decides whether fqdn is blocked. Allow rules override block rules
+// unless the block rule is $important and the allow rule is not.
+func (r *rules) match(fqdn string) decision {
+	if rule, ok := r.blockImportant.Match(fqdn); ok {
+		if allowRule, ok := r.allowImportant.Match(fqdn); ok {
+			return decision{rule: allowRule}
+		}
+		return decision{blocked: true, important: true, rule: rule}
+	}
+	if rule, ok := r.allow.Match(fqdn); ok {
+		return decision{rule: rule}
+	}
+	if rule, ok := r.allowImportant.Match(fqdn); ok {
+		return decision{rule: rule}
+	}
+	if rule, ok := r.block.Match(fqdn); ok {
+		return decision{blocked: true, rule: rule}
+	}
+	return decision{}
+}
+
+// errSkip marks abp rules that have no meaning for dns or use unsupported
+// modifiers. They are ignored.
+var errSkip = errors.New("unsupported rule")
+
+// load loads a list of format into r.
+func (r *rules) load(b []byte, format string) error {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		err := r.loadLine(s, format)
+		if errors.Is(err, errSkip) {
+			r.skipped++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (r *rules) loadLine(s, format string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	switch format {
+	case formatABP:
+		return r.loadABP(s)
+	case formatHosts:
+		return r.loadHosts(s)
+	case formatDomain:
+		s = strings.TrimSpace(utils.RemoveComment(s, "#"))
+		if len(s) == 0 {
+			return nil
+		}
+		r.blockRules++
+		return r.block.Add(s, s)
+	}
+
+	// Auto detection.
+	switch {
+	case s[0] == '!' || s[0] == '[' || s[0] == '|' || s[0] == '/' || strings.HasPrefix(s, "@@") || isCosmetic(s):
+		return r.loadABP(s)
+	case s[0] == '#':
+		return nil
+	}
+	if f := strings.Fields(s); len(f) > 1 {
+		if _, err := netip.ParseAddr(f[0]); err == nil {
+			return r.loadHosts(s)
+		}
+	}
+	return r.loadLine(s, formatDomain)
+}
+
+// hostsSkip are names in hosts files that are not rules.
+var hostsSkip = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+func (r *rules) loadHosts(s string) error {
+	f := strings.Fields(utils.RemoveComment(s, "#"))
+	if len(f) == 0 {
+		return nil
+	}
+	if _, err := netip.ParseAddr(f[0]); err != nil {
+		return fmt.Errorf("invalid ip %s", f[0])
+	}
+	for _, name := range f[1:] {
+		name = strings.ToLower(name)
+		if _, ok := hostsSkip[name]; ok {
+			continue
+		}
+		r.blockRules++
+		if err := r.block.Add(domain.MatcherFull+":"+name, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadABP loads a hostname rule in AdGuard/EasyList syntax:
+//
+//	||example.com^          example.com and its subdomains
+//	@@||example.com^        exception
+//	|example.com^           example.com only
+//	example.com             example.com and its subdomains
+//	||ad*.example.com^      wildcards
+//	/^ads?\./               regexp
+//	||example.com^$important
+//
+// Comments, cosmetic rules and rules with other modifiers are skipped.
+func (r *rules) loadABP(s string) error {
+	if s[0] == '!' || s[0] == '[' || s[0] == '#' {
+		return nil // comment or header
+	}
+	if isCosmetic(s) {
+		return errSkip
+	}
+
+	rule := s
+	allow := false
+	if p, ok := strings.CutPrefix(s, "@@"); ok {
+		allow, s = true, p
+	}
+	important := false
+	if p, mods, ok := cutModifiers(s); ok {
+		for _, m := range strings.Split(mods, ",") {
+			if m != "important" {
+				return errSkip
+			}
+			important = true
+		}
+		s = p
+	}
+
+	pattern, err := abpPattern(s)
+	if err != nil {
+		return err
+	}
+	m := r.block
+	switch {
+	case allow && important:
+		m = r.allowImportant
+	case allow:
+		m = r.allow
+	case important:
+		m = r.blockImportant
+	}
+	if allow {
+		r.allowRules++
+	} else {
+		r.blockRules++
+	}
+	return m.Add(pattern, rule)
+}
+
+// isCosmetic reports whether s is an abp element hiding or scriptlet rule.
+func isCosmetic(s string) bool {
+	for _, sep := range [...]string{"##", "#@#", "#?#", "#$#", "#%#"} {
+		if strings.Contains(s, sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// cutModifiers splits the "$modifiers" of a rule. "$" in regexp rules is
+// not a modifier separator.
+func cutModifiers(s string) (string, string, bool) {
+	if s[0] == '/' {
+		if i := strings.LastIndex(s, "/$"); i > 0 {
+			return s[:i+1], s[i+2:], true
+		}
+		return s, "", false
+	}
+	i := strings.LastIndexByte(s, '$')
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// abpPattern converts an abp hostname pattern to a domain matcher pattern.
+func abpPattern(s string) (string, error) {
+	if len(s) > 2 && s[0] == '/' && s[len(s)-1] == '/' {
+		expr := s[1 : len(s)-1]
+		if _, err := regexp.Compile(expr); err != nil {
+			return "", err
+		}
+		return domain.MatcherRegexp + ":" + expr, nil
+	}
+
+	typ := domain.MatcherDomain
+	switch {
+	case strings.HasPrefix(s, "||"):
+		s = s[2:]
+	case strings.HasPrefix(s, "|"):
+		typ, s = domain.MatcherFull, s[1:]
+	}
+	s = strings.TrimSuffix(s, "|")
+	s = strings.TrimSuffix(s, "^")
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 || strings.ContainsAny(s, "/:^|?=&") {
+		return "", errSkip // url rules
+	}
+	s = strings.ToLower(s)
+	if strings.Contains(s, "*") {
+		return wildcardPattern(s, typ == domain.MatcherFull), nil
+	}
+	return typ + ":" + s, nil
+}
+
+// wildcardPattern converts a pattern with "*" to a regexp pattern.
+func wildcardPattern(s string, full bool) string {
+	parts := strings.Split(s, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	prefix := `(^|\.)`
+	if full {
+		prefix = "^"
+	}
+	return domain.MatcherRegexp + ":" + prefix + strings.Join(parts, ".*") + "$"
+}
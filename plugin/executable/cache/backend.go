@@ -0,0 +1,369 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v5/pkg/redis"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	backendMemory = "memory"
+	backendRedis  = "redis"
+
+	redisWriteQueueSize = 4096
+	redisMaxBatch       = 128
+	redisScanCount      = 256
+)
+
+// backend stores cached items. *cache.Cache[key, *item] is the in-memory
+// backend.
+type backend interface {
+	Get(k key) (v *item, expirationTime time.Time, ok bool)
+	Store(k key, v *item, expirationTime time.Time)
+	Range(f func(k key, v *item, expirationTime time.Time) error) error
+	Flush()
+	Close() error
+}
+
+var _ backend = (*cache.Cache[key, *item])(nil)
+var _ backend = (*redisBackend)(nil)
+
+// RedisArgs configures the redis backend.
+type RedisArgs struct {
+	Addr     string `yaml:"addr"` // Required. "host:port".
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	// Prefix of keys. Default is "mosdns_cache:". Caches that share the
+	// same redis should use different prefixes unless they are meant to
+	// share entries.
+	Prefix string `yaml:"prefix"`
+	// Timeout (milliseconds) of each redis operation. Default is 100.
+	// A lookup that times out is a cache miss.
+	Timeout int `yaml:"timeout"`
+}
+
+// redisBackend stores items in redis. Items expire by redis ttls.
+// Lookups are synchronous. Writes are queued and sent in pipelined
+// batches by a background goroutine, they are dropped if the queue
+// is full.
+type redisBackend struct {
+	c       *redis.Client
+	prefix  string
+	timeout time.Duration
+	logger  *zap.Logger
+
+	writes    chan [][]byte
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+func newRedisBackend(args *RedisArgs, logger *zap.Logger) (*redisBackend, error) {
+	if len(args.Addr) == 0 {
+		return nil, errors.New("redis addr is required")
+	}
+	prefix := args.Prefix
+	if len(prefix) == 0 {
+		prefix = "mosdns_cache:"
+	}
+	timeout := time.Duration(args.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Millisecond * 100
+	}
+	b := &redisBackend{
+		c:       redis.NewClient(redis.Opts{Addr: args.Addr, Password: args.Password, DB: args.DB}),
+		prefix:  prefix,
+		timeout: timeout,
+		logger:  logger,
+		writes:  make(chan [][]byte, redisWriteQueueSize),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.writeLoop()
+	return b, nil
+}
+
+func (b *redisBackend) redisKey(k key) []byte {
+	return append([]byte(b.prefix), k...)
+}
+
+func (b *redisBackend) Get(k key) (*item, time.Time, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	r, err := b.c.Do(ctx, []byte("GET"), b.redisKey(k))
+	if err != nil {
+		b.logger.Debug("redis get failed", zap.Error(err))
+		return nil, time.Time{}, false
+	}
+	if r.Nil {
+		return nil, time.Time{}, false
+	}
+	v, exp, err := decodeItem(r.Str)
+	if err != nil {
+		b.logger.Warn("invalid cached item in redis", zap.Error(err))
+		return nil, time.Time{}, false
+	}
+	return v, exp, true
+}
+
+func (b *redisBackend) Store(k key, v *item, expirationTime time.Time) {
+	ttl := time.Until(expirationTime).Milliseconds()
+	if ttl <= 0 {
+		return
+	}
+	val, err := encodeItem(v, expirationTime)
+	if err != nil {
+		b.logger.Warn("failed to encode item", zap.Error(err))
+		return
+	}
+	cmd := [][]byte{[]byte("SET"), b.redisKey(k), val, []byte("PX"), strconv.AppendInt(nil, ttl, 10)}
+	select {
+	case b.writes <- cmd:
+	default:
+		b.logger.Debug("redis write queue is full, item dropped")
+	}
+}
+
+func (b *redisBackend) writeLoop() {
+	defer close(b.done)
+	batch := make([][][]byte, 0, redisMaxBatch)
+	for {
+		select {
+		case cmd := <-b.writes:
+			batch = append(batch[:0], cmd)
+		fill:
+			for len(batch) < redisMaxBatch {
+				select {
+				case cmd := <-b.writes:
+					batch = append(batch, cmd)
+				default:
+					break fill
+				}
+			}
+			b.sendBatch(batch)
+		case <-b.closed:
+			// Send queued writes before exiting.
+			batch = batch[:0]
+			for {
+				select {
+				case cmd := <-b.writes:
+					batch = append(batch, cmd)
+					continue
+				default:
+				}
+				break
+			}
+			if len(batch) > 0 {
+				b.sendBatch(batch)
+			}
+			return
+		}
+	}
+}
+
+func (b *redisBackend) sendBatch(batch [][][]byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout*10)
+	defer cancel()
+	rs, err := b.c.Pipeline(ctx, batch)
+	if err != nil {
+		b.logger.Warn("redis write failed", zap.Int("commands", len(batch)), zap.Error(err))
+		return
+	}
+	for _, r := range rs {
+		if r.Err != nil {
+			b.logger.Warn("redis write failed", zap.Error(r.Err))
+			return
+		}
+	}
+}
+
+// scan calls f with keys of this backend in batches.
+func (b *redisBackend) scan(f func(keys [][]byte) error) error {
+	cursor := []byte("0")
+	match := append([]byte(b.prefix), '*')
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), b.timeout*10)
+		r, err := b.c.Do(ctx, []byte("SCAN"), cursor, []byte("MATCH"), match, []byte("COUNT"), []byte(strconv.Itoa(redisScanCount)))
+		cancel()
+		if err != nil {
+			return err
+		}
+		if len(r.Array) != 2 {
+			return errors.New("invalid scan reply")
+		}
+		var keys [][]byte
+		for _, k := range r.Array[1].Array {
+			keys = append(keys, k.Str)
+		}
+		if len(keys) > 0 {
+			if err := f(keys); err != nil {
+				return err
+			}
+		}
+		cursor = r.Array[0].Str
+		if string(cursor) == "0" {
+			return nil
+		}
+	}
+}
+
+// Range ranges all items by SCAN. It's slow and should only be used
+// for dumps.
+func (b *redisBackend) Range(f func(k key, v *item, expirationTime time.Time) error) error {
+	return b.scan(func(keys [][]byte) error {
+		args := append([][]byte{[]byte("MGET")}, keys...)
+		ctx, cancel := context.WithTimeout(context.Background(), b.timeout*10)
+		defer cancel()
+		r, err := b.c.Do(ctx, args...)
+		if err != nil {
+			return err
+		}
+		for i, vr := range r.Array {
+			if vr.Nil || i >= len(keys) {
+				continue
+			}
+			v, exp, err := decodeItem(vr.Str)
+			if err != nil {
+				continue
+			}
+			if err := f(key(strings.TrimPrefix(string(keys[i]), b.prefix)), v, exp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Flush deletes all keys with the prefix.
+func (b *redisBackend) Flush() {
+	err := b.scan(func(keys [][]byte) error {
+		ctx, cancel := context.WithTimeout(context.Background(), b.timeout*10)
+		defer cancel()
+		_, err := b.c.Do(ctx, append([][]byte{[]byte("DEL")}, keys...)...)
+		return err
+	})
+	if err != nil {
+		b.logger.Warn("failed to flush redis cache", zap.Error(err))
+	}
+}
+
+func (b *redisBackend) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		<-b.done
+		b.c.Close()
+	})
+	return nil
+}
+
+// Items are encoded in msgpack as an array of
+// [stored time, msg expiration time, cache expiration time, msg], times
+// are unix seconds (int64) and msg is the wire format (bin).
+
+const (
+	mpFixArray3 = 0x93
+	mpFixArray4 = 0x94
+	mpInt64     = 0xd3
+	mpBin8      = 0xc4
+	mpBin16     = 0xc5
+	mpBin32     = 0xc6
+)
+
+func encodeItem(v *item, cacheExp time.Time) ([]byte, error) {
+	msg, err := v.resp.Pack()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, 1+9*3+5+len(msg))
+	b = append(b, mpFixArray4)
+	for _, t := range [...]time.Time{v.storedTime, v.expirationTime, cacheExp} {
+		b = append(b, mpInt64)
+		b = binary.BigEndian.AppendUint64(b, uint64(t.Unix()))
+	}
+	switch l := len(msg); {
+	case l <= 0xff:
+		b = append(b, mpBin8, byte(l))
+	case l <= 0xffff:
+		b = append(b, mpBin16)
+		b = binary.BigEndian.AppendUint16(b, uint16(l))
+	default:
+		b = append(b, mpBin32)
+		b = binary.BigEndian.AppendUint32(b, uint32(l))
+	}
+	return append(b, msg...), nil
+}
+
+func decodeItem(b []byte) (*item, time.Time, error) {
+	if len(b) < 1 || b[0] != mpFixArray4 {
+		return nil, time.Time{}, errors.New("invalid msgpack header")
+	}
+	b = b[1:]
+	var ts [3]time.Time
+	for i := range ts {
+		if len(b) < 9 || b[0] != mpInt64 {
+			return nil, time.Time{}, fmt.Errorf("invalid msgpack int64 at #%d", i)
+		}
+		ts[i] = time.Unix(int64(binary.BigEndian.Uint64(b[1:9])), 0)
+		b = b[9:]
+	}
+	if len(b) < 1 {
+		return nil, time.Time{}, errors.New("missing msg")
+	}
+	var l int
+	switch b[0] {
+	case mpBin8:
+		if len(b) < 2 {
+			return nil, time.Time{}, errors.New("invalid bin8")
+		}
+		l, b = int(b[1]), b[2:]
+	case mpBin16:
+		if len(b) < 3 {
+			return nil, time.Time{}, errors.New("invalid bin16")
+		}
+		l, b = int(binary.BigEndian.Uint16(b[1:3])), b[3:]
+	case mpBin32:
+		if len(b) < 5 {
+			return nil, time.Time{}, errors.New("invalid bin32")
+		}
+		l, b = int(binary.BigEndian.Uint32(b[1:5])), b[5:]
+	default:
+		return nil, time.Time{}, fmt.Errorf("invalid msgpack bin type 0x%x", b[0])
+	}
+	if len(b) != l {
+		return nil, time.Time{}, errors.New("invalid msg length")
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return nil, time.Time{}, err
+	}
+	return &item{resp: m, storedTime: ts[0], expirationTime: ts[1]}, ts[2], nil
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/redis/redistest"
+	"github.com/miekg/dns"
+)
+
+func Test_redisBackend(t *testing.T) {
+	s := redistest.NewServer(t)
+	c, err := NewCache(&Args{Backend: backendRedis, Redis: RedisArgs{Addr: s.Addr(), Prefix: "t:"}}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.", dns.TypeA)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   []byte{1, 2, 3, 4},
+	})
+	now := time.Now()
+	v := &item{resp: resp, storedTime: now, expirationTime: now.Add(time.Minute)}
+	c.backend.Store("k", v, now.Add(time.Hour))
+
+	// Writes are async.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := s.Get("t:k"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("item was not written")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if ttl := s.TTL("t:k"); ttl < time.Minute*59 || ttl > time.Hour {
+		t.Fatalf("unexpected ttl %s", ttl)
+	}
+
+	got, exp, ok := c.backend.Get("k")
+	if !ok {
+		t.Fatal("cache missed")
+	}
+	if exp.Unix() != now.Add(time.Hour).Unix() || got.expirationTime.Unix() != v.expirationTime.Unix() {
+		t.Fatalf("unexpected expiration time %s, %s", exp, got.expirationTime)
+	}
+	if len(got.resp.Answer) != 1 || got.resp.Answer[0].String() != resp.Answer[0].String() {
+		t.Fatalf("unexpected resp %s", got.resp)
+	}
+
+	n := 0
+	if err := c.backend.Range(func(k key, _ *item, _ time.Time) error {
+		if k != "k" {
+			t.Fatalf("unexpected key %s", k)
+		}
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("want 1 item, got %d", n)
+	}
+
+	c.Flush()
+	if _, _, ok := c.backend.Get("k"); ok {
+		t.Fatal("item was not flushed")
+	}
+}
+
+func Test_decodeItem(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.", dns.TypeTXT)
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 1},
+		Txt: []string{string(make([]byte, 255)), string(make([]byte, 255))}, // Needs bin16.
+	})
+	now := time.Now()
+	b, err := encodeItem(&item{resp: m, storedTime: now, expirationTime: now}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := decodeItem(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []int{0, 1, 10, len(b) - 1} {
+		if _, _, err := decodeItem(b[:l]); err == nil {
+			t.Fatalf("truncated item of length %d should be rejected", l)
+		}
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -34,6 +35,7 @@ import (
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
@@ -67,43 +69,91 @@ const (
 )
 
 var _ sequence.RecursiveExecutable = (*Cache)(nil)
+var _ coremain.Flusher = (*Cache)(nil)
+var _ coremain.HandOverer = (*Cache)(nil)
+var _ coremain.MetricsProvider = (*Cache)(nil)
 
 type Args struct {
 	Size         int    `yaml:"size"`
 	LazyCacheTTL int    `yaml:"lazy_cache_ttl"`
 	DumpFile     string `yaml:"dump_file"`
 	DumpInterval int    `yaml:"dump_interval"`
+
+	// Backend is where responses are stored, "memory" (default) or
+	// "redis". Size is ignored by the redis backend, entries are evicted
+	// by redis ttls and its own memory policy.
+	Backend string    `yaml:"backend"`
+	Redis   RedisArgs `yaml:"redis"`
+
+	// RotateAnswers rotates the order of A and AAAA records on each
+	// cache hit, so clients that always use the first address spread
+	// their connections over all addresses.
+	RotateAnswers bool `yaml:"rotate_answers"`
+
+	// LoadDumpAsync loads the dump file in background after start, so a
+	// big dump doesn't delay the start. Entries that are cached before
+	// they are loaded from the dump are kept. The dump file is not
+	// overwritten until the load is finished.
+	LoadDumpAsync bool `yaml:"load_dump_async"`
+
+	// ServeStale (seconds) keeps responses with answers for this long
+	// after they expire. If the upstream fails (returns an error, SERVFAIL or no
+	// response), the expired response is returned with ttl ServeStaleTTL
+	// and refreshed in background (RFC 8767). The stale response is also
+	// returned to queries in the following ServeStaleTTL without asking
+	// the failed upstream again. RFC 8767 suggests 1 to 3 days.
+	// Default is 0, disabled.
+	ServeStale    int `yaml:"serve_stale"`
+	ServeStaleTTL int `yaml:"serve_stale_ttl"` // (seconds) default is 30.
+
+	// Prefetch refreshes popular entries in background when they are hit
+	// in the last Prefetch percent of their ttl, so hot domains never
+	// expire. Entries are popular if they were hit at least PrefetchHits
+	// times. Default is 0, disabled. Hits are not counted by the redis
+	// backend, set PrefetchHits to 1 for it.
+	Prefetch     int `yaml:"prefetch"`
+	PrefetchHits int `yaml:"prefetch_hits"` // default is 2.
+
+	// ECS is how responses of queries with ECS are cached, "ignore"
+	// (default) or "aware". See ecs.go.
+	ECS string `yaml:"ecs"`
 }
 
 func (a *Args) init() {
 	utils.SetDefaultUnsignNum(&a.Size, 1024)
 	utils.SetDefaultUnsignNum(&a.DumpInterval, 600)
+	utils.SetDefaultString(&a.Backend, backendMemory)
+	utils.SetDefaultUnsignNum(&a.ServeStaleTTL, 30)
+	utils.SetDefaultUnsignNum(&a.PrefetchHits, 2)
+	utils.SetDefaultString(&a.ECS, ecsIgnore)
 }
 
 type Cache struct {
 	args *Args
 
 	logger       *zap.Logger
-	backend      *cache.Cache[key, *item]
+	backend      backend
 	lazyUpdateSF singleflight.Group
 	closeOnce    sync.Once
 	closeNotify  chan struct{}
+	dumpLoaded   chan struct{} // closed when loadDump returns.
+	dumpLoadOK   atomic.Bool   // false if loadDump was aborted.
+	handedOver   atomic.Bool   // the dump file belongs to the next instance.
 	updatedKey   atomic.Uint64
-
-	queryTotal   prometheus.Counter
-	hitTotal     prometheus.Counter
-	lazyHitTotal prometheus.Counter
-	size         prometheus.GaugeFunc
+	rotation     atomic.Uint64
+
+	queryTotal    prometheus.Counter
+	hitTotal      prometheus.Counter
+	lazyHitTotal  prometheus.Counter
+	staleHitTotal prometheus.Counter
+	prefetchTotal prometheus.Counter
+	size          prometheus.GaugeFunc // nil if the backend is not in memory.
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	c := NewCache(args.(*Args), Opts{
-		Logger:     bp.L(),
-		MetricsTag: bp.Tag(),
-	})
-
-	if err := c.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())); err != nil {
-		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	c, err := NewCache(args.(*Args), Opts{Logger: bp.L()})
+	if err != nil {
+		return nil, err
 	}
 	bp.RegAPI(c.Api())
 	return c, nil
@@ -121,15 +171,14 @@ func quickSetupCache(bq sequence.BQ, s string) (any, error) {
 		size = i
 	}
 	// Don't register metrics in quick setup.
-	return NewCache(&Args{Size: size}, Opts{Logger: bq.L()}), nil
+	return NewCache(&Args{Size: size}, Opts{Logger: bq.L()})
 }
 
 type Opts struct {
-	Logger     *zap.Logger
-	MetricsTag string
+	Logger *zap.Logger
 }
 
-func NewCache(args *Args, opts Opts) *Cache {
+func NewCache(args *Args, opts Opts) (*Cache, error) {
 	args.init()
 
 	logger := opts.Logger
@@ -137,90 +186,201 @@ func NewCache(args *Args, opts Opts) *Cache {
 		logger = zap.NewNop()
 	}
 
-	backend := cache.New[key, *item](cache.Opts{Size: args.Size})
-	lb := map[string]string{"tag": opts.MetricsTag}
+	switch args.ECS {
+	case ecsIgnore, ecsAware:
+	default:
+		return nil, fmt.Errorf("invalid ecs mode %s", args.ECS)
+	}
+
+	var b backend
+	var size prometheus.GaugeFunc
+	switch args.Backend {
+	case backendMemory:
+		mb := cache.New[key, *item](cache.Opts{Size: args.Size})
+		b = mb
+		size = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "size_current",
+			Help: "Current cache size in records",
+		}, func() float64 {
+			return float64(mb.Len())
+		})
+	case backendRedis:
+		rb, err := newRedisBackend(&args.Redis, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init redis backend, %w", err)
+		}
+		b = rb
+	default:
+		return nil, fmt.Errorf("unknown backend %s", args.Backend)
+	}
+
 	p := &Cache{
 		args:        args,
 		logger:      logger,
-		backend:     backend,
+		backend:     b,
 		closeNotify: make(chan struct{}),
+		dumpLoaded:  make(chan struct{}),
 
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        "query_total",
-			Help:        "The total number of processed queries",
-			ConstLabels: lb,
+			Name: "query_total",
+			Help: "The total number of processed queries",
 		}),
 		hitTotal: prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        "hit_total",
-			Help:        "The total number of queries that hit the cache",
-			ConstLabels: lb,
+			Name: "hit_total",
+			Help: "The total number of queries that hit the cache",
 		}),
 		lazyHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        "lazy_hit_total",
-			Help:        "The total number of queries that hit the expired cache",
-			ConstLabels: lb,
+			Name: "lazy_hit_total",
+			Help: "The total number of queries that hit the expired cache",
 		}),
-		size: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
-			Name:        "size_current",
-			Help:        "Current cache size in records",
-			ConstLabels: lb,
-		}, func() float64 {
-			return float64(backend.Len())
+		staleHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stale_hit_total",
+			Help: "The total number of queries that got stale responses because the upstream failed",
+		}),
+		prefetchTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prefetch_total",
+			Help: "The total number of prefetches of popular entries",
 		}),
+		size: size,
 	}
 
-	if err := p.loadDump(); err != nil {
-		p.logger.Error("failed to load cache dump", zap.Error(err))
+	if args.LoadDumpAsync {
+		go p.loadDump()
+	} else {
+		p.loadDump()
 	}
 	p.startDumpLoop()
 
-	return p
+	return p, nil
 }
 
-func (c *Cache) RegMetricsTo(r prometheus.Registerer) error {
-	for _, collector := range [...]prometheus.Collector{c.queryTotal, c.hitTotal, c.lazyHitTotal, c.size} {
-		if err := r.Register(collector); err != nil {
-			return err
-		}
+// Metrics implements coremain.MetricsProvider.
+func (c *Cache) Metrics() []prometheus.Collector {
+	cs := []prometheus.Collector{c.queryTotal, c.hitTotal, c.lazyHitTotal, c.staleHitTotal, c.prefetchTotal}
+	if c.size != nil {
+		cs = append(cs, c.size)
 	}
-	return nil
+	return cs
 }
 
 func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
 	c.queryTotal.Inc()
 	q := qCtx.Q()
 
-	msgKey := getMsgKey(q)
-	if len(msgKey) == 0 { // skip cache
+	keys := getMsgKeys(q, c.args.ECS)
+	if len(keys.global) == 0 { // skip cache
 		return next.ExecNext(ctx, qCtx)
 	}
 
-	cachedResp, lazyHit := getRespFromCache(msgKey, c.backend, c.args.LazyCacheTTL > 0, expiredMsgTtl)
+	var (
+		cachedResp *dns.Msg
+		cachedItem *item
+		lazyHit    bool
+	)
+	for _, k := range keys.lookupKeys() {
+		cachedResp, cachedItem, lazyHit = getRespFromCache(k, c.backend, c.args.LazyCacheTTL, expiredMsgTtl)
+		if cachedResp != nil {
+			break
+		}
+	}
 	if lazyHit {
 		c.lazyHitTotal.Inc()
-		c.doLazyUpdate(msgKey, qCtx, next)
+		c.doLazyUpdate(keys, qCtx, next)
+	} else if cachedItem != nil && c.needPrefetch(cachedItem) {
+		c.prefetchTotal.Inc()
+		c.doLazyUpdate(keys, qCtx, next)
 	}
 	if cachedResp != nil { // cache hit
 		c.hitTotal.Inc()
 		cachedResp.Id = q.Id // change msg id
+		if c.args.RotateAnswers {
+			rotateAddrRRs(cachedResp.Answer, c.rotation.Add(1))
+		}
 		qCtx.SetResponse(cachedResp)
 	}
 
+	// Keep a copy of the query for the background refresh if we may
+	// serve a stale response.
+	var qCtxCopy *query_context.Context
+	if cachedResp == nil && c.args.ServeStale > 0 {
+		qCtxCopy = qCtx.Copy()
+	}
+
 	err := next.ExecNext(ctx, qCtx)
 
+	if qCtxCopy != nil && upstreamFailed(err, qCtx.R()) {
+		if stale := c.getStaleResp(keys); stale != nil {
+			c.staleHitTotal.Inc()
+			c.logger.Debug("upstream failed, serving stale response", qCtx.InfoField(), zap.Error(err))
+			c.doLazyUpdate(keys, qCtxCopy, next)
+			stale.Id = q.Id
+			qCtx.SetResponse(stale)
+			return nil
+		}
+	}
+
 	if r := qCtx.R(); r != nil && cachedResp != r { // pointer compare. r is not cachedResp
-		saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
+		saveRespToCache(keys.saveKey(qCtx.UpstreamOpt()), r, c.backend, c.args.LazyCacheTTL, c.args.ServeStale)
 		c.updatedKey.Add(1)
 	}
 	return err
 }
 
+// needPrefetch counts the hit of v and reports whether v is popular and
+// will expire soon.
+func (c *Cache) needPrefetch(v *item) bool {
+	if c.args.Prefetch <= 0 {
+		return false
+	}
+	hits := v.hits.Add(1)
+	if hits < uint32(c.args.PrefetchHits) {
+		return false
+	}
+	ttl := v.expirationTime.Sub(v.storedTime)
+	remaining := time.Until(v.expirationTime)
+	return remaining*100 < ttl*time.Duration(c.args.Prefetch)
+}
+
+// getStaleResp returns a stale response from the cache, or nil if there
+// is none. The stale response is stored again as a fresh one that expires
+// in ServeStaleTTL, so following queries won't wait for the failed
+// upstream.
+func (c *Cache) getStaleResp(keys msgKeys) *dns.Msg {
+	var (
+		msgKey   string
+		v        *item
+		cacheExp time.Time
+		ok       bool
+	)
+	for _, msgKey = range keys.lookupKeys() {
+		if v, cacheExp, ok = c.backend.Get(key(msgKey)); ok {
+			break
+		}
+	}
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if !now.Before(v.expirationTime.Add(time.Duration(c.args.ServeStale) * time.Second)) {
+		return nil
+	}
+	r := v.resp.Copy()
+	dnsutils.SetTTL(r, uint32(c.args.ServeStaleTTL))
+	c.backend.Store(key(msgKey), &item{
+		resp:           r.Copy(),
+		storedTime:     now,
+		expirationTime: now.Add(time.Duration(c.args.ServeStaleTTL) * time.Second),
+	}, cacheExp)
+	return r
+}
+
 // doLazyUpdate starts a new goroutine to execute next node and update the cache in the background.
-// It has an inner singleflight.Group to de-duplicate same msgKey.
-func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next sequence.ChainWalker) {
+// It has an inner singleflight.Group to de-duplicate same keys.
+func (c *Cache) doLazyUpdate(keys msgKeys, qCtx *query_context.Context, next sequence.ChainWalker) {
 	qCtxCopy := qCtx.Copy()
+	sfKey := keys.global + keys.subnet
 	lazyUpdateFunc := func() (any, error) {
-		defer c.lazyUpdateSF.Forget(msgKey)
+		defer c.lazyUpdateSF.Forget(sfKey)
 		qCtx := qCtxCopy
 
 		c.logger.Debug("start lazy cache update", qCtx.InfoField())
@@ -232,41 +392,88 @@ func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next se
 			c.logger.Warn("failed to update lazy cache", qCtx.InfoField(), zap.Error(err))
 		}
 
+		// Don't replace the cached response with a failure.
 		r := qCtx.R()
-		if r != nil {
-			saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
+		if r != nil && r.Rcode != dns.RcodeServerFailure {
+			saveRespToCache(keys.saveKey(qCtx.UpstreamOpt()), r, c.backend, c.args.LazyCacheTTL, c.args.ServeStale)
 			c.updatedKey.Add(1)
 		}
 		c.logger.Debug("lazy cache updated", qCtx.InfoField())
 		return nil, nil
 	}
-	c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
+	c.lazyUpdateSF.DoChan(sfKey, lazyUpdateFunc) // DoChan won't block this goroutine
 }
 
 func (c *Cache) Close() error {
-	if err := c.dumpCache(); err != nil {
-		c.logger.Error("failed to dump cache", zap.Error(err))
-	}
 	c.closeOnce.Do(func() {
 		close(c.closeNotify)
 	})
+	<-c.dumpLoaded
+	if c.handedOver.Load() {
+		c.logger.Info("cache was handed over, skip dumping")
+	} else if c.dumpLoadOK.Load() {
+		if err := c.dumpCache(); err != nil {
+			c.logger.Error("failed to dump cache", zap.Error(err))
+		}
+	} else {
+		c.logger.Warn("cache dump was not fully loaded, skip dumping to keep the file")
+	}
 	return c.backend.Close()
 }
 
-func (c *Cache) loadDump() error {
+// HandOver implements coremain.HandOverer. It dumps the cache, so the
+// cache of the next instance loads the latest entries. After that, the
+// dump file is not written anymore.
+func (c *Cache) HandOver() (cancel func()) {
+	if len(c.args.DumpFile) == 0 {
+		return func() {}
+	}
+	select {
+	case <-c.dumpLoaded:
+		if c.dumpLoadOK.Load() {
+			if err := c.dumpCache(); err != nil {
+				c.logger.Error("failed to dump cache", zap.Error(err))
+			}
+		}
+	default:
+		// The dump is still being loaded, so the file has the latest entries.
+	}
+	c.handedOver.Store(true)
+	return func() { c.handedOver.Store(false) }
+}
+
+var errDumpLoadAborted = errors.New("cache was closed before the dump was loaded")
+
+// loadDump loads the dump file and closes c.dumpLoaded.
+func (c *Cache) loadDump() {
+	defer close(c.dumpLoaded)
+	err := c.readDumpFile()
+	// An invalid dump will be overwritten by the next dump. But an
+	// aborted one is still valid and should be kept.
+	c.dumpLoadOK.Store(!errors.Is(err, errDumpLoadAborted))
+	if err != nil {
+		c.logger.Error("failed to load cache dump", zap.Error(err))
+	}
+}
+
+func (c *Cache) readDumpFile() error {
 	if len(c.args.DumpFile) == 0 {
 		return nil
 	}
 	f, err := os.Open(c.args.DumpFile)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) { // First start.
+			return nil
+		}
 		return err
 	}
 	defer f.Close()
-	en, err := c.readDump(f)
+	start := time.Now()
+	en, err := c.readDump(f, c.args.LoadDumpAsync)
 	if err != nil {
 		return err
 	}
-	c.logger.Info("cache dump loaded", zap.Int("entries", en))
+	c.logger.Info("cache dump loaded", zap.Int("entries", en), zap.Duration("elapsed", time.Since(start)))
 	return nil
 }
 
@@ -281,6 +488,9 @@ func (c *Cache) startDumpLoop() {
 		for {
 			select {
 			case <-ticker.C:
+				if !c.dumpLoadOK.Load() || c.handedOver.Load() {
+					continue
+				}
 				// Check if we have enough changes to dump.
 				keyUpdated := c.updatedKey.Swap(0)
 				if keyUpdated < minimumChangesToDump { // Nop.
@@ -303,26 +513,42 @@ func (c *Cache) dumpCache() error {
 		return nil
 	}
 
-	f, err := os.Create(c.args.DumpFile)
+	// Write to a temp file first. So the old dump is kept if we
+	// crash in the middle.
+	f, err := os.CreateTemp(filepath.Dir(c.args.DumpFile), filepath.Base(c.args.DumpFile)+".*.tmp")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(f.Name())
 	defer f.Close()
 
 	en, err := c.writeDump(f)
 	if err != nil {
 		return fmt.Errorf("failed to write dump, %w", err)
 	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write dump, %w", err)
+	}
+	if err := os.Rename(f.Name(), c.args.DumpFile); err != nil {
+		return err
+	}
 	c.logger.Info("cache dumped", zap.Int("entries", en))
 	return nil
 }
 
+// Flush removes all cached responses.
+func (c *Cache) Flush() {
+	c.backend.Flush()
+}
+
 func (c *Cache) Api() *chi.Mux {
 	r := chi.NewRouter()
-	r.Get("/flush", func(w http.ResponseWriter, req *http.Request) {
-		c.backend.Flush()
-	})
-	r.Get("/dump", func(w http.ResponseWriter, req *http.Request) {
+	r.Get("/flush", coremain.Mutation(func(w http.ResponseWriter, req *http.Request) {
+		c.Flush()
+	}))
+	// Dumps contain the queried names of all clients.
+	admin := r.With(coremain.RequireRole(coremain.RoleAdmin))
+	admin.Get("/dump", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("content-type", "application/octet-stream")
 		_, err := c.writeDump(w)
 		if err != nil {
@@ -330,8 +556,8 @@ func (c *Cache) Api() *chi.Mux {
 			return
 		}
 	})
-	r.Post("/load_dump", func(w http.ResponseWriter, req *http.Request) {
-		if _, err := c.readDump(req.Body); err != nil {
+	admin.Post("/load_dump", func(w http.ResponseWriter, req *http.Request) {
+		if _, err := c.readDump(req.Body, false); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -340,6 +566,18 @@ func (c *Cache) Api() *chi.Mux {
 	return r
 }
 
+// DumpData implements coremain.DataDumper.
+func (c *Cache) DumpData(w io.Writer) error {
+	_, err := c.writeDump(w)
+	return err
+}
+
+// LoadData implements coremain.DataDumper.
+func (c *Cache) LoadData(r io.Reader) error {
+	_, err := c.readDump(r, false)
+	return err
+}
+
 func (c *Cache) writeDump(w io.Writer) (int, error) {
 	en := 0
 
@@ -406,8 +644,17 @@ func (c *Cache) writeDump(w io.Writer) (int, error) {
 
 // readDump reads dumped data from r. It returns the number of bytes read,
 // number of entries read and any error encountered.
-func (c *Cache) readDump(r io.Reader) (int, error) {
+// If keepExisting, entries that are already in the cache are not
+// overwritten, and reading stops once c is closed.
+func (c *Cache) readDump(r io.Reader, keepExisting bool) (int, error) {
 	en := 0
+	migrated, dropped := 0, 0
+	defer func() {
+		if migrated > 0 || dropped > 0 {
+			c.logger.Info("cache dump entries of another ecs mode were migrated",
+				zap.String("ecs", c.args.ECS), zap.Int("migrated", migrated), zap.Int("dropped", dropped))
+		}
+	}()
 	gr, err := gzip.NewReader(r)
 	if err != nil {
 		return en, fmt.Errorf("failed to read gzip header, %w", err)
@@ -446,6 +693,21 @@ func (c *Cache) readDump(r io.Reader) (int, error) {
 
 		en += len(block.GetEntries())
 		for _, entry := range block.GetEntries() {
+			ek := string(entry.GetKey())
+			k, ok := migrateKey(ek, c.args.ECS)
+			if !ok {
+				dropped++
+				continue
+			}
+			// Keep the first entry if entries are migrated to the same key.
+			if changed := k != ek; changed || keepExisting {
+				if _, _, ok := c.backend.Get(key(k)); ok {
+					continue
+				}
+				if changed {
+					migrated++
+				}
+			}
 			cacheExpTime := time.Unix(entry.GetCacheExpirationTime(), 0)
 			msgExpTime := time.Unix(entry.GetMsgExpirationTime(), 0)
 			storedTime := time.Unix(entry.GetMsgStoredTime(), 0)
@@ -459,12 +721,19 @@ func (c *Cache) readDump(r io.Reader) (int, error) {
 				storedTime:     storedTime,
 				expirationTime: msgExpTime,
 			}
-			c.backend.Store(key(entry.GetKey()), i, cacheExpTime)
+			c.backend.Store(key(k), i, cacheExpTime)
 		}
 		return nil
 	}
 
 	for {
+		if keepExisting {
+			select {
+			case <-c.closeNotify:
+				return en, errDumpLoadAborted
+			default:
+			}
+		}
 		err = readBlock()
 		if err != nil {
 			if err == errReadHeaderEOF {
@@ -21,14 +21,26 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"github.com/miekg/dns"
+	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
 )
 
 func Test_cachePlugin_Dump(t *testing.T) {
-	c := NewCache(&Args{Size: 16 * dumpBlockSize}, Opts{}) // Big enough to create dump fragments.
+	c, err := NewCache(&Args{Size: 16 * dumpBlockSize}, Opts{}) // Big enough to create dump fragments.
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	resp := new(dns.Msg)
 	resp.SetQuestion("test.", dns.TypeA)
@@ -51,7 +63,7 @@ func Test_cachePlugin_Dump(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	enr, err := c.readDump(buf)
+	enr, err := c.readDump(buf, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,3 +72,222 @@ func Test_cachePlugin_Dump(t *testing.T) {
 		t.Fatalf("read err, wrote %d entries, read %d", enw, enr)
 	}
 }
+
+func Test_rotateAddrRRs(t *testing.T) {
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: "a.", Rrtype: dns.TypeCNAME}, Target: "b."}
+	a := func(i byte) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "b.", Rrtype: dns.TypeA}, A: net.IPv4(10, 0, 0, i)}
+	}
+	rrs := []dns.RR{cname, a(1), a(2), a(3)}
+	rotateAddrRRs(rrs, 1)
+	want := []dns.RR{cname, a(2), a(3), a(1)}
+	for i := range want {
+		if rrs[i].String() != want[i].String() {
+			t.Fatalf("#%d: want %s, got %s", i, want[i], rrs[i])
+		}
+	}
+
+	rotateAddrRRs(rrs, 2) // Back to the original order.
+	if rrs[1].String() != a(1).String() {
+		t.Fatalf("unexpected first record %s", rrs[1])
+	}
+}
+
+func Test_cachePlugin_LoadDumpAsync(t *testing.T) {
+	dumpFile := filepath.Join(t.TempDir(), "cache.dump")
+	newMsg := func(ttl uint32) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("test.", dns.TypeA)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.IPv4(1, 1, 1, 1)})
+		return m
+	}
+	now := time.Now()
+	hourLater := now.Add(time.Hour)
+
+	c1, err := NewCache(&Args{DumpFile: dumpFile}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.backend.Store("old", &item{resp: newMsg(1), storedTime: now, expirationTime: hourLater}, hourLater)
+	c1.backend.Store("kept", &item{resp: newMsg(1), storedTime: now, expirationTime: hourLater}, hourLater)
+	if err := c1.Close(); err != nil { // dumps
+		t.Fatal(err)
+	}
+
+	c2, err := NewCache(&Args{DumpFile: dumpFile}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.backend.Store("kept", &item{resp: newMsg(2), storedTime: now, expirationTime: hourLater}, hourLater)
+	f, err := os.Open(dumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := c2.readDump(f, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c2.backend.Get("old"); !ok {
+		t.Fatal("entry was not loaded")
+	}
+	if v, _, _ := c2.backend.Get("kept"); v.resp.Answer[0].Header().Ttl != 2 {
+		t.Fatal("existing entry was overwritten")
+	}
+
+	c3, err := NewCache(&Args{DumpFile: dumpFile, LoadDumpAsync: true}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	<-c3.dumpLoaded
+	if !c3.dumpLoadOK.Load() {
+		t.Fatal("dump was not loaded")
+	}
+	if _, _, ok := c3.backend.Get("old"); !ok {
+		t.Fatal("entry was not loaded")
+	}
+}
+
+func Test_cachePlugin_HandOver(t *testing.T) {
+	dumpFile := filepath.Join(t.TempDir(), "cache.dump")
+	hourLater := time.Now().Add(time.Hour)
+	newItem := func() *item {
+		m := new(dns.Msg)
+		m.SetQuestion("test.", dns.TypeA)
+		return &item{resp: m, storedTime: time.Now(), expirationTime: hourLater}
+	}
+
+	oldC, err := NewCache(&Args{DumpFile: dumpFile}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldC.backend.Store("a", newItem(), hourLater)
+
+	// The next instance failed to start.
+	oldC.HandOver()()
+	oldC.backend.Store("b", newItem(), hourLater)
+
+	// The next instance loads the handed over dump.
+	oldC.HandOver()
+	newC, err := NewCache(&Args{DumpFile: dumpFile}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []key{"a", "b"} {
+		if _, _, ok := newC.backend.Get(k); !ok {
+			t.Fatalf("entry %s was not handed over", k)
+		}
+	}
+
+	// The old instance must not overwrite the dump of the new one.
+	newC.backend.Store("c", newItem(), hourLater)
+	if err := newC.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := oldC.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCache(&Args{DumpFile: dumpFile}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, ok := c.backend.Get("c"); !ok {
+		t.Fatal("dump of the new instance was overwritten by the old one")
+	}
+}
+
+func Test_cachePlugin_ServeStale(t *testing.T) {
+	c, err := NewCache(&Args{ServeStale: 3600}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	qCtx := plugintest.NewQuery("example.com.", dns.TypeA).Build()
+	if err := plugintest.Exec(t, c, qCtx, plugintest.Answer("@ 1 IN A 1.2.3.4")); err != nil {
+		t.Fatal(err)
+	}
+	// Make it expired.
+	msgKey := getMsgKey(qCtx.Q())
+	v, exp, ok := c.backend.Get(key(msgKey))
+	if !ok {
+		t.Fatal("response was not cached")
+	}
+	v.storedTime = v.storedTime.Add(-time.Minute)
+	v.expirationTime = v.expirationTime.Add(-time.Minute)
+	c.backend.Store(key(msgKey), v, exp)
+
+	var upstreamQueries atomic.Int32
+	upstream := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		if qCtx.R() != nil { // cache hit
+			return nil
+		}
+		upstreamQueries.Add(1)
+		return plugintest.Rcode(dns.RcodeServerFailure)(ctx, qCtx)
+	})
+	for i := 0; i < 2; i++ {
+		qCtx = plugintest.NewQuery("example.com.", dns.TypeA).Build()
+		if err := plugintest.Exec(t, c, qCtx, upstream); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		if r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+			t.Fatalf("#%d: want the stale response, got %v", i, r)
+		}
+		if ttl := r.Answer[0].Header().Ttl; ttl == 0 || ttl > 30 {
+			t.Fatalf("#%d: unexpected ttl %d", i, ttl)
+		}
+	}
+	// The second query was answered without asking the upstream. The
+	// background refresh may or may not have happened yet.
+	if n := upstreamQueries.Load(); n < 1 || n > 2 {
+		t.Fatalf("unexpected upstream queries %d", n)
+	}
+}
+
+func Test_cachePlugin_Prefetch(t *testing.T) {
+	c, err := NewCache(&Args{Prefetch: 20, PrefetchHits: 2}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var upstreamQueries atomic.Int32
+	upstream := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		if qCtx.R() != nil { // cache hit
+			return nil
+		}
+		upstreamQueries.Add(1)
+		return plugintest.Answer("@ 100 IN A 1.2.3.4")(ctx, qCtx)
+	})
+	query := func() {
+		t.Helper()
+		qCtx := plugintest.NewQuery("example.com.", dns.TypeA).Build()
+		if err := plugintest.Exec(t, c, qCtx, upstream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query()
+
+	// 10% of its ttl remains.
+	msgKey := getMsgKey(plugintest.NewQuery("example.com.", dns.TypeA).Build().Q())
+	v, _, _ := c.backend.Get(key(msgKey))
+	v.storedTime = v.storedTime.Add(-time.Second * 90)
+	v.expirationTime = v.expirationTime.Add(-time.Second * 90)
+
+	query() // Not popular yet.
+	time.Sleep(time.Millisecond * 50)
+	if n := upstreamQueries.Load(); n != 1 {
+		t.Fatalf("want 1 upstream query, got %d", n)
+	}
+	query() // Prefetch.
+	deadline := time.Now().Add(time.Second)
+	for upstreamQueries.Load() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("entry was not prefetched")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+// ECS (RFC 7871) and cache keys.
+//
+// Responses of ECS-enabled upstreams can depend on the client subnet in the
+// query, e.g. CDN answers. There are two ways to cache them:
+//
+//   - "ignore" (default). The subnet is not a part of the key. All clients
+//     share one entry per question, which has the best hit rate. A client
+//     may get the answer of another subnet, which is fine if all clients
+//     are in the same network, or the upstream does not use ECS.
+//   - "aware". Responses whose ECS scope prefix length is not 0 are cached
+//     per query subnet (the ECS source prefix of the query that is sent to
+//     the upstream). Responses with scope 0, or without ECS, are valid for
+//     all subnets and are cached under a global key. Lookups try the
+//     global key first and fall back to the subnet key. It's correct but
+//     has more misses and entries.
+//
+// Aware entries are cached at the source prefix length, not the scope
+// length. When the scope is shorter, an entry covers fewer clients than it
+// could, but the lookup of a query needs only two keys.
+//
+// Keys of aware mode have ecsAwareBit set, so entries of the two modes
+// never collide. Entries of the other mode are migrated when the cache
+// dump is loaded (see migrateKey):
+//
+//   - ignore -> aware: entries are dropped, because the subnets that they
+//     were fetched for are unknown.
+//   - aware -> ignore: global and subnet entries are kept under the key of
+//     their question. If a question has more than one entry, the first one
+//     in the dump wins.
+//
+// Entries in redis are not migrated. Entries of the other mode are not
+// used and expire.
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ecsIgnore = "ignore"
+	ecsAware  = "aware"
+)
+
+// msgKeys are keys of a query.
+type msgKeys struct {
+	// global is the key of responses that are valid for all clients.
+	global string
+	// subnet is the key of responses of the query subnet. Empty if the
+	// cache is not ecs aware or the query has no subnet.
+	subnet string
+}
+
+// getMsgKeys returns keys of q. Keys are empty if q should not be cached.
+func getMsgKeys(q *dns.Msg, ecsMode string) msgKeys {
+	k := getMsgKey(q)
+	if len(k) == 0 || ecsMode != ecsAware {
+		return msgKeys{global: k}
+	}
+	b := []byte(k)
+	b[0] |= ecsAwareBit
+	keys := msgKeys{global: string(b)}
+	if ecs := findECS(q.IsEdns0()); ecs != nil {
+		if p, ok := ecsPrefix(ecs); ok && p.Bits() > 0 {
+			keys.subnet = keys.global + string(appendPrefix(nil, p))
+		}
+	}
+	return keys
+}
+
+// saveKey returns the key that response r, which has upstream OPT opt,
+// should be saved to. opt can be nil.
+func (k msgKeys) saveKey(opt *dns.OPT) string {
+	if len(k.subnet) == 0 {
+		return k.global
+	}
+	// No ECS in the response means the upstream doesn't use it. Scope 0.
+	if ecs := findECS(opt); ecs == nil || ecs.SourceScope == 0 {
+		return k.global
+	}
+	return k.subnet
+}
+
+// lookupKeys returns keys in lookup order.
+func (k msgKeys) lookupKeys() []string {
+	if len(k.subnet) == 0 {
+		return []string{k.global}
+	}
+	return []string{k.global, k.subnet}
+}
+
+// migrateKey converts key k of a dump to a key of ecsMode. It returns false
+// if the entry should be dropped.
+func migrateKey(k string, ecsMode string) (string, bool) {
+	// Keys that are not made by getMsgKeys are kept as they are.
+	if len(k) == 0 || k[0]&^(adBit|cdBit|doBit|ecsAwareBit) != 0 {
+		return k, true
+	}
+	aware := k[0]&ecsAwareBit != 0
+	switch {
+	case ecsMode == ecsAware && !aware:
+		return "", false
+	case ecsMode != ecsAware && aware:
+		// flags + qtype + qname length + qname
+		if len(k) < 4 || len(k) < 4+int(k[3]) {
+			return "", false
+		}
+		b := []byte(k[:4+int(k[3])])
+		b[0] &^= ecsAwareBit
+		return string(b), true
+	}
+	return k, true
+}
+
+func findECS(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// ecsPrefix returns the source prefix of ecs.
+func ecsPrefix(ecs *dns.EDNS0_SUBNET) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ecs.Address)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	if ecs.Family == 1 {
+		addr = addr.Unmap()
+	}
+	p, err := addr.Prefix(int(ecs.SourceNetmask))
+	return p, err == nil
+}
+
+// appendPrefix appends prefix length and the masked address of p to b.
+func appendPrefix(b []byte, p netip.Prefix) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(p.Bits()))
+	return append(b, p.Addr().AsSlice()...)
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+// ecsQuery returns a query with ECS subnet/24.
+func ecsQuery(subnet string) *query_context.Context {
+	qCtx := plugintest.NewQuery("example.com.", dns.TypeA).Build()
+	if len(subnet) > 0 {
+		qCtx.QOpt().Option = append(qCtx.QOpt().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 24,
+			Address:       net.ParseIP(subnet).To4(),
+		})
+	}
+	return qCtx
+}
+
+// ecsUpstream answers queries with the address of the query subnet and
+// ECS scope. It counts queries that reach it.
+func ecsUpstream(scope uint8, n *int) sequence.ExecutableFunc {
+	return func(_ context.Context, qCtx *query_context.Context) error {
+		if qCtx.R() != nil { // cache hit
+			return nil
+		}
+		*n++
+		addr := "0.0.0.0"
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		opt := new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		if ecs := findECS(qCtx.Q().IsEdns0()); ecs != nil {
+			addr = net.IP(ecs.Address).String()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        ecs.Family,
+				SourceNetmask: ecs.SourceNetmask,
+				SourceScope:   scope,
+				Address:       ecs.Address,
+			})
+		}
+		r.Answer = []dns.RR{plugintest.MustRR("example.com. 300 IN A " + addr)}
+		r.Extra = append(r.Extra, opt)
+		qCtx.SetResponse(r)
+		return nil
+	}
+}
+
+func Test_cachePlugin_ECS(t *testing.T) {
+	tests := []struct {
+		name     string
+		ecs      string
+		scope    uint8
+		wantAddr []string // answers of queries from subnets below
+		wantN    int      // upstream queries
+	}{
+		{"ignore", "", 24, []string{"1.1.1.1", "1.1.1.1", "1.1.1.1"}, 1},
+		{"aware", ecsAware, 24, []string{"1.1.1.1", "2.2.2.2", "1.1.1.1"}, 2},
+		{"aware scope 0", ecsAware, 0, []string{"1.1.1.1", "1.1.1.1", "1.1.1.1"}, 1},
+	}
+	subnets := []string{"1.1.1.1", "2.2.2.2", "1.1.1.2"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewCache(&Args{ECS: tt.ecs}, Opts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			n := 0
+			for i, s := range subnets {
+				qCtx := ecsQuery(s)
+				if err := plugintest.Exec(t, c, qCtx, ecsUpstream(tt.scope, &n)); err != nil {
+					t.Fatal(err)
+				}
+				if got := qCtx.R().Answer[0].(*dns.A).A.String(); got != tt.wantAddr[i] {
+					t.Fatalf("#%d: want %s, got %s", i, tt.wantAddr[i], got)
+				}
+			}
+			if n != tt.wantN {
+				t.Fatalf("want %d upstream queries, got %d", tt.wantN, n)
+			}
+		})
+	}
+
+	if _, err := NewCache(&Args{ECS: "invalid"}, Opts{}); err == nil {
+		t.Fatal("invalid ecs mode was accepted")
+	}
+}
+
+func Test_cachePlugin_ECSMigration(t *testing.T) {
+	dump := func(ecs string, subnets ...string) *bytes.Buffer {
+		t.Helper()
+		c, err := NewCache(&Args{ECS: ecs}, Opts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		n := 0
+		for _, s := range subnets {
+			if err := plugintest.Exec(t, c, ecsQuery(s), ecsUpstream(24, &n)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buf := new(bytes.Buffer)
+		if _, err := c.writeDump(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	entries := func(c *Cache) int {
+		n := 0
+		c.backend.Range(func(key, *item, time.Time) error {
+			n++
+			return nil
+		})
+		return n
+	}
+	load := func(ecs string, b *bytes.Buffer) *Cache {
+		t.Helper()
+		c, err := NewCache(&Args{ECS: ecs}, Opts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if _, err := c.readDump(b, false); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// aware -> ignore: subnet entries are merged into one.
+	c := load(ecsIgnore, dump(ecsAware, "1.1.1.1", "2.2.2.2"))
+	if l := entries(c); l != 1 {
+		t.Fatalf("want 1 entry, got %d", l)
+	}
+	n := 0
+	if err := plugintest.Exec(t, c, ecsQuery("3.3.3.3"), ecsUpstream(24, &n)); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatal("migrated entry was not used")
+	}
+
+	// ignore -> aware: entries are dropped.
+	c = load(ecsAware, dump(ecsIgnore, "1.1.1.1"))
+	if l := entries(c); l != 0 {
+		t.Fatalf("want 0 entries, got %d", l)
+	}
+}
@@ -21,9 +21,9 @@ package cache
 
 import (
 	"hash/maphash"
+	"sync/atomic"
 	"time"
 
-	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
 	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/miekg/dns"
@@ -38,6 +38,14 @@ func (k key) Sum() uint64 {
 	return maphash.String(seed, string(k))
 }
 
+// Bits of the first byte of msg keys.
+const (
+	adBit = 1 << iota
+	cdBit
+	doBit
+	ecsAwareBit // See ecs.go.
+)
+
 // getMsgKey returns a string key for the query msg, or an empty
 // string if query should not be cached.
 func getMsgKey(q *dns.Msg) string {
@@ -45,12 +53,6 @@ func getMsgKey(q *dns.Msg) string {
 		return ""
 	}
 
-	const (
-		adBit = 1 << iota
-		cdBit
-		doBit
-	)
-
 	question := q.Question[0]
 	buf := make([]byte, 1+2+1+len(question.Name)) // bits + qtype + qname length + qname
 	b := byte(0)
@@ -78,6 +80,10 @@ type item struct {
 	resp           *dns.Msg
 	storedTime     time.Time
 	expirationTime time.Time
+
+	// hits is the number of queries that hit this item. It is not kept
+	// by dumps or the redis backend.
+	hits atomic.Uint32
 }
 
 func copyNoOpt(m *dns.Msg) *dns.Msg {
@@ -131,9 +137,12 @@ func min[T constraints.Ordered](a, b T) T {
 
 // getRespFromCache returns the cached response from cache.
 // The ttl of returned msg will be changed properly.
+// Returned item is the cached item of the response.
 // Returned bool indicates whether this response is hit by lazy cache.
+// Expired responses are served by lazy cache in lazyCacheTtl seconds
+// after they were stored. lazyCacheTtl <= 0 disables lazy cache.
 // Note: Caller SHOULD change the msg id because it's not same as query's.
-func getRespFromCache(msgKey string, backend *cache.Cache[key, *item], lazyCacheEnabled bool, lazyTtl int) (*dns.Msg, bool) {
+func getRespFromCache(msgKey string, backend backend, lazyCacheTtl int, lazyTtl int) (*dns.Msg, *item, bool) {
 	// Lookup cache
 	v, _, _ := backend.Get(key(msgKey))
 
@@ -145,25 +154,26 @@ func getRespFromCache(msgKey string, backend *cache.Cache[key, *item], lazyCache
 		if now.Before(v.expirationTime) {
 			r := v.resp.Copy()
 			dnsutils.SubtractTTL(r, uint32(now.Sub(v.storedTime).Seconds()))
-			return r, false
+			return r, v, false
 		}
 
 		// Msg expired but cache isn't. This is a lazy cache enabled entry.
 		// If lazy cache is enabled, return the response.
-		if lazyCacheEnabled {
+		if lazyCacheTtl > 0 && now.Before(v.storedTime.Add(time.Duration(lazyCacheTtl)*time.Second)) {
 			r := v.resp.Copy()
 			dnsutils.SetTTL(r, uint32(lazyTtl))
-			return r, true
+			return r, v, true
 		}
 	}
 
 	// cache miss
-	return nil, false
+	return nil, nil, false
 }
 
 // saveRespToCache saves r to cache backend. It returns false if r
 // should not be cached and was skipped.
-func saveRespToCache(msgKey string, r *dns.Msg, backend *cache.Cache[key, *item], lazyCacheTtl int) bool {
+// Responses with answers are kept serveStale seconds after they expire.
+func saveRespToCache(msgKey string, r *dns.Msg, backend backend, lazyCacheTtl int, serveStale int) bool {
 	if r.Truncated != false {
 		return false
 	}
@@ -190,6 +200,9 @@ func saveRespToCache(msgKey string, r *dns.Msg, backend *cache.Cache[key, *item]
 			} else {
 				cacheTtl = msgTtl
 			}
+			if serveStale > 0 {
+				cacheTtl = max(cacheTtl, msgTtl+time.Duration(serveStale)*time.Second)
+			}
 		}
 	}
 	if msgTtl <= 0 || cacheTtl <= 0 {
@@ -205,3 +218,43 @@ func saveRespToCache(msgKey string, r *dns.Msg, backend *cache.Cache[key, *item]
 	backend.Store(key(msgKey), v, now.Add(cacheTtl))
 	return true
 }
+
+// rotateAddrRRs rotates A records and AAAA records in rrs by n places
+// in place. Other records (e.g. the CNAME chain) keep their positions.
+func rotateAddrRRs(rrs []dns.RR, n uint64) {
+	var a, aaaa []int
+	for i, rr := range rrs {
+		switch rr.(type) {
+		case *dns.A:
+			a = append(a, i)
+		case *dns.AAAA:
+			aaaa = append(aaaa, i)
+		}
+	}
+	rotateAt(rrs, a, n)
+	rotateAt(rrs, aaaa, n)
+}
+
+// rotateAt rotates the elements of rrs at idx left by n places.
+func rotateAt(rrs []dns.RR, idx []int, n uint64) {
+	if len(idx) < 2 {
+		return
+	}
+	s := int(n % uint64(len(idx)))
+	if s == 0 {
+		return
+	}
+	rotated := make([]dns.RR, len(idx))
+	for i := range idx {
+		rotated[i] = rrs[idx[(i+s)%len(idx)]]
+	}
+	for i, j := range idx {
+		rrs[j] = rotated[i]
+	}
+}
+
+// upstreamFailed reports whether the query failed and a stale response
+// can be used instead.
+func upstreamFailed(err error, r *dns.Msg) bool {
+	return err != nil || r == nil || r.Rcode == dns.RcodeServerFailure
+}
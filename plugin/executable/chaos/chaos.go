@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "chaos"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.Executable = (*Chaos)(nil)
+
+// Args configures answers of CHAOS class TXT queries.
+// Set a value to "-" to hide it.
+type Args struct {
+	Version  string `yaml:"version"`  // Default is the build version.
+	Hostname string `yaml:"hostname"` // Default is the os hostname.
+	ID       string `yaml:"id"`       // Default is the hostname.
+
+	// Stats enables stats.mosdns, which answers uptime, in-flight
+	// queries and goroutines.
+	Stats bool `yaml:"stats"`
+
+	// Extra are additional names and their TXT values.
+	Extra map[string]string `yaml:"extra"`
+}
+
+func (a *Args) init() {
+	if len(a.Version) == 0 {
+		a.Version = "mosdns"
+		if bi, ok := debug.ReadBuildInfo(); ok && len(bi.Main.Version) > 0 && bi.Main.Version != "(devel)" {
+			a.Version = "mosdns " + bi.Main.Version
+		}
+	}
+	if len(a.Hostname) == 0 {
+		a.Hostname, _ = os.Hostname()
+	}
+	if len(a.ID) == 0 {
+		a.ID = a.Hostname
+	}
+}
+
+type Chaos struct {
+	startTime time.Time
+	inflight  *atomic.Int64 // maybe nil
+	values    map[string]string
+	stats     bool
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewChaos(args.(*Args), bp.M().InflightCounter()), nil
+}
+
+// QuickSetup format: [version]
+// stats.mosdns is enabled.
+func QuickSetup(bq sequence.BQ, s string) (any, error) {
+	return NewChaos(&Args{Version: strings.TrimSpace(s), Stats: true}, bq.M().InflightCounter()), nil
+}
+
+// NewChaos creates a Chaos. inflight can be nil.
+func NewChaos(args *Args, inflight *atomic.Int64) *Chaos {
+	args.init()
+	c := &Chaos{
+		startTime: time.Now(),
+		inflight:  inflight,
+		values:    make(map[string]string),
+		stats:     args.Stats,
+	}
+	set := func(v string, names ...string) {
+		if v == "-" {
+			return
+		}
+		for _, name := range names {
+			c.values[name] = v
+		}
+	}
+	set(args.Version, "version.bind.", "version.server.")
+	set(args.Hostname, "hostname.bind.")
+	set(args.ID, "id.server.")
+	for name, v := range args.Extra {
+		set(v, dns.Fqdn(strings.ToLower(name)))
+	}
+	return c
+}
+
+// Exec answers CHAOS class TXT queries of known names. Other queries
+// are passed through.
+func (c *Chaos) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if r := c.Response(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+	}
+	return nil
+}
+
+// Response returns the response of q. It returns nil if q is not a
+// CHAOS class TXT query of a known name.
+func (c *Chaos) Response(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+	if question.Qclass != dns.ClassCHAOS || (question.Qtype != dns.TypeTXT && question.Qtype != dns.TypeANY) {
+		return nil
+	}
+
+	name := strings.ToLower(question.Name)
+	var txt []string
+	if v, ok := c.values[name]; ok {
+		txt = []string{v}
+	} else if c.stats && name == "stats.mosdns." {
+		txt = c.statsTxt()
+	} else {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	r.Answer = append(r.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+			Ttl:    0,
+		},
+		Txt: txt,
+	})
+	return r
+}
+
+func (c *Chaos) statsTxt() []string {
+	txt := []string{
+		fmt.Sprintf("uptime=%d", int64(time.Since(c.startTime).Seconds())),
+		fmt.Sprintf("goroutines=%d", runtime.NumGoroutine()),
+	}
+	if c.inflight != nil {
+		txt = append(txt, fmt.Sprintf("inflight=%d", c.inflight.Load()))
+	}
+	return txt
+}
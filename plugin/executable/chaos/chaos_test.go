@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package chaos
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestChaos_Response(t *testing.T) {
+	c := NewChaos(&Args{Version: "v1", Hostname: "-", Stats: true, Extra: map[string]string{"Foo.Bar": "baz"}}, nil)
+
+	tests := []struct {
+		name    string
+		qname   string
+		qclass  uint16
+		wantTxt string // empty means no response
+	}{
+		{"version", "VERSION.bind.", dns.ClassCHAOS, "v1"},
+		{"version.server", "version.server.", dns.ClassCHAOS, "v1"},
+		{"hidden hostname", "hostname.bind.", dns.ClassCHAOS, ""},
+		{"extra", "foo.bar.", dns.ClassCHAOS, "baz"},
+		{"stats", "stats.mosdns.", dns.ClassCHAOS, "uptime=0"},
+		{"inet class", "version.bind.", dns.ClassINET, ""},
+		{"unknown", "unknown.", dns.ClassCHAOS, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, dns.TypeTXT)
+			q.Question[0].Qclass = tt.qclass
+			r := c.Response(q)
+			if len(tt.wantTxt) == 0 {
+				if r != nil {
+					t.Fatalf("want no response, got %v", r)
+				}
+				return
+			}
+			if r == nil || len(r.Answer) != 1 {
+				t.Fatalf("want one answer, got %v", r)
+			}
+			if got := r.Answer[0].(*dns.TXT).Txt[0]; got != tt.wantTxt {
+				t.Fatalf("want txt %s, got %s", tt.wantTxt, got)
+			}
+		})
+	}
+}
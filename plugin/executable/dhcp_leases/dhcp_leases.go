@@ -0,0 +1,292 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_leases
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/hosts"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dhcp_leases"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*Leases)(nil)
+var _ coremain.DataReloader = (*Leases)(nil)
+
+// Args configures lease files. Hosts are answered as "<hostname>.<suffix>".
+type Args struct {
+	Files []string `yaml:"files"` // Required.
+	// Format is one of "auto" (default), "dnsmasq", "odhcpd" and "kea".
+	Format string `yaml:"format"`
+	// Suffix is the local domain of hosts, default is "lan". Set it to
+	// "." to answer bare hostnames.
+	Suffix         string `yaml:"suffix"`
+	TTL            int    `yaml:"ttl"`             // default is 60
+	ReloadInterval int    `yaml:"reload_interval"` // (seconds) file check interval, default is 5. Negative disables it.
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultString(&a.Format, formatAuto)
+	utils.SetDefaultString(&a.Suffix, "lan")
+	utils.SetDefaultNum(&a.TTL, 60)
+	utils.SetDefaultNum(&a.ReloadInterval, 5)
+	if len(a.Files) == 0 {
+		return fmt.Errorf("no lease file")
+	}
+	switch a.Format {
+	case formatAuto, formatDnsmasq, formatOdhcpd, formatKea:
+	default:
+		return fmt.Errorf("unknown format %s", a.Format)
+	}
+	a.Suffix = strings.Trim(strings.ToLower(a.Suffix), ".")
+	return nil
+}
+
+// Leases answers A, AAAA and PTR queries of DHCP clients from lease
+// files. Files are loaded again when they change and when a lease
+// expires.
+type Leases struct {
+	args   *Args
+	logger *zap.Logger
+	t      atomic.Pointer[table]
+
+	reloadMu sync.Mutex // serializes reloads
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// table is a loaded snapshot of lease files.
+type table struct {
+	h          *hosts.Hosts
+	files      []fileStat
+	nextExpiry time.Time // zero if no lease expires
+	leases     int
+}
+
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	l, err := NewLeases(args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	l.logger = bp.L()
+	if l.args.ReloadInterval > 0 {
+		go l.watchLoop()
+	}
+	return l, nil
+}
+
+// NewLeases loads lease files. Files are not watched.
+func NewLeases(args *Args) (*Leases, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	l := &Leases{
+		args:        args,
+		logger:      zap.NewNop(),
+		closeNotify: make(chan struct{}),
+	}
+	if err := l.ReloadData(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ReloadData loads lease files again. The old leases are kept if it
+// fails.
+func (l *Leases) ReloadData() error {
+	return l.reload(time.Now())
+}
+
+// reload loads lease files and drops leases that expire before now.
+func (l *Leases) reload(now time.Time) error {
+	l.reloadMu.Lock()
+	defer l.reloadMu.Unlock()
+	t, err := l.load(now)
+	if err != nil {
+		return err
+	}
+	l.t.Store(t)
+	return nil
+}
+
+func (l *Leases) load(now time.Time) (*table, error) {
+	t := &table{files: statFiles(l.args.Files)}
+	names := make(map[string][]netip.Addr)
+	var order []string
+	for i, f := range l.args.Files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file #%d %s, %w", i, f, err)
+		}
+		leases, err := parseLeases(b, l.args.Format)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load file #%d %s, %w", i, f, err)
+		}
+		for _, le := range leases {
+			if !le.expiry.IsZero() {
+				if !le.expiry.After(now) {
+					continue
+				}
+				if t.nextExpiry.IsZero() || le.expiry.Before(t.nextExpiry) {
+					t.nextExpiry = le.expiry
+				}
+			}
+			name, ok := l.fqdn(le.hostname)
+			if !ok {
+				continue
+			}
+			if _, dup := names[name]; !dup {
+				order = append(order, name)
+			}
+			names[name] = append(names[name], le.addr.Unmap())
+			t.leases++
+		}
+	}
+
+	m := domain.NewMixMatcher[*hosts.IPs]()
+	rt := hosts.NewReverseTable(domain.MatcherFull)
+	parse := rt.ParseFunc(hosts.ParseIPs)
+	ttl := " ttl=" + strconv.Itoa(l.args.TTL)
+	for _, name := range order {
+		var sb strings.Builder
+		sb.WriteString(domain.MatcherFull + ":" + name)
+		for _, addr := range names[name] {
+			sb.WriteString(" " + addr.String())
+		}
+		sb.WriteString(ttl)
+		if err := domain.Load[*hosts.IPs](m, sb.String(), parse); err != nil {
+			return nil, fmt.Errorf("invalid lease of %s, %w", name, err)
+		}
+	}
+	t.h = hosts.NewHosts(m)
+	t.h.SetReverse(rt)
+	return t, nil
+}
+
+// fqdn returns the local fqdn of a leased hostname. Hostnames that are
+// fqdns under the suffix are kept. Other hostnames are reduced to their
+// first label.
+func (l *Leases) fqdn(hostname string) (string, bool) {
+	hostname = strings.Trim(strings.ToLower(hostname), ".")
+	if len(hostname) == 0 || hostname == "*" || hostname == "-" {
+		return "", false
+	}
+	if len(l.args.Suffix) > 0 && strings.HasSuffix(hostname, "."+l.args.Suffix) {
+		return hostname + ".", true
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	if _, ok := dns.IsDomainName(hostname); !ok {
+		return "", false
+	}
+	if len(l.args.Suffix) == 0 {
+		return hostname + ".", true
+	}
+	return hostname + "." + l.args.Suffix + ".", true
+}
+
+func statFiles(files []string) []fileStat {
+	stats := make([]fileStat, len(files))
+	for i, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			stats[i] = fileStat{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return stats
+}
+
+func (l *Leases) watchLoop() {
+	ticker := time.NewTicker(time.Duration(l.args.ReloadInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.check(now)
+		case <-l.closeNotify:
+			return
+		}
+	}
+}
+
+// check reloads lease files if they were changed or a lease expired.
+func (l *Leases) check(now time.Time) {
+	t := l.t.Load()
+	expired := !t.nextExpiry.IsZero() && !t.nextExpiry.After(now)
+	changed := false
+	for i, s := range statFiles(l.args.Files) {
+		if !s.modTime.Equal(t.files[i].modTime) || s.size != t.files[i].size {
+			changed = true
+			break
+		}
+	}
+	if !expired && !changed {
+		return
+	}
+	if err := l.reload(now); err != nil {
+		l.logger.Warn("failed to reload lease files", zap.Error(err))
+		return
+	}
+	if changed {
+		l.logger.Info("lease files reloaded", zap.Int("leases", l.t.Load().leases))
+	}
+}
+
+func (l *Leases) Close() error {
+	l.closeOnce.Do(func() { close(l.closeNotify) })
+	return nil
+}
+
+// Exec answers queries of leased hosts and their addresses.
+func (l *Leases) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if r := l.Response(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+	}
+	return nil
+}
+
+// Response returns the response of q from leases. It returns nil if q is
+// not about a leased host.
+func (l *Leases) Response(q *dns.Msg) *dns.Msg {
+	return l.t.Load().h.LookupMsg(q)
+}
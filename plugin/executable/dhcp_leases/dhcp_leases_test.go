@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_leases
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func Test_parseLeases(t *testing.T) {
+	future := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name   string
+		data   string
+		format string
+		want   []string // hostname addr
+	}{
+		{"dnsmasq", fmt.Sprintf(`%d 00:11:22:33:44:55 192.168.1.10 laptop 01:00:11:22:33:44:55
+0 00:11:22:33:44:66 192.168.1.11 * *
+duid 00:01:00:01:2c:8f:6d:34:00:11:22:33:44:55
+%d 1234 fd00::10 laptop 00:01:00:01
+`, future, future), formatDnsmasq, []string{"laptop 192.168.1.10", "* 192.168.1.11", "laptop fd00::10"}},
+		{"odhcpd", fmt.Sprintf(`# br-lan 000100012c8f6d34 8a2b1c3d phone %d 1 128 fd00::20/128 fd00::21/128
+# br-lan 000100012c8f6d35 8a2b1c3e - -1 2 128 fd00::22/128
+`, future), formatOdhcpd, []string{"phone fd00::20", "phone fd00::21", "- fd00::22"}},
+		{"kea", fmt.Sprintf(`address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context,pool_id
+192.168.1.30,00:11:22:33:44:77,,3600,%d,1,0,0,tv,0,,0
+192.168.1.31,00:11:22:33:44:88,,3600,%d,1,0,0,old,0,,0
+192.168.1.31,00:11:22:33:44:88,,3600,%d,1,0,0,old,2,,0
+`, future, future, future), formatKea, []string{"tv 192.168.1.30", " 192.168.1.31"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if f := detectFormat([]byte(tt.data)); f != tt.format {
+				t.Fatalf("detected format %s", f)
+			}
+			leases, err := parseLeases([]byte(tt.data), formatAuto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, l := range leases {
+				got = append(got, l.hostname+" "+l.addr.String())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_parseLeases_expiry(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		format   string
+		infinite bool
+	}{
+		{"dnsmasq infinite", "0 aa 192.168.1.10 a *\n", formatDnsmasq, true},
+		{"odhcpd infinite", "# br-lan 0001 8a2b1c3d a -1 1 128 fd00::20/128\n", formatOdhcpd, true},
+		{"odhcpd expired", "# br-lan 0001 8a2b1c3d a 0 1 128 fd00::20/128\n", formatOdhcpd, false},
+		{"kea expired", "address,expire,hostname\n192.168.1.30,0,a\n", formatKea, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leases, err := parseLeases([]byte(tt.data), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(leases) != 1 {
+				t.Fatalf("want 1 lease, got %d", len(leases))
+			}
+			e := leases[0].expiry
+			if tt.infinite != e.IsZero() || !tt.infinite && e.After(time.Now()) {
+				t.Fatalf("unexpected expiry %v", e)
+			}
+		})
+	}
+}
+
+func TestLeases(t *testing.T) {
+	now := time.Now()
+	f := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(f, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(fmt.Sprintf("%d aa 192.168.1.10 Laptop *\n%d bb 192.168.1.11 gone *\n0 cc 192.168.1.12 nas.lan *\n",
+		now.Add(time.Hour).Unix(), now.Add(-time.Hour).Unix()))
+
+	l, err := NewLeases(&Args{Files: []string{f}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		qCtx := plugintest.NewQuery(name, qtype).Build()
+		if err := plugintest.Exec(t, l, qCtx); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R()
+	}
+
+	if r := lookup("laptop.lan", dns.TypeA); r == nil || len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 60 {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if r := lookup("nas.lan", dns.TypeA); r == nil || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if r := lookup("gone.lan", dns.TypeA); r != nil {
+		t.Fatalf("expired leases should not be answered, got %v", r)
+	}
+	if r := lookup("laptop.lan", dns.TypeAAAA); r == nil || len(r.Answer) != 0 {
+		t.Fatalf("want NODATA, got %v", r)
+	}
+	r := lookup("10.1.168.192.in-addr.arpa", dns.TypePTR)
+	if r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.PTR).Ptr != "laptop.lan." {
+		t.Fatalf("unexpected PTR response %v", r)
+	}
+
+	// Changed files are reloaded.
+	write(fmt.Sprintf("%d dd 192.168.1.20 desktop *\n", now.Add(time.Hour).Unix()))
+	if err := os.Chtimes(f, now, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	l.check(now)
+	if r := lookup("desktop.lan", dns.TypeA); r == nil || len(r.Answer) != 1 {
+		t.Fatalf("file was not reloaded, got %v", r)
+	}
+	if r := lookup("laptop.lan", dns.TypeA); r != nil {
+		t.Fatalf("old leases should be removed, got %v", r)
+	}
+
+	// Expired leases are removed without file changes.
+	l.check(now.Add(2 * time.Hour))
+	if r := lookup("desktop.lan", dns.TypeA); r != nil {
+		t.Fatalf("expired lease should be removed, got %v", r)
+	}
+}
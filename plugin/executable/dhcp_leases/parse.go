@@ -0,0 +1,229 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_leases
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lease file formats.
+const (
+	formatAuto    = "auto"
+	formatDnsmasq = "dnsmasq"
+	formatOdhcpd  = "odhcpd"
+	formatKea     = "kea"
+)
+
+// lease is an address that is leased to a host.
+type lease struct {
+	hostname string // as in the lease file
+	addr     netip.Addr
+	expiry   time.Time // zero means never expires
+}
+
+func detectFormat(b []byte) string {
+	line, _, _ := bytes.Cut(bytes.TrimSpace(b), []byte("\n"))
+	switch {
+	case bytes.HasPrefix(line, []byte("address,")):
+		return formatKea
+	case bytes.HasPrefix(line, []byte("# ")):
+		return formatOdhcpd
+	default:
+		return formatDnsmasq
+	}
+}
+
+func parseLeases(b []byte, format string) ([]lease, error) {
+	if format == formatAuto {
+		format = detectFormat(b)
+	}
+	switch format {
+	case formatDnsmasq:
+		return parseDnsmasq(b)
+	case formatOdhcpd:
+		return parseOdhcpd(b)
+	case formatKea:
+		return parseKea(b)
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+}
+
+// unixTime parses the expiry of a lease. The zero time is returned if it
+// is infinite. Other values, including 0 and negative ones, are unix
+// times, so leases with these values are expired.
+func unixTime(s string, infinite int64) (time.Time, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if n == infinite {
+		return time.Time{}, nil
+	}
+	return time.Unix(n, 0), nil
+}
+
+// Infinite expiry values of lease files. Kea has no such value, an
+// infinite lease has an expiry far in the future.
+const (
+	dnsmasqInfinite = 0
+	odhcpdInfinite  = -1
+)
+
+// parseDnsmasq parses dnsmasq.leases.
+//
+//	<expiry> <mac> <ipv4> <hostname> <client id>
+//	duid <server duid>
+//	<expiry> <iaid> <ipv6> <hostname> <duid>
+//
+// Expiry 0 means infinite. Unknown hostnames are "*".
+func parseDnsmasq(b []byte) ([]lease, error) {
+	var leases []lease
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for scanner.Scan() {
+		line++
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 || f[0] == "duid" {
+			continue
+		}
+		if len(f) < 4 {
+			return nil, fmt.Errorf("line %d: too few fields", line)
+		}
+		expiry, err := unixTime(f[0], dnsmasqInfinite)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %s", line, f[0])
+		}
+		addr, err := netip.ParseAddr(f[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid address %s", line, f[2])
+		}
+		leases = append(leases, lease{hostname: f[3], addr: addr, expiry: expiry})
+	}
+	return leases, scanner.Err()
+}
+
+// parseOdhcpd parses the odhcpd lease file (option leasefile).
+//
+//	# <iface> <duid|mac> <iaid|ipv4> <hostname> <expiry> <id> <prefix len> <addr/len>...
+//
+// Expiry -1 means infinite and 0 means expired. Unknown hostnames are "-".
+func parseOdhcpd(b []byte) ([]lease, error) {
+	var leases []lease
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for scanner.Scan() {
+		line++
+		s, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "# ")
+		if !ok {
+			continue // not a lease
+		}
+		f := strings.Fields(s)
+		if len(f) < 8 {
+			continue
+		}
+		expiry, err := unixTime(f[4], odhcpdInfinite)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %s", line, f[4])
+		}
+		for _, a := range f[7:] {
+			a, _, _ = strings.Cut(a, "/")
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid address %s", line, a)
+			}
+			leases = append(leases, lease{hostname: f[3], addr: addr, expiry: expiry})
+		}
+	}
+	return leases, scanner.Err()
+}
+
+// Kea lease states.
+const keaStateDefault = "0"
+
+// parseKea parses a Kea memfile (csv) lease file. Columns are found by
+// the header. Later rows of an address replace earlier ones, as Kea
+// appends updates to the file.
+func parseKea(b []byte) ([]lease, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header, %w", err)
+	}
+	col := make(map[string]int)
+	for i, name := range header {
+		col[name] = i
+	}
+	for _, name := range [...]string{"address", "expire", "hostname"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+	get := func(row []string, name string) string {
+		if i, ok := col[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	byAddr := make(map[netip.Addr]int) // index in leases
+	var leases []lease
+	for {
+		row, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if row[0] == "address" {
+			continue // header of an appended file
+		}
+		addr, err := netip.ParseAddr(get(row, "address"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s", get(row, "address"))
+		}
+		expire, err := strconv.ParseInt(get(row, "expire"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expire %s", get(row, "expire"))
+		}
+		l := lease{hostname: get(row, "hostname"), addr: addr, expiry: time.Unix(expire, 0)}
+		if state := get(row, "state"); len(state) > 0 && state != keaStateDefault {
+			l.hostname = "" // declined or reclaimed
+		}
+		if i, ok := byAddr[addr]; ok {
+			leases[i] = l
+			continue
+		}
+		byAddr[addr] = len(leases)
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
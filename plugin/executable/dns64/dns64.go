@@ -0,0 +1,259 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns64
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const PluginType = "dns64"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*DNS64)(nil)
+
+// Args configures AAAA synthesis (RFC 6147) for ipv6-only clients behind
+// a NAT64 gateway.
+type Args struct {
+	// Prefix is the NAT64 prefix. Its length must be 32, 40, 48, 56, 64
+	// or 96 (RFC 6052). Default is the well-known prefix 64:ff9b::/96.
+	Prefix string `yaml:"prefix"`
+	// Exclude are ipv6 prefixes. AAAA answers in them are treated as if
+	// they don't exist, so AAAA records are synthesized instead. Default
+	// is ::ffff:0:0/96 (RFC 6147 5.1.4).
+	Exclude []string `yaml:"exclude"`
+	// ExcludeIPv4 are ipv4 prefixes that are not synthesized, e.g. private
+	// addresses that can't be reached through the well-known prefix.
+	// Default is 0.0.0.0/8 and 127.0.0.0/8.
+	ExcludeIPv4 []string `yaml:"exclude_ipv4"`
+}
+
+func (a *Args) init() {
+	if len(a.Prefix) == 0 {
+		a.Prefix = "64:ff9b::/96"
+	}
+	if a.Exclude == nil {
+		a.Exclude = []string{"::ffff:0:0/96"}
+	}
+	if a.ExcludeIPv4 == nil {
+		a.ExcludeIPv4 = []string{"0.0.0.0/8", "127.0.0.0/8"}
+	}
+}
+
+// DNS64 synthesizes AAAA answers from A answers for domains that have no
+// AAAA record. Existing AAAA answers are passed through.
+type DNS64 struct {
+	prefix      netip.Prefix
+	exclude     []netip.Prefix
+	excludeIPv4 []netip.Prefix
+
+	synthesizedTotal prometheus.Counter
+}
+
+func Init(_ *coremain.BP, args any) (any, error) {
+	return NewDNS64(args.(*Args))
+}
+
+func NewDNS64(args *Args) (*DNS64, error) {
+	args.init()
+	prefix, err := netip.ParsePrefix(args.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix, %w", err)
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return nil, fmt.Errorf("prefix %s is not an ipv6 prefix", prefix)
+	}
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("invalid prefix length %d, it must be 32, 40, 48, 56, 64 or 96", prefix.Bits())
+	}
+	d := &DNS64{
+		prefix: prefix.Masked(),
+		synthesizedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "synthesized_total",
+			Help: "The total number of responses with synthesized AAAA records",
+		}),
+	}
+	if d.exclude, err = parsePrefixes(args.Exclude, true); err != nil {
+		return nil, err
+	}
+	if d.excludeIPv4, err = parsePrefixes(args.ExcludeIPv4, false); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func parsePrefixes(l []string, v6 bool) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(l))
+	for _, s := range l {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %s, %w", s, err)
+		}
+		if p.Addr().Is6() != v6 {
+			return nil, fmt.Errorf("invalid prefix %s, wrong ip version", s)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// Metrics implements coremain.MetricsProvider.
+func (d *DNS64) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{d.synthesizedTotal}
+}
+
+// Exec sends AAAA queries to the following plugins first. If the response
+// has no usable AAAA record, the query is sent again as an A query, and
+// AAAA records are synthesized from the A answers.
+func (d *DNS64) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeAAAA || q.Question[0].Qclass != dns.ClassINET {
+		return next.ExecNext(ctx, qCtx)
+	}
+	// Clients that validate DNSSEC themselves can't accept synthesized
+	// records. See RFC 6147 5.5.
+	if opt := qCtx.ClientOpt(); opt != nil && opt.Do() && q.CheckingDisabled {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	qCtxA := qCtx.Copy()
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil || r.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	if d.removeExcluded(r) {
+		return nil
+	}
+
+	qCtxA.Q().Question[0].Qtype = dns.TypeA
+	if err := next.ExecNext(ctx, qCtxA); err != nil {
+		return err
+	}
+	if rA := qCtxA.R(); rA != nil && rA.Rcode == dns.RcodeSuccess {
+		if synth := d.synthesize(q, rA, negativeTTL(r)); synth != nil {
+			d.synthesizedTotal.Inc()
+			qCtx.SetResponse(synth)
+		}
+	}
+	return nil
+}
+
+// removeExcluded removes AAAA answers in excluded prefixes from r. It
+// reports whether r still has AAAA answers.
+func (d *DNS64) removeExcluded(r *dns.Msg) bool {
+	has := false
+	answers := r.Answer[:0]
+	for _, rr := range r.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok {
+			addr, _ := netip.AddrFromSlice(aaaa.AAAA)
+			if containsAddr(d.exclude, addr) {
+				continue
+			}
+			has = true
+		}
+		answers = append(answers, rr)
+	}
+	r.Answer = answers
+	return has
+}
+
+// negativeTTL returns how long the AAAA response r can be cached as a
+// negative response. It is the SOA minimum of r, or 600s if r has no
+// SOA record. See RFC 6147 5.1.7.
+func negativeTTL(r *dns.Msg) uint32 {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+	return 600
+}
+
+// synthesize returns the response of AAAA query q from the response of
+// its A query. The ttl of synthesized records is capped by maxTTL. It
+// returns nil if there is nothing to synthesize.
+func (d *DNS64) synthesize(q *dns.Msg, rA *dns.Msg, maxTTL uint32) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = rA.RecursionAvailable
+	r.AuthenticatedData = false
+	synthesized := false
+	for _, rr := range rA.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, ok := netip.AddrFromSlice(rr.A.To4())
+			if !ok || containsAddr(d.excludeIPv4, addr) {
+				continue
+			}
+			r.Answer = append(r.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: rr.Hdr.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: min(rr.Hdr.Ttl, maxTTL)},
+				AAAA: net.IP(embed(d.prefix, addr).AsSlice()),
+			})
+			synthesized = true
+		case *dns.CNAME, *dns.DNAME:
+			r.Answer = append(r.Answer, dns.Copy(rr))
+		}
+	}
+	if !synthesized {
+		return nil
+	}
+	return r
+}
+
+// embed embeds ipv4 address v4 in the NAT64 prefix. See RFC 6052 2.2.
+// Bits 64 to 71 (the "u" octet) are always zero.
+func embed(prefix netip.Prefix, v4 netip.Addr) netip.Addr {
+	b := prefix.Addr().As16()
+	a := v4.As4()
+	i := prefix.Bits() / 8
+	for _, x := range a {
+		if i == 8 {
+			i++ // skip the u octet
+		}
+		b[i] = x
+		i++
+	}
+	return netip.AddrFrom16(b)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
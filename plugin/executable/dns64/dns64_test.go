@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns64
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func Test_embed(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.2.33")
+	// Examples of RFC 6052 2.4.
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+	for _, tt := range tests {
+		if got := embed(netip.MustParsePrefix(tt.prefix), v4); got != netip.MustParseAddr(tt.want) {
+			t.Errorf("%s: want %s, got %s", tt.prefix, tt.want, got)
+		}
+	}
+}
+
+// byType answers queries with records of their type.
+func byType(rrs map[uint16][]string) plugintest.Responder {
+	return func(ctx context.Context, qCtx *query_context.Context) error {
+		return plugintest.Answer(rrs[qCtx.QQuestion().Qtype]...)(ctx, qCtx)
+	}
+}
+
+// withSOA adds a SOA record to the authority section of responses that
+// have no answer.
+func withSOA(next plugintest.Responder) plugintest.Responder {
+	return func(ctx context.Context, qCtx *query_context.Context) error {
+		if err := next(ctx, qCtx); err != nil {
+			return err
+		}
+		if r := qCtx.R(); r != nil && len(r.Answer) == 0 {
+			r.Ns = append(r.Ns, plugintest.MustRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 30"))
+		}
+		return nil
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	d, err := NewDNS64(&Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		qtype uint16
+		next  plugintest.Responder
+		want  string
+	}{
+		{"synthesized", dns.TypeAAAA, byType(map[uint16][]string{
+			dns.TypeA: {"@ 300 IN CNAME cdn.example.net.", "cdn.example.net. 60 IN A 192.0.2.1", "cdn.example.net. 60 IN A 127.0.0.1"},
+		}), "rcode: NOERROR\nflags: rd ra\nquestion: ;example.com.\tIN\t AAAA\nanswer:\nexample.com.\t300\tIN\tCNAME\tcdn.example.net.\ncdn.example.net.\t60\tIN\tAAAA\t64:ff9b::c000:201\n"},
+		{"existing AAAA", dns.TypeAAAA, byType(map[uint16][]string{
+			dns.TypeAAAA: {"@ 300 IN AAAA 2001:db8::1"},
+			dns.TypeA:    {"@ 300 IN A 192.0.2.1"},
+		}), "rcode: NOERROR\nflags: rd ra\nquestion: ;example.com.\tIN\t AAAA\nanswer:\nexample.com.\t300\tIN\tAAAA\t2001:db8::1\n"},
+		{"excluded AAAA", dns.TypeAAAA, byType(map[uint16][]string{
+			dns.TypeAAAA: {"@ 300 IN AAAA ::ffff:192.0.2.9"},
+			dns.TypeA:    {"@ 300 IN A 192.0.2.1"},
+		}), "rcode: NOERROR\nflags: rd ra\nquestion: ;example.com.\tIN\t AAAA\nanswer:\nexample.com.\t300\tIN\tAAAA\t64:ff9b::c000:201\n"},
+		{"soa minimum", dns.TypeAAAA, withSOA(byType(map[uint16][]string{
+			dns.TypeA: {"@ 300 IN A 192.0.2.1"},
+		})), "rcode: NOERROR\nflags: rd ra\nquestion: ;example.com.\tIN\t AAAA\nanswer:\nexample.com.\t30\tIN\tAAAA\t64:ff9b::c000:201\n"},
+		{"no soa", dns.TypeAAAA, byType(map[uint16][]string{
+			dns.TypeA: {"@ 3600 IN A 192.0.2.1"},
+		}), "rcode: NOERROR\nflags: rd ra\nquestion: ;example.com.\tIN\t AAAA\nanswer:\nexample.com.\t600\tIN\tAAAA\t64:ff9b::c000:201\n"},
+		{"no A", dns.TypeAAAA, byType(nil), "rcode: NOERROR\nflags: rd ra\nquestion: ;example.com.\tIN\t AAAA\n"},
+		{"nxdomain", dns.TypeAAAA, plugintest.Rcode(dns.RcodeNameError), "rcode: NXDOMAIN\nflags: rd ra\nquestion: ;example.com.\tIN\t AAAA\n"},
+		{"A query", dns.TypeA, byType(map[uint16][]string{
+			dns.TypeA: {"@ 300 IN A 192.0.2.1"},
+		}), "rcode: NOERROR\nflags: rd ra\nquestion: ;example.com.\tIN\t A\nanswer:\nexample.com.\t300\tIN\tA\t192.0.2.1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qCtx := plugintest.NewQuery("example.com", tt.qtype).Build()
+			if err := plugintest.Exec(t, d, qCtx, tt.next); err != nil {
+				t.Fatal(err)
+			}
+			plugintest.AssertResponse(t, qCtx.R(), tt.want)
+		})
+	}
+
+	// Clients that validate DNSSEC get the original response.
+	qCtx := plugintest.NewQuery("example.com", dns.TypeAAAA).EDNS0(1232, true).Build()
+	qCtx.Q().CheckingDisabled = true
+	if err := plugintest.Exec(t, d, qCtx, byType(map[uint16][]string{dns.TypeA: {"@ 300 IN A 192.0.2.1"}})); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); len(r.Answer) != 0 {
+		t.Fatalf("want the original response, got %v", r)
+	}
+}
+
+func TestNewDNS64(t *testing.T) {
+	for _, prefix := range []string{"64:ff9b::/80", "192.0.2.0/24", "::ffff:0:0/96", "bad"} {
+		if _, err := NewDNS64(&Args{Prefix: prefix}); err == nil {
+			t.Errorf("%s: want error", prefix)
+		}
+	}
+	if _, err := NewDNS64(&Args{Exclude: []string{"10.0.0.0/8"}}); err == nil {
+		t.Error("want error of ipv4 exclude prefix")
+	}
+}
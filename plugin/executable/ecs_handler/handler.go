@@ -51,6 +51,12 @@ type Args struct {
 	Preset  string `yaml:"preset"`
 	Mask4   int    `yaml:"mask4"`
 	Mask6   int    `yaml:"mask6"`
+
+	// Strip removes ECS from queries, other args are ignored.
+	Strip bool `yaml:"strip"`
+	// Force replaces the ECS that was already added to the query (e.g.
+	// by a previous ecs_handler) instead of keeping it.
+	Force bool `yaml:"force"`
 }
 
 type ECSHandler struct {
@@ -119,10 +125,18 @@ func (e *ECSHandler) Exec(ctx context.Context, qCtx *query_context.Context, next
 // AddECS adds a *dns.EDNS0_SUBNET record to q.
 func (e *ECSHandler) addECS(qCtx *query_context.Context) (forwarded bool) {
 	queryOpt := qCtx.QOpt()
+	if e.args.Strip {
+		removeECS(queryOpt)
+		return false
+	}
 	// Check if query already has an ecs.
 	for _, o := range queryOpt.Option {
 		if o.Option() == dns.EDNS0SUBNET {
-			return false // skip it
+			if !e.args.Force {
+				return false // skip it
+			}
+			removeECS(queryOpt)
+			break
 		}
 	}
 	if qCtx.QQuestion().Qclass != dns.ClassINET {
@@ -172,6 +186,17 @@ func (e *ECSHandler) addECS(qCtx *query_context.Context) (forwarded bool) {
 	return false
 }
 
+func removeECS(opt *dns.OPT) {
+	n := 0
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			opt.Option[n] = o
+			n++
+		}
+	}
+	opt.Option = opt.Option[:n]
+}
+
 func newSubnet(ip net.IP, mask uint8, v6 bool) *dns.EDNS0_SUBNET {
 	edns0Subnet := new(dns.EDNS0_SUBNET)
 	// edns family: https://www.iana.org/assignments/address-family-numbers/address-family-numbers.xhtml
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package edns0_meta
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "edns0_meta"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+// Args of edns0_meta. It attaches the client group and marks of the
+// query to the query that will be forwarded, as an EDNS0 local option.
+// The next mosdns in a chain reads them by its listener's edns0_meta
+// args, so its sequences can match the same client groups and marks,
+// e.g. the marks of matched policies.
+type Args struct {
+	// Code of the option. Default is dnsutils.DefaultMetaOptionCode.
+	Code uint16 `yaml:"code"`
+
+	// Marks that will be attached if the query has them.
+	Marks []uint32 `yaml:"marks"`
+
+	// ClientGroup, if not empty, replaces the client group of the query.
+	ClientGroup string `yaml:"client_group"`
+
+	// ClientAddr attaches the client address, so the next mosdns can
+	// match the original client instead of this mosdns.
+	ClientAddr bool `yaml:"client_addr"`
+}
+
+var _ sequence.Executable = (*Meta)(nil)
+
+type Meta struct {
+	code       uint16
+	marks      []uint32
+	group      string
+	clientAddr bool
+}
+
+func Init(_ *coremain.BP, args any) (any, error) {
+	return NewMeta(args.(*Args)), nil
+}
+
+func NewMeta(args *Args) *Meta {
+	code := args.Code
+	if code == 0 {
+		code = dnsutils.DefaultMetaOptionCode
+	}
+	return &Meta{code: code, marks: args.Marks, group: args.ClientGroup, clientAddr: args.ClientAddr}
+}
+
+// QuickSetup format: [mark ...]
+func QuickSetup(_ sequence.BQ, s string) (any, error) {
+	args := new(Args)
+	for _, f := range strings.Fields(s) {
+		m, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mark %s, %w", f, err)
+		}
+		args.Marks = append(args.Marks, uint32(m))
+	}
+	return NewMeta(args), nil
+}
+
+func (m *Meta) Exec(_ context.Context, qCtx *query_context.Context) error {
+	meta := dnsutils.Meta{ClientGroup: qCtx.ServerMeta.ClientGroup}
+	if len(m.group) > 0 {
+		meta.ClientGroup = m.group
+	}
+	for _, mark := range m.marks {
+		if qCtx.HasMark(mark) {
+			meta.Marks = append(meta.Marks, mark)
+		}
+	}
+	if m.clientAddr {
+		meta.ClientAddr = qCtx.ServerMeta.ClientAddr
+	}
+
+	opt := qCtx.QOpt()
+	opt.Option = removeOption(opt.Option, m.code)
+	if len(meta.ClientGroup) == 0 && len(meta.Marks) == 0 && !meta.ClientAddr.IsValid() {
+		return nil
+	}
+	b, err := dnsutils.PackMeta(meta)
+	if err != nil {
+		return err
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: m.code, Data: b})
+	return nil
+}
+
+func removeOption(opts []dns.EDNS0, code uint16) []dns.EDNS0 {
+	n := 0
+	for _, o := range opts {
+		if o.Option() != code {
+			opts[n] = o
+			n++
+		}
+	}
+	return opts[:n]
+}
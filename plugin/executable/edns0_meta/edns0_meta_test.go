@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package edns0_meta
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func TestMeta(t *testing.T) {
+	m := NewMeta(&Args{Marks: []uint32{1, 2}})
+	qCtx := plugintest.NewQuery("example.com.", dns.TypeA).ClientGroup("kids").Mark(2, 3).Build()
+	// An old option from the client should be replaced.
+	qCtx.QOpt().Option = append(qCtx.QOpt().Option, &dns.EDNS0_LOCAL{Code: dnsutils.DefaultMetaOptionCode})
+	if err := plugintest.Exec(t, m, qCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for _, o := range qCtx.QOpt().Option {
+		if o.Option() == dnsutils.DefaultMetaOptionCode {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("want 1 meta option, got %d", n)
+	}
+	b, _ := dnsutils.FindMetaOption(qCtx.QOpt(), dnsutils.DefaultMetaOptionCode)
+	got, err := dnsutils.UnpackMeta(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dnsutils.Meta{ClientGroup: "kids", Marks: []uint32{2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+
+	// Nothing to attach.
+	qCtx = plugintest.NewQuery("example.com.", dns.TypeA).Build()
+	if err := plugintest.Exec(t, m, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dnsutils.FindMetaOption(qCtx.QOpt(), dnsutils.DefaultMetaOptionCode); ok {
+		t.Fatal("unexpected meta option")
+	}
+}
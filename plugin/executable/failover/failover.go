@@ -0,0 +1,415 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package failover
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const PluginType = "failover"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*Failover)(nil)
+
+// Args configures names that are answered by healthy targets.
+type Args struct {
+	Records []RecordArgs `yaml:"records"`
+
+	Interval int `yaml:"interval"` // (seconds) probe interval, default is 10.
+	Timeout  int `yaml:"timeout"`  // (milliseconds) probe timeout, default is 2000.
+	// Failures is the number of consecutive failed probes that mark a
+	// target down. Default is 2. One successful probe marks it up.
+	Failures int `yaml:"failures"`
+	TTL      int `yaml:"ttl"` // (seconds) ttl of answers, default is 30.
+
+	// InsecureSkipVerify disables certificate verification of https probes,
+	// for self-signed services.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+type RecordArgs struct {
+	Name    string       `yaml:"name"`
+	Targets []TargetArgs `yaml:"targets"`
+}
+
+type TargetArgs struct {
+	// Addr is an ipv4 or ipv6 address. A queries are answered by
+	// ipv4 targets, AAAA queries by ipv6 targets.
+	Addr string `yaml:"addr"`
+	// Probe checks the health of the target. "tcp://host:port" connects
+	// to the port. "http://..." and "https://..." expect 2xx or 3xx status
+	// codes. Empty means the target is always healthy.
+	Probe string `yaml:"probe"`
+	// Healthy targets with the lowest priority are used. Default is 0.
+	Priority int `yaml:"priority"`
+	// Weight of the target in its priority. One target is picked
+	// randomly by weights for each response. Default is 1.
+	Weight int `yaml:"weight"`
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultNum(&a.Interval, 10)
+	utils.SetDefaultNum(&a.Timeout, 2000)
+	utils.SetDefaultNum(&a.Failures, 2)
+	utils.SetDefaultNum(&a.TTL, 30)
+	if len(a.Records) == 0 {
+		return errors.New("no record is configured")
+	}
+	for i := range a.Records {
+		r := &a.Records[i]
+		if _, ok := dns.IsDomainName(r.Name); !ok {
+			return fmt.Errorf("record #%d has an invalid name %q", i, r.Name)
+		}
+		if len(r.Targets) == 0 {
+			return fmt.Errorf("record %s has no target", r.Name)
+		}
+		for j := range r.Targets {
+			t := &r.Targets[j]
+			utils.SetDefaultNum(&t.Weight, 1)
+			if !utils.CheckNumRange(t.Weight, 1, 1000) {
+				return fmt.Errorf("record %s target #%d has an invalid weight %d, must be 1~1000", r.Name, j, t.Weight)
+			}
+		}
+	}
+	return nil
+}
+
+// probeFunc returns nil if probe succeeded.
+type probeFunc func(ctx context.Context, probe string) error
+
+// Failover answers A/AAAA queries of configured names with addresses of
+// healthy targets, so names follow services that are up. Other query types
+// of these names get empty responses. Queries of other names are ignored.
+// If all targets of a name are down, all of them are considered healthy.
+type Failover struct {
+	args    Args
+	logger  *zap.Logger
+	probe   probeFunc
+	records map[string]*record // fqdn in lower case -> record
+
+	healthy *prometheus.GaugeVec
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+type record struct {
+	name    string
+	targets []*target
+}
+
+type target struct {
+	addr     netip.Addr
+	probe    string
+	priority int
+	weight   int
+
+	up    atomic.Bool
+	fails int // consecutive failures, only accessed by the probe loop.
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if err := a.init(); err != nil {
+		return nil, err
+	}
+	f, err := NewFailover(*a, httpOrTCPProbe(a.InsecureSkipVerify))
+	if err != nil {
+		return nil, err
+	}
+	f.logger = bp.L()
+	bp.RegAPI(f.api())
+	go f.probeLoop()
+	return f, nil
+}
+
+// NewFailover creates a Failover. args must be initialized. Targets are
+// up until they are probed. Probes are not started.
+func NewFailover(args Args, probe probeFunc) (*Failover, error) {
+	f := &Failover{
+		args:    args,
+		logger:  zap.NewNop(),
+		probe:   probe,
+		records: make(map[string]*record),
+		healthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "target_healthy",
+			Help: "Whether the target is healthy (1) or not (0)",
+		}, []string{"name", "addr"}),
+		closeNotify: make(chan struct{}),
+	}
+	for _, ra := range args.Records {
+		name := dns.Fqdn(strings.ToLower(ra.Name))
+		if _, dup := f.records[name]; dup {
+			return nil, fmt.Errorf("duplicated record %s", ra.Name)
+		}
+		r := &record{name: name}
+		for _, ta := range ra.Targets {
+			addr, err := netip.ParseAddr(ta.Addr)
+			if err != nil {
+				return nil, fmt.Errorf("record %s has an invalid addr, %w", ra.Name, err)
+			}
+			if len(ta.Probe) > 0 {
+				if err := checkProbe(ta.Probe); err != nil {
+					return nil, fmt.Errorf("record %s has an invalid probe %s, %w", ra.Name, ta.Probe, err)
+				}
+			}
+			t := &target{addr: addr.Unmap(), probe: ta.Probe, priority: ta.Priority, weight: ta.Weight}
+			t.up.Store(true)
+			f.healthy.WithLabelValues(name, t.addr.String()).Set(1)
+			r.targets = append(r.targets, t)
+		}
+		f.records[name] = r
+	}
+	return f, nil
+}
+
+// Metrics implements coremain.MetricsProvider.
+func (f *Failover) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{f.healthy}
+}
+
+func (f *Failover) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+	rec := f.records[strings.ToLower(question.Name)]
+	if rec == nil {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	var is4 bool
+	switch question.Qtype {
+	case dns.TypeA:
+		is4 = true
+	case dns.TypeAAAA:
+	default:
+		qCtx.SetResponse(r)
+		return nil
+	}
+	if t := rec.pick(is4); t != nil {
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: uint32(f.args.TTL)}
+		if is4 {
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: t.addr.AsSlice()})
+		} else {
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: t.addr.AsSlice()})
+		}
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+// pick picks a target of the family by weights from healthy targets with
+// the lowest priority. If no target is healthy, all targets of the family
+// are used. It returns nil if the record has no target of the family.
+func (r *record) pick(is4 bool) *target {
+	var candidates []*target
+	for _, healthyOnly := range [...]bool{true, false} {
+		for _, t := range r.targets {
+			if t.addr.Is4() != is4 || (healthyOnly && !t.up.Load()) {
+				continue
+			}
+			switch {
+			case len(candidates) == 0 || t.priority < candidates[0].priority:
+				candidates = append(candidates[:0], t)
+			case t.priority == candidates[0].priority:
+				candidates = append(candidates, t)
+			}
+		}
+		if len(candidates) > 0 {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sum := 0
+	for _, t := range candidates {
+		sum += t.weight
+	}
+	n := rand.Intn(sum)
+	for _, t := range candidates {
+		if n < t.weight {
+			return t
+		}
+		n -= t.weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+func (f *Failover) probeLoop() {
+	ticker := time.NewTicker(time.Duration(f.args.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		f.probeAll()
+		select {
+		case <-ticker.C:
+		case <-f.closeNotify:
+			return
+		}
+	}
+}
+
+// probeAll probes all targets concurrently and updates their states.
+func (f *Failover) probeAll() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(f.args.Timeout)*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, r := range f.records {
+		for _, t := range r.targets {
+			if len(t.probe) == 0 {
+				continue
+			}
+			wg.Add(1)
+			go func(r *record, t *target) {
+				defer wg.Done()
+				f.updateTarget(r, t, f.probe(ctx, t.probe))
+			}(r, t)
+		}
+	}
+	wg.Wait()
+}
+
+func (f *Failover) updateTarget(r *record, t *target, err error) {
+	if err == nil {
+		t.fails = 0
+		if !t.up.Swap(true) {
+			f.logger.Info("target is up", zap.String("name", r.name), zap.Stringer("addr", t.addr))
+			f.healthy.WithLabelValues(r.name, t.addr.String()).Set(1)
+		}
+		return
+	}
+	t.fails++
+	if t.fails >= f.args.Failures && t.up.Swap(false) {
+		f.logger.Warn("target is down", zap.String("name", r.name), zap.Stringer("addr", t.addr), zap.Error(err))
+		f.healthy.WithLabelValues(r.name, t.addr.String()).Set(0)
+	}
+}
+
+func (f *Failover) Close() error {
+	f.closeOnce.Do(func() { close(f.closeNotify) })
+	return nil
+}
+
+type targetStatus struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Up       bool   `json:"up"`
+}
+
+func (f *Failover) api() *chi.Mux {
+	m := chi.NewRouter()
+	m.Get("/status", func(w http.ResponseWriter, _ *http.Request) {
+		var l []targetStatus
+		for _, ra := range f.args.Records {
+			r := f.records[dns.Fqdn(strings.ToLower(ra.Name))]
+			for _, t := range r.targets {
+				l = append(l, targetStatus{Name: r.name, Addr: t.addr.String(), Priority: t.priority, Weight: t.weight, Up: t.up.Load()})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(l)
+	})
+	return m
+}
+
+func checkProbe(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "tcp":
+		_, _, err := net.SplitHostPort(u.Host)
+		return err
+	case "http", "https":
+		if len(u.Host) == 0 {
+			return errors.New("missing host")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported probe scheme %q", u.Scheme)
+	}
+}
+
+func httpOrTCPProbe(insecureSkipVerify bool) probeFunc {
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+			DisableKeepAlives: true,
+		},
+		// Redirects are not followed, 3xx is healthy.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return func(ctx context.Context, probe string) error {
+		if hostPort, ok := strings.CutPrefix(probe, "tcp://"); ok {
+			var d net.Dialer
+			c, err := d.DialContext(ctx, "tcp", hostPort)
+			if err != nil {
+				return err
+			}
+			return c.Close()
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, probe, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("http status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package failover
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func TestFailover(t *testing.T) {
+	var mu sync.Mutex
+	down := make(map[string]bool)
+	probe := func(_ context.Context, p string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if down[p] {
+			return errors.New("down")
+		}
+		return nil
+	}
+
+	args := Args{Failures: 2, Records: []RecordArgs{{
+		Name: "nas.home.lan",
+		Targets: []TargetArgs{
+			{Addr: "192.168.1.10", Probe: "tcp://192.168.1.10:80"},
+			{Addr: "192.168.1.11", Probe: "tcp://192.168.1.11:80", Priority: 1},
+			{Addr: "fd00::10"},
+		},
+	}}}
+	if err := args.init(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFailover(args, probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer := func(name string, qt uint16) *dns.Msg {
+		t.Helper()
+		qCtx := plugintest.NewQuery(name, qt).Build()
+		if err := plugintest.Exec(t, f, qCtx); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R()
+	}
+	wantA := func(addr string) {
+		t.Helper()
+		r := answer("NAS.home.lan", dns.TypeA)
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != addr {
+			t.Fatalf("want %s, got %v", addr, r.Answer)
+		}
+	}
+	setDown := func(p string, v bool) {
+		mu.Lock()
+		down[p] = v
+		mu.Unlock()
+	}
+
+	wantA("192.168.1.10")
+	if r := answer("nas.home.lan", dns.TypeAAAA); len(r.Answer) != 1 {
+		t.Fatalf("want an AAAA answer, got %v", r.Answer)
+	}
+	if r := answer("nas.home.lan", dns.TypeTXT); r == nil || len(r.Answer) != 0 {
+		t.Fatalf("want an empty response, got %v", r)
+	}
+	if r := answer("other.home.lan", dns.TypeA); r != nil {
+		t.Fatalf("other names should be ignored, got %v", r)
+	}
+
+	// The primary fails. It is down after 2 failures.
+	setDown("tcp://192.168.1.10:80", true)
+	f.probeAll()
+	wantA("192.168.1.10")
+	f.probeAll()
+	wantA("192.168.1.11")
+
+	// All down, all targets are used.
+	setDown("tcp://192.168.1.11:80", true)
+	f.probeAll()
+	f.probeAll()
+	wantA("192.168.1.10")
+
+	// The primary recovers.
+	setDown("tcp://192.168.1.10:80", false)
+	f.probeAll()
+	wantA("192.168.1.10")
+}
+
+func Test_record_pick_weight(t *testing.T) {
+	args := Args{Records: []RecordArgs{{
+		Name: "web.home.lan",
+		Targets: []TargetArgs{
+			{Addr: "10.0.0.1", Weight: 3},
+			{Addr: "10.0.0.2", Weight: 1},
+		},
+	}}}
+	if err := args.init(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFailover(args, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := f.records["web.home.lan."]
+	n := 0
+	for i := 0; i < 4000; i++ {
+		if r.pick(true).addr.String() == "10.0.0.1" {
+			n++
+		}
+	}
+	if n < 2700 || n > 3300 {
+		t.Fatalf("want about 3000 picks of the heavier target, got %d", n)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package family_policy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_ip"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "family_policy"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+// Args of family_policy. Clients that match a rule only get addresses of
+// one family. Queries of the other family get empty (NODATA) responses,
+// and records and SVCB/HTTPS hints of the other family are removed from
+// other responses. The first matched rule is used.
+type Args struct {
+	Rules []RuleArgs `yaml:"rules"`
+}
+
+type RuleArgs struct {
+	// Clients of these groups (set by listener auth), or from these
+	// addresses match the rule.
+	ClientGroups []string `yaml:"client_groups"`
+	ClientIPs    []string `yaml:"client_ips"`
+	IPSets       []string `yaml:"ip_sets"`
+	Files        []string `yaml:"files"`
+
+	// Only is "ipv4" or "ipv6".
+	Only string `yaml:"only"`
+}
+
+var _ sequence.RecursiveExecutable = (*Policy)(nil)
+
+type Policy struct {
+	rules []rule
+}
+
+type rule struct {
+	groups []string
+	ips    sequence.Matcher // maybe nil
+	only   uint16           // dns.TypeA or dns.TypeAAAA
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewPolicy(bp, args.(*Args))
+}
+
+func NewPolicy(bq sequence.BQ, args *Args) (*Policy, error) {
+	p := new(Policy)
+	for i, ra := range args.Rules {
+		r := rule{groups: ra.ClientGroups}
+		switch ra.Only {
+		case "ipv4":
+			r.only = dns.TypeA
+		case "ipv6":
+			r.only = dns.TypeAAAA
+		default:
+			return nil, fmt.Errorf("rule #%d: invalid only %q, must be ipv4 or ipv6", i, ra.Only)
+		}
+		if len(ra.ClientIPs)+len(ra.IPSets)+len(ra.Files) > 0 {
+			m, err := base_ip.NewMatcher(bq, &base_ip.Args{IPs: ra.ClientIPs, IPSets: ra.IPSets, Files: ra.Files}, matchClientAddr)
+			if err != nil {
+				return nil, fmt.Errorf("rule #%d: %w", i, err)
+			}
+			r.ips = m
+		}
+		if len(r.groups) == 0 && r.ips == nil {
+			return nil, fmt.Errorf("rule #%d: no client is configured", i)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+func (p *Policy) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	only, err := p.match(ctx, qCtx)
+	if err != nil {
+		return err
+	}
+	if only == 0 {
+		return next.ExecNext(ctx, qCtx)
+	}
+	unwanted := dns.TypeAAAA
+	if only == dns.TypeAAAA {
+		unwanted = dns.TypeA
+	}
+
+	q := qCtx.Q()
+	if len(q.Question) == 1 && q.Question[0].Qtype == unwanted {
+		qCtx.SetResponse(dnsutils.GenEmptyReply(q, dns.RcodeSuccess))
+		return nil
+	}
+
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	if r := qCtx.R(); r != nil {
+		r.Answer = filterRRs(r.Answer, unwanted)
+		r.Extra = filterRRs(r.Extra, unwanted)
+	}
+	return nil
+}
+
+// match returns the family of the first matched rule, or 0 if no rule
+// matched.
+func (p *Policy) match(ctx context.Context, qCtx *query_context.Context) (uint16, error) {
+	for _, r := range p.rules {
+		if g := qCtx.ServerMeta.ClientGroup; len(g) > 0 && slices.Contains(r.groups, g) {
+			return r.only, nil
+		}
+		if r.ips != nil {
+			ok, err := r.ips.Match(ctx, qCtx)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				return r.only, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// filterRRs removes records of type unwanted, and address hints of that
+// family from SVCB/HTTPS records. Records may be shared (e.g. by cache),
+// so records are copied before modification.
+func filterRRs(rrs []dns.RR, unwanted uint16) []dns.RR {
+	unwantedHint := dns.SVCB_IPV6HINT
+	if unwanted == dns.TypeA {
+		unwantedHint = dns.SVCB_IPV4HINT
+	}
+	hasUnwantedHint := func(kv dns.SVCBKeyValue) bool { return kv.Key() == unwantedHint }
+
+	filtered := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == unwanted {
+			continue
+		}
+		switch v := rr.(type) {
+		case *dns.SVCB:
+			if slices.ContainsFunc(v.Value, hasUnwantedHint) {
+				v = dns.Copy(v).(*dns.SVCB)
+				v.Value = slices.DeleteFunc(v.Value, hasUnwantedHint)
+				rr = v
+			}
+		case *dns.HTTPS:
+			if slices.ContainsFunc(v.Value, hasUnwantedHint) {
+				v = dns.Copy(v).(*dns.HTTPS)
+				v.Value = slices.DeleteFunc(v.Value, hasUnwantedHint)
+				rr = v
+			}
+		}
+		filtered = append(filtered, rr)
+	}
+	return filtered
+}
+
+func matchClientAddr(qCtx *query_context.Context, m netlist.Matcher) (bool, error) {
+	addr := qCtx.ServerMeta.ClientAddr
+	if !addr.IsValid() {
+		return false, nil
+	}
+	return m.Match(addr), nil
+}
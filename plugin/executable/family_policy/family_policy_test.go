@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package family_policy
+
+import (
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func TestPolicy_Exec(t *testing.T) {
+	p, err := NewPolicy(plugintest.NewBQ(nil), &Args{Rules: []RuleArgs{
+		{ClientIPs: []string{"192.168.20.0/24"}, Only: "ipv4"},
+		{ClientGroups: []string{"v6lab"}, Only: "ipv6"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer := plugintest.Answer(
+		"@ 300 IN A 192.0.2.1",
+		"@ 300 IN AAAA 2001:db8::1",
+		`@ 300 IN HTTPS 1 . alpn="h2" ipv4hint="192.0.2.1" ipv6hint="2001:db8::1"`,
+	)
+	tests := []struct {
+		name   string
+		q      *plugintest.Query
+		want   int // number of answers
+		hints4 bool
+		hints6 bool
+	}{
+		{"no rule", plugintest.NewQuery("example.com", dns.TypeANY).Client("10.0.0.1"), 3, true, true},
+		{"v4 only", plugintest.NewQuery("example.com", dns.TypeANY).Client("192.168.20.5"), 2, true, false},
+		{"v4 only aaaa", plugintest.NewQuery("example.com", dns.TypeAAAA).Client("192.168.20.5"), 0, false, false},
+		{"v6 only", plugintest.NewQuery("example.com", dns.TypeANY).Client("10.0.0.1").ClientGroup("v6lab"), 2, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qCtx := tt.q.Build()
+			if err := plugintest.Exec(t, p, qCtx, answer); err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			if len(r.Answer) != tt.want {
+				t.Fatalf("want %d answers, got %v", tt.want, r.Answer)
+			}
+			var hints4, hints6 bool
+			for _, rr := range r.Answer {
+				if h, ok := rr.(*dns.HTTPS); ok {
+					for _, kv := range h.Value {
+						hints4 = hints4 || kv.Key() == dns.SVCB_IPV4HINT
+						hints6 = hints6 || kv.Key() == dns.SVCB_IPV6HINT
+					}
+				}
+			}
+			if hints4 != tt.hints4 || hints6 != tt.hints6 {
+				t.Fatalf("unexpected hints, %v", r.Answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fault
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "fault"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*Fault)(nil)
+
+// Args configures faults that are injected to queries, for testing
+// clients and fallback behaviors. Use it with sequence matches to
+// inject faults for specific domains.
+type Args struct {
+	// Enabled must be set explicitly. Otherwise, the plugin is a noop.
+	Enabled bool `yaml:"enabled"`
+
+	// Latency in milliseconds added to queries, plus a random jitter
+	// in [0, JitterMs).
+	LatencyMs int `yaml:"latency_ms"`
+	JitterMs  int `yaml:"jitter_ms"`
+
+	// Rates in [0, 1].
+	// DropRate drops queries. Clients receive no response.
+	DropRate float64 `yaml:"drop_rate"`
+	// ServfailRate answers SERVFAIL without calling following plugins.
+	ServfailRate float64 `yaml:"servfail_rate"`
+}
+
+func (a *Args) validate() error {
+	if a.LatencyMs < 0 || a.JitterMs < 0 {
+		return fmt.Errorf("invalid latency %d or jitter %d", a.LatencyMs, a.JitterMs)
+	}
+	for _, r := range [...]float64{a.DropRate, a.ServfailRate} {
+		if r < 0 || r > 1 {
+			return fmt.Errorf("invalid rate %v, must be in [0, 1]", r)
+		}
+	}
+	return nil
+}
+
+type Fault struct {
+	args *Args
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	if a.Enabled {
+		bp.L().Warn("fault injection is enabled, do not use it in production",
+			zap.Int("latency_ms", a.LatencyMs),
+			zap.Int("jitter_ms", a.JitterMs),
+			zap.Float64("drop_rate", a.DropRate),
+			zap.Float64("servfail_rate", a.ServfailRate),
+		)
+	}
+	return &Fault{args: a}, nil
+}
+
+func (f *Fault) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	if !f.args.Enabled {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	d := time.Duration(f.args.LatencyMs) * time.Millisecond
+	if f.args.JitterMs > 0 {
+		d += time.Duration(rand.Intn(f.args.JitterMs)) * time.Millisecond
+	}
+	if d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return context.Cause(ctx)
+		}
+	}
+
+	if f.args.DropRate > 0 && rand.Float64() < f.args.DropRate {
+		qCtx.DropResponse()
+		return nil
+	}
+	if f.args.ServfailRate > 0 && rand.Float64() < f.args.ServfailRate {
+		r := new(dns.Msg)
+		r.SetRcode(qCtx.Q(), dns.RcodeServerFailure)
+		qCtx.SetResponse(r)
+		return nil
+	}
+	return next.ExecNext(ctx, qCtx)
+}
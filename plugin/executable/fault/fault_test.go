@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fault
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+func TestFault_Exec(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        Args
+		wantNext    bool
+		wantDropped bool
+		wantRcode   int // -1 if no response is expected
+	}{
+		{"disabled", Args{DropRate: 1, ServfailRate: 1}, true, false, dns.RcodeSuccess},
+		{"drop", Args{Enabled: true, DropRate: 1}, false, true, -1},
+		{"servfail", Args{Enabled: true, ServfailRate: 1}, false, false, dns.RcodeServerFailure},
+		{"latency", Args{Enabled: true, LatencyMs: 20}, true, false, dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Fault{args: &tt.args}
+			var called bool
+			next := sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+				called = true
+				r := new(dns.Msg)
+				r.SetReply(qCtx.Q())
+				qCtx.SetResponse(r)
+				return nil
+			})
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			qCtx := query_context.NewContext(q)
+
+			// Drops must not wait for the query timeout.
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			start := time.Now()
+			cw := sequence.NewChainWalker([]*sequence.ChainNode{{E: next}}, nil)
+			if err := f.Exec(ctx, qCtx, cw); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < time.Duration(tt.args.LatencyMs)*time.Millisecond || elapsed > time.Second {
+				t.Fatalf("unexpected elapsed time %s", elapsed)
+			}
+			if called != tt.wantNext {
+				t.Fatalf("want next called %v, got %v", tt.wantNext, called)
+			}
+			if qCtx.ResponseDropped() != tt.wantDropped {
+				t.Fatalf("want dropped %v, got %v", tt.wantDropped, qCtx.ResponseDropped())
+			}
+			if tt.wantRcode < 0 {
+				if qCtx.R() != nil {
+					t.Fatal("unexpected response")
+				}
+				return
+			}
+			if qCtx.R() == nil || qCtx.R().Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %v", tt.wantRcode, qCtx.R())
+			}
+		})
+	}
+}
+
+func TestFault_Exec_cancel(t *testing.T) {
+	f := &Fault{args: &Args{Enabled: true, LatencyMs: 10000}}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cause := errors.New("cancelled")
+	cancel(cause)
+	if err := f.Exec(ctx, query_context.NewContext(q), sequence.NewChainWalker(nil, nil)); !errors.Is(err, cause) {
+		t.Fatalf("want err %v, got %v", cause, err)
+	}
+}
+
+func TestArgs_validate(t *testing.T) {
+	for _, a := range []Args{
+		{LatencyMs: -1},
+		{JitterMs: -1},
+		{DropRate: 1.5},
+		{ServfailRate: -0.1},
+	} {
+		if err := a.validate(); err == nil {
+			t.Errorf("%+v: expect an err", a)
+		}
+	}
+	if err := (&Args{LatencyMs: 1, DropRate: 0.5}).validate(); err != nil {
+		t.Fatal(err)
+	}
+}
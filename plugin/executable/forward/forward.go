@@ -24,7 +24,9 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -54,12 +56,39 @@ type Args struct {
 	Upstreams  []UpstreamConfig `yaml:"upstreams"`
 	Concurrent int              `yaml:"concurrent"`
 
+	// UpstreamGroups are tags of upstream groups defined in the top-level
+	// "upstreams" section. Their upstreams are appended to Upstreams.
+	UpstreamGroups []string `yaml:"upstream_groups"`
+
+	// MaxConcurrent limits the number of concurrent queries of all
+	// upstreams of this plugin. 0 means no limit.
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// ShedPolicy is the policy when a limit is reached. "wait" (default)
+	// waits for a free slot for up to QueueTimeoutMs. "drop" fails the
+	// query to the upstream immediately.
+	ShedPolicy     string `yaml:"shed_policy"`
+	QueueTimeoutMs int    `yaml:"queue_timeout_ms"`
+
+	// Debug options.
+	// Seed makes upstream picking deterministic. 0 uses a random seed.
+	Seed int64 `yaml:"seed"`
+	// RecordFile records all upstream responses to this file. Records
+	// are appended if the file exists.
+	RecordFile string `yaml:"record_file"`
+	// ReplayFile feeds responses from a record file back instead of
+	// querying upstreams.
+	ReplayFile string `yaml:"replay_file"`
+	// ReplayLatency makes replayed responses wait for their recorded
+	// latencies.
+	ReplayLatency bool `yaml:"replay_latency"`
+
 	// Global options.
 	Socks5       string `yaml:"socks5"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
 	Bootstrap    string `yaml:"bootstrap"`
 	BootstrapVer int    `yaml:"bootstrap_version"`
+	TCPRetry     bool   `yaml:"tcp_retry"`
 }
 
 type UpstreamConfig struct {
@@ -68,6 +97,10 @@ type UpstreamConfig struct {
 	DialAddr    string `yaml:"dial_addr"`
 	IdleTimeout int    `yaml:"idle_timeout"`
 
+	// MaxConcurrent limits the number of concurrent queries of this
+	// upstream. 0 means no limit.
+	MaxConcurrent int `yaml:"max_concurrent"`
+
 	// Deprecated: This option has no affect.
 	// TODO: (v6) Remove this option.
 	MaxConns           int  `yaml:"max_conns"`
@@ -80,22 +113,61 @@ type UpstreamConfig struct {
 	BindToDevice string `yaml:"bind_to_device"`
 	Bootstrap    string `yaml:"bootstrap"`
 	BootstrapVer int    `yaml:"bootstrap_version"`
+
+	// TCPRetry retries the query over tcp if an udp response is
+	// truncated, malformed or looks injected. Upstreams in upstream
+	// groups can set it per entry.
+	TCPRetry bool `yaml:"tcp_retry"`
+
+	// ECS is the ECS policy of this upstream. "strip" removes ECS from
+	// queries to this upstream, e.g. for privacy upstreams. Default is
+	// "", queries are sent with their ECS (see the ecs_handler plugin).
+	ECS string `yaml:"ecs"`
+
+	// UDPSize is the EDNS0 buffer size of queries to this udp upstream,
+	// e.g. 1232. Default is 0, the size is not changed.
+	UDPSize int `yaml:"udp_size"`
+	// TCPOnly sends queries to this udp upstream over tcp.
+	TCPOnly bool `yaml:"tcp_only"`
+	// AutoDowngrade retries queries to this udp upstream over tcp if udp
+	// times out, and lowers UDPSize, or switches to tcp for a while, if
+	// large udp responses keep being lost. See upstream.Opt.AutoDowngrade.
+	AutoDowngrade bool `yaml:"auto_downgrade"`
+	// MaxRespSize is the maximum size (bytes) of responses. Larger
+	// responses are errors. Default is 0, no limit.
+	MaxRespSize int `yaml:"max_resp_size"`
+
+	// MTUProbeInterval (seconds) probes this udp upstream with queries
+	// that have large responses, and downgrades it the same way as
+	// AutoDowngrade if the udp path drops fragments. Default is 0, no probe.
+	MTUProbeInterval int `yaml:"mtu_probe_interval"`
+	// MTUProbeDomain and MTUProbeType are the question of probes, e.g.
+	// "example.com" and "TXT". The response must be larger than 1500
+	// bytes. MTUProbeDomain is required by probes, default type is TXT.
+	MTUProbeDomain string `yaml:"mtu_probe_domain"`
+	MTUProbeType   string `yaml:"mtu_probe_type"`
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	f, err := NewForward(args.(*Args), Opts{Logger: bp.L(), MetricsTag: bp.Tag()})
-	if err != nil {
-		return nil, err
-	}
-	if err := f.RegisterMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())); err != nil {
-		_ = f.Close()
-		return nil, err
+	a := args.(*Args)
+	for _, tag := range a.UpstreamGroups {
+		raw, ok := bp.M().GetUpstreamGroup(tag)
+		if !ok {
+			return nil, fmt.Errorf("cannot find upstream group %s", tag)
+		}
+		var ucs []UpstreamConfig
+		if err := utils.WeakDecode(raw, &ucs); err != nil {
+			return nil, fmt.Errorf("invalid upstream group %s, %w", tag, err)
+		}
+		a.Upstreams = append(a.Upstreams, ucs...)
 	}
-	return f, nil
+
+	return NewForward(a, Opts{Logger: bp.L()})
 }
 
 var _ sequence.Executable = (*Forward)(nil)
 var _ sequence.QuickConfigurableExec = (*Forward)(nil)
+var _ coremain.MetricsProvider = (*Forward)(nil)
 
 type Forward struct {
 	args *Args
@@ -103,11 +175,18 @@ type Forward struct {
 	logger       *zap.Logger
 	us           []*upstreamWrapper
 	tag2Upstream map[string]*upstreamWrapper // for fast tag lookup only.
+
+	globalLimiter *limiter // maybe nil
+	shedTotal     prometheus.Counter
+
+	rndMu    sync.Mutex
+	rnd      *rand.Rand // nil if no seed was set.
+	recorder *recorder  // maybe nil
+	replayer *replayer  // maybe nil
 }
 
 type Opts struct {
-	Logger     *zap.Logger
-	MetricsTag string
+	Logger *zap.Logger
 }
 
 // NewForward inits a Forward from given args.
@@ -119,11 +198,21 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 	if opt.Logger == nil {
 		opt.Logger = zap.NewNop()
 	}
+	switch args.ShedPolicy {
+	case "", shedPolicyWait, shedPolicyDrop:
+	default:
+		return nil, fmt.Errorf("invalid shed policy %s", args.ShedPolicy)
+	}
 
 	f := &Forward{
-		args:         args,
-		logger:       opt.Logger,
-		tag2Upstream: make(map[string]*upstreamWrapper),
+		args:          args,
+		logger:        opt.Logger,
+		tag2Upstream:  make(map[string]*upstreamWrapper),
+		globalLimiter: newLimiter(args.MaxConcurrent),
+		shedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "global_shed_total",
+			Help: "The total number of upstream queries that were shed by concurrency limits",
+		}),
 	}
 
 	applyGlobal := func(c *UpstreamConfig) {
@@ -132,15 +221,54 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		utils.SetDefaultString(&c.BindToDevice, args.BindToDevice)
 		utils.SetDefaultString(&c.Bootstrap, args.Bootstrap)
 		utils.SetDefaultUnsignNum(&c.BootstrapVer, args.BootstrapVer)
+		c.TCPRetry = c.TCPRetry || args.TCPRetry
+	}
+
+	if args.Seed != 0 {
+		f.rnd = rand.New(rand.NewSource(args.Seed))
+	}
+	if len(args.ReplayFile) > 0 {
+		r, err := newReplayer(args.ReplayFile, args.ReplayLatency)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load replay file, %w", err)
+		}
+		f.replayer = r
+	}
+	if len(args.RecordFile) > 0 {
+		r, err := newRecorder(args.RecordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open record file, %w", err)
+		}
+		f.recorder = r
 	}
 
 	for i, c := range args.Upstreams {
 		if len(c.Addr) == 0 {
 			return nil, fmt.Errorf("#%d upstream invalid args, addr is required", i)
 		}
+		if len(c.ECS) > 0 && c.ECS != ecsStrip {
+			return nil, fmt.Errorf("#%d upstream invalid args, invalid ecs policy %s", i, c.ECS)
+		}
+		if c.UDPSize != 0 && (c.UDPSize < 512 || c.UDPSize > 65535) {
+			return nil, fmt.Errorf("#%d upstream invalid args, udp_size must be in [512, 65535]", i)
+		}
+		if c.MaxRespSize < 0 {
+			return nil, fmt.Errorf("#%d upstream invalid args, negative max_resp_size", i)
+		}
+		if c.MTUProbeInterval > 0 && len(c.MTUProbeDomain) == 0 {
+			return nil, fmt.Errorf("#%d upstream invalid args, mtu_probe_interval requires mtu_probe_domain", i)
+		}
+		var probeType uint16
+		if len(c.MTUProbeType) > 0 {
+			t, ok := dns.StringToType[strings.ToUpper(c.MTUProbeType)]
+			if !ok {
+				return nil, fmt.Errorf("#%d upstream invalid args, invalid mtu_probe_type %s", i, c.MTUProbeType)
+			}
+			probeType = t
+		}
 		applyGlobal(&c)
 
-		uw := newWrapper(i, c, opt.MetricsTag)
+		uw := newWrapper(i, c)
 		uOpt := upstream.Opt{
 			DialAddr:       c.DialAddr,
 			Socks5:         c.Socks5,
@@ -151,6 +279,15 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 			EnableHTTP3:    c.EnableHTTP3,
 			Bootstrap:      c.Bootstrap,
 			BootstrapVer:   c.BootstrapVer,
+			TCPRetry:       c.TCPRetry,
+			UDPSize:        c.UDPSize,
+			TCPOnly:        c.TCPOnly,
+			AutoDowngrade:  c.AutoDowngrade,
+			MaxRespSize:    c.MaxRespSize,
+
+			MTUProbeInterval: time.Duration(c.MTUProbeInterval) * time.Second,
+			MTUProbeDomain:   c.MTUProbeDomain,
+			MTUProbeType:     probeType,
 			TLSConfig: &tls.Config{
 				InsecureSkipVerify: c.InsecureSkipVerify,
 				ClientSessionCache: tls.NewLRUClientSessionCache(4),
@@ -179,17 +316,17 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 	return f, nil
 }
 
-func (f *Forward) RegisterMetricsTo(r prometheus.Registerer) error {
+// Metrics implements coremain.MetricsProvider.
+func (f *Forward) Metrics() []prometheus.Collector {
+	cs := []prometheus.Collector{f.shedTotal}
 	for _, wu := range f.us {
-		// Only register metrics for upstream that has a tag.
+		// Only export metrics for upstream that has a tag.
 		if len(wu.cfg.Tag) == 0 {
 			continue
 		}
-		if err := wu.registerMetricsTo(r); err != nil {
-			return err
-		}
+		cs = append(cs, wu.collectors()...)
 	}
-	return nil
+	return cs
 }
 
 func (f *Forward) Exec(ctx context.Context, qCtx *query_context.Context) (err error) {
@@ -230,13 +367,30 @@ func (f *Forward) Close() error {
 	for _, u := range f.us {
 		_ = u.Close()
 	}
+	if f.recorder != nil {
+		_ = f.recorder.Close()
+	}
 	return nil
 }
 
+// pick picks a random upstream from us.
+func (f *Forward) pick(us []*upstreamWrapper) *upstreamWrapper {
+	if f.rnd == nil {
+		return randPick(us)
+	}
+	f.rndMu.Lock()
+	defer f.rndMu.Unlock()
+	return us[f.rnd.Intn(len(us))]
+}
+
 func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us []*upstreamWrapper) (*dns.Msg, error) {
 	if len(us) == 0 {
 		return nil, errors.New("no upstream to exchange")
 	}
+	if f.replayer != nil {
+		return f.replayer.replay(ctx, qCtx.Q())
+	}
+	us = availableUpstreams(us)
 
 	queryPayload, err := pool.PackBuffer(qCtx.Q())
 	if err != nil {
@@ -254,6 +408,7 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 
 	type res struct {
 		r   *dns.Msg
+		u   string
 		err error
 	}
 
@@ -261,17 +416,45 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	done := make(chan struct{})
 	defer close(done)
 
+	// Payload for upstreams that strip ECS. Packed if it's needed.
+	var strippedPayload *[]byte
+	defer func() {
+		if strippedPayload != nil {
+			pool.ReleaseBuf(strippedPayload)
+		}
+	}()
+
+	var seq uint64
+	if f.recorder != nil {
+		seq = f.recorder.nextSeq()
+	}
 	for i := 0; i < concurrent; i++ {
-		u := randPick(us)
-		qc := copyPayload(queryPayload)
-		go func(uqid uint32, question dns.Question) {
+		u := f.pick(us)
+		payload := queryPayload
+		if u.cfg.ECS == ecsStrip {
+			if strippedPayload == nil {
+				strippedPayload, err = packWithoutECS(qCtx.Q())
+				if err != nil {
+					return nil, err
+				}
+			}
+			payload = strippedPayload
+		}
+		qc := copyPayload(payload)
+		go func(idx int, uqid uint32, question dns.Question) {
 			defer pool.ReleaseBuf(qc)
 			// Give each upstream a fixed timeout to finish the query.
 			upstreamCtx, cancel := context.WithTimeout(context.Background(), queryTimeout)
 			defer cancel()
 
 			var r *dns.Msg
-			respPayload, err := u.ExchangeContext(upstreamCtx, *qc)
+			var respPayload *[]byte
+			start := time.Now()
+			release, err := f.acquire(upstreamCtx, u)
+			if err == nil {
+				respPayload, err = u.ExchangeContext(upstreamCtx, *qc)
+				release()
+			}
 			if err != nil {
 				f.logger.Warn(
 					"upstream error",
@@ -285,16 +468,27 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 			} else {
 				r = new(dns.Msg)
 				err = r.Unpack(*respPayload)
-				pool.ReleaseBuf(respPayload)
 				if err != nil {
 					r = nil
 				}
 			}
+			if f.recorder != nil {
+				var resp []byte
+				if respPayload != nil {
+					resp = *respPayload
+				}
+				if err := f.recorder.record(seq, idx, u.name(), question, time.Since(start), resp, err); err != nil {
+					f.logger.Error("failed to record upstream response", zap.Error(err))
+				}
+			}
+			if respPayload != nil {
+				pool.ReleaseBuf(respPayload)
+			}
 			select {
-			case resChan <- res{r: r, err: err}:
+			case resChan <- res{r: r, u: u.name(), err: err}:
 			case <-done:
 			}
-		}(qCtx.Id(), qCtx.QQuestion())
+		}(i, qCtx.Id(), qCtx.QQuestion())
 	}
 
 	for i := 0; i < concurrent; i++ {
@@ -309,6 +503,7 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 			if i < concurrent-1 && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
 				continue
 			}
+			qCtx.StoreValue(query_context.KeyUpstream, res.u)
 			return r, nil
 		case <-ctx.Done():
 			return nil, context.Cause(ctx)
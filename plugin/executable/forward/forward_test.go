@@ -0,0 +1,58 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+)
+
+func Test_upstreamGroups(t *testing.T) {
+	group := coremain.UpstreamGroupConfig{
+		Tag:       "public",
+		Upstreams: []any{map[string]any{"tag": "u1", "addr": "udp://127.0.0.1:53"}},
+	}
+
+	cfg := &coremain.Config{
+		Upstreams: []coremain.UpstreamGroupConfig{group},
+		Plugins: []coremain.PluginConfig{{
+			Tag:  "forward",
+			Type: PluginType,
+			Args: map[string]any{"upstream_groups": []any{"public"}},
+		}},
+	}
+	m, err := coremain.NewMosdns(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := m.GetPlugin("forward").(*Forward)
+	if len(f.us) != 1 || f.us[0].cfg.Tag != "u1" {
+		t.Fatalf("upstreams of the group were not loaded")
+	}
+	m.GetSafeClose().SendCloseSignal(nil)
+	_ = m.GetSafeClose().WaitClosed()
+
+	cfg.Plugins = nil
+	if _, err := coremain.NewMosdns(cfg); err == nil || !strings.Contains(err.Error(), "not used") {
+		t.Fatalf("want an error for the unused upstream group, got %v", err)
+	}
+}
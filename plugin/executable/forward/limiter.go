@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	shedPolicyWait = "wait"
+	shedPolicyDrop = "drop"
+)
+
+var errTooManyQueries = errors.New("too many concurrent queries")
+
+// limiter is a semaphore that limits the number of concurrent queries.
+// A nil *limiter has no limit.
+type limiter struct {
+	c chan struct{}
+}
+
+func newLimiter(n int) *limiter {
+	if n <= 0 {
+		return nil
+	}
+	return &limiter{c: make(chan struct{}, n)}
+}
+
+// acquire acquires a slot. If wait is false, it returns errTooManyQueries
+// immediately if there is no free slot. Otherwise, it waits until ctx
+// is done.
+func (l *limiter) acquire(ctx context.Context, wait bool) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.c <- struct{}{}:
+		return nil
+	default:
+	}
+	if !wait {
+		return errTooManyQueries
+	}
+	select {
+	case l.c <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errTooManyQueries
+	}
+}
+
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.c
+}
+
+// acquire acquires slots from uw's limiter and the global limiter.
+// The upstream slot is acquired first, so queries waiting for a slow
+// upstream don't hold global slots and starve other upstreams.
+// If it returns a nil error, the caller must call the returned func to
+// release slots.
+func (f *Forward) acquire(ctx context.Context, uw *upstreamWrapper) (func(), error) {
+	if f.globalLimiter == nil && uw.limiter == nil {
+		return func() {}, nil
+	}
+
+	wait := f.args.ShedPolicy != shedPolicyDrop
+	if wait && f.args.QueueTimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(f.args.QueueTimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+
+	start := time.Now()
+	if err := uw.limiter.acquire(ctx, wait); err != nil {
+		f.shedTotal.Inc()
+		uw.shedTotal.Inc()
+		return nil, err
+	}
+	if err := f.globalLimiter.acquire(ctx, wait); err != nil {
+		uw.limiter.release()
+		f.shedTotal.Inc()
+		return nil, err
+	}
+	uw.queueWait.Observe(float64(time.Since(start).Milliseconds()))
+	return func() {
+		uw.limiter.release()
+		f.globalLimiter.release()
+	}, nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_limiter(t *testing.T) {
+	var nilLimiter *limiter
+	if err := nilLimiter.acquire(context.Background(), false); err != nil {
+		t.Fatalf("nil limiter should have no limit, %v", err)
+	}
+	nilLimiter.release()
+
+	l := newLimiter(1)
+	if err := l.acquire(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire(context.Background(), false); !errors.Is(err, errTooManyQueries) {
+		t.Fatalf("want errTooManyQueries, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := l.acquire(ctx, true); !errors.Is(err, errTooManyQueries) {
+		t.Fatalf("want errTooManyQueries after timeout, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		l.release()
+	}()
+	if err := l.acquire(context.Background(), true); err != nil {
+		t.Fatalf("want slot after release, got %v", err)
+	}
+}
+
+func TestForward_acquire(t *testing.T) {
+	f := &Forward{
+		args:          &Args{ShedPolicy: shedPolicyWait, QueueTimeoutMs: 50},
+		globalLimiter: newLimiter(2),
+		shedTotal:     prometheus.NewCounter(prometheus.CounterOpts{Name: "shed_total"}),
+	}
+	slow := newWrapper(0, UpstreamConfig{Tag: "slow", MaxConcurrent: 1})
+	healthy := newWrapper(1, UpstreamConfig{Tag: "healthy"})
+
+	release, err := f.acquire(context.Background(), slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// Queries waiting for the slow upstream must not hold global slots.
+	done := make(chan error)
+	go func() {
+		_, err := f.acquire(context.Background(), slow)
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+	r, err := f.acquire(context.Background(), healthy)
+	if err != nil {
+		t.Fatalf("healthy upstream is starved, %v", err)
+	}
+	r()
+	if err := <-done; !errors.Is(err, errTooManyQueries) {
+		t.Fatalf("want errTooManyQueries after queue timeout, got %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordEntry is a line of a record file.
+type recordEntry struct {
+	// Session is the start time (unix nano) of the recorder. Records of
+	// multiple runs can be appended to the same file.
+	Session int64 `json:"session"`
+	// Seq is the sequence number of the query in the session.
+	Seq uint64 `json:"seq"`
+	// Idx is the index of the concurrent upstream query of Seq.
+	Idx       int    `json:"idx"`
+	LatencyMs int64  `json:"latency_ms"`
+	Upstream  string `json:"upstream"`
+	Qname     string `json:"qname"`
+	Qtype     uint16 `json:"qtype"`
+	Qclass    uint16 `json:"qclass"`
+	Resp      []byte `json:"resp,omitempty"` // wire format
+	Err       string `json:"err,omitempty"`
+}
+
+func recordKey(q dns.Question) string {
+	return fmt.Sprintf("%s %d %d", strings.ToLower(q.Name), q.Qtype, q.Qclass)
+}
+
+// recorder appends upstream responses to a file.
+type recorder struct {
+	session int64
+	seq     atomic.Uint64
+
+	m sync.Mutex
+	f *os.File
+	w *bufio.Writer
+}
+
+func newRecorder(file string) (*recorder, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{session: time.Now().UnixNano(), f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// nextSeq returns the sequence number for a new query.
+func (r *recorder) nextSeq() uint64 {
+	return r.seq.Add(1)
+}
+
+func (r *recorder) record(seq uint64, idx int, upstream string, q dns.Question, latency time.Duration, resp []byte, err error) error {
+	e := recordEntry{
+		Session:   r.session,
+		Seq:       seq,
+		Idx:       idx,
+		LatencyMs: latency.Milliseconds(),
+		Upstream:  upstream,
+		Qname:     q.Name,
+		Qtype:     q.Qtype,
+		Qclass:    q.Qclass,
+		Resp:      resp,
+	}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if _, err := r.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return r.w.Flush()
+}
+
+func (r *recorder) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	_ = r.w.Flush()
+	return r.f.Close()
+}
+
+// replayer feeds recorded responses back in the recorded query order.
+// Results of concurrent upstream queries are recorded in their arrival
+// order, so they are sorted by (session, seq, idx) when loading. The
+// response that is replayed for a query is selected by the recorded
+// latencies, not by the order in the file.
+type replayer struct {
+	// latency makes replay wait for the recorded latency of the
+	// selected response.
+	latency bool
+
+	m      sync.Mutex
+	groups map[string][][]recordEntry // key is recordKey
+}
+
+func newReplayer(file string, latency bool) (*replayer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []recordEntry
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	line := 0
+	for s.Scan() {
+		line++
+		e := recordEntry{}
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("invalid record at line %d, %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Session != b.Session {
+			return a.Session < b.Session
+		}
+		if a.Seq != b.Seq {
+			return a.Seq < b.Seq
+		}
+		return a.Idx < b.Idx
+	})
+
+	r := &replayer{latency: latency, groups: make(map[string][][]recordEntry)}
+	for i, e := range entries {
+		k := recordKey(dns.Question{Name: e.Qname, Qtype: e.Qtype, Qclass: e.Qclass})
+		gs := r.groups[k]
+		if i > 0 && len(gs) > 0 {
+			prev := entries[i-1]
+			if prev.Session == e.Session && prev.Seq == e.Seq {
+				gs[len(gs)-1] = append(gs[len(gs)-1], e)
+				continue
+			}
+		}
+		r.groups[k] = append(gs, []recordEntry{e})
+	}
+	return r, nil
+}
+
+// replay returns the recorded response of the next recorded query of q.
+// The last recorded query of q will be replayed repeatedly once others
+// are consumed.
+func (r *replayer) replay(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return nil, errors.New("replay: odd question")
+	}
+	k := recordKey(q.Question[0])
+
+	r.m.Lock()
+	gs := r.groups[k]
+	if len(gs) == 0 {
+		r.m.Unlock()
+		return nil, fmt.Errorf("replay: no recorded response for %s", k)
+	}
+	g := gs[0]
+	if len(gs) > 1 {
+		r.groups[k] = gs[1:]
+	}
+	r.m.Unlock()
+
+	e := selectRecord(g)
+	if r.latency && e.LatencyMs > 0 {
+		t := time.NewTimer(time.Duration(e.LatencyMs) * time.Millisecond)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+
+	if len(e.Err) > 0 {
+		return nil, fmt.Errorf("replay: recorded error from %s: %s", e.Upstream, e.Err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(e.Resp); err != nil {
+		return nil, fmt.Errorf("replay: invalid recorded response, %w", err)
+	}
+	resp.Id = q.Id
+	return resp, nil
+}
+
+// selectRecord selects the record of g that Forward.exchange would have
+// used, as if responses arrived in the order of their recorded latencies.
+// If all records are errors, the last one is returned.
+func selectRecord(g []recordEntry) recordEntry {
+	sorted := make([]recordEntry, len(g))
+	copy(sorted, g)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LatencyMs < sorted[j].LatencyMs
+	})
+	for i, e := range sorted {
+		if len(e.Err) > 0 {
+			continue
+		}
+		if i < len(sorted)-1 && !isFinalRcode(e.Resp) {
+			continue
+		}
+		return e
+	}
+	return sorted[len(sorted)-1]
+}
+
+// isFinalRcode reports whether the rcode of the packed response b is
+// NOERROR or NXDOMAIN, which Forward.exchange accepts without waiting
+// for other upstreams.
+func isFinalRcode(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	rcode := int(b[3] & 0x0f)
+	return rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError
+}
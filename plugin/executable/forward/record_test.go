@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_record_replay(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "record")
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	pack := func(rcode int) []byte {
+		r := new(dns.Msg)
+		r.SetRcode(q, rcode)
+		b, err := r.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	rec, err := newRecorder(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Concurrent results are recorded in their arrival order.
+	seq := rec.nextSeq()
+	if err := rec.record(seq, 1, "u2", q.Question[0], time.Millisecond*5, pack(dns.RcodeNameError), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.record(seq, 0, "u1", q.Question[0], time.Millisecond, pack(dns.RcodeServerFailure), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second run appends to the file.
+	rec, err = newRecorder(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.record(rec.nextSeq(), 0, "u1", q.Question[0], 0, nil, errors.New("timeout")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rp, err := newReplayer(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Id = 1234
+	// SERVFAIL arrived first, but the NXDOMAIN should be selected.
+	resp, err := rp.replay(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeNameError || resp.Id != q.Id {
+		t.Fatalf("unexpected replayed resp %v", resp)
+	}
+	// The last query is the error and it should be repeated.
+	for i := 0; i < 2; i++ {
+		if _, err := rp.replay(context.Background(), q); err == nil {
+			t.Fatal("want recorded error")
+		}
+	}
+
+	q2 := new(dns.Msg)
+	q2.SetQuestion("not-recorded.", dns.TypeA)
+	if _, err := rp.replay(context.Background(), q2); err == nil {
+		t.Fatal("want error for unrecorded question")
+	}
+}
+
+func Test_replay_latency(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "record")
+	rec, err := newRecorder(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	b, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.record(rec.nextSeq(), 0, "u1", q.Question[0], time.Millisecond*50, b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rp, err := newReplayer(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := rp.replay(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < time.Millisecond*50 {
+		t.Fatalf("replay should wait for the recorded latency, waited %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rp.replay(ctx, q); err == nil {
+		t.Fatal("want ctx error")
+	}
+}
@@ -40,8 +40,19 @@ type upstreamWrapper struct {
 	thread          prometheus.Gauge
 	responseLatency prometheus.Histogram
 
+	limiter   *limiter // maybe nil
+	queueWait prometheus.Histogram
+	shedTotal prometheus.Counter
+
 	connOpened prometheus.Counter
 	connClosed prometheus.Counter
+
+	// Responses that were dropped because they didn't match any query.
+	respIdMismatch       prometheus.Counter
+	respQuestionMismatch prometheus.Counter
+
+	tcpRetry     prometheus.Counter
+	udpDowngrade prometheus.Counter
 }
 
 func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
@@ -50,15 +61,24 @@ func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
 		uw.connOpened.Inc()
 	case upstream.EventConnClose:
 		uw.connClosed.Inc()
+	case upstream.EventRespIdMismatch:
+		uw.respIdMismatch.Inc()
+	case upstream.EventRespQuestionMismatch:
+		uw.respQuestionMismatch.Inc()
+	case upstream.EventTCPRetry:
+		uw.tcpRetry.Inc()
+	case upstream.EventUDPDowngrade:
+		uw.udpDowngrade.Inc()
 	}
 }
 
 // newWrapper inits all metrics.
 // Note: upstreamWrapper.u still needs to be set.
-func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper {
-	lb := map[string]string{"upstream": cfg.Tag, "tag": pluginTag}
+func newWrapper(idx int, cfg UpstreamConfig) *upstreamWrapper {
+	lb := map[string]string{"upstream": cfg.Tag}
 	return &upstreamWrapper{
-		cfg: cfg,
+		cfg:     cfg,
+		limiter: newLimiter(cfg.MaxConcurrent),
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "query_total",
 			Help:        "The total number of queries processed by this upstream",
@@ -80,6 +100,17 @@ func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper
 			Buckets:     []float64{1, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000},
 			ConstLabels: lb,
 		}),
+		queueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "queue_wait_millisecond",
+			Help:        "The time in millisecond that queries waited for concurrency limits",
+			Buckets:     []float64{1, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000},
+			ConstLabels: lb,
+		}),
+		shedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "shed_total",
+			Help:        "The total number of queries that were shed by concurrency limits",
+			ConstLabels: lb,
+		}),
 
 		connOpened: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "conn_opened_total",
@@ -91,23 +122,44 @@ func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper
 			Help:        "The total number of connections that are closed",
 			ConstLabels: lb,
 		}),
+		respIdMismatch: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "resp_id_mismatch_total",
+			Help:        "The total number of responses that were dropped because no ongoing query has their ids, including late responses",
+			ConstLabels: lb,
+		}),
+		respQuestionMismatch: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "resp_question_mismatch_total",
+			Help:        "The total number of responses that were dropped because their questions don't match the queries, may indicate spoofing attempts",
+			ConstLabels: lb,
+		}),
+		tcpRetry: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "udp_tcp_retry_total",
+			Help:        "The total number of suspicious udp responses that were retried over tcp",
+			ConstLabels: lb,
+		}),
+		udpDowngrade: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "udp_downgrade_total",
+			Help:        "The total number of times that the edns0 buffer size was lowered or udp was switched to tcp because large udp responses were lost",
+			ConstLabels: lb,
+		}),
 	}
 }
 
-func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
-	for _, collector := range [...]prometheus.Collector{
+func (uw *upstreamWrapper) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
 		uw.queryTotal,
 		uw.errTotal,
 		uw.thread,
 		uw.responseLatency,
+		uw.queueWait,
+		uw.shedTotal,
 		uw.connOpened,
 		uw.connClosed,
-	} {
-		if err := r.Register(collector); err != nil {
-			return err
-		}
+		uw.respIdMismatch,
+		uw.respQuestionMismatch,
+		uw.tcpRetry,
+		uw.udpDowngrade,
 	}
-	return nil
 }
 
 // name returns upstream tag if it was set in the config.
@@ -153,6 +205,28 @@ func (q *queryInfo) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
 	return nil
 }
 
+// availableUpstreams returns upstreams in us that can serve queries now,
+// e.g. DNSCrypt upstreams whose certificates are expired are skipped.
+// If none is available, us is returned.
+func availableUpstreams(us []*upstreamWrapper) []*upstreamWrapper {
+	n := 0
+	for _, u := range us {
+		if upstream.IsAvailable(u.u) {
+			n++
+		}
+	}
+	if n == len(us) || n == 0 {
+		return us
+	}
+	au := make([]*upstreamWrapper, 0, n)
+	for _, u := range us {
+		if upstream.IsAvailable(u.u) {
+			au = append(au, u)
+		}
+	}
+	return au
+}
+
 func randPick[T any](s []T) T {
 	return s[rand.Intn(len(s))]
 }
@@ -162,3 +236,25 @@ func copyPayload(b *[]byte) *[]byte {
 	copy(*bc, *b)
 	return bc
 }
+
+const ecsStrip = "strip"
+
+// packWithoutECS packs q without its ECS option. q is not modified.
+func packWithoutECS(q *dns.Msg) (*[]byte, error) {
+	qc := *q
+	qc.Extra = make([]dns.RR, 0, len(q.Extra))
+	for _, rr := range q.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			oc := *opt
+			oc.Option = nil
+			for _, o := range opt.Option {
+				if o.Option() != dns.EDNS0SUBNET {
+					oc.Option = append(oc.Option, o)
+				}
+			}
+			rr = &oc
+		}
+		qc.Extra = append(qc.Extra, rr)
+	}
+	return pool.PackBuffer(&qc)
+}
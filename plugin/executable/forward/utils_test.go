@@ -0,0 +1,57 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+func Test_packWithoutECS(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, true)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(192, 0, 2, 0)},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+	)
+
+	b, err := packWithoutECS(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.ReleaseBuf(b)
+	if len(opt.Option) != 2 {
+		t.Fatal("query was modified")
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(*b); err != nil {
+		t.Fatal(err)
+	}
+	mOpt := m.IsEdns0()
+	if mOpt == nil || !mOpt.Do() || len(mOpt.Option) != 1 || mOpt.Option[0].Option() != dns.EDNS0COOKIE {
+		t.Fatalf("unexpected opt %v", mOpt)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package health_domain
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "health_domain"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.Executable = (*HealthDomain)(nil)
+
+type Args struct {
+	// Domain is always resolved locally. Default is "ok.mosdns.test".
+	Domain string `yaml:"domain"`
+
+	// InstanceID is answered in TXT records. Default is the os hostname.
+	InstanceID string `yaml:"instance_id"`
+
+	// Addresses of A and AAAA answers. Default is 127.0.0.1 and ::1.
+	IPv4 string `yaml:"ipv4"`
+	IPv6 string `yaml:"ipv6"`
+}
+
+func (a *Args) init() {
+	utils.SetDefaultString(&a.Domain, "ok.mosdns.test")
+	if len(a.InstanceID) == 0 {
+		a.InstanceID, _ = os.Hostname()
+	}
+	utils.SetDefaultString(&a.IPv4, "127.0.0.1")
+	utils.SetDefaultString(&a.IPv6, "::1")
+}
+
+// HealthDomain answers a synthetic domain locally, so external monitors
+// can verify the whole query path of the server.
+// TXT queries are answered with the current unix timestamp and the
+// instance id. A/AAAA queries are answered with configured addresses.
+// Other query types get an empty NOERROR response.
+type HealthDomain struct {
+	domain     string
+	instanceID string
+	ipv4       netip.Addr
+	ipv6       netip.Addr
+}
+
+func Init(_ *coremain.BP, args any) (any, error) {
+	return NewHealthDomain(args.(*Args))
+}
+
+// QuickSetup format: [domain]
+func QuickSetup(_ sequence.BQ, s string) (any, error) {
+	return NewHealthDomain(&Args{Domain: strings.TrimSpace(s)})
+}
+
+func NewHealthDomain(args *Args) (*HealthDomain, error) {
+	args.init()
+	ipv4, err := netip.ParseAddr(args.IPv4)
+	if err != nil || !ipv4.Is4() {
+		return nil, fmt.Errorf("invalid ipv4 %s", args.IPv4)
+	}
+	ipv6, err := netip.ParseAddr(args.IPv6)
+	if err != nil || !ipv6.Is6() {
+		return nil, fmt.Errorf("invalid ipv6 %s", args.IPv6)
+	}
+	if _, ok := dns.IsDomainName(args.Domain); !ok {
+		return nil, fmt.Errorf("invalid domain %s", args.Domain)
+	}
+	return &HealthDomain{
+		domain:     dns.Fqdn(strings.ToLower(args.Domain)),
+		instanceID: args.InstanceID,
+		ipv4:       ipv4,
+		ipv6:       ipv6,
+	}, nil
+}
+
+func (h *HealthDomain) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if r := h.Response(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+	}
+	return nil
+}
+
+// Response returns the response of q. It returns nil if q is not
+// for the health domain.
+func (h *HealthDomain) Response(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+	if question.Qclass != dns.ClassINET || strings.ToLower(question.Name) != h.domain {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 0}
+	switch question.Qtype {
+	case dns.TypeTXT:
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: hdr,
+			Txt: []string{"ts=" + strconv.FormatInt(time.Now().Unix(), 10), "instance=" + h.instanceID},
+		})
+	case dns.TypeA:
+		r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: h.ipv4.AsSlice()})
+	case dns.TypeAAAA:
+		r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: h.ipv6.AsSlice()})
+	}
+	return r
+}
@@ -23,13 +23,20 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/hosts"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
-	"os"
+	"go.uber.org/zap"
 )
 
 const PluginType = "hosts"
@@ -38,52 +45,212 @@ func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
 }
 
-var _ sequence.Executable = (*Hosts)(nil)
+var _ sequence.RecursiveExecutable = (*Hosts)(nil)
+var _ coremain.DataReloader = (*Hosts)(nil)
 
+// Args configures hosts entries. An entry is "pattern ip..." or
+// "pattern cname:target", optionally followed by "ttl=seconds". Patterns
+// can be "*.example.com" wildcards. PTR queries of ips are answered with
+// names of full and domain patterns.
+// Entries are inline entries. They are loaded before Files.
 type Args struct {
-	Entries []string `yaml:"entries"`
-	Files   []string `yaml:"files"`
+	Entries        []string `yaml:"entries"`
+	Files          []string `yaml:"files"`
+	ReloadInterval int      `yaml:"reload_interval"` // (seconds) local file check interval, default is 5. Negative disables it.
 }
 
+func (a *Args) init() {
+	utils.SetDefaultNum(&a.ReloadInterval, 5)
+}
+
+// Hosts answers queries from hosts entries. Local files are loaded
+// again when their modification time or size changes.
 type Hosts struct {
-	h *hosts.Hosts
+	args   *Args
+	ss     remote.Storages
+	logger *zap.Logger
+	h      atomic.Pointer[hosts.Hosts]
+
+	reloadMu sync.Mutex // serializes reloads
+	files    []fileStat // stats of args.Files when they were loaded, protected by reloadMu
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	h, err := NewHosts(args.(*Args), bp.M().Storages())
+	if err != nil {
+		return nil, err
+	}
+	h.logger = bp.L()
+	if h.args.ReloadInterval > 0 && len(h.args.Files) > 0 {
+		go h.watchLoop()
+	}
+	return h, nil
+}
+
+// NewHosts loads entries and files. Files in remote storages are read
+// from ss. Files are not watched.
+func NewHosts(args *Args, ss remote.Storages) (*Hosts, error) {
+	args.init()
+	h := &Hosts{
+		args:        args,
+		ss:          ss,
+		logger:      zap.NewNop(),
+		closeNotify: make(chan struct{}),
+	}
+	if err := h.ReloadData(); err != nil {
+		return nil, err
+	}
+	return h, nil
 }
 
-func Init(_ *coremain.BP, args any) (any, error) {
-	return NewHosts(args.(*Args))
+// ReloadData loads entries and files again. The old entries are kept
+// if it fails.
+func (h *Hosts) ReloadData() error {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+	stats := statFiles(h.args.Files)
+	hs, err := load(h.args, h.ss)
+	if err != nil {
+		return err
+	}
+	h.h.Store(hs)
+	h.files = stats
+	return nil
 }
 
-func NewHosts(args *Args) (*Hosts, error) {
+func load(args *Args, ss remote.Storages) (*hosts.Hosts, error) {
 	m := domain.NewMixMatcher[*hosts.IPs]()
 	m.SetDefaultMatcher(domain.MatcherFull)
+	rt := hosts.NewReverseTable(domain.MatcherFull)
+	parse := rt.ParseFunc(hosts.ParseIPs)
 	for i, entry := range args.Entries {
-		if err := domain.Load[*hosts.IPs](m, entry, hosts.ParseIPs); err != nil {
+		if err := domain.Load[*hosts.IPs](m, entry, parse); err != nil {
 			return nil, fmt.Errorf("failed to load entry #%d %s, %w", i, entry, err)
 		}
 	}
 	for i, file := range args.Files {
-		b, err := os.ReadFile(file)
+		b, err := ss.ReadFile(file)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read file #%d %s, %w", i, file, err)
 		}
-		if err := domain.LoadFromTextReader[*hosts.IPs](m, bytes.NewReader(b), hosts.ParseIPs); err != nil {
+		if err := domain.LoadFromTextReader[*hosts.IPs](m, bytes.NewReader(b), parse); err != nil {
 			return nil, fmt.Errorf("failed to load file #%d %s, %w", i, file, err)
 		}
 	}
 
-	return &Hosts{
-		h: hosts.NewHosts(m),
-	}, nil
+	h := hosts.NewHosts(m)
+	h.SetReverse(rt)
+	return h, nil
+}
+
+// statFiles returns stats of local files. Remote and missing files
+// have zero stats.
+func statFiles(files []string) []fileStat {
+	stats := make([]fileStat, len(files))
+	for i, f := range files {
+		if remote.IsStorageFile(f) {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil {
+			stats[i] = fileStat{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return stats
 }
 
+func (h *Hosts) watchLoop() {
+	ticker := time.NewTicker(time.Duration(h.args.ReloadInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.checkFiles()
+		case <-h.closeNotify:
+			return
+		}
+	}
+}
+
+// checkFiles reloads hosts if any local file was changed.
+func (h *Hosts) checkFiles() {
+	if !h.filesChanged() {
+		return
+	}
+	if err := h.ReloadData(); err != nil {
+		h.logger.Warn("failed to reload hosts", zap.Error(err))
+		return
+	}
+	h.logger.Info("hosts reloaded")
+}
+
+func (h *Hosts) filesChanged() bool {
+	stats := statFiles(h.args.Files)
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+	for i := range stats {
+		if !stats[i].modTime.Equal(h.files[i].modTime) || stats[i].size != h.files[i].size {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hosts) Close() error {
+	h.closeOnce.Do(func() { close(h.closeNotify) })
+	return nil
+}
+
+// Response returns the response of q from hosts. CNAME targets that are
+// not in hosts are not resolved.
 func (h *Hosts) Response(q *dns.Msg) *dns.Msg {
-	return h.h.LookupMsg(q)
+	return h.h.Load().LookupMsg(q)
 }
 
-func (h *Hosts) Exec(_ context.Context, qCtx *query_context.Context) error {
-	r := h.h.LookupMsg(qCtx.Q())
-	if r != nil {
+// Exec answers queries from hosts. If a CNAME chain ends with a name that
+// is not in hosts, the rest of the sequence resolves that name and the
+// chain is inserted to its response.
+func (h *Hosts) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	hs := h.h.Load()
+	q := qCtx.Q()
+	if len(q.Question) == 1 && q.Question[0].Qclass == dns.ClassINET {
+		switch q.Question[0].Qtype {
+		case dns.TypeCNAME, dns.TypePTR:
+		default:
+			if chain, last, local := hs.Follow(q.Question[0].Name); len(chain) > 0 && !local {
+				return h.resolveTarget(ctx, qCtx, next, chain, last)
+			}
+		}
+	}
+
+	if r := hs.LookupMsg(q); r != nil {
 		qCtx.SetResponse(r)
 	}
-	return nil
+	return next.ExecNext(ctx, qCtx)
+}
+
+func (h *Hosts) resolveTarget(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker, chain []dns.RR, target string) error {
+	q := qCtx.Q()
+	orgQName := q.Question[0].Name
+	q.Question[0].Name = target
+	defer func() {
+		q.Question[0].Name = orgQName
+	}()
+	err := next.ExecNext(ctx, qCtx)
+	if r := qCtx.R(); r != nil {
+		for i := range r.Question {
+			if r.Question[i].Name == target {
+				r.Question[i].Name = orgQName
+			}
+		}
+		r.Answer = append(append(make([]dns.RR, 0, len(chain)+len(r.Answer)), chain...), r.Answer...)
+	}
+	return err
 }
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hosts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func TestHosts_Exec_CNAME(t *testing.T) {
+	h, err := NewHosts(&Args{Entries: []string{
+		"local.com 1.2.3.4",
+		"alias.com cname:local.com",
+		"ext.com cname:example.org",
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The target is resolved by the rest of the sequence.
+	rec := &plugintest.Recorder{Next: plugintest.Answer("@ 60 IN A 5.6.7.8")}
+	qCtx := plugintest.NewQuery("ext.com", dns.TypeA).Build()
+	if err := plugintest.Exec(t, h, qCtx, rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Queries) != 1 || rec.Queries[0].Question[0].Name != "example.org." {
+		t.Fatalf("want the target to be resolved, got %v", rec.Queries)
+	}
+	r := qCtx.R()
+	if r == nil || len(r.Answer) != 2 || r.Question[0].Name != "ext.com." || qCtx.Q().Question[0].Name != "ext.com." {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if c, ok := r.Answer[0].(*dns.CNAME); !ok || c.Target != "example.org." {
+		t.Fatalf("want a CNAME first, got %v", r.Answer[0])
+	}
+
+	// Local targets are answered by hosts.
+	qCtx = plugintest.NewQuery("alias.com", dns.TypeA).Build()
+	if err := plugintest.Exec(t, h, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || len(r.Answer) != 2 {
+		t.Fatalf("want a CNAME and an A, got %v", r)
+	}
+
+	qCtx = plugintest.NewQuery("4.3.2.1.in-addr.arpa", dns.TypePTR).Build()
+	if err := plugintest.Exec(t, h, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.PTR).Ptr != "local.com." {
+		t.Fatalf("want a PTR, got %v", r)
+	}
+}
+
+func TestHosts_Reload(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(f, []byte("file.com 1.1.1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHosts(&Args{Entries: []string{"inline.com 2.2.2.2"}, Files: []string{f}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(name string) string {
+		t.Helper()
+		r := h.Response(plugintest.NewQuery(name, dns.TypeA).Build().Q())
+		if r == nil || len(r.Answer) == 0 {
+			return ""
+		}
+		return r.Answer[0].(*dns.A).A.String()
+	}
+	if got := lookup("inline.com"); got != "2.2.2.2" {
+		t.Fatalf("inline entry, got %q", got)
+	}
+	if got := lookup("file.com"); got != "1.1.1.1" {
+		t.Fatalf("file entry, got %q", got)
+	}
+
+	if h.filesChanged() {
+		t.Fatal("unchanged file reported as changed")
+	}
+	if err := os.WriteFile(f, []byte("file.com 3.3.3.3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is visible on file systems with coarse mtime.
+	if err := os.Chtimes(f, time.Now(), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	h.checkFiles()
+	if got := lookup("file.com"); got != "3.3.3.3" {
+		t.Fatalf("file was not reloaded, got %q", got)
+	}
+	if got := lookup("inline.com"); got != "2.2.2.2" {
+		t.Fatalf("inline entry lost after reload, got %q", got)
+	}
+
+	// Broken files keep the old entries.
+	if err := os.WriteFile(f, []byte("file.com not_an_ip\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(f, time.Now(), time.Now().Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	h.checkFiles()
+	if got := lookup("file.com"); got != "3.3.3.3" {
+		t.Fatalf("want old entries kept, got %q", got)
+	}
+}
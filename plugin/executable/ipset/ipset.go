@@ -21,7 +21,9 @@ package ipset
 
 import (
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"net/netip"
 	"strconv"
 	"strings"
 )
@@ -29,6 +31,7 @@ import (
 const PluginType = "ipset"
 
 func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
 	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
 }
 
@@ -37,6 +40,81 @@ type Args struct {
 	SetName6 string `yaml:"set_name6"`
 	Mask4    int    `yaml:"mask4"` // default 24
 	Mask6    int    `yaml:"mask6"` // default 32
+
+	// Timeouts of added entries in seconds. They only work with sets
+	// that are created with the timeout option.
+	// If TTLTimeout is set, the ttl of the record is used and clamped
+	// to [MinTimeout, MaxTimeout]. Otherwise, Timeout is used.
+	// If none of them is set, the default timeout of the set is used.
+	Timeout    int  `yaml:"timeout"`
+	TTLTimeout bool `yaml:"ttl_timeout"`
+	MinTimeout int  `yaml:"min_timeout"` // default 1
+	MaxTimeout int  `yaml:"max_timeout"` // default no limit
+}
+
+func (a *Args) init() error {
+	if a.Mask4 == 0 {
+		a.Mask4 = 24
+	}
+	if a.Mask6 == 0 {
+		a.Mask6 = 32
+	}
+	if a.Mask4 < 0 || a.Mask4 > 32 {
+		return fmt.Errorf("invalid mask4 %d", a.Mask4)
+	}
+	if a.Mask6 < 0 || a.Mask6 > 128 {
+		return fmt.Errorf("invalid mask6 %d", a.Mask6)
+	}
+	if a.MinTimeout < 1 {
+		a.MinTimeout = 1
+	}
+	if a.Timeout < 0 || a.MaxTimeout < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+	if a.MaxTimeout > 0 && a.MaxTimeout < a.MinTimeout {
+		return fmt.Errorf("max_timeout %d is less than min_timeout %d", a.MaxTimeout, a.MinTimeout)
+	}
+	return nil
+}
+
+// entryTimeout returns the timeout of an entry from a record with ttl.
+// ok is false if the default timeout of the set should be used.
+func (a *Args) entryTimeout(ttl uint32) (timeout uint32, ok bool) {
+	if !a.TTLTimeout {
+		return uint32(a.Timeout), a.Timeout > 0
+	}
+	// Note: 0 means permanent in ipset, min_timeout is at least 1.
+	timeout = max(ttl, uint32(a.MinTimeout))
+	if a.MaxTimeout > 0 {
+		timeout = min(timeout, uint32(a.MaxTimeout))
+	}
+	return timeout, true
+}
+
+// entry is a masked prefix with its timeout.
+type entry struct {
+	prefix     netip.Prefix
+	timeout    uint32
+	hasTimeout bool
+}
+
+// appendEntry appends a masked prefix of addr to es. If the prefix is
+// already in es, only the longest timeout is kept, so a response adds
+// each network once.
+func (a *Args) appendEntry(es []entry, addr netip.Addr, mask int, ttl uint32) []entry {
+	p := netip.PrefixFrom(addr, mask).Masked()
+	timeout, ok := a.entryTimeout(ttl)
+	for i := range es {
+		if es[i].prefix == p {
+			es[i].timeout = max(es[i].timeout, timeout)
+			return es
+		}
+	}
+	return append(es, entry{prefix: p, timeout: timeout, hasTimeout: ok})
+}
+
+func Init(_ *coremain.BP, args any) (any, error) {
+	return newIpSetPlugin(args.(*Args))
 }
 
 var _ sequence.Executable = (*ipSetPlugin)(nil)
@@ -36,11 +36,8 @@ type ipSetPlugin struct {
 }
 
 func newIpSetPlugin(args *Args) (*ipSetPlugin, error) {
-	if args.Mask4 == 0 {
-		args.Mask4 = 24
-	}
-	if args.Mask6 == 0 {
-		args.Mask6 = 32
+	if err := args.init(); err != nil {
+		return nil, err
 	}
 
 	nl, err := ipset.Init()
@@ -69,6 +66,7 @@ func (p *ipSetPlugin) Close() error {
 }
 
 func (p *ipSetPlugin) addIPSet(r *dns.Msg) error {
+	var v4, v6 []entry
 	for i := range r.Answer {
 		switch rr := r.Answer[i].(type) {
 		case *dns.A:
@@ -79,9 +77,7 @@ func (p *ipSetPlugin) addIPSet(r *dns.Msg) error {
 			if !ok {
 				return fmt.Errorf("invalid A record with ip: %s", rr.A)
 			}
-			if err := ipset.AddPrefix(p.nl, p.args.SetName4, netip.PrefixFrom(addr, p.args.Mask4)); err != nil {
-				return err
-			}
+			v4 = p.args.appendEntry(v4, addr, p.args.Mask4, rr.Hdr.Ttl)
 
 		case *dns.AAAA:
 			if len(p.args.SetName6) == 0 {
@@ -91,13 +87,27 @@ func (p *ipSetPlugin) addIPSet(r *dns.Msg) error {
 			if !ok {
 				return fmt.Errorf("invalid AAAA record with ip: %s", rr.AAAA)
 			}
-			if err := ipset.AddPrefix(p.nl, p.args.SetName6, netip.PrefixFrom(addr, p.args.Mask6)); err != nil {
-				return err
-			}
+			v6 = p.args.appendEntry(v6, addr, p.args.Mask6, rr.Hdr.Ttl)
 		default:
 			continue
 		}
 	}
 
+	if err := p.addEntries(p.args.SetName4, v4); err != nil {
+		return err
+	}
+	return p.addEntries(p.args.SetName6, v6)
+}
+
+func (p *ipSetPlugin) addEntries(setName string, es []entry) error {
+	for _, e := range es {
+		var opts []ipset.Option
+		if e.hasTimeout {
+			opts = append(opts, ipset.OptTimeout(e.timeout))
+		}
+		if err := ipset.AddPrefix(p.nl, setName, e.prefix, opts...); err != nil {
+			return err
+		}
+	}
 	return nil
 }
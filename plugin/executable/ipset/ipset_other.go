@@ -28,7 +28,10 @@ import (
 
 type ipSetPlugin struct{}
 
-func newIpSetPlugin(_ *Args) (*ipSetPlugin, error) {
+func newIpSetPlugin(args *Args) (*ipSetPlugin, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
 	return &ipSetPlugin{}, nil
 }
 
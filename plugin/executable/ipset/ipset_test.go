@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"net/netip"
 	"os"
 	"strconv"
 	"testing"
@@ -118,3 +119,58 @@ func Test_ipset(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestArgs_entryTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    Args
+		ttl     uint32
+		want    uint32
+		wantSet bool
+	}{
+		{"set default", Args{}, 300, 0, false},
+		{"fixed", Args{Timeout: 60}, 300, 60, true},
+		{"ttl", Args{TTLTimeout: true}, 300, 300, true},
+		{"zero ttl", Args{TTLTimeout: true}, 0, 1, true},
+		{"min", Args{TTLTimeout: true, MinTimeout: 60}, 10, 60, true},
+		{"max", Args{TTLTimeout: true, MaxTimeout: 600}, 86400, 600, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.args.init(); err != nil {
+				t.Fatal(err)
+			}
+			got, ok := tt.args.entryTimeout(tt.ttl)
+			if got != tt.want || ok != tt.wantSet {
+				t.Errorf("want %d, %v, got %d, %v", tt.want, tt.wantSet, got, ok)
+			}
+		})
+	}
+
+	if err := (&Args{MinTimeout: 60, MaxTimeout: 10}).init(); err == nil {
+		t.Fatal("max_timeout < min_timeout should fail")
+	}
+	if err := (&Args{Mask6: 129}).init(); err == nil {
+		t.Fatal("invalid mask6 should fail")
+	}
+}
+
+func TestArgs_appendEntry(t *testing.T) {
+	a := &Args{TTLTimeout: true}
+	if err := a.init(); err != nil {
+		t.Fatal(err)
+	}
+	var es []entry
+	es = a.appendEntry(es, netip.MustParseAddr("1.2.3.4"), a.Mask4, 60)
+	es = a.appendEntry(es, netip.MustParseAddr("1.2.3.5"), a.Mask4, 300)
+	es = a.appendEntry(es, netip.MustParseAddr("1.2.4.5"), a.Mask4, 30)
+	if len(es) != 2 {
+		t.Fatalf("want 2 entries, got %+v", es)
+	}
+	if es[0].prefix != netip.MustParsePrefix("1.2.3.0/24") || es[0].timeout != 300 {
+		t.Fatalf("unexpected entry %+v", es[0])
+	}
+	if es[1].prefix != netip.MustParsePrefix("1.2.4.0/24") || es[1].timeout != 30 {
+		t.Fatalf("unexpected entry %+v", es[1])
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package mdns_bridge resolves names of mdns (RFC 6762) devices, e.g.
+// hosts that are advertised by avahi or bonjour, for unicast dns clients.
+package mdns_bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/mdns"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "mdns_bridge"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*Bridge)(nil)
+
+type Args struct {
+	// Suffixes of names that are resolved by mdns. Default is "local".
+	// Reverse zones can be added for PTR queries, e.g. "254.169.in-addr.arpa".
+	Suffixes []string `yaml:"suffixes"`
+	// Interfaces to query on. Default is all up multicast interfaces,
+	// except loopback.
+	Interfaces []string `yaml:"interfaces"`
+	// Timeout of mdns queries in milliseconds. Default is 1000.
+	Timeout int `yaml:"timeout"`
+	// DisableIPv6 disables querying ff02::fb.
+	DisableIPv6 bool `yaml:"disable_ipv6"`
+	// Fallthrough leaves queries that are not resolved by mdns to the
+	// following plugins. By default, they are answered with NXDOMAIN,
+	// because names under suffixes only exist in mdns.
+	Fallthrough bool `yaml:"fallthrough"`
+}
+
+func (a *Args) init() {
+	if len(a.Suffixes) == 0 {
+		a.Suffixes = []string{"local"}
+	}
+	utils.SetDefaultNum(&a.Timeout, 1000)
+}
+
+// Bridge answers queries of names under suffixes with mdns responses.
+type Bridge struct {
+	suffixes    []string // fqdn, lower case
+	r           *resolver
+	fallThrough bool
+	logger      *zap.Logger
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewBridge(args.(*Args), bp.L())
+}
+
+func NewBridge(args *Args, logger *zap.Logger) (*Bridge, error) {
+	args.init()
+	b := &Bridge{
+		r:           &resolver{timeout: time.Duration(args.Timeout) * time.Millisecond},
+		fallThrough: args.Fallthrough,
+		logger:      logger,
+	}
+	for _, s := range args.Suffixes {
+		s = dns.Fqdn(strings.ToLower(strings.Trim(s, ".")))
+		if _, ok := dns.IsDomainName(s); !ok || s == "." {
+			return nil, fmt.Errorf("invalid suffix %q", s)
+		}
+		b.suffixes = append(b.suffixes, s)
+	}
+	ifaces, err := mdns.Interfaces(args.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	b.r.ifaces = ifaces
+	b.r.groups = append(b.r.groups, mdns.GroupV4)
+	if !args.DisableIPv6 {
+		b.r.groups = append(b.r.groups, mdns.GroupV6)
+	}
+	return b, nil
+}
+
+// match reports whether name is under one of the suffixes.
+func (b *Bridge) match(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range b.suffixes {
+		if name == s || strings.HasSuffix(name, "."+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Exec resolves queries of names under suffixes by mdns. If no responder
+// answers, the query is answered with NXDOMAIN, unless Fallthrough is set.
+func (b *Bridge) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET || !b.match(q.Question[0].Name) {
+		return nil
+	}
+	rrs, err := b.r.resolve(ctx, q.Question[0])
+	if err != nil {
+		if !errors.Is(err, errNoResponse) {
+			b.logger.Warn("failed to query mdns", zap.String("qname", q.Question[0].Name), zap.Error(err))
+		}
+		if b.fallThrough {
+			return nil
+		}
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeNameError)
+		r.RecursionAvailable = true
+		qCtx.SetResponse(r)
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	r.Answer = rrs
+	qCtx.SetResponse(r)
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mdns_bridge
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/mdns"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+// startResponder starts a fake mdns responder that owns "printer.local".
+func startResponder(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		b := make([]byte, dns.MaxMsgSize)
+		for {
+			n, src, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(b[:n]); err != nil || !strings.EqualFold(q.Question[0].Name, "printer.local.") {
+				continue
+			}
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Authoritative = true
+			switch q.Question[0].Qtype {
+			case dns.TypeA:
+				r.Answer = []dns.RR{plugintest.MustRR("printer.local. 10 IN A 192.168.1.50")}
+				r.Answer[0].Header().Class |= mdns.CacheFlushBit
+				r.Extra = []dns.RR{plugintest.MustRR("other.local. 10 IN A 192.168.1.51")}
+			default:
+				r.Extra = []dns.RR{plugintest.MustRR("printer.local. 10 IN NSEC printer.local. A")}
+			}
+			out, _ := r.Pack()
+			_, _ = c.WriteTo(out, src)
+		}
+	}()
+	return c.LocalAddr().(*net.UDPAddr)
+}
+
+func TestBridge(t *testing.T) {
+	addr := startResponder(t)
+	newBridge := func(fallThrough bool) *Bridge {
+		b, err := NewBridge(&Args{Timeout: 200, Fallthrough: fallThrough, Suffixes: []string{"local."}}, mlog.Nop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.r.ifaces = nil
+		b.r.groups = []*net.UDPAddr{addr}
+		return b
+	}
+	b := newBridge(false)
+
+	qCtx := plugintest.NewQuery("Printer.local", dns.TypeA).Build()
+	if err := plugintest.Exec(t, b, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	r := qCtx.R()
+	if r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if h := r.Answer[0].Header(); h.Class != dns.ClassINET || h.Name != "Printer.local." || r.Answer[0].(*dns.A).A.String() != "192.168.1.50" {
+		t.Fatalf("unexpected answer %v", r.Answer[0])
+	}
+
+	// The responder owns the name but has no AAAA.
+	qCtx = plugintest.NewQuery("printer.local", dns.TypeAAAA).Build()
+	if err := plugintest.Exec(t, b, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatalf("want NODATA, got %v", r)
+	}
+
+	// No responder.
+	start := time.Now()
+	qCtx = plugintest.NewQuery("nobody.local", dns.TypeA).Build()
+	if err := plugintest.Exec(t, b, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeNameError {
+		t.Fatalf("want NXDOMAIN, got %v", r)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("timeout is not respected")
+	}
+	qCtx = plugintest.NewQuery("nobody.local", dns.TypeA).Build()
+	if err := plugintest.Exec(t, newBridge(true), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r != nil {
+		t.Fatalf("want fallthrough, got %v", r)
+	}
+
+	// Other names are not touched.
+	qCtx = plugintest.NewQuery("printer.lan", dns.TypeA).Build()
+	if err := plugintest.Exec(t, b, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r != nil {
+		t.Fatalf("unexpected response %v", r)
+	}
+}
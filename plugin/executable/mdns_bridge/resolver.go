@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mdns_bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/mdns"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// errNoResponse means no responder answered the question.
+var errNoResponse = errors.New("no mdns response")
+
+// resolver sends legacy unicast queries (RFC 6762 6.7) to mdns groups.
+// Queries are sent from an ephemeral port, so responders reply with
+// conventional unicast dns responses to the source address.
+type resolver struct {
+	ifaces  []net.Interface // empty means the default interface
+	groups  []*net.UDPAddr
+	timeout time.Duration
+}
+
+// resolve returns records of question q from the first response. The
+// records may be empty if the responder owns the name but has no record
+// of the type. It returns errNoResponse if there was no response in time.
+func (r *resolver) resolve(ctx context.Context, q dns.Question) ([]dns.RR, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	m := new(dns.Msg)
+	m.Id = dns.Id()
+	m.Question = []dns.Question{{Name: q.Name, Qtype: q.Qtype, Qclass: dns.ClassINET}}
+	b, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		rrs []dns.RR
+		err error
+	}
+	resc := make(chan result, len(r.groups))
+	for _, g := range r.groups {
+		go func(g *net.UDPAddr) {
+			rrs, err := r.exchange(ctx, g, b, m)
+			resc <- result{rrs: rrs, err: err}
+		}(g)
+	}
+	var errs []error
+	for range r.groups {
+		res := <-resc
+		if res.err == nil {
+			return res.rrs, nil
+		}
+		if !errors.Is(res.err, errNoResponse) {
+			errs = append(errs, res.err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, errNoResponse
+}
+
+// exchange sends query b to group g on every interface and waits for the
+// first response.
+func (r *resolver) exchange(ctx context.Context, g *net.UDPAddr, b []byte, q *dns.Msg) ([]dns.RR, error) {
+	network := "udp4"
+	if g.IP.To4() == nil {
+		network = "udp6"
+	}
+	c, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	go func() {
+		<-ctx.Done()
+		_ = c.SetReadDeadline(time.Now())
+	}()
+
+	write := func(ifIndex int) error {
+		_, err := c.WriteTo(b, g)
+		return err
+	}
+	if g.IP.IsMulticast() {
+		if network == "udp4" {
+			pc := ipv4.NewPacketConn(c)
+			_ = pc.SetMulticastTTL(255)
+			write = func(ifIndex int) error {
+				_, err := pc.WriteTo(b, &ipv4.ControlMessage{IfIndex: ifIndex}, g)
+				return err
+			}
+		} else {
+			pc := ipv6.NewPacketConn(c)
+			_ = pc.SetMulticastHopLimit(255)
+			write = func(ifIndex int) error {
+				_, err := pc.WriteTo(b, &ipv6.ControlMessage{IfIndex: ifIndex}, g)
+				return err
+			}
+		}
+	}
+	if len(r.ifaces) == 0 {
+		if err := write(0); err != nil {
+			return nil, fmt.Errorf("failed to send query to %s, %w", g, err)
+		}
+	} else {
+		sent := 0
+		for _, ifi := range r.ifaces {
+			if write(ifi.Index) == nil {
+				sent++
+			}
+		}
+		if sent == 0 {
+			return nil, fmt.Errorf("failed to send query to %s on any interface", g)
+		}
+	}
+
+	buf := pool.GetBuf(dns.MaxMsgSize)
+	defer pool.ReleaseBuf(buf)
+	for {
+		n, _, err := c.ReadFrom(*buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, errNoResponse
+			}
+			return nil, err
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack((*buf)[:n]); err != nil || !resp.Response || resp.Id != q.Id || resp.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		return answersOf(resp, q.Question[0]), nil
+	}
+}
+
+// answersOf returns records of question q in mdns response resp, with
+// the cache flush bit cleared. Records of other names (e.g. additional
+// records) are dropped.
+func answersOf(resp *dns.Msg, q dns.Question) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range resp.Answer {
+		h := rr.Header()
+		h.Class &^= mdns.CacheFlushBit
+		if !strings.EqualFold(h.Name, q.Name) || h.Class != dns.ClassINET {
+			continue
+		}
+		if h.Rrtype == q.Qtype || h.Rrtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+			h.Name = q.Name
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
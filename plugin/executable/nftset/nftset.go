@@ -21,14 +21,17 @@ package nftset
 
 import (
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const PluginType = "nftset"
 
 func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
 	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
 }
 
@@ -37,6 +40,16 @@ var _ sequence.Executable = (*nftSetPlugin)(nil)
 type Args struct {
 	IPv4 SetArgs `yaml:"ipv4"`
 	IPv6 SetArgs `yaml:"ipv6"`
+
+	// Timeouts of added elements. They only work with sets that have
+	// the timeout flag. If both are unset, the default timeout of the
+	// set is used.
+	Timeout    int  `yaml:"timeout"`     // (seconds) timeout of elements.
+	TTLTimeout bool `yaml:"ttl_timeout"` // use ttls of answer records as timeouts, but at least timeout seconds.
+}
+
+func Init(_ *coremain.BP, args any) (any, error) {
+	return newNftSetPlugin(args.(*Args))
 }
 
 type SetArgs struct {
@@ -82,3 +95,14 @@ func QuickSetup(_ sequence.BQ, s string) (any, error) {
 	}
 	return newNftSetPlugin(args)
 }
+
+// elemTimeout returns the timeout of an element from a record with ttl.
+func elemTimeout(args *Args, ttl uint32) time.Duration {
+	timeout := time.Duration(args.Timeout) * time.Second
+	if args.TTLTimeout {
+		if d := time.Duration(ttl) * time.Second; d > timeout {
+			timeout = d
+		}
+	}
+	return timeout
+}
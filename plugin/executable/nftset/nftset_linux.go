@@ -48,6 +48,9 @@ func newNftSetPlugin(args *Args) (*nftSetPlugin, error) {
 	if m := args.IPv6.Mask; m > 128 {
 		return nil, fmt.Errorf("invalid ipv6 mask %d", m)
 	}
+	if args.Timeout < 0 {
+		return nil, fmt.Errorf("invalid timeout %d", args.Timeout)
+	}
 
 	p := &nftSetPlugin{
 		args: args,
@@ -91,8 +94,8 @@ func (p *nftSetPlugin) Exec(_ context.Context, qCtx *query_context.Context) erro
 }
 
 func (p *nftSetPlugin) addElems(r *dns.Msg) error {
-	var v4Elems []netip.Prefix
-	var v6Elems []netip.Prefix
+	var v4Elems []nftset_utils.Elem
+	var v6Elems []nftset_utils.Elem
 
 	for i := range r.Answer {
 		switch rr := r.Answer[i].(type) {
@@ -105,7 +108,10 @@ func (p *nftSetPlugin) addElems(r *dns.Msg) error {
 			if !ok || !addr.Is4() {
 				return fmt.Errorf("internel: dns.A record [%s] is not a ipv4 address", rr.A)
 			}
-			v4Elems = append(v4Elems, netip.PrefixFrom(addr, p.args.IPv4.Mask))
+			v4Elems = append(v4Elems, nftset_utils.Elem{
+				Prefix:  netip.PrefixFrom(addr, p.args.IPv4.Mask),
+				Timeout: elemTimeout(p.args, rr.Hdr.Ttl),
+			})
 
 		case *dns.AAAA:
 			if p.v6Handler == nil {
@@ -118,20 +124,23 @@ func (p *nftSetPlugin) addElems(r *dns.Msg) error {
 			if addr.Is4() {
 				addr = netip.AddrFrom16(addr.As16())
 			}
-			v6Elems = append(v6Elems, netip.PrefixFrom(addr, p.args.IPv6.Mask))
+			v6Elems = append(v6Elems, nftset_utils.Elem{
+				Prefix:  netip.PrefixFrom(addr, p.args.IPv6.Mask),
+				Timeout: elemTimeout(p.args, rr.Hdr.Ttl),
+			})
 		default:
 			continue
 		}
 	}
 
 	if p.v4Handler != nil && len(v4Elems) > 0 {
-		if err := p.v4Handler.AddElems(v4Elems...); err != nil {
+		if err := p.v4Handler.AddElemsWithTimeout(v4Elems...); err != nil {
 			return fmt.Errorf("failed to add ipv4 elems %s: %w", v4Elems, err)
 		}
 	}
 
 	if p.v6Handler != nil && len(v6Elems) > 0 {
-		if err := p.v6Handler.AddElems(v6Elems...); err != nil {
+		if err := p.v6Handler.AddElemsWithTimeout(v6Elems...); err != nil {
 			return fmt.Errorf("failed to add ipv6 elems %s: %w", v6Elems, err)
 		}
 	}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package nftset
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_elemTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		args Args
+		ttl  uint32
+		want time.Duration
+	}{
+		{"set default", Args{}, 300, 0},
+		{"fixed", Args{Timeout: 60}, 300, time.Minute},
+		{"ttl", Args{TTLTimeout: true}, 300, 5 * time.Minute},
+		{"ttl below minimum", Args{TTLTimeout: true, Timeout: 60}, 10, time.Minute},
+		{"ttl above minimum", Args{TTLTimeout: true, Timeout: 60}, 600, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := elemTimeout(&tt.args, tt.ttl); got != tt.want {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package override
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/hosts"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const PluginType = "override"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*Override)(nil)
+var _ coremain.StateExporter = (*Override)(nil)
+
+// Args configures static answers that are only active within schedules
+// or while the flag is on. The flag can be toggled by the api.
+type Args struct {
+	// Entries and Files are in the hosts format, see the hosts plugin.
+	Entries []string `yaml:"entries"`
+	Files   []string `yaml:"files"`
+
+	// Schedules are time windows in local time, in the format of
+	// "[days] HH:MM-HH:MM", e.g. "mon-fri 02:00-04:00", "sat,sun 22:00-06:00".
+	Schedules []string `yaml:"schedules"`
+
+	// Enabled is the initial state of the flag.
+	Enabled bool `yaml:"enabled"`
+}
+
+type Override struct {
+	h         *hosts.Hosts
+	schedules []*schedule
+	enabled   atomic.Bool
+	logger    *zap.Logger
+	now       func() time.Time
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	o, err := NewOverride(args.(*Args), bp.L(), bp.M().Storages())
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(o.Api())
+	return o, nil
+}
+
+func NewOverride(args *Args, logger *zap.Logger, ss remote.Storages) (*Override, error) {
+	if len(args.Entries)+len(args.Files) == 0 {
+		return nil, errors.New("no entry is configured")
+	}
+	h, err := hosts.NewHosts(&hosts.Args{Entries: args.Entries, Files: args.Files}, ss)
+	if err != nil {
+		return nil, err
+	}
+	o := &Override{
+		h:      h,
+		logger: logger,
+		now:    time.Now,
+	}
+	for _, s := range args.Schedules {
+		sc, err := parseSchedule(s)
+		if err != nil {
+			return nil, err
+		}
+		o.schedules = append(o.schedules, sc)
+	}
+	o.enabled.Store(args.Enabled)
+	return o, nil
+}
+
+// Active reports whether the override answers are being served.
+func (o *Override) Active() bool {
+	if o.enabled.Load() {
+		return true
+	}
+	now := o.now()
+	for _, sc := range o.schedules {
+		if sc.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Override) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if !o.Active() {
+		return nil
+	}
+	if r := o.h.Response(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+	}
+	return nil
+}
+
+type overrideState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ExportState exports the flag that was set by the api.
+func (o *Override) ExportState() (json.RawMessage, error) {
+	return json.Marshal(overrideState{Enabled: o.enabled.Load()})
+}
+
+// ImportState imports the flag.
+func (o *Override) ImportState(b json.RawMessage) error {
+	var s overrideState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	o.enabled.Store(s.Enabled)
+	return nil
+}
+
+func (o *Override) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Enabled bool `json:"enabled"`
+			Active  bool `json:"active"`
+		}{o.enabled.Load(), o.Active()})
+	})
+	setFlag := func(v bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			o.enabled.Store(v)
+			o.logger.Info("override flag changed", zap.Bool("enabled", v))
+			_, _ = fmt.Fprintf(w, "enabled: %v\n", v)
+		}
+	}
+	r.Post("/enable", setFlag(true))
+	r.Post("/disable", setFlag(false))
+	return r
+}
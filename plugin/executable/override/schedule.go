@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package override
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// schedule is a daily time window on some weekdays.
+type schedule struct {
+	days       [7]bool
+	start, end int // minutes of the day
+}
+
+// parseSchedule parses "[days] HH:MM-HH:MM".
+// days is a comma separated list of weekdays or weekday ranges,
+// e.g. "mon-fri", "sat,sun". Default is every day.
+// If end is before start, the window ends on the next day.
+func parseSchedule(s string) (*schedule, error) {
+	fs := strings.Fields(s)
+	var dayStr, timeStr string
+	switch len(fs) {
+	case 1:
+		timeStr = fs[0]
+	case 2:
+		dayStr, timeStr = fs[0], fs[1]
+	default:
+		return nil, fmt.Errorf("invalid schedule %q", s)
+	}
+
+	sc := new(schedule)
+	if len(dayStr) == 0 {
+		for i := range sc.days {
+			sc.days[i] = true
+		}
+	} else {
+		for _, d := range strings.Split(strings.ToLower(dayStr), ",") {
+			from, to, isRange := strings.Cut(d, "-")
+			fd, ok := weekdays[from]
+			if !ok {
+				return nil, fmt.Errorf("invalid weekday %q", from)
+			}
+			td := fd
+			if isRange {
+				if td, ok = weekdays[to]; !ok {
+					return nil, fmt.Errorf("invalid weekday %q", to)
+				}
+			}
+			for wd := fd; ; wd = (wd + 1) % 7 {
+				sc.days[wd] = true
+				if wd == td {
+					break
+				}
+			}
+		}
+	}
+
+	startStr, endStr, ok := strings.Cut(timeStr, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time window %q", timeStr)
+	}
+	var err error
+	if sc.start, err = parseClock(startStr); err != nil {
+		return nil, err
+	}
+	if sc.end, err = parseClock(endStr); err != nil {
+		return nil, err
+	}
+	if sc.start == sc.end {
+		return nil, fmt.Errorf("empty time window %q", timeStr)
+	}
+	return sc, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, %w", s, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (sc *schedule) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	wd := t.Weekday()
+	if sc.start < sc.end {
+		return sc.days[wd] && m >= sc.start && m < sc.end
+	}
+	// Window crosses midnight.
+	if m >= sc.start {
+		return sc.days[wd]
+	}
+	if m < sc.end {
+		return sc.days[(wd+6)%7]
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package override
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_schedule_contains(t *testing.T) {
+	// 2024-01-01 is a Monday.
+	at := func(day int, hm string) time.Time {
+		c, _ := time.Parse("15:04", hm)
+		return time.Date(2024, 1, day, c.Hour(), c.Minute(), 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		schedule string
+		t        time.Time
+		want     bool
+	}{
+		{"02:00-04:00", at(1, "03:00"), true},
+		{"02:00-04:00", at(1, "04:00"), false},
+		{"mon-fri 02:00-04:00", at(6, "03:00"), false}, // Saturday
+		{"sat,sun 02:00-04:00", at(7, "03:00"), true},  // Sunday
+		{"fri-mon 02:00-04:00", at(1, "03:00"), true},  // range wraps the week
+		{"fri-mon 02:00-04:00", at(3, "03:00"), false}, // Wednesday
+		{"fri 22:00-06:00", at(5, "23:00"), true},      // Friday night
+		{"fri 22:00-06:00", at(6, "05:00"), true},      // Saturday morning
+		{"fri 22:00-06:00", at(5, "05:00"), false},     // Friday morning
+	}
+	for _, tt := range tests {
+		sc, err := parseSchedule(tt.schedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sc.contains(tt.t); got != tt.want {
+			t.Errorf("%s contains %s = %v, want %v", tt.schedule, tt.t, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", "02:00", "mon 02:00-02:00", "xyz 02:00-03:00", "a b c"} {
+		if _, err := parseSchedule(s); err == nil {
+			t.Errorf("expect an err for %q", s)
+		}
+	}
+}
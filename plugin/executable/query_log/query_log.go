@@ -0,0 +1,227 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	qlog "github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const PluginType = "query_log"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	formatJSON   = "json"
+	formatBinary = "binary"
+
+	flushInterval = time.Second
+)
+
+var _ sequence.RecursiveExecutable = (*QueryLog)(nil)
+var _ coremain.MetricsProvider = (*QueryLog)(nil)
+
+// Args configures the query log. Records are written after the rest of
+// the sequence is done, by a background goroutine. Records are dropped if
+// the writer can't keep up.
+type Args struct {
+	File string `yaml:"file"` // Required.
+	// Format is "json" (default, json lines) or "binary" (length prefixed
+	// protobuf records, see appendBinary).
+	Format string `yaml:"format"`
+
+	MaxSize    int `yaml:"max_size"`    // (MB) rotate the file at this size, default is 100. Negative disables it.
+	MaxAge     int `yaml:"max_age"`     // (seconds) rotate the file at this age. 0 (default) disables it.
+	MaxBackups int `yaml:"max_backups"` // number of rotated files to keep, default is 5. Negative keeps all.
+
+	// SampleRate is the fraction of queries that are logged. Default is 1.
+	SampleRate float64 `yaml:"sample_rate"`
+	BufferSize int     `yaml:"buffer_size"` // number of records, default is 4096
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultString(&a.Format, formatJSON)
+	utils.SetDefaultNum(&a.MaxSize, 100)
+	utils.SetDefaultNum(&a.MaxBackups, 5)
+	utils.SetDefaultNum(&a.SampleRate, 1)
+	utils.SetDefaultNum(&a.BufferSize, 4096)
+	if len(a.File) == 0 {
+		return fmt.Errorf("missing file")
+	}
+	if a.Format != formatJSON && a.Format != formatBinary {
+		return fmt.Errorf("unknown format %s", a.Format)
+	}
+	if a.SampleRate < 0 || a.SampleRate > 1 {
+		return fmt.Errorf("invalid sample rate %v", a.SampleRate)
+	}
+	return nil
+}
+
+type QueryLog struct {
+	args   *Args
+	logger *zap.Logger
+	w      *rotateWriter
+	ch     chan *qlog.Record
+
+	recordsTotal prometheus.Counter
+	droppedTotal prometheus.Counter
+
+	// ch is never closed, because Exec may still be running when the
+	// plugin is closed. closeNotify stops the writer instead.
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	closed      chan struct{} // closed after the writer goroutine exits
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewQueryLog(args.(*Args), bp.L())
+}
+
+// NewQueryLog opens the log file and starts the writer goroutine.
+func NewQueryLog(args *Args, logger *zap.Logger) (*QueryLog, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	var maxSize int64
+	if args.MaxSize > 0 {
+		maxSize = int64(args.MaxSize) << 20
+	}
+	w, err := newRotateWriter(args.File, maxSize, time.Duration(args.MaxAge)*time.Second, max(args.MaxBackups, 0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file, %w", err)
+	}
+	l := &QueryLog{
+		args:   args,
+		logger: logger,
+		w:      w,
+		ch:     make(chan *qlog.Record, args.BufferSize),
+		recordsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "records_total",
+			Help: "The total number of written records",
+		}),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dropped_total",
+			Help: "The total number of records that were dropped because the buffer was full",
+		}),
+		closeNotify: make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	go l.writeLoop()
+	return l, nil
+}
+
+// Metrics implements coremain.MetricsProvider.
+func (l *QueryLog) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{l.recordsTotal, l.droppedTotal}
+}
+
+func (l *QueryLog) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	err := next.ExecNext(ctx, qCtx)
+	if l.args.SampleRate < 1 && rand.Float64() >= l.args.SampleRate {
+		return err
+	}
+	select {
+	case <-l.closeNotify:
+		return err
+	default:
+	}
+	select {
+	case l.ch <- qlog.NewRecord(qCtx, qCtx.R(), err):
+	default:
+		l.droppedTotal.Inc()
+	}
+	return err
+}
+
+func (l *QueryLog) writeLoop() {
+	defer close(l.closed)
+	bw := bufio.NewWriterSize(l.w, 64*1024)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var b []byte
+	flush := func() {
+		if err := bw.Flush(); err != nil {
+			l.logger.Warn("failed to write query log", zap.Error(err))
+			bw.Reset(l.w)
+		}
+	}
+	write := func(rec *qlog.Record) {
+		b = b[:0]
+		if l.args.Format == formatBinary {
+			b = appendBinary(b, rec)
+		} else {
+			var err error
+			if b, err = appendJSON(b, rec); err != nil {
+				l.logger.Warn("failed to encode query log record", zap.Error(err))
+				return
+			}
+		}
+		if _, err := bw.Write(b); err != nil {
+			l.logger.Warn("failed to write query log", zap.Error(err))
+			bw.Reset(l.w)
+			return
+		}
+		l.recordsTotal.Inc()
+	}
+	for {
+		select {
+		case rec := <-l.ch:
+			write(rec)
+		case <-ticker.C:
+			flush()
+		case <-l.closeNotify:
+			// Write records that are already buffered.
+			for {
+				select {
+				case rec := <-l.ch:
+					write(rec)
+				default:
+					flush()
+					if err := l.w.Close(); err != nil {
+						l.logger.Warn("failed to close query log", zap.Error(err))
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close flushes buffered records and closes the file. Records of queries
+// that are done after Close are dropped.
+func (l *QueryLog) Close() error {
+	l.closeOnce.Do(func() { close(l.closeNotify) })
+	<-l.closed
+	return nil
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	qlog "github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestQueryLog_JSON(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "query.log")
+	l, err := NewQueryLog(&Args{File: file}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+		qCtx.StoreValue(query_context.KeyUpstream, "udp://10.0.0.1")
+		return nil
+	})
+	qCtx := plugintest.NewQuery("example.com", dns.TypeA).Client("127.0.0.1").Build()
+	if err := plugintest.Exec(t, l, qCtx, upstream, plugintest.Answer("@ 300 IN A 192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec qlog.Record
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Client != "127.0.0.1" || rec.QName != "example.com." || rec.QType != "A" || rec.Rcode != "NOERROR" ||
+		len(rec.Answers) != 1 || rec.Answers[0] != "192.0.2.1" || rec.Upstream != "udp://10.0.0.1" {
+		t.Fatalf("unexpected record %s", b)
+	}
+}
+
+// Exec may still be running when the plugin is closed.
+func TestQueryLog_CloseWhileExec(t *testing.T) {
+	l, err := NewQueryLog(&Args{File: filepath.Join(t.TempDir(), "query.log"), BufferSize: 1}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				qCtx := plugintest.NewQuery("example.com", dns.TypeA).Build()
+				if err := plugintest.Exec(t, l, qCtx); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+func TestRecord_appendBinary(t *testing.T) {
+	qCtx := plugintest.NewQuery("example.com", dns.TypeAAAA).Build()
+	rec := qlog.NewRecord(qCtx, nil, nil)
+	rec.Time = time.Unix(1, 0)
+	rec.Answers = []string{"192.0.2.1", "192.0.2.2"}
+	rec.Rule = "||example.com^"
+	b := appendBinary(nil, rec)
+	n, l := protowire.ConsumeVarint(b)
+	if l < 0 || int(n) != len(b)-l {
+		t.Fatal("invalid length prefix")
+	}
+	b = b[l:]
+
+	strings := make(map[protowire.Number][]string)
+	varints := make(map[protowire.Number]uint64)
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			t.Fatal(protowire.ParseError(l))
+		}
+		b = b[l:]
+		switch typ {
+		case protowire.VarintType:
+			v, l := protowire.ConsumeVarint(b)
+			if l < 0 {
+				t.Fatal(protowire.ParseError(l))
+			}
+			varints[num] = v
+			b = b[l:]
+		case protowire.BytesType:
+			v, l := protowire.ConsumeString(b)
+			if l < 0 {
+				t.Fatal(protowire.ParseError(l))
+			}
+			strings[num] = append(strings[num], v)
+			b = b[l:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+	if varints[fieldTime] != uint64(time.Second) || varints[fieldQType] != uint64(dns.TypeAAAA) {
+		t.Fatalf("unexpected varints %v", varints)
+	}
+	if _, ok := varints[fieldRcode]; ok {
+		t.Fatal("rcode should be absent")
+	}
+	if len(strings[fieldAnswers]) != 2 || strings[fieldRule][0] != rec.Rule || strings[fieldQName][0] != rec.QName {
+		t.Fatalf("unexpected strings %v", strings)
+	}
+}
+
+func TestRotateWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "query.log")
+	w, err := newRotateWriter(file, 10, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	w.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(w.backups()); n != 2 {
+		t.Fatalf("want 2 backups, got %d", n)
+	}
+
+	// Rotated by age.
+	now = now.Add(time.Hour)
+	if _, err := w.Write([]byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	if w.size != 1 {
+		t.Fatalf("want a new file, got size %d", w.size)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Scan()
+	if s.Text() != "0" {
+		t.Fatalf("unexpected content %q", s.Text())
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"encoding/json"
+
+	qlog "github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// appendJSON appends the json line of rec to b. It has the same fields
+// as the live query log api.
+func appendJSON(b []byte, rec *qlog.Record) ([]byte, error) {
+	j, err := json.Marshal(rec)
+	if err != nil {
+		return b, err
+	}
+	b = append(b, j...)
+	return append(b, '\n'), nil
+}
+
+// Field numbers of binary records. A binary file is a sequence of
+// varint length prefixed protobuf messages:
+//
+//	message Record {
+//	  int64  time_unix_nano = 1;
+//	  string client = 2;
+//	  string qname = 3;
+//	  uint32 qtype = 4;
+//	  uint32 rcode = 5; // absent if there is no response
+//	  repeated string answers = 6;
+//	  string upstream = 7;
+//	  uint64 latency_us = 8;
+//	  string rule = 9;
+//	  string error = 10;
+//	  bool   dropped = 11;
+//	}
+const (
+	fieldTime protowire.Number = iota + 1
+	fieldClient
+	fieldQName
+	fieldQType
+	fieldRcode
+	fieldAnswers
+	fieldUpstream
+	fieldLatency
+	fieldRule
+	fieldError
+	fieldDropped
+)
+
+// appendBinary appends the length prefixed binary record of rec to b.
+func appendBinary(b []byte, rec *qlog.Record) []byte {
+	var m []byte
+	appendString := func(num protowire.Number, s string) {
+		if len(s) > 0 {
+			m = protowire.AppendTag(m, num, protowire.BytesType)
+			m = protowire.AppendString(m, s)
+		}
+	}
+	appendVarint := func(num protowire.Number, v uint64) {
+		m = protowire.AppendTag(m, num, protowire.VarintType)
+		m = protowire.AppendVarint(m, v)
+	}
+	appendVarint(fieldTime, uint64(rec.Time.UnixNano()))
+	appendString(fieldClient, rec.Client)
+	appendString(fieldQName, rec.QName)
+	appendVarint(fieldQType, uint64(rec.Qtype()))
+	if rcode, ok := rec.RcodeCode(); ok {
+		appendVarint(fieldRcode, uint64(rcode))
+	}
+	for _, a := range rec.Answers {
+		appendString(fieldAnswers, a)
+	}
+	appendString(fieldUpstream, rec.Upstream)
+	appendVarint(fieldLatency, uint64(rec.LatencyMs*1000))
+	appendString(fieldRule, rec.Rule)
+	appendString(fieldError, rec.Err)
+	if rec.Dropped {
+		appendVarint(fieldDropped, 1)
+	}
+
+	b = protowire.AppendVarint(b, uint64(len(m)))
+	return append(b, m...)
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405.000"
+
+// rotateWriter writes to a file and rotates it by size and age. Rotated
+// files are renamed to "<path>.<time>". It is not safe for concurrent use.
+type rotateWriter struct {
+	path       string
+	maxSize    int64         // 0 means no limit
+	maxAge     time.Duration // 0 means no limit
+	maxBackups int           // 0 means keeping all backups
+
+	f      *os.File
+	size   int64
+	opened time.Time
+	now    func() time.Time
+}
+
+func newRotateWriter(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotateWriter, error) {
+	w := &rotateWriter{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups, now: time.Now}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	w.f, w.size, w.opened = f, fi.Size(), w.now()
+	return nil
+}
+
+func (w *rotateWriter) Write(b []byte) (int, error) {
+	if w.shouldRotate(len(b)) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) shouldRotate(n int) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.maxSize > 0 && w.size+int64(n) > w.maxSize {
+		return true
+	}
+	return w.maxAge > 0 && w.now().Sub(w.opened) >= w.maxAge
+}
+
+func (w *rotateWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	backup := w.path + "." + w.now().Format(backupTimeFormat)
+	if err := os.Rename(w.path, backup); err != nil {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.removeOldBackups()
+	return nil
+}
+
+// backups returns rotated files, oldest first.
+func (w *rotateWriter) backups() []string {
+	l, _ := filepath.Glob(w.path + ".*")
+	var backups []string
+	for _, f := range l {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(f, w.path+".")); err == nil {
+			backups = append(backups, f)
+		}
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+func (w *rotateWriter) removeOldBackups() {
+	if w.maxBackups <= 0 {
+		return
+	}
+	backups := w.backups()
+	for len(backups) > w.maxBackups {
+		_ = os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+func (w *rotateWriter) Sync() error {
+	return w.f.Sync()
+}
+
+func (w *rotateWriter) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_stats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	qlog "github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+)
+
+const clickhouseTimeFormat = "2006-01-02 15:04:05.000"
+
+// clickhouseSink inserts rows with the http interface of ClickHouse.
+type clickhouseSink struct {
+	url      string
+	table    string
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newClickhouseSink(u, table, user, password string) *clickhouseSink {
+	return &clickhouseSink{
+		url:      strings.TrimSuffix(u, "/") + "/",
+		table:    table,
+		user:     user,
+		password: password,
+		client:   &http.Client{},
+	}
+}
+
+// createTable creates the table if it doesn't exist.
+func (s *clickhouseSink) createTable(ctx context.Context) error {
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	ts DateTime64(3, 'UTC'),
+	client String,
+	qname String,
+	qtype LowCardinality(String),
+	rcode LowCardinality(String),
+	upstream LowCardinality(String),
+	latency_ms Float64,
+	rule String
+) ENGINE = MergeTree ORDER BY ts`, s.table)
+	return s.do(ctx, q, nil)
+}
+
+type clickhouseRow struct {
+	TS       string  `json:"ts"`
+	Client   string  `json:"client"`
+	QName    string  `json:"qname"`
+	QType    string  `json:"qtype"`
+	Rcode    string  `json:"rcode"`
+	Upstream string  `json:"upstream"`
+	Latency  float64 `json:"latency_ms"`
+	Rule     string  `json:"rule"`
+}
+
+func (s *clickhouseSink) insert(ctx context.Context, rows []*qlog.Record) error {
+	b := new(bytes.Buffer)
+	enc := json.NewEncoder(b)
+	for _, r := range rows {
+		err := enc.Encode(clickhouseRow{
+			TS:       r.Time.UTC().Format(clickhouseTimeFormat),
+			Client:   r.Client,
+			QName:    r.QName,
+			QType:    r.QType,
+			Rcode:    r.Rcode,
+			Upstream: r.Upstream,
+			Latency:  r.LatencyMs,
+			Rule:     r.Rule,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.do(ctx, fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", s.table), b)
+}
+
+// do runs query q. body is the data of the query and can be nil.
+func (s *clickhouseSink) do(ctx context.Context, q string, body io.Reader) error {
+	u := s.url + "?query=" + url.QueryEscape(q)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, body)
+	if err != nil {
+		return err
+	}
+	if len(s.user) > 0 {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("http status %d, %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (s *clickhouseSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
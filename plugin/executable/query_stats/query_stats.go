@@ -0,0 +1,282 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	qlog "github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const PluginType = "query_stats"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	driverSqlite     = "sqlite"
+	driverClickhouse = "clickhouse"
+
+	insertTimeout = time.Second * 10
+	maxBackoff    = time.Minute
+)
+
+var tableNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+var _ sequence.RecursiveExecutable = (*QueryStats)(nil)
+var _ coremain.MetricsProvider = (*QueryStats)(nil)
+
+// Args configures the stats sink. Query records are batched and inserted
+// into the database by a background goroutine. If the database is slow
+// or down, up to BufferSize records are held in memory, and newer
+// records are dropped.
+type Args struct {
+	Driver string `yaml:"driver"` // "sqlite" or "clickhouse". Required.
+	Table  string `yaml:"table"`  // Default is "mosdns_queries".
+
+	// sqlite
+	File      string `yaml:"file"`      // Required by sqlite.
+	Retention int    `yaml:"retention"` // (days) delete older rows. 0 (default) keeps all rows.
+
+	// clickhouse
+	URL      string `yaml:"url"` // http interface, e.g. "http://127.0.0.1:8123". Required by clickhouse.
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+
+	BatchSize     int `yaml:"batch_size"`     // Default is 1000.
+	FlushInterval int `yaml:"flush_interval"` // (seconds) Default is 5.
+	BufferSize    int `yaml:"buffer_size"`    // Default is 100000.
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultString(&a.Table, "mosdns_queries")
+	utils.SetDefaultNum(&a.BatchSize, 1000)
+	utils.SetDefaultNum(&a.FlushInterval, 5)
+	utils.SetDefaultNum(&a.BufferSize, 100000)
+	if !tableNameRe.MatchString(a.Table) {
+		return fmt.Errorf("invalid table name %q", a.Table)
+	}
+	if a.BufferSize < a.BatchSize {
+		return errors.New("buffer_size must not be smaller than batch_size")
+	}
+	switch a.Driver {
+	case driverSqlite:
+		if len(a.File) == 0 {
+			return errors.New("missing file")
+		}
+	case driverClickhouse:
+		if len(a.URL) == 0 {
+			return errors.New("missing url")
+		}
+	default:
+		return fmt.Errorf("invalid driver %q", a.Driver)
+	}
+	return nil
+}
+
+type sink interface {
+	insert(ctx context.Context, rows []*qlog.Record) error
+	Close() error
+}
+
+type QueryStats struct {
+	args   *Args
+	logger *zap.Logger
+	sink   sink
+	ch     chan *qlog.Record
+
+	insertedTotal prometheus.Counter
+	droppedTotal  prometheus.Counter
+	errTotal      prometheus.Counter
+	pending       prometheus.Gauge
+
+	// ch is never closed, because Exec may still be running when the
+	// plugin is closed. closeNotify stops the writer instead.
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	closed      chan struct{} // closed after the writer goroutine exits
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if err := a.init(); err != nil {
+		return nil, err
+	}
+	var s sink
+	switch a.Driver {
+	case driverSqlite:
+		ss, err := newSqliteSink(a.File, a.Table, time.Duration(a.Retention)*time.Hour*24, bp.L())
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sqlite file, %w", err)
+		}
+		s = ss
+	case driverClickhouse:
+		cs := newClickhouseSink(a.URL, a.Table, a.User, a.Password)
+		ctx, cancel := context.WithTimeout(context.Background(), insertTimeout)
+		defer cancel()
+		if err := cs.createTable(ctx); err != nil {
+			bp.L().Warn("failed to create clickhouse table", zap.Error(err))
+		}
+		s = cs
+	}
+	return newQueryStats(a, s, bp.L()), nil
+}
+
+// newQueryStats starts the writer goroutine. args must be initialized.
+func newQueryStats(args *Args, s sink, logger *zap.Logger) *QueryStats {
+	q := &QueryStats{
+		args:   args,
+		logger: logger,
+		sink:   s,
+		ch:     make(chan *qlog.Record, args.BatchSize),
+		insertedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "inserted_total",
+			Help: "The total number of inserted records",
+		}),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dropped_total",
+			Help: "The total number of records that were dropped because the buffer was full",
+		}),
+		errTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "insert_err_total",
+			Help: "The total number of failed inserts",
+		}),
+		pending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pending_records",
+			Help: "The number of records that are waiting to be inserted",
+		}),
+		closeNotify: make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	go q.writeLoop()
+	return q
+}
+
+// Metrics implements coremain.MetricsProvider.
+func (q *QueryStats) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{q.insertedTotal, q.droppedTotal, q.errTotal, q.pending}
+}
+
+func (q *QueryStats) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	err := next.ExecNext(ctx, qCtx)
+	select {
+	case <-q.closeNotify:
+		return err
+	default:
+	}
+	select {
+	case q.ch <- qlog.NewRecord(qCtx, qCtx.R(), err):
+	default:
+		q.droppedTotal.Inc()
+	}
+	return err
+}
+
+func (q *QueryStats) writeLoop() {
+	defer close(q.closed)
+	ticker := time.NewTicker(time.Duration(q.args.FlushInterval) * time.Second)
+	defer ticker.Stop()
+
+	var (
+		rows      []*qlog.Record
+		failures  int
+		nextRetry time.Time
+	)
+	flush := func() {
+		if len(rows) == 0 || time.Now().Before(nextRetry) {
+			return
+		}
+		for len(rows) > 0 {
+			n := min(len(rows), q.args.BatchSize)
+			ctx, cancel := context.WithTimeout(context.Background(), insertTimeout)
+			err := q.sink.insert(ctx, rows[:n])
+			cancel()
+			if err != nil {
+				q.errTotal.Inc()
+				failures++
+				backoff := min(time.Second<<min(failures, 6), maxBackoff)
+				nextRetry = time.Now().Add(backoff)
+				q.logger.Warn("failed to insert query records", zap.Int("pending", len(rows)), zap.Duration("retry_in", backoff), zap.Error(err))
+				break
+			}
+			failures = 0
+			q.insertedTotal.Add(float64(n))
+			rows = rows[n:]
+		}
+		if len(rows) == 0 {
+			rows = nil
+		}
+		q.pending.Set(float64(len(rows)))
+	}
+
+	add := func(r *qlog.Record) {
+		if len(rows) >= q.args.BufferSize {
+			q.droppedTotal.Inc()
+			return
+		}
+		rows = append(rows, r)
+		if len(rows)%q.args.BatchSize == 0 {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case r := <-q.ch:
+			add(r)
+		case <-ticker.C:
+			flush()
+		case <-q.closeNotify:
+			// Take records that are already buffered.
+			for len(q.ch) > 0 {
+				add(<-q.ch)
+			}
+			nextRetry = time.Time{}
+			flush()
+			if len(rows) > 0 {
+				q.logger.Warn("query records are lost", zap.Int("records", len(rows)))
+			}
+			if err := q.sink.Close(); err != nil {
+				q.logger.Warn("failed to close sink", zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+// Close inserts buffered records and closes the database. Records of
+// queries that are done after Close are dropped.
+func (q *QueryStats) Close() error {
+	q.closeOnce.Do(func() { close(q.closeNotify) })
+	<-q.closed
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_stats
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	qlog "github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type fakeSink struct {
+	mu     sync.Mutex
+	err    error
+	rows   []*qlog.Record
+	closed bool
+}
+
+func (s *fakeSink) insert(_ context.Context, rows []*qlog.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.rows = append(s.rows, rows...)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestQueryStats(t *testing.T) {
+	args := &Args{Driver: driverSqlite, File: "-", BatchSize: 2, BufferSize: 3}
+	if err := args.init(); err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSink{err: errors.New("db is down")}
+	q := newQueryStats(args, s, zap.NewNop())
+
+	for i := 0; i < 5; i++ {
+		qCtx := plugintest.NewQuery("example.com", dns.TypeA).Client("127.0.0.1").Build()
+		if err := plugintest.Exec(t, q, qCtx, plugintest.Rcode(dns.RcodeNameError)); err != nil {
+			t.Fatal(err)
+		}
+		// Waits the writer, so records are not dropped by the channel.
+		time.Sleep(time.Millisecond * 10)
+	}
+	s.mu.Lock()
+	s.err = nil
+	s.mu.Unlock()
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records that exceeded the buffer were dropped.
+	if len(s.rows) != 3 || !s.closed {
+		t.Fatalf("want 3 inserted rows and a closed sink, got %d, %v", len(s.rows), s.closed)
+	}
+	r := s.rows[0]
+	if r.QName != "example.com." || r.QType != "A" || r.Rcode != "NXDOMAIN" || r.Client != "127.0.0.1" {
+		t.Fatalf("unexpected row %+v", r)
+	}
+}
+
+// Exec may still be running when the plugin is closed.
+func TestQueryStats_CloseWhileExec(t *testing.T) {
+	args := &Args{Driver: driverSqlite, File: "-", BatchSize: 1, BufferSize: 1}
+	if err := args.init(); err != nil {
+		t.Fatal(err)
+	}
+	q := newQueryStats(args, new(fakeSink), zap.NewNop())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				qCtx := plugintest.NewQuery("example.com", dns.TypeA).Build()
+				if err := plugintest.Exec(t, q, qCtx); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+func TestSqliteSink(t *testing.T) {
+	s, err := newSqliteSink(filepath.Join(t.TempDir(), "stats.db"), "queries", time.Hour, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	rows := []*qlog.Record{
+		{Time: time.Now().Add(-time.Hour * 2), QName: "old.", QType: "A"},
+		{Time: time.Now(), QName: "example.com.", QType: "A", Rcode: "NOERROR", Rule: "||example.com^"},
+	}
+	if err := s.insert(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	var rule string
+	if err := s.db.QueryRow("SELECT count(*), max(rule) FROM queries").Scan(&n, &rule); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || rule != "||example.com^" {
+		t.Fatalf("want 1 row after purging, got %d, %q", n, rule)
+	}
+}
+
+func TestClickhouseSink(t *testing.T) {
+	var (
+		queries []string
+		body    []clickhouseRow
+		user    string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("query"))
+		user = r.Header.Get("X-ClickHouse-User")
+		s := bufio.NewScanner(r.Body)
+		for s.Scan() {
+			var cr clickhouseRow
+			if err := json.Unmarshal(s.Bytes(), &cr); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = append(body, cr)
+		}
+	}))
+	defer srv.Close()
+
+	s := newClickhouseSink(srv.URL, "db.queries", "default", "pw")
+	defer s.Close()
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	if err := s.insert(context.Background(), []*qlog.Record{{Time: ts, QName: "example.com.", LatencyMs: 1.5}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 || queries[0] != "INSERT INTO db.queries FORMAT JSONEachRow" || user != "default" {
+		t.Fatalf("unexpected request %v, %s", queries, user)
+	}
+	if len(body) != 1 || body[0].TS != "2024-01-02 03:04:05.006" || body[0].Latency != 1.5 {
+		t.Fatalf("unexpected body %+v", body)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_stats
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	qlog "github.com/IrineSistiana/mosdns/v5/pkg/query_log"
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSink writes rows to a local sqlite file.
+type sqliteSink struct {
+	db        *sql.DB
+	logger    *zap.Logger
+	table     string
+	retention time.Duration // 0 means keeping all rows
+	lastPurge time.Time
+}
+
+func newSqliteSink(file, table string, retention time.Duration, logger *zap.Logger) (*sqliteSink, error) {
+	db, err := sql.Open("sqlite", file+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	schema := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	ts INTEGER NOT NULL,
+	client TEXT NOT NULL,
+	qname TEXT NOT NULL,
+	qtype TEXT NOT NULL,
+	rcode TEXT NOT NULL,
+	upstream TEXT NOT NULL,
+	latency_ms REAL NOT NULL,
+	rule TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS %[1]s_ts ON %[1]s (ts);`, table)
+	if _, err := db.Exec(schema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create table, %w", err)
+	}
+	return &sqliteSink{db: db, logger: logger, table: table, retention: retention}, nil
+}
+
+// insert inserts rows in a transaction. ts is in unix milliseconds.
+// Old rows are purged after the rows are committed. A failed purge is
+// logged, it doesn't fail the insert.
+func (s *sqliteSink) insert(ctx context.Context, rows []*qlog.Record) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (ts, client, qname, qtype, rcode, upstream, latency_ms, rule) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", s.table))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range rows {
+		if _, err := stmt.ExecContext(ctx, r.Time.UnixMilli(), r.Client, r.QName, r.QType, r.Rcode, r.Upstream, r.LatencyMs, r.Rule); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := s.purge(ctx); err != nil {
+		s.logger.Warn("failed to purge old query records", zap.Error(err))
+	}
+	return nil
+}
+
+// purge deletes rows that are older than the retention, at most once
+// an hour.
+func (s *sqliteSink) purge(ctx context.Context) error {
+	if s.retention <= 0 || time.Since(s.lastPurge) < time.Hour {
+		return nil
+	}
+	s.lastPurge = time.Now()
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE ts < ?", s.table), time.Now().Add(-s.retention).UnixMilli())
+	return err
+}
+
+func (s *sqliteSink) Close() error {
+	return s.db.Close()
+}
@@ -30,6 +30,8 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/pkg/rate_limiter"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/time/rate"
 )
 
@@ -39,37 +41,76 @@ func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
 }
 
+// Args configures token buckets of clients. Client addresses are masked
+// by Mask4 and Mask6 first, so a bucket can be shared by a network.
+// If SubnetQps is set, networks of SubnetMask4 and SubnetMask6 have
+// their own buckets, which limit the sum of queries of all clients in them.
+//
+// Used as a matcher, it matches queries that are allowed.
+// Used as an executable, queries over the limits are answered by
+// Action and do not go to the rest of the sequence.
 type Args struct {
 	Qps   float64 `yaml:"qps"`
 	Burst int     `yaml:"burst"`
 	Mask4 int     `yaml:"mask4"`
 	Mask6 int     `yaml:"mask6"`
+
+	SubnetQps   float64 `yaml:"subnet_qps"`   // 0 disables subnet buckets.
+	SubnetBurst int     `yaml:"subnet_burst"` // default is 2 * subnet_qps.
+	SubnetMask4 int     `yaml:"subnet_mask4"` // default 24
+	SubnetMask6 int     `yaml:"subnet_mask6"` // default 48
+
+	// Action is "refuse" (default), which responds REFUSED, or "drop",
+	// which sends no response.
+	Action string `yaml:"action"`
 }
 
+const (
+	actionRefuse = "refuse"
+	actionDrop   = "drop"
+)
+
 func (args *Args) init() error {
 	utils.SetDefaultUnsignNum(&args.Qps, 20)
 	utils.SetDefaultUnsignNum(&args.Burst, 40)
 	utils.SetDefaultUnsignNum(&args.Mask4, 32)
 	utils.SetDefaultUnsignNum(&args.Mask6, 48)
+	utils.SetDefaultUnsignNum(&args.SubnetBurst, max(1, int(args.SubnetQps*2)))
+	utils.SetDefaultUnsignNum(&args.SubnetMask4, 24)
+	utils.SetDefaultUnsignNum(&args.SubnetMask6, 48)
+	utils.SetDefaultString(&args.Action, actionRefuse)
 
-	if !utils.CheckNumRange(args.Mask4, 0, 32) {
+	if !utils.CheckNumRange(args.Mask4, 0, 32) || !utils.CheckNumRange(args.SubnetMask4, 0, 32) {
 		return fmt.Errorf("invalid mask4")
 	}
-	if !utils.CheckNumRange(args.Mask6, 0, 128) {
+	if !utils.CheckNumRange(args.Mask6, 0, 128) || !utils.CheckNumRange(args.SubnetMask6, 0, 128) {
 		return fmt.Errorf("invalid mask6")
 	}
+	if args.SubnetQps < 0 {
+		return fmt.Errorf("invalid subnet_qps")
+	}
+	switch args.Action {
+	case actionRefuse, actionDrop:
+	default:
+		return fmt.Errorf("invalid action %s", args.Action)
+	}
 	return nil
 }
 
 var _ sequence.Matcher = (*RateLimiter)(nil)
+var _ sequence.RecursiveExecutable = (*RateLimiter)(nil)
 var _ io.Closer = (*RateLimiter)(nil)
+var _ coremain.MetricsProvider = (*RateLimiter)(nil)
 
 type RateLimiter struct {
-	args Args
-	l    *rate_limiter.Limiter
+	args   Args
+	l      *rate_limiter.Limiter
+	subnet *rate_limiter.Limiter // nil if subnet buckets are disabled
+
+	limitedTotal prometheus.Counter
 }
 
-func Init(_ *coremain.BP, args any) (any, error) {
+func Init(bp *coremain.BP, args any) (any, error) {
 	return New(*(args.(*Args)))
 }
 
@@ -78,33 +119,75 @@ func New(args Args) (*RateLimiter, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid args, %w", err)
 	}
-	l := rate_limiter.NewRateLimiter(rate.Limit(args.Qps), args.Burst)
-	return &RateLimiter{l: l, args: args}, nil
+	l := &RateLimiter{
+		l:    rate_limiter.NewRateLimiter(rate.Limit(args.Qps), args.Burst),
+		args: args,
+		limitedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "limited_total",
+			Help: "The total number of queries over the rate limits",
+		}),
+	}
+	if args.SubnetQps > 0 {
+		l.subnet = rate_limiter.NewRateLimiter(rate.Limit(args.SubnetQps), args.SubnetBurst)
+	}
+	return l, nil
+}
+
+// Metrics implements coremain.MetricsProvider.
+func (s *RateLimiter) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{s.limitedTotal}
 }
 
 func (s *RateLimiter) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
-	addr := s.getMaskedClientAddr(qCtx)
-	if addr.IsValid() {
-		return s.l.Allow(addr), nil
+	return s.allow(qCtx), nil
+}
+
+func (s *RateLimiter) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	if s.allow(qCtx) {
+		return next.ExecNext(ctx, qCtx)
 	}
-	return true, nil
+	if s.args.Action == actionDrop {
+		qCtx.DropResponse()
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetRcode(qCtx.Q(), dns.RcodeRefused)
+	qCtx.SetResponse(r)
+	return nil
 }
 
-func (s *RateLimiter) getMaskedClientAddr(qCtx *query_context.Context) netip.Addr {
+// allow reports whether the query is within the limits. Queries without
+// a client address are always allowed.
+func (s *RateLimiter) allow(qCtx *query_context.Context) bool {
 	a := qCtx.ServerMeta.ClientAddr
 	if !a.IsValid() {
-		return netip.Addr{}
+		return true
 	}
 	a = a.Unmap()
+	ok := s.l.Allow(maskAddr(a, s.args.Mask4, s.args.Mask6))
+	if ok && s.subnet != nil {
+		ok = s.subnet.Allow(maskAddr(a, s.args.SubnetMask4, s.args.SubnetMask6))
+	}
+	if !ok {
+		s.limitedTotal.Inc()
+	}
+	return ok
+}
+
+// maskAddr returns the network address of unmapped address a.
+func maskAddr(a netip.Addr, mask4, mask6 int) netip.Addr {
 	var p netip.Prefix
 	if a.Is4() {
-		p, _ = a.Prefix(s.args.Mask4)
+		p, _ = a.Prefix(mask4)
 	} else {
-		p, _ = a.Prefix(s.args.Mask6)
+		p, _ = a.Prefix(mask6)
 	}
 	return p.Addr()
 }
 
 func (s *RateLimiter) Close() error {
+	if s.subnet != nil {
+		s.subnet.Close()
+	}
 	return s.l.Close()
 }
@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rate_limiter
+
+import (
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l, err := New(Args{Qps: 0.001, Burst: 2, SubnetQps: 0.001, SubnetBurst: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	exec := func(client string) int {
+		t.Helper()
+		qCtx := plugintest.NewQuery("example.com", dns.TypeA).Client(client).Build()
+		if err := plugintest.Exec(t, l, qCtx, plugintest.Rcode(dns.RcodeSuccess)); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R().Rcode
+	}
+
+	// Per client limit.
+	for i, want := range []int{dns.RcodeSuccess, dns.RcodeSuccess, dns.RcodeRefused} {
+		if rc := exec("192.0.2.1"); rc != want {
+			t.Fatalf("query #%d: want %s, got %s", i, dns.RcodeToString[want], dns.RcodeToString[rc])
+		}
+	}
+	// Subnet limit. 192.0.2.1 used 2 of 3 tokens.
+	if rc := exec("192.0.2.2"); rc != dns.RcodeSuccess {
+		t.Fatalf("want NOERROR, got %s", dns.RcodeToString[rc])
+	}
+	if rc := exec("192.0.2.3"); rc != dns.RcodeRefused {
+		t.Fatalf("subnet limit: want REFUSED, got %s", dns.RcodeToString[rc])
+	}
+	// Other subnets are not affected.
+	if rc := exec("198.51.100.1"); rc != dns.RcodeSuccess {
+		t.Fatalf("want NOERROR, got %s", dns.RcodeToString[rc])
+	}
+}
+
+func TestRateLimiter_Drop(t *testing.T) {
+	l, err := New(Args{Qps: 0.001, Burst: 1, Action: "drop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 2; i++ {
+		qCtx := plugintest.NewQuery("example.com", dns.TypeA).Client("2001:db8::1").Build()
+		if err := plugintest.Exec(t, l, qCtx, plugintest.Rcode(dns.RcodeSuccess)); err != nil {
+			t.Fatal(err)
+		}
+		if dropped := qCtx.ResponseDropped(); dropped != (i == 1) {
+			t.Fatalf("query #%d: dropped = %v", i, dropped)
+		}
+	}
+
+	if _, err := New(Args{Action: "reject"}); err == nil {
+		t.Fatal("invalid action should fail")
+	}
+}
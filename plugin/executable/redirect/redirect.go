@@ -23,7 +23,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"os"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
 	"strings"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -52,7 +52,7 @@ type Redirect struct {
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	r, err := NewRedirect(args.(*Args))
+	r, err := NewRedirect(args.(*Args), bp.M().Storages())
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +60,7 @@ func Init(bp *coremain.BP, args any) (any, error) {
 	return r, nil
 }
 
-func NewRedirect(args *Args) (*Redirect, error) {
+func NewRedirect(args *Args, ss remote.Storages) (*Redirect, error) {
 	parseFunc := func(s string) (p, v string, err error) {
 		f := strings.Fields(s)
 		if len(f) != 2 {
@@ -76,7 +76,7 @@ func NewRedirect(args *Args) (*Redirect, error) {
 		}
 	}
 	for i, file := range args.Files {
-		b, err := os.ReadFile(file)
+		b, err := ss.ReadFile(file)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read file #%d %s, %w", i, file, err)
 		}
@@ -0,0 +1,259 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Policy actions. Actions of a trigger are given by a CNAME record of
+// its owner name, or its local data records.
+const (
+	actionNXDomain = "nxdomain" // CNAME .
+	actionNoData   = "nodata"   // CNAME *.
+	actionPassthru = "passthru" // CNAME rpz-passthru.
+	actionDrop     = "drop"     // CNAME rpz-drop.
+	actionTCPOnly  = "tcp-only" // CNAME rpz-tcp-only.
+	actionLocal    = "local"    // other records
+)
+
+// Trigger suffixes. Names of qname triggers have no special suffix.
+const (
+	suffixClientIP = ".rpz-client-ip"
+	suffixIP       = ".rpz-ip"
+	suffixNSDName  = ".rpz-nsdname"
+	suffixNSIP     = ".rpz-nsip"
+)
+
+// rule is the policy of a trigger.
+type rule struct {
+	trigger string // owner name of the trigger without the zone origin
+	action  string
+	ttl     uint32
+	rrs     []dns.RR // local data of actionLocal
+}
+
+func newRule(trigger string, rrs []dns.RR) *rule {
+	r := &rule{trigger: trigger, action: actionLocal, ttl: rrs[0].Header().Ttl}
+	for _, rr := range rrs {
+		c, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(c.Target) {
+		case ".":
+			r.action = actionNXDomain
+		case "*.":
+			r.action = actionNoData
+		case "rpz-passthru.":
+			r.action = actionPassthru
+		case "rpz-drop.":
+			r.action = actionDrop
+		case "rpz-tcp-only.":
+			r.action = actionTCPOnly
+		default:
+			continue
+		}
+		r.ttl = c.Hdr.Ttl
+		return r
+	}
+	r.rrs = rrs
+	return r
+}
+
+// policies are the triggers of an RPZ zone.
+type policies struct {
+	qname    map[string]*rule // fqdn
+	wildcard map[string]*rule // "*.example.com." is stored as "example.com."
+	clientIP ipRules
+	respIP   ipRules
+
+	triggers int
+	skipped  int // unsupported or invalid triggers
+}
+
+// newPolicies builds policies from records rrs of zone origin. Records of
+// the zone apex, e.g. SOA and NS, are ignored. Triggers that are not
+// supported, rpz-nsdname and rpz-nsip, are skipped.
+func newPolicies(origin string, rrs []dns.RR) *policies {
+	p := &policies{
+		qname:    make(map[string]*rule),
+		wildcard: make(map[string]*rule),
+	}
+	owners := make(map[string][]dns.RR)
+	var order []string
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if _, ok := owners[name]; !ok {
+			order = append(order, name)
+		}
+		owners[name] = append(owners[name], rr)
+	}
+
+	for _, owner := range order {
+		if owner == origin {
+			continue
+		}
+		if !dns.IsSubDomain(origin, owner) {
+			p.skipped++
+			continue
+		}
+		trigger := strings.TrimSuffix(owner, "."+origin)
+		r := newRule(trigger, owners[owner])
+		var err error
+		switch {
+		case strings.HasSuffix(trigger, suffixClientIP):
+			err = p.clientIP.add(strings.TrimSuffix(trigger, suffixClientIP), r)
+		case strings.HasSuffix(trigger, suffixIP):
+			err = p.respIP.add(strings.TrimSuffix(trigger, suffixIP), r)
+		case strings.HasSuffix(trigger, suffixNSDName), strings.HasSuffix(trigger, suffixNSIP):
+			err = errors.New("unsupported trigger")
+		case strings.HasPrefix(trigger, "*."):
+			p.wildcard[trigger[2:]+"."] = r
+		default:
+			p.qname[trigger+"."] = r
+		}
+		if err != nil {
+			p.skipped++
+			continue
+		}
+		p.triggers++
+	}
+	p.clientIP.sortBits()
+	p.respIP.sortBits()
+	return p
+}
+
+// matchQName returns the rule of qname trigger of name, which must be a
+// lower case fqdn. An exact trigger beats wildcards, and a longer
+// wildcard beats shorter ones.
+func (p *policies) matchQName(name string) *rule {
+	if r := p.qname[name]; r != nil {
+		return r
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if r := p.wildcard[name[off:]]; r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// ipRules are rules of ip triggers. The longest prefix wins.
+type ipRules struct {
+	m    map[netip.Prefix]*rule
+	bits []int // prefix lengths in m, descending
+}
+
+// add adds an ip trigger, e.g. "24.0.2.0.192" or "48.zz.db8.2001", without
+// the trigger suffix.
+func (l *ipRules) add(s string, r *rule) error {
+	p, err := parseIPTrigger(s)
+	if err != nil {
+		return err
+	}
+	if l.m == nil {
+		l.m = make(map[netip.Prefix]*rule)
+	}
+	if _, ok := l.m[p]; !ok {
+		l.bits = append(l.bits, p.Bits())
+	}
+	l.m[p] = r
+	return nil
+}
+
+func (l *ipRules) sortBits() {
+	sort.Sort(sort.Reverse(sort.IntSlice(l.bits)))
+	n := 0
+	for i, b := range l.bits {
+		if i == 0 || b != l.bits[n-1] {
+			l.bits[n] = b
+			n++
+		}
+	}
+	l.bits = l.bits[:n]
+}
+
+func (l *ipRules) match(addr netip.Addr) *rule {
+	if len(l.m) == 0 {
+		return nil
+	}
+	addr = addr.Unmap()
+	for _, b := range l.bits {
+		p, err := addr.Prefix(b)
+		if err != nil { // longer than the address
+			continue
+		}
+		if r := l.m[p]; r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// parseIPTrigger parses the prefix length and the reversed address of an
+// ip trigger. IPv6 addresses are in 16 bit groups and "zz" is "::".
+func parseIPTrigger(s string) (netip.Prefix, error) {
+	labels := strings.Split(s, ".")
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix length %s", labels[0])
+	}
+	labels = labels[1:]
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	addr, err := netip.ParseAddr(strings.Join(labels, "."))
+	if err != nil || !addr.Is4() {
+		for i, g := range labels {
+			if g == "zz" {
+				labels[i] = ""
+			}
+		}
+		// Make "::" of the empty group if it's the first or the last one.
+		v6 := strings.Join(labels, ":")
+		if strings.HasPrefix(v6, ":") || len(v6) == 0 {
+			v6 = ":" + v6
+		}
+		if strings.HasSuffix(v6, ":") {
+			v6 += ":"
+		}
+		addr, err = netip.ParseAddr(v6)
+	}
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %s, %w", s, err)
+	}
+	p, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if p.Addr() != addr {
+		return netip.Prefix{}, fmt.Errorf("%s has host bits", s)
+	}
+	return p, nil
+}
@@ -0,0 +1,562 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const PluginType = "rpz"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+// Zone policies. A zone policy can also be one of actionNXDomain,
+// actionNoData, actionPassthru and actionDrop, which overrides the actions
+// of all triggers of the zone.
+const (
+	policyGiven    = "given"    // actions of triggers
+	policyDisabled = "disabled" // matches are only logged and counted
+)
+
+// Args configures Response Policy Zones. Zones are checked in order. The
+// first zone that has a matched trigger decides the response. Client ip
+// (rpz-client-ip) and qname triggers are checked before the rest of the
+// sequence, response ip triggers (rpz-ip) are checked on its response.
+// rpz-nsdname and rpz-nsip triggers are not supported.
+type Args struct {
+	Zones []ZoneArgs `yaml:"zones"`
+}
+
+// ZoneArgs is an RPZ zone. It's loaded from File, or transferred from
+// Primary.
+type ZoneArgs struct {
+	// Name is the zone origin. Required if Primary is set. Default is the
+	// owner of the SOA record in File.
+	Name string `yaml:"name"`
+	// File is a zone file. It's loaded again by ReloadData.
+	File string `yaml:"file"`
+
+	// Primary is the address ("host:port", default port is 53) of the
+	// feed server. The zone is transferred by IXFR, or AXFR if IXFR
+	// fails, when the serial of the primary changes.
+	Primary string   `yaml:"primary"`
+	Key     *KeyArgs `yaml:"key"`     // TSIG key of transfers.
+	Refresh int      `yaml:"refresh"` // (seconds) check interval, default is the SOA refresh, at least 60.
+	Timeout int      `yaml:"timeout"` // (seconds) default is 30.
+	// CacheFile keeps the last transferred zone. It is loaded at startup
+	// so that the zone is available before the first transfer.
+	CacheFile string `yaml:"cache_file"`
+
+	// Policy is "given" (default), "disabled", or an action that
+	// overrides actions of the zone, "nxdomain", "nodata", "passthru" or
+	// "drop".
+	Policy string `yaml:"policy"`
+}
+
+// KeyArgs is a TSIG key.
+type KeyArgs struct {
+	Name      string `yaml:"name"`
+	Secret    string `yaml:"secret"`    // base64
+	Algorithm string `yaml:"algorithm"` // Default is "hmac-sha256".
+}
+
+func (a *Args) init() error {
+	if len(a.Zones) == 0 {
+		return errors.New("no zone is configured")
+	}
+	for i := range a.Zones {
+		if err := a.Zones[i].init(); err != nil {
+			return fmt.Errorf("invalid zone #%d, %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (a *ZoneArgs) init() error {
+	switch {
+	case len(a.File) > 0 && len(a.Primary) > 0:
+		return errors.New("file and primary are both set")
+	case len(a.File) == 0 && len(a.Primary) == 0:
+		return errors.New("file or primary is required")
+	case len(a.Primary) > 0 && len(a.Name) == 0:
+		return errors.New("name is required by primary")
+	}
+	if len(a.Name) > 0 {
+		if _, ok := dns.IsDomainName(a.Name); !ok {
+			return fmt.Errorf("invalid name %s", a.Name)
+		}
+	}
+	if len(a.Primary) > 0 {
+		a.Primary = hostPort(a.Primary)
+	}
+	if k := a.Key; k != nil {
+		if len(k.Name) == 0 {
+			return errors.New("key has no name")
+		}
+		if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil || len(k.Secret) == 0 {
+			return fmt.Errorf("key %s has an invalid base64 secret", k.Name)
+		}
+		k.Name = strings.ToLower(dns.Fqdn(k.Name))
+		utils.SetDefaultString(&k.Algorithm, dns.HmacSHA256)
+		k.Algorithm = strings.ToLower(dns.Fqdn(k.Algorithm))
+		switch k.Algorithm {
+		case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		default:
+			return fmt.Errorf("key %s has an unsupported algorithm %s", k.Name, k.Algorithm)
+		}
+	}
+	utils.SetDefaultNum(&a.Timeout, 30)
+	utils.SetDefaultString(&a.Policy, policyGiven)
+	switch a.Policy {
+	case policyGiven, policyDisabled, actionNXDomain, actionNoData, actionPassthru, actionDrop:
+	default:
+		return fmt.Errorf("unknown policy %s", a.Policy)
+	}
+	return nil
+}
+
+var _ sequence.RecursiveExecutable = (*RPZ)(nil)
+var _ coremain.DataReloader = (*RPZ)(nil)
+var _ coremain.MetricsProvider = (*RPZ)(nil)
+
+type RPZ struct {
+	args   *Args
+	logger *zap.Logger
+	zones  []*zone
+
+	hitsTotal *prometheus.CounterVec
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	r, err := NewRPZ(args.(*Args), bp.L(), bp.M().Storages())
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(r.Api())
+	r.start()
+	return r, nil
+}
+
+// NewRPZ loads all zones. Transferred zones are loaded from their cache
+// files, or are empty if there is no cache, so a slow or unreachable
+// primary doesn't block the startup. They are transferred by start.
+func NewRPZ(args *Args, logger *zap.Logger, ss remote.Storages) (*RPZ, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	r := &RPZ{
+		args:   args,
+		logger: logger,
+		hitsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hits_total",
+			Help: "The total number of queries that matched triggers",
+		}, []string{"zone", "action"}),
+		closeNotify: make(chan struct{}),
+	}
+	for i := range args.Zones {
+		z := newZone(&args.Zones[i], logger, ss)
+		if len(z.args.CacheFile) > 0 {
+			if err := z.loadCache(); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logger.Warn("failed to load cache file", zap.String("file", z.args.CacheFile), zap.Error(err))
+			}
+		}
+		switch {
+		case z.data.Load() != nil:
+		case len(z.args.Primary) > 0:
+			z.data.Store(newZoneData(z.origin, nil))
+		default:
+			if _, err := z.update(); err != nil {
+				return nil, fmt.Errorf("failed to load zone %s, %w", z.name(), err)
+			}
+		}
+		r.zones = append(r.zones, z)
+	}
+	return r, nil
+}
+
+// start starts refreshing transferred zones in the background. They are
+// refreshed immediately, then every refresh interval.
+func (r *RPZ) start() {
+	for _, z := range r.zones {
+		if len(z.args.Primary) > 0 {
+			go r.refreshLoop(z)
+		}
+	}
+}
+
+func (r *RPZ) refreshLoop(z *zone) {
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			err := r.updateAndLog(z)
+			t.Reset(z.refreshInterval(err != nil))
+		case <-r.closeNotify:
+			return
+		}
+	}
+}
+
+func (r *RPZ) updateAndLog(z *zone) error {
+	updated, err := z.update()
+	if err != nil {
+		r.logger.Warn("failed to update zone", zap.String("zone", z.name()), zap.Error(err))
+		return err
+	}
+	if updated {
+		d := z.data.Load()
+		r.logger.Info("zone updated", zap.String("zone", z.name()), zap.Int("triggers", d.p.triggers), zap.Int("skipped", d.p.skipped))
+	}
+	return nil
+}
+
+// ReloadData loads zone files again and checks transferred zones now.
+// Zones that failed keep their old data.
+func (r *RPZ) ReloadData() error {
+	var errs []error
+	for _, z := range r.zones {
+		if err := r.updateAndLog(z); err != nil {
+			errs = append(errs, fmt.Errorf("zone %s, %w", z.name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *RPZ) Close() error {
+	r.closeOnce.Do(func() { close(r.closeNotify) })
+	return nil
+}
+
+// Metrics implements coremain.MetricsProvider.
+func (r *RPZ) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{r.hitsTotal}
+}
+
+func (r *RPZ) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return next.ExecNext(ctx, qCtx)
+	}
+	qname := strings.ToLower(q.Question[0].Name)
+	client := qCtx.ServerMeta.ClientAddr
+	for _, z := range r.zones {
+		d := z.data.Load()
+		var ru *rule
+		if client.IsValid() {
+			ru = d.p.clientIP.match(client)
+		}
+		if ru == nil {
+			ru = d.p.matchQName(qname)
+		}
+		if ru != nil && r.hit(qCtx, z, ru) {
+			return r.apply(ctx, qCtx, next, z, ru)
+		}
+	}
+
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	resp := qCtx.R()
+	if resp == nil {
+		return nil
+	}
+	for _, z := range r.zones {
+		d := z.data.Load()
+		if len(d.p.respIP.m) == 0 {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			var addr netip.Addr
+			switch rr := rr.(type) {
+			case *dns.A:
+				addr, _ = netip.AddrFromSlice(rr.A.To4())
+			case *dns.AAAA:
+				addr, _ = netip.AddrFromSlice(rr.AAAA)
+			default:
+				continue
+			}
+			if ru := d.p.respIP.match(addr); ru != nil && r.hit(qCtx, z, ru) {
+				r.applyResolved(qCtx, z, ru)
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// action returns the action of rule ru of zone z.
+func action(z *zone, ru *rule) string {
+	if z.args.Policy != policyGiven {
+		return z.args.Policy
+	}
+	return ru.action
+}
+
+// hit records a match of rule ru of zone z. It reports whether the rule
+// should be applied.
+func (r *RPZ) hit(qCtx *query_context.Context, z *zone, ru *rule) bool {
+	a := action(z, ru)
+	r.hitsTotal.WithLabelValues(z.name(), a).Inc()
+	switch a {
+	case policyDisabled:
+		r.logger.Debug("disabled rpz trigger matched", qCtx.InfoField(), zap.String("zone", z.name()), zap.String("trigger", ru.trigger))
+		return false
+	case actionPassthru:
+		// Allowed queries are not blocked, so they have no rule.
+		return true
+	}
+	qCtx.StoreValue(query_context.KeyRule, "rpz "+z.name()+" "+ru.trigger)
+	return true
+}
+
+// apply applies rule ru of qname or client ip triggers.
+func (r *RPZ) apply(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker, z *zone, ru *rule) error {
+	q := qCtx.Q()
+	switch a := action(z, ru); a {
+	case actionPassthru:
+		return next.ExecNext(ctx, qCtx)
+	case actionDrop:
+		qCtx.DropResponse()
+	case actionTCPOnly:
+		if !qCtx.ServerMeta.FromUDP {
+			return next.ExecNext(ctx, qCtx)
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.Truncated = true
+		qCtx.SetResponse(resp)
+	case actionNXDomain, actionNoData:
+		qCtx.SetResponse(blockResp(q, a, ru.ttl))
+	case actionLocal:
+		if c := cname(ru); c != nil && q.Question[0].Qtype != dns.TypeCNAME {
+			return r.rewrite(ctx, qCtx, next, c)
+		}
+		qCtx.SetResponse(localResp(q, ru))
+	}
+	return nil
+}
+
+// applyResolved applies rule ru of response ip triggers. CNAMEs of local
+// data are not followed.
+func (r *RPZ) applyResolved(qCtx *query_context.Context, z *zone, ru *rule) {
+	q := qCtx.Q()
+	switch a := action(z, ru); a {
+	case actionDrop:
+		qCtx.DropResponse()
+	case actionTCPOnly:
+		if qCtx.ServerMeta.FromUDP {
+			resp := new(dns.Msg)
+			resp.SetReply(q)
+			resp.Truncated = true
+			qCtx.SetResponse(resp)
+		}
+	case actionNXDomain, actionNoData:
+		qCtx.SetResponse(blockResp(q, a, ru.ttl))
+	case actionLocal:
+		qCtx.SetResponse(localResp(q, ru))
+	}
+}
+
+// rewrite answers the query with CNAME c, which is local data of a
+// trigger, and the response of its target from the rest of the sequence.
+func (r *RPZ) rewrite(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker, c *dns.CNAME) error {
+	q := qCtx.Q()
+	orgQName := q.Question[0].Name
+	target := cnameTarget(c, orgQName)
+	q.Question[0].Name = target
+	defer func() {
+		q.Question[0].Name = orgQName
+	}()
+	err := next.ExecNext(ctx, qCtx)
+	if resp := qCtx.R(); resp != nil {
+		for i := range resp.Question {
+			if resp.Question[i].Name == target {
+				resp.Question[i].Name = orgQName
+			}
+		}
+		c := &dns.CNAME{Hdr: c.Hdr, Target: target}
+		c.Hdr.Name = orgQName
+		resp.Answer = append([]dns.RR{c}, resp.Answer...)
+	}
+	return err
+}
+
+// cname returns the CNAME of local data of ru, or nil if there is none.
+func cname(ru *rule) *dns.CNAME {
+	for _, rr := range ru.rrs {
+		if c, ok := rr.(*dns.CNAME); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// cnameTarget returns the target of c for query name qname. A target
+// "*.example." is qname + "example.".
+func cnameTarget(c *dns.CNAME, qname string) string {
+	if strings.HasPrefix(c.Target, "*.") {
+		return qname + c.Target[2:]
+	}
+	return c.Target
+}
+
+func blockResp(q *dns.Msg, a string, ttl uint32) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	if a == actionNXDomain {
+		resp.Rcode = dns.RcodeNameError
+	}
+	soa := dnsutils.FakeSOA(q.Question[0].Name)
+	soa.Hdr.Ttl = ttl
+	soa.Minttl = ttl
+	resp.Ns = []dns.RR{soa}
+	return resp
+}
+
+// localResp answers q with local data of ru. Owners of the records are
+// replaced by the query name. It's NODATA if there is no record of the
+// query type.
+func localResp(q *dns.Msg, ru *rule) *dns.Msg {
+	question := q.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	for _, rr := range ru.rrs {
+		t := rr.Header().Rrtype
+		if c, ok := rr.(*dns.CNAME); ok {
+			c := &dns.CNAME{Hdr: c.Hdr, Target: cnameTarget(c, question.Name)}
+			c.Hdr.Name = question.Name
+			resp.Answer = []dns.RR{c}
+			return resp
+		}
+		if t == question.Qtype || question.Qtype == dns.TypeANY {
+			rr = dns.Copy(rr)
+			rr.Header().Name = question.Name
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if len(resp.Answer) == 0 {
+		return blockResp(q, actionNoData, ru.ttl)
+	}
+	return resp
+}
+
+// ZoneStatus is the status of a zone.
+type ZoneStatus struct {
+	Zone       string    `json:"zone"`
+	Serial     uint32    `json:"serial"`
+	Triggers   int       `json:"triggers"`
+	Skipped    int       `json:"skipped"`
+	LastUpdate time.Time `json:"last_update"`
+	LastError  string    `json:"last_error,omitempty"`
+	Errors     uint64    `json:"errors"`
+}
+
+func (z *zone) status() ZoneStatus {
+	d := z.data.Load()
+	s := ZoneStatus{Zone: z.name(), Triggers: d.p.triggers, Skipped: d.p.skipped, Errors: z.errTotal.Load()}
+	if d.soa != nil {
+		s.Serial = d.soa.Serial
+	}
+	z.statusMu.Lock()
+	s.LastUpdate = z.lastUpdate
+	s.LastError = z.lastError
+	z.statusMu.Unlock()
+	return s
+}
+
+// CheckResult is the result of the check api.
+type CheckResult struct {
+	Name    string `json:"name"`
+	Zone    string `json:"zone,omitempty"`
+	Trigger string `json:"trigger,omitempty"`
+	Action  string `json:"action,omitempty"`
+}
+
+// Api serves "/check?name=example.com" which tells the first qname trigger
+// that matches a name, "/status" and "POST /update" which reloads and
+// transfers zones now.
+func (r *RPZ) Api() *chi.Mux {
+	m := chi.NewRouter()
+	m.Get("/check", func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("name")
+		if len(name) == 0 {
+			http.Error(w, "missing name", http.StatusBadRequest)
+			return
+		}
+		res := CheckResult{Name: name}
+		for _, z := range r.zones {
+			if ru := z.data.Load().p.matchQName(strings.ToLower(dns.Fqdn(name))); ru != nil {
+				res.Zone, res.Trigger, res.Action = z.name(), ru.trigger, action(z, ru)
+				break
+			}
+		}
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+	status := func(w http.ResponseWriter) {
+		s := make([]ZoneStatus, 0, len(r.zones))
+		for _, z := range r.zones {
+			s = append(s, z.status())
+		}
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(s)
+	}
+	m.Get("/status", func(w http.ResponseWriter, req *http.Request) {
+		status(w)
+	})
+	m.Post("/update", func(w http.ResponseWriter, req *http.Request) {
+		if err := r.ReloadData(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		status(w)
+	})
+	return m
+}
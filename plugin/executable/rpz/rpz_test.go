@@ -0,0 +1,384 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+const testZone = `$ORIGIN rpz.test.
+$TTL 300
+@ SOA ns.rpz.test. admin.rpz.test. 1 3600 600 86400 300
+@ NS ns.rpz.test.
+nx.example CNAME .
+*.nx.example CNAME .
+ok.nx.example CNAME rpz-passthru.
+nodata.example CNAME *.
+drop.example CNAME rpz-drop.
+tcp.example CNAME rpz-tcp-only.
+local.example A 10.0.0.1
+local.example TXT "blocked"
+*.wild.example A 10.0.0.2
+garden.example CNAME walled.garden.
+*.sub.example CNAME *.garden.
+32.1.0.0.10.rpz-client-ip CNAME .
+24.0.2.0.192.rpz-ip CNAME .
+ns.example.rpz-nsdname CNAME .
+`
+
+func writeZone(t *testing.T, s string) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "rpz.zone")
+	if err := os.WriteFile(f, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestRPZ_Exec(t *testing.T) {
+	r, err := NewRPZ(&Args{Zones: []ZoneArgs{{File: writeZone(t, testZone)}}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if p := r.zones[0].data.Load().p; p.triggers != 12 || p.skipped != 1 {
+		t.Fatalf("want 12 triggers and 1 skipped, got %d and %d", p.triggers, p.skipped)
+	}
+
+	upstream := plugintest.Answer("@ 60 IN A 1.1.1.1")
+	tests := []struct {
+		name   string
+		qtype  uint16
+		client string
+		udp    bool
+		rcode  int
+		answer string // the first answer, empty if no answer
+		drop   bool
+		tc     bool
+	}{
+		{name: "nx.example.", rcode: dns.RcodeNameError},
+		{name: "a.NX.example.", rcode: dns.RcodeNameError},
+		{name: "ok.nx.example.", answer: "ok.nx.example.\t60\tIN\tA\t1.1.1.1"},
+		{name: "nodata.example."},
+		{name: "drop.example.", drop: true},
+		{name: "tcp.example.", udp: true, tc: true},
+		{name: "tcp.example.", answer: "tcp.example.\t60\tIN\tA\t1.1.1.1"},
+		{name: "local.example.", answer: "local.example.\t300\tIN\tA\t10.0.0.1"},
+		{name: "local.example.", qtype: dns.TypeAAAA},
+		{name: "local.example.", qtype: dns.TypeTXT, answer: "local.example.\t300\tIN\tTXT\t\"blocked\""},
+		{name: "a.wild.example.", answer: "a.wild.example.\t300\tIN\tA\t10.0.0.2"},
+		{name: "wild.example.", answer: "wild.example.\t60\tIN\tA\t1.1.1.1"},
+		{name: "example.com.", client: "10.0.0.1", rcode: dns.RcodeNameError},
+		{name: "example.com.", client: "10.0.0.2", answer: "example.com.\t60\tIN\tA\t1.1.1.1"},
+		{name: "ns.example.", answer: "ns.example.\t60\tIN\tA\t1.1.1.1"},
+	}
+	for _, tt := range tests {
+		if tt.qtype == 0 {
+			tt.qtype = dns.TypeA
+		}
+		b := plugintest.NewQuery(tt.name, tt.qtype)
+		if len(tt.client) > 0 {
+			b.Client(tt.client)
+		}
+		if tt.udp {
+			b.UDP()
+		}
+		qCtx := b.Build()
+		if err := plugintest.Exec(t, r, qCtx, upstream); err != nil {
+			t.Fatal(err)
+		}
+		if tt.drop {
+			if !qCtx.ResponseDropped() {
+				t.Errorf("%s: response was not dropped", tt.name)
+			}
+			continue
+		}
+		resp := qCtx.R()
+		if resp == nil {
+			t.Errorf("%s: no response", tt.name)
+			continue
+		}
+		if resp.Truncated != tt.tc {
+			t.Errorf("%s: want tc %v", tt.name, tt.tc)
+		}
+		if resp.Rcode != tt.rcode {
+			t.Errorf("%s: want rcode %d, got %d", tt.name, tt.rcode, resp.Rcode)
+		}
+		var answer string
+		if len(resp.Answer) > 0 {
+			answer = resp.Answer[0].String()
+		}
+		if answer != tt.answer {
+			t.Errorf("%s: want answer %q, got %q", tt.name, tt.answer, answer)
+		}
+	}
+
+	// Only blocked queries have a rule.
+	for name, want := range map[string]bool{"nx.example.": true, "ok.nx.example.": false} {
+		qCtx := plugintest.NewQuery(name, dns.TypeA).Build()
+		if err := plugintest.Exec(t, r, qCtx, upstream); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := qCtx.GetValue(query_context.KeyRule); ok != want {
+			t.Errorf("%s: want rule %v", name, want)
+		}
+	}
+}
+
+func TestRPZ_Rewrite(t *testing.T) {
+	r, err := NewRPZ(&Args{Zones: []ZoneArgs{{File: writeZone(t, testZone)}}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for name, target := range map[string]string{
+		"garden.example.": "walled.garden.",
+		"a.sub.example.":  "a.sub.example.garden.",
+	} {
+		rec := &plugintest.Recorder{Next: plugintest.Answer("@ 60 IN A 1.1.1.1")}
+		qCtx := plugintest.NewQuery(name, dns.TypeA).Build()
+		if err := plugintest.Exec(t, r, qCtx, rec); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Queries[0].Question[0].Name; got != target {
+			t.Fatalf("%s: want query of %s, got %s", name, target, got)
+		}
+		resp := qCtx.R()
+		if len(resp.Answer) != 2 || resp.Answer[0].(*dns.CNAME).Target != target || resp.Question[0].Name != name {
+			t.Fatalf("%s: unexpected response %v", name, resp)
+		}
+	}
+}
+
+func TestRPZ_ResponseIP(t *testing.T) {
+	r, err := NewRPZ(&Args{Zones: []ZoneArgs{{File: writeZone(t, testZone)}}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for addr, rcode := range map[string]int{"192.0.2.5": dns.RcodeNameError, "192.0.3.5": dns.RcodeSuccess} {
+		qCtx := plugintest.NewQuery("example.com.", dns.TypeA).Build()
+		if err := plugintest.Exec(t, r, qCtx, plugintest.Answer("@ 60 IN A "+addr)); err != nil {
+			t.Fatal(err)
+		}
+		if got := qCtx.R().Rcode; got != rcode {
+			t.Fatalf("%s: want rcode %d, got %d", addr, rcode, got)
+		}
+	}
+}
+
+func TestRPZ_Policy(t *testing.T) {
+	r, err := NewRPZ(&Args{Zones: []ZoneArgs{
+		{File: writeZone(t, testZone), Policy: policyDisabled},
+		{Name: "b.test", File: writeZone(t, "$ORIGIN b.test.\nlocal.example 60 A 10.0.0.9\n"), Policy: actionNoData},
+		{Name: "c.test", File: writeZone(t, "$ORIGIN c.test.\nnx.example 60 A 10.0.0.9\n")},
+	}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for name, answers := range map[string]int{"local.example.": 0, "nx.example.": 1} {
+		qCtx := plugintest.NewQuery(name, dns.TypeA).Build()
+		if err := plugintest.Exec(t, r, qCtx); err != nil {
+			t.Fatal(err)
+		}
+		if resp := qCtx.R(); resp == nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != answers {
+			t.Fatalf("%s: unexpected response %v", name, resp)
+		}
+	}
+
+	if _, err := NewRPZ(&Args{Zones: []ZoneArgs{{File: "f", Policy: "invalid"}}}, nil, nil); err == nil {
+		t.Fatal("invalid policy was accepted")
+	}
+}
+
+func Test_parseIPTrigger(t *testing.T) {
+	tests := map[string]string{
+		"32.1.0.0.127":            "127.0.0.1/32",
+		"24.0.2.0.192":            "192.0.2.0/24",
+		"128.1.zz.db8.2001":       "2001:db8::1/128",
+		"48.zz.db8.2001":          "2001:db8::/48",
+		"128.1.zz":                "::1/128",
+		"64.0.0.0.0.0.0.db8.2001": "2001:db8::/64",
+		"64.0.0.db8.2001":         "",
+		"24.1.2.0.192":            "",
+		"33.1.0.0.127":            "",
+		"x.1.0.0.127":             "",
+	}
+	for s, want := range tests {
+		p, err := parseIPTrigger(s)
+		if len(want) == 0 {
+			if err == nil {
+				t.Errorf("%s: want an error, got %s", s, p)
+			}
+			continue
+		}
+		if err != nil || p != netip.MustParsePrefix(want) {
+			t.Errorf("%s: want %s, got %s, %v", s, want, p, err)
+		}
+	}
+}
+
+// xfrServer serves SOA queries and transfers of a zone.
+type xfrServer struct {
+	mu    sync.Mutex
+	zone  []dns.RR            // the SOA and records
+	ixfr  map[uint32][]dns.RR // IXFR responses by the serial of requests
+	xfrs  []uint16            // qtypes of transfer requests
+	addr  string
+	close func()
+}
+
+func newXFRServer(t *testing.T) *xfrServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &xfrServer{ixfr: make(map[uint32][]dns.RR), addr: l.Addr().String()}
+	ds := &dns.Server{Listener: l, Handler: s}
+	go ds.ActivateAndServe()
+	t.Cleanup(func() { _ = ds.Shutdown() })
+	return s
+}
+
+func (s *xfrServer) set(zone []string, ixfr map[uint32][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zone = nil
+	for _, rr := range zone {
+		s.zone = append(s.zone, plugintest.MustRR(rr))
+	}
+	for serial, rrs := range ixfr {
+		s.ixfr[serial] = nil
+		for _, rr := range rrs {
+			s.ixfr[serial] = append(s.ixfr[serial], plugintest.MustRR(rr))
+		}
+	}
+}
+
+func (s *xfrServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qt := q.Question[0].Qtype
+	if qt == dns.TypeSOA {
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		resp.Answer = s.zone[:1]
+		_ = w.WriteMsg(resp)
+		return
+	}
+	s.xfrs = append(s.xfrs, qt)
+	rrs := append(append([]dns.RR{}, s.zone...), s.zone[0])
+	if qt == dns.TypeIXFR {
+		if d, ok := s.ixfr[q.Ns[0].(*dns.SOA).Serial]; ok {
+			rrs = d
+		}
+	}
+	ch := make(chan *dns.Envelope, 1)
+	ch <- &dns.Envelope{RR: rrs}
+	close(ch)
+	_ = new(dns.Transfer).Out(w, q, ch)
+	_ = w.Close()
+}
+
+func (s *xfrServer) transfers() []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint16(nil), s.xfrs...)
+}
+
+func TestRPZ_Transfer(t *testing.T) {
+	s := newXFRServer(t)
+	soa := func(serial string) string {
+		return "rpz.test. 300 IN SOA ns.rpz.test. admin.rpz.test. " + serial + " 3600 600 86400 300"
+	}
+	s.set([]string{soa("1"), "a.example.rpz.test. 300 IN CNAME .", "c.example.rpz.test. 300 IN CNAME ."}, nil)
+
+	cacheFile := filepath.Join(t.TempDir(), "rpz.cache")
+	args := func() *Args {
+		return &Args{Zones: []ZoneArgs{{Name: "rpz.test", Primary: s.addr, CacheFile: cacheFile}}}
+	}
+	r, err := NewRPZ(args(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	matched := func(r *RPZ, name string) bool {
+		return r.zones[0].data.Load().p.matchQName(name) != nil
+	}
+	// Without a cache file, the zone is empty until it is transferred
+	// in the background.
+	if matched(r, "a.example.") || len(s.transfers()) != 0 {
+		t.Fatal("zone was transferred by NewRPZ")
+	}
+	r.start()
+	for i := 0; !matched(r, "a.example."); i++ {
+		if i > 100 {
+			t.Fatal("zone was not transferred")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !matched(r, "c.example.") {
+		t.Fatal("zone was not transferred")
+	}
+
+	// Remove a.example and add b.example.
+	s.set([]string{soa("2"), "b.example.rpz.test. 300 IN CNAME .", "c.example.rpz.test. 300 IN CNAME ."}, map[uint32][]string{
+		1: {soa("2"), soa("1"), "a.example.rpz.test. 300 IN CNAME .", soa("2"), "b.example.rpz.test. 300 IN CNAME .", soa("2")},
+	})
+	if err := r.ReloadData(); err != nil {
+		t.Fatal(err)
+	}
+	if matched(r, "a.example.") || !matched(r, "b.example.") || !matched(r, "c.example.") {
+		t.Fatal("ixfr was not applied")
+	}
+	if err := r.ReloadData(); err != nil { // up to date
+		t.Fatal(err)
+	}
+	if got := s.transfers(); len(got) != 2 || got[0] != dns.TypeAXFR || got[1] != dns.TypeIXFR {
+		t.Fatalf("unexpected transfers %v", got)
+	}
+	if st := r.zones[0].status(); st.Serial != 2 || st.Triggers != 2 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	// Loaded from the cache file.
+	r2, err := NewRPZ(args(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	if len(s.transfers()) != 2 || !matched(r2, "b.example.") || r2.zones[0].data.Load().soa.Serial != 2 {
+		t.Fatal("zone was not loaded from the cache file")
+	}
+}
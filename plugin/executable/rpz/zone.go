@@ -0,0 +1,407 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// minRefresh is the minimum interval of transfers.
+const minRefresh = time.Minute
+
+// zoneData is a version of a zone.
+type zoneData struct {
+	soa *dns.SOA // nil if the zone file has no SOA
+	rrs []dns.RR // records without the SOA
+	p   *policies
+}
+
+func newZoneData(origin string, rrs []dns.RR) *zoneData {
+	d := &zoneData{}
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, origin) {
+			if d.soa == nil {
+				d.soa = soa
+			}
+			continue
+		}
+		d.rrs = append(d.rrs, rr)
+	}
+	d.p = newPolicies(origin, d.rrs)
+	return d
+}
+
+// zone is an RPZ zone. Its data is loaded from a file, or transferred
+// from a primary server. New data replaces the old one atomically. A
+// failed update keeps the old data.
+type zone struct {
+	args   *ZoneArgs
+	ss     remote.Storages
+	logger *zap.Logger
+	origin string // lower case fqdn, empty until the file is loaded if it is not configured
+
+	data     atomic.Pointer[zoneData]
+	updateMu sync.Mutex // serializes updates
+	errTotal atomic.Uint64
+
+	statusMu   sync.Mutex
+	lastUpdate time.Time
+	lastError  string
+}
+
+func newZone(args *ZoneArgs, logger *zap.Logger, ss remote.Storages) *zone {
+	z := &zone{args: args, ss: ss, logger: logger}
+	if len(args.Name) > 0 {
+		z.origin = strings.ToLower(dns.Fqdn(args.Name))
+	}
+	return z
+}
+
+// name returns the name of z for logs and metrics.
+func (z *zone) name() string {
+	if len(z.origin) > 0 {
+		return z.origin
+	}
+	return z.args.File
+}
+
+// update loads the file or transfers the zone. It reports whether the
+// data was changed.
+func (z *zone) update() (bool, error) {
+	z.updateMu.Lock()
+	defer z.updateMu.Unlock()
+	var updated bool
+	var err error
+	if len(z.args.Primary) > 0 {
+		updated, err = z.transfer()
+	} else {
+		err = z.loadFile()
+		updated = err == nil
+	}
+	if err != nil {
+		z.errTotal.Add(1)
+	}
+
+	z.statusMu.Lock()
+	defer z.statusMu.Unlock()
+	z.lastError = ""
+	if err != nil {
+		z.lastError = err.Error()
+	}
+	if updated {
+		z.lastUpdate = time.Now()
+	}
+	return updated, err
+}
+
+func (z *zone) loadFile() error {
+	b, err := z.ss.ReadFile(z.args.File)
+	if err != nil {
+		return err
+	}
+	origin, rrs, err := parseZone(b, z.origin, z.args.File)
+	if err != nil {
+		return err
+	}
+	z.origin = origin
+	z.data.Store(newZoneData(origin, rrs))
+	return nil
+}
+
+// parseZone parses a zone file. If origin is empty, it's the owner of the
+// first SOA record.
+func parseZone(b []byte, origin, file string) (string, []dns.RR, error) {
+	zp := dns.NewZoneParser(bytes.NewReader(b), origin, file)
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return "", nil, err
+	}
+	if len(origin) == 0 {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				origin = strings.ToLower(rr.Header().Name)
+				break
+			}
+		}
+		if len(origin) == 0 {
+			return "", nil, errors.New("zone has no SOA record, zone name is required")
+		}
+	}
+	return origin, rrs, nil
+}
+
+// loadCache loads the cache file of a transferred zone.
+func (z *zone) loadCache() error {
+	b, err := os.ReadFile(z.args.CacheFile)
+	if err != nil {
+		return err
+	}
+	_, rrs, err := parseZone(b, z.origin, z.args.CacheFile)
+	if err != nil {
+		return err
+	}
+	z.data.Store(newZoneData(z.origin, rrs))
+	return nil
+}
+
+func (z *zone) saveCache(d *zoneData) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "$ORIGIN %s\n%s\n", z.origin, d.soa)
+	for _, rr := range d.rrs {
+		b.WriteString(rr.String())
+		b.WriteByte('\n')
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(z.args.CacheFile), filepath.Base(z.args.CacheFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), z.args.CacheFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// transfer transfers the zone if the serial of the primary is newer. It
+// tries IXFR first if there is a version of the zone, and falls back to
+// AXFR.
+func (z *zone) transfer() (bool, error) {
+	cur := z.data.Load()
+	if cur != nil && cur.soa != nil {
+		serial, err := z.querySerial()
+		if err != nil {
+			return false, fmt.Errorf("failed to query soa, %w", err)
+		}
+		if !serialNewer(serial, cur.soa.Serial) {
+			return false, nil
+		}
+	}
+
+	var d *zoneData
+	if cur != nil && cur.soa != nil {
+		m := new(dns.Msg)
+		m.SetIxfr(z.origin, cur.soa.Serial, cur.soa.Ns, cur.soa.Mbox)
+		rrs, err := z.xfr(m)
+		if err == nil {
+			d, err = applyIXFR(z.origin, cur, rrs)
+		}
+		if err != nil {
+			z.logger.Debug("ixfr failed, fall back to axfr", zap.String("zone", z.origin), zap.Error(err))
+		}
+	}
+	if d == nil {
+		m := new(dns.Msg)
+		m.SetAxfr(z.origin)
+		rrs, err := z.xfr(m)
+		if err != nil {
+			return false, fmt.Errorf("axfr failed, %w", err)
+		}
+		if len(rrs) < 2 || rrs[0].Header().Rrtype != dns.TypeSOA {
+			return false, errors.New("axfr response has no soa")
+		}
+		d = newZoneData(z.origin, rrs[:len(rrs)-1]) // The last record is the SOA again.
+	}
+	if d == cur {
+		return false, nil
+	}
+	z.data.Store(d)
+	if len(z.args.CacheFile) > 0 {
+		if err := z.saveCache(d); err != nil {
+			z.logger.Warn("failed to write cache file", zap.String("file", z.args.CacheFile), zap.Error(err))
+		}
+	}
+	return true, nil
+}
+
+func (z *zone) sign(m *dns.Msg) map[string]string {
+	k := z.args.Key
+	if k == nil {
+		return nil
+	}
+	m.SetTsig(k.Name, k.Algorithm, 300, time.Now().Unix())
+	return map[string]string{k.Name: k.Secret}
+}
+
+func (z *zone) querySerial() (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(z.origin, dns.TypeSOA)
+	// The primary must accept tcp for transfers anyway.
+	c := &dns.Client{Net: "tcp", Timeout: z.timeout()}
+	c.TsigSecret = z.sign(m)
+	r, _, err := c.Exchange(m, z.args.Primary)
+	if err != nil {
+		return 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("primary returned %s", dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("no soa in the answer")
+}
+
+// xfr sends a transfer request m and returns all records of the response.
+func (z *zone) xfr(m *dns.Msg) ([]dns.RR, error) {
+	t := &dns.Transfer{
+		DialTimeout:  z.timeout(),
+		ReadTimeout:  z.timeout(),
+		WriteTimeout: z.timeout(),
+	}
+	t.TsigSecret = z.sign(m)
+	ch, err := t.In(m, z.args.Primary)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for e := range ch {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return rrs, nil
+}
+
+func (z *zone) timeout() time.Duration {
+	return time.Duration(z.args.Timeout) * time.Second
+}
+
+// refreshInterval returns the time to wait before the next update.
+func (z *zone) refreshInterval(failed bool) time.Duration {
+	var d time.Duration
+	var soa *dns.SOA
+	if cur := z.data.Load(); cur != nil {
+		soa = cur.soa
+	}
+	switch {
+	case z.args.Refresh > 0:
+		d = time.Duration(z.args.Refresh) * time.Second
+	case failed && soa != nil:
+		d = time.Duration(soa.Retry) * time.Second
+	case soa != nil:
+		d = time.Duration(soa.Refresh) * time.Second
+	}
+	return max(d, minRefresh)
+}
+
+// applyIXFR applies an IXFR response rrs (RFC 1995) to cur. If the
+// response is a full zone, it's returned as it is. If the zone is up to
+// date, cur is returned.
+func applyIXFR(origin string, cur *zoneData, rrs []dns.RR) (*zoneData, error) {
+	if len(rrs) == 0 || rrs[0].Header().Rrtype != dns.TypeSOA {
+		return nil, errors.New("ixfr response has no soa")
+	}
+	newSOA := rrs[0].(*dns.SOA)
+	if len(rrs) == 1 {
+		if newSOA.Serial == cur.soa.Serial {
+			return cur, nil
+		}
+		return nil, errors.New("ixfr response has only one soa")
+	}
+	if rrs[1].Header().Rrtype != dns.TypeSOA { // full zone
+		return newZoneData(origin, rrs[:len(rrs)-1]), nil
+	}
+	if last, ok := rrs[len(rrs)-1].(*dns.SOA); !ok || last.Serial != newSOA.Serial {
+		return nil, errors.New("incomplete ixfr response")
+	}
+	if rrs[1].(*dns.SOA).Serial != cur.soa.Serial {
+		return nil, fmt.Errorf("ixfr starts from serial %d, want %d", rrs[1].(*dns.SOA).Serial, cur.soa.Serial)
+	}
+
+	set := make(map[string]dns.RR, len(cur.rrs))
+	order := make([]string, 0, len(cur.rrs))
+	for _, rr := range cur.rrs {
+		k := rrKey(rr)
+		set[k] = rr
+		order = append(order, k)
+	}
+	adding := true
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			adding = !adding
+			continue
+		}
+		k := rrKey(rr)
+		if !adding {
+			delete(set, k)
+			continue
+		}
+		if _, ok := set[k]; !ok {
+			order = append(order, k)
+		}
+		set[k] = rr
+	}
+	next := make([]dns.RR, 0, len(set)+1)
+	next = append(next, newSOA)
+	for _, k := range order {
+		if rr, ok := set[k]; ok {
+			next = append(next, rr)
+			delete(set, k) // in case of duplicated keys in order
+		}
+	}
+	return newZoneData(origin, next), nil
+}
+
+// rrKey returns the key of rr in a zone, which ignores the ttl and the
+// case of the owner.
+func rrKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	return rr.String()
+}
+
+// serialNewer reports whether serial a is newer than b (RFC 1982).
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// hostPort adds the default port 53 to addr if it has no port.
+func hostPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, "53")
+	}
+	return addr
+}
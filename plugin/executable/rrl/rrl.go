@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rrl
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const PluginType = "rrl"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const gcInterval = time.Minute
+
+// Args configures response rate limiting (RRL) of udp responses.
+// Each client network has a budget of responses and bytes per second.
+// Responses over the budget are dropped, except that every slip-th one
+// is replaced by an empty truncated response, so real clients can retry
+// over tcp while spoofed sources get nothing to amplify.
+type Args struct {
+	ResponsesPerSecond float64 `yaml:"responses_per_second"` // default 10
+	// BytesPerSecond limits the response bandwidth. 0 means no limit.
+	BytesPerSecond int `yaml:"bytes_per_second"`
+	// Window in seconds. Budgets can be accumulated up to this window.
+	// Default is 5.
+	Window int `yaml:"window"`
+	// Slip is 2 by default. 1 truncates all limited responses.
+	// -1 drops all limited responses.
+	Slip  int `yaml:"slip"`
+	Mask4 int `yaml:"mask4"` // default 24
+	Mask6 int `yaml:"mask6"` // default 56
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultUnsignNum(&a.ResponsesPerSecond, 10)
+	utils.SetDefaultNum(&a.Window, 5)
+	utils.SetDefaultNum(&a.Slip, 2)
+	utils.SetDefaultNum(&a.Mask4, 24)
+	utils.SetDefaultNum(&a.Mask6, 56)
+	if !utils.CheckNumRange(a.Mask4, 0, 32) {
+		return fmt.Errorf("invalid mask4")
+	}
+	if !utils.CheckNumRange(a.Mask6, 0, 128) {
+		return fmt.Errorf("invalid mask6")
+	}
+	if a.Window < 0 || a.BytesPerSecond < 0 {
+		return fmt.Errorf("window and bytes_per_second must not be negative")
+	}
+	return nil
+}
+
+var _ sequence.RecursiveExecutable = (*RRL)(nil)
+
+type RRL struct {
+	args Args
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*bucket
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+
+	droppedTotal prometheus.Counter
+	slippedTotal prometheus.Counter
+}
+
+type bucket struct {
+	responses float64
+	bytes     float64
+	last      time.Time
+	limited   int // number of limited responses, for slip.
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	r, err := NewRRL(*(args.(*Args)))
+	if err != nil {
+		return nil, err
+	}
+	lb := prometheus.Labels{"tag": bp.Tag()}
+	r.droppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "dropped_total",
+		Help:        "The total number of responses dropped by rrl",
+		ConstLabels: lb,
+	})
+	r.slippedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "slipped_total",
+		Help:        "The total number of responses replaced by truncated responses by rrl",
+		ConstLabels: lb,
+	})
+	reg := prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())
+	for _, c := range [...]prometheus.Collector{r.droppedTotal, r.slippedTotal} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register metrics, %w", err)
+		}
+	}
+	return r, nil
+}
+
+func NewRRL(args Args) (*RRL, error) {
+	if err := args.init(); err != nil {
+		return nil, fmt.Errorf("invalid args, %w", err)
+	}
+	r := &RRL{
+		args:        args,
+		clients:     make(map[netip.Addr]*bucket),
+		closeNotify: make(chan struct{}),
+	}
+	go r.gcLoop()
+	return r, nil
+}
+
+func (r *RRL) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	// Only udp can be used for reflection.
+	resp := qCtx.R()
+	if !qCtx.ServerMeta.FromUDP || resp == nil {
+		return nil
+	}
+	client := r.maskedClient(qCtx.ServerMeta.ClientAddr)
+	if !client.IsValid() {
+		return nil
+	}
+
+	allowed, slip := r.account(client, resp.Len(), time.Now())
+	switch {
+	case allowed:
+	case slip:
+		if r.slippedTotal != nil {
+			r.slippedTotal.Inc()
+		}
+		tc := new(dns.Msg)
+		tc.SetReply(qCtx.Q())
+		tc.Truncated = true
+		qCtx.SetResponse(tc)
+	default:
+		if r.droppedTotal != nil {
+			r.droppedTotal.Inc()
+		}
+		qCtx.DropResponse()
+	}
+	return nil
+}
+
+// account charges a response of size bytes to client. It reports whether
+// the response is allowed and, if not, whether it should slip.
+func (r *RRL) account(client netip.Addr, size int, now time.Time) (allowed, slip bool) {
+	window := float64(r.args.Window)
+	maxResponses := r.args.ResponsesPerSecond * window
+	maxBytes := float64(r.args.BytesPerSecond) * window
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.clients[client]
+	if b == nil {
+		b = &bucket{responses: maxResponses, bytes: maxBytes, last: now}
+		r.clients[client] = b
+	} else {
+		elapsed := now.Sub(b.last).Seconds()
+		b.last = now
+		b.responses = min(maxResponses, b.responses+elapsed*r.args.ResponsesPerSecond)
+		b.bytes = min(maxBytes, b.bytes+elapsed*float64(r.args.BytesPerSecond))
+	}
+
+	if b.responses >= 1 && (r.args.BytesPerSecond == 0 || b.bytes >= float64(size)) {
+		b.responses--
+		if r.args.BytesPerSecond > 0 {
+			b.bytes -= float64(size)
+		}
+		return true, false
+	}
+	b.limited++
+	return false, r.args.Slip > 0 && b.limited%r.args.Slip == 0
+}
+
+func (r *RRL) maskedClient(a netip.Addr) netip.Addr {
+	if !a.IsValid() {
+		return netip.Addr{}
+	}
+	a = a.Unmap()
+	var p netip.Prefix
+	if a.Is4() {
+		p, _ = a.Prefix(r.args.Mask4)
+	} else {
+		p, _ = a.Prefix(r.args.Mask6)
+	}
+	return p.Addr()
+}
+
+func (r *RRL) gcLoop() {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.closeNotify:
+			return
+		case now := <-ticker.C:
+			// Clients idle for longer than the window have full budgets.
+			// Removing them does not change anything.
+			idle := time.Duration(r.args.Window) * time.Second
+			r.mu.Lock()
+			for a, b := range r.clients {
+				if now.Sub(b.last) > idle {
+					delete(r.clients, a)
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+func (r *RRL) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closeNotify)
+	})
+	return nil
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rrl
+
+import (
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func TestRRL_Exec(t *testing.T) {
+	r, err := NewRRL(Args{ResponsesPerSecond: 1, Window: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	q := plugintest.NewQuery("example.com", dns.TypeA).Client("192.0.2.1").UDP()
+	answer := plugintest.Answer("@ 300 IN A 127.0.0.1")
+
+	// Burst is 2. Then every second limited response slips.
+	for i, want := range []string{"ok", "ok", "drop", "slip", "drop", "slip"} {
+		qCtx := q.Build()
+		if err := plugintest.Exec(t, r, qCtx, answer); err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		switch {
+		case qCtx.ResponseDropped():
+			got = "drop"
+		case qCtx.R().Truncated && len(qCtx.R().Answer) == 0:
+			got = "slip"
+		default:
+			got = "ok"
+		}
+		if got != want {
+			t.Fatalf("#%d: want %s, got %s", i, want, got)
+		}
+	}
+
+	// Other networks and tcp are not limited.
+	for _, qCtx := range []*query_context.Context{
+		plugintest.NewQuery("example.com", dns.TypeA).Client("192.0.3.1").UDP().Build(),
+		plugintest.NewQuery("example.com", dns.TypeA).Client("192.0.2.1").Build(),
+	} {
+		if err := plugintest.Exec(t, r, qCtx, answer); err != nil {
+			t.Fatal(err)
+		}
+		if qCtx.ResponseDropped() || qCtx.R().Truncated {
+			t.Fatal("unexpected limited response")
+		}
+	}
+}
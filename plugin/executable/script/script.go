@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package script
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "script"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.Executable = (*Script)(nil)
+
+// Args configures a command that will be executed for every query that
+// reaches this plugin. Use it with sequence matches to run it for specific
+// domains.
+//
+// Query metadata is passed in env MOSDNS_QNAME, MOSDNS_QTYPE, MOSDNS_QCLASS,
+// MOSDNS_QUERY_ID, MOSDNS_CLIENT_ADDR, MOSDNS_SERVER_NAME and MOSDNS_URL_PATH.
+// The query in text form is written to the stdin.
+type Args struct {
+	Cmd  string   `yaml:"cmd"`
+	Args []string `yaml:"args"`
+
+	// Timeout in seconds. Default is 10.
+	Timeout int `yaml:"timeout"`
+
+	// MaxConcurrent is the max number of running commands. Commands that
+	// exceed the limit are skipped. Default is 4.
+	MaxConcurrent int `yaml:"max_concurrent"`
+
+	// Wait makes the plugin wait for the command to exit before
+	// continuing the sequence. By default, the command runs in background.
+	Wait bool `yaml:"wait"`
+}
+
+func (a *Args) init() error {
+	if len(a.Cmd) == 0 {
+		return errors.New("missing cmd")
+	}
+	utils.SetDefaultUnsignNum(&a.Timeout, 10)
+	utils.SetDefaultUnsignNum(&a.MaxConcurrent, 4)
+	return nil
+}
+
+type Script struct {
+	args    *Args
+	logger  *zap.Logger
+	running chan struct{}
+
+	// ctx of background commands. It is canceled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewScript(args.(*Args), bp.L())
+}
+
+// QuickSetup format: cmd [args]...
+func QuickSetup(bq sequence.BQ, s string) (any, error) {
+	fs := strings.Fields(s)
+	if len(fs) == 0 {
+		return nil, errors.New("missing cmd")
+	}
+	return NewScript(&Args{Cmd: fs[0], Args: fs[1:]}, bq.L())
+}
+
+func NewScript(args *Args, logger *zap.Logger) (*Script, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Script{
+		args:    args,
+		logger:  logger,
+		running: make(chan struct{}, args.MaxConcurrent),
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+// Close kills background commands and waits for them to exit.
+func (s *Script) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Script) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	select {
+	case s.running <- struct{}{}:
+	default:
+		s.logger.Warn("too many running commands, skipped", qCtx.InfoField())
+		return nil
+	}
+
+	env := queryEnv(qCtx)
+	stdin := qCtx.Q().String()
+	if s.args.Wait {
+		s.run(ctx, env, stdin, qCtx.InfoField())
+		return nil
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		<-s.running
+		return nil
+	}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	go func() {
+		defer s.wg.Done()
+		s.run(s.ctx, env, stdin, qCtx.InfoField())
+	}()
+	return nil
+}
+
+func (s *Script) run(ctx context.Context, env []string, stdin string, info zap.Field) {
+	defer func() { <-s.running }()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.args.Timeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.args.Cmd, s.args.Args...)
+	cmd.Env = append(cmd.Environ(), env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		s.logger.Warn("command failed", info, zap.Error(err), zap.ByteString("output", out))
+		return
+	}
+	s.logger.Debug("command finished", info, zap.ByteString("output", out))
+}
+
+func queryEnv(qCtx *query_context.Context) []string {
+	q := qCtx.QQuestion()
+	meta := qCtx.ServerMeta
+	env := []string{
+		"MOSDNS_QNAME=" + q.Name,
+		"MOSDNS_QTYPE=" + dns.Type(q.Qtype).String(),
+		"MOSDNS_QCLASS=" + dns.Class(q.Qclass).String(),
+		"MOSDNS_QUERY_ID=" + strconv.FormatUint(uint64(qCtx.Id()), 10),
+		"MOSDNS_SERVER_NAME=" + meta.ServerName,
+		"MOSDNS_URL_PATH=" + meta.UrlPath,
+	}
+	if meta.ClientAddr.IsValid() {
+		env = append(env, "MOSDNS_CLIENT_ADDR="+meta.ClientAddr.String())
+	}
+	return env
+}
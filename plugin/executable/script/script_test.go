@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package script
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func TestScript_Exec(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	s, err := NewScript(&Args{
+		Cmd:  "/bin/sh",
+		Args: []string{"-c", `echo "$MOSDNS_QNAME $MOSDNS_QTYPE" > ` + out},
+		Wait: true,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("nas.lan.", dns.TypeA)
+	if err := s.Exec(context.Background(), query_context.NewContext(q)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "nas.lan. A\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestScript_Close(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	s, err := NewScript(&Args{Cmd: "/bin/sh", Args: []string{"-c", "sleep 10"}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("nas.lan.", dns.TypeA)
+	if err := s.Exec(context.Background(), query_context.NewContext(q)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close kills the background command and waits for it.
+	start := time.Now()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("the background command was not killed")
+	}
+	if len(s.running) != 0 {
+		t.Fatal("the background command is still running")
+	}
+
+	// No command runs after Close.
+	if err := s.Exec(context.Background(), query_context.NewContext(q)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.running) != 0 {
+		t.Fatal("a command was started after close")
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sequence
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+)
+
+// minAnalysisSamples is the number of evaluations that every matcher of
+// a rule needs before the rule gets a suggestion.
+const minAnalysisSamples = 100
+
+// measuredMatcher records the cost and match rate of a matcher.
+type measuredMatcher struct {
+	m    Matcher
+	desc string
+
+	evaluated atomic.Uint64
+	matched   atomic.Uint64
+	nanos     atomic.Uint64
+}
+
+func (mm *measuredMatcher) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	start := time.Now()
+	ok, err := mm.m.Match(ctx, qCtx)
+	mm.nanos.Add(uint64(time.Since(start)))
+	mm.evaluated.Add(1)
+	if ok {
+		mm.matched.Add(1)
+	}
+	return ok, err
+}
+
+// measuredExec records the cost of an executable.
+type measuredExec struct {
+	e Executable
+
+	executed atomic.Uint64
+	nanos    atomic.Uint64
+}
+
+func (me *measuredExec) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	start := time.Now()
+	err := me.e.Exec(ctx, qCtx)
+	me.nanos.Add(uint64(time.Since(start)))
+	me.executed.Add(1)
+	return err
+}
+
+// enableAnalysis wraps all matchers and executables of the chain so they
+// are measured. ra must be the args that the chain was built from.
+func (s *Sequence) enableAnalysis(ra []RuleArgs) {
+	s.analysis = true
+	for i, n := range s.chain {
+		for j, m := range n.Matches {
+			mm := &measuredMatcher{m: m, desc: ra[i].Matches[j]}
+			n.Matches[j] = mm
+			n.stats.measuredMatches = append(n.stats.measuredMatches, mm)
+		}
+		if n.E != nil {
+			me := &measuredExec{e: n.E}
+			n.E = me
+			n.stats.measuredExec = me
+		}
+	}
+}
+
+type MatcherAnalysis struct {
+	Match     string  `json:"match"`
+	Evaluated uint64  `json:"evaluated"`
+	MatchRate float64 `json:"match_rate"`
+	AvgNanos  float64 `json:"avg_ns"`
+}
+
+type RuleAnalysis struct {
+	RuleStat
+	Matchers     []MatcherAnalysis `json:"matchers,omitempty"`
+	ExecAvgNanos float64           `json:"exec_avg_ns,omitempty"`
+
+	// Expected matching cost per query that reached the rule, in the
+	// current and the suggested order.
+	CostNanos          float64  `json:"cost_ns,omitempty"`
+	SuggestedOrder     []string `json:"suggested_order,omitempty"`
+	SuggestedCostNanos float64  `json:"suggested_cost_ns,omitempty"`
+}
+
+// Analysis returns the measured costs of all rules and suggests cheaper
+// matcher orders. Matchers of a rule are ANDed, so the cheapest order
+// evaluates matchers with low cost and low match rate first. Rules
+// themselves are never reordered because executables have effects.
+// It returns nil if analysis is disabled.
+func (s *Sequence) Analysis() []RuleAnalysis {
+	if !s.analysis {
+		return nil
+	}
+	var l []RuleAnalysis
+	for _, st := range s.Stats() {
+		rs := s.chain[st.Rule].stats
+		ra := RuleAnalysis{RuleStat: st}
+		for _, mm := range rs.measuredMatches {
+			evaluated := mm.evaluated.Load()
+			a := MatcherAnalysis{Match: mm.desc, Evaluated: evaluated}
+			if evaluated > 0 {
+				a.MatchRate = float64(mm.matched.Load()) / float64(evaluated)
+				a.AvgNanos = float64(mm.nanos.Load()) / float64(evaluated)
+			}
+			ra.Matchers = append(ra.Matchers, a)
+		}
+		if me := rs.measuredExec; me != nil {
+			if n := me.executed.Load(); n > 0 {
+				ra.ExecAvgNanos = float64(me.nanos.Load()) / float64(n)
+			}
+		}
+		suggestOrder(&ra)
+		l = append(l, ra)
+	}
+	return l
+}
+
+// suggestOrder sets the costs of ra and a suggested order if it is
+// cheaper than the current one by more than 5%.
+func suggestOrder(ra *RuleAnalysis) {
+	if len(ra.Matchers) == 0 {
+		return
+	}
+	for _, a := range ra.Matchers {
+		if a.Evaluated < minAnalysisSamples {
+			return
+		}
+	}
+	ra.CostNanos = matchCost(ra.Matchers)
+	if len(ra.Matchers) < 2 {
+		return
+	}
+	sorted := append([]MatcherAnalysis(nil), ra.Matchers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return costRank(sorted[i]) < costRank(sorted[j])
+	})
+	cost := matchCost(sorted)
+	if cost < ra.CostNanos*0.95 {
+		for _, a := range sorted {
+			ra.SuggestedOrder = append(ra.SuggestedOrder, a.Match)
+		}
+		ra.SuggestedCostNanos = cost
+	}
+}
+
+// matchCost returns the expected cost of evaluating l in order, assuming
+// matchers are independent.
+func matchCost(l []MatcherAnalysis) float64 {
+	cost, reach := 0.0, 1.0
+	for _, a := range l {
+		cost += reach * a.AvgNanos
+		reach *= a.MatchRate
+	}
+	return cost
+}
+
+// costRank orders ANDed matchers. Sorting by cost / (1 - match rate)
+// minimizes the expected cost of independent matchers.
+func costRank(a MatcherAnalysis) float64 {
+	if a.MatchRate >= 1 {
+		return math.Inf(1)
+	}
+	return a.AvgNanos / (1 - a.MatchRate)
+}
+
+func (s *Sequence) analysisHandler(w http.ResponseWriter, _ *http.Request) {
+	if !s.analysis {
+		http.Error(w, "analysis is disabled, set metrics.analysis to enable it", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.Analysis())
+}
@@ -34,6 +34,8 @@ type ChainNode struct {
 	// In case both are set. E is preferred.
 	E  Executable
 	RE RecursiveExecutable
+
+	stats *ruleStats // nil if the node was not built from rule args.
 }
 
 type ChainWalker struct {
@@ -55,6 +57,9 @@ func (w *ChainWalker) ExecNext(ctx context.Context, qCtx *query_context.Context)
 checkMatchesLoop:
 	for p < len(w.chain) {
 		n := w.chain[p]
+		if n.stats != nil {
+			n.stats.evaluated.Add(1)
+		}
 
 		for _, match := range n.Matches {
 			ok, err := match.Match(ctx, qCtx)
@@ -68,6 +73,10 @@ checkMatchesLoop:
 			}
 		}
 
+		if n.stats != nil {
+			n.stats.taken.Add(1)
+		}
+
 		// Exec rules' executables in loop, or in stack if it is a recursive executable.
 		switch {
 		case n.E != nil:
@@ -211,6 +220,11 @@ func (s *Sequence) newExec(bq BQ, rc RuleConfig, ri int) (Executable, RecursiveE
 	if re == nil && e == nil {
 		return nil, nil, errors.New("invalid args, initialized object is not executable")
 	}
+	if e != nil && len(rc.Tag) > 0 {
+		if o := bq.M().PluginLatencyObserver(rc.Tag); o != nil {
+			e = &timedExec{e: e, o: o}
+		}
+	}
 	return e, re, nil
 }
 
@@ -42,6 +42,7 @@ func init() {
 type Sequence struct {
 	chain            []*ChainNode
 	anonymousPlugins []any
+	analysis         bool
 }
 
 func (s *Sequence) Close() error {
@@ -54,7 +55,12 @@ func (s *Sequence) Close() error {
 type Args = []RuleArgs
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	return NewSequence(bp, *args.(*Args))
+	s, err := NewSequence(bp, *args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(s.api())
+	return s, nil
 }
 
 func NewSequence(bq BQ, ra []RuleArgs) (*Sequence, error) {
@@ -68,6 +74,12 @@ func NewSequence(bq BQ, ra []RuleArgs) (*Sequence, error) {
 		_ = s.Close()
 		return nil, err
 	}
+	for i, n := range s.chain {
+		n.stats = newRuleStats(ra[i])
+	}
+	if bq.M().AnalysisEnabled() {
+		s.enableAnalysis(ra)
+	}
 	return s, nil
 }
 
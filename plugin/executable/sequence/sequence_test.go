@@ -197,3 +197,108 @@ func Test_sequence_Exec(t *testing.T) {
 		})
 	}
 }
+
+func Test_sequence_Stats(t *testing.T) {
+	ps := make(map[string]any)
+	m := coremain.NewTestMosdnsWithPlugins(ps)
+	preparePlugins(ps)
+	s, err := NewSequence(coremain.NewBP("test", m), []RuleArgs{
+		{Matches: []string{"$false"}, Exec: "$err"},
+		{Matches: []string{"$true", "!$false"}, Exec: "$nop"},
+		{Exec: "accept"},
+		{Exec: "$err"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.Exec(context.Background(), query_context.NewContext(new(dns.Msg))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []RuleStat{
+		{Rule: 0, Matches: "$false", Exec: "$err", Evaluated: 3, Taken: 0},
+		{Rule: 1, Matches: "$true && !$false", Exec: "$nop", Evaluated: 3, Taken: 3},
+		{Rule: 2, Exec: "accept", Evaluated: 3, Taken: 3},
+		{Rule: 3, Exec: "$err", Evaluated: 0, Taken: 0},
+	}
+	got := s.Stats()
+	if len(got) != len(want) {
+		t.Fatalf("want %d rules, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("rule #%d: want %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func Test_sequence_Analysis(t *testing.T) {
+	ps := make(map[string]any)
+	m := coremain.NewTestMosdnsWithPlugins(ps)
+	preparePlugins(ps)
+	ra := []RuleArgs{
+		{Matches: []string{"$true", "$false"}, Exec: "$nop"},
+	}
+	s, err := NewSequence(coremain.NewBP("test", m), ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Analysis() != nil {
+		t.Fatal("analysis should be disabled by default")
+	}
+	s.enableAnalysis(ra)
+	for i := 0; i < 10; i++ {
+		if err := s.Exec(context.Background(), query_context.NewContext(new(dns.Msg))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := s.Analysis()
+	if len(l) != 1 || len(l[0].Matchers) != 2 {
+		t.Fatalf("unexpected analysis %+v", l)
+	}
+	if a := l[0].Matchers[0]; a.Evaluated != 10 || a.MatchRate != 1 {
+		t.Fatalf("unexpected $true analysis %+v", a)
+	}
+	if a := l[0].Matchers[1]; a.Evaluated != 10 || a.MatchRate != 0 {
+		t.Fatalf("unexpected $false analysis %+v", a)
+	}
+	if l[0].CostNanos != 0 {
+		t.Fatal("rules with too few samples should not have costs")
+	}
+}
+
+func Test_suggestOrder(t *testing.T) {
+	ra := &RuleAnalysis{Matchers: []MatcherAnalysis{
+		{Match: "slow", Evaluated: 1000, MatchRate: 0.5, AvgNanos: 1000},
+		{Match: "always", Evaluated: 500, MatchRate: 1, AvgNanos: 10},
+		{Match: "cheap", Evaluated: 500, MatchRate: 0.1, AvgNanos: 100},
+	}}
+	suggestOrder(ra)
+	if ra.CostNanos != 1000+0.5*10+0.5*100 {
+		t.Fatalf("unexpected cost %v", ra.CostNanos)
+	}
+	want := []string{"cheap", "slow", "always"}
+	if len(ra.SuggestedOrder) != len(want) {
+		t.Fatalf("want %v, got %v", want, ra.SuggestedOrder)
+	}
+	for i := range want {
+		if ra.SuggestedOrder[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, ra.SuggestedOrder)
+		}
+	}
+	if ra.SuggestedCostNanos != 100+0.1*1000+0.1*0.5*10 {
+		t.Fatalf("unexpected suggested cost %v", ra.SuggestedCostNanos)
+	}
+
+	// Already in the best order.
+	ra = &RuleAnalysis{Matchers: []MatcherAnalysis{
+		{Match: "cheap", Evaluated: 1000, MatchRate: 0.1, AvgNanos: 100},
+		{Match: "slow", Evaluated: 100, MatchRate: 0.5, AvgNanos: 1000},
+	}}
+	suggestOrder(ra)
+	if len(ra.SuggestedOrder) != 0 {
+		t.Fatalf("unexpected suggestion %v", ra.SuggestedOrder)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sequence
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ruleStats counts how many queries reached a rule and how many of them
+// matched it and ran its executable.
+type ruleStats struct {
+	matches string
+	exec    string
+
+	evaluated atomic.Uint64
+	taken     atomic.Uint64
+
+	// Set if analysis is enabled.
+	measuredMatches []*measuredMatcher
+	measuredExec    *measuredExec
+}
+
+func newRuleStats(ra RuleArgs) *ruleStats {
+	return &ruleStats{
+		matches: strings.Join(ra.Matches, " && "),
+		exec:    strings.TrimSpace(ra.Exec),
+	}
+}
+
+type RuleStat struct {
+	Rule      int    `json:"rule"`
+	Matches   string `json:"matches,omitempty"`
+	Exec      string `json:"exec"`
+	Evaluated uint64 `json:"evaluated"`
+	Taken     uint64 `json:"taken"`
+}
+
+// Stats returns counters of all rules in order. Rules that are never
+// taken are dead, rules with the highest counters are hot paths.
+func (s *Sequence) Stats() []RuleStat {
+	l := make([]RuleStat, 0, len(s.chain))
+	for i, n := range s.chain {
+		if n.stats == nil {
+			continue
+		}
+		l = append(l, RuleStat{
+			Rule:      i,
+			Matches:   n.stats.matches,
+			Exec:      n.stats.exec,
+			Evaluated: n.stats.evaluated.Load(),
+			Taken:     n.stats.taken.Load(),
+		})
+	}
+	return l
+}
+
+func (s *Sequence) api() *chi.Mux {
+	m := chi.NewRouter()
+	m.Get("/stats", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Stats())
+	})
+	m.Get("/analysis", s.analysisHandler)
+	return m
+}
+
+var (
+	ruleEvaluatedDesc = prometheus.NewDesc("rule_evaluated_total", "The total number of queries that reached the rule", []string{"rule", "exec"}, nil)
+	ruleTakenDesc     = prometheus.NewDesc("rule_taken_total", "The total number of queries that matched the rule and ran its exec", []string{"rule", "exec"}, nil)
+)
+
+// Metrics implements coremain.MetricsProvider.
+func (s *Sequence) Metrics() []prometheus.Collector {
+	return []prometheus.Collector{statsCollector{s: s}}
+}
+
+type statsCollector struct {
+	s *Sequence
+}
+
+func (c statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ruleEvaluatedDesc
+	ch <- ruleTakenDesc
+}
+
+func (c statsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, st := range c.s.Stats() {
+		rule := strconv.Itoa(st.Rule)
+		ch <- prometheus.MustNewConstMetric(ruleEvaluatedDesc, prometheus.CounterValue, float64(st.Evaluated), rule, st.Exec)
+		ch <- prometheus.MustNewConstMetric(ruleTakenDesc, prometheus.CounterValue, float64(st.Taken), rule, st.Exec)
+	}
+}
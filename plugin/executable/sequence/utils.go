@@ -21,7 +21,10 @@ package sequence
 
 import (
 	"context"
+	"time"
+
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // reWrapper converts RecursiveExecutable to Executable
@@ -43,3 +46,16 @@ func ToExecutable(v any) Executable {
 		return nil
 	}
 }
+
+// timedExec observes the execution time of e.
+type timedExec struct {
+	e Executable
+	o prometheus.Observer
+}
+
+func (t *timedExec) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	start := time.Now()
+	err := t.e.Exec(ctx, qCtx)
+	t.o.Observe(time.Since(start).Seconds())
+	return err
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package special_domain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "special_domain"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.RecursiveExecutable = (*SpecialDomain)(nil)
+
+// Categories of special-use domains.
+const (
+	catLocalhost = "localhost" // RFC 6761 6.3, loopback addresses
+	catTest      = "test"      // RFC 6761 6.2
+	catInvalid   = "invalid"   // RFC 6761 6.4
+	catOnion     = "onion"     // RFC 7686
+	catLocal     = "local"     // RFC 6762, mDNS only
+	catHomeArpa  = "home.arpa" // RFC 8375
+	catAlt       = "alt"       // RFC 9476
+	catReverse   = "reverse"   // RFC 6303, private reverse zones
+)
+
+// zones are the zones of categories. Names under them are answered
+// locally.
+var zones = map[string][]string{
+	catLocalhost: {"localhost"},
+	catTest:      {"test"},
+	catInvalid:   {"invalid"},
+	catOnion:     {"onion"},
+	catLocal:     {"local"},
+	catHomeArpa:  {"home.arpa"},
+	catAlt:       {"alt"},
+}
+
+func init() {
+	exps, _ := domain.SpecialSet("reverse-private")
+	for _, exp := range exps {
+		zones[catReverse] = append(zones[catReverse], strings.TrimPrefix(exp, domain.MatcherDomain+":"))
+	}
+}
+
+// Args selects the categories that are answered locally. Categories
+// are "localhost", "test", "invalid", "onion", "local", "home.arpa",
+// "alt" and "reverse". Empty Only means all categories.
+type Args struct {
+	Only   []string `yaml:"only"`
+	Except []string `yaml:"except"`
+}
+
+// SpecialDomain answers special-use domains locally instead of sending
+// them to upstreams. Names under localhost get loopback addresses. Other
+// names get NXDOMAIN. Put it after plugins that have local data for these
+// names, e.g. hosts with home.arpa entries.
+type SpecialDomain struct {
+	m *domain.MixMatcher[string] // zone suffix -> zone
+}
+
+func Init(_ *coremain.BP, args any) (any, error) {
+	return NewSpecialDomain(args.(*Args))
+}
+
+// QuickSetup format: [category]...
+// Empty means all categories.
+func QuickSetup(_ sequence.BQ, s string) (any, error) {
+	return NewSpecialDomain(&Args{Only: strings.Fields(s)})
+}
+
+func NewSpecialDomain(args *Args) (*SpecialDomain, error) {
+	enabled := make(map[string]bool)
+	if len(args.Only) == 0 {
+		for cat := range zones {
+			enabled[cat] = true
+		}
+	}
+	for _, cat := range args.Only {
+		if _, ok := zones[cat]; !ok {
+			return nil, fmt.Errorf("unknown category %s", cat)
+		}
+		enabled[cat] = true
+	}
+	for _, cat := range args.Except {
+		if _, ok := zones[cat]; !ok {
+			return nil, fmt.Errorf("unknown category %s", cat)
+		}
+		delete(enabled, cat)
+	}
+
+	m := domain.NewMixMatcher[string]()
+	for cat := range enabled {
+		for _, zone := range zones[cat] {
+			if err := m.Add(domain.MatcherDomain+":"+zone, dns.Fqdn(zone)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &SpecialDomain{m: m}, nil
+}
+
+func (s *SpecialDomain) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	if r := s.Response(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+		return nil
+	}
+	return next.ExecNext(ctx, qCtx)
+}
+
+// Response returns the local response of q. It returns nil if q is not
+// a special-use domain.
+func (s *SpecialDomain) Response(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+	zone, ok := s.m.Match(question.Name)
+	if !ok {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	if zone == "localhost." {
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 3600}
+		switch question.Qtype {
+		case dns.TypeA:
+			r.Answer = []dns.RR{&dns.A{Hdr: hdr, A: []byte{127, 0, 0, 1}}}
+			return r
+		case dns.TypeAAAA:
+			r.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: []byte{15: 1}}}
+			return r
+		}
+	} else {
+		r.Rcode = dns.RcodeNameError
+	}
+	r.Ns = []dns.RR{dnsutils.FakeSOA(zone)}
+	return r
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package special_domain
+
+import (
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func TestSpecialDomain(t *testing.T) {
+	s, err := NewSpecialDomain(&Args{Except: []string{"local"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		qtype   uint16
+		handled bool
+		rcode   int
+		answer  string
+	}{
+		{"localhost", dns.TypeA, true, dns.RcodeSuccess, "127.0.0.1"},
+		{"app.localhost", dns.TypeAAAA, true, dns.RcodeSuccess, "::1"},
+		{"localhost", dns.TypeMX, true, dns.RcodeSuccess, ""},
+		{"x.onion", dns.TypeA, true, dns.RcodeNameError, ""},
+		{"nas.home.arpa", dns.TypeA, true, dns.RcodeNameError, ""},
+		{"a.test", dns.TypeA, true, dns.RcodeNameError, ""},
+		{"1.1.168.192.in-addr.arpa", dns.TypePTR, true, dns.RcodeNameError, ""},
+		{"printer.local", dns.TypeA, false, 0, ""},
+		{"example.com", dns.TypeA, false, 0, ""},
+		{"8.8.8.8.in-addr.arpa", dns.TypePTR, false, 0, ""},
+	}
+	for _, tt := range tests {
+		rec := &plugintest.Recorder{}
+		qCtx := plugintest.NewQuery(tt.name, tt.qtype).Build()
+		if err := plugintest.Exec(t, s, qCtx, rec); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		if !tt.handled {
+			if r != nil || len(rec.Queries) != 1 {
+				t.Errorf("%s should be passed on", tt.name)
+			}
+			continue
+		}
+		if r == nil || len(rec.Queries) != 0 {
+			t.Errorf("%s should be answered locally", tt.name)
+			continue
+		}
+		if r.Rcode != tt.rcode {
+			t.Errorf("%s: want rcode %d, got %d", tt.name, tt.rcode, r.Rcode)
+		}
+		var got string
+		switch rr := firstRR(r).(type) {
+		case *dns.A:
+			got = rr.A.String()
+		case *dns.AAAA:
+			got = rr.AAAA.String()
+		}
+		if got != tt.answer {
+			t.Errorf("%s: want answer %q, got %q", tt.name, tt.answer, got)
+		}
+	}
+
+	if _, err := QuickSetup(nil, "onion bad"); err == nil {
+		t.Fatal("unknown category should fail")
+	}
+}
+
+func firstRR(r *dns.Msg) dns.RR {
+	if len(r.Answer) == 0 {
+		return nil
+	}
+	return r.Answer[0]
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package top_n
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "top_n"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*TopN)(nil)
+
+// Args configures rolling top-N tables of domains and clients.
+type Args struct {
+	Window     int `yaml:"window"`      // (seconds) rolling window, default is 600.
+	Slots      int `yaml:"slots"`       // number of sub windows, default is 10.
+	MaxEntries int `yaml:"max_entries"` // max domains and clients per sub window, default is 100000.
+	MinQueries int `yaml:"min_queries"` // min queries of entries that are ranked by nxdomain rate, default is 10.
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultNum(&a.Window, 600)
+	utils.SetDefaultNum(&a.Slots, 10)
+	utils.SetDefaultNum(&a.MaxEntries, 100000)
+	utils.SetDefaultNum(&a.MinQueries, 10)
+	if a.Window <= 0 {
+		return fmt.Errorf("invalid window %d", a.Window)
+	}
+	if a.Slots <= 0 {
+		return fmt.Errorf("invalid slots %d", a.Slots)
+	}
+	return nil
+}
+
+// TopN counts queries, response bytes and NXDOMAIN responses of domains
+// and clients that pass through it in a rolling window. Tables are
+// served by the api.
+type TopN struct {
+	args    Args
+	slotLen int64 // seconds
+
+	m     sync.Mutex
+	slots []*slot
+}
+
+// slot counts a sub window that starts at epoch*slotLen.
+type slot struct {
+	epoch   int64
+	domains map[string]*counts
+	clients map[netip.Addr]*counts
+}
+
+type counts struct {
+	queries  uint64
+	bytes    uint64
+	nxdomain uint64
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	t, err := NewTopN(*args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(t.api())
+	return t, nil
+}
+
+func NewTopN(args Args) (*TopN, error) {
+	if err := args.init(); err != nil {
+		return nil, fmt.Errorf("invalid args, %w", err)
+	}
+	slotLen := int64(args.Window / args.Slots)
+	if slotLen < 1 {
+		slotLen = 1
+	}
+	t := &TopN{args: args, slotLen: slotLen}
+	for i := 0; i < args.Slots; i++ {
+		t.slots = append(t.slots, &slot{epoch: -1})
+	}
+	return t, nil
+}
+
+func (t *TopN) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	err := next.ExecNext(ctx, qCtx)
+
+	var size int
+	var nx bool
+	if r := qCtx.R(); r != nil {
+		size = r.Len()
+		nx = r.Rcode == dns.RcodeNameError
+	}
+	t.observe(strings.ToLower(qCtx.QQuestion().Name), qCtx.ServerMeta.ClientAddr, size, nx, time.Now())
+	return err
+}
+
+func (t *TopN) observe(name string, client netip.Addr, size int, nx bool, now time.Time) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	s := t.slotLocked(now)
+	add := func(c *counts) {
+		c.queries++
+		c.bytes += uint64(size)
+		if nx {
+			c.nxdomain++
+		}
+	}
+	if c := s.domains[name]; c != nil {
+		add(c)
+	} else if len(s.domains) < t.args.MaxEntries {
+		c = new(counts)
+		add(c)
+		s.domains[name] = c
+	}
+	if client.IsValid() {
+		if c := s.clients[client]; c != nil {
+			add(c)
+		} else if len(s.clients) < t.args.MaxEntries {
+			c = new(counts)
+			add(c)
+			s.clients[client] = c
+		}
+	}
+}
+
+// slotLocked returns the slot of now, resetting it if it is stale.
+func (t *TopN) slotLocked(now time.Time) *slot {
+	epoch := now.Unix() / t.slotLen
+	s := t.slots[epoch%int64(len(t.slots))]
+	if s.epoch != epoch {
+		s.epoch = epoch
+		s.domains = make(map[string]*counts)
+		s.clients = make(map[netip.Addr]*counts)
+	}
+	return s
+}
+
+// Entry is a row of a top-N table.
+type Entry struct {
+	Name         string  `json:"name"`
+	Queries      uint64  `json:"queries"`
+	Bytes        uint64  `json:"bytes"`
+	Nxdomain     uint64  `json:"nxdomain"`
+	NxdomainRate float64 `json:"nxdomain_rate"`
+}
+
+const (
+	ByQueries  = "queries"
+	ByBytes    = "bytes"
+	ByNxdomain = "nxdomain"
+)
+
+// Top returns the top n domains (or clients if clients is true) in the
+// window, ordered by ByQueries, ByBytes or ByNxdomain (rate). Entries
+// with less than MinQueries queries are not ranked by nxdomain rate.
+func (t *TopN) Top(by string, clients bool, n int, now time.Time) []Entry {
+	sum := make(map[string]*counts)
+	merge := func(k string, c *counts) {
+		s := sum[k]
+		if s == nil {
+			s = new(counts)
+			sum[k] = s
+		}
+		s.queries += c.queries
+		s.bytes += c.bytes
+		s.nxdomain += c.nxdomain
+	}
+
+	t.m.Lock()
+	minEpoch := now.Unix()/t.slotLen - int64(len(t.slots)) + 1
+	for _, s := range t.slots {
+		if s.epoch < minEpoch {
+			continue
+		}
+		if clients {
+			for addr, c := range s.clients {
+				merge(addr.String(), c)
+			}
+		} else {
+			for name, c := range s.domains {
+				merge(name, c)
+			}
+		}
+	}
+	t.m.Unlock()
+
+	l := make([]Entry, 0, len(sum))
+	for k, c := range sum {
+		if by == ByNxdomain && (c.nxdomain == 0 || c.queries < uint64(t.args.MinQueries)) {
+			continue
+		}
+		l = append(l, Entry{
+			Name:         k,
+			Queries:      c.queries,
+			Bytes:        c.bytes,
+			Nxdomain:     c.nxdomain,
+			NxdomainRate: float64(c.nxdomain) / float64(c.queries),
+		})
+	}
+	key := func(e Entry) float64 {
+		switch by {
+		case ByBytes:
+			return float64(e.Bytes)
+		case ByNxdomain:
+			return e.NxdomainRate
+		default:
+			return float64(e.Queries)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		ki, kj := key(l[i]), key(l[j])
+		if ki != kj {
+			return ki > kj
+		}
+		if l[i].Queries != l[j].Queries {
+			return l[i].Queries > l[j].Queries
+		}
+		return l[i].Name < l[j].Name
+	})
+	if n > 0 && len(l) > n {
+		l = l[:n]
+	}
+	return l
+}
+
+// api serves GET /top?by={queries|bytes|nxdomain}&key={domain|client}&n=20.
+func (t *TopN) api() *chi.Mux {
+	m := chi.NewRouter()
+	m.Get("/top", func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		by := q.Get("by")
+		switch by {
+		case "":
+			by = ByQueries
+		case ByQueries, ByBytes, ByNxdomain:
+		default:
+			http.Error(w, "invalid by, want queries, bytes or nxdomain", http.StatusBadRequest)
+			return
+		}
+		var clients bool
+		switch q.Get("key") {
+		case "", "domain":
+		case "client":
+			clients = true
+		default:
+			http.Error(w, "invalid key, want domain or client", http.StatusBadRequest)
+			return
+		}
+		n := 20
+		if s := q.Get("n"); len(s) > 0 {
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 0 {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+			n = i
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(t.Top(by, clients, n, time.Now()))
+	})
+	return m
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package top_n
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func names(l []Entry) []string {
+	var s []string
+	for _, e := range l {
+		s = append(s, e.Name)
+	}
+	return s
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTopN_Top(t *testing.T) {
+	tn, err := NewTopN(Args{Window: 60, Slots: 6, MinQueries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	c1 := netip.MustParseAddr("192.168.1.2")
+	c2 := netip.MustParseAddr("192.168.1.3")
+	for i := 0; i < 5; i++ {
+		tn.observe("chatty.", c1, 50, false, now)
+	}
+	tn.observe("big.", c2, 1000, false, now)
+	tn.observe("typo.", c2, 40, true, now)
+	tn.observe("typo.", c2, 40, true, now)
+	tn.observe("once.", c2, 40, true, now)
+
+	if got := names(tn.Top(ByQueries, false, 2, now)); !equal(got, []string{"chatty.", "typo."}) {
+		t.Fatalf("by queries: got %v", got)
+	}
+	if got := names(tn.Top(ByBytes, false, 1, now)); !equal(got, []string{"big."}) {
+		t.Fatalf("by bytes: got %v", got)
+	}
+	// once. has too few queries to be ranked by rate.
+	if got := names(tn.Top(ByNxdomain, false, 0, now)); !equal(got, []string{"typo."}) {
+		t.Fatalf("by nxdomain: got %v", got)
+	}
+	l := tn.Top(ByQueries, true, 0, now)
+	if !equal(names(l), []string{"192.168.1.2", "192.168.1.3"}) || l[1].Bytes != 1120 || l[1].Nxdomain != 3 {
+		t.Fatalf("by clients: got %+v", l)
+	}
+
+	// Counters roll out of the window.
+	later := now.Add(30 * time.Second)
+	tn.observe("big.", c2, 1000, false, later)
+	if l := tn.Top(ByQueries, false, 0, later); len(l) != 4 {
+		t.Fatalf("want 4 domains in the window, got %v", names(l))
+	}
+	later = now.Add(65 * time.Second)
+	if l := tn.Top(ByQueries, false, 0, later); !equal(names(l), []string{"big."}) || l[0].Queries != 1 {
+		t.Fatalf("want only the recent query, got %+v", l)
+	}
+}
+
+func TestTopN_Exec(t *testing.T) {
+	tn, err := NewTopN(Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qCtx := plugintest.NewQuery("Example.com", dns.TypeA).Client("10.0.0.1").Build()
+	if err := plugintest.Exec(t, tn, qCtx, plugintest.Rcode(dns.RcodeNameError)); err != nil {
+		t.Fatal(err)
+	}
+	l := tn.Top(ByNxdomain, false, 0, time.Now())
+	if len(l) != 0 {
+		t.Fatalf("entries below min_queries should not be ranked by rate, got %+v", l)
+	}
+	l = tn.Top(ByQueries, false, 0, time.Now())
+	if len(l) != 1 || l[0].Name != "example.com." || l[0].Nxdomain != 1 || l[0].Bytes == 0 {
+		t.Fatalf("unexpected entries %+v", l)
+	}
+}
+
+func TestNewTopN_invalidArgs(t *testing.T) {
+	for _, args := range []Args{{Window: -1}, {Slots: -1}} {
+		if _, err := NewTopN(args); err == nil {
+			t.Fatalf("expect an err for %+v", args)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ttl_override
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	base "github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_domain"
+)
+
+const PluginType = "ttl_override"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*TTLOverride)(nil)
+
+// Args is a table of domain patterns and their forced ttls.
+// Rules are matched in order, the first matched rule wins.
+type Args struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+type Rule struct {
+	Exps       []string `yaml:"exps"`
+	DomainSets []string `yaml:"domain_sets"`
+	Files      []string `yaml:"files"`
+	TTL        uint32   `yaml:"ttl"`
+}
+
+type rule struct {
+	m   *base.Matcher
+	ttl uint32
+}
+
+// TTLOverride overrides ttls of responses from its following plugins.
+// Put it before cache and forward so that both cached and forwarded
+// answers are covered.
+type TTLOverride struct {
+	rules []rule
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewTTLOverride(bp, args.(*Args))
+}
+
+func NewTTLOverride(bq sequence.BQ, args *Args) (*TTLOverride, error) {
+	if len(args.Rules) == 0 {
+		return nil, errors.New("no rule is configured")
+	}
+	t := new(TTLOverride)
+	for i, r := range args.Rules {
+		if r.TTL == 0 {
+			return nil, fmt.Errorf("rule #%d has no ttl", i)
+		}
+		m, err := base.NewMatcher(bq, &base.Args{Exps: r.Exps, DomainSets: r.DomainSets, Files: r.Files}, matchQName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init rule #%d, %w", i, err)
+		}
+		t.rules = append(t.rules, rule{m: m, ttl: r.TTL})
+	}
+	return t, nil
+}
+
+func (t *TTLOverride) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil {
+		return nil
+	}
+	for _, rule := range t.rules {
+		ok, err := rule.m.Match(ctx, qCtx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			dnsutils.SetTTL(r, rule.ttl)
+			return nil
+		}
+	}
+	return nil
+}
+
+func matchQName(qCtx *query_context.Context, m domain.Matcher[struct{}]) (bool, error) {
+	_, ok := m.Match(qCtx.QQuestion().Name)
+	return ok, nil
+}
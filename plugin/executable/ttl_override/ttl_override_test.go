@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ttl_override
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func TestTTLOverride_Exec(t *testing.T) {
+	bq := sequence.NewBQ(coremain.NewTestMosdnsWithPlugins(nil), zap.NewNop())
+	p, err := NewTTLOverride(bq, &Args{Rules: []Rule{
+		{Exps: []string{"full:nas.lan"}, TTL: 5},
+		{Exps: []string{"lan"}, TTL: 86400},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: qCtx.QQuestion().Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+		qCtx.SetResponse(r)
+		return nil
+	})
+
+	for name, want := range map[string]uint32{
+		"nas.lan.":     5,
+		"router.lan.":  86400,
+		"example.com.": 300,
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		cw := sequence.NewChainWalker([]*sequence.ChainNode{{E: next}}, nil)
+		if err := p.Exec(context.Background(), qCtx, cw); err != nil {
+			t.Fatal(err)
+		}
+		if got := qCtx.R().Answer[0].Header().Ttl; got != want {
+			t.Errorf("%s: got ttl %d, want %d", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package wol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "wol"
+
+const (
+	defaultBroadcast = "255.255.255.255:9"
+	probeInterval    = time.Millisecond * 500
+	probeDialTimeout = time.Millisecond * 500
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*Wol)(nil)
+
+type Args struct {
+	Hosts []HostConfig `yaml:"hosts"`
+
+	// Cooldown in seconds before another packet is sent to the same host.
+	// Default is 10.
+	Cooldown int `yaml:"cooldown"`
+}
+
+type HostConfig struct {
+	Domain    string `yaml:"domain"`    // Required. Matched exactly.
+	MAC       string `yaml:"mac"`       // Required.
+	Broadcast string `yaml:"broadcast"` // Default is 255.255.255.255:9.
+
+	// Probe is a tcp address, e.g. "192.168.1.10:22". If set, the query
+	// will be delayed until the probe is connectable or Wait is reached.
+	// (TCP is used because ICMP ping requires extra privileges.)
+	Probe string `yaml:"probe"`
+	// Wait is the max delay in seconds. Default is 10.
+	Wait int `yaml:"wait"`
+}
+
+func (a *Args) init() {
+	utils.SetDefaultUnsignNum(&a.Cooldown, 10)
+	for i := range a.Hosts {
+		h := &a.Hosts[i]
+		utils.SetDefaultString(&h.Broadcast, defaultBroadcast)
+		utils.SetDefaultUnsignNum(&h.Wait, 10)
+	}
+}
+
+type host struct {
+	cfg    HostConfig
+	packet []byte
+
+	m        sync.Mutex
+	lastSent time.Time
+}
+
+type Wol struct {
+	logger   *zap.Logger
+	cooldown time.Duration
+	hosts    map[string]*host // fqdn domain -> host
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewWol(args.(*Args), bp.L())
+}
+
+func NewWol(args *Args, logger *zap.Logger) (*Wol, error) {
+	args.init()
+	w := &Wol{
+		logger:   logger,
+		cooldown: time.Duration(args.Cooldown) * time.Second,
+		hosts:    make(map[string]*host),
+	}
+	for i, hc := range args.Hosts {
+		if len(hc.Domain) == 0 {
+			return nil, fmt.Errorf("host #%d, missing domain", i)
+		}
+		mac, err := net.ParseMAC(hc.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("host #%d, invalid mac, %w", i, err)
+		}
+		if _, err := net.ResolveUDPAddr("udp", hc.Broadcast); err != nil {
+			return nil, fmt.Errorf("host #%d, invalid broadcast addr, %w", i, err)
+		}
+		w.hosts[dns.Fqdn(strings.ToLower(hc.Domain))] = &host{cfg: hc, packet: MagicPacket(mac)}
+	}
+	return w, nil
+}
+
+// MagicPacket builds a wake-on-lan magic packet for mac.
+func MagicPacket(mac net.HardwareAddr) []byte {
+	b := make([]byte, 0, 6+16*len(mac))
+	for i := 0; i < 6; i++ {
+		b = append(b, 0xff)
+	}
+	for i := 0; i < 16; i++ {
+		b = append(b, mac...)
+	}
+	return b
+}
+
+// Exec sends a magic packet if the query name is a configured host.
+// If the host has a probe, Exec waits until the host is up.
+func (w *Wol) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	h := w.hosts[strings.ToLower(qCtx.QQuestion().Name)]
+	if h == nil {
+		return nil
+	}
+
+	if w.shouldSend(h) {
+		if err := sendPacket(h.cfg.Broadcast, h.packet); err != nil {
+			w.logger.Warn("failed to send magic packet", zap.String("mac", h.cfg.MAC), zap.Error(err))
+			return nil
+		}
+		w.logger.Debug("magic packet sent", zap.String("mac", h.cfg.MAC), qCtx.InfoField())
+	}
+
+	if len(h.cfg.Probe) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(h.cfg.Wait)*time.Second)
+		defer cancel()
+		if err := waitUp(ctx, h.cfg.Probe); err != nil {
+			w.logger.Warn("host is still down", zap.String("probe", h.cfg.Probe), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func (w *Wol) shouldSend(h *host) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	now := time.Now()
+	if now.Sub(h.lastSent) < w.cooldown {
+		return false
+	}
+	h.lastSent = now
+	return true
+}
+
+func sendPacket(addr string, b []byte) error {
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write(b)
+	return err
+}
+
+func waitUp(ctx context.Context, probe string) error {
+	d := net.Dialer{Timeout: probeDialTimeout}
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		c, err := d.DialContext(ctx, "tcp", probe)
+		if err == nil {
+			c.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, context.Cause(ctx))
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,42 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package wol
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestMagicPacket(t *testing.T) {
+	mac, _ := net.ParseMAC("01:23:45:67:89:ab")
+	b := MagicPacket(mac)
+	if len(b) != 102 {
+		t.Fatalf("invalid packet length %d", len(b))
+	}
+	if !bytes.Equal(b[:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+		t.Fatal("invalid sync stream")
+	}
+	for i := 0; i < 16; i++ {
+		if !bytes.Equal(b[6+i*6:12+i*6], mac) {
+			t.Fatalf("invalid mac at #%d", i)
+		}
+	}
+}
@@ -68,7 +68,7 @@ func NewMatcher(bq sequence.BQ, args *Args, f MatchFunc) (m *Matcher, err error)
 	// Anonymous set from plugin's args and files.
 	if len(args.Exps)+len(args.Files) > 0 {
 		anonymousSet := domain.NewDomainMixMatcher()
-		if err := domain_set.LoadExpsAndFiles(args.Exps, args.Files, anonymousSet); err != nil {
+		if err := domain_set.LoadExpsAndFiles(args.Exps, args.Files, anonymousSet, bq.M().Storages()); err != nil {
 			return nil, err
 		}
 		if anonymousSet.Len() > 0 {
@@ -80,7 +80,7 @@ func NewMatcher(bq sequence.BQ, args *Args, f MatchFunc) (m *Matcher, err error)
 }
 
 // ParseQuickSetupArgs parses expressions and domain set to args.
-// Format: "([exp] | [$domain_set_tag] | [&domain_list_file])..."
+// Format: "([exp] | [@builtin_domain_set] | [$domain_set_tag] | [&domain_list_file])..."
 func ParseQuickSetupArgs(s string) *Args {
 	cutPrefix := func(s string, p string) (string, bool) {
 		if strings.HasPrefix(s, p) {
@@ -69,7 +69,7 @@ func NewMatcher(bq sequence.BQ, args *Args, f MatchFunc) (m *Matcher, err error)
 	// Anonymous set from plugin's args and files.
 	if len(args.IPs)+len(args.Files) > 0 {
 		anonymousList := netlist.NewList()
-		if err := ip_set.LoadFromIPsAndFiles(args.IPs, args.Files, anonymousList); err != nil {
+		if err := ip_set.LoadFromIPsAndFiles(args.IPs, args.Files, anonymousList, bq.M().Storages()); err != nil {
 			return nil, err
 		}
 		anonymousList.Sort()
@@ -82,7 +82,7 @@ func NewMatcher(bq sequence.BQ, args *Args, f MatchFunc) (m *Matcher, err error)
 }
 
 // ParseQuickSetupArgs parses expressions and "ip_set"s to args.
-// Format: "([ip] | [$ip_set_tag] | [&ip_list_file])..."
+// Format: "([ip] | [@special_use_set] | [$ip_set_tag] | [&ip_list_file])..."
 func ParseQuickSetupArgs(s string) *Args {
 	cutPrefix := func(s string, p string) (string, bool) {
 		if strings.HasPrefix(s, p) {
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package captive_portal
+
+import (
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	base "github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_domain"
+)
+
+const PluginType = "captive_portal"
+
+func init() {
+	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+}
+
+// Domains are the domains that operating systems and browsers use to
+// detect captive portals. If they are blocked, redirected or answered
+// with stale cached records, devices may report "no internet" behind
+// hotel or airport Wi-Fi.
+var Domains = []string{
+	// Android / ChromeOS
+	"connectivitycheck.gstatic.com",
+	"connectivitycheck.android.com",
+	"full:clients1.google.com",
+	"full:clients3.google.com",
+	"full:www.google.com",
+
+	// Apple
+	"captive.apple.com",
+	"full:www.apple.com",
+	"www.appleiphonecell.com",
+	"www.airport.us",
+	"www.ibook.info",
+	"www.itools.info",
+	"www.thinkdifferent.us",
+
+	// Windows
+	"msftconnecttest.com",
+	"msftncsi.com",
+
+	// Firefox
+	"detectportal.firefox.com",
+
+	// Linux desktops
+	"nmcheck.gnome.org",
+	"network-test.debian.org",
+	"connectivity-check.ubuntu.com",
+	"networkcheck.kde.org",
+	"full:fedoraproject.org",
+
+	// Android vendors in China
+	"connect.rom.miui.com",
+	"connectivitycheck.platform.hicloud.com",
+	"conn1.oppomobile.com",
+	"conn2.oppomobile.com",
+	"wifi.vivo.com.cn",
+	"connectivitycheck.meizu.com",
+}
+
+// QuickSetup format: same as qname. It matches queries of captive
+// portal probe domains, plus domains from args.
+// To bypass filters and the cache for captive portal probes, put a rule
+// with "matches: captive_portal" and "exec: goto <sequence_tag>" before them.
+func QuickSetup(bq sequence.BQ, s string) (sequence.Matcher, error) {
+	args := base.ParseQuickSetupArgs(s)
+	args.Exps = append(args.Exps, Domains...)
+	return base.NewMatcher(bq, args, matchQName)
+}
+
+func matchQName(qCtx *query_context.Context, m domain.Matcher[struct{}]) (bool, error) {
+	for _, question := range qCtx.Q().Question {
+		if _, ok := m.Match(question.Name); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_group
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+)
+
+const PluginType = "client_group"
+
+func init() {
+	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.Matcher = (*matcher)(nil)
+
+// QuickSetup format: group...
+// It matches queries from authenticated clients of given groups.
+func QuickSetup(_ sequence.BQ, s string) (sequence.Matcher, error) {
+	groups := strings.Fields(s)
+	if len(groups) == 0 {
+		return nil, errors.New("no group is given")
+	}
+	m := make(matcher, len(groups))
+	for _, g := range groups {
+		m[g] = struct{}{}
+	}
+	return m, nil
+}
+
+type matcher map[string]struct{}
+
+func (m matcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	g := qCtx.ServerMeta.ClientGroup
+	if len(g) == 0 {
+		return false, nil
+	}
+	_, ok := m[g]
+	return ok, nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_id
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+)
+
+const PluginType = "client_id"
+
+func init() {
+	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.Matcher = (matcher)(nil)
+
+// QuickSetup format: [id|&file]...
+// It matches queries whose client id (see server_utils.ClientIDArgs) is
+// one of the ids, e.g. "aa:bb:cc:dd:ee:ff" or "kids-tablet". MAC
+// addresses can be in any format of net.ParseMAC. Ids are case-insensitive.
+// Files have one id per line. Lines starting with "#" are ignored.
+func QuickSetup(bq sequence.BQ, s string) (sequence.Matcher, error) {
+	m := make(matcher)
+	for _, exp := range strings.Fields(s) {
+		if path, ok := strings.CutPrefix(exp, "&"); ok {
+			if err := m.loadFile(path, bq.M().Storages()); err != nil {
+				return nil, fmt.Errorf("failed to load file %s, %w", path, err)
+			}
+			continue
+		}
+		if err := m.add(exp); err != nil {
+			return nil, err
+		}
+	}
+	if len(m) == 0 {
+		return nil, errors.New("no client id is given")
+	}
+	return m, nil
+}
+
+type matcher map[string]struct{}
+
+func (m matcher) add(s string) error {
+	id := dnsutils.NormalizeClientID(s)
+	if len(id) == 0 {
+		return fmt.Errorf("invalid client id %q", s)
+	}
+	m[id] = struct{}{}
+	return nil
+}
+
+func (m matcher) loadFile(path string, ss remote.Storages) error {
+	b, err := ss.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+		if err := m.add(s); err != nil {
+			return fmt.Errorf("line %d, %w", line, err)
+		}
+	}
+	return sc.Err()
+}
+
+func (m matcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	id := qCtx.ServerMeta.ClientID
+	if len(id) == 0 {
+		return false, nil
+	}
+	_, ok := m[id]
+	return ok, nil
+}
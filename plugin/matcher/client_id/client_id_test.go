@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_id
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func TestClientID(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "kids.txt")
+	if err := os.WriteFile(f, []byte("# kids\n00-11-22-33-44-55\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := QuickSetup(plugintest.NewBQ(nil), "AA:BB:CC:DD:EE:FF Kids-Tablet &"+f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		id   string
+		want bool
+	}{
+		{"aa:bb:cc:dd:ee:ff", true},
+		{"kids-tablet", true},
+		{"00:11:22:33:44:55", true},
+		{"laptop", false},
+		{"", false},
+	} {
+		qCtx := plugintest.NewQuery("example.com", dns.TypeA).ClientID(test.id).Build()
+		if got := plugintest.Match(t, m, qCtx); got != test.want {
+			t.Errorf("client id %q: got %v, want %v", test.id, got, test.want)
+		}
+	}
+
+	if _, err := QuickSetup(plugintest.NewBQ(nil), ""); err == nil {
+		t.Fatal("empty args should fail")
+	}
+}
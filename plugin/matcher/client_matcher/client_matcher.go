@@ -0,0 +1,223 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_matcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/remote"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/ip_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+)
+
+const PluginType = "client_matcher"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.QuickConfigurableMatch = (*ClientMatcher)(nil)
+var _ sequence.RecursiveExecutable = (*ClientMatcher)(nil)
+var _ coremain.DataFileProvider = (*ClientMatcher)(nil)
+
+type Args struct {
+	Classes []ClassArgs `yaml:"classes"`
+}
+
+// ClassArgs is a named group of client addresses.
+type ClassArgs struct {
+	Name     string   `yaml:"name"`
+	IPs      []string `yaml:"ips"`      // ips, CIDRs or special-use sets like "@private".
+	Files    []string `yaml:"files"`    // files of ips and CIDRs, one per line.
+	Sequence string   `yaml:"sequence"` // optional, queries of this class go to this sequence.
+}
+
+func (a *Args) init() error {
+	if len(a.Classes) == 0 {
+		return errors.New("no class is configured")
+	}
+	names := make(map[string]struct{})
+	for i, c := range a.Classes {
+		if len(c.Name) == 0 {
+			return fmt.Errorf("class #%d has no name", i)
+		}
+		if _, dup := names[c.Name]; dup {
+			return fmt.Errorf("duplicated class %s", c.Name)
+		}
+		names[c.Name] = struct{}{}
+	}
+	return nil
+}
+
+// ClientMatcher sorts clients into classes by their source addresses.
+//
+// Used in matches as "$tag [class]...", it matches queries from clients of
+// given classes, or of any class if none is given.
+// Used in exec as "$tag", the query goes to the sequence of the first class
+// that the client belongs to, like goto. Queries from other clients or
+// classes without a sequence continue the current chain.
+type ClientMatcher struct {
+	args    Args
+	ss      remote.Storages
+	execs   []sequence.Executable // sequences of classes, can be nil.
+	lists   atomic.Pointer[[]*netlist.List]
+	classes map[string]int // class name to index
+
+	reloadMu sync.Mutex // serializes reloads
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	c, err := NewClientMatcher(*args.(*Args), bp.M().Storages())
+	if err != nil {
+		return nil, err
+	}
+	for i, ca := range c.args.Classes {
+		if len(ca.Sequence) == 0 {
+			continue
+		}
+		e := sequence.ToExecutable(bp.M().GetPlugin(ca.Sequence))
+		if e == nil {
+			return nil, fmt.Errorf("class %s, can not find executable %s", ca.Name, ca.Sequence)
+		}
+		c.execs[i] = e
+	}
+	return c, nil
+}
+
+// NewClientMatcher loads all classes. Files in remote storages are read
+// from ss. Sequences are not resolved.
+func NewClientMatcher(args Args, ss remote.Storages) (*ClientMatcher, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	c := &ClientMatcher{
+		args:    args,
+		ss:      ss,
+		execs:   make([]sequence.Executable, len(args.Classes)),
+		classes: make(map[string]int),
+	}
+	for i, ca := range args.Classes {
+		c.classes[ca.Name] = i
+	}
+	if err := c.ReloadData(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReloadData loads ips and files of all classes again. The old lists
+// are kept if it fails.
+func (c *ClientMatcher) ReloadData() error {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	lists := make([]*netlist.List, 0, len(c.args.Classes))
+	for _, ca := range c.args.Classes {
+		l := netlist.NewList()
+		if err := ip_set.LoadFromIPsAndFiles(ca.IPs, ca.Files, l, c.ss); err != nil {
+			return fmt.Errorf("class %s, %w", ca.Name, err)
+		}
+		l.Sort()
+		lists = append(lists, l)
+	}
+	c.lists.Store(&lists)
+	return nil
+}
+
+// DataFiles implements coremain.DataFileProvider.
+func (c *ClientMatcher) DataFiles() []string {
+	var files []string
+	for _, ca := range c.args.Classes {
+		files = append(files, ca.Files...)
+	}
+	return files
+}
+
+// classOf returns the index of the first class that the client of qCtx
+// belongs to, or -1.
+func (c *ClientMatcher) classOf(qCtx *query_context.Context) int {
+	addr := qCtx.ServerMeta.ClientAddr
+	if !addr.IsValid() {
+		return -1
+	}
+	addr = addr.Unmap()
+	for i, l := range *c.lists.Load() {
+		if l.Match(addr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Exec sends the query to the sequence of the client's class.
+func (c *ClientMatcher) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	if i := c.classOf(qCtx); i >= 0 && c.execs[i] != nil {
+		return c.execs[i].Exec(ctx, qCtx)
+	}
+	return next.ExecNext(ctx, qCtx)
+}
+
+// QuickConfigureMatch format: [class]...
+func (c *ClientMatcher) QuickConfigureMatch(args string) (sequence.Matcher, error) {
+	m := &classMatcher{c: c}
+	for _, name := range strings.Fields(args) {
+		i, ok := c.classes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown class %s", name)
+		}
+		m.classes = append(m.classes, i)
+	}
+	return m, nil
+}
+
+type classMatcher struct {
+	c       *ClientMatcher
+	classes []int // empty means any class.
+}
+
+func (m *classMatcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	addr := qCtx.ServerMeta.ClientAddr
+	if !addr.IsValid() {
+		return false, nil
+	}
+	addr = addr.Unmap()
+	lists := *m.c.lists.Load()
+	if len(m.classes) == 0 {
+		for _, l := range lists {
+			if l.Match(addr) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	for _, i := range m.classes {
+		if lists[i].Match(addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
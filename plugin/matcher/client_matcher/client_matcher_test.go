@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_matcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func TestClientMatcher(t *testing.T) {
+	dir := t.TempDir()
+	kidsFile := filepath.Join(dir, "kids.txt")
+	if err := os.WriteFile(kidsFile, []byte("192.168.10.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	kids := new(plugintest.Recorder)
+	bp := plugintest.NewBP("clients", map[string]any{"kids_seq": kids})
+	v, err := Init(bp, &Args{
+		Classes: []ClassArgs{
+			{Name: "kids", Files: []string{kidsFile}, Sequence: "kids_seq"},
+			{Name: "iot", IPs: []string{"192.168.20.0/24", "fd00::/8"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := v.(*ClientMatcher)
+	if files := c.DataFiles(); len(files) != 1 || files[0] != kidsFile {
+		t.Fatalf("unexpected data files %v", files)
+	}
+
+	q := func(addr string) *plugintest.Query {
+		return plugintest.NewQuery("example.com", dns.TypeA).Client(addr)
+	}
+
+	anyClass, _ := c.QuickConfigureMatch("")
+	iot, _ := c.QuickConfigureMatch("iot")
+	if _, err := c.QuickConfigureMatch("guest"); err == nil {
+		t.Fatal("unknown class should fail")
+	}
+	tests := []struct {
+		addr     string
+		any, iot bool
+	}{
+		{"192.168.10.5", true, false},
+		{"::ffff:192.168.20.5", true, true},
+		{"fd00::1", true, true},
+		{"10.0.0.1", false, false},
+	}
+	for _, tt := range tests {
+		if got := plugintest.Match(t, anyClass, q(tt.addr).Build()); got != tt.any {
+			t.Errorf("%s: any class = %v, want %v", tt.addr, got, tt.any)
+		}
+		if got := plugintest.Match(t, iot, q(tt.addr).Build()); got != tt.iot {
+			t.Errorf("%s: iot = %v, want %v", tt.addr, got, tt.iot)
+		}
+	}
+
+	// Kids go to their own sequence and skip the rest of the chain.
+	rest := new(plugintest.Recorder)
+	if err := plugintest.Exec(t, c, q("192.168.10.5").Build(), rest); err != nil {
+		t.Fatal(err)
+	}
+	if len(kids.Queries) != 1 || len(rest.Queries) != 0 {
+		t.Fatalf("kids query: kids_seq got %d, chain got %d", len(kids.Queries), len(rest.Queries))
+	}
+	// A class without a sequence and unknown clients continue the chain.
+	for _, addr := range []string{"192.168.20.5", "10.0.0.1"} {
+		if err := plugintest.Exec(t, c, q(addr).Build(), rest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(kids.Queries) != 1 || len(rest.Queries) != 2 {
+		t.Fatalf("kids_seq got %d, chain got %d", len(kids.Queries), len(rest.Queries))
+	}
+
+	// Changed files are loaded again.
+	if err := os.WriteFile(kidsFile, []byte("192.168.10.0/24\n192.168.11.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReloadData(); err != nil {
+		t.Fatal(err)
+	}
+	if !plugintest.Match(t, anyClass, q("192.168.11.1").Build()) {
+		t.Fatal("file was not reloaded")
+	}
+}
+
+func TestArgs(t *testing.T) {
+	for _, a := range []Args{
+		{},
+		{Classes: []ClassArgs{{IPs: []string{"10.0.0.0/8"}}}},
+		{Classes: []ClassArgs{{Name: "a"}, {Name: "a"}}},
+		{Classes: []ClassArgs{{Name: "a", IPs: []string{"10.0.0.0/33"}}}},
+	} {
+		if _, err := NewClientMatcher(a, nil); err == nil {
+			t.Errorf("%+v should fail", a)
+		}
+	}
+	if _, err := Init(plugintest.NewBP("c", nil), &Args{Classes: []ClassArgs{{Name: "a", Sequence: "missing"}}}); err == nil {
+		t.Error("missing sequence should fail")
+	}
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mmdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/concurrent_lru"
+	"github.com/IrineSistiana/mosdns/v5/pkg/mmdb"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "mmdb"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.QuickConfigurableMatch = (*GeoIP)(nil)
+var _ coremain.DataReloader = (*GeoIP)(nil)
+
+// Args configures a MaxMind DB (e.g. GeoLite2-Country, GeoLite2-ASN).
+type Args struct {
+	File           string `yaml:"file"`
+	CacheSize      int    `yaml:"cache_size"`      // lookup cache size, default is 4096.
+	ReloadInterval int    `yaml:"reload_interval"` // (seconds) file check interval, default is 60. Negative disables it.
+}
+
+func (a *Args) init() {
+	utils.SetDefaultNum(&a.CacheSize, 4096)
+	utils.SetDefaultNum(&a.ReloadInterval, 60)
+}
+
+// GeoIP classifies answer ips by country and ASN using a MaxMind DB.
+// It is used as "$tag CN JP AS13335" in sequence matches. The database
+// file is loaded again when its modification time or size changes.
+type GeoIP struct {
+	args   Args
+	logger *zap.Logger
+	db     atomic.Pointer[db]
+
+	reloadMu sync.Mutex // serializes reloads
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// db is a loaded database with its own lookup cache.
+type db struct {
+	r       *mmdb.Reader
+	modTime time.Time
+	size    int64
+	cache   *concurrent_lru.ConcurrentLRU[netip.Addr, geoInfo]
+}
+
+type geoInfo struct {
+	country string // ISO code in upper case, or empty.
+	asn     uint32
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	g, err := NewGeoIP(*args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	g.logger = bp.L()
+	if g.args.ReloadInterval > 0 {
+		go g.watchLoop()
+	}
+	return g, nil
+}
+
+// NewGeoIP loads the database. The file is not watched.
+func NewGeoIP(args Args) (*GeoIP, error) {
+	args.init()
+	if len(args.File) == 0 {
+		return nil, fmt.Errorf("missing database file")
+	}
+	g := &GeoIP{
+		args:        args,
+		logger:      zap.NewNop(),
+		closeNotify: make(chan struct{}),
+	}
+	if err := g.ReloadData(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// ReloadData loads the database file again. The old database is kept
+// if it fails.
+func (g *GeoIP) ReloadData() error {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+	fi, err := os.Stat(g.args.File)
+	if err != nil {
+		return err
+	}
+	r, err := mmdb.Open(g.args.File)
+	if err != nil {
+		return fmt.Errorf("failed to load %s, %w", g.args.File, err)
+	}
+	g.db.Store(&db{
+		r:       r,
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		cache:   concurrent_lru.NewConecurrentLRU[netip.Addr, geoInfo](g.args.CacheSize, nil),
+	})
+	return nil
+}
+
+func (g *GeoIP) watchLoop() {
+	ticker := time.NewTicker(time.Duration(g.args.ReloadInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.checkFile()
+		case <-g.closeNotify:
+			return
+		}
+	}
+}
+
+// checkFile reloads the database if the file was changed.
+func (g *GeoIP) checkFile() {
+	fi, err := os.Stat(g.args.File)
+	if err != nil {
+		g.logger.Warn("failed to stat database file", zap.String("file", g.args.File), zap.Error(err))
+		return
+	}
+	d := g.db.Load()
+	if fi.ModTime().Equal(d.modTime) && fi.Size() == d.size {
+		return
+	}
+	if err := g.ReloadData(); err != nil {
+		g.logger.Warn("failed to reload database", zap.Error(err))
+		return
+	}
+	g.logger.Info("database reloaded", zap.String("file", g.args.File))
+}
+
+func (g *GeoIP) Close() error {
+	g.closeOnce.Do(func() { close(g.closeNotify) })
+	return nil
+}
+
+// lookup returns the country and ASN of addr. Results are cached.
+func (g *GeoIP) lookup(addr netip.Addr) (geoInfo, error) {
+	d := g.db.Load()
+	if info, ok := d.cache.Get(addr); ok {
+		return info, nil
+	}
+	v, ok, err := d.r.Lookup(addr)
+	if err != nil {
+		return geoInfo{}, err
+	}
+	var info geoInfo
+	if ok {
+		info = parseGeoInfo(v)
+	}
+	d.cache.Add(addr, info)
+	return info, nil
+}
+
+// parseGeoInfo reads the country iso code (or the registered country
+// if it is missing) and the ASN from a record.
+func parseGeoInfo(v any) geoInfo {
+	var info geoInfo
+	if s, ok := mmdb.Path(v, "country", "iso_code"); ok {
+		info.country, _ = s.(string)
+	}
+	if len(info.country) == 0 {
+		if s, ok := mmdb.Path(v, "registered_country", "iso_code"); ok {
+			info.country, _ = s.(string)
+		}
+	}
+	info.country = strings.ToUpper(info.country)
+	if n, ok := mmdb.Path(v, "autonomous_system_number"); ok {
+		if u, ok := n.(uint64); ok {
+			info.asn = uint32(u)
+		}
+	}
+	return info
+}
+
+// QuickConfigureMatch returns a matcher that matches responses that
+// have an answer ip in any of the given countries or ASNs.
+// args is a list of ISO country codes and "AS" prefixed numbers.
+func (g *GeoIP) QuickConfigureMatch(args string) (sequence.Matcher, error) {
+	m := &respMatcher{g: g, countries: make(map[string]struct{}), asns: make(map[uint32]struct{})}
+	for _, s := range strings.Fields(args) {
+		if len(s) > 2 && strings.EqualFold(s[:2], "as") {
+			n, err := strconv.ParseUint(s[2:], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid asn %s, %w", s, err)
+			}
+			m.asns[uint32(n)] = struct{}{}
+			continue
+		}
+		if len(s) != 2 {
+			return nil, fmt.Errorf("invalid country code %s", s)
+		}
+		m.countries[strings.ToUpper(s)] = struct{}{}
+	}
+	if len(m.countries) == 0 && len(m.asns) == 0 {
+		return nil, fmt.Errorf("no country or asn is specified")
+	}
+	return m, nil
+}
+
+type respMatcher struct {
+	g         *GeoIP
+	countries map[string]struct{}
+	asns      map[uint32]struct{}
+}
+
+func (m *respMatcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	r := qCtx.R()
+	if r == nil {
+		return false, nil
+	}
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		info, err := m.g.lookup(addr.Unmap())
+		if err != nil {
+			return false, err
+		}
+		if _, ok := m.countries[info.country]; ok && len(info.country) > 0 {
+			return true, nil
+		}
+		if _, ok := m.asns[info.asn]; ok && info.asn != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
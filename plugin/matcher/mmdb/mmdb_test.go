@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mmdb
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/mmdb/mmdbtest"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func testDB(country string) *mmdbtest.Builder {
+	b := &mmdbtest.Builder{}
+	b.Insert(netip.MustParsePrefix("1.0.0.0/8"), map[string]any{
+		"country": map[string]any{"iso_code": country},
+	})
+	b.Insert(netip.MustParsePrefix("2.0.0.0/8"), map[string]any{
+		"registered_country": map[string]any{"iso_code": "us"},
+	})
+	b.Insert(netip.MustParsePrefix("2400::/16"), map[string]any{
+		"autonomous_system_number": uint32(13335),
+	})
+	return b
+}
+
+func TestGeoIP_Match(t *testing.T) {
+	f := testDB("CN").WriteFile(t)
+	g, err := NewGeoIP(Args{File: f, ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if _, err := g.QuickConfigureMatch(""); err == nil {
+		t.Fatal("empty args should fail")
+	}
+	if _, err := g.QuickConfigureMatch("CHN"); err == nil {
+		t.Fatal("invalid country code should fail")
+	}
+
+	match := func(args string, answers ...string) bool {
+		t.Helper()
+		m, err := g.QuickConfigureMatch(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		qCtx := plugintest.NewQuery("example.com", dns.TypeA).Build()
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		for _, s := range answers {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Answer = append(r.Answer, rr)
+		}
+		qCtx.SetResponse(r)
+		ok, err := m.Match(context.Background(), qCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	tests := []struct {
+		args    string
+		answers []string
+		want    bool
+	}{
+		{"cn", []string{"example.com. 60 IN A 1.2.3.4"}, true},
+		{"JP", []string{"example.com. 60 IN A 1.2.3.4"}, false},
+		{"US", []string{"example.com. 60 IN A 2.2.3.4"}, true},
+		{"JP US", []string{"example.com. 60 IN A 3.3.3.3", "example.com. 60 IN A 2.2.3.4"}, true},
+		{"AS13335", []string{"example.com. 60 IN AAAA 2400:cb00::1"}, true},
+		{"AS1", []string{"example.com. 60 IN AAAA 2400:cb00::1"}, false},
+		{"CN", []string{"example.com. 60 IN CNAME cn.example."}, false},
+		{"CN", nil, false},
+	}
+	for _, tt := range tests {
+		if got := match(tt.args, tt.answers...); got != tt.want {
+			t.Errorf("%s %v: want %v, got %v", tt.args, tt.answers, tt.want, got)
+		}
+	}
+	if n := g.db.Load().cache.Len(); n != 4 {
+		t.Fatalf("want 4 cached lookups, got %d", n)
+	}
+}
+
+func TestGeoIP_Reload(t *testing.T) {
+	f := testDB("CN").WriteFile(t)
+	g, err := NewGeoIP(Args{File: f, ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	addr := netip.MustParseAddr("1.1.1.1")
+	info, err := g.lookup(addr)
+	if err != nil || info.country != "CN" {
+		t.Fatalf("want CN, got %v, %v", info, err)
+	}
+
+	// Unchanged file, nothing happens.
+	d := g.db.Load()
+	g.checkFile()
+	if g.db.Load() != d {
+		t.Fatal("unchanged file should not be reloaded")
+	}
+
+	// A broken file keeps the old database.
+	if err := os.WriteFile(f, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g.checkFile()
+	if g.db.Load() != d {
+		t.Fatal("broken file should not replace the database")
+	}
+
+	if err := os.WriteFile(f, testDB("JP").Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(f, future, future); err != nil {
+		t.Fatal(err)
+	}
+	g.checkFile()
+	info, err = g.lookup(addr)
+	if err != nil || info.country != "JP" {
+		t.Fatalf("want JP after reload, got %v, %v", info, err)
+	}
+}
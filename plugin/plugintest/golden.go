@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package plugintest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// UpdateGoldenEnv is the env that, if set to "1", makes AssertGolden
+// (re)write golden files instead of comparing with them.
+const UpdateGoldenEnv = "MOSDNS_UPDATE_GOLDEN"
+
+// FormatResponse formats r into a stable text form. Fields that vary
+// between runs, e.g. msg id, are omitted. A nil r is formatted as "<nil>".
+func FormatResponse(r *dns.Msg) string {
+	if r == nil {
+		return "<nil>\n"
+	}
+	b := new(strings.Builder)
+	b.WriteString("rcode: " + dns.RcodeToString[r.Rcode] + "\n")
+	var flags []string
+	for _, f := range []struct {
+		s  string
+		ok bool
+	}{{"aa", r.Authoritative}, {"tc", r.Truncated}, {"rd", r.RecursionDesired}, {"ra", r.RecursionAvailable}, {"ad", r.AuthenticatedData}, {"cd", r.CheckingDisabled}} {
+		if f.ok {
+			flags = append(flags, f.s)
+		}
+	}
+	b.WriteString("flags: " + strings.Join(flags, " ") + "\n")
+	writeSection := func(name string, rrs []dns.RR) {
+		if len(rrs) == 0 {
+			return
+		}
+		b.WriteString(name + ":\n")
+		for _, rr := range rrs {
+			b.WriteString(rr.String() + "\n")
+		}
+	}
+	for _, q := range r.Question {
+		b.WriteString("question: " + q.String() + "\n")
+	}
+	writeSection("answer", r.Answer)
+	writeSection("authority", r.Ns)
+	writeSection("additional", r.Extra)
+	return b.String()
+}
+
+// AssertResponse fails the test if r does not match the text form want.
+// See FormatResponse.
+func AssertResponse(t testing.TB, r *dns.Msg, want string) {
+	t.Helper()
+	if got := FormatResponse(r); got != want {
+		t.Errorf("unexpected response\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// AssertGolden compares r with the golden file testdata/<name>.golden.
+// If env UpdateGoldenEnv is "1", the golden file is written instead.
+func AssertGolden(t testing.TB, r *dns.Msg, name string) {
+	t.Helper()
+	fp := filepath.Join("testdata", name+".golden")
+	got := FormatResponse(r)
+	if os.Getenv(UpdateGoldenEnv) == "1" {
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fp, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatalf("failed to read golden file, %v (set %s=1 to create it)", err, UpdateGoldenEnv)
+	}
+	if got != string(want) {
+		t.Errorf("response mismatches golden file %s\ngot:\n%s\nwant:\n%s", fp, got, want)
+	}
+}
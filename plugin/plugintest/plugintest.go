@@ -0,0 +1,227 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+// Package plugintest provides helpers for writing plugin unit tests.
+// It builds query contexts, runs executables and matchers with fake
+// downstream responders and compares responses with golden files.
+package plugintest
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// NewBQ returns a sequence.BQ backed by a test Mosdns with plugins p.
+// p can be nil.
+func NewBQ(p map[string]any) sequence.BQ {
+	return sequence.NewBQ(coremain.NewTestMosdnsWithPlugins(p), zap.NewNop())
+}
+
+// NewBP returns a coremain.BP with tag backed by a test Mosdns with plugins p.
+// p can be nil.
+func NewBP(tag string, p map[string]any) *coremain.BP {
+	return coremain.NewBP(tag, coremain.NewTestMosdnsWithPlugins(p))
+}
+
+// Query builds a query_context.Context.
+type Query struct {
+	q    *dns.Msg
+	meta query_context.ServerMeta
+	mark []uint32
+}
+
+// NewQuery returns a Query of name and qtype. name does not need to be fqdn.
+func NewQuery(name string, qtype uint16) *Query {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	return &Query{q: q}
+}
+
+// Client sets the client address. It panics if addr is invalid.
+func (b *Query) Client(addr string) *Query {
+	b.meta.ClientAddr = netip.MustParseAddr(addr)
+	return b
+}
+
+// ServerName sets the tls server name (sni) of the query.
+func (b *Query) ServerName(s string) *Query {
+	b.meta.ServerName = s
+	return b
+}
+
+// UrlPath sets the url path of the query.
+func (b *Query) UrlPath(s string) *Query {
+	b.meta.UrlPath = s
+	return b
+}
+
+// ClientGroup sets the authenticated client group of the query.
+func (b *Query) ClientGroup(s string) *Query {
+	b.meta.ClientGroup = s
+	return b
+}
+
+// ClientID sets the client id of the query.
+func (b *Query) ClientID(s string) *Query {
+	b.meta.ClientID = s
+	return b
+}
+
+// UDP marks the query as received from udp.
+func (b *Query) UDP() *Query {
+	b.meta.FromUDP = true
+	return b
+}
+
+// EDNS0 adds an edns0 opt to the query.
+func (b *Query) EDNS0(udpSize uint16, do bool) *Query {
+	b.q.SetEdns0(udpSize, do)
+	return b
+}
+
+// Mark sets marks on the query context.
+func (b *Query) Mark(m ...uint32) *Query {
+	b.mark = append(b.mark, m...)
+	return b
+}
+
+// Build builds a new query context. Build can be called multiple times.
+func (b *Query) Build() *query_context.Context {
+	qCtx := query_context.NewContext(b.q.Copy())
+	qCtx.ServerMeta = b.meta
+	for _, m := range b.mark {
+		qCtx.SetMark(m)
+	}
+	return qCtx
+}
+
+// Responder is a fake downstream executable that sets responses.
+type Responder = sequence.ExecutableFunc
+
+// Answer returns a Responder that answers queries with records rrs.
+// Records are in zone file format, e.g. "example.com. 300 IN A 127.0.0.1".
+// Record owner "@" is replaced by the query name.
+// It panics if a record is invalid.
+func Answer(rrs ...string) Responder {
+	return func(_ context.Context, qCtx *query_context.Context) error {
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		r.RecursionAvailable = true
+		r.Answer = answerRRs(qCtx.QQuestion().Name, rrs)
+		qCtx.SetResponse(r)
+		return nil
+	}
+}
+
+// Rcode returns a Responder that responds an empty response with rcode.
+func Rcode(rcode int) Responder {
+	return func(_ context.Context, qCtx *query_context.Context) error {
+		r := new(dns.Msg)
+		r.SetRcode(qCtx.Q(), rcode)
+		r.RecursionAvailable = true
+		qCtx.SetResponse(r)
+		return nil
+	}
+}
+
+// Fail returns a Responder that always returns err.
+func Fail(err error) Responder {
+	return func(_ context.Context, _ *query_context.Context) error {
+		return err
+	}
+}
+
+// Recorder is a fake downstream executable that records every query
+// it receives and then calls Next, if it is not nil.
+type Recorder struct {
+	Next    sequence.Executable
+	Queries []*dns.Msg
+}
+
+// Exec implements sequence.Executable.
+func (r *Recorder) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	r.Queries = append(r.Queries, qCtx.Q().Copy())
+	if r.Next == nil {
+		return nil
+	}
+	return r.Next.Exec(ctx, qCtx)
+}
+
+// answerRRs parses rrs and replaces owner "@" with name.
+func answerRRs(name string, rrs []string) []dns.RR {
+	var answer []dns.RR
+	for _, s := range rrs {
+		if strings.HasPrefix(s, "@ ") {
+			s = name + s[1:]
+		}
+		answer = append(answer, MustRR(s))
+	}
+	return answer
+}
+
+// MustRR parses a record in zone file format. It panics if s is invalid.
+func MustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	if rr == nil {
+		panic(errors.New("empty record"))
+	}
+	return rr
+}
+
+// Exec runs p with qCtx. p must be a sequence.Executable or
+// sequence.RecursiveExecutable. For a RecursiveExecutable, next
+// executables are called in order as the rest of the chain.
+func Exec(t testing.TB, p any, qCtx *query_context.Context, next ...sequence.Executable) error {
+	t.Helper()
+	var nodes []*sequence.ChainNode
+	switch p := p.(type) {
+	case sequence.RecursiveExecutable:
+		nodes = append(nodes, &sequence.ChainNode{RE: p})
+	case sequence.Executable:
+		nodes = append(nodes, &sequence.ChainNode{E: p})
+	default:
+		t.Fatalf("%T is not an executable", p)
+	}
+	for _, e := range next {
+		nodes = append(nodes, &sequence.ChainNode{E: e})
+	}
+	cw := sequence.NewChainWalker(nodes, nil)
+	return cw.ExecNext(context.Background(), qCtx)
+}
+
+// Match runs matcher m with qCtx. It fails the test if m returns an error.
+func Match(t testing.TB, m sequence.Matcher, qCtx *query_context.Context) bool {
+	t.Helper()
+	ok, err := m.Match(context.Background(), qCtx)
+	if err != nil {
+		t.Fatalf("matcher returned an err, %v", err)
+	}
+	return ok
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package plugintest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/ttl_override"
+	"github.com/miekg/dns"
+)
+
+func TestExec(t *testing.T) {
+	p, err := ttl_override.NewTTLOverride(NewBQ(nil), &ttl_override.Args{Rules: []ttl_override.Rule{
+		{Exps: []string{"lan"}, TTL: 5},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &Recorder{Next: Answer("@ 300 IN A 192.168.1.10")}
+	qCtx := NewQuery("nas.lan", dns.TypeA).Client("192.168.1.2").Build()
+	if err := Exec(t, p, qCtx, rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Queries) != 1 {
+		t.Fatalf("want 1 query, got %d", len(rec.Queries))
+	}
+	AssertGolden(t, qCtx.R(), "ttl_override")
+
+	qCtx = NewQuery("example.com", dns.TypeAAAA).Build()
+	if err := Exec(t, p, qCtx, Rcode(dns.RcodeNameError)); err != nil {
+		t.Fatal(err)
+	}
+	AssertResponse(t, qCtx.R(), "rcode: NXDOMAIN\nflags: rd ra\nquestion: ;example.com.\tIN\t AAAA\n")
+}
+
+func TestUpstream(t *testing.T) {
+	u := NewUpstream("@ 60 IN A 127.0.0.1")
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, _ := q.Pack()
+	rb, err := u.ExchangeContext(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.ReleaseBuf(rb)
+	r := new(dns.Msg)
+	if err := r.Unpack(*rb); err != nil {
+		t.Fatal(err)
+	}
+	AssertResponse(t, r, "rcode: NOERROR\nflags: rd ra\nquestion: ;example.com.\tIN\t A\nanswer:\nexample.com.\t60\tIN\tA\t127.0.0.1\n")
+	if len(u.Queries()) != 1 {
+		t.Fatal("query is not recorded")
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package plugintest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"github.com/miekg/dns"
+)
+
+var _ upstream.Upstream = (*Upstream)(nil)
+
+// Upstream is a fake upstream.Upstream. It is safe for concurrent use.
+type Upstream struct {
+	// Handler returns the response of q. A nil response with a nil error
+	// means a SERVFAIL. Nil Handler always responds SERVFAIL.
+	Handler func(q *dns.Msg) (*dns.Msg, error)
+
+	mu      sync.Mutex
+	queries []*dns.Msg
+}
+
+// NewUpstream returns an Upstream that answers queries with records rrs.
+// See Answer for the record format.
+func NewUpstream(rrs ...string) *Upstream {
+	return &Upstream{Handler: func(q *dns.Msg) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.RecursionAvailable = true
+		r.Answer = answerRRs(q.Question[0].Name, rrs)
+		return r, nil
+	}}
+}
+
+// ExchangeContext implements upstream.Upstream.
+func (u *Upstream) ExchangeContext(_ context.Context, m []byte) (*[]byte, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, fmt.Errorf("invalid query, %w", err)
+	}
+	u.mu.Lock()
+	u.queries = append(u.queries, q.Copy())
+	u.mu.Unlock()
+
+	var r *dns.Msg
+	if u.Handler != nil {
+		var err error
+		r, err = u.Handler(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r == nil {
+		r = new(dns.Msg)
+		r.SetRcode(q, dns.RcodeServerFailure)
+	}
+	r.Id = q.Id
+	return pool.PackBuffer(r)
+}
+
+// Queries returns queries received by u.
+func (u *Upstream) Queries() []*dns.Msg {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]*dns.Msg(nil), u.queries...)
+}
+
+// Close implements upstream.Upstream.
+func (u *Upstream) Close() error {
+	return nil
+}
@@ -0,0 +1,628 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dyn_hosts
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/server/update_server"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dyn_hosts"
+
+// secretHeader carries the shared secret. The Authorization header is
+// left to the api auth.
+const secretHeader = "X-DDNS-Secret"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+// recordStore keeps and answers the records of hosts.
+type recordStore interface {
+	Apply(updates []dns.RR) (skipped []dns.RR, err error)
+	Records(name string, qtype uint16) []dns.RR
+	InZone(name string) bool
+}
+
+var _ recordStore = (*update_server.UpdateServer)(nil)
+
+var _ coremain.ListenerStopper = (*DynHosts)(nil)
+
+// Args configures the registration endpoint. Hosts are registered as
+// A and AAAA records of "<hostname>.<suffix>" in an update_server, and
+// PTR records if the reverse zone of the address is also one of its
+// zones. The update_server answers queries and keeps the records.
+type Args struct {
+	Secret string `yaml:"secret"` // Required.
+	// UpdateServer is the tag of the update_server plugin. Required.
+	UpdateServer string `yaml:"update_server"`
+	// Suffix is the local domain of hosts, default is "lan". It must be
+	// in a zone of the update_server. Set it to "." to register bare
+	// hostnames.
+	Suffix   string `yaml:"suffix"`
+	TTL      int    `yaml:"ttl"`       // default is 60
+	Lease    int    `yaml:"lease"`     // (seconds) default lifetime of registrations, default is 86400. Negative means forever.
+	MaxHosts int    `yaml:"max_hosts"` // default is 1024
+	// LeaseFile keeps leases across restarts. Default is "", leases are
+	// kept in memory only, and hosts that were registered before a
+	// restart never expire.
+	LeaseFile string `yaml:"lease_file"`
+	// Listen is an optional http address, e.g. "192.168.1.1:8053", that
+	// serves the endpoint without the api auth, for DHCP hooks that only
+	// know the secret. The endpoint is always served by the api.
+	Listen string `yaml:"listen"`
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultString(&a.Suffix, "lan")
+	utils.SetDefaultNum(&a.TTL, 60)
+	utils.SetDefaultNum(&a.Lease, 86400)
+	utils.SetDefaultNum(&a.MaxHosts, 1024)
+	if len(a.Secret) == 0 {
+		return errors.New("missing secret")
+	}
+	a.Suffix = strings.Trim(strings.ToLower(a.Suffix), ".")
+	return nil
+}
+
+var (
+	errInvalidHostname = errors.New("invalid hostname")
+	errNoAddress       = errors.New("no address")
+	errTooManyHosts    = errors.New("too many hosts")
+	errConflict        = errors.New("hostname conflicts with existing records")
+)
+
+// DynHosts registers hosts by DHCP hooks or the hosts themselves over
+// http. It only keeps leases, records are kept by the update_server.
+type DynHosts struct {
+	args   *Args
+	logger *zap.Logger
+	s      recordStore
+
+	mu     sync.Mutex       // serializes changes
+	leases map[string]int64 // fqdn -> expire time in unix seconds, 0 means never
+
+	server      *http.Server
+	sl          *utils.StoppableListener // the listener of server
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// Record is a registered host.
+type Record struct {
+	Name    string       `json:"name"` // fqdn
+	Addrs   []netip.Addr `json:"addrs"`
+	Expires int64        `json:"expires"` // unix seconds, 0 means never
+}
+
+func expired(expires int64, now time.Time) bool {
+	return expires > 0 && expires <= now.Unix()
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	s, _ := bp.M().GetPlugin(a.UpdateServer).(*update_server.UpdateServer)
+	if s == nil {
+		return nil, fmt.Errorf("cannot find update_server %q", a.UpdateServer)
+	}
+	d, err := NewDynHosts(a, s, bp.L())
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(d.Api())
+	if len(d.args.Listen) > 0 {
+		// A new instance of a graceful reload listens on the same address.
+		lc := net.ListenConfig{Control: server_utils.ListenerControl(server_utils.ListenerSocketOpts{SO_REUSEPORT: true})}
+		l, err := lc.Listen(context.Background(), "tcp", d.args.Listen)
+		if err != nil {
+			return nil, err
+		}
+		d.sl = utils.NewStoppableListener(l)
+		d.server = &http.Server{Handler: d.Api(), ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			if err := d.server.Serve(d.sl); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				bp.M().GetSafeClose().SendCloseSignal(fmt.Errorf("dyn_hosts http server exited, %w", err))
+			}
+		}()
+	}
+	go d.expireLoop()
+	return d, nil
+}
+
+// NewDynHosts loads leases from the lease file. Expired hosts are not
+// removed until expireLoop runs.
+func NewDynHosts(args *Args, s recordStore, logger *zap.Logger) (*DynHosts, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	d := &DynHosts{
+		args:        args,
+		logger:      logger,
+		s:           s,
+		leases:      make(map[string]int64),
+		closeNotify: make(chan struct{}),
+	}
+	if name, _ := d.fqdn("host"); !s.InZone(name) {
+		return nil, fmt.Errorf("suffix %q is not in any zone of the update_server", args.Suffix)
+	}
+	if err := d.load(); err != nil {
+		return nil, fmt.Errorf("failed to load lease file, %w", err)
+	}
+	return d, nil
+}
+
+func (d *DynHosts) load() error {
+	if len(d.args.LeaseFile) == 0 {
+		return nil
+	}
+	b, err := os.ReadFile(d.args.LeaseFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(b, &d.leases)
+}
+
+// save writes leases to the file. It must be called with mu held.
+func (d *DynHosts) save() {
+	if len(d.args.LeaseFile) == 0 {
+		return
+	}
+	b, err := json.Marshal(d.leases)
+	if err == nil {
+		err = writeFile(d.args.LeaseFile, b)
+	}
+	if err != nil {
+		d.logger.Warn("failed to save leases", zap.String("file", d.args.LeaseFile), zap.Error(err))
+	}
+}
+
+// writeFile writes b to file atomically.
+func writeFile(file string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// addrs returns the registered addresses of name.
+func (d *DynHosts) addrs(name string) []netip.Addr {
+	var l []netip.Addr
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, rr := range d.s.Records(name, qtype) {
+			var addr netip.Addr
+			switch rr := rr.(type) {
+			case *dns.A:
+				addr, _ = netip.AddrFromSlice(rr.A.To4())
+			case *dns.AAAA:
+				addr, _ = netip.AddrFromSlice(rr.AAAA)
+			}
+			if addr.IsValid() {
+				l = append(l, addr)
+			}
+		}
+	}
+	return l
+}
+
+// addrRR returns the A or AAAA record of name and addr. class is
+// dns.ClassINET to add the record, or dns.ClassNONE to delete it.
+func (d *DynHosts) addrRR(name string, addr netip.Addr, class uint16) dns.RR {
+	ttl := uint32(d.args.TTL)
+	if class == dns.ClassNONE {
+		ttl = 0
+	}
+	if addr.Is4() {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: class, Ttl: ttl}, A: addr.AsSlice()}
+	}
+	return &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: class, Ttl: ttl}, AAAA: addr.AsSlice()}
+}
+
+// ptrRR returns the PTR record of addr to name, or nil if the reverse
+// zone of addr is not a zone of the update_server.
+func (d *DynHosts) ptrRR(name string, addr netip.Addr, class uint16) dns.RR {
+	rev, err := dns.ReverseAddr(addr.String())
+	if err != nil || !d.s.InZone(rev) {
+		return nil
+	}
+	ttl := uint32(d.args.TTL)
+	if class == dns.ClassNONE {
+		ttl = 0
+	}
+	return &dns.PTR{Hdr: dns.RR_Header{Name: rev, Rrtype: dns.TypePTR, Class: class, Ttl: ttl}, Ptr: name}
+}
+
+// deleteRRs returns the updates that delete the records of addrs of name.
+func (d *DynHosts) deleteRRs(name string, addrs []netip.Addr) []dns.RR {
+	var updates []dns.RR
+	for _, addr := range addrs {
+		updates = append(updates, d.addrRR(name, addr, dns.ClassNONE))
+		if ptr := d.ptrRR(name, addr, dns.ClassNONE); ptr != nil {
+			updates = append(updates, ptr)
+		}
+	}
+	return updates
+}
+
+// Register sets the addresses of hostname. Addresses of the families in
+// addrs replace the old ones, so a host can register its ipv4 and ipv6
+// addresses separately. lease <= 0 means the registration never expires.
+func (d *DynHosts) Register(hostname string, addrs []netip.Addr, lease time.Duration, now time.Time) (*Record, error) {
+	name, ok := d.fqdn(hostname)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errInvalidHostname, hostname)
+	}
+	if len(addrs) == 0 {
+		return nil, errNoAddress
+	}
+	var has4, has6 bool
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+		if addrs[i].Is4() {
+			has4 = true
+		} else {
+			has6 = true
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.leases[name]; !ok && len(d.leases) >= d.args.MaxHosts {
+		return nil, errTooManyHosts
+	}
+	var replaced []netip.Addr
+	for _, addr := range d.addrs(name) {
+		if (addr.Is4() && has4) || (!addr.Is4() && has6) {
+			replaced = append(replaced, addr)
+		}
+	}
+	updates := d.deleteRRs(name, replaced)
+	var added []netip.Addr
+	for _, addr := range addrs {
+		if containsAddr(added, addr) {
+			continue
+		}
+		added = append(added, addr)
+		updates = append(updates, d.addrRR(name, addr, dns.ClassINET))
+		if ptr := d.ptrRR(name, addr, dns.ClassINET); ptr != nil {
+			updates = append(updates, ptr)
+		}
+	}
+	skipped, err := d.s.Apply(updates)
+	if err != nil {
+		return nil, err
+	}
+	var expires int64
+	if lease > 0 {
+		expires = now.Add(lease).Unix()
+	}
+	registered := d.addrs(name)
+	if len(registered) > 0 {
+		d.leases[name] = expires
+		d.save()
+	}
+	if len(skipped) > 0 {
+		return nil, fmt.Errorf("%w, %s", errConflict, skipped[0].Header().Name)
+	}
+	return &Record{Name: name, Addrs: registered, Expires: expires}, nil
+}
+
+// Unregister removes addrs of hostname, or the host if addrs is empty.
+// It reports whether the host was registered.
+func (d *DynHosts) Unregister(hostname string, addrs []netip.Addr, now time.Time) (bool, error) {
+	name, ok := d.fqdn(hostname)
+	if !ok {
+		return false, fmt.Errorf("%w %q", errInvalidHostname, hostname)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.leases[name]; !ok {
+		return false, nil
+	}
+	var removed []netip.Addr
+	for _, addr := range d.addrs(name) {
+		if len(addrs) == 0 || containsAddr(addrs, addr.Unmap()) {
+			removed = append(removed, addr)
+		}
+	}
+	if _, err := d.s.Apply(d.deleteRRs(name, removed)); err != nil {
+		return true, err
+	}
+	if len(d.addrs(name)) == 0 {
+		delete(d.leases, name)
+		d.save()
+	}
+	return true, nil
+}
+
+// Records returns unexpired hosts sorted by name.
+func (d *DynHosts) Records(now time.Time) []*Record {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rs := make([]*Record, 0, len(d.leases))
+	for name, expires := range d.leases {
+		if !expired(expires, now) {
+			rs = append(rs, &Record{Name: name, Addrs: d.addrs(name), Expires: expires})
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Name < rs[j].Name })
+	return rs
+}
+
+// expire removes expired hosts.
+func (d *DynHosts) expire(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var updates []dns.RR
+	var names []string
+	for name, expires := range d.leases {
+		if expired(expires, now) {
+			names = append(names, name)
+			updates = append(updates, d.deleteRRs(name, d.addrs(name))...)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	if _, err := d.s.Apply(updates); err != nil {
+		d.logger.Warn("failed to remove expired hosts", zap.Error(err))
+		return
+	}
+	for _, name := range names {
+		delete(d.leases, name)
+	}
+	d.save()
+	d.logger.Debug("expired hosts removed", zap.Int("hosts", len(names)))
+}
+
+func (d *DynHosts) expireLoop() {
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.expire(now)
+		case <-d.closeNotify:
+			return
+		}
+	}
+}
+
+// fqdn returns the local fqdn of a hostname. Hostnames that are fqdns
+// under the suffix are kept. Other hostnames are reduced to their first
+// label.
+func (d *DynHosts) fqdn(hostname string) (string, bool) {
+	hostname = strings.Trim(strings.ToLower(hostname), ".")
+	if len(hostname) == 0 {
+		return "", false
+	}
+	if len(d.args.Suffix) > 0 && strings.HasSuffix(hostname, "."+d.args.Suffix) {
+		if _, ok := dns.IsDomainName(hostname); !ok {
+			return "", false
+		}
+		return hostname + ".", true
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	if _, ok := dns.IsDomainName(hostname); !ok || strings.ContainsAny(hostname, "*\\ ") {
+		return "", false
+	}
+	if len(d.args.Suffix) == 0 {
+		return hostname + ".", true
+	}
+	return hostname + "." + d.args.Suffix + ".", true
+}
+
+func containsAddr(l []netip.Addr, addr netip.Addr) bool {
+	for _, a := range l {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// StopListening implements coremain.ListenerStopper. Requests in flight
+// are still served until d is closed.
+func (d *DynHosts) StopListening() {
+	if d.sl != nil {
+		d.sl.Stop()
+		d.server.SetKeepAlivesEnabled(false)
+	}
+}
+
+func (d *DynHosts) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closeNotify)
+		if d.server != nil {
+			_ = d.server.Close()
+		}
+	})
+	return nil
+}
+
+// Api serves "POST /register" and "POST /unregister" with the form values
+// "hostname", "ip" (repeatable, or comma separated) and "lease" (seconds),
+// and "GET /records". The secret is the X-DDNS-Secret header or the
+// "secret" value of the request body, never the url, so it won't end up
+// in access logs. Admin api users can get /records without the secret.
+// If "ip" of /register is empty, the address of the client is registered,
+// e.g.
+//
+//	curl -H "X-DDNS-Secret: s" -d hostname=nas -d ip=192.168.1.10 http://127.0.0.1:9091/plugins/dyn_hosts/register
+func (d *DynHosts) Api() *chi.Mux {
+	m := chi.NewRouter()
+	m.With(d.authMiddleware).Post("/register", func(w http.ResponseWriter, req *http.Request) {
+		addrs, err := formAddrs(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(addrs) == 0 {
+			addr, err := remoteAddr(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			addrs = append(addrs, addr)
+		}
+		lease := time.Duration(d.args.Lease) * time.Second
+		if s := req.FormValue("lease"); len(s) > 0 {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, "invalid lease", http.StatusBadRequest)
+				return
+			}
+			lease = time.Duration(n) * time.Second
+		}
+		r, err := d.Register(req.FormValue("hostname"), addrs, lease, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), errStatus(err))
+			return
+		}
+		d.logger.Info("host registered", zap.String("name", r.Name), zap.Any("addrs", r.Addrs))
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(r)
+	})
+	m.With(d.authMiddleware).Post("/unregister", func(w http.ResponseWriter, req *http.Request) {
+		addrs, err := formAddrs(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ok, err := d.Unregister(req.FormValue("hostname"), addrs, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), errStatus(err))
+			return
+		}
+		if !ok {
+			http.Error(w, "host is not registered", http.StatusNotFound)
+			return
+		}
+	})
+	m.With(d.recordsAuthMiddleware).Get("/records", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(d.Records(time.Now()))
+	})
+	return m
+}
+
+func errStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidHostname), errors.Is(err, errNoAddress):
+		return http.StatusBadRequest
+	case errors.Is(err, errConflict):
+		return http.StatusConflict
+	case errors.Is(err, errTooManyHosts):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (d *DynHosts) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s := req.Header.Get(secretHeader)
+		if len(s) == 0 {
+			s = req.PostFormValue("secret")
+		}
+		if subtle.ConstantTimeCompare([]byte(s), []byte(d.args.Secret)) != 1 {
+			http.Error(w, "invalid secret", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// recordsAuthMiddleware lets admin api users in without the secret.
+func (d *DynHosts) recordsAuthMiddleware(next http.Handler) http.Handler {
+	auth := d.authMiddleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if role, ok := coremain.RequestRole(req); ok && role >= coremain.RoleAdmin {
+			next.ServeHTTP(w, req)
+			return
+		}
+		auth.ServeHTTP(w, req)
+	})
+}
+
+func formAddrs(req *http.Request) ([]netip.Addr, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, err
+	}
+	var addrs []netip.Addr
+	for _, v := range req.Form["ip"] {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			if len(s) == 0 {
+				continue
+			}
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ip %q", s)
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+func remoteAddr(req *http.Request) (netip.Addr, error) {
+	ap, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote address %s", req.RemoteAddr)
+	}
+	return ap.Addr().Unmap(), nil
+}
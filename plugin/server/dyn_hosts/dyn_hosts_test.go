@@ -0,0 +1,221 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dyn_hosts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/IrineSistiana/mosdns/v5/plugin/server/update_server"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func newStore(t *testing.T) *update_server.UpdateServer {
+	t.Helper()
+	s, err := update_server.NewUpdateServer(&update_server.Args{Zones: []string{"lan", "168.192.in-addr.arpa"}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDynHosts(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "leases.json")
+	s := newStore(t)
+	d, err := NewDynHosts(&Args{Secret: "s", UpdateServer: "us", LeaseFile: f}, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		qCtx := plugintest.NewQuery(name, qtype).Build()
+		if err := plugintest.Exec(t, s, qCtx); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R()
+	}
+
+	now := time.Now()
+	if _, err := d.Register("NAS.home", []netip.Addr{netip.MustParseAddr("192.168.1.10")}, 0, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Register("nas", []netip.Addr{netip.MustParseAddr("fd00::10")}, 0, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Register("phone", []netip.Addr{netip.MustParseAddr("192.168.1.20")}, time.Minute, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Register("bad name", []netip.Addr{netip.MustParseAddr("192.168.1.30")}, 0, now); err == nil {
+		t.Fatal("want invalid hostname error")
+	}
+
+	if r := lookup("nas.lan", dns.TypeA); r == nil || len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 60 {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if r := lookup("nas.lan", dns.TypeAAAA); r == nil || len(r.Answer) != 1 {
+		t.Fatalf("ipv6 address should not replace ipv4 address, got %v", r)
+	}
+	r := lookup("10.1.168.192.in-addr.arpa", dns.TypePTR)
+	if r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.PTR).Ptr != "nas.lan." {
+		t.Fatalf("unexpected PTR response %v", r)
+	}
+
+	// A new address replaces the old one and its PTR.
+	if _, err := d.Register("nas", []netip.Addr{netip.MustParseAddr("192.168.1.11")}, 0, now); err != nil {
+		t.Fatal(err)
+	}
+	if r := lookup("10.1.168.192.in-addr.arpa", dns.TypePTR); r != nil {
+		t.Fatalf("old PTR should be removed, got %v", r)
+	}
+	if r := lookup("nas.lan", dns.TypeA); r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.168.1.11" {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	// Leases are kept in the file.
+	d2, err := NewDynHosts(&Args{Secret: "s", UpdateServer: "us", LeaseFile: f}, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs := d2.Records(now); len(rs) != 2 || rs[1].Name != "phone.lan." || rs[1].Expires != now.Add(time.Minute).Unix() {
+		t.Fatalf("leases were not loaded, got %v", rs)
+	}
+
+	// Expired hosts are removed.
+	d.expire(now.Add(2 * time.Minute))
+	if r := lookup("phone.lan", dns.TypeA); r != nil {
+		t.Fatalf("expired record should be removed, got %v", r)
+	}
+	if r := lookup("20.1.168.192.in-addr.arpa", dns.TypePTR); r != nil {
+		t.Fatalf("expired PTR should be removed, got %v", r)
+	}
+
+	if ok, err := d.Unregister("nas", []netip.Addr{netip.MustParseAddr("192.168.1.11")}, now); !ok || err != nil {
+		t.Fatalf("unexpected unregister result %v, %v", ok, err)
+	}
+	if r := lookup("nas.lan", dns.TypeA); r == nil || len(r.Answer) != 0 {
+		t.Fatalf("want NODATA, got %v", r)
+	}
+	if ok, _ := d.Unregister("nas", nil, now); !ok {
+		t.Fatal("nas should be registered")
+	}
+	if r := lookup("nas.lan", dns.TypeAAAA); r != nil {
+		t.Fatalf("host should be removed, got %v", r)
+	}
+}
+
+func TestDynHosts_limits(t *testing.T) {
+	s := newStore(t)
+	if _, err := NewDynHosts(&Args{Secret: "s", Suffix: "home"}, s, nil); err == nil {
+		t.Fatal("want error of a suffix out of the zones")
+	}
+	d, err := NewDynHosts(&Args{Secret: "s", MaxHosts: 1}, s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	addr := []netip.Addr{netip.MustParseAddr("192.168.1.10")}
+	if _, err := d.Register("a", addr, 0, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Register("a", addr, 0, now); err != nil {
+		t.Fatalf("registered hosts can be updated, got %v", err)
+	}
+	if _, err := d.Register("b", addr, 0, now); errStatus(err) != http.StatusInsufficientStorage {
+		t.Fatalf("want too many hosts error, got %v", err)
+	}
+
+	// Hosts cannot take names of other records.
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: "c.lan.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "a.lan."}
+	if _, err := s.Apply([]dns.RR{cname}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Unregister("a", nil, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Register("c", addr, 0, now); errStatus(err) != http.StatusConflict {
+		t.Fatalf("want conflict error, got %v", err)
+	}
+	if rs := d.Records(now); len(rs) != 0 {
+		t.Fatalf("conflicted host should not be leased, got %v", rs)
+	}
+	if ok, _ := d.Unregister("x", nil, now); ok {
+		t.Fatal("unregistered names should not be removed")
+	}
+}
+
+func TestDynHosts_Api(t *testing.T) {
+	d, err := NewDynHosts(&Args{Secret: "s"}, newStore(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := d.Api()
+	do := func(method, path, secret string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		if len(secret) > 0 {
+			req.Header.Set(secretHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(http.MethodPost, "/register", "wrong", url.Values{"hostname": {"pc"}}); w.Code != http.StatusForbidden {
+		t.Fatalf("want 403, got %d", w.Code)
+	}
+	// The secret is not taken from the url.
+	if w := do(http.MethodPost, "/register?secret=s", "", url.Values{"hostname": {"pc"}}); w.Code != http.StatusForbidden {
+		t.Fatalf("want 403, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/register", "", url.Values{"secret": {"s"}, "hostname": {"pc"}, "ip": {"192.168.1.5, fd00::5"}}); w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d %s", w.Code, w.Body)
+	}
+	// The client address is registered if ip is empty.
+	if w := do(http.MethodPost, "/register", "s", url.Values{"hostname": {"laptop"}}); w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodPost, "/register", "s", url.Values{"hostname": {"pc"}, "ip": {"bad"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/records", "", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("want 403, got %d", w.Code)
+	}
+	w := do(http.MethodGet, "/records", "s", nil)
+	if want := `[{"name":"laptop.lan.","addrs":["192.0.2.1"],"expires":`; !strings.HasPrefix(w.Body.String(), want) {
+		t.Fatalf("unexpected records %s", w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `{"name":"pc.lan.","addrs":["192.168.1.5","fd00::5"]`) {
+		t.Fatalf("unexpected records %s", w.Body)
+	}
+	if w := do(http.MethodPost, "/unregister", "s", url.Values{"hostname": {"pc"}}); w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/unregister", "s", url.Values{"hostname": {"pc"}}); w.Code != http.StatusNotFound {
+		t.Fatalf("want 404, got %d", w.Code)
+	}
+}
@@ -21,6 +21,8 @@ package tcp_server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -37,53 +39,155 @@ import (
 
 const PluginType = "http_server"
 
+const defaultPath = "/dns-query"
+
 func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
 }
 
+// Args of http_server. It serves DNS over HTTPS (RFC 8484) by GET and
+// POST requests. HTTP/2 is enabled if Cert and Key are set, otherwise
+// it serves plain HTTP/1.1, e.g. behind a reverse proxy.
 type Args struct {
-	Entries []struct {
-		Exec string `yaml:"exec"`
-		Path string `yaml:"path"`
-	} `yaml:"entries"`
+	// Entries map url paths to different sequences. So that one endpoint
+	// can serve multiple policies, e.g. /dns-query, /family, /unfiltered.
+	Entries []EntryConfig `yaml:"entries"`
+
 	Listen      string `yaml:"listen"`
 	SrcIPHeader string `yaml:"src_ip_header"`
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
-	IdleTimeout int    `yaml:"idle_timeout"`
+	IdleTimeout int    `yaml:"idle_timeout"` // (seconds) default is 30.
+
+	// Auth authenticates clients by url tokens, basic auth or
+	// client certificates.
+	Auth server_utils.AuthArgs `yaml:"auth"`
+
+	// MinimalANY answers ANY queries with a HINFO record (RFC 8482)
+	// instead of executing the entry.
+	MinimalANY bool `yaml:"minimal_any"`
+
+	// Edns0Meta accepts the identity of original clients (address,
+	// client group and marks) from trusted front proxies.
+	Edns0Meta server_utils.MetaArgs `yaml:"edns0_meta"`
+
+	// ClientID reads the client id (e.g. the MAC address) of queries.
+	ClientID server_utils.ClientIDArgs `yaml:"client_id"`
+}
+
+type EntryConfig struct {
+	Exec string `yaml:"exec"`
+	// Path is the url path of this entry. Default is "/dns-query".
+	// Paths ending with a slash match all paths under it.
+	Path string `yaml:"path"`
 }
 
-func (a *Args) init() {
+func (a *Args) init() error {
 	utils.SetDefaultNum(&a.IdleTimeout, 30)
+	if len(a.Entries) == 0 {
+		return errors.New("no entry is configured")
+	}
+	paths := make(map[string]struct{})
+	// http.ServeMux panics on invalid or conflicting patterns. Register
+	// paths to a test mux first, so they are reported as errors.
+	mux := http.NewServeMux()
+	for i := range a.Entries {
+		e := &a.Entries[i]
+		utils.SetDefaultString(&e.Path, defaultPath)
+		if !strings.HasPrefix(e.Path, "/") {
+			return fmt.Errorf("invalid path %s, must start with /", e.Path)
+		}
+		// Paths are literal, they are not ServeMux patterns.
+		if strings.ContainsAny(e.Path, "{} \t") {
+			return fmt.Errorf("invalid path %s, must not contain braces or spaces", e.Path)
+		}
+		// Tokens in the url path are under the entry path.
+		if a.Auth.PathToken && !strings.HasSuffix(e.Path, "/") {
+			return fmt.Errorf("invalid path %s, path_token requires paths ending with a slash", e.Path)
+		}
+		if _, dup := paths[e.Path]; dup {
+			return fmt.Errorf("duplicated path %s", e.Path)
+		}
+		paths[e.Path] = struct{}{}
+		if err := handleSafe(mux, e.Path, http.NotFoundHandler()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleSafe is like mux.Handle, but returns an error instead of
+// panicking if the pattern is invalid.
+func handleSafe(mux *http.ServeMux, pattern string, h http.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid path %s, %v", pattern, r)
+		}
+	}()
+	mux.Handle(pattern, h)
+	return nil
 }
 
 type HttpServer struct {
 	args *Args
 
 	server *http.Server
+	sl     *utils.StoppableListener
+	addr   net.Addr
 }
 
+var _ coremain.ListenerStopper = (*HttpServer)(nil)
+
 func (s *HttpServer) Close() error {
 	return s.server.Close()
 }
 
+// StopListening implements coremain.ListenerStopper. Idle connections
+// are closed and keep-alives are disabled, so clients reconnect to the
+// new listener. Requests in flight are still served until s is closed.
+func (s *HttpServer) StopListening() {
+	s.sl.Stop()
+	s.server.SetKeepAlivesEnabled(false)
+}
+
+// Addr returns the listening address.
+func (s *HttpServer) Addr() net.Addr {
+	return s.addr
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
 
 func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	auth, err := server_utils.NewClientAuth(&args.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth args, %w", err)
+	}
+	tlsEnabled := len(args.Key)+len(args.Cert) > 0
+	if len(args.Auth.ClientCA) > 0 && !tlsEnabled {
+		return nil, errors.New("client_ca requires tls")
+	}
+
 	mux := http.NewServeMux()
 	for _, entry := range args.Entries {
-		dh, err := server_utils.NewHandler(bp, entry.Exec)
+		dh, err := server_utils.NewHandler(bp, entry.Exec, server_utils.HandlerOpts{MinimalANY: args.MinimalANY, Meta: &args.Edns0Meta, ClientID: &args.ClientID})
 		if err != nil {
-			return nil, fmt.Errorf("failed to init dns handler, %w", err)
+			return nil, fmt.Errorf("failed to init dns handler for path %s, %w", entry.Path, err)
 		}
 		hhOpts := server.HttpHandlerOpts{
 			GetSrcIPFromHeader: args.SrcIPHeader,
 			Logger:             bp.L(),
+			Auth:               auth,
+			ClientIDParam:      args.ClientID.URLParam,
 		}
 		hh := server.NewHttpHandler(dh, hhOpts)
-		mux.Handle(entry.Path, hh)
+		if err := handleSafe(mux, entry.Path, hh); err != nil {
+			return nil, err
+		}
 	}
 
 	socketOpt := server_utils.ListenerSocketOpts{
@@ -96,10 +200,11 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 	if strings.HasPrefix(args.Listen, "@") {
 		listenerNetwork = "unix"
 	}
-	l, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
+	rawL, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen socket, %w", err)
 	}
+	l := utils.NewStoppableListener(rawL)
 	bp.L().Info("http server started", zap.Stringer("addr", l.Addr()))
 
 	hs := &http.Server{
@@ -108,6 +213,12 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		IdleTimeout:    time.Duration(args.IdleTimeout) * time.Second,
 		MaxHeaderBytes: 512,
 	}
+	if tlsEnabled {
+		hs.TLSConfig = new(tls.Config)
+		if err := server_utils.SetupClientCA(hs.TLSConfig, &args.Auth); err != nil {
+			return nil, err
+		}
+	}
 	if err := http2.ConfigureServer(hs, &http2.Server{
 		MaxReadFrameSize:             16 * 1024,
 		IdleTimeout:                  time.Duration(args.IdleTimeout) * time.Second,
@@ -119,7 +230,7 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 
 	go func() {
 		var err error
-		if len(args.Key)+len(args.Cert) > 0 {
+		if tlsEnabled {
 			err = hs.ServeTLS(l, args.Cert, args.Key)
 		} else {
 			err = hs.Serve(l)
@@ -129,5 +240,7 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 	return &HttpServer{
 		args:   args,
 		server: hs,
+		sl:     l,
+		addr:   l.Addr(),
 	}, nil
 }
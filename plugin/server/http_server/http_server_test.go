@@ -0,0 +1,56 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tcp_server
+
+import (
+	"testing"
+)
+
+func TestArgs_init(t *testing.T) {
+	tests := []struct {
+		name      string
+		paths     []string
+		pathToken bool
+		wantErr   bool
+	}{
+		{"default", []string{""}, false, false},
+		{"multiple", []string{"/dns-query", "/family", "/kids/"}, false, false},
+		{"no slash", []string{"dns-query"}, false, true},
+		{"duplicated", []string{"/a", "/a"}, false, true},
+		{"duplicated default", []string{"", "/dns-query"}, false, true},
+		{"wildcard", []string{"/{id}"}, false, true},
+		{"unclosed brace", []string{"/a{"}, false, true},
+		{"method", []string{"/a b"}, false, true},
+		{"path token", []string{"/dns-query/", "/kids/"}, true, false},
+		{"path token without slash", []string{"/dns-query/", "/kids"}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := new(Args)
+			a.Auth.PathToken = tt.pathToken
+			for _, p := range tt.paths {
+				a.Entries = append(a.Entries, EntryConfig{Exec: "main", Path: p})
+			}
+			if err := a.init(); (err != nil) != tt.wantErr {
+				t.Fatalf("init() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
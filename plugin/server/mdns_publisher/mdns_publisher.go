@@ -0,0 +1,288 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package mdns_publisher publishes names that are served by mosdns to
+// mdns (RFC 6762), so devices that only do multicast discovery can find
+// them.
+package mdns_publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/mdns"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const PluginType = "mdns_publisher"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	// Entry is the executable that resolves published names. Required.
+	Entry string `yaml:"entry"`
+	// Names to publish, in the format of "<name> [mdns_name]". e.g.
+	// "nas.lan" is published as "nas.local", "printer.home.arpa office-printer"
+	// is published as "office-printer.local". Required.
+	Names []string `yaml:"names"`
+
+	// Interfaces to publish on. Default is all up multicast interfaces,
+	// except loopback.
+	Interfaces []string `yaml:"interfaces"`
+	// TTL of published records. Default is 120.
+	TTL uint32 `yaml:"ttl"`
+	// DisableIPv6 disables publishing on ff02::fb.
+	DisableIPv6 bool `yaml:"disable_ipv6"`
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultNum(&a.TTL, 120)
+	if len(a.Entry) == 0 {
+		return errors.New("missing entry")
+	}
+	if len(a.Names) == 0 {
+		return errors.New("no name is configured")
+	}
+	return nil
+}
+
+type Publisher struct {
+	r      *responder
+	logger *zap.Logger
+
+	conns     []mcastConn
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if err := a.init(); err != nil {
+		return nil, err
+	}
+	entry := sequence.ToExecutable(bp.M().GetPlugin(a.Entry))
+	if entry == nil {
+		return nil, fmt.Errorf("cannot find executable entry by tag %s", a.Entry)
+	}
+	return NewPublisher(a, entry, bp.L())
+}
+
+// NewPublisher joins mdns groups and starts answering queries.
+func NewPublisher(args *Args, entry sequence.Executable, logger *zap.Logger) (*Publisher, error) {
+	names, err := parseNames(args.Names)
+	if err != nil {
+		return nil, err
+	}
+	ifaces, err := mdns.Interfaces(args.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	if len(ifaces) == 0 {
+		return nil, errors.New("no multicast interface is available")
+	}
+
+	p := &Publisher{
+		r:      &responder{entry: entry, names: names, ttl: args.TTL},
+		logger: logger,
+	}
+	c4, err := listenV4(ifaces)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s, %w", mdns.GroupV4, err)
+	}
+	p.conns = append(p.conns, c4)
+	if !args.DisableIPv6 {
+		c6, err := listenV6(ifaces)
+		if err != nil {
+			logger.Warn("failed to listen on ipv6 mdns group, ipv6 is disabled", zap.Error(err))
+		} else {
+			p.conns = append(p.conns, c6)
+		}
+	}
+	for _, c := range p.conns {
+		p.wg.Add(1)
+		go func(c mcastConn) {
+			defer p.wg.Done()
+			p.serve(c)
+		}(c)
+	}
+	logger.Info("mdns publisher started", zap.Int("names", len(names)), zap.Int("interfaces", len(ifaces)))
+	return p, nil
+}
+
+func (p *Publisher) serve(c mcastConn) {
+	b := pool.GetBuf(dns.MaxMsgSize)
+	defer pool.ReleaseBuf(b)
+	for {
+		n, ifIndex, src, err := c.readFrom(*b)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				p.logger.Warn("failed to read mdns packet", zap.Error(err))
+			}
+			return
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack((*b)[:n]); err != nil {
+			continue
+		}
+		srcAddr := src.(*net.UDPAddr).AddrPort()
+		srcAddr = netip.AddrPortFrom(srcAddr.Addr().Unmap(), srcAddr.Port())
+		resp, unicast := p.r.respond(context.Background(), q, srcAddr)
+		if resp == nil {
+			continue
+		}
+		out, err := resp.Pack()
+		if err != nil {
+			p.logger.Warn("failed to pack mdns response", zap.Error(err))
+			continue
+		}
+		dst := c.group()
+		if unicast {
+			dst = src
+		}
+		if err := c.writeTo(out, ifIndex, dst); err != nil {
+			p.logger.Warn("failed to send mdns response", zap.Stringer("dst", dst), zap.Error(err))
+		}
+	}
+}
+
+func (p *Publisher) Close() error {
+	p.closeOnce.Do(func() {
+		for _, c := range p.conns {
+			_ = c.Close()
+		}
+	})
+	p.wg.Wait()
+	return nil
+}
+
+// mcastConn is a multicast socket that reports and selects the interface
+// of each packet.
+type mcastConn interface {
+	readFrom(b []byte) (n int, ifIndex int, src net.Addr, err error)
+	writeTo(b []byte, ifIndex int, dst net.Addr) error
+	group() net.Addr
+	Close() error
+}
+
+// listenV4 listens on the mdns group. The socket is bound to the group
+// address, so it can be shared with other mdns responders (e.g. avahi).
+func listenV4(ifaces []net.Interface) (mcastConn, error) {
+	c, err := net.ListenPacket("udp4", mdns.GroupV4.String())
+	if err != nil {
+		return nil, err
+	}
+	pc := ipv4.NewPacketConn(c)
+	joined := 0
+	for i := range ifaces {
+		if pc.JoinGroup(&ifaces[i], mdns.GroupV4) == nil {
+			joined++
+		}
+	}
+	if joined == 0 {
+		_ = c.Close()
+		return nil, errors.New("failed to join group on any interface")
+	}
+	if err := pc.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	_ = pc.SetMulticastTTL(255)
+	return &conn4{pc: pc}, nil
+}
+
+type conn4 struct {
+	pc *ipv4.PacketConn
+}
+
+func (c *conn4) readFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.pc.ReadFrom(b)
+	ifIndex := 0
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+	return n, ifIndex, src, err
+}
+
+func (c *conn4) writeTo(b []byte, ifIndex int, dst net.Addr) error {
+	_, err := c.pc.WriteTo(b, &ipv4.ControlMessage{IfIndex: ifIndex}, dst)
+	return err
+}
+
+func (c *conn4) group() net.Addr { return mdns.GroupV4 }
+
+func (c *conn4) Close() error { return c.pc.Close() }
+
+func listenV6(ifaces []net.Interface) (mcastConn, error) {
+	c, err := net.ListenPacket("udp6", mdns.GroupV6.String())
+	if err != nil {
+		return nil, err
+	}
+	pc := ipv6.NewPacketConn(c)
+	joined := 0
+	for i := range ifaces {
+		if pc.JoinGroup(&ifaces[i], mdns.GroupV6) == nil {
+			joined++
+		}
+	}
+	if joined == 0 {
+		_ = c.Close()
+		return nil, errors.New("failed to join group on any interface")
+	}
+	if err := pc.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	_ = pc.SetMulticastHopLimit(255)
+	return &conn6{pc: pc}, nil
+}
+
+type conn6 struct {
+	pc *ipv6.PacketConn
+}
+
+func (c *conn6) readFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.pc.ReadFrom(b)
+	ifIndex := 0
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+	return n, ifIndex, src, err
+}
+
+func (c *conn6) writeTo(b []byte, ifIndex int, dst net.Addr) error {
+	_, err := c.pc.WriteTo(b, &ipv6.ControlMessage{IfIndex: ifIndex}, dst)
+	return err
+}
+
+func (c *conn6) group() net.Addr { return mdns.GroupV6 }
+
+func (c *conn6) Close() error { return c.pc.Close() }
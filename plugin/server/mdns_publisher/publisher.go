@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mdns_publisher
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/mdns"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const (
+	// legacyTTL is the max ttl of responses to legacy unicast queries.
+	// See RFC 6762 6.7.
+	legacyTTL = 10
+
+	resolveTimeout = time.Second * 2
+)
+
+// parseNames parses name entries in the format of "<name> [mdns_name]"
+// and returns a map from mdns names (fqdn, in the .local domain) to the
+// names that are resolved by the entry.
+func parseNames(entries []string) (map[string]string, error) {
+	m := make(map[string]string, len(entries))
+	for i, e := range entries {
+		fs := strings.Fields(e)
+		if len(fs) == 0 || len(fs) > 2 {
+			return nil, fmt.Errorf("invalid name entry #%d %q", i, e)
+		}
+		name := dns.Fqdn(strings.ToLower(fs[0]))
+		var local string
+		if len(fs) == 2 {
+			local = strings.ToLower(fs[1])
+		} else {
+			local = dns.SplitDomainName(name)[0]
+		}
+		local = strings.TrimSuffix(dns.Fqdn(local), "local.")
+		if label := strings.TrimSuffix(local, "."); len(label) == 0 || strings.Contains(label, ".") {
+			return nil, fmt.Errorf("invalid mdns name in entry #%d %q, mdns names must have a single label", i, e)
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("invalid name in entry #%d %q", i, e)
+		}
+		local += "local."
+		if _, dup := m[local]; dup {
+			return nil, fmt.Errorf("duplicated mdns name %s", local)
+		}
+		m[local] = name
+	}
+	return m, nil
+}
+
+// responder answers mdns queries of published names with records that are
+// resolved by the entry.
+type responder struct {
+	entry sequence.Executable
+	names map[string]string
+	ttl   uint32
+}
+
+// respond returns the response of q from src. It returns nil if q should
+// not be answered. unicast reports whether the response should be sent
+// to src directly instead of the multicast group.
+func (r *responder) respond(ctx context.Context, q *dns.Msg, src netip.AddrPort) (resp *dns.Msg, unicast bool) {
+	if q.Response || q.Opcode != dns.OpcodeQuery || q.Rcode != dns.RcodeSuccess {
+		return nil, false
+	}
+	// Legacy unicast queries are sent from ports other than 5353. They
+	// expect conventional dns responses. See RFC 6762 6.7.
+	legacy := src.Port() != mdns.Port
+
+	resp = new(dns.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+	unicast = true // all answered questions requested unicast responses
+	for _, question := range q.Question {
+		name, ok := r.names[strings.ToLower(question.Name)]
+		if !ok {
+			continue
+		}
+		if question.Qclass&mdns.UnicastResponseBit == 0 {
+			unicast = false
+		}
+		for _, rr := range r.resolve(ctx, name, question.Qtype, src) {
+			rr.Header().Name = question.Name
+			rr.Header().Ttl = r.ttl
+			if legacy {
+				rr.Header().Ttl = min(r.ttl, legacyTTL)
+			} else {
+				rr.Header().Class |= mdns.CacheFlushBit
+			}
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if len(resp.Answer) == 0 {
+		return nil, false
+	}
+	if legacy {
+		resp.Id = q.Id
+		resp.Question = q.Question
+		unicast = true
+	}
+	return resp, unicast
+}
+
+// resolve resolves name with the entry. Only A and AAAA records are returned.
+func (r *responder) resolve(ctx context.Context, name string, qtype uint16, src netip.AddrPort) []dns.RR {
+	var qtypes []uint16
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		qtypes = []uint16{qtype}
+	case dns.TypeANY:
+		qtypes = []uint16{dns.TypeA, dns.TypeAAAA}
+	default:
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	var rrs []dns.RR
+	for _, t := range qtypes {
+		q := new(dns.Msg)
+		q.SetQuestion(name, t)
+		qCtx := query_context.NewContext(q)
+		qCtx.ServerMeta.ClientAddr = src.Addr()
+		if err := r.entry.Exec(ctx, qCtx); err != nil {
+			continue
+		}
+		resp := qCtx.R()
+		if resp == nil || resp.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype == t {
+				rrs = append(rrs, dns.Copy(rr))
+			}
+		}
+	}
+	return rrs
+}
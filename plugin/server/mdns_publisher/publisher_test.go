@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mdns_publisher
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/mdns"
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+)
+
+func Test_parseNames(t *testing.T) {
+	m, err := parseNames([]string{"nas.lan", "Printer.Home.Arpa office-printer", "tv.lan tv.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"nas.local.":            "nas.lan.",
+		"office-printer.local.": "printer.home.arpa.",
+		"tv.local.":             "tv.lan.",
+	}
+	for k, v := range want {
+		if m[k] != v {
+			t.Errorf("want %s -> %s, got %s", k, v, m[k])
+		}
+	}
+
+	for _, bad := range [][]string{
+		{"nas.lan", "nas.home"},
+		{"nas.lan a.b"},
+		{"nas.lan .local"},
+		{"a b c"},
+	} {
+		if _, err := parseNames(bad); err == nil {
+			t.Errorf("want an error for %v", bad)
+		}
+	}
+}
+
+func Test_responder(t *testing.T) {
+	names, err := parseNames([]string{"nas.lan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := plugintest.Answer("@ 300 IN A 192.168.1.10", "@ 300 IN AAAA fd00::10")
+	r := &responder{entry: entry, names: names, ttl: 120}
+
+	query := func(name string, qtype uint16, qu bool) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		q.Id = 0
+		if qu {
+			q.Question[0].Qclass |= mdns.UnicastResponseBit
+		}
+		return q
+	}
+	mdnsSrc := netip.MustParseAddrPort("192.168.1.2:5353")
+
+	resp, unicast := r.respond(context.Background(), query("NAS.local.", dns.TypeA, false), mdnsSrc)
+	if resp == nil || unicast {
+		t.Fatalf("want a multicast response, got %v, %v", resp, unicast)
+	}
+	if len(resp.Answer) != 1 || len(resp.Question) != 0 || !resp.Authoritative {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	h := resp.Answer[0].Header()
+	if h.Name != "NAS.local." || h.Rrtype != dns.TypeA || h.Ttl != 120 || h.Class != dns.ClassINET|mdns.CacheFlushBit {
+		t.Fatalf("unexpected record %v", resp.Answer[0])
+	}
+
+	if _, unicast := r.respond(context.Background(), query("nas.local.", dns.TypeANY, true), mdnsSrc); !unicast {
+		t.Fatal("want a unicast response")
+	}
+
+	// Legacy unicast query.
+	q := query("nas.local.", dns.TypeANY, false)
+	q.Id = 1234
+	resp, unicast = r.respond(context.Background(), q, netip.MustParseAddrPort("192.168.1.2:40000"))
+	if resp == nil || !unicast || resp.Id != 1234 || len(resp.Question) != 1 || len(resp.Answer) != 2 {
+		t.Fatalf("unexpected legacy response %v", resp)
+	}
+	if h := resp.Answer[0].Header(); h.Ttl != legacyTTL || h.Class != dns.ClassINET {
+		t.Fatalf("unexpected legacy record %v", resp.Answer[0])
+	}
+
+	// Not published names and responses are ignored.
+	if resp, _ := r.respond(context.Background(), query("other.local.", dns.TypeA, false), mdnsSrc); resp != nil {
+		t.Fatalf("want no response, got %v", resp)
+	}
+	q = query("nas.local.", dns.TypeA, false)
+	q.Response = true
+	if resp, _ := r.respond(context.Background(), q, mdnsSrc); resp != nil {
+		t.Fatalf("want no response, got %v", resp)
+	}
+}
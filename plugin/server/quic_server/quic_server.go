@@ -20,10 +20,12 @@
 package quic_server
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -40,12 +42,35 @@ func init() {
 	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
 }
 
+// Args of quic_server. It serves DNS over QUIC (RFC 9250).
 type Args struct {
 	Entry       string `yaml:"entry"`
 	Listen      string `yaml:"listen"`
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
-	IdleTimeout int    `yaml:"idle_timeout"`
+	IdleTimeout int    `yaml:"idle_timeout"` // (seconds) default is 30.
+
+	// Allow0RTT accepts queries in 0-RTT data from clients that resume
+	// previous sessions, which saves a round trip on reconnects. 0-RTT data
+	// can be replayed, zone transfers are not handled before handshakes
+	// complete.
+	Allow0RTT bool `yaml:"allow_0rtt"`
+
+	// MinimalANY answers ANY queries with a HINFO record (RFC 8482)
+	// instead of executing the entry.
+	MinimalANY bool `yaml:"minimal_any"`
+
+	// Edns0Meta accepts the identity of original clients (address,
+	// client group and marks) from trusted front proxies.
+	Edns0Meta server_utils.MetaArgs `yaml:"edns0_meta"`
+
+	// ClientID reads the client id (e.g. the MAC address) of queries.
+	ClientID server_utils.ClientIDArgs `yaml:"client_id"`
+
+	// Auth authenticates clients. DoQ has no way to carry tokens or
+	// passwords, so only client certificates are supported. If auth is
+	// configured, 0-RTT data is not used.
+	Auth server_utils.AuthArgs `yaml:"auth"`
 }
 
 func (a *Args) init() {
@@ -55,11 +80,33 @@ func (a *Args) init() {
 type QuicServer struct {
 	args *Args
 
-	l *quic.Listener
+	l        *quic.EarlyListener
+	t        *quic.Transport
+	stopOnce sync.Once
+	stop     chan struct{}
 }
 
+var _ coremain.ListenerStopper = (*QuicServer)(nil)
+
+// Addr returns the listening address.
+func (s *QuicServer) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+// Close closes the listener, and connections that are still served.
 func (s *QuicServer) Close() error {
-	return s.l.Close()
+	_ = s.l.Close()
+	err := s.t.Close()
+	if closeErr := s.t.Conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// StopListening implements coremain.ListenerStopper. It closes the
+// listener. Accepted connections are still served until s is closed.
+func (s *QuicServer) StopListening() {
+	s.stopOnce.Do(func() { close(s.stop) })
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -69,11 +116,19 @@ func Init(bp *coremain.BP, args any) (any, error) {
 func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	logger := bp.L()
 
-	dh, err := server_utils.NewHandler(bp, args.Entry)
+	dh, err := server_utils.NewHandler(bp, args.Entry, server_utils.HandlerOpts{MinimalANY: args.MinimalANY, Meta: &args.Edns0Meta, ClientID: &args.ClientID})
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
 
+	if len(args.Auth.Tokens)+len(args.Auth.BasicAuth) > 0 {
+		return nil, errors.New("quic server only supports client certificate auth")
+	}
+	auth, err := server_utils.NewClientAuth(&args.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth args, %w", err)
+	}
+
 	// Init tls
 	if len(args.Key) == 0 || len(args.Cert) == 0 {
 		return nil, errors.New("quic server requires a tls certificate")
@@ -82,9 +137,16 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	if err := server.LoadCert(tlsConfig, args.Cert, args.Key); err != nil {
 		return nil, fmt.Errorf("failed to read tls cert, %w", err)
 	}
+	if err := server_utils.SetupClientCA(tlsConfig, &args.Auth); err != nil {
+		return nil, err
+	}
 	tlsConfig.NextProtos = []string{"doq"}
 
-	uc, err := net.ListenPacket("udp", args.Listen)
+	socketOpt := server_utils.ListenerSocketOpts{
+		SO_REUSEPORT: true,
+	}
+	lc := net.ListenConfig{Control: server_utils.ListenerControl(socketOpt)}
+	uc, err := lc.ListenPacket(context.Background(), "udp", args.Listen)
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen socket, %w", err)
 	}
@@ -97,7 +159,7 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 		MaxStreamReceiveWindow:         4 * 1024,
 		InitialConnectionReceiveWindow: 8 * 1024,
 		MaxConnectionReceiveWindow:     16 * 1024,
-		Allow0RTT:                      false,
+		Allow0RTT:                      args.Allow0RTT,
 
 		// UniStream is not allowed.
 		MaxIncomingUniStreams: -1,
@@ -112,21 +174,28 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 		StatelessResetKey: (*quic.StatelessResetKey)(srk),
 	}
 
-	quicListener, err := qt.Listen(tlsConfig, quicConfig)
+	quicListener, err := qt.ListenEarly(tlsConfig, quicConfig)
 	if err != nil {
 		qt.Close()
 		return nil, fmt.Errorf("failed to listen quic, %w", err)
 	}
 	bp.L().Info("quic server started", zap.Stringer("addr", quicListener.Addr()))
 
+	s := &QuicServer{
+		args: args,
+		l:    quicListener,
+		t:    qt,
+		stop: make(chan struct{}),
+	}
 	go func() {
 		defer quicListener.Close()
-		serverOpts := server.DoQServerOpts{Logger: bp.L(), IdleTimeout: idleTimeout}
+		serverOpts := server.DoQServerOpts{Logger: bp.L(), IdleTimeout: idleTimeout, Auth: auth, StopAccepting: s.stop}
 		err := server.ServeDoQ(quicListener, dh, serverOpts)
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		select {
+		case <-s.stop: // the old instance of a graceful reload is closing
+		default:
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &QuicServer{
-		args: args,
-		l:    quicListener,
-	}, nil
+	return s, nil
 }
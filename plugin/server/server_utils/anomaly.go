@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// AnomalyArgs configures counters of suspicious queries (malformed,
+// unexpected opcode, oversized and spoofed-looking) of a listener.
+// Counters are always enabled. Bans are optional.
+type AnomalyArgs struct {
+	// Queries larger than this are oversized. Default is 512.
+	MaxQuerySize int `yaml:"max_query_size"`
+
+	// Drop udp queries from spoofed-looking sources (e.g. source port 0,
+	// 53 or 123). By default, they are only counted.
+	DropSpoofed bool `yaml:"drop_spoofed"`
+
+	// A client is banned for ban_duration seconds after it sent
+	// ban_threshold anomalies within ban_window seconds.
+	// Zero ban_threshold disables bans.
+	BanThreshold int `yaml:"ban_threshold"`
+	BanWindow    int `yaml:"ban_window"`   // default is 60
+	BanDuration  int `yaml:"ban_duration"` // default is 600
+}
+
+// NewAnomalyTracker returns a tracker of the listener bp, and registers
+// its counters to bp's metrics registry.
+func NewAnomalyTracker(bp *coremain.BP, a *AnomalyArgs) (*server.AnomalyTracker, error) {
+	window, duration := a.BanWindow, a.BanDuration
+	if window <= 0 {
+		window = 60
+	}
+	if duration <= 0 {
+		duration = 600
+	}
+	t := server.NewAnomalyTracker(server.AnomalyOpts{
+		MaxQuerySize: a.MaxQuerySize,
+		DropSpoofed:  a.DropSpoofed,
+		BanThreshold: a.BanThreshold,
+		BanWindow:    time.Duration(window) * time.Second,
+		BanDuration:  time.Duration(duration) * time.Second,
+		OnBan: func(client netip.Addr) {
+			bp.L().Warn("client banned due to anomalies", zap.Stringer("client", client), zap.Int("duration", duration))
+		},
+	})
+
+	lb := prometheus.Labels{"tag": bp.Tag()}
+	var cs []prometheus.Collector
+	for _, k := range server.AllAnomalyKinds() {
+		k := k
+		cs = append(cs, prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "listener_anomaly_total",
+			Help:        "The total number of suspicious queries of the listener",
+			ConstLabels: prometheus.Labels{"tag": bp.Tag(), "kind": k.String()},
+		}, func() float64 { return float64(t.Count(k)) }))
+	}
+	cs = append(cs, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "listener_banned_clients",
+		Help:        "The number of clients that are banned by the listener",
+		ConstLabels: lb,
+	}, func() float64 { return float64(t.BannedClients()) }))
+	for _, c := range cs {
+		if err := bp.M().GetMetricsReg().Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register metrics, %w", err)
+		}
+	}
+	return t, nil
+}
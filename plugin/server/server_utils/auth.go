@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+)
+
+// AuthArgs configures client authentication of encrypted listeners.
+// Authenticated clients get a client group, which can be matched
+// by the client_group matcher.
+type AuthArgs struct {
+	Tokens    map[string]string `yaml:"tokens"` // token -> client group
+	BasicAuth []struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+		Group    string `yaml:"group"`
+	} `yaml:"basic_auth"`
+
+	// PathToken also accepts tokens as the last element of the url
+	// path, e.g. "/dns-query/<token>". Entry paths must end with a slash.
+	PathToken bool `yaml:"path_token"`
+
+	// ClientCA is a pem file of CAs to verify client certificates (mTLS).
+	ClientCA string `yaml:"client_ca"`
+	// CertGroups maps certificate common names to client groups.
+	CertGroups map[string]string `yaml:"cert_groups"`
+
+	// Required rejects clients that cannot be authenticated.
+	Required bool `yaml:"required"`
+}
+
+func (a *AuthArgs) enabled() bool {
+	return len(a.Tokens)+len(a.BasicAuth)+len(a.ClientCA) > 0
+}
+
+// NewClientAuth returns a nil ClientAuth if auth is not configured.
+func NewClientAuth(a *AuthArgs) (*server.ClientAuth, error) {
+	if !a.enabled() {
+		if a.Required || len(a.CertGroups) > 0 {
+			return nil, errors.New("auth is required but no token, basic_auth or client_ca is configured")
+		}
+		return nil, nil
+	}
+	if a.PathToken && len(a.Tokens) == 0 {
+		return nil, errors.New("path_token requires tokens")
+	}
+	if len(a.CertGroups) > 0 && len(a.ClientCA) == 0 {
+		return nil, errors.New("cert_groups requires client_ca")
+	}
+	for token := range a.Tokens {
+		if len(token) == 0 {
+			return nil, errors.New("empty token")
+		}
+	}
+	ca := &server.ClientAuth{
+		Tokens:     a.Tokens,
+		PathToken:  a.PathToken,
+		CertGroups: a.CertGroups,
+		Required:   a.Required,
+	}
+	if len(a.BasicAuth) > 0 {
+		ca.Users = make(map[string]server.BasicUser)
+		for _, u := range a.BasicAuth {
+			if len(u.Username) == 0 {
+				return nil, errors.New("basic_auth user has an empty username")
+			}
+			if len(u.Password) == 0 {
+				return nil, fmt.Errorf("basic_auth user %s has an empty password", u.Username)
+			}
+			ca.Users[u.Username] = server.BasicUser{Password: u.Password, Group: u.Group}
+		}
+	}
+	return ca, nil
+}
+
+// SetupClientCA configures tc to verify client certificates if
+// a client CA is configured.
+func SetupClientCA(tc *tls.Config, a *AuthArgs) error {
+	if len(a.ClientCA) == 0 {
+		return nil
+	}
+	b, err := os.ReadFile(a.ClientCA)
+	if err != nil {
+		return fmt.Errorf("failed to read client ca, %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("no valid certificate in %s", a.ClientCA)
+	}
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
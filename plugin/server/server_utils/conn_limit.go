@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConnLimitArgs configures limits of concurrent persistent connections.
+// Connections are always counted. Zero means no limit.
+type ConnLimitArgs struct {
+	MaxConnsPerClient int `yaml:"max_conns_per_client"`
+	MaxConns          int `yaml:"max_conns"`
+}
+
+// NewConnLimiter returns a limiter of the listener bp, registers its
+// metrics to bp's metrics registry and its api (GET /conns?n=) to bp.
+func NewConnLimiter(bp *coremain.BP, a *ConnLimitArgs) (*server.ConnLimiter, error) {
+	if a.MaxConnsPerClient < 0 || a.MaxConns < 0 {
+		return nil, fmt.Errorf("negative connection limit")
+	}
+	l := server.NewConnLimiter(server.ConnLimitOpts{MaxPerClient: a.MaxConnsPerClient, MaxTotal: a.MaxConns})
+
+	lb := prometheus.Labels{"tag": bp.Tag()}
+	cs := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "listener_conns",
+			Help:        "The number of connections of the listener",
+			ConstLabels: lb,
+		}, func() float64 { return float64(l.Stats().Conns) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "listener_conn_clients",
+			Help:        "The number of clients that have connections to the listener",
+			ConstLabels: lb,
+		}, func() float64 { return float64(l.Stats().Clients) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "listener_client_conns_max",
+			Help:        "The number of connections of the busiest client of the listener",
+			ConstLabels: lb,
+		}, func() float64 { return float64(l.Stats().MaxClientConns) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "listener_conn_rejected_total",
+			Help:        "The total number of connections that were rejected by limits",
+			ConstLabels: lb,
+		}, func() float64 { return float64(l.Rejected()) }),
+	}
+	for _, c := range cs {
+		if err := bp.M().GetMetricsReg().Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register metrics, %w", err)
+		}
+	}
+
+	r := chi.NewRouter()
+	r.Get("/conns", func(w http.ResponseWriter, req *http.Request) {
+		n := 100
+		if s := req.URL.Query().Get("n"); len(s) > 0 {
+			i, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+			n = i
+		}
+		type client struct {
+			Client string `json:"client"`
+			Conns  int    `json:"conns"`
+		}
+		var list []client
+		for _, c := range l.Top(n) {
+			list = append(list, client{Client: c.Client.String(), Conns: c.Conns})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(list)
+	})
+	bp.RegAPI(r)
+	return l, nil
+}
@@ -20,24 +20,129 @@
 package server_utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-func NewHandler(bp *coremain.BP, entry string) (server.Handler, error) {
+// HandlerOpts are listener options of the dns handler.
+type HandlerOpts struct {
+	// MinimalANY answers ANY queries with a HINFO record (RFC 8482).
+	MinimalANY bool
+
+	// Meta accepts query metadata from trusted clients. Can be nil.
+	Meta *MetaArgs
+
+	// ClientID reads the client id from EDNS0 options. Can be nil.
+	ClientID *ClientIDArgs
+}
+
+func NewHandler(bp *coremain.BP, entry string, opts HandlerOpts) (server.Handler, error) {
 	p := bp.M().GetPlugin(entry)
 	exec := sequence.ToExecutable(p)
 	if exec == nil {
 		return nil, fmt.Errorf("cannot find executable entry by tag %s", entry)
 	}
 
+	mismatch, err := questionMismatchCounter(bp)
+	if err != nil {
+		return nil, err
+	}
+	queries, responses, err := queryCounters(bp)
+	if err != nil {
+		return nil, err
+	}
+	metaCode, metaTrusted, err := opts.Meta.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid edns0_meta args, %w", err)
+	}
+	idCodes, idTrusted, err := opts.ClientID.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid client_id args, %w", err)
+	}
+
 	handlerOpts := server_handler.EntryHandlerOpts{
-		Logger: bp.L(),
-		Entry:  exec,
+		Logger:             bp.L(),
+		Entry:              exec,
+		Inflight:           bp.M().InflightCounter(),
+		QueryLog:           bp.M().QueryLogHub(),
+		OnQuery:            bp.M().QueryObserver(),
+		MinimalANY:         opts.MinimalANY,
+		OnQuestionMismatch: mismatch.Inc,
+		OnResponse: func(rcode int) {
+			responses.WithLabelValues(dns.RcodeToString[rcode]).Inc()
+		},
+		MetaTrusted:       metaTrusted,
+		MetaOptionCode:    metaCode,
+		ClientAddrFromECS: opts.Meta != nil && opts.Meta.ECS,
+		ClientIDCodes:     idCodes,
+		ClientIDTrusted:   idTrusted,
+	}
+	return &countingHandler{Handler: server_handler.NewEntryHandler(handlerOpts), queries: queries}, nil
+}
+
+// countingHandler counts queries, including queries that have no
+// response.
+type countingHandler struct {
+	server.Handler
+	queries prometheus.Counter
+}
+
+func (h *countingHandler) Handle(ctx context.Context, q *dns.Msg, meta server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	h.queries.Inc()
+	return h.Handler.Handle(ctx, q, meta, packMsgPayload)
+}
+
+// questionMismatchCounter returns the counter of responses of the listener
+// bp that didn't match their queries. Handlers of the same listener share it.
+func questionMismatchCounter(bp *coremain.BP) (prometheus.Counter, error) {
+	c := prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "listener_question_mismatch_total",
+		Help:        "The total number of responses that didn't echo the id or question of the query",
+		ConstLabels: prometheus.Labels{"tag": bp.Tag()},
+	})
+	return regOrExisting(bp, c)
+}
+
+// queryCounters returns counters of queries and responses (by rcode)
+// of the listener bp. Handlers of the same listener share them.
+func queryCounters(bp *coremain.BP) (prometheus.Counter, *prometheus.CounterVec, error) {
+	q, err := regOrExisting[prometheus.Counter](bp, prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "listener_queries_total",
+		Help:        "The total number of queries received by the listener",
+		ConstLabels: prometheus.Labels{"tag": bp.Tag()},
+	}))
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := regOrExisting(bp, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "listener_responses_total",
+		Help:        "The total number of responses sent by the listener",
+		ConstLabels: prometheus.Labels{"tag": bp.Tag()},
+	}, []string{"rcode"}))
+	if err != nil {
+		return nil, nil, err
+	}
+	return q, r, nil
+}
+
+// regOrExisting registers c, or returns the collector that has been
+// registered by another handler of the same listener.
+func regOrExisting[T prometheus.Collector](bp *coremain.BP, c T) (T, error) {
+	if err := bp.M().GetMetricsReg().Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector.(T), nil
+		}
+		var zero T
+		return zero, fmt.Errorf("failed to register metrics, %w", err)
 	}
-	return server_handler.NewEntryHandler(handlerOpts), nil
+	return c, nil
 }
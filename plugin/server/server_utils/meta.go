@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+)
+
+// MetaArgs configures trusted front proxies, whose queries carry the
+// identity of the original clients, by the edns0_meta plugin of another
+// mosdns or by ECS. Matchers then see the original clients instead of
+// the proxies.
+type MetaArgs struct {
+	// Trusted clients, ip addresses or prefixes. Metadata from other
+	// clients is ignored. Metadata is disabled if it's empty.
+	Trusted []string `yaml:"trusted"`
+
+	// Code of the option. Default is dnsutils.DefaultMetaOptionCode.
+	Code uint16 `yaml:"code"`
+
+	// ECS uses the address in the ECS option as the client address.
+	// Note that it's usually a truncated subnet address.
+	ECS bool `yaml:"ecs"`
+}
+
+// parse returns a zero code if metadata is disabled.
+func (a *MetaArgs) parse() (uint16, func(netip.Addr) bool, error) {
+	if a == nil || len(a.Trusted) == 0 {
+		return 0, nil, nil
+	}
+	trusted, err := parseTrusted(a.Trusted)
+	if err != nil {
+		return 0, nil, err
+	}
+	code := a.Code
+	if code == 0 {
+		code = dnsutils.DefaultMetaOptionCode
+	}
+	return code, trusted, nil
+}
+
+// ClientIDArgs configures how the client id (e.g. the MAC address of the
+// device) of queries is read. Matchers can match it by "client_id".
+type ClientIDArgs struct {
+	// EDNS0 reads the id from EDNS0 options that are inserted by
+	// forwarders like dnsmasq (--add-mac, --add-cpe-id) and OpenWrt.
+	EDNS0 bool `yaml:"edns0"`
+
+	// Codes of the options. Default is dnsutils.DefaultClientIDCodes.
+	Codes []uint16 `yaml:"codes"`
+
+	// Trusted clients, ip addresses or prefixes. If it's not empty, ids
+	// from other clients are ignored.
+	Trusted []string `yaml:"trusted"`
+
+	// URLParam is the url query parameter that carries the id. Only for
+	// DoH listeners. e.g. "id" for "/dns-query?id=kids-tablet".
+	URLParam string `yaml:"url_param"`
+}
+
+// parse returns nil codes if EDNS0 is disabled. trusted is nil if all
+// clients are trusted.
+func (a *ClientIDArgs) parse() (codes []uint16, trusted func(netip.Addr) bool, err error) {
+	if a == nil || !a.EDNS0 {
+		return nil, nil, nil
+	}
+	codes = a.Codes
+	if len(codes) == 0 {
+		codes = dnsutils.DefaultClientIDCodes
+	}
+	if len(a.Trusted) > 0 {
+		trusted, err = parseTrusted(a.Trusted)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return codes, trusted, nil
+}
+
+// parseTrusted returns a func that reports whether an address is in l,
+// a list of ip addresses or prefixes.
+func parseTrusted(l []string) (func(netip.Addr) bool, error) {
+	var prefixes []netip.Prefix
+	for _, s := range l {
+		var p netip.Prefix
+		var err error
+		if strings.Contains(s, "/") {
+			p, err = netip.ParsePrefix(s)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(s)
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted client %s, %w", s, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return func(addr netip.Addr) bool {
+		addr = addr.Unmap()
+		for _, p := range prefixes {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
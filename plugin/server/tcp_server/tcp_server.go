@@ -22,6 +22,7 @@ package tcp_server
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -46,6 +47,26 @@ type Args struct {
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+
+	// Auth requires tls. Only client certificates are supported.
+	Auth server_utils.AuthArgs `yaml:"auth"`
+
+	// Anomaly configures counters of suspicious queries and client bans.
+	Anomaly server_utils.AnomalyArgs `yaml:"anomaly"`
+
+	// MinimalANY answers ANY queries with a HINFO record (RFC 8482)
+	// instead of executing the entry.
+	MinimalANY bool `yaml:"minimal_any"`
+
+	// Edns0Meta accepts the identity of original clients (address,
+	// client group and marks) from trusted front proxies.
+	Edns0Meta server_utils.MetaArgs `yaml:"edns0_meta"`
+
+	// ClientID reads the client id (e.g. the MAC address) of queries.
+	ClientID server_utils.ClientIDArgs `yaml:"client_id"`
+
+	// ConnLimit limits concurrent connections per client.
+	ConnLimit server_utils.ConnLimitArgs `yaml:"conn_limit"`
 }
 
 func (a *Args) init() {
@@ -56,23 +77,45 @@ func (a *Args) init() {
 type TcpServer struct {
 	args *Args
 
-	l net.Listener
+	l  net.Listener
+	sl *utils.StoppableListener // the listener under tls
 }
 
+var _ coremain.ListenerStopper = (*TcpServer)(nil)
+
 func (s *TcpServer) Close() error {
 	return s.l.Close()
 }
 
+// StopListening implements coremain.ListenerStopper. Accepted
+// connections are still served until s is closed.
+func (s *TcpServer) StopListening() {
+	s.sl.Stop()
+}
+
+// Addr returns the listening address.
+func (s *TcpServer) Addr() net.Addr {
+	return s.l.Addr()
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
 
 func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
-	dh, err := server_utils.NewHandler(bp, args.Entry)
+	dh, err := server_utils.NewHandler(bp, args.Entry, server_utils.HandlerOpts{MinimalANY: args.MinimalANY, Meta: &args.Edns0Meta, ClientID: &args.ClientID})
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
 
+	if len(args.Auth.Tokens)+len(args.Auth.BasicAuth) > 0 {
+		return nil, errors.New("tcp server only supports client certificate auth")
+	}
+	auth, err := server_utils.NewClientAuth(&args.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth args, %w", err)
+	}
+
 	// Init tls
 	var tc *tls.Config
 	if len(args.Key)+len(args.Cert) > 0 {
@@ -80,6 +123,20 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 		if err := server.LoadCert(tc, args.Cert, args.Key); err != nil {
 			return nil, fmt.Errorf("failed to read tls cert, %w", err)
 		}
+		if err := server_utils.SetupClientCA(tc, &args.Auth); err != nil {
+			return nil, err
+		}
+	} else if auth != nil {
+		return nil, errors.New("auth requires tls")
+	}
+
+	anomaly, err := server_utils.NewAnomalyTracker(bp, &args.Anomaly)
+	if err != nil {
+		return nil, err
+	}
+	connLimiter, err := server_utils.NewConnLimiter(bp, &args.ConnLimit)
+	if err != nil {
+		return nil, err
 	}
 
 	socketOpt := server_utils.ListenerSocketOpts{
@@ -91,10 +148,12 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 	if strings.HasPrefix(args.Listen, "@") {
 		listenerNetwork = "unix"
 	}
-	l, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
+	rawL, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen socket, %w", err)
 	}
+	sl := utils.NewStoppableListener(rawL)
+	var l net.Listener = sl
 	if tc != nil {
 		l = tls.NewListener(l, tc)
 	}
@@ -102,12 +161,13 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 
 	go func() {
 		defer l.Close()
-		serverOpts := server.TCPServerOpts{Logger: bp.L(), IdleTimeout: time.Duration(args.IdleTimeout) * time.Second}
+		serverOpts := server.TCPServerOpts{Logger: bp.L(), IdleTimeout: time.Duration(args.IdleTimeout) * time.Second, Auth: auth, Anomaly: anomaly, ConnLimiter: connLimiter}
 		err := server.ServeTCP(l, dh, serverOpts)
 		bp.M().GetSafeClose().SendCloseSignal(err)
 	}()
 	return &TcpServer{
 		args: args,
 		l:    l,
+		sl:   sl,
 	}, nil
 }
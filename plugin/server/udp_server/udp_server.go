@@ -23,6 +23,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
@@ -40,6 +41,20 @@ func init() {
 type Args struct {
 	Entry  string `yaml:"entry"`
 	Listen string `yaml:"listen"`
+
+	// Anomaly configures counters of suspicious queries and client bans.
+	Anomaly server_utils.AnomalyArgs `yaml:"anomaly"`
+
+	// MinimalANY answers ANY queries with a HINFO record (RFC 8482)
+	// instead of executing the entry.
+	MinimalANY bool `yaml:"minimal_any"`
+
+	// Edns0Meta accepts the identity of original clients (address,
+	// client group and marks) from trusted front proxies.
+	Edns0Meta server_utils.MetaArgs `yaml:"edns0_meta"`
+
+	// ClientID reads the client id (e.g. the MAC address) of queries.
+	ClientID server_utils.ClientIDArgs `yaml:"client_id"`
 }
 
 func (a *Args) init() {
@@ -49,23 +64,43 @@ func (a *Args) init() {
 type UdpServer struct {
 	args *Args
 
-	c net.PacketConn
+	c        net.PacketConn
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+var _ coremain.ListenerStopper = (*UdpServer)(nil)
+
+// Addr returns the listening address.
+func (s *UdpServer) Addr() net.Addr {
+	return s.c.LocalAddr()
 }
 
 func (s *UdpServer) Close() error {
 	return s.c.Close()
 }
 
+// StopListening implements coremain.ListenerStopper. Queries in flight
+// are still answered until s is closed.
+func (s *UdpServer) StopListening() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
 
 func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
-	dh, err := server_utils.NewHandler(bp, args.Entry)
+	dh, err := server_utils.NewHandler(bp, args.Entry, server_utils.HandlerOpts{MinimalANY: args.MinimalANY, Meta: &args.Edns0Meta, ClientID: &args.ClientID})
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
 
+	anomaly, err := server_utils.NewAnomalyTracker(bp, &args.Anomaly)
+	if err != nil {
+		return nil, err
+	}
+
 	socketOpt := server_utils.ListenerSocketOpts{
 		SO_REUSEPORT: true,
 		SO_RCVBUF:    64 * 1024,
@@ -77,13 +112,15 @@ func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
 	}
 	bp.L().Info("udp server started", zap.Stringer("addr", c.LocalAddr()))
 
+	s := &UdpServer{
+		args: args,
+		c:    c,
+		stop: make(chan struct{}),
+	}
 	go func() {
 		defer c.Close()
-		err := server.ServeUDP(c.(*net.UDPConn), dh, server.UDPServerOpts{Logger: bp.L()})
+		err := server.ServeUDP(c.(*net.UDPConn), dh, server.UDPServerOpts{Logger: bp.L(), Anomaly: anomaly, StopAccepting: s.stop})
 		bp.M().GetSafeClose().SendCloseSignal(err)
 	}()
-	return &UdpServer{
-		args: args,
-		c:    c,
-	}, nil
+	return s, nil
 }
@@ -0,0 +1,238 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package update_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// recordsBody is the json body of POST and PUT "/records".
+// Records are in zone file format, e.g. "pc.lan. 300 IN A 192.168.1.2".
+type recordsBody struct {
+	Records []string `json:"records"`
+}
+
+// applyBody is the json body of POST "/apply".
+type applyBody struct {
+	Records []string `json:"records"`
+	// Zones that will be replaced. Records of other zones are kept.
+	// Default is all zones.
+	Zones []string `json:"zones"`
+	// DryRun only returns the diff.
+	DryRun bool `json:"dry_run"`
+}
+
+// skippedBody is the json response of "/records" if some records were
+// skipped.
+type skippedBody struct {
+	Skipped []string `json:"skipped"`
+}
+
+// applyResult is the json response of POST "/apply".
+type applyResult struct {
+	Changed bool `json:"changed"`
+	diff
+}
+
+// api registers:
+//   - GET "/records", lists records. Url query "name" filters records by name.
+//   - POST "/records", adds records.
+//   - PUT "/records", replaces records of the same names and types.
+//   - DELETE "/records", deletes records of url query "name" and
+//     optional "type".
+//   - POST "/apply", replaces all records with the desired records, see
+//     applyBody. It returns the diff. Applying the same records again
+//     changes nothing, so it can be used by configuration management tools.
+//
+// Changes take effect immediately and are saved to the file.
+func (u *UpdateServer) api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/records", func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("name")
+		l := make([]string, 0)
+		for _, rr := range u.s.all() {
+			if len(name) > 0 && !strings.EqualFold(rr.Header().Name, dns.Fqdn(name)) {
+				continue
+			}
+			l = append(l, rr.String())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l)
+	})
+	r.Post("/records", func(w http.ResponseWriter, req *http.Request) {
+		rrs, err := readRecords(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u.applyAPI(w, rrs)
+	})
+	r.Put("/records", func(w http.ResponseWriter, req *http.Request) {
+		rrs, err := readRecords(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.RemoveRRset(rrs)
+		u.applyAPI(w, append(m.Ns, rrs...))
+	})
+	r.Delete("/records", func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		name := q.Get("name")
+		if _, ok := dns.IsDomainName(name); !ok || len(name) == 0 {
+			http.Error(w, "invalid name", http.StatusBadRequest)
+			return
+		}
+		name = dns.Fqdn(name)
+		m := new(dns.Msg)
+		if s := q.Get("type"); len(s) > 0 {
+			t, ok := dns.StringToType[strings.ToUpper(s)]
+			if !ok {
+				http.Error(w, "invalid type", http.StatusBadRequest)
+				return
+			}
+			m.RemoveRRset([]dns.RR{&dns.RR_Header{Name: name, Rrtype: t, Class: dns.ClassINET}})
+		} else {
+			m.RemoveName([]dns.RR{&dns.RR_Header{Name: name}})
+		}
+		u.applyAPI(w, m.Ns)
+	})
+	r.Post("/apply", func(w http.ResponseWriter, req *http.Request) {
+		var body applyBody
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		zones := u.args.Zones
+		if len(body.Zones) > 0 {
+			zones = nil
+			for _, z := range body.Zones {
+				z = strings.ToLower(dns.Fqdn(z))
+				if !slices.Contains(u.args.Zones, z) {
+					http.Error(w, fmt.Sprintf("unknown zone %s", z), http.StatusBadRequest)
+					return
+				}
+				zones = append(zones, z)
+			}
+		}
+		rrs, err := parseRecords(body.Records)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d, err := u.s.replace(zones, rrs, body.DryRun)
+		if err != nil {
+			code := http.StatusBadRequest
+			if errors.Is(err, errTooManyRecords) {
+				code = http.StatusInsufficientStorage
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		res := applyResult{Changed: !body.DryRun && !d.empty(), diff: *d}
+		if res.Changed {
+			u.logger.Info("records applied", zap.Int("added", len(d.Added)), zap.Int("removed", len(d.Removed)), zap.Int("updated", len(d.Updated)))
+			if !u.saveAPI(w) {
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+	return r
+}
+
+// readRecords reads recordsBody from req.
+func readRecords(req *http.Request) ([]dns.RR, error) {
+	var body recordsBody
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if len(body.Records) == 0 {
+		return nil, fmt.Errorf("no record")
+	}
+	return parseRecords(body.Records)
+}
+
+// parseRecords parses records in zone file format. Records must be
+// in class IN.
+func parseRecords(l []string) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(l))
+	for _, s := range l {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record %q, %w", s, err)
+		}
+		if rr == nil || rr.Header().Class != dns.ClassINET {
+			return nil, fmt.Errorf("invalid record %q", s)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// applyAPI applies updates and writes the result to w. If some records
+// were skipped, e.g. an A record of a name that has a CNAME, it responds
+// 409 with skippedBody. Other updates are still applied.
+func (u *UpdateServer) applyAPI(w http.ResponseWriter, updates []dns.RR) {
+	skipped, err := u.Apply(updates)
+	if err != nil {
+		code := http.StatusBadRequest
+		switch {
+		case errors.Is(err, errTooManyRecords):
+			code = http.StatusInsufficientStorage
+		case errors.Is(err, errSave):
+			code = http.StatusInternalServerError
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if len(skipped) > 0 {
+		body := skippedBody{Skipped: make([]string, 0, len(skipped))}
+		for _, rr := range skipped {
+			body.Skipped = append(body.Skipped, rr.String())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// saveAPI saves records to the file. If it fails, it responds 500 and
+// returns false. Changes are kept in memory and will be saved by the
+// next successful save.
+func (u *UpdateServer) saveAPI(w http.ResponseWriter) bool {
+	if err := u.save(); err != nil {
+		u.logger.Warn("failed to save records", zap.Error(err))
+		http.Error(w, fmt.Sprintf("%s, %s", errSave, err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
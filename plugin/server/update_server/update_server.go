@@ -0,0 +1,407 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package update_server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "update_server"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*UpdateServer)(nil)
+var _ coremain.StateExporter = (*UpdateServer)(nil)
+
+type Args struct {
+	Listen     string    `yaml:"listen"` // Optional. Listens on both udp and tcp. If it's empty, records can only be changed by the api.
+	Zones      []string  `yaml:"zones"`  // Required.
+	Keys       []KeyArgs `yaml:"keys"`   // Required if Listen is set. Updates must be signed by one of these keys.
+	File       string    `yaml:"file"`   // Optional. Records are saved to and loaded from this file.
+	MaxRecords int       `yaml:"max_records"`
+}
+
+// KeyArgs is a TSIG key.
+type KeyArgs struct {
+	Name      string `yaml:"name"`
+	Secret    string `yaml:"secret"`    // base64
+	Algorithm string `yaml:"algorithm"` // Default is "hmac-sha256".
+}
+
+func (a *Args) init() error {
+	if len(a.Zones) == 0 {
+		return errors.New("no zone is configured")
+	}
+	if len(a.Listen) > 0 && len(a.Keys) == 0 {
+		return errors.New("no tsig key is configured")
+	}
+	for i, z := range a.Zones {
+		if _, ok := dns.IsDomainName(z); !ok {
+			return fmt.Errorf("invalid zone %s", z)
+		}
+		a.Zones[i] = strings.ToLower(dns.Fqdn(z))
+	}
+	for i := range a.Keys {
+		k := &a.Keys[i]
+		if len(k.Name) == 0 {
+			return fmt.Errorf("key #%d has no name", i)
+		}
+		if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil || len(k.Secret) == 0 {
+			return fmt.Errorf("key %s has an invalid base64 secret", k.Name)
+		}
+		k.Name = strings.ToLower(dns.Fqdn(k.Name))
+		utils.SetDefaultString(&k.Algorithm, dns.HmacSHA256)
+		k.Algorithm = strings.ToLower(dns.Fqdn(k.Algorithm))
+		switch k.Algorithm {
+		case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		default:
+			return fmt.Errorf("key %s has an unsupported algorithm %s", k.Name, k.Algorithm)
+		}
+	}
+	utils.SetDefaultNum(&a.MaxRecords, 10000)
+	return nil
+}
+
+// UpdateServer accepts TSIG signed dynamic updates (RFC 2136) of its zones
+// and answers queries from the updated records. Queries of names that have
+// no record go to the rest of the sequence. Records can also be changed by
+// the api, see api.go.
+// The zones have no SOA and NS records. Records are kept in memory, and in
+// File if it is configured.
+type UpdateServer struct {
+	args   *Args
+	logger *zap.Logger
+	s      *store
+	keys   map[string]KeyArgs
+
+	saveMu sync.Mutex
+
+	udp *dns.Server
+	tcp *dns.Server
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	u, err := NewUpdateServer(args.(*Args), bp.L())
+	if err != nil {
+		return nil, err
+	}
+	if len(u.args.Listen) > 0 {
+		if err := u.start(bp.M().GetSafeClose().SendCloseSignal); err != nil {
+			return nil, err
+		}
+	}
+	bp.RegAPI(u.api())
+	return u, nil
+}
+
+// NewUpdateServer loads records from args.File. The listener is not
+// started.
+func NewUpdateServer(args *Args, logger *zap.Logger) (*UpdateServer, error) {
+	if err := args.init(); err != nil {
+		return nil, err
+	}
+	u := &UpdateServer{
+		args:   args,
+		logger: logger,
+		s:      newStore(args.Zones, args.MaxRecords),
+		keys:   make(map[string]KeyArgs),
+	}
+	for _, k := range args.Keys {
+		u.keys[k.Name] = k
+	}
+	if len(args.File) > 0 {
+		f, err := os.Open(args.File)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, err
+		default:
+			err := u.s.load(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to load %s, %w", args.File, err)
+			}
+		}
+	}
+	return u, nil
+}
+
+// start starts the listeners. onErr is called if a listener exits
+// with an error.
+func (u *UpdateServer) start(onErr func(err error)) error {
+	secrets := make(map[string]string)
+	for _, k := range u.keys {
+		secrets[k.Name] = k.Secret
+	}
+	// Msgs were validated by server.UnpackUpdate in updateReader.
+	accept := func(dh dns.Header) dns.MsgAcceptAction {
+		return dns.MsgAccept
+	}
+	decorate := func(r dns.Reader) dns.Reader {
+		return updateReader{Reader: r, logger: u.logger}
+	}
+
+	pc, err := net.ListenPacket("udp", u.args.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp, %w", err)
+	}
+	// Same port as udp, in case it is 0.
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("failed to listen on tcp, %w", err)
+	}
+	h := dns.HandlerFunc(u.handleUpdate)
+	var started sync.WaitGroup
+	started.Add(2)
+	u.udp = &dns.Server{PacketConn: pc, Handler: h, TsigSecret: secrets, MsgAcceptFunc: accept, DecorateReader: decorate, NotifyStartedFunc: started.Done}
+	u.tcp = &dns.Server{Listener: l, Handler: h, TsigSecret: secrets, MsgAcceptFunc: accept, DecorateReader: decorate, NotifyStartedFunc: started.Done, ReadTimeout: 10 * time.Second}
+	for _, s := range []*dns.Server{u.udp, u.tcp} {
+		go func(s *dns.Server) {
+			if err := s.ActivateAndServe(); err != nil {
+				onErr(fmt.Errorf("update server exited, %w", err))
+			}
+		}(s)
+	}
+	// Shutdown fails if the server has not started.
+	started.Wait()
+	u.logger.Info("update server started", zap.Stringer("addr", pc.LocalAddr()))
+	return nil
+}
+
+// updateReader drops msgs that are not valid updates. The dns.Server
+// unpacks msgs again after this, because it needs the raw msg to verify
+// the TSIG.
+type updateReader struct {
+	dns.Reader
+	logger *zap.Logger
+}
+
+func (r updateReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	b, err := r.Reader.ReadTCP(conn, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := server.UnpackUpdate(b); err != nil {
+		r.logger.Debug("invalid update msg", zap.Stringer("client", conn.RemoteAddr()), zap.Error(err))
+		return nil, err // closes the connection
+	}
+	return b, nil
+}
+
+func (r updateReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	for {
+		b, s, err := r.Reader.ReadUDP(conn, timeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := server.UnpackUpdate(b); err != nil {
+			r.logger.Debug("invalid update msg", zap.Stringer("client", s.RemoteAddr()), zap.Error(err))
+			continue
+		}
+		return b, s, nil
+	}
+}
+
+// Addr returns the listening address. It's nil if the server has no
+// listener.
+func (u *UpdateServer) Addr() net.Addr {
+	if u.udp == nil {
+		return nil
+	}
+	return u.udp.PacketConn.LocalAddr()
+}
+
+func (u *UpdateServer) Close() error {
+	if u.udp != nil {
+		u.udp.Shutdown()
+		u.tcp.Shutdown()
+	}
+	return nil
+}
+
+func (u *UpdateServer) handleUpdate(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	t := req.IsTsig()
+	k, ok := KeyArgs{}, false
+	if t != nil {
+		k, ok = u.keys[strings.ToLower(t.Hdr.Name)]
+	}
+	switch {
+	case t == nil:
+		resp.SetRcode(req, dns.RcodeRefused)
+	case !ok || w.TsigStatus() != nil || !strings.EqualFold(t.Algorithm, k.Algorithm):
+		u.logger.Warn("bad update signature", zap.Stringer("client", w.RemoteAddr()), zap.NamedError("tsig_err", w.TsigStatus()))
+		resp.SetRcode(req, dns.RcodeNotAuth)
+	default:
+		rc, changed := u.s.update(req)
+		u.logger.Info("update received",
+			zap.Stringer("client", w.RemoteAddr()),
+			zap.String("zone", req.Question[0].Name),
+			zap.String("key", k.Name),
+			zap.String("rcode", dns.RcodeToString[rc]),
+		)
+		if changed {
+			if err := u.save(); err != nil {
+				u.logger.Warn("failed to save records", zap.Error(err))
+			}
+		}
+		resp.SetRcode(req, rc)
+		resp.SetTsig(k.Name, k.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(resp)
+}
+
+// save writes all records to args.File.
+func (u *UpdateServer) save() error {
+	if len(u.args.File) == 0 {
+		return nil
+	}
+	u.saveMu.Lock()
+	defer u.saveMu.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(u.args.File), filepath.Base(u.args.File)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := u.s.dump(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), u.args.File)
+}
+
+var (
+	errNotInZone = errors.New("record is not in any zone")
+	errSave      = errors.New("failed to save records")
+)
+
+// Apply applies updates in the format of the update section of a dns
+// update message (RFC 2136 2.5), e.g. a record of class NONE deletes the
+// record, and saves records to the file. skipped are the records that
+// were not added because they conflict with existing records. Other
+// plugins manage their records by it, e.g. dyn_hosts.
+func (u *UpdateServer) Apply(updates []dns.RR) (skipped []dns.RR, err error) {
+	rc, changed, skipped := u.s.apply(updates)
+	switch rc {
+	case dns.RcodeSuccess:
+	case dns.RcodeNotZone:
+		return nil, errNotInZone
+	case dns.RcodeServerFailure:
+		return nil, errTooManyRecords
+	default:
+		return nil, fmt.Errorf("invalid records, %s", dns.RcodeToString[rc])
+	}
+	if changed {
+		if err := u.save(); err != nil {
+			u.logger.Warn("failed to save records", zap.Error(err))
+			return skipped, fmt.Errorf("%w, %w", errSave, err)
+		}
+	}
+	return skipped, nil
+}
+
+// Records returns records of name and qtype. They must not be modified.
+func (u *UpdateServer) Records(name string, qtype uint16) []dns.RR {
+	rrs, _ := u.s.lookup(name, qtype)
+	if len(rrs) > 0 && rrs[0].Header().Rrtype != qtype { // CNAME
+		return nil
+	}
+	return rrs
+}
+
+// InZone reports whether name is in one of the zones.
+func (u *UpdateServer) InZone(name string) bool {
+	return len(u.s.zoneOf(name)) > 0
+}
+
+// ExportState exports all records in zone file format.
+func (u *UpdateServer) ExportState() (json.RawMessage, error) {
+	rrs := u.s.all()
+	l := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		l = append(l, rr.String())
+	}
+	return json.Marshal(l)
+}
+
+// ImportState replaces records of all zones with the exported records.
+func (u *UpdateServer) ImportState(b json.RawMessage) error {
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	rrs, err := parseRecords(l)
+	if err != nil {
+		return err
+	}
+	d, err := u.s.replace(u.args.Zones, rrs, false)
+	if err != nil {
+		return err
+	}
+	if d.empty() {
+		return nil
+	}
+	return u.save()
+}
+
+// Exec answers queries of names that have records.
+func (u *UpdateServer) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	if len(q.Question) == 1 && q.Question[0].Qclass == dns.ClassINET && len(u.s.zoneOf(q.Question[0].Name)) > 0 {
+		if rrs, found := u.s.lookup(q.Question[0].Name, q.Question[0].Qtype); found {
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Authoritative = true
+			r.RecursionAvailable = true
+			for _, rr := range rrs {
+				rr = dns.Copy(rr)
+				rr.Header().Name = q.Question[0].Name
+				r.Answer = append(r.Answer, rr)
+			}
+			qCtx.SetResponse(r)
+		}
+	}
+	return next.ExecNext(ctx, qCtx)
+}
@@ -0,0 +1,377 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package update_server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/plugintest"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func rr(s string) dns.RR { return plugintest.MustRR(s) }
+
+func updateMsg() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate("lan.")
+	return m
+}
+
+func newUpdate(prereqs []dns.RR, updates []dns.RR) *dns.Msg {
+	m := updateMsg()
+	m.Answer = prereqs
+	m.Ns = updates
+	// Pack and unpack, so rdlength is set like in a received msg.
+	b, err := m.Pack()
+	if err != nil {
+		panic(err)
+	}
+	m = new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func TestStore_Update(t *testing.T) {
+	s := newStore([]string{"lan."}, 4)
+	add := func(rrs ...dns.RR) *dns.Msg {
+		m := updateMsg()
+		m.Insert(rrs)
+		return newUpdate(m.Answer, m.Ns)
+	}
+
+	if rc, _ := s.update(add(rr("pc.lan. 60 IN A 192.168.1.2"), rr("pc.lan. 60 IN A 192.168.1.3"))); rc != dns.RcodeSuccess {
+		t.Fatalf("add: %s", dns.RcodeToString[rc])
+	}
+	if rrs, _ := s.lookup("PC.lan.", dns.TypeA); len(rrs) != 2 {
+		t.Fatalf("want 2 records, got %v", rrs)
+	}
+	// CNAME can not be added to a name with other records.
+	s.update(add(rr("pc.lan. 60 IN CNAME nas.lan.")))
+	if rrs, _ := s.lookup("pc.lan.", dns.TypeCNAME); len(rrs) != 0 {
+		t.Fatalf("cname should be ignored, got %v", rrs)
+	}
+
+	// Name not in zone.
+	if rc, _ := s.update(add(rr("pc.example. 60 IN A 1.1.1.1"))); rc != dns.RcodeNotZone {
+		t.Fatalf("want NOTZONE, got %s", dns.RcodeToString[rc])
+	}
+	// Zone not served.
+	m := add(rr("pc.lan. 60 IN A 1.1.1.1"))
+	m.Question[0].Name = "other."
+	if rc, _ := s.update(m); rc != dns.RcodeNotAuth {
+		t.Fatalf("want NOTAUTH, got %s", dns.RcodeToString[rc])
+	}
+
+	// Prerequisites.
+	p := updateMsg()
+	p.NameNotUsed([]dns.RR{rr("pc.lan. 0 IN A 0.0.0.0")})
+	if rc, _ := s.update(newUpdate(p.Answer, nil)); rc != dns.RcodeYXDomain {
+		t.Fatalf("want YXDOMAIN, got %s", dns.RcodeToString[rc])
+	}
+	p = updateMsg()
+	p.RRsetUsed([]dns.RR{rr("nas.lan. 0 IN A 0.0.0.0")})
+	if rc, _ := s.update(newUpdate(p.Answer, nil)); rc != dns.RcodeNXRrset {
+		t.Fatalf("want NXRRSET, got %s", dns.RcodeToString[rc])
+	}
+	p = updateMsg()
+	p.Used([]dns.RR{rr("pc.lan. 0 IN A 192.168.1.3"), rr("pc.lan. 0 IN A 192.168.1.2")})
+	if rc, _ := s.update(newUpdate(p.Answer, nil)); rc != dns.RcodeSuccess {
+		t.Fatalf("value dependent prerequisite: %s", dns.RcodeToString[rc])
+	}
+
+	// Too many records. Nothing is changed.
+	if rc, _ := s.update(add(rr("a.lan. 60 IN A 1.1.1.1"), rr("b.lan. 60 IN A 1.1.1.1"), rr("c.lan. 60 IN A 1.1.1.1"))); rc != dns.RcodeServerFailure {
+		t.Fatalf("want SERVFAIL, got %s", dns.RcodeToString[rc])
+	}
+	if _, found := s.lookup("a.lan.", dns.TypeA); found {
+		t.Fatal("failed update was partially applied")
+	}
+
+	// Deletions.
+	d := updateMsg()
+	d.Remove([]dns.RR{rr("pc.lan. 0 IN A 192.168.1.2")})
+	s.update(newUpdate(nil, d.Ns))
+	if rrs, _ := s.lookup("pc.lan.", dns.TypeA); len(rrs) != 1 {
+		t.Fatalf("want 1 record, got %v", rrs)
+	}
+	d = updateMsg()
+	d.RemoveName([]dns.RR{rr("pc.lan. 0 IN A 0.0.0.0")})
+	s.update(newUpdate(nil, d.Ns))
+	if _, found := s.lookup("pc.lan.", dns.TypeA); found || s.n != 0 {
+		t.Fatalf("name was not removed, n = %d", s.n)
+	}
+}
+
+func TestUpdateServer(t *testing.T) {
+	const keyName, secret = "dhcp.", "c2VjcmV0c2VjcmV0c2VjcmV0"
+	file := filepath.Join(t.TempDir(), "lan.zone")
+	newServer := func() *UpdateServer {
+		u, err := NewUpdateServer(&Args{
+			Listen: "127.0.0.1:0",
+			Zones:  []string{"lan"},
+			Keys:   []KeyArgs{{Name: "dhcp", Secret: secret}},
+			File:   file,
+		}, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.start(func(err error) { t.Error(err) }); err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	u := newServer()
+	defer u.Close()
+
+	exchange := func(key, secret string) int {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetUpdate("lan.")
+		m.Insert([]dns.RR{rr("printer.lan. 300 IN A 192.168.1.9")})
+		// Updates with both the OPT and the TSIG must be accepted.
+		m.SetEdns0(1232, false)
+		c := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+		if len(key) > 0 {
+			c.TsigSecret = map[string]string{key: secret}
+			m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		r, _, err := c.Exchange(m, u.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Rcode
+	}
+
+	if rc := exchange("", ""); rc != dns.RcodeRefused {
+		t.Fatalf("unsigned update: want REFUSED, got %s", dns.RcodeToString[rc])
+	}
+	if rc := exchange("other.", secret); rc != dns.RcodeNotAuth {
+		t.Fatalf("unknown key: want NOTAUTH, got %s", dns.RcodeToString[rc])
+	}
+	if rc := exchange(keyName, secret); rc != dns.RcodeSuccess {
+		t.Fatalf("signed update: got %s", dns.RcodeToString[rc])
+	}
+
+	qCtx := plugintest.NewQuery("Printer.lan", dns.TypeA).Build()
+	if err := plugintest.Exec(t, u, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	r := qCtx.R()
+	if r == nil || !r.Authoritative || len(r.Answer) != 1 || r.Answer[0].String() != "Printer.lan.\t300\tIN\tA\t192.168.1.9" {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	// Names without records go to the rest of the sequence.
+	next := new(plugintest.Recorder)
+	if err := plugintest.Exec(t, u, plugintest.NewQuery("nas.lan", dns.TypeA).Build(), next); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Queries) != 1 {
+		t.Fatal("query was not passed to the next executable")
+	}
+
+	// Records are saved and loaded again.
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "192.168.1.9") {
+		t.Fatalf("unexpected file content %q", b)
+	}
+	u.Close()
+	u = newServer()
+	if rrs, _ := u.s.lookup("printer.lan.", dns.TypeA); len(rrs) != 1 {
+		t.Fatalf("records were not loaded, %v", rrs)
+	}
+}
+
+func TestUpdateServer_API(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "lan.zone")
+	u, err := NewUpdateServer(&Args{Zones: []string{"lan"}, File: file}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := u.api()
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+	list := func(url string) []string {
+		t.Helper()
+		var l []string
+		if err := json.Unmarshal(do(http.MethodGet, url, "").Body.Bytes(), &l); err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	if w := do(http.MethodPost, "/records", `{"records": ["pc.lan. 300 IN A 192.168.1.2", "pc.lan. 300 IN A 192.168.1.3", "nas.lan. 300 IN AAAA fd00::2"]}`); w.Code != http.StatusOK {
+		t.Fatalf("post: %d %s", w.Code, w.Body)
+	}
+	if l := list("/records?name=PC.lan"); len(l) != 2 {
+		t.Fatalf("want 2 records of pc.lan, got %v", l)
+	}
+	if w := do(http.MethodPut, "/records", `{"records": ["pc.lan. 60 IN A 192.168.1.9"]}`); w.Code != http.StatusOK {
+		t.Fatalf("put: %d %s", w.Code, w.Body)
+	}
+	if l := list("/records?name=pc.lan"); len(l) != 1 || !strings.Contains(l[0], "192.168.1.9") {
+		t.Fatalf("records of pc.lan were not replaced, %v", l)
+	}
+	if w := do(http.MethodDelete, "/records?name=nas.lan&type=aaaa", ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if l := list("/records"); len(l) != 1 {
+		t.Fatalf("want 1 record, got %v", l)
+	}
+
+	for _, tt := range []struct{ method, url, body string }{
+		{http.MethodPost, "/records", `{"records": ["pc.example. 300 IN A 1.1.1.1"]}`},
+		{http.MethodPost, "/records", `{"records": ["invalid"]}`},
+		{http.MethodPost, "/records", `{}`},
+		{http.MethodDelete, "/records?name=pc.lan&type=bad", ""},
+	} {
+		if w := do(tt.method, tt.url, tt.body); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s %s %s: want 400, got %d", tt.method, tt.url, tt.body, w.Code)
+		}
+	}
+
+	// A CNAME can't coexist with the A record, other records are added.
+	w := do(http.MethodPost, "/records", `{"records": ["pc.lan. 300 IN CNAME nas.lan.", "tv.lan. 300 IN A 192.168.1.5"]}`)
+	var skipped skippedBody
+	if err := json.Unmarshal(w.Body.Bytes(), &skipped); w.Code != http.StatusConflict || err != nil ||
+		len(skipped.Skipped) != 1 || !strings.Contains(skipped.Skipped[0], "CNAME") {
+		t.Fatalf("want 409 with the skipped CNAME, got %d %s", w.Code, w.Body)
+	}
+	if l := list("/records?name=tv.lan"); len(l) != 1 {
+		t.Fatalf("tv.lan was not added, %v", l)
+	}
+
+	// Changes were saved.
+	u2, err := NewUpdateServer(&Args{Zones: []string{"lan"}, File: file}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rrs, _ := u2.s.lookup("pc.lan.", dns.TypeA); len(rrs) != 1 {
+		t.Fatalf("records were not saved, %v", rrs)
+	}
+	if rrs, _ := u2.s.lookup("tv.lan.", dns.TypeA); len(rrs) != 1 {
+		t.Fatalf("records were not saved, %v", rrs)
+	}
+
+	u.args.File = filepath.Join(t.TempDir(), "no_such_dir", "lan.zone")
+	if w := do(http.MethodPost, "/records", `{"records": ["tv.lan. 300 IN A 192.168.1.6"]}`); w.Code != http.StatusInternalServerError {
+		t.Fatalf("want 500 if records can't be saved, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUpdateServer_Apply(t *testing.T) {
+	u, err := NewUpdateServer(&Args{Zones: []string{"lan", "iot.lan"}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := u.api()
+	apply := func(body string) (int, applyResult) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/apply", strings.NewReader(body)))
+		var res applyResult
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, res
+	}
+
+	u.s.apply([]dns.RR{rr("old.lan. 300 IN A 192.168.1.1"), rr("pc.lan. 300 IN A 192.168.1.2"), rr("cam.iot.lan. 300 IN A 192.168.2.2")})
+	desired := `{"zones": ["lan"], "records": ["pc.lan. 60 IN A 192.168.1.2", "nas.lan. 300 IN A 192.168.1.3"]}`
+
+	_, res := apply(strings.Replace(desired, `{`, `{"dry_run": true, `, 1))
+	if res.Changed || len(res.Added) != 1 || len(res.Removed) != 1 || len(res.Updated) != 1 {
+		t.Fatalf("unexpected dry run result %+v", res)
+	}
+	if _, found := u.s.lookup("nas.lan.", dns.TypeA); found {
+		t.Fatal("dry run changed records")
+	}
+
+	if code, res := apply(desired); code != http.StatusOK || !res.Changed {
+		t.Fatalf("apply: %d %+v", code, res)
+	}
+	if _, found := u.s.lookup("old.lan.", dns.TypeA); found {
+		t.Fatal("old.lan was not removed")
+	}
+	if _, found := u.s.lookup("cam.iot.lan.", dns.TypeA); !found {
+		t.Fatal("records of other zones should be kept")
+	}
+	// Idempotent.
+	if _, res := apply(desired); res.Changed || !res.diff.empty() {
+		t.Fatalf("second apply should change nothing, %+v", res)
+	}
+
+	for _, body := range []string{
+		`{"zones": ["lan"], "records": ["cam.iot.lan. 300 IN A 1.1.1.1"]}`,
+		`{"zones": ["example"], "records": []}`,
+		`{"records": ["pc.lan. 300 IN A 1.1.1.1", "pc.lan. 300 IN CNAME nas.lan."]}`,
+	} {
+		if code, _ := apply(body); code != http.StatusBadRequest {
+			t.Fatalf("%s: want 400, got %d", body, code)
+		}
+	}
+}
+
+func TestUpdateServer_State(t *testing.T) {
+	newServer := func() *UpdateServer {
+		u, err := NewUpdateServer(&Args{Zones: []string{"lan"}}, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	src := newServer()
+	src.s.apply([]dns.RR{rr("pc.lan. 300 IN A 192.168.1.2"), rr("nas.lan. 300 IN AAAA fd00::3")})
+	b, err := src.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newServer()
+	dst.s.apply([]dns.RR{rr("old.lan. 300 IN A 192.168.1.1")})
+	if err := dst.ImportState(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := dst.s.lookup("old.lan.", dns.TypeA); found {
+		t.Fatal("old records should be replaced")
+	}
+	if got, _ := dst.ExportState(); string(got) != string(b) {
+		t.Fatalf("want state %s, got %s", b, got)
+	}
+}
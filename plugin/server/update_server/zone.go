@@ -0,0 +1,524 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package update_server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// store keeps records of dynamic zones. Names are in lower case.
+type store struct {
+	zones      []string // fqdn, in lower case.
+	maxRecords int
+
+	mu      sync.RWMutex
+	records map[string]rrsets // Do not modify. It is replaced by update.
+	n       int               // number of records
+}
+
+type rrsets map[uint16][]dns.RR
+
+func newStore(zones []string, maxRecords int) *store {
+	return &store{zones: zones, maxRecords: maxRecords, records: make(map[string]rrsets)}
+}
+
+// zoneOf returns the zone that name belongs to, or "" if it is not in
+// any zone. The longest zone wins.
+func (s *store) zoneOf(name string) string {
+	var z string
+	for _, zone := range s.zones {
+		if dns.IsSubDomain(zone, name) && len(zone) > len(z) {
+			z = zone
+		}
+	}
+	return z
+}
+
+// lookup returns records of name and qtype. If name has a CNAME, the CNAME
+// is returned for other types. found is false if name has no record.
+func (s *store) lookup(name string, qtype uint16) (rrs []dns.RR, found bool) {
+	s.mu.RLock()
+	sets := s.records[strings.ToLower(name)]
+	s.mu.RUnlock()
+	if len(sets) == 0 {
+		return nil, false
+	}
+	if rrs = sets[qtype]; len(rrs) == 0 && qtype != dns.TypeCNAME {
+		rrs = sets[dns.TypeCNAME]
+	}
+	return rrs, true
+}
+
+// all returns all records, sorted by name and type.
+func (s *store) all() []dns.RR {
+	s.mu.RLock()
+	records := s.records
+	s.mu.RUnlock()
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var rrs []dns.RR
+	for _, name := range names {
+		types := make([]uint16, 0, len(records[name]))
+		for t := range records[name] {
+			types = append(types, t)
+		}
+		slices.Sort(types)
+		for _, t := range types {
+			rrs = append(rrs, records[name][t]...)
+		}
+	}
+	return rrs
+}
+
+// load loads records from r, one record per line in zone file format.
+// Empty lines and lines starting with ";" or "#" are ignored.
+func (s *store) load(r io.Reader) error {
+	records := make(map[string]rrsets)
+	n := 0
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		t := strings.TrimSpace(sc.Text())
+		if len(t) == 0 || t[0] == ';' || t[0] == '#' {
+			continue
+		}
+		rr, err := dns.NewRR(t)
+		if err != nil {
+			return fmt.Errorf("invalid record at line %d, %w", line, err)
+		}
+		if rr == nil {
+			continue
+		}
+		if len(s.zoneOf(rr.Header().Name)) == 0 {
+			return fmt.Errorf("record at line %d is not in any zone", line)
+		}
+		if addRR(records, rr) {
+			n++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.records, s.n = records, n
+	s.mu.Unlock()
+	return nil
+}
+
+// dump writes all records to w in the format of load.
+func (s *store) dump(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, rr := range s.all() {
+		bw.WriteString(rr.String())
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// update applies the prerequisites and updates of a dns update message
+// (RFC 2136 3.2 - 3.4) and returns a rcode. Updates are applied
+// atomically. changed reports whether any record was changed.
+func (s *store) update(m *dns.Msg) (rcode int, changed bool) {
+	if len(m.Question) != 1 || m.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError, false
+	}
+	zone := strings.ToLower(m.Question[0].Name)
+	if m.Question[0].Qclass != dns.ClassINET || !slices.Contains(s.zones, zone) {
+		return dns.RcodeNotAuth, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rc := s.checkPrereqs(zone, m.Answer); rc != dns.RcodeSuccess {
+		return rc, false
+	}
+	if rc := prescan(zone, m.Ns); rc != dns.RcodeSuccess {
+		return rc, false
+	}
+	// RFC 2136 3.4.2. Conflicting updates are silently ignored.
+	rcode, changed, _ = s.applyLocked(m.Ns)
+	return rcode, changed
+}
+
+// apply applies updates in the format of the update section of a dns
+// update message. Unlike update, updates can be in different zones.
+// skipped are the records that were not added, see applyLocked.
+func (s *store) apply(updates []dns.RR) (rcode int, changed bool, skipped []dns.RR) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rr := range updates {
+		zone := s.zoneOf(rr.Header().Name)
+		if len(zone) == 0 {
+			return dns.RcodeNotZone, false, nil
+		}
+		if rc := prescan(zone, []dns.RR{rr}); rc != dns.RcodeSuccess {
+			return rc, false, nil
+		}
+	}
+	return s.applyLocked(updates)
+}
+
+// applyLocked applies updates that have passed prescan. s.mu must
+// be held. skipped are the records that were not added because they
+// are soa records or conflict with a CNAME. Other updates are still
+// applied.
+func (s *store) applyLocked(updates []dns.RR) (rcode int, changed bool, skipped []dns.RR) {
+	records := maps.Clone(s.records)
+	cloned := make(map[string]bool)
+	sets := func(name string) rrsets {
+		if !cloned[name] {
+			cloned[name] = true
+			if old := records[name]; old != nil {
+				records[name] = maps.Clone(old)
+			}
+		}
+		return records[name]
+	}
+	n := s.n
+	for _, rr := range updates {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		switch h.Class {
+		case dns.ClassINET:
+			if h.Rrtype == dns.TypeSOA {
+				skipped = append(skipped, rr) // The zone has no soa.
+				continue
+			}
+			rs := sets(name)
+			// RFC 2136 3.4.2.2. CNAME can not coexist with other types.
+			if h.Rrtype == dns.TypeCNAME && len(rs) > 0 && len(rs[dns.TypeCNAME]) == 0 {
+				skipped = append(skipped, rr)
+				continue
+			}
+			if h.Rrtype != dns.TypeCNAME && len(rs[dns.TypeCNAME]) > 0 {
+				skipped = append(skipped, rr)
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			if h.Rrtype == dns.TypeCNAME && len(rs[dns.TypeCNAME]) > 0 {
+				n -= len(rs[dns.TypeCNAME])
+				delete(rs, dns.TypeCNAME)
+			}
+			if addRR(records, rr) {
+				n++
+			} else {
+				// Duplicated. Only the ttl may change.
+				l := slices.Clone(records[name][h.Rrtype])
+				replaceTTL(l, rr)
+				records[name][h.Rrtype] = l
+			}
+		case dns.ClassANY:
+			rs := sets(name)
+			if len(rs) == 0 {
+				continue
+			}
+			if h.Rrtype == dns.TypeANY {
+				for _, l := range rs {
+					n -= len(l)
+				}
+				delete(records, name)
+				continue
+			}
+			n -= len(rs[h.Rrtype])
+			delete(rs, h.Rrtype)
+		case dns.ClassNONE:
+			rs := sets(name)
+			if len(rs) == 0 {
+				continue
+			}
+			l := rs[h.Rrtype]
+			i := slices.IndexFunc(l, func(e dns.RR) bool { return sameRdata(e, rr) })
+			if i < 0 {
+				continue
+			}
+			l = slices.Delete(slices.Clone(l), i, i+1)
+			n--
+			if len(l) == 0 {
+				delete(rs, h.Rrtype)
+			} else {
+				rs[h.Rrtype] = l
+			}
+		}
+		if rs := records[name]; rs != nil && len(rs) == 0 {
+			delete(records, name)
+		}
+	}
+	if s.maxRecords > 0 && n > s.maxRecords {
+		return dns.RcodeServerFailure, false, nil
+	}
+	changed = len(cloned) > 0
+	s.records, s.n = records, n
+	return dns.RcodeSuccess, changed, skipped
+}
+
+// checkPrereqs checks the prerequisite section. RFC 2136 3.2.
+func (s *store) checkPrereqs(zone string, prereqs []dns.RR) int {
+	valueDependent := make(map[string]map[uint16][]dns.RR)
+	for _, rr := range prereqs {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone, name) {
+			return dns.RcodeNotZone
+		}
+		rs := s.records[name]
+		switch h.Class {
+		case dns.ClassANY:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if len(rs) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(rs[h.Rrtype]) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY {
+				if len(rs) > 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(rs[h.Rrtype]) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			if valueDependent[name] == nil {
+				valueDependent[name] = make(map[uint16][]dns.RR)
+			}
+			valueDependent[name][h.Rrtype] = append(valueDependent[name][h.Rrtype], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	for name, sets := range valueDependent {
+		for t, want := range sets {
+			if !sameRRset(s.records[name][t], want) {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// prescan checks the update section. RFC 2136 3.4.1.
+func prescan(zone string, updates []dns.RR) int {
+	for _, rr := range updates {
+		h := rr.Header()
+		if !dns.IsSubDomain(zone, h.Name) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			if isMetaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if h.Ttl != 0 || h.Rdlength != 0 || (isMetaType(h.Rrtype) && h.Rrtype != dns.TypeANY) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if h.Ttl != 0 || isMetaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+func isMetaType(t uint16) bool {
+	switch t {
+	case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG, dns.TypeTKEY:
+		return true
+	}
+	return false
+}
+
+// addRR adds rr to records. It returns false if records already has rr.
+// The rrsets of rr's name must be owned by the caller.
+func addRR(records map[string]rrsets, rr dns.RR) bool {
+	h := rr.Header()
+	name := strings.ToLower(h.Name)
+	rs := records[name]
+	if rs == nil {
+		rs = make(rrsets)
+		records[name] = rs
+	}
+	l := rs[h.Rrtype]
+	if slices.ContainsFunc(l, func(e dns.RR) bool { return sameRdata(e, rr) }) {
+		return false
+	}
+	rs[h.Rrtype] = append(slices.Clip(l), rr)
+	return true
+}
+
+// replaceTTL sets the ttl of rr's duplicate in l to rr's ttl. The
+// record is copied, so it can be shared with other lists.
+func replaceTTL(l []dns.RR, rr dns.RR) {
+	for i, e := range l {
+		if sameRdata(e, rr) && e.Header().Ttl != rr.Header().Ttl {
+			c := dns.Copy(e)
+			c.Header().Ttl = rr.Header().Ttl
+			l[i] = c
+		}
+	}
+}
+
+// sameRdata reports whether a and b have the same name, type and rdata.
+// Class and ttl are ignored.
+func sameRdata(a, b dns.RR) bool {
+	ah, bh := a.Header(), b.Header()
+	if ah.Rrtype != bh.Rrtype || !strings.EqualFold(ah.Name, bh.Name) {
+		return false
+	}
+	return rdata(a) == rdata(b)
+}
+
+func rdata(rr dns.RR) string {
+	h := rr.Header().String()
+	return strings.TrimPrefix(rr.String(), h)
+}
+
+// sameRRset reports whether a and b have the same records, ignoring
+// order and ttl.
+func sameRRset(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as, bs := make([]string, len(a)), make([]string, len(b))
+	for i := range a {
+		as[i], bs[i] = rdata(a[i]), rdata(b[i])
+	}
+	sort.Strings(as)
+	sort.Strings(bs)
+	return slices.Equal(as, bs)
+}
+
+var errTooManyRecords = errors.New("too many records")
+
+// diff is the difference between two sets of records. Updated records
+// only have different ttls.
+type diff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Updated []string `json:"updated"`
+}
+
+func (d *diff) empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Updated) == 0
+}
+
+// replace replaces all records of zones with desired atomically. Zones must
+// be zones of s. Records of other zones are not changed. If dryRun is true,
+// the diff is returned but s is not changed.
+func (s *store) replace(zones []string, desired []dns.RR, dryRun bool) (*diff, error) {
+	inScope := func(name string) bool {
+		return slices.Contains(zones, s.zoneOf(name))
+	}
+	next := make(map[string]rrsets)
+	n := 0
+	for _, rr := range desired {
+		h := rr.Header()
+		if !inScope(h.Name) {
+			return nil, fmt.Errorf("%s is not in zones %v", h.Name, zones)
+		}
+		if h.Class != dns.ClassINET || isMetaType(h.Rrtype) || h.Rrtype == dns.TypeSOA {
+			return nil, fmt.Errorf("invalid record %s", rr)
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = strings.ToLower(h.Name)
+		if addRR(next, rr) {
+			n++
+		}
+	}
+	for name, sets := range next {
+		if len(sets[dns.TypeCNAME]) > 0 && len(sets) > 1 {
+			return nil, fmt.Errorf("%s has a cname and other records", name)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := &diff{Added: []string{}, Removed: []string{}, Updated: []string{}}
+	for name, sets := range s.records {
+		if !inScope(name) {
+			next[name] = sets
+			for _, l := range sets {
+				n += len(l)
+			}
+			continue
+		}
+		for t, l := range sets {
+			for _, rr := range l {
+				i := slices.IndexFunc(next[name][t], func(e dns.RR) bool { return sameRdata(e, rr) })
+				switch {
+				case i < 0:
+					d.Removed = append(d.Removed, rr.String())
+				case next[name][t][i].Header().Ttl != rr.Header().Ttl:
+					d.Updated = append(d.Updated, next[name][t][i].String())
+				}
+			}
+		}
+	}
+	for name, sets := range next {
+		if !inScope(name) {
+			continue
+		}
+		for t, l := range sets {
+			for _, rr := range l {
+				if !slices.ContainsFunc(s.records[name][t], func(e dns.RR) bool { return sameRdata(e, rr) }) {
+					d.Added = append(d.Added, rr.String())
+				}
+			}
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Updated)
+	if s.maxRecords > 0 && n > s.maxRecords {
+		return nil, fmt.Errorf("%w, %d > %d", errTooManyRecords, n, s.maxRecords)
+	}
+	if !dryRun && !d.empty() {
+		s.records, s.n = next, n
+	}
+	return d, nil
+}
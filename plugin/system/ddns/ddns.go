@@ -0,0 +1,279 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package ddns is a dynamic dns client. It watches the wan addresses and
+// pushes changes to Cloudflare, DuckDNS or a RFC 2136 server.
+package ddns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const PluginType = "ddns"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	updateTimeout = time.Second * 30
+)
+
+type Args struct {
+	// Domains to update. Required.
+	Domains []string `yaml:"domains"`
+
+	// Provider is "cloudflare", "duckdns" or "rfc2136". Required.
+	Provider   string         `yaml:"provider"`
+	Cloudflare CloudflareArgs `yaml:"cloudflare"`
+	DuckDNS    DuckDNSArgs    `yaml:"duckdns"`
+	RFC2136    RFC2136Args    `yaml:"rfc2136"`
+
+	// Interface gets addresses from a local interface (e.g. "pppoe-wan").
+	// If it is empty, addresses are got from IPv4URL and IPv6URL.
+	Interface string `yaml:"interface"`
+	IPv4URL   string `yaml:"ipv4_url"` // Default is "https://api.ipify.org".
+	IPv6URL   string `yaml:"ipv6_url"` // Default is "https://api6.ipify.org".
+
+	IPv4 *bool `yaml:"ipv4"` // Update A records. Default is true.
+	IPv6 bool  `yaml:"ipv6"` // Update AAAA records.
+
+	// Interval of address checks in seconds. Default is 300.
+	Interval int `yaml:"interval"`
+	// Refresh pushes addresses even if they are not changed, in seconds.
+	// Default is 86400. Negative disables it.
+	Refresh int `yaml:"refresh"`
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultString(&a.IPv4URL, "https://api.ipify.org")
+	utils.SetDefaultString(&a.IPv6URL, "https://api6.ipify.org")
+	utils.SetDefaultNum(&a.Interval, 300)
+	utils.SetDefaultNum(&a.Refresh, 86400)
+	if a.IPv4 == nil {
+		t := true
+		a.IPv4 = &t
+	}
+	if len(a.Domains) == 0 {
+		return errors.New("no domain is configured")
+	}
+	if !*a.IPv4 && !a.IPv6 {
+		return errors.New("both ipv4 and ipv6 are disabled")
+	}
+	if a.Interval < 10 {
+		return errors.New("interval must be at least 10s")
+	}
+	return nil
+}
+
+func newProvider(a *Args) (provider, error) {
+	switch a.Provider {
+	case "cloudflare":
+		return newCloudflare(&a.Cloudflare)
+	case "duckdns":
+		return newDuckDNS(&a.DuckDNS)
+	case "rfc2136":
+		return newRFC2136(&a.RFC2136)
+	default:
+		return nil, fmt.Errorf("invalid provider %q", a.Provider)
+	}
+}
+
+// Status is the status of the last check.
+type Status struct {
+	IPv4       string    `json:"ipv4,omitempty"` // the last pushed address
+	IPv6       string    `json:"ipv6,omitempty"`
+	LastCheck  time.Time `json:"last_check"`
+	LastUpdate time.Time `json:"last_update"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+type DDNS struct {
+	args     *Args
+	logger   *zap.Logger
+	provider provider
+	detect   detector
+
+	// updateMu serializes checks.
+	updateMu sync.Mutex
+	pushed   [2]netip.Addr // v4, v6
+
+	statusMu sync.Mutex
+	status   Status
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if err := a.init(); err != nil {
+		return nil, err
+	}
+	p, err := newProvider(a)
+	if err != nil {
+		return nil, err
+	}
+	d := urlDetector(a.IPv4URL, a.IPv6URL)
+	if len(a.Interface) > 0 {
+		d = interfaceDetector(a.Interface)
+	}
+	c := newDDNS(a, p, d, bp.L())
+	go c.loop()
+	bp.RegAPI(c.Api())
+	return c, nil
+}
+
+func newDDNS(args *Args, p provider, d detector, logger *zap.Logger) *DDNS {
+	return &DDNS{
+		args:        args,
+		logger:      logger,
+		provider:    p,
+		detect:      d,
+		closeNotify: make(chan struct{}),
+	}
+}
+
+func (c *DDNS) loop() {
+	ticker := time.NewTicker(time.Duration(c.args.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+		if _, err := c.check(ctx, false); err != nil {
+			c.logger.Warn("ddns update failed", zap.Error(err))
+		}
+		cancel()
+		select {
+		case <-ticker.C:
+		case <-c.closeNotify:
+			return
+		}
+	}
+}
+
+// check detects addresses and pushes them if they were changed, the
+// refresh interval passed, or force is true. It reports whether
+// addresses were pushed.
+func (c *DDNS) check(ctx context.Context, force bool) (bool, error) {
+	c.updateMu.Lock()
+	defer c.updateMu.Unlock()
+
+	var (
+		addrs [2]netip.Addr
+		errs  []error
+	)
+	for i, enabled := range []bool{*c.args.IPv4, c.args.IPv6} {
+		if !enabled {
+			continue
+		}
+		network := [2]string{"tcp4", "tcp6"}[i]
+		addr, err := c.detect(ctx, network)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to detect %s address, %w", network[3:], err))
+			continue
+		}
+		addrs[i] = addr
+	}
+	if !addrs[0].IsValid() && !addrs[1].IsValid() {
+		return false, c.setStatus(false, errors.Join(errs...))
+	}
+
+	c.statusMu.Lock()
+	lastUpdate := c.status.LastUpdate
+	c.statusMu.Unlock()
+	refresh := c.args.Refresh > 0 && time.Since(lastUpdate) >= time.Duration(c.args.Refresh)*time.Second
+	if !force && !refresh && addrs == c.pushed {
+		return false, c.setStatus(false, errors.Join(errs...))
+	}
+	if err := c.provider.update(ctx, c.args.Domains, addrs[0], addrs[1]); err != nil {
+		return false, c.setStatus(false, errors.Join(append(errs, err)...))
+	}
+	if addrs != c.pushed {
+		c.logger.Info("ddns updated", zap.Stringer("ipv4", addrs[0]), zap.Stringer("ipv6", addrs[1]), zap.Strings("domains", c.args.Domains))
+	}
+	c.pushed = addrs
+	return true, c.setStatus(true, errors.Join(errs...))
+}
+
+// setStatus records the result of a check and returns err.
+func (c *DDNS) setStatus(updated bool, err error) error {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	now := time.Now()
+	c.status.LastCheck = now
+	if updated {
+		c.status.LastUpdate = now
+		c.status.IPv4, c.status.IPv6 = "", ""
+		if c.pushed[0].IsValid() {
+			c.status.IPv4 = c.pushed[0].String()
+		}
+		if c.pushed[1].IsValid() {
+			c.status.IPv6 = c.pushed[1].String()
+		}
+	}
+	c.status.LastError = ""
+	if err != nil {
+		c.status.LastError = err.Error()
+	}
+	return err
+}
+
+func (c *DDNS) Status() Status {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	return c.status
+}
+
+// Api serves the status at "/status" and forces an update by
+// "POST /update".
+func (c *DDNS) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.Status())
+	})
+	r.Post("/update", func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), updateTimeout)
+		defer cancel()
+		if _, err := c.check(ctx, true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.Status())
+	})
+	return r
+}
+
+func (c *DDNS) Close() error {
+	c.closeOnce.Do(func() { close(c.closeNotify) })
+	return nil
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ddns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type fakeProvider struct {
+	updates [][2]netip.Addr
+}
+
+func (p *fakeProvider) update(_ context.Context, _ []string, v4, v6 netip.Addr) error {
+	p.updates = append(p.updates, [2]netip.Addr{v4, v6})
+	return nil
+}
+
+func TestDDNS_check(t *testing.T) {
+	args := &Args{Domains: []string{"home.example.com"}, IPv6: true}
+	if err := args.init(); err != nil {
+		t.Fatal(err)
+	}
+	v4 := netip.MustParseAddr("203.0.113.1")
+	detect := func(_ context.Context, network string) (netip.Addr, error) {
+		if network == "tcp6" {
+			return netip.Addr{}, fmt.Errorf("no ipv6")
+		}
+		return v4, nil
+	}
+	p := new(fakeProvider)
+	c := newDDNS(args, p, detect, zap.NewNop())
+	ctx := context.Background()
+
+	// ipv6 failed, ipv4 is pushed.
+	if updated, err := c.check(ctx, false); !updated || err == nil {
+		t.Fatalf("want an update with an ipv6 error, got %v, %v", updated, err)
+	}
+	if updated, _ := c.check(ctx, false); updated {
+		t.Fatal("unchanged addresses should not be pushed")
+	}
+	if updated, _ := c.check(ctx, true); !updated {
+		t.Fatal("want a forced update")
+	}
+	v4 = netip.MustParseAddr("203.0.113.2")
+	if updated, _ := c.check(ctx, false); !updated {
+		t.Fatal("want an update after the address changed")
+	}
+	if len(p.updates) != 3 || p.updates[2][0] != v4 || p.updates[2][1].IsValid() {
+		t.Fatalf("unexpected updates %v", p.updates)
+	}
+	if s := c.Status(); s.IPv4 != v4.String() || len(s.LastError) == 0 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+}
+
+func TestCloudflare(t *testing.T) {
+	var reqs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		reqs = append(reqs, r.Method+" "+r.URL.String()+" "+string(b))
+		if r.Method == http.MethodGet {
+			if r.URL.Query().Get("type") == "A" {
+				fmt.Fprint(w, `{"success":true,"result":[{"id":"r1","content":"203.0.113.1"}]}`)
+			} else {
+				fmt.Fprint(w, `{"success":true,"result":[]}`)
+			}
+			return
+		}
+		fmt.Fprint(w, `{"success":true,"result":{}}`)
+	}))
+	defer srv.Close()
+
+	c, err := newCloudflare(&CloudflareArgs{APIToken: "token", ZoneID: "z1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.endpoint = srv.URL
+	err = c.update(context.Background(), []string{"home.example.com"}, netip.MustParseAddr("203.0.113.2"), netip.MustParseAddr("2001:db8::1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`GET /zones/z1/dns_records?name=home.example.com&type=A `,
+		`PATCH /zones/z1/dns_records/r1 {"content":"203.0.113.2"}`,
+		`GET /zones/z1/dns_records?name=home.example.com&type=AAAA `,
+		`POST /zones/z1/dns_records {"type":"AAAA","name":"home.example.com","content":"2001:db8::1","ttl":1,"proxied":false}`,
+	}
+	if len(reqs) != len(want) {
+		t.Fatalf("unexpected requests %q", reqs)
+	}
+	for i := range want {
+		if reqs[i] != want[i] {
+			t.Errorf("request #%d: want %s, got %s", i, want[i], reqs[i])
+		}
+	}
+
+	c.args.APIToken = "bad"
+	if err := c.update(context.Background(), []string{"home.example.com"}, netip.MustParseAddr("203.0.113.2"), netip.Addr{}); err == nil {
+		t.Fatal("want an error")
+	}
+}
+
+func TestDuckDNS(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		if r.URL.Query().Get("token") != "token" {
+			fmt.Fprint(w, "KO")
+			return
+		}
+		fmt.Fprint(w, "OK")
+	}))
+	defer srv.Close()
+
+	d, err := newDuckDNS(&DuckDNSArgs{Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.endpoint = srv.URL
+	if err := d.update(context.Background(), []string{"a.duckdns.org", "b"}, netip.MustParseAddr("203.0.113.1"), netip.Addr{}); err != nil {
+		t.Fatal(err)
+	}
+	if query != "domains=a%2Cb&ip=203.0.113.1&token=token" {
+		t.Fatalf("unexpected query %s", query)
+	}
+	d.token = "bad"
+	if err := d.update(context.Background(), []string{"a"}, netip.MustParseAddr("203.0.113.1"), netip.Addr{}); err == nil {
+		t.Fatal("want an error")
+	}
+}
+
+func TestRFC2136(t *testing.T) {
+	const (
+		keyName = "ddns-key."
+		secret  = "c2VjcmV0c2VjcmV0c2VjcmV0"
+	)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan *dns.Msg, 1)
+	srv := &dns.Server{
+		Listener:   l,
+		TsigSecret: map[string]string{keyName: secret},
+		// The default func rejects updates.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(m)
+			if m.IsTsig() == nil || w.TsigStatus() != nil {
+				resp.Rcode = dns.RcodeNotAuth
+			} else {
+				updates <- m
+			}
+			resp.SetTsig(keyName, dns.HmacSHA256, 300, time.Now().Unix())
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	r, err := newRFC2136(&RFC2136Args{Server: l.Addr().String(), Zone: "example.com", TSIGName: "ddns-key", TSIGSecret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := r.update(ctx, []string{"home.example.com"}, netip.MustParseAddr("203.0.113.1"), netip.Addr{}); err != nil {
+		t.Fatal(err)
+	}
+	m := <-updates
+	if m.Opcode != dns.OpcodeUpdate || m.Question[0].Name != "example.com." || len(m.Ns) != 2 {
+		t.Fatalf("unexpected update %v", m)
+	}
+	if a, ok := m.Ns[1].(*dns.A); !ok || a.A.String() != "203.0.113.1" || a.Hdr.Ttl != 300 {
+		t.Fatalf("unexpected record %v", m.Ns[1])
+	}
+
+	if err := r.update(ctx, []string{"home.example.org"}, netip.MustParseAddr("203.0.113.1"), netip.Addr{}); err == nil {
+		t.Fatal("want an out of zone error")
+	}
+	r.args.TSIGSecret = "YmFkYmFkYmFk"
+	if err := r.update(ctx, []string{"home.example.com"}, netip.MustParseAddr("203.0.113.1"), netip.Addr{}); err == nil {
+		t.Fatal("want an error with a bad key")
+	}
+}
+
+func Test_urlDetector(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, r.URL.Query().Get("ip"))
+	}))
+	defer srv.Close()
+
+	d := urlDetector(srv.URL+"/?ip=203.0.113.1", srv.URL+"/?ip=203.0.113.2")
+	addr, err := d(context.Background(), "tcp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != netip.MustParseAddr("203.0.113.1") {
+		t.Fatalf("unexpected addr %s", addr)
+	}
+
+	d = urlDetector(srv.URL+"/?ip=2001:db8::1", "")
+	if _, err := d(context.Background(), "tcp4"); err == nil {
+		t.Fatal("want a family error")
+	}
+}
+
+func Test_pickAddr(t *testing.T) {
+	var addrs []net.Addr
+	for _, s := range []string{"127.0.0.1/8", "fe80::1/64", "fd00::1/64", "192.168.1.2/24", "2001:db8::1/64"} {
+		ip, ipNet, _ := net.ParseCIDR(s)
+		ipNet.IP = ip
+		addrs = append(addrs, ipNet)
+	}
+	if a, err := pickAddr(addrs, true); err != nil || a.String() != "192.168.1.2" {
+		t.Fatalf("unexpected v4 %s, %v", a, err)
+	}
+	if a, err := pickAddr(addrs, false); err != nil || a.String() != "2001:db8::1" {
+		t.Fatalf("unexpected v6 %s, %v", a, err)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// detector detects the current wan address of a family. network is
+// "tcp4" or "tcp6".
+type detector func(ctx context.Context, network string) (netip.Addr, error)
+
+// urlDetector returns a detector that gets the address from the text
+// response of an http url, e.g. "https://api.ipify.org".
+func urlDetector(v4URL, v6URL string) detector {
+	clients := make(map[string]*http.Client, 2)
+	for _, network := range []string{"tcp4", "tcp6"} {
+		d := &net.Dialer{}
+		network := network
+		clients[network] = &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return d.DialContext(ctx, network, addr)
+			},
+		}}
+	}
+	return func(ctx context.Context, network string) (netip.Addr, error) {
+		u := v4URL
+		if network == "tcp6" {
+			u = v6URL
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		resp, err := clients[network].Do(req)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return netip.Addr{}, fmt.Errorf("http status %d", resp.StatusCode)
+		}
+		b, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		addr, err := netip.ParseAddr(strings.TrimSpace(string(b)))
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid response, %w", err)
+		}
+		if addr.Is4() != (network == "tcp4") {
+			return netip.Addr{}, fmt.Errorf("unexpected address family %s", addr)
+		}
+		return addr, nil
+	}
+}
+
+// interfaceDetector returns a detector that gets the first global unicast
+// address of an interface. Unique local ipv6 addresses are ignored.
+func interfaceDetector(name string) detector {
+	return func(_ context.Context, network string) (netip.Addr, error) {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		return pickAddr(addrs, network == "tcp4")
+	}
+}
+
+func pickAddr(addrs []net.Addr, v4 bool) (netip.Addr, error) {
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if addr.Is4() != v4 || !addr.IsGlobalUnicast() || (!v4 && addr.IsPrivate()) {
+			continue
+		}
+		return addr, nil
+	}
+	return netip.Addr{}, errors.New("interface has no global unicast address")
+}
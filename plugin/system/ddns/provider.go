@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+const (
+	cloudflareEndpoint = "https://api.cloudflare.com/client/v4"
+	duckdnsEndpoint    = "https://www.duckdns.org"
+)
+
+// provider updates records of domains. Invalid addresses are skipped.
+type provider interface {
+	update(ctx context.Context, domains []string, v4, v6 netip.Addr) error
+}
+
+type CloudflareArgs struct {
+	APIToken string `yaml:"api_token"` // Required. Needs the Zone.DNS edit permission.
+	ZoneID   string `yaml:"zone_id"`   // Required.
+	TTL      int    `yaml:"ttl"`       // Default is 1 (automatic).
+	Proxied  bool   `yaml:"proxied"`
+}
+
+type cloudflare struct {
+	args     *CloudflareArgs
+	endpoint string
+	client   *http.Client
+}
+
+func newCloudflare(args *CloudflareArgs) (*cloudflare, error) {
+	if len(args.APIToken) == 0 || len(args.ZoneID) == 0 {
+		return nil, errors.New("cloudflare requires api_token and zone_id")
+	}
+	if args.TTL == 0 {
+		args.TTL = 1
+	}
+	return &cloudflare{args: args, endpoint: cloudflareEndpoint, client: &http.Client{}}, nil
+}
+
+type cfRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+	Proxied *bool  `json:"proxied,omitempty"`
+}
+
+type cfResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (c *cloudflare) update(ctx context.Context, domains []string, v4, v6 netip.Addr) error {
+	for _, domain := range domains {
+		for _, addr := range []netip.Addr{v4, v6} {
+			if !addr.IsValid() {
+				continue
+			}
+			if err := c.updateRecord(ctx, domain, addr); err != nil {
+				return fmt.Errorf("failed to update %s, %w", domain, err)
+			}
+		}
+	}
+	return nil
+}
+
+// updateRecord updates the first record of domain, or creates one if
+// there is none.
+func (c *cloudflare) updateRecord(ctx context.Context, domain string, addr netip.Addr) error {
+	typ := "A"
+	if addr.Is6() {
+		typ = "AAAA"
+	}
+	var records []cfRecord
+	q := url.Values{"type": {typ}, "name": {domain}}
+	if err := c.call(ctx, http.MethodGet, "/dns_records?"+q.Encode(), nil, &records); err != nil {
+		return err
+	}
+	if len(records) > 0 {
+		if records[0].Content == addr.String() {
+			return nil
+		}
+		return c.call(ctx, http.MethodPatch, "/dns_records/"+url.PathEscape(records[0].ID), cfRecord{Content: addr.String()}, nil)
+	}
+	r := cfRecord{Type: typ, Name: domain, Content: addr.String(), TTL: c.args.TTL, Proxied: &c.args.Proxied}
+	return c.call(ctx, http.MethodPost, "/dns_records", r, nil)
+}
+
+// call calls the zone api at path. body and result can be nil.
+func (c *cloudflare) call(ctx context.Context, method, path string, body, result any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	u := c.endpoint + "/zones/" + url.PathEscape(c.args.ZoneID) + path
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.args.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var cr cfResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&cr); err != nil {
+		return fmt.Errorf("invalid response, http status %d, %w", resp.StatusCode, err)
+	}
+	if !cr.Success {
+		var msgs []string
+		for _, e := range cr.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d: %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("cloudflare error, http status %d, %s", resp.StatusCode, strings.Join(msgs, "; "))
+	}
+	if result != nil {
+		return json.Unmarshal(cr.Result, result)
+	}
+	return nil
+}
+
+type DuckDNSArgs struct {
+	Token string `yaml:"token"` // Required.
+}
+
+type duckdns struct {
+	token    string
+	endpoint string
+	client   *http.Client
+}
+
+func newDuckDNS(args *DuckDNSArgs) (*duckdns, error) {
+	if len(args.Token) == 0 {
+		return nil, errors.New("duckdns requires token")
+	}
+	return &duckdns{token: args.Token, endpoint: duckdnsEndpoint, client: &http.Client{}}, nil
+}
+
+// update updates all domains in one request. Domains can be full names
+// ("x.duckdns.org") or sub domains ("x").
+func (d *duckdns) update(ctx context.Context, domains []string, v4, v6 netip.Addr) error {
+	subs := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		subs = append(subs, strings.TrimSuffix(domain, ".duckdns.org"))
+	}
+	q := url.Values{"domains": {strings.Join(subs, ",")}, "token": {d.token}}
+	if v4.IsValid() {
+		q.Set("ip", v4.String())
+	}
+	if v6.IsValid() {
+		q.Set("ipv6", v6.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.endpoint+"/update?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if resp.StatusCode != http.StatusOK || !bytes.HasPrefix(b, []byte("OK")) {
+		return fmt.Errorf("duckdns update failed, http status %d, %q", resp.StatusCode, bytes.TrimSpace(b))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type RFC2136Args struct {
+	Server string `yaml:"server"` // Required. e.g. "192.168.1.1:53".
+	Zone   string `yaml:"zone"`   // Required.
+	TTL    uint32 `yaml:"ttl"`    // Default is 300.
+
+	TSIGName      string `yaml:"tsig_name"`
+	TSIGSecret    string `yaml:"tsig_secret"`    // base64
+	TSIGAlgorithm string `yaml:"tsig_algorithm"` // Default is "hmac-sha256".
+}
+
+// rfc2136 sends dns updates (RFC 2136), signed with tsig if it is
+// configured.
+type rfc2136 struct {
+	args *RFC2136Args
+	zone string
+	alg  string
+}
+
+func newRFC2136(args *RFC2136Args) (*rfc2136, error) {
+	if len(args.Server) == 0 || len(args.Zone) == 0 {
+		return nil, errors.New("rfc2136 requires server and zone")
+	}
+	if _, _, err := net.SplitHostPort(args.Server); err != nil {
+		args.Server = net.JoinHostPort(args.Server, "53")
+	}
+	if args.TTL == 0 {
+		args.TTL = 300
+	}
+	if (len(args.TSIGName) == 0) != (len(args.TSIGSecret) == 0) {
+		return nil, errors.New("tsig_name and tsig_secret must be set together")
+	}
+	alg := dns.Fqdn(args.TSIGAlgorithm)
+	if len(args.TSIGAlgorithm) == 0 {
+		alg = dns.HmacSHA256
+	}
+	return &rfc2136{args: args, zone: dns.Fqdn(args.Zone), alg: alg}, nil
+}
+
+// update replaces A and AAAA records of domains in one update message.
+func (r *rfc2136) update(ctx context.Context, domains []string, v4, v6 netip.Addr) error {
+	m := new(dns.Msg)
+	m.SetUpdate(r.zone)
+	for _, domain := range domains {
+		name := dns.Fqdn(domain)
+		if !dns.IsSubDomain(r.zone, name) {
+			return fmt.Errorf("%s is not in zone %s", domain, r.zone)
+		}
+		if v4.IsValid() {
+			h := dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: r.args.TTL}
+			m.RemoveRRset([]dns.RR{&dns.A{Hdr: h}})
+			m.Insert([]dns.RR{&dns.A{Hdr: h, A: v4.AsSlice()}})
+		}
+		if v6.IsValid() {
+			h := dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: r.args.TTL}
+			m.RemoveRRset([]dns.RR{&dns.AAAA{Hdr: h}})
+			m.Insert([]dns.RR{&dns.AAAA{Hdr: h, AAAA: v6.AsSlice()}})
+		}
+	}
+
+	c := &dns.Client{Net: "tcp", Timeout: 10 * time.Second}
+	if len(r.args.TSIGName) > 0 {
+		name := dns.Fqdn(r.args.TSIGName)
+		c.TsigSecret = map[string]string{name: r.args.TSIGSecret}
+		m.SetTsig(name, r.alg, 300, time.Now().Unix())
+	}
+	resp, _, err := c.ExchangeContext(ctx, m, r.args.Server)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("dns update failed, %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package macos_resolver routes queries of specific domains to mosdns
+// with macOS scoped resolvers (/etc/resolver/<domain>).
+package macos_resolver
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+const PluginType = "macos_resolver"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	// Domains that will be resolved by mosdns. Required.
+	Domains []string `yaml:"domains"`
+
+	// Nameserver is the addr of mosdns. Default is 127.0.0.1.
+	Nameserver string `yaml:"nameserver"`
+	// Port of mosdns. Default is 53.
+	Port int `yaml:"port"`
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultString(&a.Nameserver, "127.0.0.1")
+	utils.SetDefaultNum(&a.Port, 53)
+	if !utils.CheckNumRange(a.Port, 1, 65535) {
+		return fmt.Errorf("invalid port %d", a.Port)
+	}
+	if _, err := netip.ParseAddr(a.Nameserver); err != nil {
+		return fmt.Errorf("invalid nameserver, %w", err)
+	}
+	if len(a.Domains) == 0 {
+		return errors.New("no domain is configured")
+	}
+	for i, d := range a.Domains {
+		d = strings.TrimSuffix(strings.ToLower(d), ".")
+		if len(d) == 0 || strings.ContainsAny(d, "/\\ ") {
+			return fmt.Errorf("invalid domain #%d %q", i, a.Domains[i])
+		}
+		a.Domains[i] = d
+	}
+	return nil
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if err := a.init(); err != nil {
+		return nil, err
+	}
+	return newResolver(a, bp.L())
+}
+
+func resolverFileContent(a *Args) []byte {
+	return []byte(fmt.Sprintf("# Generated by mosdns.\nnameserver %s\nport %d\n", a.Nameserver, a.Port))
+}
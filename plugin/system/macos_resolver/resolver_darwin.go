@@ -0,0 +1,112 @@
+//go:build darwin
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package macos_resolver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"go.uber.org/zap"
+)
+
+const resolverDir = "/etc/resolver"
+
+type resolver struct {
+	logger *zap.Logger
+
+	// Files that were written by this plugin. If the file existed
+	// before, its original content is kept.
+	files     map[string][]byte // nil value means the file did not exist.
+	releases  map[string]func() (last bool)
+	closeOnce sync.Once
+}
+
+func newResolver(args *Args, logger *zap.Logger) (*resolver, error) {
+	if err := os.MkdirAll(resolverDir, 0755); err != nil {
+		return nil, err
+	}
+	r := &resolver{logger: logger, files: make(map[string][]byte), releases: make(map[string]func() bool)}
+	content := resolverFileContent(args)
+	for _, d := range args.Domains {
+		f := filepath.Join(resolverDir, d)
+		// The instance of a graceful reload may hold the file as well.
+		// The original content is the one before any instance wrote it.
+		original, release, err := coremain.HoldSystemState("macos_resolver/"+f, func() ([]byte, error) {
+			b, err := os.ReadFile(f)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, nil
+			}
+			return b, err
+		})
+		if err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+		r.files[f] = original
+		r.releases[f] = release
+		if err := os.WriteFile(f, content, 0644); err != nil {
+			_ = r.Close()
+			return nil, fmt.Errorf("failed to write %s, %w", f, err)
+		}
+	}
+	flushSystemCache()
+	logger.Info("scoped resolvers installed", zap.Strings("domains", args.Domains))
+	return r, nil
+}
+
+// Close removes the scoped resolvers and restores the original files
+// that are not held by other instances.
+func (r *resolver) Close() error {
+	var errs []error
+	r.closeOnce.Do(func() {
+		for f, original := range r.files {
+			if !r.releases[f]() {
+				continue
+			}
+			var err error
+			if original == nil {
+				err = os.Remove(f)
+			} else {
+				err = os.WriteFile(f, original, 0644)
+			}
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				r.logger.Error("failed to restore scoped resolver", zap.String("file", f), zap.Error(err))
+				errs = append(errs, err)
+			}
+		}
+		flushSystemCache()
+		r.logger.Info("scoped resolvers removed")
+	})
+	return errors.Join(errs...)
+}
+
+// flushSystemCache asks SystemConfiguration/mDNSResponder to reload
+// resolver settings and drop cached answers.
+func flushSystemCache() {
+	_ = exec.Command("dscacheutil", "-flushcache").Run()
+	_ = exec.Command("killall", "-HUP", "mDNSResponder").Run()
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package odhcpd_dns announces mosdns as the IPv6 resolver of an OpenWrt
+// lan by setting the "dns" option of odhcpd. odhcpd then advertises it
+// as RDNSS in router advertisements and as the DHCPv6 dns server.
+package odhcpd_dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"go.uber.org/zap"
+)
+
+const PluginType = "odhcpd_dns"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	// Addrs are the IPv6 addresses of mosdns. Required.
+	Addrs []string `yaml:"addrs"`
+
+	// Section is the uci section in /etc/config/dhcp. Default is "lan".
+	Section string `yaml:"section"`
+
+	// Restore restores the original settings on shutdown.
+	// Default is true.
+	Restore *bool `yaml:"restore"`
+}
+
+func (a *Args) init() {
+	if len(a.Section) == 0 {
+		a.Section = "lan"
+	}
+	if a.Restore == nil {
+		t := true
+		a.Restore = &t
+	}
+}
+
+type OdhcpdDns struct {
+	args   *Args
+	logger *zap.Logger
+
+	// original value of the dns option, nil if it was unset.
+	original  []string
+	release   func() (last bool)
+	closeOnce sync.Once
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewOdhcpdDns(args.(*Args), bp.L())
+}
+
+func NewOdhcpdDns(args *Args, logger *zap.Logger) (*OdhcpdDns, error) {
+	args.init()
+	if len(args.Addrs) == 0 {
+		return nil, errors.New("no addr is configured")
+	}
+	for _, s := range args.Addrs {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid addr %s, %w", s, err)
+		}
+		if !addr.Is6() || addr.Is4In6() {
+			return nil, fmt.Errorf("%s is not an ipv6 addr", s)
+		}
+	}
+	if _, err := exec.LookPath("uci"); err != nil {
+		return nil, fmt.Errorf("uci is not available, this plugin only works on OpenWrt, %w", err)
+	}
+
+	p := &OdhcpdDns{args: args, logger: logger}
+	// The instance of a graceful reload holds the option as well. The
+	// original value is the one before any instance changed it.
+	original, release, err := coremain.HoldSystemState(PluginType+"/"+args.Section, p.getDns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read current settings, %w", err)
+	}
+	p.original, p.release = original, release
+	if err := p.setDns(args.Addrs); err != nil {
+		release()
+		return nil, fmt.Errorf("failed to announce dns, %w", err)
+	}
+	logger.Info("dns announced via odhcpd", zap.Strings("addrs", args.Addrs), zap.Strings("original", original))
+	return p, nil
+}
+
+func (p *OdhcpdDns) option() string {
+	return "dhcp." + p.args.Section + ".dns"
+}
+
+func (p *OdhcpdDns) getDns() ([]string, error) {
+	out, err := uci("-q", "get", p.option())
+	if err != nil {
+		// uci exits with 1 if the option is not set.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+func (p *OdhcpdDns) setDns(addrs []string) error {
+	if _, err := uci("-q", "delete", p.option()); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return err
+		}
+	}
+	for _, addr := range addrs {
+		if _, err := uci("add_list", p.option()+"="+addr); err != nil {
+			return err
+		}
+	}
+	if _, err := uci("commit", "dhcp"); err != nil {
+		return err
+	}
+	return exec.Command("/etc/init.d/odhcpd", "reload").Run()
+}
+
+// Close restores the original settings if Args.Restore is true and no
+// other instance holds them.
+func (p *OdhcpdDns) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		if !p.release() || !*p.args.Restore {
+			return
+		}
+		err = p.setDns(p.original)
+		if err != nil {
+			p.logger.Error("failed to restore odhcpd dns settings", zap.Error(err))
+			return
+		}
+		p.logger.Info("odhcpd dns settings restored", zap.Strings("addrs", p.original))
+	})
+	return err
+}
+
+func uci(args ...string) (string, error) {
+	cmd := exec.Command("uci", args...)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if stderr.Len() > 0 {
+			return "", fmt.Errorf("uci %s: %w, %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,339 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package port_mapping maps ports of mosdns listeners (e.g. DoT, DoH and
+// DoQ servers) on the home router with NAT-PMP or UPnP, so they can be
+// reached from the internet. Mappings are renewed at half of their
+// lifetime and deleted on shutdown.
+package port_mapping
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/portmap"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const PluginType = "port_mapping"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	discoverTimeout = time.Second * 10
+	retryInterval   = time.Minute
+	minRenew        = time.Minute
+)
+
+type Args struct {
+	// Servers are tags of server plugins, in the format of
+	// "<tag>[:external_port]". The external port is the listening port
+	// by default. Required.
+	Servers []string `yaml:"servers"`
+
+	// Protocol is "auto" (default), "natpmp" or "upnp".
+	Protocol string `yaml:"protocol"`
+	// Gateway is the NAT-PMP gateway. Default is the default gateway
+	// (only on linux).
+	Gateway string `yaml:"gateway"`
+	// Lifetime of mappings in seconds. Default is 3600.
+	Lifetime int `yaml:"lifetime"`
+}
+
+func (a *Args) init() error {
+	utils.SetDefaultString(&a.Protocol, portmap.ProtocolAuto)
+	utils.SetDefaultNum(&a.Lifetime, 3600)
+	if len(a.Servers) == 0 {
+		return errors.New("no server is configured")
+	}
+	switch a.Protocol {
+	case portmap.ProtocolAuto, portmap.ProtocolNATPMP, portmap.ProtocolUPnP:
+	default:
+		return fmt.Errorf("invalid protocol %s", a.Protocol)
+	}
+	if a.Lifetime < 120 {
+		return errors.New("lifetime must be at least 120s")
+	}
+	return nil
+}
+
+// mapping is a port mapping of a server.
+type mapping struct {
+	Server       string    `json:"server"`
+	Proto        string    `json:"proto"`
+	InternalPort uint16    `json:"internal_port"`
+	ExternalPort uint16    `json:"external_port"` // the requested port until it is mapped
+	Expires      time.Time `json:"expires,omitempty"`
+	Error        string    `json:"error,omitempty"`
+
+	// release releases the mapping. The mapping is deleted only if it
+	// was the last holder. See coremain.HoldSystemState.
+	release func() (last bool)
+}
+
+// hold sets m.release. Instances of a graceful reload hold the same
+// mapping at the same time, only the last one deletes it.
+func (m *mapping) hold() {
+	key := fmt.Sprintf("%s/%s/%d/%d", PluginType, m.Proto, m.InternalPort, m.ExternalPort)
+	_, m.release, _ = coremain.HoldSystemState(key, func() (struct{}, error) { return struct{}{}, nil })
+}
+
+// Status is the status of port mappings.
+type Status struct {
+	Protocol     string    `json:"protocol,omitempty"`
+	ExternalAddr string    `json:"external_addr,omitempty"`
+	Mappings     []mapping `json:"mappings"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+type discoverFunc func(ctx context.Context) (portmap.Mapper, error)
+
+type PortMapping struct {
+	logger   *zap.Logger
+	discover discoverFunc
+	lifetime time.Duration
+
+	statusMu sync.Mutex
+	mapper   portmap.Mapper
+	mappings []mapping
+	status   Status
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	closed      chan struct{}
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if err := a.init(); err != nil {
+		return nil, err
+	}
+	var gateway netip.Addr
+	if len(a.Gateway) > 0 {
+		var err error
+		if gateway, err = netip.ParseAddr(a.Gateway); err != nil {
+			return nil, fmt.Errorf("invalid gateway, %w", err)
+		}
+	}
+
+	var mappings []mapping
+	for _, s := range a.Servers {
+		m, err := serverMapping(bp, s)
+		if err != nil {
+			for _, m := range mappings {
+				m.release()
+			}
+			return nil, err
+		}
+		mappings = append(mappings, m)
+	}
+	discover := func(ctx context.Context) (portmap.Mapper, error) {
+		return portmap.Discover(ctx, a.Protocol, gateway)
+	}
+	p := newPortMapping(mappings, time.Duration(a.Lifetime)*time.Second, discover, bp.L())
+	bp.RegAPI(p.Api())
+	return p, nil
+}
+
+// serverMapping returns the mapping of server entry s.
+func serverMapping(bp *coremain.BP, s string) (mapping, error) {
+	tag, portStr, hasPort := strings.Cut(s, ":")
+	server, _ := bp.M().GetPlugin(tag).(interface{ Addr() net.Addr })
+	if server == nil {
+		return mapping{}, fmt.Errorf("cannot find server by tag %s", tag)
+	}
+	var (
+		proto string
+		port  int
+	)
+	switch addr := server.Addr().(type) {
+	case *net.TCPAddr:
+		proto, port = "tcp", addr.Port
+	case *net.UDPAddr:
+		proto, port = "udp", addr.Port
+	default:
+		return mapping{}, fmt.Errorf("server %s is not listening on a tcp or udp port", tag)
+	}
+	m := mapping{Server: tag, Proto: proto, InternalPort: uint16(port), ExternalPort: uint16(port)}
+	if hasPort {
+		ep, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || ep == 0 {
+			return mapping{}, fmt.Errorf("invalid external port in %s", s)
+		}
+		m.ExternalPort = uint16(ep)
+	}
+	m.hold()
+	return m, nil
+}
+
+func newPortMapping(mappings []mapping, lifetime time.Duration, discover discoverFunc, logger *zap.Logger) *PortMapping {
+	p := &PortMapping{
+		logger:      logger,
+		discover:    discover,
+		lifetime:    lifetime,
+		mappings:    mappings,
+		closeNotify: make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *PortMapping) loop() {
+	defer close(p.closed)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(p.refresh())
+		case <-p.closeNotify:
+			return
+		}
+	}
+}
+
+// refresh discovers the gateway if it is unknown, and (re)creates all
+// mappings. It returns the time until the next refresh.
+func (p *PortMapping) refresh() time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+	defer cancel()
+
+	p.statusMu.Lock()
+	mapper := p.mapper
+	p.statusMu.Unlock()
+	if mapper == nil {
+		m, err := p.discover(ctx)
+		if err != nil {
+			p.logger.Warn("failed to discover gateway", zap.Error(err))
+			p.setErr(err)
+			return retryInterval
+		}
+		mapper = m
+	}
+
+	extAddr, err := mapper.ExternalAddr(ctx)
+	if err != nil {
+		p.logger.Warn("failed to get external address", zap.Error(err))
+		p.statusMu.Lock()
+		p.mapper = nil // discovers again
+		p.statusMu.Unlock()
+		p.setErr(err)
+		return retryInterval
+	}
+
+	next := p.lifetime / 2
+	var mappings []mapping
+	p.statusMu.Lock()
+	mappings = append(mappings, p.mappings...)
+	p.statusMu.Unlock()
+	for i := range mappings {
+		m := &mappings[i]
+		port, lifetime, err := mapper.Map(ctx, m.Proto, m.InternalPort, m.ExternalPort, p.lifetime)
+		if err != nil {
+			m.Error = err.Error()
+			m.Expires = time.Time{}
+			p.logger.Warn("failed to map port", zap.String("server", m.Server), zap.String("proto", m.Proto), zap.Uint16("port", m.ExternalPort), zap.Error(err))
+			next = min(next, retryInterval)
+			continue
+		}
+		if m.Expires.IsZero() {
+			p.logger.Info("port mapped", zap.String("server", m.Server), zap.String("proto", m.Proto), zap.Stringer("external", netip.AddrPortFrom(extAddr, port)))
+		}
+		m.Error = ""
+		m.ExternalPort = port
+		m.Expires = time.Now().Add(lifetime)
+		next = min(next, max(lifetime/2, minRenew))
+	}
+
+	p.statusMu.Lock()
+	p.mapper = mapper
+	p.mappings = mappings
+	p.status.Protocol = mapper.Protocol()
+	p.status.ExternalAddr = extAddr.String()
+	p.status.LastError = ""
+	p.statusMu.Unlock()
+	return next
+}
+
+func (p *PortMapping) setErr(err error) {
+	p.statusMu.Lock()
+	p.status.LastError = err.Error()
+	p.statusMu.Unlock()
+}
+
+func (p *PortMapping) Status() Status {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	s := p.status
+	s.Mappings = append([]mapping(nil), p.mappings...)
+	return s
+}
+
+// Api serves the status at "/status".
+func (p *PortMapping) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.Status())
+	})
+	return r
+}
+
+// Close stops renewing and deletes mappings that are not held by
+// other instances.
+func (p *PortMapping) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closeNotify)
+		<-p.closed
+
+		p.statusMu.Lock()
+		mapper, mappings := p.mapper, p.mappings
+		p.statusMu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		for _, m := range mappings {
+			// The instance of a graceful reload renews the same mapping.
+			if m.release != nil && !m.release() {
+				continue
+			}
+			if mapper == nil || m.Expires.IsZero() {
+				continue
+			}
+			if err := mapper.Unmap(ctx, m.Proto, m.InternalPort, m.ExternalPort); err != nil {
+				p.logger.Warn("failed to delete port mapping", zap.String("server", m.Server), zap.Error(err))
+			}
+		}
+	})
+	return nil
+}
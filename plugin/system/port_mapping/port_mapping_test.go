@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package port_mapping
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/portmap"
+	"go.uber.org/zap"
+)
+
+type fakeMapper struct {
+	mu       sync.Mutex
+	mapped   map[uint16]uint16 // internal -> external
+	unmapped int
+}
+
+func (m *fakeMapper) Protocol() string { return portmap.ProtocolNATPMP }
+
+func (m *fakeMapper) ExternalAddr(context.Context) (netip.Addr, error) {
+	return netip.MustParseAddr("203.0.113.1"), nil
+}
+
+func (m *fakeMapper) Map(_ context.Context, _ string, internalPort, externalPort uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if internalPort == 443 {
+		return 0, 0, errors.New("refused")
+	}
+	m.mapped[internalPort] = externalPort + 10000
+	return externalPort + 10000, lifetime, nil
+}
+
+func (m *fakeMapper) Unmap(_ context.Context, _ string, internalPort, _ uint16) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.mapped, internalPort)
+	m.unmapped++
+	return nil
+}
+
+func TestPortMapping(t *testing.T) {
+	fm := &fakeMapper{mapped: make(map[uint16]uint16)}
+	discover := func(context.Context) (portmap.Mapper, error) { return fm, nil }
+	mappings := []mapping{
+		{Server: "dot", Proto: "tcp", InternalPort: 853, ExternalPort: 853},
+		{Server: "doh", Proto: "tcp", InternalPort: 443, ExternalPort: 443},
+	}
+	p := newPortMapping(mappings, time.Hour, discover, zap.NewNop())
+
+	var s Status
+	for i := 0; i < 100; i++ {
+		if s = p.Status(); len(s.ExternalAddr) > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if s.ExternalAddr != "203.0.113.1" || s.Protocol != portmap.ProtocolNATPMP {
+		t.Fatalf("unexpected status %+v", s)
+	}
+	if m := s.Mappings[0]; m.ExternalPort != 10853 || m.Expires.IsZero() || len(m.Error) > 0 {
+		t.Fatalf("unexpected mapping %+v", m)
+	}
+	if m := s.Mappings[1]; !m.Expires.IsZero() || m.Error != "refused" {
+		t.Fatalf("want a failed mapping, got %+v", m)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fm.mapped) != 0 || fm.unmapped != 1 {
+		t.Fatalf("want mappings deleted, got %v, %d", fm.mapped, fm.unmapped)
+	}
+}
+
+func TestPortMapping_overlap(t *testing.T) {
+	fm := &fakeMapper{mapped: make(map[uint16]uint16)}
+	discover := func(context.Context) (portmap.Mapper, error) { return fm, nil }
+	newP := func() *PortMapping {
+		m := mapping{Server: "dot", Proto: "tcp", InternalPort: 853, ExternalPort: 853}
+		m.hold()
+		p := newPortMapping([]mapping{m}, time.Hour, discover, zap.NewNop())
+		for i := 0; i < 100 && p.Status().Mappings[0].Expires.IsZero(); i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		return p
+	}
+
+	// The old and the new instance of a graceful reload.
+	oldP, newP2 := newP(), newP()
+	_ = oldP.Close()
+	if len(fm.mapped) != 1 || fm.unmapped != 0 {
+		t.Fatalf("mapping of the new instance was deleted, %v, %d", fm.mapped, fm.unmapped)
+	}
+	_ = newP2.Close()
+	if len(fm.mapped) != 0 || fm.unmapped != 1 {
+		t.Fatalf("want mappings deleted, got %v, %d", fm.mapped, fm.unmapped)
+	}
+}
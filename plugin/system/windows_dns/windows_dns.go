@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package windows_dns registers mosdns as the dns server of network
+// interfaces and/or as the NRPT nameserver of selected suffixes on Windows.
+package windows_dns
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+)
+
+const PluginType = "windows_dns"
+
+// nrptComment marks NRPT rules that are managed by this plugin.
+const nrptComment = "mosdns"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	// Addrs are the addrs of mosdns. Default is 127.0.0.1.
+	Addrs []string `yaml:"addrs"`
+
+	// Interfaces are aliases of the interfaces whose dns servers will be
+	// set to Addrs. If empty and SetInterfaceDNS is true, all interfaces
+	// that are up will be used.
+	Interfaces      []string `yaml:"interfaces"`
+	SetInterfaceDNS bool     `yaml:"set_interface_dns"`
+
+	// NRPTSuffixes are namespaces (e.g. ".corp.example.com") that will be
+	// routed to Addrs by Name Resolution Policy Table rules.
+	NRPTSuffixes []string `yaml:"nrpt_suffixes"`
+}
+
+func (a *Args) init() error {
+	if len(a.Addrs) == 0 {
+		a.Addrs = []string{"127.0.0.1"}
+	}
+	for _, s := range a.Addrs {
+		if _, err := netip.ParseAddr(s); err != nil {
+			return fmt.Errorf("invalid addr %s, %w", s, err)
+		}
+	}
+	for i, s := range a.NRPTSuffixes {
+		if len(s) == 0 || strings.ContainsAny(s, "'\"`; ") {
+			return fmt.Errorf("invalid nrpt suffix #%d %q", i, s)
+		}
+		if !strings.HasPrefix(s, ".") {
+			a.NRPTSuffixes[i] = "." + s
+		}
+	}
+	for i, s := range a.Interfaces {
+		if len(s) == 0 || strings.ContainsAny(s, "'\"`;") {
+			return fmt.Errorf("invalid interface #%d %q", i, s)
+		}
+	}
+	if !a.SetInterfaceDNS && len(a.NRPTSuffixes) == 0 {
+		return errors.New("neither set_interface_dns nor nrpt_suffixes is configured")
+	}
+	return nil
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if err := a.init(); err != nil {
+		return nil, err
+	}
+	return newWindowsDns(a, bp.L())
+}
+
+// psQuote quotes s as a powershell single-quoted string.
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func psList(ss []string) string {
+	q := make([]string, 0, len(ss))
+	for _, s := range ss {
+		q = append(q, psQuote(s))
+	}
+	return "@(" + strings.Join(q, ",") + ")"
+}
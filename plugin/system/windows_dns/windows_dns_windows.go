@@ -0,0 +1,174 @@
+//go:build windows
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windows_dns
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"go.uber.org/zap"
+)
+
+type windowsDns struct {
+	args   *Args
+	logger *zap.Logger
+
+	// original dns servers of interfaces. Empty value means the
+	// interface used dhcp assigned servers.
+	original map[string][]string
+	releases map[string]func() (last bool)
+	// releaseNrpt is nil if no nrpt rule is added.
+	releaseNrpt func() (last bool)
+	closeOnce   sync.Once
+}
+
+func newWindowsDns(args *Args, logger *zap.Logger) (*windowsDns, error) {
+	p := &windowsDns{args: args, logger: logger, original: make(map[string][]string), releases: make(map[string]func() bool)}
+
+	// Remove rules that were left by a previous run that did not exit
+	// cleanly, or were added by the old instance of a graceful reload.
+	if err := removeNrptRules(); err != nil {
+		return nil, fmt.Errorf("failed to remove stale nrpt rules, %w", err)
+	}
+
+	if args.SetInterfaceDNS {
+		ifaces := args.Interfaces
+		if len(ifaces) == 0 {
+			out, err := powershell("Get-NetAdapter | Where-Object Status -eq 'Up' | Select-Object -ExpandProperty Name")
+			if err != nil {
+				return nil, fmt.Errorf("failed to list interfaces, %w", err)
+			}
+			for _, line := range strings.Split(out, "\n") {
+				if line = strings.TrimSpace(line); len(line) > 0 {
+					ifaces = append(ifaces, line)
+				}
+			}
+		}
+		for _, iface := range ifaces {
+			// The instance of a graceful reload may hold the interface as
+			// well. The original servers are the ones before any instance
+			// changed them.
+			servers, release, err := coremain.HoldSystemState(PluginType+"/interface/"+iface, func() ([]string, error) {
+				return staticDnsServers(iface)
+			})
+			if err != nil {
+				_ = p.Close()
+				return nil, fmt.Errorf("failed to get dns servers of %s, %w", iface, err)
+			}
+			p.original[iface] = servers
+			p.releases[iface] = release
+			if err := setInterfaceDns(iface, args.Addrs); err != nil {
+				_ = p.Close()
+				return nil, fmt.Errorf("failed to set dns servers of %s, %w", iface, err)
+			}
+			logger.Info("interface dns servers set", zap.String("interface", iface), zap.Strings("original", p.original[iface]))
+		}
+	}
+
+	if len(args.NRPTSuffixes) > 0 {
+		_, p.releaseNrpt, _ = coremain.HoldSystemState(PluginType+"/nrpt", func() (struct{}, error) { return struct{}{}, nil })
+	}
+	for _, suffix := range args.NRPTSuffixes {
+		cmd := fmt.Sprintf("Add-DnsClientNrptRule -Namespace %s -NameServers %s -Comment %s", psQuote(suffix), psList(args.Addrs), psQuote(nrptComment))
+		if _, err := powershell(cmd); err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("failed to add nrpt rule for %s, %w", suffix, err)
+		}
+	}
+	if len(args.NRPTSuffixes) > 0 {
+		logger.Info("nrpt rules added", zap.Strings("suffixes", args.NRPTSuffixes))
+	}
+	_, _ = powershell("Clear-DnsClientCache")
+	return p, nil
+}
+
+// Close restores interface dns servers and removes nrpt rules that are
+// not held by other instances.
+func (p *windowsDns) Close() error {
+	var errs []error
+	p.closeOnce.Do(func() {
+		for iface, servers := range p.original {
+			if !p.releases[iface]() {
+				continue
+			}
+			if err := setInterfaceDns(iface, servers); err != nil {
+				p.logger.Error("failed to restore interface dns servers", zap.String("interface", iface), zap.Error(err))
+				errs = append(errs, err)
+			}
+		}
+		if p.releaseNrpt != nil && p.releaseNrpt() {
+			if err := removeNrptRules(); err != nil {
+				p.logger.Error("failed to remove nrpt rules", zap.Error(err))
+				errs = append(errs, err)
+			}
+		}
+		_, _ = powershell("Clear-DnsClientCache")
+		p.logger.Info("windows dns settings restored")
+	})
+	return errors.Join(errs...)
+}
+
+// staticDnsServers returns the statically configured dns servers of iface.
+// Get-DnsClientServerAddress can't be used here because it also returns
+// servers assigned by dhcp, which must not be restored as static ones.
+func staticDnsServers(iface string) ([]string, error) {
+	cmd := fmt.Sprintf(`$g = (Get-NetAdapter -Name %s -ErrorAction Stop).InterfaceGuid
+foreach ($k in 'Tcpip', 'Tcpip6') {
+	(Get-ItemProperty -Path "HKLM:\SYSTEM\CurrentControlSet\Services\$k\Parameters\Interfaces\$g" -Name NameServer -ErrorAction SilentlyContinue).NameServer
+}`, psQuote(iface))
+	out, err := powershell(cmd)
+	if err != nil {
+		return nil, err
+	}
+	// NameServer is a comma or space separated list.
+	return strings.FieldsFunc(out, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}), nil
+}
+
+func setInterfaceDns(iface string, servers []string) error {
+	var cmd string
+	if len(servers) == 0 {
+		cmd = fmt.Sprintf("Set-DnsClientServerAddress -InterfaceAlias %s -ResetServerAddresses", psQuote(iface))
+	} else {
+		cmd = fmt.Sprintf("Set-DnsClientServerAddress -InterfaceAlias %s -ServerAddresses %s", psQuote(iface), psList(servers))
+	}
+	_, err := powershell(cmd)
+	return err
+}
+
+func removeNrptRules() error {
+	_, err := powershell(fmt.Sprintf("Get-DnsClientNrptRule | Where-Object Comment -eq %s | Remove-DnsClientNrptRule -Force", psQuote(nrptComment)))
+	return err
+}
+
+func powershell(cmd string) (string, error) {
+	out, err := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", cmd).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%w, %s", err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -20,6 +20,10 @@
 package tools
 
 import (
+	"os"
+	"path/filepath"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/mlog"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -107,3 +111,53 @@ plugins:
 
 	return v.WriteConfigAs(out)
 }
+
+func newGraphCmd() *cobra.Command {
+	var (
+		in     string
+		out    string
+		format string
+	)
+	c := &cobra.Command{
+		Use:   "graph -c config_file [-o output] [-f dot|mermaid]",
+		Args:  cobra.NoArgs,
+		Short: "Render the graph of plugins, sequences and upstream groups of a config as DOT or Mermaid.",
+		Long: "Render the graph of plugins, sequences and upstream groups of a config as DOT or Mermaid. " +
+			"If format is omitted, it's mermaid for outputs with .mmd or .md extension, otherwise dot. " +
+			"Plugins are not initialized.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := graphCfg(in, out, format); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&in, "config", "c", "", "config file")
+	c.Flags().StringVarP(&out, "out", "o", "", "output file, default is stdout")
+	c.Flags().StringVarP(&format, "format", "f", "", "dot or mermaid")
+	c.MarkFlagRequired("config")
+	c.MarkFlagFilename("config")
+	c.MarkFlagFilename("out")
+	return c
+}
+
+func graphCfg(in, out, format string) error {
+	if len(format) == 0 {
+		format = coremain.GraphFormatDOT
+		if ext := filepath.Ext(out); ext == ".mmd" || ext == ".md" {
+			format = coremain.GraphFormatMermaid
+		}
+	}
+	if len(out) == 0 {
+		return coremain.WriteConfigGraph(in, format, os.Stdout)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := coremain.WriteConfigGraph(in, format, f); err != nil {
+		return err
+	}
+	return f.Close()
+}
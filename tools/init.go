@@ -40,6 +40,6 @@ func init() {
 		Use:   "config",
 		Short: "Tools that can generate/convert mosdns config file.",
 	}
-	configCmd.AddCommand(newGenCmd(), newConvCmd())
+	configCmd.AddCommand(newGenCmd(), newConvCmd(), newGraphCmd())
 	coremain.AddSubCmd(configCmd)
 }